@@ -0,0 +1,106 @@
+// Package buildinfo 构建元数据及运行环境能力报告，命令行 -version 与桌面端共用
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+)
+
+// 构建时通过 -ldflags 注入，例如:
+//
+//	go build -ldflags "-X github.com/atticus6/echPlus/apps/client/buildinfo.Version=1.2.0 \
+//	  -X github.com/atticus6/echPlus/apps/client/buildinfo.Commit=abc1234 \
+//	  -X github.com/atticus6/echPlus/apps/client/buildinfo.Date=2024-01-01T00:00:00Z"
+//
+// 未注入 Commit、Date 时从 Go 记录的 VCS 信息中读取
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info 构建元数据及运行环境能力
+type Info struct {
+	Version      string `json:"version"`
+	Commit       string `json:"commit"`
+	Date         string `json:"date"`
+	GoVersion    string `json:"goVersion"`
+	Platform     string `json:"platform"` // GOOS/GOARCH
+	CoreAPI      string `json:"coreApi"`  // core 公开 API 版本
+	ECHSupported bool   `json:"echSupported"`
+	ECHError     string `json:"echError,omitempty"` // 不支持 ECH 的原因
+}
+
+// Get 返回当前程序的构建信息
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		CoreAPI:   core.Version,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+	}
+	if len(info.Commit) > 12 {
+		info.Commit = info.Commit[:12]
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.Date == "" {
+		info.Date = "unknown"
+	}
+
+	if err := core.CheckECHSupport(); err != nil {
+		info.ECHError = err.Error()
+	} else {
+		info.ECHSupported = true
+	}
+	return info
+}
+
+// ModuleVersion 返回编译进程序的依赖模块版本，未找到时返回 "unknown"
+func ModuleVersion(path string) string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path == path {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// String 返回多行的构建信息报告，用于 -version 输出和问题反馈
+func (i Info) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "版本:     %s\n", i.Version)
+	fmt.Fprintf(&b, "提交:     %s\n", i.Commit)
+	fmt.Fprintf(&b, "构建时间: %s\n", i.Date)
+	fmt.Fprintf(&b, "Go 版本:  %s\n", i.GoVersion)
+	fmt.Fprintf(&b, "平台:     %s\n", i.Platform)
+	fmt.Fprintf(&b, "Core API: %s\n", i.CoreAPI)
+	if i.ECHSupported {
+		b.WriteString("ECH:      支持\n")
+	} else {
+		fmt.Fprintf(&b, "ECH:      不支持 (%s)\n", i.ECHError)
+	}
+	return b.String()
+}
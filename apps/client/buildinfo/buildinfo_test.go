@@ -0,0 +1,99 @@
+package buildinfo
+
+import (
+	"crypto/tls"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+)
+
+// setLdflags 模拟 -ldflags 注入的值，测试结束后恢复
+func setLdflags(t *testing.T, version, commit, date string) {
+	t.Helper()
+	oldVersion, oldCommit, oldDate := Version, Commit, Date
+	t.Cleanup(func() { Version, Commit, Date = oldVersion, oldCommit, oldDate })
+	Version, Commit, Date = version, commit, date
+}
+
+// TestECHCapability ECHSupported 与 setECHConfig 实际设置的 tls.Config 字段在当前 Go 版本上的情况一致
+func TestECHCapability(t *testing.T) {
+	config := reflect.ValueOf(&tls.Config{}).Elem()
+	settable := true
+	for _, name := range []string{"EncryptedClientHelloConfigList", "EncryptedClientHelloRejectionVerify"} {
+		if f := config.FieldByName(name); !f.IsValid() || !f.CanSet() {
+			settable = false
+		}
+	}
+
+	info := Get()
+	if info.ECHSupported != settable {
+		t.Fatalf("ECHSupported = %v on %s, but the ECH fields of tls.Config settable = %v", info.ECHSupported, runtime.Version(), settable)
+	}
+	if info.ECHSupported != (info.ECHError == "") {
+		t.Fatalf("ECHSupported = %v with ECHError %q", info.ECHSupported, info.ECHError)
+	}
+	if info.GoVersion != runtime.Version() || info.Platform != runtime.GOOS+"/"+runtime.GOARCH || info.CoreAPI != core.Version {
+		t.Fatalf("runtime fields = %+v", info)
+	}
+}
+
+// TestGetLdflags 注入的 Version、Commit、Date 原样报告，Commit 截短为 12 位；未注入时不为空
+func TestGetLdflags(t *testing.T) {
+	t.Run("injected", func(t *testing.T) {
+		setLdflags(t, "1.2.0", "0123456789abcdef0123", "2024-01-01T00:00:00Z")
+		info := Get()
+		if info.Version != "1.2.0" || info.Commit != "0123456789ab" || info.Date != "2024-01-01T00:00:00Z" {
+			t.Fatalf("Get() = %+v, want the injected values with a 12-character commit", info)
+		}
+	})
+	t.Run("defaults", func(t *testing.T) {
+		setLdflags(t, "dev", "", "")
+		info := Get()
+		if info.Version != "dev" || info.Commit == "" || len(info.Commit) > 12 || info.Date == "" {
+			t.Fatalf("Get() = %+v, want dev with the VCS values or unknown", info)
+		}
+	})
+}
+
+// TestInfoString 多行报告的格式，不支持 ECH 时附带原因
+func TestInfoString(t *testing.T) {
+	info := Info{
+		Version:      "1.2.0",
+		Commit:       "0123456789ab",
+		Date:         "2024-01-01T00:00:00Z",
+		GoVersion:    "go1.24.0",
+		Platform:     "linux/amd64",
+		CoreAPI:      "1.42",
+		ECHSupported: true,
+	}
+	want := strings.Join([]string{
+		"版本:     1.2.0",
+		"提交:     0123456789ab",
+		"构建时间: 2024-01-01T00:00:00Z",
+		"Go 版本:  go1.24.0",
+		"平台:     linux/amd64",
+		"Core API: 1.42",
+		"ECH:      支持",
+	}, "\n") + "\n"
+	if got := info.String(); got != want {
+		t.Fatalf("String() =\n%s\nwant\n%s", got, want)
+	}
+
+	info = Info{Version: "dev", Commit: "unknown", Date: "unknown", GoVersion: "go1.22.0", Platform: "windows/arm64", CoreAPI: "1.42",
+		ECHError: "当前构建的 Go/TLS 不支持 ECH"}
+	want = strings.Join([]string{
+		"版本:     dev",
+		"提交:     unknown",
+		"构建时间: unknown",
+		"Go 版本:  go1.22.0",
+		"平台:     windows/arm64",
+		"Core API: 1.42",
+		"ECH:      不支持 (当前构建的 Go/TLS 不支持 ECH)",
+	}, "\n") + "\n"
+	if got := info.String(); got != want {
+		t.Fatalf("String() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+)
+
+// subcommand 非交互的子命令，用法为 client [参数] <子命令> [子命令参数]。
+// 子命令之前的全局参数（如 -dns、-routing、-upstream-proxy）对子命令同样生效，结果输出到标准输出，失败时以状态码 1 退出
+type subcommand struct {
+	name  string
+	args  string
+	usage string
+	run   func(storeDir string, args []string) error
+}
+
+var subcommands = []subcommand{
+	{"pin", "-f <服务端地址> [-ip IP]", "输出服务端证书链的公钥固定值，供 -pin-spki 使用", func(_ string, args []string) error {
+		runPin(args)
+		return nil
+	}},
+	{"node", "add <链接>... | list | remove <名称>... | test [名称或链接]...", "管理保存在存储目录的节点，-node 可使用保存的名称", runNode},
+	{"route", "test <主机>...", "按 -routing 等参数判断访问各主机时直连还是经代理", runRoute},
+	{"stats", "[reset]", "查看或重置保存的流量统计，代理运行时重置会被其保存的数据覆盖", runStats},
+	{"flush", "", "删除已下载的中国 IP 列表，下次以 bypass_cn 启动时重新下载", runFlush},
+}
+
+// runSubcommand 执行 args[0] 指定的子命令，失败时退出进程
+func runSubcommand(storeDir string, args []string) {
+	if args[0] == "help" {
+		printUsage()
+		return
+	}
+	for _, c := range subcommands {
+		if c.name == args[0] {
+			if err := c.run(storeDir, args[1:]); err != nil {
+				log.Fatalf("[%s] %v", c.name, err)
+			}
+			return
+		}
+	}
+	log.Fatalf("未知的子命令 %q，用 -h 查看用法", args[0])
+}
+
+// printUsage 输出用法，包括子命令和全局参数
+func printUsage() {
+	out := flag.CommandLine.Output()
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(out, "用法:\n  %s [参数]                         运行代理\n  %s [参数] <子命令> [子命令参数]   执行一次操作后退出\n\n子命令:\n", name, name)
+	for _, c := range subcommands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", strings.TrimSpace(c.name+" "+c.args), c.usage)
+	}
+	fmt.Fprintln(out, "\n参数:")
+	flag.PrintDefaults()
+}
+
+// runRoute 实现 route test 子命令：逐个输出主机、分流结果（直连或代理）和原因，以制表符分隔
+func runRoute(storeDir string, args []string) error {
+	if len(args) < 2 || args[0] != "test" {
+		return errors.New("用法: route test <主机>...")
+	}
+	cfg, _, err := buildConfig(storeDir)
+	if err != nil {
+		return err
+	}
+	for _, host := range args[1:] {
+		d := core.TestRoute(cfg, host)
+		route := "代理"
+		if d.Direct {
+			route = "直连"
+		}
+		fmt.Printf("%s\t%s\t%s\n", d.Host, route, d.Reason)
+	}
+	return nil
+}
+
+// runStats 实现 stats 子命令：输出存储目录中保存的流量统计，reset 清空后保存
+func runStats(storeDir string, args []string) error {
+	stats := core.NewTrafficStats(storeDir)
+	switch {
+	case len(args) == 0:
+		fmt.Print(stats.PrintStats())
+	case args[0] == "reset":
+		stats.Reset()
+		if err := stats.Save(); err != nil {
+			return fmt.Errorf("保存失败: %w", err)
+		}
+		fmt.Println("流量统计已重置")
+	default:
+		return errors.New("用法: stats [reset]")
+	}
+	return nil
+}
+
+// routingFiles bypass_cn 模式下载到存储目录的分流数据文件，与 core 中的文件名一致
+var routingFiles = []string{"chn_ip.txt", "chn_ip_v6.txt"}
+
+// runFlush 实现 flush 子命令：删除已下载的分流数据文件。其他缓存只在代理进程内，运行中时用交互命令 flush 清空
+func runFlush(storeDir string, args []string) error {
+	if len(args) > 0 {
+		return errors.New("用法: flush")
+	}
+	for _, name := range routingFiles {
+		path := filepath.Join(storeDir, name)
+		switch err := os.Remove(path); {
+		case err == nil:
+			fmt.Printf("已删除 %s\n", path)
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		}
+	}
+	return nil
+}
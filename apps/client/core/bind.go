@@ -0,0 +1,55 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// SOCKS5 BIND（命令 0x02）总是经服务端：服务端监听并告知地址（BOUND），对端连入后回复 CONNECTED，
+// 之后与 CONNECT 相同地转发。直连分流和 FallbackDirect 对 BIND 不生效，需服务端启用 -bind
+const bindWaitTimeout = 90 * time.Second // 收到 BOUND 后等待对端连入的时间，略长于服务端的 60 秒
+
+// awaitBindPeer 收到 BOUND 后向客户端发送第一个 SOCKS5 应答（BND 为服务端的监听地址），
+// 再等待服务端报告对端连入，返回随后的 CONNECTED 或 ERROR 帧。ctx 取消（如服务器停止）时立即放弃等待
+func (s *ProxyServer) awaitBindPeer(ctx context.Context, conn net.Conn, ws *websocket.Conn, codec protocol.Codec, bound string) (protocol.Frame, error) {
+	if err := writeSOCKS5Reply(conn, 0x00, bound); err != nil {
+		return protocol.Frame{}, err
+	}
+	deadline := time.Now().Add(bindWaitTimeout)
+	conn.SetDeadline(deadline)
+	ws.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { ws.SetReadDeadline(time.Now()) })
+	defer stop()
+	mt, msg, err := ws.ReadMessage()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	return codec.Decode(mt, msg)
+}
+
+// writeSOCKS5Reply 发送 SOCKS5 应答，addr 为 BND.ADDR:BND.PORT，非 IP 的主机按域名发送，无法解析时为 0.0.0.0:0
+func writeSOCKS5Reply(conn net.Conn, rep byte, addr string) error {
+	reply := []byte{0x05, rep, 0x00}
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil && host != "" && len(host) <= 255:
+		reply = append(append(reply, 0x03, byte(len(host))), host...)
+	case ip.To4() != nil:
+		reply = append(append(reply, 0x01), ip.To4()...)
+	case ip != nil:
+		reply = append(append(reply, 0x04), ip.To16()...)
+	default:
+		reply = append(reply, 0x01, 0, 0, 0, 0)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := conn.Write(reply)
+	return err
+}
@@ -0,0 +1,14 @@
+package core
+
+import "sync"
+
+// relayBuffers 转发数据使用的 readBufferSize 大小的缓冲区，连接结束后放回复用
+var relayBuffers = sync.Pool{New: func() any { return new([readBufferSize]byte) }}
+
+func getRelayBuffer() *[readBufferSize]byte {
+	return relayBuffers.Get().(*[readBufferSize]byte)
+}
+
+func putRelayBuffer(buf *[readBufferSize]byte) {
+	relayBuffers.Put(buf)
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch 服务端证书的公钥与 Config.PinnedSPKI 均不匹配，握手已中止
+var ErrPinMismatch = errors.New("服务端证书公钥与固定的公钥不匹配")
+
+// spkiPinPrefix 公钥固定值的可选前缀，与 HPKP 的写法相同
+const spkiPinPrefix = "sha256/"
+
+// SPKIPin 返回证书的公钥固定值：SubjectPublicKeyInfo 的 SHA-256，标准 base64 编码
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parseSPKIPins 校验并规范化公钥固定值，去掉 "sha256/" 前缀和空白
+func parseSPKIPins(pins []string) (map[string]bool, error) {
+	if len(pins) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), spkiPinPrefix)
+		sum, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("无效的公钥固定值 %q: 应为 SHA-256 的 base64 编码", pin)
+		}
+		set[pin] = true
+	}
+	return set, nil
+}
+
+// verifySPKIPins 返回 tls.Config.VerifyPeerCertificate，在系统根证书验证通过后检查公钥固定值。
+// anyChain 为 false 时只检查服务端证书，为 true 时验证出的证书链中任一证书匹配即可
+func verifySPKIPins(pins map[string]bool, anyChain bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 {
+			return fmt.Errorf("%w: 没有已验证的证书链", ErrPinMismatch)
+		}
+		leaf := chains[0][0]
+		for _, chain := range chains {
+			for i, cert := range chain {
+				if i > 0 && !anyChain {
+					break
+				}
+				if pins[SPKIPin(cert)] {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("%w: %s 的公钥为 %s%s", ErrPinMismatch, leaf.Subject, spkiPinPrefix, SPKIPin(leaf))
+	}
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// CloseReason 连接结束的原因
+type CloseReason string
+
+const (
+	CloseClient  CloseReason = "client_closed" // 本地客户端关闭连接
+	CloseRemote  CloseReason = "remote_closed" // 目标或服务端关闭连接
+	CloseError   CloseReason = "error"         // 读写或建立连接出错
+	CloseTimeout CloseReason = "timeout"       // 建立阶段或读写超时
+	CloseIdle    CloseReason = "idle"          // 空闲超时
+	CloseStopped CloseReason = "stopped"       // 代理停止、重启或暂停时关闭
+	CloseKilled  CloseReason = "killed"        // 由 CloseConnection 手动关闭
+)
+
+// closeReasonFor 由读写错误得出关闭原因，side 为读到 EOF 或正常关闭时归属的一方
+func closeReasonFor(side CloseReason, err error) CloseReason {
+	var netErr net.Error
+	switch {
+	case err == nil || isNormalCloseError(err):
+		return side
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseTimeout
+	default:
+		return CloseError
+	}
+}
+
+// connCloser 转发结束信号，只保留第一次关闭的原因
+type connCloser struct {
+	done   chan struct{}
+	once   sync.Once
+	reason CloseReason
+}
+
+func newConnCloser() *connCloser {
+	return &connCloser{done: make(chan struct{})}
+}
+
+// close 以 reason 结束转发，重复调用时忽略
+func (c *connCloser) close(reason CloseReason) {
+	c.once.Do(func() {
+		c.reason = reason
+		close(c.done)
+	})
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// 上传方向合并小块数据的参数
+const (
+	defaultCoalesceDelay = time.Millisecond
+	coalesceThreshold    = 4096 // 一次读到的数据不少于该值时直接发送
+)
+
+// uploadCoalesceDelay 返回生效的合并等待时间，为 0 时使用默认值，返回 0 表示不合并
+func uploadCoalesceDelay(cfg Config) time.Duration {
+	switch {
+	case cfg.UploadCoalesceDelay < 0:
+		return 0
+	case cfg.UploadCoalesceDelay == 0:
+		return defaultCoalesceDelay
+	}
+	return cfg.UploadCoalesceDelay
+}
+
+// coalescingReader 读取客户端上传的数据。一次读到的数据少于 coalesceThreshold 时，
+// 在 delay 内继续读取并追加到同一缓冲区，交互式流量的多个小包合并为一个 WebSocket 消息，
+// 减少帧开销和写入次数。等待期间读到的错误在返回已读数据之后的下一次 Read 返回。
+// 合并时使用 conn 的读截止时间，结束后清除，只能在不设截止时间的转发阶段使用
+type coalescingReader struct {
+	conn  net.Conn
+	delay time.Duration
+	err   error
+}
+
+func (r *coalescingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		err := r.err
+		r.err = nil
+		return 0, err
+	}
+	n, err := r.conn.Read(p)
+	if err != nil || r.delay <= 0 || n >= coalesceThreshold || n == len(p) {
+		return n, err
+	}
+	r.conn.SetReadDeadline(time.Now().Add(r.delay))
+	defer r.conn.SetReadDeadline(time.Time{})
+	for n < coalesceThreshold && n < len(p) {
+		m, err := r.conn.Read(p[n:])
+		n += m
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				r.err = err
+			}
+			break
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,27 @@
+package core
+
+import (
+	"net"
+	"slices"
+	"strconv"
+)
+
+// tlsPorts 常见的 TLS 服务端口，此类流量已加密，压缩只会增加 CPU 开销
+var tlsPorts = []int{443, 465, 563, 636, 853, 989, 990, 993, 995, 5061, 8443}
+
+// tunnelCompression 判断转发到 target（host:port）的隧道是否协商 permessage-deflate：
+// 未启用 Compression 时不压缩；设置了 CompressPorts 时只压缩其中的端口；
+// 否则除 tlsPorts 外都压缩。target 无法解析出端口时只在未设置 CompressPorts 时压缩
+func tunnelCompression(cfg Config, target string) bool {
+	if !cfg.Compression {
+		return false
+	}
+	port := 0
+	if _, p, err := net.SplitHostPort(target); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+	if len(cfg.CompressPorts) > 0 {
+		return slices.Contains(cfg.CompressPorts, port)
+	}
+	return !slices.Contains(tlsPorts, port)
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 默认停止时等待连接优雅关闭的时间
+const defaultDrainTimeout = 5 * time.Second
+
+// trackedConn 已接受的客户端连接及其上游连接（WebSocket 或直连目标）
+type trackedConn struct {
+	conn     net.Conn
+	mu       sync.Mutex
+	upstream io.Closer
+	headers  map[string]string // 上游升级响应的诊断头部
+	stats    *connStats        // 解析出目标后由 handleTunnel 关联
+	killed   bool              // 已由 CloseConnection 关闭
+	done     chan struct{}     // untrackConn 注销时关闭
+
+	phase         connPhase // 当前阶段及其截止时间，用于记录超时发生在哪个阶段
+	phaseDeadline time.Time
+}
+
+// setUpstream 关联上游连接，强制关闭时一并关闭
+func (tc *trackedConn) setUpstream(upstream io.Closer) {
+	tc.mu.Lock()
+	tc.upstream = upstream
+	tc.mu.Unlock()
+}
+
+// forceClose 强制关闭客户端连接和上游连接
+func (tc *trackedConn) forceClose() {
+	tc.conn.Close()
+	tc.mu.Lock()
+	upstream := tc.upstream
+	tc.mu.Unlock()
+	if upstream != nil {
+		upstream.Close()
+	}
+}
+
+// trackedKey 返回登记时使用的客户端连接。普通 HTTP 代理的隧道读写的是管道，
+// 管道一端通过 clientConn 指向所属的客户端连接
+func trackedKey(conn net.Conn) net.Conn {
+	if c, ok := conn.(interface{ clientConn() net.Conn }); ok {
+		return c.clientConn()
+	}
+	return conn
+}
+
+// trackConn 登记新接受的连接，调用方需在处理结束后调用 untrackConn
+func (s *ProxyServer) trackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*trackedConn)
+	}
+	s.conns[conn] = &trackedConn{conn: conn, done: make(chan struct{})}
+	s.connWg.Add(1)
+}
+
+// untrackConn 注销连接
+func (s *ProxyServer) untrackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if tc, ok := s.conns[conn]; ok {
+		delete(s.conns, conn)
+		close(tc.done)
+		s.connWg.Done()
+	}
+}
+
+// attachUpstream 为已登记的客户端连接关联上游连接
+func (s *ProxyServer) attachUpstream(conn net.Conn, upstream io.Closer) {
+	s.connsMu.Lock()
+	tc := s.conns[trackedKey(conn)]
+	s.connsMu.Unlock()
+	if tc != nil {
+		tc.setUpstream(upstream)
+	}
+}
+
+// setUpstreamHeaders 记录连接所用上游的诊断头部
+func (s *ProxyServer) setUpstreamHeaders(conn net.Conn, headers map[string]string) {
+	s.connsMu.Lock()
+	tc := s.conns[trackedKey(conn)]
+	s.connsMu.Unlock()
+	if tc != nil {
+		tc.mu.Lock()
+		tc.headers = headers
+		tc.mu.Unlock()
+	}
+}
+
+// connKilled 连接是否已由 CloseConnection 关闭
+func (s *ProxyServer) connKilled(conn net.Conn) bool {
+	s.connsMu.Lock()
+	tc := s.conns[trackedKey(conn)]
+	s.connsMu.Unlock()
+	if tc == nil {
+		return false
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.killed
+}
+
+// connCount 返回当前跟踪的连接数
+func (s *ProxyServer) connCount() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return len(s.conns)
+}
+
+// trackedConns 返回当前跟踪中的连接
+func (s *ProxyServer) trackedConns() []*trackedConn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	conns := make([]*trackedConn, 0, len(s.conns))
+	for _, tc := range s.conns {
+		conns = append(conns, tc)
+	}
+	return conns
+}
+
+// closeAllConns 强制关闭所有跟踪中的连接
+func (s *ProxyServer) closeAllConns() {
+	for _, tc := range s.trackedConns() {
+		tc.forceClose()
+	}
+}
+
+// drainTrackedConns 等待 conns 在 timeout 内自行结束，超时后强制关闭其中仍未结束的连接。
+// 只处理 conns 中的连接，之后接受的连接不受影响，因此可以在监听继续接受连接时调用
+func drainTrackedConns(conns []*trackedConn, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for i, tc := range conns {
+		select {
+		case <-tc.done:
+			continue
+		case <-timer.C:
+		}
+		var remaining []*trackedConn
+		for _, tc := range conns[i:] {
+			select {
+			case <-tc.done:
+			default:
+				remaining = append(remaining, tc)
+			}
+		}
+		LogInfo("[代理] 等待连接关闭超时，强制关闭 %d 个连接", len(remaining))
+		for _, tc := range remaining {
+			tc.forceClose()
+		}
+		return
+	}
+}
+
+// drainConns 等待所有连接在 timeout 内自行结束，超时后强制关闭
+func (s *ProxyServer) drainConns(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	drained := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return
+	case <-time.After(timeout):
+	}
+	LogInfo("[代理] 等待连接关闭超时，强制关闭 %d 个连接", s.connCount())
+	s.closeAllConns()
+	<-drained
+}
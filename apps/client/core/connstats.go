@@ -0,0 +1,171 @@
+package core
+
+import (
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeSampleSize 计算建立耗时分位数保留的最近样本数
+const handshakeSampleSize = 256
+
+// ActiveConnection 正在处理的连接
+type ActiveConnection struct {
+	ConnID        uint64        `json:"connId"`
+	ClientAddr    string        `json:"clientAddr"`
+	Target        string        `json:"target"`
+	Direct        bool          `json:"direct"`
+	StartedAt     time.Time     `json:"startedAt"`
+	HandshakeTime time.Duration `json:"handshakeTime"` // 建立耗时（纳秒），尚未建立完成时为 0，见 ConnectionRecord
+	Upload        int64         `json:"upload"`        // 已上传字节数
+	Download      int64         `json:"download"`      // 已下载字节数
+	Throughput    int64         `json:"throughput"`    // 转发阶段至今的平均吞吐量（字节/秒，上传与下载之和）
+}
+
+// HandshakeStats 最近建立隧道耗时的分位数，不含直连
+type HandshakeStats struct {
+	Samples int           `json:"samples"` // 样本数，最多保留最近 256 次
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+}
+
+// connStats 一个连接的建立耗时和转发字节数，由 handleTunnel 更新，
+// 活动连接和连接结束后的 ConnectionRecord 均从这里读取。时间使用 time.Now 的单调时钟读数计算
+type connStats struct {
+	connID     uint64
+	clientAddr string
+	target     string
+	startedAt  time.Time
+
+	upload, download atomic.Int64
+
+	mu            sync.Mutex
+	direct        bool
+	handshake     time.Duration
+	establishedAt time.Time // 进入转发阶段的时间，零值表示尚未建立
+}
+
+// newConnStats 创建连接的统计并关联到已登记的客户端连接，供 GetActiveConnections 读取
+func (s *ProxyServer) newConnStats(conn net.Conn, connID uint64, clientAddr, target string, direct bool, startedAt time.Time) *connStats {
+	st := &connStats{connID: connID, clientAddr: clientAddr, target: target, startedAt: startedAt, direct: direct}
+	s.connsMu.Lock()
+	tc := s.conns[trackedKey(conn)]
+	s.connsMu.Unlock()
+	if tc != nil {
+		tc.mu.Lock()
+		tc.stats = st
+		tc.mu.Unlock()
+	}
+	return st
+}
+
+// setDirect 服务端不可用降级为直连时更新
+func (st *connStats) setDirect() {
+	st.mu.Lock()
+	st.direct = true
+	st.mu.Unlock()
+}
+
+// established 记录建立耗时，之后进入转发阶段
+func (st *connStats) established(handshake time.Duration) {
+	st.mu.Lock()
+	st.handshake = handshake
+	st.establishedAt = time.Now()
+	st.mu.Unlock()
+}
+
+func (st *connStats) addUpload(n int64)   { st.upload.Add(n) }
+func (st *connStats) addDownload(n int64) { st.download.Add(n) }
+
+// snapshot 返回截至 now 的统计
+func (st *connStats) snapshot(now time.Time) ActiveConnection {
+	st.mu.Lock()
+	direct, handshake, establishedAt := st.direct, st.handshake, st.establishedAt
+	st.mu.Unlock()
+	c := ActiveConnection{
+		ConnID:        st.connID,
+		ClientAddr:    st.clientAddr,
+		Target:        st.target,
+		Direct:        direct,
+		StartedAt:     st.startedAt,
+		HandshakeTime: handshake,
+		Upload:        st.upload.Load(),
+		Download:      st.download.Load(),
+	}
+	if !establishedAt.IsZero() {
+		if elapsed := now.Sub(establishedAt); elapsed > 0 {
+			c.Throughput = int64(float64(c.Upload+c.Download) / elapsed.Seconds())
+		}
+	}
+	return c
+}
+
+// GetActiveConnections 获取正在处理的连接，按开始时间从旧到新排列。
+// 仍在进行本地握手（尚未解析出目标）的连接不包含在内
+func (s *ProxyServer) GetActiveConnections() []ActiveConnection {
+	s.connsMu.Lock()
+	stats := make([]*connStats, 0, len(s.conns))
+	for _, tc := range s.conns {
+		tc.mu.Lock()
+		if tc.stats != nil {
+			stats = append(stats, tc.stats)
+		}
+		tc.mu.Unlock()
+	}
+	s.connsMu.Unlock()
+
+	now := time.Now()
+	conns := make([]ActiveConnection, len(stats))
+	for i, st := range stats {
+		conns[i] = st.snapshot(now)
+	}
+	slices.SortFunc(conns, func(a, b ActiveConnection) int { return a.StartedAt.Compare(b.StartedAt) })
+	return conns
+}
+
+// CloseConnection 强制关闭 ConnID 为 id 的活动连接（见 GetActiveConnections）及其上游连接，
+// 连接记录的关闭原因为 CloseKilled。连接不存在或已结束时返回 false
+func (s *ProxyServer) CloseConnection(id uint64) bool {
+	s.connsMu.Lock()
+	var target *trackedConn
+	for _, tc := range s.conns {
+		tc.mu.Lock()
+		if tc.stats != nil && tc.stats.connID == id {
+			target = tc
+			tc.killed = true
+		}
+		tc.mu.Unlock()
+		if target != nil {
+			break
+		}
+	}
+	s.connsMu.Unlock()
+	if target == nil {
+		return false
+	}
+	target.forceClose()
+	return true
+}
+
+// GetHandshakeStats 获取最近建立隧道耗时的 p50、p95
+func (s *ProxyServer) GetHandshakeStats() HandshakeStats {
+	samples := s.history.handshakes.Snapshot()
+	if len(samples) == 0 {
+		return HandshakeStats{}
+	}
+	slices.Sort(samples)
+	return HandshakeStats{
+		Samples: len(samples),
+		P50:     percentile(samples, 0.50),
+		P95:     percentile(samples, 0.95),
+	}
+}
+
+// percentile 按最近秩法返回已排序样本的 p 分位数
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
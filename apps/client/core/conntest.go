@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestConnection 按 cfg 的连接设置（ServerAddr、Token、ServerIP、ECH、UpstreamProxy 等）向第一个服务端建立一次 WebSocket 后立即关闭，
+// 返回建立耗时，用于保存节点前发现地址、令牌或服务端 IP 填写错误。不监听端口、不启动后台任务，也不读写流量统计，
+// 可在代理运行时调用。配置无效、获取 ECH 配置失败（RequireECH 为 true 时）或连接失败时返回错误，
+// 连接最多等待 DialTimeout + TLSHandshakeTimeout
+func TestConnection(ctx context.Context, cfg Config) (time.Duration, error) {
+	if err := validateConfig(cfg); err != nil {
+		return 0, err
+	}
+	servers := serverAddrs(cfg.ServerAddr)
+	if len(servers) == 0 {
+		return 0, errors.New("未设置服务端地址")
+	}
+	s := newDetachedServer(cfg)
+	if err := s.setupECH(); err != nil {
+		return 0, err
+	}
+	s.resetServerIPs(cfg)
+
+	server := servers[0]
+	dialCtx, cancel := context.WithTimeout(ctx, s.dialTimeout()+s.tlsHandshakeTimeout())
+	defer cancel()
+	start := time.Now()
+	wsConn, _, err := s.dialWebSocket(dialCtx, server, "")
+	if err != nil {
+		return 0, fmt.Errorf("连接 %s 失败: %w", server, err)
+	}
+	elapsed := time.Since(start)
+	wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	wsConn.Close()
+	return elapsed, nil
+}
+
+// TestRoute 按 cfg 的分流设置判断访问 host（可带端口）时直连还是经代理，不启动代理。bypass_cn 模式下先加载中国 IP 列表，
+// StoreDir 中没有时下载，加载失败时按未加载列表判断；域名按系统 DNS 解析后判断。按应用分流的规则需要来源连接，不参与判断
+func TestRoute(cfg Config, host string) RouteDecision {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	s := newDetachedServer(cfg)
+	if err := s.loadRoutingData(); err != nil {
+		LogError("[警告] 加载分流数据失败: %v", err)
+	}
+	direct, reason, _ := s.routeDecision(cfg, nil, host)
+	return RouteDecision{Time: time.Now(), Host: host, Direct: direct, Reason: reason}
+}
+
+// newDetachedServer 创建只用于 TestConnection、TestRoute 的 ProxyServer：不监听、不读写流量统计，也不启动后台任务
+func newDetachedServer(cfg Config) *ProxyServer {
+	return &ProxyServer{
+		config:    normalizeConfig(cfg),
+		history:   newHistory(cfg),
+		dnsPins:   newDNSPins(),
+		serverIPs: newServerIPSet(),
+		health:    Health{Healthy: true},
+	}
+}
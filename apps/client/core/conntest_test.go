@@ -0,0 +1,27 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRouteCheck TestRoute 不启动代理即按分流设置判断，主机可带端口，局域网地址总是直连
+func TestRouteCheck(t *testing.T) {
+	cfg := testConfig(t)
+	for _, tc := range []struct {
+		mode   RoutingMode
+		host   string
+		direct bool
+		reason string
+	}{
+		{RoutingModeGlobal, "example.com:443", false, "全局代理"},
+		{RoutingModeGlobal, "192.168.1.10", true, "局域网地址"},
+		{RoutingModeNone, "example.com", true, "直连模式"},
+	} {
+		cfg.RoutingMode = tc.mode
+		d := TestRoute(cfg, tc.host)
+		if d.Direct != tc.direct || d.Reason != tc.reason || strings.Contains(d.Host, ":") {
+			t.Errorf("TestRoute(%s, %s) = %+v, want direct=%v reason=%q", tc.mode, tc.host, d, tc.direct, tc.reason)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -11,43 +12,284 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/atticus6/echPlus/apps/client/protocol"
 	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
 )
 
 // Config 代理客户端配置
 type Config struct {
-	ListenAddr  string
-	ServerAddr  string
-	ServerIP    string
-	Token       string
-	DNSServer   string
+	ListenAddr string
+	ServerAddr string
+	ServerIP   string
+	// FallbackServerHost ServerIP 为空且 ECH 查询域名的 HTTPS 记录中没有 ipv4hint、ipv6hint 时连接服务端使用的域名，为空时使用 www.visa.com。
+	// 应为接入同一 CDN 的常见站点，连接的目标 IP 看起来是访问该站点；TLS 的 SNI 仍由 ServerAddr 和 ECH 决定。启动时（以及 Reload 修改后）解析一次，
+	// 有多个 IP 时测速后使用最快的，解析失败时每次连接时解析。有地址提示时改为使用提示的地址（见 serverIPHints），刷新 ECH 配置后随之更新。
+	// GetConfig 返回的 ServerIP 保持为空，实际使用的地址见 GetServerIPStats
+	FallbackServerHost string
+	Token              string
+	// DNSServer 查询 ECH 配置的 DoH 服务器，逗号分隔多个时从最近一次成功的开始依次尝试，不可达或出错时使用下一个。
+	// 每个的格式为 [https://]主机[:端口][@IP][/路径]，如 dns.alidns.com@223.5.5.5/dns-query，指定 @IP 时直接连接该 IP 而不解析主机
+	DNSServer string
+	// ECHDomain 查询 ECH 配置的域名，为 ECHDomainServer 时各服务端查询自身主机名
 	ECHDomain   string
 	RoutingMode RoutingMode
 	StoreDir    string
+
+	// IPListBaseURL bypass_cn 模式下 StoreDir 中没有中国 IP 列表时下载 chn_ip.txt 和 chn_ip_v6.txt 的目录地址，
+	// 为空时从 GitHub 下载。下载失败时经 ECH 从当前服务端的 /files/ 下载，需服务端以 -files 开放这两个文件
+	IPListBaseURL string
+
+	// ServePAC 为 true 时在代理端口上提供按 RoutingMode 生成的 PAC 自动配置脚本（/proxy.pac），
+	// 地址见 PACURL；分流模式变化后重新生成
+	ServePAC bool
+
+	// DNSListenAddr 本地 DNS 服务的监听地址，如 127.0.0.1:5353，为空时不启动。UDP 接受普通 DNS 查询，
+	// 同一端口的 TCP 接受 DNS over TCP 和 DoH（http://地址/dns-query），查询经 ECH 隧道所在的服务端以 DoH 解析，
+	// 应答按 TTL 缓存。系统 DNS 指向该地址后，不经 SOCKS5 UDP ASSOCIATE 的 DNS 查询也不会明文发出
+	DNSListenAddr string
+
+	// Transparent 为 true 时 ListenAddr 作为透明代理监听（仅 Linux），用于配合 iptables REDIRECT 转发所有出站 TCP：
+	// 不再识别 SOCKS5/HTTP，而是通过 SO_ORIGINAL_DST 读取重定向前的目标地址作为 CONNECT 目标，
+	// 目标只有 IP，按 IP 分流。修改后对新连接生效
+	Transparent bool
+
+	// RequireECH 为 true 时无法获取 ECH 配置则拒绝启动；为 false 时降级为普通 TLS，
+	// ServerAddr 以 ws:// 开头时不加密（仅用于本地调试和测试）
+	RequireECH bool
+
+	// ECHPublicName ECH 配置中公开名称 (public_name) 的预期值，为空时不检查。
+	// 启用 ECH 时内层 ClientHello 以服务端主机名（ServerAddr 中的主机）为 SNI 并整体加密，
+	// 外层 ClientHello 以公开名称为 SNI 明文发送；公开名称由 ECHDomain 的 HTTPS 记录中的 ECH 配置决定，
+	// 如 Cloudflare 为 cloudflare-ech.com。使用其他 ECH 提供方时设置此项，获取到的配置不一致时报错且不使用
+	ECHPublicName string
+
+	// ECHCacheMaxAge 每次查询成功后 ECH 配置写入 StoreDir 中的 ech_cache.json，尚未加载配置（如启动时）而 DoH 查询失败时，
+	// 使用获取时间在该时长以内的缓存，之后的刷新成功时替换。0 使用默认的 7 天，负数表示不读写缓存
+	ECHCacheMaxAge time.Duration
+
+	// ECHRefreshInterval 后台重新查询全部 ECH 配置的间隔，服务端轮换 ECH 密钥后不必等到连接被拒绝才刷新。
+	// 实际间隔在 ±10% 内随机抖动，失败后从 1 分钟开始退避重试。0 使用默认的 1 小时，负数表示只在连接被拒绝时刷新，
+	// 见 GetECHStatus
+	ECHRefreshInterval time.Duration
+
+	// ServerIPProbeInterval ServerIP 有多个候选地址时重新测速的间隔，0 使用默认的 10 分钟，
+	// 负数表示只在启动和连续连接失败后测速，见 GetServerIPStats
+	ServerIPProbeInterval time.Duration
+
+	// UpstreamProxy 连接服务端（隧道、ServerIP 测速）和 DoH 服务器时经过的代理，用于只能经公司代理等出网的环境，
+	// 如 socks5://127.0.0.1:7890、http://用户名:密码@proxy:3128。http 代理使用 CONNECT，
+	// URL 中的用户名和密码用于代理认证。为空时使用环境变量 HTTPS_PROXY（未设置时 HTTP_PROXY）和 NO_PROXY，
+	// 下载 IP 列表同样经过该代理；为 UpstreamProxyNone ("direct") 时总是直接连接。修改后对之后建立的连接生效
+	UpstreamProxy string
+	// UpstreamProxyDirect 为 true 时直连的 TCP 连接也经过 UpstreamProxy，目标域名由代理解析，不使用 DNSPinTTL；
+	// 默认直连不经过代理
+	UpstreamProxyDirect bool
+
+	// BalanceStrategy ServerAddr 有多个服务端时新隧道选择服务端的方式，为空时使用 BalanceFailover，
+	// 可选值见 BalanceStrategy 常量。Start 和 Reload 时校验，修改后对之后建立的隧道生效
+	BalanceStrategy BalanceStrategy
+
+	// MaxConnections 最大并发连接数，0 表示不限制。达到上限时新连接短暂排队，
+	// 仍无空位则拒绝（SOCKS5 回复 0x01，HTTP 返回 503）
+	MaxConnections int
+
+	// HostRateLimits 按目标主机限速（bytes/s），键为主机名、IP 或 *.example.com 形式的通配后缀，
+	// 同一规则下的连接共享带宽，上传和下载分别按该速率限制，直连和代理连接均生效
+	HostRateLimits map[string]int64
+
+	// TotalRateLimit 所有连接共享的总带宽（bytes/s），0 表示不限制。
+	// TotalRateLimitExemptDirect 为 true 时直连流量不计入、不受限
+	TotalRateLimit             int64
+	TotalRateLimitExemptDirect bool
+
+	// WatchNetwork 为 true 时检测网络切换（Wi-Fi、VPN 等），切换后自动清空缓存并重新获取 ECH 配置
+	WatchNetwork bool
+
+	// 连接各阶段的超时，为 0 时使用默认值，进入下一阶段时重新计时:
+	//   HandshakeTimeout 本地 SOCKS5/HTTP 握手，默认 10s
+	//   EstablishTimeout 分流决策及上游连接建立，默认 30s
+	//   IdleTimeout      建立后双向均无数据超过该时间则关闭隧道，0 表示不限制
+	HandshakeTimeout time.Duration
+	EstablishTimeout time.Duration
+	IdleTimeout      time.Duration
+
+	// 建立上游连接各步骤的超时，为 0 时使用默认值，小于 0 时 Start 和 Reload 返回错误；
+	// 建立阶段的总时间仍受 EstablishTimeout 限制:
+	//   DialTimeout         建立一个 TCP 连接（服务端、ServerIP 测速、直连目标、UpstreamProxy），默认 10s
+	//   TLSHandshakeTimeout 与服务端的 TLS 握手及 WebSocket 升级，默认 10s
+	//   DoHTimeout          一次 DoH 查询（获取 ECH 配置、经服务端解析域名），默认 10s
+	// 高延迟线路可适当调大，局域网可调小以便更快地发现失败
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	DoHTimeout          time.Duration
+
+	// AppRules 按发起连接的应用分流，匹配时优先于 RoutingMode 的按目标分流，不影响暂停和直连模式。
+	// 仅支持 Linux（/proc）和 macOS（lsof），且只能识别与客户端在同一台机器上的应用，
+	// 其他平台及局域网设备的连接按目标分流。格式见 ParseAppRules
+	AppRules []AppRule
+
+	// ResumeGrace 大于 0 时启用可恢复隧道（需服务端支持）：WebSocket 在传输中途异常断开时，
+	// 在该时间内重新连接服务端并恢复会话，本地连接不受影响；恢复失败时按原方式关闭。
+	// ResumeBufferSize 每条隧道保留的最近上传数据量，用于重发服务端未收到的部分，为 0 时使用默认值 256KB
+	ResumeGrace      time.Duration
+	ResumeBufferSize int
+
+	// PingInterval 隧道 WebSocket 的 ping 间隔，为 0 时使用默认值 10s。
+	// PongTimeout 超过该时间未收到 pong 或数据时认为连接已失效，关闭隧道并断开本地连接
+	// （启用 ResumeGrace 时先尝试恢复），为 0 时使用默认值 30s。
+	// 生效的 PingInterval 必须小于 PongTimeout，否则 Start 和 Reload 返回错误
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// DNSPinTTL 直连域名成功后记住实际连接的 IP，在该时间内直接连接该 IP 而不重新解析，
+	// 连接失败时重新解析并改用新的可用 IP；用于在可用和不可用 IP 之间轮换的 CDN。
+	// 为 0 时使用默认值 10m，小于 0 时不记住。
+	// DNSPinExclude 不记住 IP 的主机，格式同 HostRateLimits 的键；
+	// DNSPinMaxEntries 最多记住的主机数，为 0 时使用默认值 1024
+	DNSPinTTL        time.Duration
+	DNSPinExclude    []string
+	DNSPinMaxEntries int
+
+	// Resolver 直连时解析域名使用的解析器，nil 表示使用系统默认解析器。
+	// 直连和 ServerIP 为域名时同时解析 IPv6 和 IPv4 地址，按 Happy Eyeballs（RFC 8305）竞速连接
+	Resolver *net.Resolver
+
+	// PinnedSPKI 服务端证书的公钥固定值（SubjectPublicKeyInfo 的 SHA-256，base64 编码，可带 "sha256/" 前缀），
+	// 设置后证书除通过根证书验证外还须与其中之一匹配，否则握手失败并返回 ErrPinMismatch。
+	// 固定值可用 SPKIPin 或命令行 "client pin -f 服务端地址" 获取。
+	// PinAnyChainCert 为 false 时只匹配服务端证书本身，为 true 时证书链中任一证书（如中间 CA）匹配即可。
+	// 仅对 wss:// 生效
+	PinnedSPKI      []string
+	PinAnyChainCert bool
+
+	// RootCAs 验证服务端证书使用的根证书，nil 表示使用系统根证书
+	RootCAs *x509.CertPool
+
+	// Compression 为 true 时与服务端协商 permessage-deflate 压缩（需服务端启用 -compression），
+	// 协商结果见 GetUpstreamStatus 的 Sec-WebSocket-Extensions 头部。
+	// 适合 HTTP 明文、JSON 等可压缩流量；HTTPS 等已加密流量无法压缩，只会增加 CPU 开销，默认关闭
+	Compression bool
+
+	// CompressPorts 启用 Compression 时只对这些目标端口的隧道协商压缩，如 [80, 8080]。
+	// 为空时对除 443、853 等常见 TLS 端口外的所有目标压缩，见 tunnelCompression
+	CompressPorts []int
+
+	// HTTP2WebSocket 为 true 时通过 HTTP/2 扩展 CONNECT（RFC 8441）建立 WebSocket，
+	// 而不是 HTTP/1.1 升级；wss:// 经 ALPN 协商 h2，ws:// 直接使用 h2c。
+	// 需服务端启用 -h2c 或前置代理支持 RFC 8441，否则连接失败。默认关闭
+	HTTP2WebSocket bool
+
+	// Obfuscation 隧道开头几帧的混淆方式，避免中间设备按前几帧的大小特征识别隧道，之后的帧不受影响，默认不混淆。
+	// 可选值见 ObfuscationFragment、ObfuscationPad，Start 和 Reload 时校验
+	Obfuscation Obfuscation
+
+	// UploadCoalesceDelay 上传方向一次读到的数据少于 4KB 时，在该时间内继续读取并合并为一个 WebSocket 消息，
+	// 减少交互式流量的帧开销，最多增加该时间的延迟。为 0 时使用默认值 1ms，小于 0 表示不合并
+	UploadCoalesceDelay time.Duration
+
+	// DialRetries 建立 WebSocket 遇到临时性错误（DNS、连接被拒绝、超时、5xx 等）时的重试次数，
+	// 为 0 时使用默认值 2，小于 0 表示不重试；认证失败、证书校验失败等错误立即返回
+	DialRetries int
+	// DialRetryDelay 首次重试前的等待时间，之后每次翻倍（上限 10s）并加入随机抖动，为 0 时使用默认值 500ms
+	DialRetryDelay time.Duration
+
+	// FallbackDirect 为 true 时，需要代理的连接在服务端不可用（重试后仍无法建立 WebSocket）时
+	// 改为直连而不是失败，降级次数计入流量统计。只在网络错误或错误状态码时降级，令牌被拒绝、TLS 失败时不降级；
+	// BIND 和按应用规则指定经代理的连接不降级。直连会暴露真实 IP 和访问目标，默认关闭
+	FallbackDirect bool
+
+	// HealthCheckInterval 后台健康检查的间隔，每次经 ECH 向当前服务端建立一个 WebSocket 后立即关闭，
+	// 记录延迟和连续失败次数（见 ProxyServer.GetHealth），0 表示关闭
+	HealthCheckInterval time.Duration
+	// HealthCheckFailures 连续失败多少次后认为服务端不可用，为 0 时使用默认值 3
+	HealthCheckFailures int
+
+	// PlaintextPolicy 经代理发送明文协议（如 80 端口的 HTTP、FTP、未加密的 SMTP）时的处理方式，避免凭据暴露给服务端出口：
+	// 发往 plaintextPorts 中端口的连接首个数据包不是 TLS ClientHello、或为 HTTP 代理请求时视为明文，
+	// warn 记录日志，block 拒绝连接并返回 ErrPlaintextBlocked，均通知 PlaintextHandler。
+	// 为空或 allow 时不检查，直连不检查。Start 和 Reload 时校验
+	PlaintextPolicy PlaintextPolicy
+	// PlaintextExempt 不按 PlaintextPolicy 检查的主机，格式同 HostRateLimits 的键
+	PlaintextExempt []string
+
+	// DrainTimeout 停止时等待连接优雅关闭的时间，超时后强制关闭，为 0 时使用默认值 5s
+	DrainTimeout time.Duration
+
+	// PauseMode 暂停期间新连接的处理方式，默认拒绝
+	PauseMode PauseMode
+	// PauseDrain 为 true 时暂停会关闭现有连接，否则现有隧道继续运行
+	PauseDrain bool
+
+	// 历史记录缓冲区容量，为 0 时使用默认值
+	RouteDecisionLogSize  int // 最近分流决策条数，默认 200
+	RecentConnectionsSize int // 最近结束连接条数，默认 100
+
+	// StatsMaxSites 流量统计最多保留的站点数，超出时淘汰最久未访问的站点，为 0 时使用默认值 10000
+	StatsMaxSites int
+
+	// InternalsLogInterval 大于 0 时按该间隔记录 goroutine 数、堆内存及连接、固定 IP、站点统计等内部表的大小
+	// （同 GetInternals），用于排查长时间运行后的内存增长，默认关闭
+	InternalsLogInterval time.Duration
 }
 
 // ProxyServer 代理服务器
 type ProxyServer struct {
 	config   Config
 	listener net.Listener
-	stopChan chan struct{}
-	wg       sync.WaitGroup
-	running  bool
+	dns      *localDNS // DNSListenAddr 上的本地 DNS 服务，未设置时为 nil
+	state    lifecycleState
 	mu       sync.RWMutex
 
+	// lifecycleMu 串行化 Start、Stop、Restart、UpdateConfig 和 Reload，见 lifecycleState
+	lifecycleMu sync.Mutex
+
+	// ctx 在 Start 时创建、Stop 时取消，传递给所有连接处理流程和后台任务。
+	// group 为本运行周期的后台任务组，见 goBackground
+	ctx    context.Context
+	cancel context.CancelFunc
+	group  *errgroup.Group
+
+	// 已接受连接的跟踪
+	connsMu sync.Mutex
+	conns   map[net.Conn]*trackedConn
+	connWg  sync.WaitGroup
+
+	// 并发连接数限制，nil 表示不限制
+	limiter     atomic.Pointer[connLimiter]
+	activeConns atomic.Int64
+
+	// 进行中的 SOCKS5 UDP ASSOCIATE 数
+	udpAssociations atomic.Int64
+
+	// 按目标主机限速，nil 表示不限速
+	hostLimits atomic.Pointer[hostRateLimits]
+	// 总带宽限制，nil 表示不限速
+	totalLimit atomic.Pointer[totalRateLimit]
+
+	// 暂停后新连接按 PauseMode 处理
+	paused atomic.Bool
+
 	echListMu         sync.RWMutex
-	echList           []byte
+	echCacheMu        sync.Mutex           // 串行读写 echCacheFile
+	echRefresh        echRefreshState      // 由 echListMu 保护
+	echConfigs        map[string]*echEntry // 按查询域名缓存的 ECH 配置，见 echDomainFor
+	dohPreferred      string               // 最近一次查询成功的 DoH 服务器，由 echListMu 保护，见 queryECHRecord
 	chinaIPRangesMu   sync.RWMutex
 	chinaIPRanges     []ipRange
 	chinaIPV6RangesMu sync.RWMutex
@@ -59,6 +301,29 @@ type ProxyServer struct {
 
 	// 流量统计
 	trafficStats *TrafficStats
+
+	// 上游状态
+	upstreamMu      sync.RWMutex
+	upstreamHealth  map[string]*serverHealth // 各服务端的健康状态，键为地址
+	upstreamCurrent string                   // 最近一次连接成功的服务端，下次优先尝试
+	upstreamNext    atomic.Uint64            // BalanceRoundRobin 下一条隧道的起始服务端序号
+	upstreamHeaders map[string]string        // 最近一次成功升级的诊断头部
+	health          Health                   // 最近一次后台健康检查的结果
+
+	// 最近的分流决策、连接等历史记录
+	history *history
+
+	// 直连记住的主机 IP
+	dnsPins *dnsPins
+
+	// ServerIP 的候选地址及测速结果，见 serverip.go
+	serverIPs *serverIPSet
+
+	// 当前分流模式的 PAC 脚本，见 pac.go
+	pac atomic.Pointer[string]
+
+	// 本地 DNS 服务的应答缓存，见 dnsserver.go
+	dnsCache dnsCache
 }
 
 type ipRange struct {
@@ -75,9 +340,14 @@ const (
 	modeSOCKS5      = 1
 	modeHTTPConnect = 2
 	modeHTTPProxy   = 3
+	modeSOCKS5Bind  = 4
+	modeTransparent = 5
 	typeHTTPS       = 65
 )
 
+// firstFrameWait SOCKS5 和透明代理连接等待客户端首个数据包的时间，读到的数据随连接请求一起发送
+const firstFrameWait = 100 * time.Millisecond
+
 // RoutingMode 路由模式常量
 type RoutingMode string
 
@@ -87,16 +357,20 @@ const (
 	RoutingModeNone     RoutingMode = "none"      // 直连模式
 )
 
+// defaultFallbackServerHost FallbackServerHost 为空时使用的域名
+const defaultFallbackServerHost = "www.visa.com"
+
 // HTTP 客户端配置常量
 const (
 	defaultHTTPTimeout = 30 * time.Second
-	dohTimeout         = 10 * time.Second
-	dialTimeout        = 10 * time.Second
-	handshakeTimeout   = 10 * time.Second
-	connectionDeadline = 30 * time.Second
-	pingInterval       = 10 * time.Second
 	readBufferSize     = 32768
-	maxContentLength   = 10 * 1024 * 1024
+)
+
+// DialTimeout、TLSHandshakeTimeout、DoHTimeout 为 0 时的默认值
+const (
+	defaultDialTimeout         = 10 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultDoHTimeout          = 10 * time.Second
 )
 
 var defaultHTTPClient = &http.Client{
@@ -108,8 +382,8 @@ var defaultHTTPClient = &http.Client{
 	},
 }
 
+// dohClient 直接查询 DoH 的客户端，每次查询的超时由 DoHTimeout 决定
 var dohClient = &http.Client{
-	Timeout: dohTimeout,
 	Transport: &http.Transport{
 		MaxIdleConns:        5,
 		IdleConnTimeout:     60 * time.Second,
@@ -120,35 +394,58 @@ var dohClient = &http.Client{
 // NewProxyServer 创建新的代理服务器
 func NewProxyServer(cfg Config) *ProxyServer {
 	ts := NewTrafficStats(cfg.StoreDir)
+	ts.setMaxSites(cfg.StatsMaxSites)
 	upload, download := ts.GetTotalStats()
 	if upload > 0 || download > 0 {
 		LogInfo("[统计] 已加载历史流量统计: ↑ %s  ↓ %s", FormatBytes(upload), FormatBytes(download))
 	}
+	serverIPs := newServerIPSet()
+	serverIPs.reset(cfg.ServerIP)
 	return &ProxyServer{
 		config:       cfg,
-		stopChan:     make(chan struct{}),
 		trafficStats: ts,
+		history:      newHistory(cfg),
+		dnsPins:      newDNSPins(),
+		serverIPs:    serverIPs,
+		health:       Health{Healthy: true},
 	}
 }
 
-// Start 启动代理服务器
+// Start 启动代理服务器，已在运行时返回 ErrAlreadyRunning。
+// 与 Stop、Restart 等并发调用时依次执行
 func (s *ProxyServer) Start() error {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	return s.start()
+}
+
+// start 启动代理服务器，调用方需持有 lifecycleMu
+func (s *ProxyServer) start() error {
 	s.mu.Lock()
-	if s.running {
+	if s.state != lifecycleStopped {
 		s.mu.Unlock()
-		return errors.New("服务器已在运行")
+		return ErrAlreadyRunning
 	}
-	s.running = true
-	s.stopChan = make(chan struct{})
+	s.state = lifecycleStarting
+	s.paused.Store(false)
+	s.resetUpstreamHealth()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.group, s.ctx = errgroup.WithContext(ctx)
+	s.cancel = cancel
 	s.mu.Unlock()
 
-	LogInfo("[启动] 正在获取 ECH 配置...")
-	if err := s.prepareECH(); err != nil {
-		s.mu.Lock()
-		s.running = false
-		s.mu.Unlock()
-		return fmt.Errorf("获取 ECH 配置失败: %w", err)
+	if err := validateConfig(s.config); err != nil {
+		s.abortStart()
+		return err
 	}
+	s.mu.Lock()
+	s.config = normalizeConfig(s.config)
+	s.mu.Unlock()
+	if err := s.setupECH(); err != nil {
+		s.abortStart()
+		return err
+	}
+	s.resetServerIPs(s.config)
 
 	if err := s.loadRoutingData(); err != nil {
 		LogError("[警告] 加载分流数据失败: %v", err)
@@ -156,44 +453,241 @@ func (s *ProxyServer) Start() error {
 
 	listener, err := net.Listen("tcp", s.config.ListenAddr)
 	if err != nil {
-		s.mu.Lock()
-		s.running = false
-		s.mu.Unlock()
+		s.abortStart()
 		return fmt.Errorf("监听失败: %w", err)
 	}
+	var dns *localDNS
+	if s.config.DNSListenAddr != "" {
+		if dns, err = listenDNS(s.config.DNSListenAddr); err != nil {
+			listener.Close()
+			s.abortStart()
+			return fmt.Errorf("DNS 监听失败: %w", err)
+		}
+	}
+	s.mu.Lock()
 	s.listener = listener
+	s.dns = dns
+	s.mu.Unlock()
+	s.limiter.Store(newConnLimiter(s.config.MaxConnections))
+	s.hostLimits.Store(newHostRateLimits(s.config.HostRateLimits, nil))
+	s.totalLimit.Store(newTotalRateLimit(s.config.TotalRateLimit, s.config.TotalRateLimitExemptDirect, nil))
 
-	LogInfo("[代理] 服务器启动: %s (支持 SOCKS5 和 HTTP)", s.config.ListenAddr)
+	if s.config.Transparent {
+		LogInfo("[代理] 服务器启动: %s (透明代理)", s.config.ListenAddr)
+	} else {
+		LogInfo("[代理] 服务器启动: %s (支持 SOCKS5 和 HTTP)", s.config.ListenAddr)
+	}
 	LogInfo("[代理] 后端服务器: %s", s.config.ServerAddr)
-	if s.config.ServerIP == "" {
-		s.config.ServerIP = "www.visa.com"
+	if s.config.ServerIP != "" {
+		LogInfo("[代理] 使用固定 IP: %s", s.config.ServerIP)
+	}
+	if u, err := url.Parse(s.config.UpstreamProxy); err == nil && s.config.UpstreamProxy != "" && s.config.UpstreamProxy != UpstreamProxyNone {
+		LogInfo("[代理] 经上游代理连接服务端: %s", u.Redacted())
+	} else if host, port, _, err := parseServerAddr(s.currentServer()); err == nil && s.config.UpstreamProxy == "" {
+		if p, err := envProxy(net.JoinHostPort(host, port), s.config.ListenAddr); err != nil {
+			LogError("[代理] %v，连接服务端将失败，设置 UpstreamProxy 为 %s 可忽略环境变量", err, UpstreamProxyNone)
+		} else if p != nil {
+			LogInfo("[代理] 经环境变量中的代理连接服务端: %s://%s", p.scheme, p.addr)
+		}
+	}
+	if len(s.config.AppRules) > 0 && !processLookupSupported {
+		LogError("[警告] %v，按应用分流规则不会生效", errProcessLookupUnsupported)
 	}
+	s.goBackground("accept", func(ctx context.Context) error { return s.acceptLoop(ctx, listener) })
+	if dns != nil {
+		LogInfo("[DNS] 本地 DNS 服务启动: %s (UDP/TCP，DoH 路径 %s)", dns.tcp.Addr(), dnsQueryPath)
+		s.goBackground("dns", func(ctx context.Context) error { return s.serveDNS(ctx, dns) })
+	}
+
+	// 定期保存流量统计
+	s.goBackground("stats", s.autoSaveStats)
+
+	// 检测网络切换，是否生效由 WatchNetwork 控制
+	s.goBackground("netwatch", s.watchNetwork)
+
+	// 定期记录内部状态，是否生效由 InternalsLogInterval 控制
+	s.goBackground("internals", s.logInternals)
 
-	LogInfo("[代理] 使用固定 IP: %s", s.config.ServerIP)
-	s.wg.Add(1)
-	go s.acceptLoop()
+	// ServerIP 有多个候选地址时后台测速
+	s.goBackground("serverip", s.probeServerIPs)
 
-	// 启动定期保存流量统计
-	go s.autoSaveStats()
+	// 后台健康检查，是否生效由 HealthCheckInterval 控制
+	s.goBackground("health", s.checkHealth)
 
+	// 定期刷新 ECH 配置
+	s.goBackground("echrefresh", s.refreshECHPeriodically)
+
+	s.setState(lifecycleRunning)
 	return nil
 }
 
-// Stop 停止代理服务器
+// validateConfig 检查 Start 和 Reload 前需要校验的配置
+func validateConfig(cfg Config) error {
+	if err := validateServerAddrs(cfg.ServerAddr); err != nil {
+		return err
+	}
+	if _, err := parseServerIPs(cfg.ServerIP); err != nil {
+		return err
+	}
+	if _, err := parseDoHServers(cfg.DNSServer); err != nil {
+		return err
+	}
+	if cfg.FallbackServerHost != "" && !validHost(cfg.FallbackServerHost) {
+		return fmt.Errorf("无效的 FallbackServerHost: %q", cfg.FallbackServerHost)
+	}
+	if _, err := parseUpstreamProxy(cfg.UpstreamProxy); err != nil {
+		return err
+	}
+	if err := validBalanceStrategy(cfg.BalanceStrategy); err != nil {
+		return err
+	}
+	if cfg.Transparent && !transparentSupported {
+		return errTransparentUnsupported
+	}
+	if _, err := parseSPKIPins(cfg.PinnedSPKI); err != nil {
+		return err
+	}
+	if _, _, err := keepaliveTimeouts(cfg); err != nil {
+		return err
+	}
+	switch cfg.Obfuscation {
+	case "", ObfuscationNone, ObfuscationFragment, ObfuscationPad:
+	default:
+		return fmt.Errorf("未知的混淆方式: %s", cfg.Obfuscation)
+	}
+	if cfg.DialTimeout < 0 || cfg.TLSHandshakeTimeout < 0 || cfg.DoHTimeout < 0 {
+		return errors.New("DialTimeout、TLSHandshakeTimeout、DoHTimeout 不能为负数")
+	}
+	return validatePlaintextPolicy(cfg.PlaintextPolicy)
+}
+
+// normalizeConfig 在保存到 ProxyServer 前补全可以按默认值处理的字段：RoutingMode 为空或未知时使用 global。
+// 在启动和 Reload 时调用，之后运行中的代理不再修改配置
+func normalizeConfig(cfg Config) Config {
+	switch cfg.RoutingMode {
+	case RoutingModeGlobal, RoutingModeBypassCN, RoutingModeNone:
+	case "":
+		cfg.RoutingMode = RoutingModeGlobal
+	default:
+		LogError("[警告] 未知的分流模式: %s，使用默认模式 global", cfg.RoutingMode)
+		cfg.RoutingMode = RoutingModeGlobal
+	}
+	return cfg
+}
+
+// abortStart 撤销启动失败时的运行状态
+func (s *ProxyServer) abortStart() {
+	s.mu.Lock()
+	s.state = lifecycleStopped
+	s.cancel()
+	s.mu.Unlock()
+}
+
+// setupECH 按配置准备 ECH：RequireECH 为 true 时 ECH 不可用即启动失败，
+// 否则降级为普通 TLS；ws:// 明文连接不使用 ECH
+func (s *ProxyServer) setupECH() error {
+	cfg := s.GetConfig()
+	if !serverUsesTLS(cfg) {
+		if cfg.RequireECH {
+			return errors.New("ws:// 明文连接不支持 ECH，请使用 wss:// 或关闭 RequireECH")
+		}
+		LogInfo("[ECH] 使用 ws:// 明文连接，跳过 ECH")
+		return nil
+	}
+	if err := CheckECHSupport(); err != nil {
+		if cfg.RequireECH {
+			return err
+		}
+		LogError("[警告] %v，将使用普通 TLS", err)
+		return nil
+	}
+	LogInfo("[启动] 正在获取 ECH 配置...")
+	domains := echDomains(cfg)
+	for _, domain := range domains {
+		if err := s.prepareECH(domain); err != nil {
+			if cfg.RequireECH {
+				return fmt.Errorf("获取 %s 的 ECH 配置失败: %w", domain, err)
+			}
+			LogError("[警告] 获取 %s 的 ECH 配置失败: %v，将使用普通 TLS", domain, err)
+		}
+	}
+	s.pruneECH(domains)
+	return nil
+}
+
+// Addr 返回实际监听地址，未运行时返回 nil
+func (s *ProxyServer) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state != lifecycleRunning || s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop 停止代理服务器，未运行时返回 ErrNotRunning。
+// 正在启动时等待启动完成后再停止
 func (s *ProxyServer) Stop() error {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	return s.stop()
+}
+
+// shutdownMargin ShutdownTimeout 在 DrainTimeout 之外留给停止后台任务和保存流量统计的时间
+const shutdownMargin = 5 * time.Second
+
+// ShutdownTimeout 返回按 cfg 运行时 Shutdown 正常完成所需的时间上限，供退出进程时设置 ctx 的超时
+func ShutdownTimeout(cfg Config) time.Duration {
+	return cmp.Or(max(cfg.DrainTimeout, 0), defaultDrainTimeout) + shutdownMargin
+}
+
+// Shutdown 退出进程前停止代理服务器，步骤与 Stop 相同：停止接受新连接，在 DrainTimeout 内等待连接关闭，
+// 再保存流量统计。ctx 结束时不再等待尚未完成的步骤（它们在后台继续），立即保存一次流量统计并返回 ctx.Err()。
+// 未运行时返回 nil
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- s.Stop() }()
+	select {
+	case err := <-done:
+		if errors.Is(err, ErrNotRunning) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+	LogError("[代理] 停止超时，不再等待: %v", ctx.Err())
+	if s.trafficStats != nil {
+		if err := s.trafficStats.Save(); err != nil {
+			LogError("[统计] 保存流量统计失败: %v", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// stop 停止代理服务器，调用方需持有 lifecycleMu
+func (s *ProxyServer) stop() error {
 	s.mu.Lock()
-	if !s.running {
+	if s.state != lifecycleRunning {
 		s.mu.Unlock()
-		return errors.New("服务器未运行")
+		return ErrNotRunning
 	}
-	s.running = false
+	s.state = lifecycleStopping
+	listener := s.listener
+	drainTimeout := s.config.DrainTimeout
+	cancel, group := s.cancel, s.group
 	s.mu.Unlock()
 
-	close(s.stopChan)
-	if s.listener != nil {
-		s.listener.Close()
+	cancel()
+	if listener != nil {
+		listener.Close()
+	}
+	// 先等待 acceptLoop 等后台任务退出，确保之后不会再登记新连接
+	if err := group.Wait(); err != nil {
+		LogError("[代理] %v", err)
 	}
-	s.wg.Wait()
+	s.drainConns(drainTimeout)
+	// 缓存的应答不带到下次启动，期间网络或 DoH 设置可能已经改变
+	s.dnsCache.reset()
 
 	// 保存流量统计
 	if s.trafficStats != nil {
@@ -205,37 +699,46 @@ func (s *ProxyServer) Stop() error {
 		}
 	}
 
+	s.setState(lifecycleStopped)
 	LogInfo("[代理] 服务器已停止")
 	return nil
 }
 
-// Restart 重启代理服务器
+// Restart 重启代理服务器，未运行时直接启动。停止和启动之间不会插入其他生命周期操作
 func (s *ProxyServer) Restart() error {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
 	LogInfo("[代理] 正在重启服务器...")
-	if err := s.Stop(); err != nil && err.Error() != "服务器未运行" {
+	if err := s.stop(); err != nil && !errors.Is(err, ErrNotRunning) {
 		return fmt.Errorf("停止服务器失败: %w", err)
 	}
-	return s.Start()
+	return s.start()
 }
 
-// UpdateConfig 更新配置并重启
+// UpdateConfig 更新配置，运行中时重启
 func (s *ProxyServer) UpdateConfig(cfg Config) error {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
 	s.mu.Lock()
 	s.config = cfg
+	running := s.state == lifecycleRunning
 	s.mu.Unlock()
 
-	if s.IsRunning() {
-		return s.Restart()
+	if !running {
+		return nil
 	}
-	return nil
-
+	LogInfo("[代理] 正在重启服务器...")
+	if err := s.stop(); err != nil {
+		return fmt.Errorf("停止服务器失败: %w", err)
+	}
+	return s.start()
 }
 
-// IsRunning 检查服务器是否运行中
+// IsRunning 检查服务器是否运行中，正在启动或停止时也返回 true
 func (s *ProxyServer) IsRunning() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.running
+	return s.state != lifecycleStopped
 }
 
 // GetConfig 获取当前配置
@@ -251,14 +754,14 @@ func (s *ProxyServer) GetTrafficStats() *TrafficStats {
 }
 
 // autoSaveStats 定期自动保存流量统计
-func (s *ProxyServer) autoSaveStats() {
+func (s *ProxyServer) autoSaveStats(ctx context.Context) error {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.stopChan:
-			return
+		case <-ctx.Done():
+			return nil
 		case <-ticker.C:
 			if s.trafficStats != nil {
 				s.trafficStats.Save()
@@ -267,50 +770,76 @@ func (s *ProxyServer) autoSaveStats() {
 	}
 }
 
-func (s *ProxyServer) acceptLoop() {
-	defer s.wg.Done()
+func (s *ProxyServer) acceptLoop(ctx context.Context, listener net.Listener) error {
 	for {
-		select {
-		case <-s.stopChan:
-			return
-		default:
-		}
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			select {
-			case <-s.stopChan:
-				return
-			default:
-				LogError("[代理] 接受连接失败: %v", err)
-				continue
+			// 已停止，或监听已被 Reload 替换
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
 			}
+			LogError("[代理] 接受连接失败: %v", err)
+			continue
+		}
+		if ctx.Err() != nil {
+			conn.Close()
+			return nil
 		}
-		go s.handleConnection(conn)
+		s.trackConn(conn)
+		go s.handleConnection(ctx, conn)
 	}
 }
 
-func (s *ProxyServer) handleConnection(conn net.Conn) {
+func (s *ProxyServer) handleConnection(ctx context.Context, conn net.Conn) {
+	defer s.untrackConn(conn)
 	defer conn.Close()
 	clientAddr := conn.RemoteAddr().String()
-	conn.SetDeadline(time.Now().Add(connectionDeadline))
+	ctx = withConnID(ctx)
+	defer s.logPhaseTimeout(ctx, conn, clientAddr)
+	s.enterPhase(conn, phaseHandshake)
 
+	// 透明代理的客户端不发送握手，服务端先发言的协议也可能不会先发送数据
+	transparent := s.GetConfig().Transparent
 	buf := make([]byte, 1)
-	if n, err := conn.Read(buf); err != nil || n == 0 {
+	if !transparent {
+		if n, err := conn.Read(buf); err != nil || n == 0 {
+			return
+		}
+	}
+
+	release, ok := s.acquireConnSlot(ctx)
+	if !ok {
+		LogInfo("[代理] %s 连接数已达上限 (%d)，拒绝连接", clientAddr, s.GetConfig().MaxConnections)
+		if !transparent {
+			rejectConnection(conn, buf[0])
+		}
+		return
+	}
+	defer release()
+
+	if s.paused.Load() && s.pauseMode() == PauseModeReject {
+		if !transparent {
+			rejectConnection(conn, buf[0])
+		}
 		return
 	}
 
+	if transparent {
+		s.handleTransparent(ctx, conn, clientAddr)
+		return
+	}
 	switch buf[0] {
 	case 0x05:
-		s.handleSOCKS5(conn, clientAddr, buf[0])
+		s.handleSOCKS5(ctx, conn, clientAddr, buf[0])
 	case 'C', 'G', 'P', 'H', 'D', 'O', 'T':
-		s.handleHTTP(conn, clientAddr, buf[0])
+		s.handleHTTP(ctx, conn, clientAddr, buf[0])
 	default:
 		LogInfo("[代理] %s 未知协议: 0x%02x", clientAddr, buf[0])
 	}
 }
 
 func (s *ProxyServer) loadRoutingData() error {
-	switch s.config.RoutingMode {
+	switch s.GetConfig().RoutingMode {
 	case RoutingModeBypassCN:
 		LogInfo("[启动] 分流模式: 跳过中国大陆，正在加载中国IP列表...")
 		ipv4Count, ipv6Count := 0, 0
@@ -337,10 +866,8 @@ func (s *ProxyServer) loadRoutingData() error {
 		LogInfo("[启动] 分流模式: 全局代理")
 	case RoutingModeNone:
 		LogInfo("[启动] 分流模式: 不改变代理（直连模式）")
-	default:
-		LogError("[警告] 未知的分流模式: %s，使用默认模式 global", s.config.RoutingMode)
-		s.config.RoutingMode = RoutingModeGlobal
 	}
+	s.refreshPAC()
 	return nil
 }
 
@@ -445,41 +972,53 @@ func isPrivateIPAddress(ip net.IP) bool {
 	return false
 }
 
-func (s *ProxyServer) shouldBypassProxy(targetHost string) bool {
-	if s.config.RoutingMode == RoutingModeNone {
-		return true
+// routeDecision 按 cfg 判断目标是否直连，并返回决策原因，appRule 表示由按应用分流的规则决定
+func (s *ProxyServer) routeDecision(cfg Config, conn net.Conn, targetHost string) (direct bool, reason string, appRule bool) {
+	if s.paused.Load() {
+		return true, "代理已暂停", false
+	}
+	if cfg.RoutingMode == RoutingModeNone {
+		return true, "直连模式", false
 	}
 
 	// 检查是否为内网地址，内网地址始终直连
 	if s.isPrivateIP(targetHost) {
 		LogInfo("[分流] %s 局域网地址，强制直连", targetHost)
-		return true
+		return true, "局域网地址", false
 	}
 
-	if s.config.RoutingMode == RoutingModeGlobal {
-		return false
+	if direct, reason, ok := s.appRouteDecision(conn, cfg.AppRules); ok {
+		return direct, reason, true
+	}
+
+	if cfg.RoutingMode == RoutingModeGlobal {
+		return false, "全局代理", false
 	}
-	if s.config.RoutingMode == RoutingModeBypassCN {
+	if cfg.RoutingMode == RoutingModeBypassCN {
 		if ip := net.ParseIP(targetHost); ip != nil {
-			return s.isChinaIP(targetHost)
+			if s.isChinaIP(targetHost) {
+				return true, "中国大陆 IP", false
+			}
+			return false, "非中国大陆 IP", false
 		}
 		ips, err := net.LookupIP(targetHost)
 		if err != nil {
-			return false
+			return false, "域名解析失败", false
 		}
 		for _, ip := range ips {
 			if s.isChinaIP(ip.String()) {
-				return true
+				return true, "解析到中国大陆 IP", false
 			}
 		}
-		return false
+		return false, "未解析到中国大陆 IP", false
 	}
-	return false
+	return false, "未知分流模式", false
 }
 
-func downloadIPList(urlStr, filePath string) error {
+// downloadIPList 经 client 下载 urlStr 保存到 filePath
+func downloadIPList(client *http.Client, urlStr, filePath string) error {
 	LogInfo("[下载] 正在下载 IP 列表: %s", urlStr)
-	resp, err := defaultHTTPClient.Get(urlStr)
+	resp, err := client.Get(urlStr)
 	if err != nil {
 		return fmt.Errorf("下载失败: %w", err)
 	}
@@ -500,7 +1039,7 @@ func downloadIPList(urlStr, filePath string) error {
 
 func (s *ProxyServer) loadChinaIPList() error {
 
-	ipListFile := filepath.Join(s.config.StoreDir, "chn_ip.txt")
+	ipListFile := filepath.Join(s.GetConfig().StoreDir, "chn_ip.txt")
 	needDownload := false
 	if info, err := os.Stat(ipListFile); os.IsNotExist(err) {
 		needDownload = true
@@ -510,8 +1049,7 @@ func (s *ProxyServer) loadChinaIPList() error {
 		LogInfo("[加载] IPv4 列表文件为空，将自动下载")
 	}
 	if needDownload {
-		urlStr := "https://raw.githubusercontent.com/mayaxcn/china-ip-list/refs/heads/master/chn_ip.txt"
-		if err := downloadIPList(urlStr, ipListFile); err != nil {
+		if err := s.downloadRoutingFile("chn_ip.txt"); err != nil {
 			return fmt.Errorf("自动下载 IPv4 列表失败: %w", err)
 		}
 	}
@@ -556,7 +1094,7 @@ func (s *ProxyServer) loadChinaIPList() error {
 }
 
 func (s *ProxyServer) loadChinaIPV6List() error {
-	ipListFile := filepath.Join(s.config.StoreDir, "chn_ip_v6.txt")
+	ipListFile := filepath.Join(s.GetConfig().StoreDir, "chn_ip_v6.txt")
 	// if _, err := os.Stat(ipListFile); os.IsNotExist(err) {
 	// 	ipListFile = "chn_ip_v6.txt"
 	// }
@@ -569,8 +1107,7 @@ func (s *ProxyServer) loadChinaIPV6List() error {
 		LogInfo("[加载] IPv6 列表文件为空，将自动下载")
 	}
 	if needDownload {
-		urlStr := "https://raw.githubusercontent.com/mayaxcn/china-ip-list/refs/heads/master/chn_ip_v6.txt"
-		if err := downloadIPList(urlStr, ipListFile); err != nil {
+		if err := s.downloadRoutingFile("chn_ip_v6.txt"); err != nil {
 			LogError("[警告] 自动下载 IPv6 列表失败: %v，将跳过 IPv6 支持", err)
 			return nil
 		}
@@ -622,40 +1159,207 @@ func (s *ProxyServer) loadChinaIPV6List() error {
 	return nil
 }
 
-func (s *ProxyServer) prepareECH() error {
-	echBase64, err := s.queryHTTPSRecord(s.config.ECHDomain, s.config.DNSServer)
-	if err != nil {
-		return fmt.Errorf("DNS 查询失败: %w", err)
+// ECHDomainServer 作为 ECHDomain 时，各服务端从自身主机名的 HTTPS 记录获取 ECH 配置，用于自建并发布了
+// HTTPS 记录的 ECH 服务端。按 RFC 9460，443 端口查询主机名本身，其他端口查询 _端口._https.主机名
+const ECHDomainServer = "@server"
+
+// echEntry 一个查询域名的 ECH 配置
+type echEntry struct {
+	list     []byte
+	alpn     []string  // HTTPS 记录声明的 ALPN，见 offeredALPN
+	hints    []string  // HTTPS 记录中 ipv4hint、ipv6hint 给出的地址，先 IPv4 后 IPv6，见 serverIPHints
+	loadedAt time.Time // list 最近一次加载成功的时间，来自缓存时为缓存中记录的查询时间
+	cached   bool      // DoH 查询失败，list 来自 StoreDir 中的缓存，见 echCacheFile
+	resolver string    // 查询到 list 的 DoH 服务器（DNSServer 中的写法），来自缓存时为空
+	err      error     // 最近一次加载失败的原因，加载成功后清空
+}
+
+// echDomainFor 返回连接 host:port 上的服务端时使用的 ECH 查询域名
+func echDomainFor(cfg Config, host, port string) string {
+	switch {
+	case cfg.ECHDomain != ECHDomainServer:
+		return cfg.ECHDomain
+	case port == "443":
+		return host
+	}
+	return "_" + port + "._https." + host
+}
+
+// echDomains 返回 cfg 中各服务端使用的 ECH 查询域名，按服务端顺序去重
+func echDomains(cfg Config) []string {
+	if cfg.ECHDomain != ECHDomainServer {
+		return []string{cfg.ECHDomain}
 	}
-	if echBase64 == "" {
-		return errors.New("未找到 ECH 参数")
+	var domains []string
+	for _, server := range serverAddrs(cfg.ServerAddr) {
+		host, port, _, err := parseServerAddr(server)
+		if err != nil {
+			continue
+		}
+		if domain := echDomainFor(cfg, host, port); !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
 	}
-	raw, err := base64.StdEncoding.DecodeString(echBase64)
-	if err != nil {
-		return fmt.Errorf("ECH 解码失败: %w", err)
+	return domains
+}
+
+// prepareECH 查询 domain 的 HTTPS 记录并缓存其中的 ECH 配置，查询成功时同时写入 echCacheFile。
+// 失败时保留之前加载的配置；尚未加载时若 DoH 查询失败或暂无 ECH 参数，使用未超过 ECHCacheMaxAge 的缓存
+func (s *ProxyServer) prepareECH(domain string) (err error) {
+	defer func() {
+		if err != nil {
+			s.echListMu.Lock()
+			s.echEntryLocked(domain).err = err
+			s.echListMu.Unlock()
+		}
+	}()
+	cfg := s.GetConfig()
+	record, resolver, err := s.queryECHRecord(domain)
+	switch {
+	case errors.Is(err, errNoECHParam):
+		if _, err := s.getECHList(domain); err == nil {
+			LogError("[ECH] %s 的 HTTPS 记录暂时没有 ECH 参数，可能正在轮换密钥，继续使用之前加载的配置", domain)
+		} else if s.loadCachedECH(domain, err) {
+			return nil
+		}
+		return err
+	case errors.Is(err, errNoHTTPSRecord), errors.Is(err, errNoSuchDomain):
+		return fmt.Errorf("%w，请检查 ECHDomain 和 DNSServer", err)
+	case err != nil:
+		err = fmt.Errorf("DNS 查询失败: %w", err)
+		if _, loadErr := s.getECHList(domain); loadErr != nil && s.loadCachedECH(domain, err) {
+			return nil
+		}
+		return err
+	}
+	raw := record.ech
+	if want := cfg.ECHPublicName; want != "" {
+		if err := checkECHPublicName(raw, want); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	s.echListMu.Lock()
+	*s.echEntryLocked(domain) = echEntry{list: raw, alpn: record.alpn, hints: record.hints, loadedAt: now, resolver: resolver.name}
+	s.echListMu.Unlock()
+	s.saveECHCache(domain, echCacheEntry{List: raw, ALPN: record.alpn, Hints: record.hints, FetchedAt: now})
+	LogInfo("[ECH] %s 的配置已通过 DoH 服务器 %s 加载，长度: %d 字节", domain, resolver.name, len(raw))
+	return nil
+}
+
+// loadCachedECH 查询失败 (queryErr) 时加载 domain 缓存的配置，没有可用的缓存时返回 false
+func (s *ProxyServer) loadCachedECH(domain string, queryErr error) bool {
+	cached, ok := s.cachedECH(domain)
+	if !ok {
+		return false
+	}
+	if want := s.GetConfig().ECHPublicName; want != "" && checkECHPublicName(cached.List, want) != nil {
+		return false
 	}
 	s.echListMu.Lock()
-	s.echList = raw
+	*s.echEntryLocked(domain) = echEntry{list: cached.List, alpn: cached.ALPN, hints: cached.Hints, loadedAt: cached.FetchedAt, cached: true, err: queryErr}
 	s.echListMu.Unlock()
-	LogInfo("[ECH] 配置已加载，长度: %d 字节", len(raw))
+	LogError("[ECH] %s 的 DoH 查询失败 (%v)，使用缓存的配置（获取于 %s），长度: %d 字节", domain, queryErr,
+		cached.FetchedAt.Format(time.DateTime), len(cached.List))
+	return true
+}
+
+// echEntryLocked 返回 domain 的缓存项，不存在时创建。调用方需持有 echListMu
+func (s *ProxyServer) echEntryLocked(domain string) *echEntry {
+	e := s.echConfigs[domain]
+	if e == nil {
+		e = &echEntry{}
+		if s.echConfigs == nil {
+			s.echConfigs = make(map[string]*echEntry)
+		}
+		s.echConfigs[domain] = e
+	}
+	return e
+}
+
+// pruneECH 丢弃 domains 以外的缓存项，服务端列表或 ECHDomain 变化后调用
+func (s *ProxyServer) pruneECH(domains []string) {
+	s.echListMu.Lock()
+	defer s.echListMu.Unlock()
+	maps.DeleteFunc(s.echConfigs, func(domain string, _ *echEntry) bool { return !slices.Contains(domains, domain) })
+}
+
+// refreshECH 重新获取 domains 的 ECH 配置，未指定时刷新当前配置使用的全部域名。
+// 未设置 ServerIP 且 HTTPS 记录中的地址提示变化时重新生成 ServerIP 候选地址并测速
+func (s *ProxyServer) refreshECH(domains ...string) error {
+	cfg := s.GetConfig()
+	if len(domains) == 0 {
+		domains = echDomains(cfg)
+	}
+	hints := s.serverIPHints(cfg)
+	var errs []error
+	for _, domain := range domains {
+		LogInfo("[ECH] 刷新 %s 的配置...", domain)
+		if err := s.prepareECH(domain); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+		}
+	}
+	if !slices.Equal(hints, s.serverIPHints(cfg)) {
+		s.resetServerIPs(cfg)
+		s.resetDoHProxyClient()
+		s.serverIPs.requestProbe()
+	}
+	return errors.Join(errs...)
+}
+
+// serverIPHints 返回 cfg 未设置 ServerIP 时连接服务端使用的地址提示：第一个服务端的 ECH 查询域名的 HTTPS 记录中
+// ipv4hint、ipv6hint 给出的地址。设置了 ServerIP、使用 ws:// 或尚未加载该域名的 ECH 配置时返回 nil
+func (s *ProxyServer) serverIPHints(cfg Config) []string {
+	servers := serverAddrs(cfg.ServerAddr)
+	if cfg.ServerIP != "" || len(servers) == 0 || !addrUsesTLS(servers[0]) {
+		return nil
+	}
+	domains := echDomains(cfg)
+	if len(domains) == 0 {
+		return nil
+	}
+	s.echListMu.RLock()
+	defer s.echListMu.RUnlock()
+	if e := s.echConfigs[domains[0]]; e != nil && len(e.list) > 0 {
+		return e.hints
+	}
 	return nil
 }
 
-func (s *ProxyServer) refreshECH() error {
-	LogInfo("[ECH] 刷新配置...")
-	return s.prepareECH()
+// getECHList 返回 domain 已加载的 ECH 配置
+func (s *ProxyServer) getECHList(domain string) ([]byte, error) {
+	s.echListMu.RLock()
+	defer s.echListMu.RUnlock()
+	if e := s.echConfigs[domain]; e != nil && len(e.list) > 0 {
+		return e.list, nil
+	}
+	return nil, errors.New("ECH 配置未加载")
 }
 
-func (s *ProxyServer) getECHList() ([]byte, error) {
+// echALPN 返回 domain 的 HTTPS 记录声明的 ALPN，记录未加载时返回 nil
+func (s *ProxyServer) echALPN(domain string) []string {
 	s.echListMu.RLock()
 	defer s.echListMu.RUnlock()
-	if len(s.echList) == 0 {
-		return nil, errors.New("ECH 配置未加载")
+	if e := s.echConfigs[domain]; e != nil {
+		return e.alpn
+	}
+	return nil
+}
+
+// offeredALPN 返回 HTTPS 记录的 ALPN 中 supported 支持的协议，保持记录中的顺序，使握手与浏览器访问该域名时一致。
+// 只提供连接实际能使用的协议：服务端选中其他协议（如 WebSocket 经 HTTP/1.1 升级时的 h2）会导致升级失败
+func offeredALPN(alpn, supported []string) []string {
+	var offered []string
+	for _, proto := range alpn {
+		if slices.Contains(supported, proto) {
+			offered = append(offered, proto)
+		}
 	}
-	return s.echList, nil
+	return offered
 }
 
-func buildTLSConfigWithECH(serverName string, echList []byte) (*tls.Config, error) {
+// buildTLSConfigWithECH 构建启用 ECH 的 TLS 配置，alpn 不为空时设为 NextProtos
+func buildTLSConfigWithECH(serverName string, echList []byte, alpn []string) (*tls.Config, error) {
 	roots, err := x509.SystemCertPool()
 	if err != nil {
 		return nil, fmt.Errorf("加载系统根证书失败: %w", err)
@@ -663,7 +1367,7 @@ func buildTLSConfigWithECH(serverName string, echList []byte) (*tls.Config, erro
 	if len(echList) == 0 {
 		return nil, errors.New("ECH 配置为空，这是必需功能")
 	}
-	config := &tls.Config{MinVersion: tls.VersionTLS13, ServerName: serverName, RootCAs: roots}
+	config := &tls.Config{MinVersion: tls.VersionTLS13, ServerName: serverName, RootCAs: roots, NextProtos: alpn}
 	if err := setECHConfig(config, echList); err != nil {
 		return nil, fmt.Errorf("设置 ECH 配置失败（需要 Go 1.23+ 或支持 ECH 的版本）: %w", err)
 	}
@@ -686,41 +1390,62 @@ func setECHConfig(config *tls.Config, echList []byte) error {
 	return nil
 }
 
-func (s *ProxyServer) queryHTTPSRecord(domain, dnsServer string) (string, error) {
-	dohURL := dnsServer
-	if !strings.HasPrefix(dohURL, "https://") && !strings.HasPrefix(dohURL, "http://") {
-		dohURL = "https://" + dohURL
+// queryHTTPSRecord 的失败原因：区分域名不存在、域名存在但没有 HTTPS 记录、记录中没有 ECH 参数，
+// 便于排查 ECH 配置失败
+var (
+	errNoSuchDomain  = errors.New("域名不存在")
+	errNoHTTPSRecord = errors.New("域名存在但没有 HTTPS 记录，未发布 ECH 配置")
+	errNoECHParam    = errors.New("HTTPS 记录中没有 ECH 参数，域名未启用 ECH 或正在轮换密钥")
+)
+
+// httpsRecord HTTPS 记录中客户端使用的参数
+type httpsRecord struct {
+	ech   []byte   // ECHConfigList
+	alpn  []string // alpn 参数列出的协议，未设置 no-default-alpn 时末尾加上默认的 http/1.1 (RFC 9460 7.1.1)
+	hints []string // ipv4hint、ipv6hint 给出的地址，先 IPv4 后 IPv6
+}
+
+// queryHTTPSRecord 通过 DoH 服务器 e 查询 domain 的 HTTPS 记录，返回第一条带 ECH 配置的记录。
+// 没有可用的 ECH 配置时返回 errNoSuchDomain、errNoHTTPSRecord 或 errNoECHParam
+func (s *ProxyServer) queryHTTPSRecord(domain string, e dohEndpoint) (httpsRecord, error) {
+	client, release := s.controlClient(dohClient, e.url)
+	if e.ip != "" {
+		client, release = s.bootstrapClient(e)
 	}
-	return queryDoH(domain, dohURL)
+	defer release()
+	return queryDoH(client, domain, e.url, s.dohTimeout())
 }
 
-func queryDoH(domain, dohURL string) (string, error) {
+// queryDoH 经 client 向 dohURL 查询 domain 的 HTTPS 记录，整个查询最多 timeout
+func queryDoH(client *http.Client, domain, dohURL string, timeout time.Duration) (httpsRecord, error) {
 	u, err := url.Parse(dohURL)
 	if err != nil {
-		return "", fmt.Errorf("无效的 DoH URL: %v", err)
+		return httpsRecord{}, fmt.Errorf("无效的 DoH URL: %v", err)
 	}
 	dnsQuery := buildDNSQuery(domain, typeHTTPS)
 	dnsBase64 := base64.RawURLEncoding.EncodeToString(dnsQuery)
 	q := u.Query()
 	q.Set("dns", dnsBase64)
 	u.RawQuery = q.Encode()
-	req, err := http.NewRequest("GET", u.String(), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
-		return "", fmt.Errorf("创建请求失败: %v", err)
+		return httpsRecord{}, fmt.Errorf("创建请求失败: %v", err)
 	}
 	req.Header.Set("Accept", "application/dns-message")
 	req.Header.Set("Content-Type", "application/dns-message")
-	resp, err := dohClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("DoH 请求失败: %v", err)
+		return httpsRecord{}, fmt.Errorf("DoH 请求失败: %v", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
+		return httpsRecord{}, fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("读取 DoH 响应失败: %v", err)
+		return httpsRecord{}, fmt.Errorf("读取 DoH 响应失败: %v", err)
 	}
 	return parseDNSResponse(body)
 }
@@ -736,14 +1461,22 @@ func buildDNSQuery(domain string, qtype uint16) []byte {
 	return query
 }
 
-func parseDNSResponse(response []byte) (string, error) {
+func parseDNSResponse(response []byte) (httpsRecord, error) {
 	if len(response) < 12 {
-		return "", errors.New("响应过短")
+		return httpsRecord{}, errors.New("响应过短")
+	}
+	switch rcode := response[3] & 0x0f; rcode {
+	case 0:
+	case 3: // NXDOMAIN
+		return httpsRecord{}, errNoSuchDomain
+	default:
+		return httpsRecord{}, fmt.Errorf("DNS 服务器返回错误 (RCODE %d)", rcode)
 	}
 	ancount := binary.BigEndian.Uint16(response[6:8])
 	if ancount == 0 {
-		return "", errors.New("无应答记录")
+		return httpsRecord{}, errNoHTTPSRecord
 	}
+	sawHTTPS := false // 应答中有 HTTPS 记录，但都没有 ECH 参数
 	offset := 12
 	for offset < len(response) && response[offset] != 0 {
 		offset += int(response[offset]) + 1
@@ -774,18 +1507,27 @@ func parseDNSResponse(response []byte) (string, error) {
 		data := response[offset : offset+int(dataLen)]
 		offset += int(dataLen)
 		if rrType == typeHTTPS {
-			if ech := parseHTTPSRecord(data); ech != "" {
-				return ech, nil
+			sawHTTPS = true
+			if record := parseHTTPSRecord(data); len(record.ech) > 0 {
+				return record, nil
 			}
 		}
 	}
-	return "", nil
+	if sawHTTPS {
+		return httpsRecord{}, errNoECHParam
+	}
+	return httpsRecord{}, errNoHTTPSRecord
 }
 
-func parseHTTPSRecord(data []byte) string {
+// parseHTTPSRecord 解析 HTTPS 记录的 RDATA，提取 alpn (1)、no-default-alpn (2)、ech (5)、ipv4hint (4) 和 ipv6hint (6) 参数，
+// 长度不符的地址提示和格式错误的 alpn 被忽略
+func parseHTTPSRecord(data []byte) httpsRecord {
+	var record httpsRecord
 	if len(data) < 2 {
-		return ""
+		return record
 	}
+	var v4, v6 []string
+	noDefaultALPN := false
 	offset := 2
 	if offset < len(data) && data[offset] == 0 {
 		offset++
@@ -804,11 +1546,42 @@ func parseHTTPSRecord(data []byte) string {
 		}
 		value := data[offset : offset+int(length)]
 		offset += int(length)
-		if key == 5 {
-			return base64.StdEncoding.EncodeToString(value)
+		switch {
+		case key == 1:
+			record.alpn = parseALPNValue(value)
+		case key == 2:
+			noDefaultALPN = true
+		case key == 4 && len(value)%net.IPv4len == 0:
+			for ip := range slices.Chunk(value, net.IPv4len) {
+				v4 = append(v4, net.IP(ip).String())
+			}
+		case key == 5:
+			record.ech = value
+		case key == 6 && len(value)%net.IPv6len == 0:
+			for ip := range slices.Chunk(value, net.IPv6len) {
+				v6 = append(v6, net.IP(ip).String())
+			}
 		}
 	}
-	return ""
+	record.hints = append(v4, v6...)
+	if !noDefaultALPN && !slices.Contains(record.alpn, "http/1.1") {
+		record.alpn = append(record.alpn, "http/1.1")
+	}
+	return record
+}
+
+// parseALPNValue 解析 alpn 参数的值：一个或多个以长度字节开头的协议名
+func parseALPNValue(value []byte) []string {
+	var protos []string
+	for len(value) > 0 {
+		n := int(value[0])
+		if n == 0 || 1+n > len(value) {
+			return nil
+		}
+		protos = append(protos, string(value[1:1+n]))
+		value = value[1+n:]
+	}
+	return protos
 }
 
 func (s *ProxyServer) getDoHProxyClient(port string) (*http.Client, error) {
@@ -828,14 +1601,26 @@ func (s *ProxyServer) getDoHProxyClient(port string) (*http.Client, error) {
 		return s.dohProxyClient, nil
 	}
 
-	echBytes, err := s.getECHList()
-	if err != nil {
+	cfg := s.GetConfig()
+	var tlsCfg *tls.Config
+	// DoH 查询不指定服务端，使用第一个服务端的 ECH 配置
+	domain := echDomains(cfg)[0]
+	echBytes, err := s.getECHList(domain)
+	switch {
+	case err == nil:
+		// Transport 设置了 TLSClientConfig，不会启用 HTTP/2
+		tlsCfg, err = buildTLSConfigWithECH("cloudflare-dns.com", echBytes, offeredALPN(s.echALPN(domain), []string{"http/1.1"}))
+		if err != nil {
+			return nil, fmt.Errorf("构建 TLS 配置失败: %w", err)
+		}
+	case cfg.RequireECH:
 		return nil, fmt.Errorf("获取 ECH 配置失败: %w", err)
+	default:
+		tlsCfg = &tls.Config{MinVersion: tls.VersionTLS13, ServerName: "cloudflare-dns.com"}
 	}
-
-	tlsCfg, err := buildTLSConfigWithECH("cloudflare-dns.com", echBytes)
-	if err != nil {
-		return nil, fmt.Errorf("构建 TLS 配置失败: %w", err)
+	// 与隧道相同，连接的是服务端 IP
+	if cfg.RootCAs != nil {
+		tlsCfg.RootCAs = cfg.RootCAs
 	}
 
 	transport := &http.Transport{
@@ -843,25 +1628,16 @@ func (s *ProxyServer) getDoHProxyClient(port string) (*http.Client, error) {
 		MaxIdleConns:        5,
 		IdleConnTimeout:     60 * time.Second,
 		MaxIdleConnsPerHost: 2,
-	}
-	if s.config.ServerIP != "" {
-		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			_, p, err := net.SplitHostPort(addr)
-			if err != nil {
-				return nil, err
-			}
-			dialer := &net.Dialer{Timeout: dialTimeout}
-			return dialer.DialContext(ctx, network, net.JoinHostPort(s.config.ServerIP, p))
-		}
+		DialContext:         s.serverDialContext,
 	}
 
-	s.dohProxyClient = &http.Client{Transport: transport, Timeout: dohTimeout}
+	s.dohProxyClient = &http.Client{Transport: transport}
 	s.dohProxyClientPort = port
 	return s.dohProxyClient, nil
 }
 
 func (s *ProxyServer) queryDoHForProxy(dnsQuery []byte) ([]byte, error) {
-	_, port, _, err := s.parseServerAddr()
+	_, port, _, err := parseServerAddr(s.currentServer())
 	if err != nil {
 		return nil, err
 	}
@@ -870,7 +1646,9 @@ func (s *ProxyServer) queryDoHForProxy(dnsQuery []byte) ([]byte, error) {
 		return nil, err
 	}
 	dohURL := fmt.Sprintf("https://cloudflare-dns.com:%s/dns-query", port)
-	req, err := http.NewRequest("POST", dohURL, bytes.NewReader(dnsQuery))
+	ctx, cancel := context.WithTimeout(context.Background(), s.dohTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", dohURL, bytes.NewReader(dnsQuery))
 	if err != nil {
 		return nil, err
 	}
@@ -887,8 +1665,15 @@ func (s *ProxyServer) queryDoHForProxy(dnsQuery []byte) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
-func (s *ProxyServer) parseServerAddr() (host, port, path string, err error) {
-	addr := s.config.ServerAddr
+// serverUsesTLS cfg 中的服务端是否使用 TLS (wss://，默认)，多个服务端的协议相同（见 validateServerAddrs）
+func serverUsesTLS(cfg Config) bool {
+	servers := serverAddrs(cfg.ServerAddr)
+	return len(servers) == 0 || addrUsesTLS(servers[0])
+}
+
+// parseServerAddr 解析 ServerAddr 中的一个服务端地址，路径缺省为 "/"
+func parseServerAddr(server string) (host, port, path string, err error) {
+	addr := strings.TrimPrefix(strings.TrimPrefix(server, "wss://"), "ws://")
 	path = "/"
 	slashIdx := strings.Index(addr, "/")
 	if slashIdx != -1 {
@@ -902,65 +1687,128 @@ func (s *ProxyServer) parseServerAddr() (host, port, path string, err error) {
 	return host, port, path, nil
 }
 
-func (s *ProxyServer) dialWebSocketWithECH(maxRetries int) (*websocket.Conn, error) {
-	host, port, path, err := s.parseServerAddr()
+// dialWebSocketWithECH 建立到服务端、转发到 target 的 WebSocket 连接，同时返回连接成功的服务端和升级响应中的诊断头部。
+// 配置了多个服务端时按 upstreamCandidates 的顺序故障转移；retry 为 true 时按 DialRetries、DialRetryDelay
+// 重试临时性错误，ctx 结束时停止等待
+func (s *ProxyServer) dialWebSocketWithECH(ctx context.Context, target string, retry bool) (*websocket.Conn, string, map[string]string, error) {
+	return s.dialServers(ctx, s.upstreamCandidates(s.GetConfig()), target, retry)
+}
+
+// buildUpstreamTLSConfig 按 cfg 构建连接服务端的 TLS 配置。ECH 配置可用时启用 ECH，
+// 否则仅在未要求 ECH 时降级为普通 TLS；设置了 PinnedSPKI 时校验证书公钥。ws:// 时返回 nil
+func (s *ProxyServer) buildUpstreamTLSConfig(cfg Config, host, port string) (*tls.Config, error) {
+	if !serverUsesTLS(cfg) {
+		return nil, nil
+	}
+	pins, err := parseSPKIPins(cfg.PinnedSPKI)
 	if err != nil {
 		return nil, err
 	}
-	wsURL := fmt.Sprintf("wss://%s:%s%s", host, port, path)
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		echBytes, echErr := s.getECHList()
-		if echErr != nil {
-			if attempt < maxRetries {
-				s.refreshECH()
-				continue
-			}
-			return nil, echErr
+	var config *tls.Config
+	domain := echDomainFor(cfg, host, port)
+	echBytes, err := s.getECHList(domain)
+	switch {
+	case err == nil:
+		// gorilla/websocket 只能经 HTTP/1.1 升级，HTTP/2 WebSocket 要求协商 h2
+		supported := []string{"http/1.1"}
+		if cfg.HTTP2WebSocket {
+			supported = []string{"h2", "http/1.1"}
+		}
+		if config, err = buildTLSConfigWithECH(host, echBytes, offeredALPN(s.echALPN(domain), supported)); err != nil {
+			return nil, err
 		}
+	case cfg.RequireECH:
+		return nil, err
+	default:
+		config = &tls.Config{MinVersion: tls.VersionTLS13, ServerName: host}
+	}
+	if cfg.RootCAs != nil {
+		config.RootCAs = cfg.RootCAs
+	}
+	if pins != nil {
+		config.VerifyPeerCertificate = verifySPKIPins(pins, cfg.PinAnyChainCert)
+	}
+	return config, nil
+}
 
-		tlsCfg, tlsErr := buildTLSConfigWithECH(host, echBytes)
-		if tlsErr != nil {
-			return nil, tlsErr
+// dialWebSocket 向 server 建立转发到 target 的 WebSocket 连接，按 tunnelCompression 决定是否协商压缩，
+// ECH 被拒绝时刷新配置后立即重试一次；其他失败直接返回，由 dialServers 决定重试或故障转移
+func (s *ProxyServer) dialWebSocket(ctx context.Context, server, target string) (*websocket.Conn, map[string]string, error) {
+	return s.dialWebSocketToken(ctx, server, target, s.GetConfig().Token)
+}
+
+// dialWebSocketToken 同 dialWebSocket，以 token 代替配置中的令牌，UpdateToken 用它验证新令牌
+func (s *ProxyServer) dialWebSocketToken(ctx context.Context, server, target, token string) (*websocket.Conn, map[string]string, error) {
+	cfg := s.GetConfig()
+	host, port, path, err := parseServerAddr(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	scheme := "wss"
+	if !serverUsesTLS(cfg) {
+		scheme = "ws"
+	}
+	wsURL := fmt.Sprintf("%s://%s:%s%s", scheme, host, port, path)
+
+	for echRefreshed := false; ; echRefreshed = true {
+		tlsCfg, err := s.buildUpstreamTLSConfig(cfg, host, port)
+		if err != nil {
+			// 获取 ECH 配置失败时由 dialServers 刷新后重试
+			return nil, nil, err
 		}
 
 		dialer := websocket.Dialer{
-			TLSClientConfig:  tlsCfg,
-			HandshakeTimeout: handshakeTimeout,
+			TLSClientConfig:   tlsCfg,
+			HandshakeTimeout:  s.tlsHandshakeTimeout(),
+			EnableCompression: tunnelCompression(cfg, target),
+		}
+		if token != "" {
+			dialer.Subprotocols = []string{token, protocol.FramingSubprotocol}
+			if cfg.ResumeGrace > 0 {
+				dialer.Subprotocols = []string{token, protocol.ResumeSubprotocol, protocol.FramingSubprotocol}
+			}
+			if cfg.Obfuscation == ObfuscationPad {
+				dialer.Subprotocols = offerPadding(dialer.Subprotocols)
+			}
 		}
-		if s.config.Token != "" {
-			dialer.Subprotocols = []string{s.config.Token}
+		if cfg.HTTP2WebSocket {
+			dial := s.h2WebSocketDialer(tlsCfg)
+			dialer.NetDialContext, dialer.NetDialTLSContext = dial, dial
+		} else {
+			dialer.NetDialContext = s.serverDialContext
 		}
-		if s.config.ServerIP != "" {
-			dialer.NetDial = func(network, address string) (net.Conn, error) {
-				_, p, err := net.SplitHostPort(address)
-				if err != nil {
-					return nil, err
-				}
-				return net.DialTimeout(network, net.JoinHostPort(s.config.ServerIP, p), dialTimeout)
-			}
+
+		if cfg.Obfuscation == ObfuscationFragment {
+			fragmentDialer(&dialer)
 		}
 
-		wsConn, _, dialErr := dialer.Dial(wsURL, nil)
-		if dialErr != nil {
-			if strings.Contains(dialErr.Error(), "ECH") && attempt < maxRetries {
-				LogInfo("[ECH] 连接失败，尝试刷新配置 (%d/%d)", attempt, maxRetries)
-				s.refreshECH()
-				time.Sleep(time.Second)
-				continue
+		wsConn, resp, dialErr := dialer.DialContext(ctx, wsURL, nil)
+		if dialErr == nil {
+			wsConn.SetReadLimit(protocol.MaxMessageSize)
+			if fc, ok := wsConn.NetConn().(*fragmentConn); ok {
+				// 握手请求按原样发送，只拆分其后的第一个 WebSocket 帧
+				fc.arm()
 			}
-			return nil, dialErr
+			return wsConn, captureUpstreamHeaders(resp), nil
+		}
+		if resp != nil {
+			dialErr = &upgradeStatusError{err: dialErr, status: resp.StatusCode}
 		}
-		return wsConn, nil
+		if echRefreshed || upstreamFailureClass(dialErr) != UpstreamFailureECHRejected {
+			return nil, nil, dialErr
+		}
+		// 密钥轮换后旧配置会被拒绝，刷新即可恢复，不等待也不占用重试次数
+		LogInfo("[ECH] 服务端拒绝了 ECH，刷新配置后立即重试")
+		s.refreshECH(echDomainFor(cfg, host, port))
 	}
-	return nil, errors.New("连接失败，已达最大重试次数")
 }
 
 func isNormalCloseError(err error) bool {
 	if err == nil {
 		return false
 	}
-	if err == io.EOF {
+	// io.ErrClosedPipe: 普通 HTTP 代理改用其他目标时关闭了原隧道的管道
+	if err == io.EOF || errors.Is(err, io.ErrClosedPipe) {
 		return true
 	}
 	errStr := err.Error()
@@ -970,7 +1818,7 @@ func isNormalCloseError(err error) bool {
 		strings.Contains(errStr, "normal closure")
 }
 
-func (s *ProxyServer) handleSOCKS5(conn net.Conn, clientAddr string, firstByte byte) {
+func (s *ProxyServer) handleSOCKS5(ctx context.Context, conn net.Conn, clientAddr string, firstByte byte) {
 	if firstByte != 0x05 {
 		LogInfo("[SOCKS5] %s 版本错误: 0x%02x", clientAddr, firstByte)
 		return
@@ -1029,28 +1877,30 @@ func (s *ProxyServer) handleSOCKS5(conn net.Conn, clientAddr string, firstByte b
 		return
 	}
 	port := int(buf[0])<<8 | int(buf[1])
+	target := net.JoinHostPort(host, strconv.Itoa(port))
 	switch command {
 	case 0x01:
-		var target string
-		if atyp == 0x04 {
-			target = fmt.Sprintf("[%s]:%d", host, port)
-		} else {
-			target = fmt.Sprintf("%s:%d", host, port)
+		logConnInfo(ctx, "[SOCKS5] %s -> %s", clientAddr, target)
+		if err := s.handleTunnel(ctx, conn, target, clientAddr, modeSOCKS5, ""); err != nil {
+			if !isNormalCloseError(err) {
+				logConnError(ctx, "[SOCKS5] %s 代理失败: %v", clientAddr, err)
+			}
 		}
-		LogInfo("[SOCKS5] %s -> %s", clientAddr, target)
-		if err := s.handleTunnel(conn, target, clientAddr, modeSOCKS5, ""); err != nil {
+	case 0x02:
+		logConnInfo(ctx, "[SOCKS5] %s BIND %s", clientAddr, target)
+		if err := s.handleTunnel(ctx, conn, target, clientAddr, modeSOCKS5Bind, ""); err != nil {
 			if !isNormalCloseError(err) {
-				LogError("[SOCKS5] %s 代理失败: %v", clientAddr, err)
+				logConnError(ctx, "[SOCKS5] %s BIND 失败: %v", clientAddr, err)
 			}
 		}
 	case 0x03:
-		s.handleUDPAssociate(conn, clientAddr)
+		s.handleUDPAssociate(ctx, conn, clientAddr)
 	default:
 		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 	}
 }
 
-func (s *ProxyServer) handleUDPAssociate(tcpConn net.Conn, clientAddr string) {
+func (s *ProxyServer) handleUDPAssociate(ctx context.Context, tcpConn net.Conn, clientAddr string) {
 	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	if err != nil {
 		LogError("[UDP] %s 解析地址失败: %v", clientAddr, err)
@@ -1073,12 +1923,23 @@ func (s *ProxyServer) handleUDPAssociate(tcpConn net.Conn, clientAddr string) {
 		udpConn.Close()
 		return
 	}
+	// 控制连接在 UDP 关联期间保持打开，不受握手超时限制
+	s.enterPhase(tcpConn, phaseIdle)
+	s.udpAssociations.Add(1)
+	defer s.udpAssociations.Add(-1)
 	stopChan := make(chan struct{})
-	go s.handleUDPRelay(udpConn, clientAddr, stopChan)
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		s.handleUDPRelay(udpConn, clientAddr, stopChan)
+	}()
+	stopWatch := context.AfterFunc(ctx, func() { tcpConn.Close() })
+	defer stopWatch()
 	buf := make([]byte, 1)
 	tcpConn.Read(buf)
 	close(stopChan)
 	udpConn.Close()
+	<-relayDone
 	LogInfo("[UDP] %s UDP ASSOCIATE 连接关闭", clientAddr)
 }
 
@@ -1098,47 +1959,13 @@ func (s *ProxyServer) handleUDPRelay(udpConn *net.UDPConn, clientAddr string, st
 			}
 			return
 		}
-		if n < 10 {
-			continue
-		}
 		data := buf[:n]
-		if data[2] != 0x00 {
-			continue
-		}
-		atyp := data[3]
-		var headerLen, dstPort int
-		var dstHost string
-		switch atyp {
-		case 0x01:
-			if n < 10 {
-				continue
-			}
-			dstHost = net.IP(data[4:8]).String()
-			dstPort = int(data[8])<<8 | int(data[9])
-			headerLen = 10
-		case 0x03:
-			if n < 5 {
-				continue
-			}
-			domainLen := int(data[4])
-			if n < 7+domainLen {
-				continue
-			}
-			dstHost = string(data[5 : 5+domainLen])
-			dstPort = int(data[5+domainLen])<<8 | int(data[6+domainLen])
-			headerLen = 7 + domainLen
-		case 0x04:
-			if n < 22 {
-				continue
-			}
-			dstHost = net.IP(data[4:20]).String()
-			dstPort = int(data[20])<<8 | int(data[21])
-			headerLen = 22
-		default:
+		dstHost, dstPort, headerLen, ok := parseSOCKS5UDPHeader(data)
+		if !ok {
 			continue
 		}
 		udpData := data[headerLen:]
-		target := fmt.Sprintf("%s:%d", dstHost, dstPort)
+		target := net.JoinHostPort(dstHost, strconv.Itoa(dstPort))
 		if dstPort == 53 {
 			LogInfo("[UDP-DNS] %s -> %s (DoH 查询)", clientAddr, target)
 			go s.handleDNSQuery(udpConn, addr, udpData, data[:headerLen])
@@ -1148,6 +1975,33 @@ func (s *ProxyServer) handleUDPRelay(udpConn *net.UDPConn, clientAddr string, st
 	}
 }
 
+// parseSOCKS5UDPHeader 解析 SOCKS5 UDP 请求头 (RFC 1928 第 7 节)，返回目标地址和端口及头部长度。
+// 不支持分片，头部不完整或地址类型未知时 ok 为 false
+func parseSOCKS5UDPHeader(data []byte) (host string, port, headerLen int, ok bool) {
+	if len(data) < 10 || data[2] != 0x00 {
+		return "", 0, 0, false
+	}
+	switch data[3] {
+	case 0x01:
+		host, headerLen = net.IP(data[4:8]).String(), 10
+	case 0x03:
+		domainLen := int(data[4])
+		if len(data) < 7+domainLen {
+			return "", 0, 0, false
+		}
+		host, headerLen = string(data[5:5+domainLen]), 7+domainLen
+	case 0x04:
+		if len(data) < 22 {
+			return "", 0, 0, false
+		}
+		host, headerLen = net.IP(data[4:20]).String(), 22
+	default:
+		return "", 0, 0, false
+	}
+	port = int(data[headerLen-2])<<8 | int(data[headerLen-1])
+	return host, port, headerLen, true
+}
+
 func (s *ProxyServer) handleDNSQuery(udpConn *net.UDPConn, clientAddr *net.UDPAddr, dnsQuery []byte, socks5Header []byte) {
 	dnsResponse, err := s.queryDoHForProxy(dnsQuery)
 	if err != nil {
@@ -1165,161 +2019,177 @@ func (s *ProxyServer) handleDNSQuery(udpConn *net.UDPConn, clientAddr *net.UDPAd
 	LogInfo("[UDP-DNS] DoH 查询成功，响应 %d 字节", len(dnsResponse))
 }
 
-func (s *ProxyServer) handleHTTP(conn net.Conn, clientAddr string, firstByte byte) {
+func (s *ProxyServer) handleHTTP(ctx context.Context, conn net.Conn, clientAddr string, firstByte byte) {
 	reader := bufio.NewReader(io.MultiReader(strings.NewReader(string(firstByte)), conn))
-	requestLine, err := reader.ReadString('\n')
-	if err != nil {
-		return
-	}
-	parts := strings.Fields(requestLine)
-	if len(parts) < 3 {
-		return
-	}
-	method := parts[0]
-	requestURL := parts[1]
-	httpVersion := parts[2]
-	headers := make(map[string]string)
-	var headerLines []string
+	proxy := &httpProxy{s: s, ctx: ctx, conn: conn, clientAddr: clientAddr, reader: reader}
+	defer proxy.closeSession()
 	for {
-		line, err := reader.ReadString('\n')
+		req, err := http.ReadRequest(reader)
 		if err != nil {
-			return
-		}
-		line = strings.TrimRight(line, "\r\n")
-		if line == "" {
-			break
-		}
-		headerLines = append(headerLines, line)
-		if idx := strings.Index(line, ":"); idx > 0 {
-			key := strings.TrimSpace(line[:idx])
-			value := strings.TrimSpace(line[idx+1:])
-			headers[strings.ToLower(key)] = value
-		}
-	}
-	switch method {
-	case "CONNECT":
-		LogInfo("[HTTP-CONNECT] %s -> %s", clientAddr, requestURL)
-		if err := s.handleTunnel(conn, requestURL, clientAddr, modeHTTPConnect, ""); err != nil {
-			if !isNormalCloseError(err) {
-				LogError("[HTTP-CONNECT] %s 代理失败: %v", clientAddr, err)
-			}
-		}
-	case "GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "TRACE":
-		LogInfo("[HTTP-%s] %s -> %s", method, clientAddr, requestURL)
-		var target, path string
-		if strings.HasPrefix(requestURL, "http://") {
-			urlWithoutScheme := strings.TrimPrefix(requestURL, "http://")
-			idx := strings.Index(urlWithoutScheme, "/")
-			if idx > 0 {
-				target = urlWithoutScheme[:idx]
-				path = urlWithoutScheme[idx:]
-			} else {
-				target = urlWithoutScheme
-				path = "/"
+			// 客户端关闭连接或等待下一个请求超时时直接关闭，请求格式错误（如请求行含空格、多个 Host 头）时返回 400
+			var netErr net.Error
+			if err != io.EOF && !errors.As(err, &netErr) && !isNormalCloseError(err) {
+				LogInfo("[HTTP] %s 请求格式错误: %v", clientAddr, err)
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
 			}
-		} else {
-			target = headers["host"]
-			path = requestURL
-		}
-		if target == "" {
-			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
 			return
 		}
-		if !strings.Contains(target, ":") {
-			target += ":80"
-		}
-		var requestBuilder strings.Builder
-		requestBuilder.WriteString(fmt.Sprintf("%s %s %s\r\n", method, path, httpVersion))
-		for _, line := range headerLines {
-			key := strings.Split(line, ":")[0]
-			keyLower := strings.ToLower(strings.TrimSpace(key))
-			if keyLower != "proxy-connection" && keyLower != "proxy-authorization" {
-				requestBuilder.WriteString(line)
-				requestBuilder.WriteString("\r\n")
+		switch req.Method {
+		case "CONNECT":
+			proxy.closeSession()
+			logConnInfo(ctx, "[HTTP-CONNECT] %s -> %s", clientAddr, req.RequestURI)
+			target := httpProxyTarget(req)
+			if target == "" {
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+				return
 			}
-		}
-		requestBuilder.WriteString("\r\n")
-		if contentLength := headers["content-length"]; contentLength != "" {
-			var length int
-			fmt.Sscanf(contentLength, "%d", &length)
-			if length > 0 && length < 10*1024*1024 {
-				body := make([]byte, length)
-				if _, err := io.ReadFull(reader, body); err == nil {
-					requestBuilder.Write(body)
+			if err := s.handleTunnel(ctx, conn, target, clientAddr, modeHTTPConnect, ""); err != nil {
+				if !isNormalCloseError(err) {
+					logConnError(ctx, "[HTTP-CONNECT] %s 代理失败: %v", clientAddr, err)
 				}
 			}
-		}
-		firstFrame := requestBuilder.String()
-		if err := s.handleTunnel(conn, target, clientAddr, modeHTTPProxy, firstFrame); err != nil {
-			if !isNormalCloseError(err) {
-				LogError("[HTTP-%s] %s 代理失败: %v", method, clientAddr, err)
+			return
+		case "GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "TRACE":
+			if req.Method == "GET" && req.RequestURI == pacPath && s.GetConfig().ServePAC {
+				LogInfo("[PAC] %s 获取 PAC 脚本", clientAddr)
+				s.servePAC(conn, req.Host)
+				return
+			}
+			if !proxy.serve(req) {
+				return
 			}
+		default:
+			LogInfo("[HTTP] %s 不支持的方法: %s", clientAddr, req.Method)
+			conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+			return
 		}
-	default:
-		LogInfo("[HTTP] %s 不支持的方法: %s", clientAddr, method)
-		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		// 等待同一连接上的下一个请求，超时与首个请求的握手阶段相同
+		conn.SetReadDeadline(time.Now().Add(s.phaseTimeout(phaseHandshake)))
 	}
 }
 
-func (s *ProxyServer) handleTunnel(conn net.Conn, target, clientAddr string, mode int, firstFrame string) error {
-	targetHost, _, err := net.SplitHostPort(target)
-	if err != nil {
-		targetHost = target
-	}
+func (s *ProxyServer) handleTunnel(ctx context.Context, conn net.Conn, target, clientAddr string, mode int, firstFrame string) (err error) {
+	targetHost, _ := splitTarget(target, "")
+	// 整个连接使用同一份配置，Reload 只影响之后的连接
+	cfg := s.GetConfig()
+
+	deadline := s.enterPhase(conn, phaseEstablish)
 
 	// 记录连接
 	s.trafficStats.RecordConnection(targetHost)
 
-	if s.shouldBypassProxy(targetHost) {
-		LogInfo("[分流] %s -> %s (直连，绕过代理)", clientAddr, target)
-		return s.handleDirectConnection(conn, target, clientAddr, mode, firstFrame, targetHost)
+	// bypass_cn 下 IP 目标只能按 IP 分流；客户端已发出 TLS ClientHello 时改按其中的 SNI 分流，
+	// 读到的数据作为首帧转发。HTTP CONNECT 的客户端要等到响应才发送数据，不适用
+	routeHost, peeked := targetHost, false
+	if firstFrame == "" && (mode == modeSOCKS5 || mode == modeTransparent) && cfg.RoutingMode == RoutingModeBypassCN &&
+		net.ParseIP(targetHost) != nil && !s.isPrivateIP(targetHost) {
+		sni, buffered := peekSNI(conn, firstFrameWait)
+		conn.SetReadDeadline(deadline)
+		firstFrame, peeked = string(buffered), true
+		if sni != "" {
+			routeHost = sni
+		}
+	}
+
+	direct, reason, appRule := s.routeDecision(cfg, conn, routeHost)
+	if routeHost != targetHost {
+		reason += ", SNI " + routeHost
+	}
+	if direct && mode == modeSOCKS5Bind {
+		direct, reason = false, "BIND 须经服务端"
+	}
+	connID := connIDFrom(ctx)
+	s.history.routeDecisions.Add(RouteDecision{ConnID: connID, Time: time.Now(), Host: targetHost, Direct: direct, Reason: reason})
+	record := ConnectionRecord{ConnID: connID, ClientAddr: clientAddr, Target: target, Direct: direct, StartedAt: time.Now()}
+	st := s.newConnStats(conn, connID, clientAddr, target, direct, record.StartedAt)
+	defer func() {
+		record.EndedAt = time.Now()
+		summary := st.snapshot(record.EndedAt)
+		record.HandshakeTime, record.Throughput = summary.HandshakeTime, summary.Throughput
+		record.Upload, record.Download = summary.Upload, summary.Download
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if s.connKilled(conn) {
+			// 关闭连接导致的读写错误不是失败
+			record.CloseReason, record.Error = CloseKilled, ""
+		}
+		if record.CloseReason == "" {
+			// 未进入转发阶段，建立连接失败
+			record.CloseReason = closeReasonFor(CloseError, err)
+		}
+		s.history.recentConns.Add(record)
+	}()
+
+	if direct {
+		logConnInfo(ctx, "[分流] %s -> %s (直连，绕过代理)", clientAddr, target)
+		record.CloseReason, err = s.handleDirectConnection(ctx, conn, target, clientAddr, mode, firstFrame, targetHost, deadline, st)
+		return err
 	}
 
-	LogInfo("[分流] %s -> %s (通过代理)", clientAddr, target)
-	wsConn, err := s.dialWebSocketWithECH(2)
+	if plaintextScreened(cfg, target, targetHost, mode) {
+		// 连接服务端之前识别明文协议，需要首个数据包时提前读取
+		if firstFrame == "" && !peeked && (mode == modeSOCKS5 || mode == modeTransparent) {
+			firstFrame, peeked = readFirstFrame(conn, deadline), true
+		}
+		if err := s.checkPlaintext(ctx, target, mode, []byte(firstFrame)); err != nil {
+			sendBlockedResponse(conn, mode)
+			return err
+		}
+	}
+
+	logConnInfo(ctx, "[分流] %s -> %s (通过代理)", clientAddr, target)
+	dialStart := time.Now()
+	wsConn, server, headers, err := s.dialWebSocketWithECH(ctx, target, true)
+	record.DialTime, record.FailureClass = time.Since(dialStart), upstreamFailureClass(err)
 	if err != nil {
+		if fallbackAllowed(ctx, cfg, mode, appRule, record.FailureClass) {
+			logConnError(ctx, "[警告] 服务端不可用 (%v)，%s -> %s 已降级为直连，流量未经代理", err, clientAddr, target)
+			record.Direct = true
+			st.setDirect()
+			s.trafficStats.RecordFallback()
+			record.CloseReason, err = s.handleDirectConnection(ctx, conn, target, clientAddr, mode, firstFrame, targetHost, deadline, st)
+			return err
+		}
 		sendErrorResponse(conn, mode)
 		return err
 	}
-	defer wsConn.Close()
+	record.Upstream = server
+	s.trafficStats.RecordServerConnection(server)
+	link := newTunnelLink(s, wsConn, server, target)
+	defer link.Close()
+	s.attachUpstream(conn, link)
+	s.setUpstreamHeaders(conn, headers)
 
-	var mu sync.Mutex
-	ctx, cancel := context.WithCancel(context.Background())
+	writeFrame := link.writeFrame
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Ping goroutine
 	go func() {
-		ticker := time.NewTicker(pingInterval)
+		ticker := time.NewTicker(link.pingInterval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				mu.Lock()
-				wsConn.WriteMessage(websocket.PingMessage, nil)
-				mu.Unlock()
+				link.ping()
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
 
-	conn.SetDeadline(time.Time{})
-
 	// 尝试读取首帧数据
-	if firstFrame == "" && mode == modeSOCKS5 {
-		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-		buffer := make([]byte, readBufferSize)
-		if n, _ := conn.Read(buffer); n > 0 {
-			firstFrame = string(buffer[:n])
-		}
-		conn.SetReadDeadline(time.Time{})
+	if firstFrame == "" && !peeked && (mode == modeSOCKS5 || mode == modeTransparent) {
+		firstFrame = readFirstFrame(conn, deadline)
 	}
 
 	// 发送连接请求
-	connectMsg := fmt.Sprintf("CONNECT:%s|%s", target, firstFrame)
-	mu.Lock()
-	err = wsConn.WriteMessage(websocket.TextMessage, []byte(connectMsg))
-	mu.Unlock()
+	request := protocol.Frame{Op: protocol.OpConnect, Target: target, Payload: []byte(firstFrame)}
+	if mode == modeSOCKS5Bind {
+		request = protocol.Frame{Op: protocol.OpBind, Target: target}
+	}
+	err = writeFrame(request)
 	if err != nil {
 		sendErrorResponse(conn, mode)
 		return err
@@ -1327,54 +2197,104 @@ func (s *ProxyServer) handleTunnel(conn net.Conn, target, clientAddr string, mod
 
 	// 记录首帧上传流量
 	if firstFrame != "" {
-		s.trafficStats.RecordUpload(targetHost, int64(len(firstFrame)))
+		s.trafficStats.RecordTunnelUpload(targetHost, server, int64(len(firstFrame)))
+		st.addUpload(int64(len(firstFrame)))
 	}
 
-	// 等待连接响应
-	_, msg, err := wsConn.ReadMessage()
+	// 等待连接响应，服务端无响应时在建立阶段截止时间失败
+	wsConn.SetReadDeadline(deadline)
+	mt, msg, err := wsConn.ReadMessage()
 	if err != nil {
 		sendErrorResponse(conn, mode)
 		return err
 	}
+	link.watchLiveness(wsConn)
 
-	response := string(msg)
-	if strings.HasPrefix(response, "ERROR:") {
+	response, err := link.codec.Decode(mt, msg)
+	if err == nil && mode == modeSOCKS5Bind && response.Op == protocol.OpBound {
+		logConnInfo(ctx, "[SOCKS5] %s BIND 在服务端 %s 等待 %s 连入", clientAddr, response.Target, target)
+		if response, err = s.awaitBindPeer(ctx, conn, wsConn, link.codec, response.Target); err != nil {
+			sendErrorResponse(conn, mode)
+			return fmt.Errorf("等待 BIND 连入: %w", err)
+		}
+		link.watchLiveness(wsConn)
+	}
+	if err != nil {
 		sendErrorResponse(conn, mode)
-		return errors.New(response)
+		return fmt.Errorf("无效响应: %w", err)
 	}
-	if response != "CONNECTED" {
+	if response.Op == protocol.OpError {
 		sendErrorResponse(conn, mode)
-		return fmt.Errorf("意外响应: %s", response)
+		return errors.New(protocol.MsgError + string(response.Payload))
 	}
+	if response.Op != protocol.OpConnected {
+		sendErrorResponse(conn, mode)
+		return fmt.Errorf("意外响应: %.64q", msg)
+	}
+	handshake := time.Since(dialStart)
+	st.established(handshake)
+	s.history.handshakes.Add(handshake)
 
-	if err := sendSuccessResponse(conn, mode); err != nil {
+	// 可恢复隧道的 CONNECTED 携带恢复令牌
+	if base, _ := protocol.SplitSubprotocol(wsConn.Subprotocol()); base == protocol.ResumeSubprotocol && len(response.Payload) > 0 {
+		link.enableResume(string(response.Payload), s.GetConfig().ResumeBufferSize)
+	}
+
+	if mode == modeSOCKS5Bind {
+		// 第二个应答的 BND 为实际连入的对端地址
+		err = writeSOCKS5Reply(conn, 0x00, response.Target)
+	} else {
+		err = sendSuccessResponse(conn, mode)
+	}
+	if err != nil {
 		return err
 	}
-	LogInfo("[代理] %s 已连接: %s", clientAddr, target)
+	logConnInfo(ctx, "[代理] %s 已连接: %s%s", clientAddr, target, upstreamTag(headers))
 
 	// 双向数据转发
-	done := make(chan struct{})
-	var closeOnce sync.Once
-	closeDone := func() { closeOnce.Do(func() { close(done) }) }
+	closer := newConnCloser()
+	done := closer.done
+	var clientEOF atomic.Bool // 客户端已半关闭写方向
+
+	// 空闲超时后通知服务端关闭
+	idle := s.newIdleTimer(ctx, conn, clientAddr, func() {
+		writeFrame(protocol.Frame{Op: protocol.OpClose})
+		closer.close(CloseIdle)
+	})
+	defer idle.stop()
+
+	// 服务器停止时通知服务端关闭，由 Stop 的等待超时兜底强制关闭
+	stopWatch := context.AfterFunc(ctx, func() {
+		writeFrame(protocol.Frame{Op: protocol.OpClose})
+		closer.close(CloseStopped)
+	})
+	defer stopWatch()
 
 	// Client -> WebSocket (上传)
+	upload := &coalescingReader{conn: conn, delay: uploadCoalesceDelay(s.GetConfig())}
 	go func() {
-		buf := make([]byte, readBufferSize)
+		buf := getRelayBuffer()
+		defer putRelayBuffer(buf)
 		for {
-			n, err := conn.Read(buf)
+			n, err := upload.Read(buf[:])
 			if err != nil {
-				mu.Lock()
-				wsConn.WriteMessage(websocket.TextMessage, []byte("CLOSE"))
-				mu.Unlock()
-				closeDone()
+				link.send(protocol.Frame{Op: protocol.OpClose}, done)
+				// 客户端半关闭写方向时继续接收下载数据，直到服务端发送 CLOSE 或断开
+				if err != io.EOF {
+					closer.close(closeReasonFor(CloseClient, err))
+				} else {
+					clientEOF.Store(true)
+				}
 				return
 			}
-			s.trafficStats.RecordUpload(targetHost, int64(n))
-			mu.Lock()
-			err = wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
-			mu.Unlock()
-			if err != nil {
-				closeDone()
+			idle.touch()
+			if !s.waitRateLimits(targetHost, false, true, n, done) {
+				return
+			}
+			s.trafficStats.RecordTunnelUpload(targetHost, server, int64(n))
+			st.addUpload(int64(n))
+			if err := link.send(protocol.Frame{Op: protocol.OpData, Payload: buf[:n]}, done); err != nil {
+				closer.close(closeReasonFor(CloseRemote, err))
 				return
 			}
 		}
@@ -1383,103 +2303,191 @@ func (s *ProxyServer) handleTunnel(conn net.Conn, target, clientAddr string, mod
 	// WebSocket -> Client (下载)
 	go func() {
 		for {
-			mt, msg, err := wsConn.ReadMessage()
+			f, err := link.readFrame(done)
 			if err != nil {
-				closeDone()
-				return
-			}
-			if mt == websocket.TextMessage && string(msg) == "CLOSE" {
-				closeDone()
+				reason := closeReasonFor(CloseRemote, err)
+				if reason == CloseTimeout || errors.Is(err, errInvalidFrame) {
+					logConnError(ctx, "[代理] %s %v", clientAddr, err)
+				}
+				closer.close(reason)
 				return
 			}
-			s.trafficStats.RecordDownload(targetHost, int64(len(msg)))
-			if _, err := conn.Write(msg); err != nil {
-				closeDone()
+			switch f.Op {
+			case protocol.OpClose:
+				closeWrite(conn)
+				// 客户端先半关闭时 CLOSE 是服务端的应答
+				if clientEOF.Load() {
+					closer.close(CloseClient)
+				} else {
+					closer.close(CloseRemote)
+				}
 				return
+			case protocol.OpData:
+				idle.touch()
+				if !s.waitRateLimits(targetHost, false, false, len(f.Payload), done) {
+					return
+				}
+				s.trafficStats.RecordTunnelDownload(targetHost, server, int64(len(f.Payload)))
+				st.addDownload(int64(len(f.Payload)))
+				if _, err := conn.Write(f.Payload); err != nil {
+					closer.close(closeReasonFor(CloseClient, err))
+					return
+				}
 			}
 		}
 	}()
 
 	<-done
-	LogInfo("[代理] %s 已断开: %s", clientAddr, target)
+	record.CloseReason = closer.reason
+	logConnInfo(ctx, "[代理] %s 已断开: %s (%s)", clientAddr, target, closer.reason)
 	return nil
 }
 
-func (s *ProxyServer) handleDirectConnection(conn net.Conn, target, clientAddr string, mode int, firstFrame string, targetHost string) error {
+// splitTarget 拆分目标地址的主机和端口，没有端口时使用 defaultPort。
+// [IPv6] 形式的主机去掉方括号，不会重复加上方括号
+func splitTarget(target, defaultPort string) (host, port string) {
 	host, port, err := net.SplitHostPort(target)
 	if err != nil {
-		host = target
-		port = "443"
-		if mode == modeHTTPProxy {
-			port = "80"
+		host, port = target, defaultPort
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
 		}
-		target = net.JoinHostPort(host, port)
 	}
+	return host, port
+}
+
+// fallbackAllowed 判断经代理的连接建立 WebSocket 失败后能否按 FallbackDirect 改为直连，failure 为失败分类。
+// 只在服务端不可达（网络错误、错误状态码）时降级：令牌被拒绝、TLS 失败（可能遭中间人攻击）等其他失败，
+// 以及 ctx 已取消（如代理停止）时不降级。BIND 须经服务端；proxyRule 表示该连接由应用规则指定经代理，同样不降级
+func fallbackAllowed(ctx context.Context, cfg Config, mode int, proxyRule bool, failure string) bool {
+	if !cfg.FallbackDirect || mode == modeSOCKS5Bind || proxyRule || ctx.Err() != nil {
+		return false
+	}
+	return failure == UpstreamFailureNetwork || failure == UpstreamFailureHTTPStatus
+}
 
-	targetConn, err := net.DialTimeout("tcp", target, dialTimeout)
+// handleDirectConnection 直连目标并转发，返回转发结束的原因
+func (s *ProxyServer) handleDirectConnection(ctx context.Context, conn net.Conn, target, clientAddr string, mode int, firstFrame string, targetHost string, deadline time.Time, st *connStats) (CloseReason, error) {
+	defaultPort := "443"
+	if mode == modeHTTPProxy {
+		defaultPort = "80"
+	}
+	host, port := splitTarget(target, defaultPort)
+	target = net.JoinHostPort(host, port)
+
+	dialStart := time.Now()
+	targetConn, err := s.dialDirect(host, port, deadline)
 	if err != nil {
 		sendErrorResponse(conn, mode)
-		return fmt.Errorf("直连失败: %w", err)
+		return "", fmt.Errorf("直连失败: %w", err)
 	}
+	st.established(time.Since(dialStart))
 	defer targetConn.Close()
+	s.attachUpstream(conn, targetConn)
 
 	if err := sendSuccessResponse(conn, mode); err != nil {
-		return err
+		return "", err
 	}
-
 	if firstFrame != "" {
 		if _, err := targetConn.Write([]byte(firstFrame)); err != nil {
-			return err
+			return "", err
 		}
 		s.trafficStats.RecordUpload(targetHost, int64(len(firstFrame)))
+		st.addUpload(int64(len(firstFrame)))
 	}
 
 	// 双向数据转发
-	done := make(chan struct{})
-	var closeOnce sync.Once
-	closeDone := func() { closeOnce.Do(func() { close(done) }) }
+	closer := newConnCloser()
+	done := closer.done
+	stopWatch := context.AfterFunc(ctx, func() { closer.close(CloseStopped) })
+	defer stopWatch()
+	idle := s.newIdleTimer(ctx, conn, clientAddr, func() { closer.close(CloseIdle) })
+	defer idle.stop()
+
+	// 一个方向读到 EOF 时只关闭对端的写方向，另一方向继续转发，两个方向都结束后才断开，
+	// 原因归属先读到 EOF 的一方；出错或连接不支持半关闭时立即断开
+	var finished int32
+	var firstEOF CloseReason
+	var firstEOFOnce sync.Once
+	finish := func(side CloseReason, err error, dst net.Conn) {
+		if err != nil || !closeWrite(dst) {
+			closer.close(closeReasonFor(side, err))
+			return
+		}
+		firstEOFOnce.Do(func() { firstEOF = side })
+		if atomic.AddInt32(&finished, 1) == 2 {
+			closer.close(firstEOF)
+		}
+	}
 
 	// 上传
 	go func() {
-		buf := make([]byte, readBufferSize)
-		for {
-			n, err := conn.Read(buf)
-			if err != nil {
-				closeDone()
-				return
-			}
-			s.trafficStats.RecordUpload(targetHost, int64(n))
-			if _, err := targetConn.Write(buf[:n]); err != nil {
-				closeDone()
-				return
-			}
-		}
+		limited := &rateLimitedWriter{w: targetConn, wait: func(n int) bool { return s.waitRateLimits(targetHost, true, true, n, done) }}
+		upload := &countingWriter{w: limited, record: func(n int64) {
+			idle.touch()
+			s.trafficStats.RecordUpload(targetHost, n)
+			st.addUpload(n)
+		}}
+		buf := getRelayBuffer()
+		_, err := io.CopyBuffer(upload, conn, buf[:])
+		putRelayBuffer(buf)
+		finish(CloseClient, err, targetConn)
 	}()
 	// 下载
 	go func() {
-		buf := make([]byte, readBufferSize)
-		for {
-			n, err := targetConn.Read(buf)
-			if err != nil {
-				closeDone()
-				return
-			}
-			s.trafficStats.RecordDownload(targetHost, int64(n))
-			if _, err := conn.Write(buf[:n]); err != nil {
-				closeDone()
-				return
-			}
-		}
+		limited := &rateLimitedWriter{w: conn, wait: func(n int) bool { return s.waitRateLimits(targetHost, true, false, n, done) }}
+		download := &countingWriter{w: limited, record: func(n int64) {
+			idle.touch()
+			s.trafficStats.RecordDownload(targetHost, n)
+			st.addDownload(n)
+		}}
+		buf := getRelayBuffer()
+		_, err := io.CopyBuffer(download, targetConn, buf[:])
+		putRelayBuffer(buf)
+		finish(CloseRemote, err, conn)
 	}()
 
 	<-done
-	LogInfo("[分流] %s 直连已断开: %s", clientAddr, target)
-	return nil
+	logConnInfo(ctx, "[分流] %s 直连已断开: %s (%s)", clientAddr, target, closer.reason)
+	return closer.reason, nil
+}
+
+// closeWrite 关闭连接的写方向（发送 FIN），连接不支持半关闭时返回 false
+func closeWrite(conn net.Conn) bool {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite() == nil
+	}
+	return false
+}
+
+// countingWriter 写入成功后记录流量。
+// 直连转发需要实时统计，因此不实现 io.ReaderFrom，以免 io.Copy 绕过计数
+type countingWriter struct {
+	w      io.Writer
+	record func(n int64)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.record(int64(n))
+	}
+	return n, err
+}
+
+// readFirstFrame 在 firstFrameWait 内读取客户端的首个数据包，没有数据时返回空，之后恢复截止时间 deadline
+func readFirstFrame(conn net.Conn, deadline time.Time) string {
+	conn.SetReadDeadline(time.Now().Add(firstFrameWait))
+	defer conn.SetReadDeadline(deadline)
+	buffer := getRelayBuffer()
+	defer putRelayBuffer(buffer)
+	n, _ := conn.Read(buffer[:])
+	return string(buffer[:n])
 }
 
 func sendErrorResponse(conn net.Conn, mode int) {
 	switch mode {
-	case modeSOCKS5:
+	case modeSOCKS5, modeSOCKS5Bind:
 		conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 	case modeHTTPConnect, modeHTTPProxy:
 		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
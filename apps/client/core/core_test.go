@@ -0,0 +1,342 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// testConfig 监听随机端口的客户端配置，服务端地址不可达，供不建立隧道的测试使用
+func testConfig(t *testing.T) Config {
+	return Config{
+		ListenAddr:  "127.0.0.1:0",
+		ServerAddr:  "ws://127.0.0.1:1/",
+		ServerIP:    "127.0.0.1",
+		Token:       "token",
+		RoutingMode: RoutingModeGlobal,
+		StoreDir:    t.TempDir(),
+	}
+}
+
+// startTestServer 按 cfg 启动 ProxyServer，测试结束时停止
+func startTestServer(t *testing.T, cfg Config) *ProxyServer {
+	t.Helper()
+	s := NewProxyServer(cfg)
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+// TestParseSOCKS5UDPHeader 三种地址类型的请求头，以及分片和不完整的请求头
+func TestParseSOCKS5UDPHeader(t *testing.T) {
+	v4 := []byte{0x00, 0x00, 0x00, 0x01, 192, 0, 2, 1, 0x00, 0x35}
+	domain := append([]byte{0x00, 0x00, 0x00, 0x03, 11}, "example.com\x01\xbb"...)
+	v6 := append(append([]byte{0x00, 0x00, 0x00, 0x04}, net.ParseIP("2001:db8::1")...), 0x1f, 0x90)
+	with := func(b []byte, payload string) []byte { return append(append([]byte{}, b...), payload...) }
+
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		ok        bool
+		host      string
+		port      int
+		headerLen int
+	}{
+		{"ipv4", with(v4, "query"), true, "192.0.2.1", 53, 10},
+		{"ipv4 empty payload", v4, true, "192.0.2.1", 53, 10},
+		{"domain", with(domain, "query"), true, "example.com", 443, 18},
+		{"ipv6", with(v6, "query"), true, "2001:db8::1", 8080, 22},
+		{"ipv6 empty payload", v6, true, "2001:db8::1", 8080, 22},
+		{"fragmented", append([]byte{0x00, 0x00, 0x01}, with(v4, "query")[3:]...), false, "", 0, 0},
+		{"unknown address type", append([]byte{0x00, 0x00, 0x00, 0x02}, with(v4, "query")[4:]...), false, "", 0, 0},
+		{"empty", nil, false, "", 0, 0},
+		{"ipv4 truncated", v4[:9], false, "", 0, 0},
+		{"domain truncated", domain[:len(domain)-1], false, "", 0, 0},
+		{"domain length past end", append([]byte{0x00, 0x00, 0x00, 0x03, 200}, "example.com\x01\xbb"...), false, "", 0, 0},
+		{"ipv6 truncated", v6[:21], false, "", 0, 0},
+		{"ipv6 address only", v6[:15], false, "", 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			host, port, headerLen, ok := parseSOCKS5UDPHeader(tc.data)
+			if ok != tc.ok || host != tc.host || port != tc.port || headerLen != tc.headerLen {
+				t.Fatalf("got %q, %d, %d, %v; want %q, %d, %d, %v",
+					host, port, headerLen, ok, tc.host, tc.port, tc.headerLen, tc.ok)
+			}
+			if !ok {
+				return
+			}
+			// 与 handleUDPRelay 相同的方式拼接目标地址，应能被 net.SplitHostPort 还原
+			target := net.JoinHostPort(host, strconv.Itoa(port))
+			gotHost, gotPort, err := net.SplitHostPort(target)
+			if err != nil || gotHost != tc.host || gotPort != strconv.Itoa(tc.port) {
+				t.Fatalf("SplitHostPort(%q) = %q, %q, %v", target, gotHost, gotPort, err)
+			}
+		})
+	}
+}
+
+// TestFallbackAppRule 应用规则指定经代理的连接在服务端不可用时不降级为直连，
+// 指定直连或未匹配规则的连接不受影响
+func TestFallbackAppRule(t *testing.T) {
+	if !processLookupSupported {
+		t.Skip("process lookup unsupported")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	self := filepath.Base(os.Args[0])
+	for _, tc := range []struct {
+		rules    string
+		direct   bool
+		appRule  bool
+		fallback bool
+	}{
+		{"proxy:" + self, false, true, false},
+		{"direct:" + self, true, true, false},
+		{"proxy:no-such-app", false, false, true},
+		{"", false, false, true},
+	} {
+		rules, err := ParseAppRules(tc.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := Config{RoutingMode: RoutingModeGlobal, AppRules: rules, FallbackDirect: true}
+		s := newDetachedServer(cfg)
+		direct, reason, appRule := s.routeDecision(cfg, conn, "203.0.113.10")
+		if direct != tc.direct || appRule != tc.appRule {
+			t.Errorf("rules %q: direct = %v, appRule = %v (%s), want %v, %v", tc.rules, direct, appRule, reason, tc.direct, tc.appRule)
+			continue
+		}
+		if !direct {
+			if got := fallbackAllowed(context.Background(), cfg, modeSOCKS5, appRule, UpstreamFailureNetwork); got != tc.fallback {
+				t.Errorf("rules %q: fallbackAllowed = %v, want %v", tc.rules, got, tc.fallback)
+			}
+		}
+	}
+}
+
+// TestFallbackFailureClass 只在服务端不可达时降级为直连：令牌被拒绝、TLS 失败（含公钥固定不匹配）、
+// 连接被取消以及 BIND 连接不降级
+func TestFallbackFailureClass(t *testing.T) {
+	cfg := Config{FallbackDirect: true}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		cfg  Config
+		mode int
+		err  error
+		want bool
+	}{
+		{"network", context.Background(), cfg, modeSOCKS5, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"http status", context.Background(), cfg, modeHTTPConnect, &upgradeStatusError{status: http.StatusBadGateway, err: errors.New("bad handshake")}, true},
+		{"unauthorized", context.Background(), cfg, modeSOCKS5, &upgradeStatusError{status: http.StatusUnauthorized, err: ErrUpstreamMisconfigured}, false},
+		{"pin mismatch", context.Background(), cfg, modeSOCKS5, fmt.Errorf("tls: %w", ErrPinMismatch), false},
+		{"ech rejected", context.Background(), cfg, modeSOCKS5, &tls.ECHRejectionError{}, false},
+		{"other", context.Background(), cfg, modeSOCKS5, errors.New("unexpected"), false},
+		{"canceled", canceled, cfg, modeSOCKS5, &net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled}, false},
+		{"bind", context.Background(), cfg, modeSOCKS5Bind, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, false},
+		{"disabled", context.Background(), Config{}, modeSOCKS5, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, false},
+	} {
+		if got := fallbackAllowed(tc.ctx, tc.cfg, tc.mode, false, upstreamFailureClass(tc.err)); got != tc.want {
+			t.Errorf("%s: fallbackAllowed = %v (class %q), want %v", tc.name, got, upstreamFailureClass(tc.err), tc.want)
+		}
+	}
+}
+
+// testdata/cloudflare-ech.com.bin 为 buildDNSQuery("cloudflare-ech.com", typeHTTPS) 的 DoH 应答，
+// 按 cloudflare-ech.com 发布的 HTTPS 记录组装：参数及其顺序、alpn 和地址提示与之相同，
+// ech 参数的 config_id 和公钥为占位值。编写时所在环境无法访问外网，抓取真实应答替换后需同步更新预期值：
+//
+//	curl -s -H 'accept: application/dns-message' \
+//		'https://cloudflare-dns.com/dns-query?dns=AAEBAAABAAAAAAAADmNsb3VkZmxhcmUtZWNoA2NvbQAAQQAB' \
+//		> testdata/cloudflare-ech.com.bin
+func cloudflareECHResponse(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "cloudflare-ech.com.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// httpsRDATA 返回 cloudflareECHResponse 中 HTTPS 记录的 RDATA：头部和问题与查询长度相同，
+// 之后为 2 字节名称压缩指针、8 字节类型/类/TTL 和 2 字节 RDATA 长度
+func httpsRDATA(t *testing.T, response []byte) []byte {
+	t.Helper()
+	offset := len(buildDNSQuery("cloudflare-ech.com", typeHTTPS)) + 10
+	n := int(binary.BigEndian.Uint16(response[offset:]))
+	if offset+2+n != len(response) {
+		t.Fatalf("RDATA length %d does not end the %d-byte response", n, len(response))
+	}
+	return response[offset+2:]
+}
+
+// svcbRDATA 组装 SvcPriority 为 1、TargetName 为 "." 的 HTTPS 记录 RDATA
+func svcbRDATA(params ...[]byte) []byte {
+	return slices.Concat(append([][]byte{{0x00, 0x01, 0x00}}, params...)...)
+}
+
+// TestParseDNSResponseHints 从 HTTPS 应答中取出 ipv4hint 和 ipv6hint 的地址，先 IPv4 后 IPv6
+func TestParseDNSResponseHints(t *testing.T) {
+	record, err := parseDNSResponse(cloudflareECHResponse(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"104.18.10.118", "104.18.11.118", "2606:4700::6812:a76", "2606:4700::6812:b76"}
+	if !slices.Equal(record.hints, want) {
+		t.Fatalf("hints = %q, want %q", record.hints, want)
+	}
+}
+
+// TestParseDNSResponseECH 从 HTTPS 应答中取出 alpn 和 ECHConfigList：alpn 按记录中的顺序，
+// 记录未设置 no-default-alpn，末尾加上 http/1.1；ECH 配置的公开名称为 cloudflare-ech.com
+func TestParseDNSResponseECH(t *testing.T) {
+	response := cloudflareECHResponse(t)
+	record, err := parseDNSResponse(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"h3", "h2", "http/1.1"}; !slices.Equal(record.alpn, want) {
+		t.Fatalf("alpn = %q, want %q", record.alpn, want)
+	}
+	names, err := echPublicNames(record.ech)
+	if err != nil || !slices.Equal(names, []string{"cloudflare-ech.com"}) {
+		t.Fatalf("ECH public names = %q, %v", names, err)
+	}
+	if err := checkECHPublicName(record.ech, "cloudflare-ech.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setECHConfig(&tls.Config{}, record.ech); err != nil {
+		t.Fatal(err)
+	}
+
+	// 去掉 ech 参数（改为未知的键）后记录仍是 HTTPS 记录，但没有 ECH 配置
+	noECH := slices.Clone(response)
+	rdata := httpsRDATA(t, noECH)
+	i := bytes.Index(rdata, append([]byte{0x00, 0x05}, binary.BigEndian.AppendUint16(nil, uint16(len(record.ech)))...))
+	if i < 0 {
+		t.Fatal("ech parameter not found in RDATA")
+	}
+	rdata[i+1] = 0xff
+	if _, err := parseDNSResponse(noECH); !errors.Is(err, errNoECHParam) {
+		t.Fatalf("without ech: err = %v, want errNoECHParam", err)
+	}
+}
+
+// TestParseHTTPSRecordALPN alpn 与 no-default-alpn 的组合：设置 no-default-alpn 时不加 http/1.1，
+// 已列出 http/1.1 时不重复，格式错误的 alpn 被忽略
+func TestParseHTTPSRecordALPN(t *testing.T) {
+	alpn := func(protos ...string) []byte {
+		var v []byte
+		for _, p := range protos {
+			v = append(append(v, byte(len(p))), p...)
+		}
+		return append(binary.BigEndian.AppendUint16([]byte{0x00, 0x01}, uint16(len(v))), v...)
+	}
+	noDefault := []byte{0x00, 0x02, 0x00, 0x00}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"no alpn", svcbRDATA(), []string{"http/1.1"}},
+		{"h2", svcbRDATA(alpn("h2")), []string{"h2", "http/1.1"}},
+		{"h2 no-default-alpn", svcbRDATA(alpn("h2"), noDefault), []string{"h2"}},
+		{"http/1.1 listed", svcbRDATA(alpn("http/1.1", "h2")), []string{"http/1.1", "h2"}},
+		{"zero-length protocol", svcbRDATA([]byte{0x00, 0x01, 0x00, 0x04, 0x02, 'h', '2', 0x00}), []string{"http/1.1"}},
+		{"protocol past value", svcbRDATA([]byte{0x00, 0x01, 0x00, 0x02, 0x05, 'h'}), []string{"http/1.1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseHTTPSRecord(tc.data).alpn; !slices.Equal(got, tc.want) {
+				t.Fatalf("alpn = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestParseDNSResponseTruncated 截断的应答返回错误而不会越界
+func TestParseDNSResponseTruncated(t *testing.T) {
+	response := cloudflareECHResponse(t)
+	for n := range len(response) {
+		if record, err := parseDNSResponse(response[:n]); err == nil {
+			t.Fatalf("%d of %d bytes: parsed %+v, want error", n, len(response), record)
+		}
+	}
+}
+
+// TestParseHTTPSRecordMalformed 格式错误或被截断的 SvcParams 不会越界：长度不符的地址提示被忽略，
+// 长度超出 RDATA 的参数及其后的参数被丢弃，之前的参数保留
+func TestParseHTTPSRecordMalformed(t *testing.T) {
+	param := func(key uint16, value ...byte) []byte {
+		b := binary.BigEndian.AppendUint16(nil, key)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+		return append(b, value...)
+	}
+	v4 := param(4, 192, 0, 2, 1)
+	v6 := param(6, net.ParseIP("2001:db8::1")...)
+
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		hints []string
+	}{
+		{"both hints", svcbRDATA(v4, v6), []string{"192.0.2.1", "2001:db8::1"}},
+		{"ipv4hint not a multiple of 4", svcbRDATA(param(4, 192, 0, 2), v6), []string{"2001:db8::1"}},
+		{"ipv6hint not a multiple of 16", svcbRDATA(v4, param(6, make([]byte, 15)...)), []string{"192.0.2.1"}},
+		{"empty hints", svcbRDATA(param(4), param(6)), nil},
+		{"length past end", svcbRDATA(v4, []byte{0x00, 0x06, 0x00, 0x20, 0x20, 0x01}), []string{"192.0.2.1"}},
+		{"truncated key", svcbRDATA(v4, []byte{0x00, 0x06, 0x00}), []string{"192.0.2.1"}},
+		{"target label past end", []byte{0x00, 0x01, 0x3f, 'a'}, nil},
+		{"only priority", []byte{0x00, 0x01}, nil},
+		{"empty", nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseHTTPSRecord(tc.data).hints; !slices.Equal(got, tc.hints) {
+				t.Fatalf("hints = %q, want %q", got, tc.hints)
+			}
+		})
+	}
+
+	// 在任意位置截断真实记录的 RDATA：不越界，且只保留截断处之前完整的地址提示
+	full := httpsRDATA(t, cloudflareECHResponse(t))
+	want := parseHTTPSRecord(full).hints
+	for n := range len(full) {
+		got := parseHTTPSRecord(full[:n]).hints
+		for _, h := range got {
+			if !slices.Contains(want, h) {
+				t.Fatalf("%d of %d bytes: hint %q not in the full record", n, len(full), h)
+			}
+		}
+		if len(got) == len(want) {
+			t.Fatalf("%d of %d bytes: all %d hints parsed from a truncated record", n, len(full), len(want))
+		}
+	}
+}
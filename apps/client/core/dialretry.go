@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 建立 WebSocket 的重试参数
+const (
+	defaultDialRetries    = 2
+	defaultDialRetryDelay = 500 * time.Millisecond
+	maxDialRetryDelay     = 10 * time.Second
+)
+
+// dialRetryPolicy 返回生效的重试次数和首次重试前的等待时间，为 0 的字段使用默认值
+func dialRetryPolicy(cfg Config) (retries int, base time.Duration) {
+	retries, base = cfg.DialRetries, cfg.DialRetryDelay
+	if retries == 0 {
+		retries = defaultDialRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	if base <= 0 {
+		base = defaultDialRetryDelay
+	}
+	return retries, base
+}
+
+// dialBackoff 返回第 n 次重试（从 1 开始）前的等待时间。等待时间从 base 开始每次翻倍，
+// 上限 maxDialRetryDelay，实际取其一半再加上不超过一半的随机抖动，避免大量连接同时重连
+func dialBackoff(base time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < maxDialRetryDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxDialRetryDelay)
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// isTransientDialError 判断建立 WebSocket 的错误重试后能否恢复。握手被拒绝时按状态码判断：
+// 5xx、429、408 可重试，401、403 等其他状态码立即失败。证书校验失败、公钥不匹配、
+// 服务端不支持 HTTP/2 WebSocket 也不重试；DNS、连接被拒绝、超时等网络错误和 ECH 被拒绝可重试
+func isTransientDialError(err error) bool {
+	var statusErr *upgradeStatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.status
+		return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+	var (
+		verifyErr  *tls.CertificateVerificationError
+		unknownCA  x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, ErrPinMismatch),
+		errors.Is(err, errH2WebSocketUnsupported),
+		errors.As(err, &verifyErr),
+		errors.As(err, &unknownCA),
+		errors.As(err, &hostErr),
+		errors.As(err, &invalidErr):
+		return false
+	case strings.Contains(err.Error(), "ECH"):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// sleepContext 等待 d，ctx 先结束时返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
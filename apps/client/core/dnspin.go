@@ -0,0 +1,202 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS 固定参数
+const (
+	defaultDNSPinTTL        = 10 * time.Minute
+	defaultDNSPinMaxEntries = 1024
+	dnsPinMaxFailures       = 2               // 固定的 IP 连续失败该次数后丢弃
+	dnsPinDialTimeout       = 3 * time.Second // 连接固定的 IP 的超时，超时后重新解析
+)
+
+// DNSPin 记住的主机可用 IP
+type DNSPin struct {
+	Host      string    `json:"host"`
+	IP        string    `json:"ip"`
+	LearnedAt time.Time `json:"learnedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Hits      int64     `json:"hits"`     // 直接使用该 IP 连接成功的次数
+	Failures  int       `json:"failures"` // 连续失败次数
+}
+
+// dnsPins 直连成功后记住的主机 IP，容量满时淘汰最早过期的记录
+type dnsPins struct {
+	mu      sync.Mutex
+	entries map[string]*DNSPin
+}
+
+func newDNSPins() *dnsPins {
+	return &dnsPins{entries: make(map[string]*DNSPin)}
+}
+
+// lookup 返回主机未过期的固定 IP
+func (p *dnsPins) lookup(host string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[host]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.ExpiresAt) {
+		delete(p.entries, host)
+		return "", false
+	}
+	return e.IP, true
+}
+
+// learn 记住主机实际连接成功的 IP，重置失败次数
+func (p *dnsPins) learn(host, ip string, ttl time.Duration, maxEntries int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if e, ok := p.entries[host]; ok {
+		if e.IP != ip {
+			LogInfo("[DNS] %s 固定 IP 更新: %s -> %s", host, e.IP, ip)
+			e.IP, e.LearnedAt, e.Hits = ip, now, 0
+		}
+		e.ExpiresAt, e.Failures = now.Add(ttl), 0
+		return
+	}
+	if len(p.entries) >= maxEntries {
+		var oldest *DNSPin
+		for _, e := range p.entries {
+			if oldest == nil || e.ExpiresAt.Before(oldest.ExpiresAt) {
+				oldest = e
+			}
+		}
+		delete(p.entries, oldest.Host)
+	}
+	p.entries[host] = &DNSPin{Host: host, IP: ip, LearnedAt: now, ExpiresAt: now.Add(ttl)}
+}
+
+// hit 记录一次直接使用固定 IP 的成功连接
+func (p *dnsPins) hit(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[host]; ok {
+		e.Hits++
+		e.Failures = 0
+	}
+}
+
+// fail 记录一次固定 IP 连接失败，连续失败 dnsPinMaxFailures 次后丢弃
+func (p *dnsPins) fail(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[host]
+	if !ok {
+		return
+	}
+	if e.Failures++; e.Failures >= dnsPinMaxFailures {
+		LogInfo("[DNS] %s 固定的 IP %s 连续 %d 次连接失败，已丢弃", host, e.IP, e.Failures)
+		delete(p.entries, host)
+	}
+}
+
+// snapshot 返回未过期的记录，按主机名排序
+func (p *dnsPins) snapshot() []DNSPin {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	pins := make([]DNSPin, 0, len(p.entries))
+	for _, e := range p.entries {
+		if now.Before(e.ExpiresAt) {
+			pins = append(pins, *e)
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Host < pins[j].Host })
+	return pins
+}
+
+func (p *dnsPins) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+func (p *dnsPins) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.entries)
+}
+
+// dnsPinSettings 返回固定 IP 的有效期和容量，不固定 host 时返回 false
+func dnsPinSettings(cfg Config, host string) (ttl time.Duration, maxEntries int, ok bool) {
+	if cfg.DNSPinTTL < 0 || net.ParseIP(host) != nil || matchHostPatterns(cfg.DNSPinExclude, host) {
+		return 0, 0, false
+	}
+	ttl, maxEntries = cfg.DNSPinTTL, cfg.DNSPinMaxEntries
+	if ttl == 0 {
+		ttl = defaultDNSPinTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultDNSPinMaxEntries
+	}
+	return ttl, maxEntries, true
+}
+
+// matchHostPatterns 判断 host 是否匹配任一规则，规则为主机名，或以 *. 开头匹配所有子域名
+func matchHostPatterns(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if pattern == host {
+			return true
+		}
+	}
+	return false
+}
+
+// dialDirect 直连目标。域名有固定的 IP 时先连接该 IP，失败后重新解析并按 Happy Eyeballs 连接；
+// 经解析连接成功后记住实际连接的 IP，之后的直连不再受 DNS 轮换到不可用 IP 的影响
+func (s *ProxyServer) dialDirect(host, port string, deadline time.Time) (net.Conn, error) {
+	cfg := s.GetConfig()
+	dialer := net.Dialer{Timeout: cmp.Or(cfg.DialTimeout, defaultDialTimeout), Deadline: deadline, Resolver: cfg.Resolver}
+	if cfg.UpstreamProxyDirect && cfg.UpstreamProxy != "" && cfg.UpstreamProxy != UpstreamProxyNone {
+		return s.dialUpstream(context.Background(), &dialer, net.JoinHostPort(host, port))
+	}
+	ttl, maxEntries, pin := dnsPinSettings(cfg, host)
+	if !pin {
+		return dialHappyEyeballs(context.Background(), &dialer, net.JoinHostPort(host, port))
+	}
+
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip, ok := s.dnsPins.lookup(key); ok {
+		pinned := dialer
+		pinned.Timeout = dnsPinDialTimeout
+		conn, err := pinned.Dial("tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			s.dnsPins.hit(key)
+			return conn, nil
+		}
+		LogInfo("[DNS] %s 固定的 IP %s 连接失败: %v，重新解析", host, ip, err)
+		s.dnsPins.fail(key)
+	}
+
+	conn, err := dialHappyEyeballs(context.Background(), &dialer, net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		s.dnsPins.learn(key, addr.IP.String(), ttl, maxEntries)
+	}
+	return conn, nil
+}
+
+// GetDNSPins 获取直连记住的主机 IP，用于调试。内部 API
+func (s *ProxyServer) GetDNSPins() []DNSPin {
+	return s.dnsPins.snapshot()
+}
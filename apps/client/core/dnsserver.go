@@ -0,0 +1,422 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsQueryPath DNSListenAddr 的 TCP 端口上提供 DoH (RFC 8484) 的路径
+	dnsQueryPath = "/dns-query"
+	// dnsCacheMaxEntries 本地 DNS 服务最多缓存的应答数
+	dnsCacheMaxEntries = 4096
+	// dnsCacheMaxTTL 缓存应答的最长时间，记录的 TTL 更长时按此计算
+	dnsCacheMaxTTL = time.Hour
+	// dnsMaxInflight 同时经 DoH 转发的 UDP 查询数上限，超出时丢弃查询，由客户端重试
+	dnsMaxInflight = 64
+	// dnsTCPIdleTimeout DNS over TCP 和 DoH 连接上等待下一个查询的时间
+	dnsTCPIdleTimeout = 10 * time.Second
+	// dnsMaxUDPSize 没有 EDNS 时 UDP 应答的长度上限，更长的应答截断并设置 TC，由客户端改用 TCP
+	dnsMaxUDPSize = 512
+)
+
+var errInvalidDNSQuery = errors.New("无效的 DNS 查询")
+
+// localDNS DNSListenAddr 上的本地 DNS 服务：UDP 接受普通 DNS 查询，同一端口的 TCP 接受 DNS over TCP 和 DoH
+type localDNS struct {
+	udp      net.PacketConn
+	tcp      net.Listener
+	inflight chan struct{}
+}
+
+// listenDNS 在 addr 的 TCP 和 UDP 上监听，端口为 0 时 UDP 使用 TCP 分配到的端口
+func listenDNS(addr string) (*localDNS, error) {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	_, port, _ := net.SplitHostPort(tcp.Addr().String())
+	udp, err := net.ListenPacket("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	return &localDNS{udp: udp, tcp: tcp, inflight: make(chan struct{}, dnsMaxInflight)}, nil
+}
+
+func (d *localDNS) close() {
+	d.udp.Close()
+	d.tcp.Close()
+}
+
+// DNSAddr 返回本地 DNS 服务的监听地址（UDP 使用相同端口），未运行或未设置 DNSListenAddr 时返回 nil
+func (s *ProxyServer) DNSAddr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state != lifecycleRunning || s.dns == nil {
+		return nil
+	}
+	return s.dns.tcp.Addr()
+}
+
+// serveDNS 运行本地 DNS 服务直到 ctx 取消或 d 被关闭（Reload 切换地址），退出前关闭其上的所有连接
+func (s *ProxyServer) serveDNS(ctx context.Context, d *localDNS) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	context.AfterFunc(ctx, d.close)
+	wg.Go(func() { s.serveDNSUDP(d) })
+	for {
+		conn, err := d.tcp.Accept()
+		if err != nil {
+			return nil
+		}
+		wg.Go(func() { s.serveDNSConn(ctx, conn) })
+	}
+}
+
+func (s *ProxyServer) serveDNSUDP(d *localDNS) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := d.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := bytes.Clone(buf[:n])
+		select {
+		case d.inflight <- struct{}{}:
+		default:
+			continue
+		}
+		go func() {
+			defer func() { <-d.inflight }()
+			resp := s.answerDNS(query, addr.String())
+			if resp != nil {
+				d.udp.WriteTo(truncateDNS(resp, udpPayloadSize(query)), addr)
+			}
+		}()
+	}
+}
+
+// serveDNSConn 处理一个 TCP 连接：以大写字母开头的是 DoH 的 HTTP 请求，否则按 DNS over TCP (RFC 7766) 读取带两字节长度前缀的查询。
+// 长度前缀的首字节为大写字母意味着查询超过 16KB，实际不会出现
+func (s *ProxyServer) serveDNSConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	clientAddr := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] >= 'A' && first[0] <= 'Z' {
+			if !s.serveDoHRequest(conn, reader, clientAddr) {
+				return
+			}
+			continue
+		}
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(reader, query); err != nil {
+			return
+		}
+		resp := s.answerDNS(query, clientAddr)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+// serveDoHRequest 读取并回应一个 DoH 请求（GET ?dns= 或 POST application/dns-message），返回连接能否继续使用
+func (s *ProxyServer) serveDoHRequest(conn net.Conn, reader *bufio.Reader, clientAddr string) bool {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return false
+	}
+	reply := func(status int, body []byte) bool {
+		keepAlive := status == http.StatusOK && !req.Close
+		var b strings.Builder
+		fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\nContent-Length: %d\r\n", status, http.StatusText(status), len(body))
+		if status == http.StatusOK {
+			b.WriteString("Content-Type: application/dns-message\r\nCache-Control: no-store\r\n")
+		}
+		if !keepAlive {
+			b.WriteString("Connection: close\r\n")
+		}
+		b.WriteString("\r\n")
+		if _, err := conn.Write(append([]byte(b.String()), body...)); err != nil {
+			return false
+		}
+		return keepAlive
+	}
+	var query []byte
+	switch {
+	case req.URL.Path != dnsQueryPath:
+		return reply(http.StatusNotFound, nil)
+	case req.Method == http.MethodGet:
+		if query, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns")); err != nil || len(query) == 0 {
+			return reply(http.StatusBadRequest, nil)
+		}
+	case req.Method == http.MethodPost:
+		if query, err = io.ReadAll(io.LimitReader(req.Body, 65535)); err != nil || len(query) == 0 {
+			return reply(http.StatusBadRequest, nil)
+		}
+	default:
+		return reply(http.StatusMethodNotAllowed, nil)
+	}
+	resp := s.answerDNS(query, clientAddr)
+	if resp == nil {
+		return reply(http.StatusBadRequest, nil)
+	}
+	return reply(http.StatusOK, resp)
+}
+
+// answerDNS 解析 query 并返回应答：经 DoH 查询失败时返回 SERVFAIL，格式错误时返回 FORMERR，
+// 连首部都无法解析时返回 nil
+func (s *ProxyServer) answerDNS(query []byte, clientAddr string) []byte {
+	resp, err := s.resolveDNS(query)
+	if err == nil {
+		return resp
+	}
+	rcode := dnsmessage.RCodeServerFailure
+	if errors.Is(err, errInvalidDNSQuery) {
+		rcode = dnsmessage.RCodeFormatError
+	} else {
+		LogError("[DNS] %s 查询失败: %v", clientAddr, err)
+	}
+	return dnsErrorResponse(query, rcode)
+}
+
+// resolveDNS 经 queryDoHForProxy 通过服务端解析 query，未过期的应答直接从缓存返回
+func (s *ProxyServer) resolveDNS(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, errInvalidDNSQuery
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, errInvalidDNSQuery
+	}
+	key := strings.ToLower(q.Name.String()) + " " + q.Type.String() + " " + q.Class.String()
+	if resp := s.dnsCache.get(key, h.ID); resp != nil {
+		LogDebug("[DNS] %s %s (缓存)", q.Name, q.Type)
+		return resp, nil
+	}
+	resp, err := s.queryDoHForProxy(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, errors.New("DoH 应答过短")
+	}
+	LogDebug("[DNS] %s %s (DoH 查询)", q.Name, q.Type)
+	s.dnsCache.put(key, resp)
+	return resp, nil
+}
+
+// dnsCache 按问题缓存 DoH 应答，有效期为应答中记录的最小 TTL，不超过 dnsCacheMaxTTL。
+// 返回时按已缓存的时间减少各记录的 TTL
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	resp     []byte
+	storedAt time.Time
+	expires  time.Time
+}
+
+// get 返回 key 未过期的缓存应答，ID 改为 id
+func (c *dnsCache) get(key string, id uint16) []byte {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || !time.Now().Before(e.expires) {
+		return nil
+	}
+	resp := bytes.Clone(e.resp)
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err == nil {
+		age := uint32(time.Since(e.storedAt) / time.Second)
+		for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+			for i := range section {
+				if section[i].Header.Type != dnsmessage.TypeOPT {
+					section[i].Header.TTL -= min(age, section[i].Header.TTL)
+				}
+			}
+		}
+		if packed, err := m.Pack(); err == nil {
+			resp = packed
+		}
+	}
+	binary.BigEndian.PutUint16(resp, id)
+	return resp
+}
+
+// put 缓存 key 的应答。只缓存成功和 NXDOMAIN 的完整应答，没有记录或 TTL 为 0 时不缓存；
+// 缓存已满时先丢弃过期的应答，仍然满时随机丢弃一个
+func (c *dnsCache) put(key string, resp []byte) {
+	ttl, ok := dnsResponseTTL(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]dnsCacheEntry)
+	}
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= dnsCacheMaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < dnsCacheMaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dnsCacheEntry{resp: bytes.Clone(resp), storedAt: now, expires: now.Add(ttl)}
+}
+
+// reset 丢弃全部缓存的应答
+func (c *dnsCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// dnsResponseTTL 返回应答可缓存的时间：应答和授权部分记录的最小 TTL，SOA 记录另外不超过其 MINIMUM (RFC 2308)
+func dnsResponseTTL(resp []byte) (time.Duration, bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || m.Truncated {
+		return 0, false
+	}
+	if m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	ttl, found := uint32(0), false
+	for _, r := range append(m.Answers, m.Authorities...) {
+		t := r.Header.TTL
+		if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			t = min(t, soa.MinTTL)
+		}
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	return min(time.Duration(ttl)*time.Second, dnsCacheMaxTTL), true
+}
+
+// dnsErrorResponse 生成 query 的错误应答，只包含问题部分；首部无法解析时返回 nil
+func dnsErrorResponse(query []byte, rcode dnsmessage.RCode) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	questions, _ := p.AllQuestions()
+	return buildDNSReply(dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	}, questions)
+}
+
+// truncateDNS 应答超过 size 时只保留首部和问题部分并设置 TC
+func truncateDNS(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return resp[:size]
+	}
+	questions, _ := p.AllQuestions()
+	h.Truncated = true
+	if reply := buildDNSReply(h, questions); reply != nil {
+		return reply
+	}
+	return resp[:size]
+}
+
+func buildDNSReply(h dnsmessage.Header, questions []dnsmessage.Question) []byte {
+	b := dnsmessage.NewBuilder(nil, h)
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil
+		}
+	}
+	reply, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return reply
+}
+
+// udpPayloadSize 返回 query 的 EDNS OPT 记录声明的 UDP 应答长度上限，没有时为 dnsMaxUDPSize
+func udpPayloadSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return dnsMaxUDPSize
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return dnsMaxUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsMaxUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(int(h.Class), dnsMaxUDPSize)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsMaxUDPSize
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dohEndpoint DNSServer 中的一个 DoH 服务器，格式为 [https://]主机[:端口][@IP][/路径]。
+// 指定 @IP 时直接连接该 IP（TLS 仍验证主机名），不解析主机，用于系统 DNS 无法解析或被污染的 DoH 主机
+type dohEndpoint struct {
+	name string // DNSServer 中的原样写法，用于日志和状态
+	url  string
+	ip   string
+}
+
+// parseDoHServers 解析逗号分隔的 DNSServer，为空时返回 nil
+func parseDoHServers(spec string) ([]dohEndpoint, error) {
+	var endpoints []dohEndpoint
+	for entry := range strings.SplitSeq(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		scheme, rest := "https://", entry
+		if i := strings.Index(entry, "://"); i >= 0 {
+			scheme, rest = entry[:i+3], entry[i+3:]
+		}
+		authority, path := rest, ""
+		if i := strings.Index(rest, "/"); i >= 0 {
+			authority, path = rest[:i], rest[i:]
+		}
+		e := dohEndpoint{name: entry}
+		if host, ip, ok := strings.Cut(authority, "@"); ok {
+			ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("无效的 DNSServer %q: @ 后应为 IP 地址", entry)
+			}
+			authority, e.ip = host, ip
+		}
+		e.url = scheme + authority + path
+		if u, err := url.Parse(e.url); err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return nil, fmt.Errorf("无效的 DNSServer %q", entry)
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// queryECHRecord 依次向 DNSServer 中的 DoH 服务器查询 domain 的 HTTPS 记录，从最近一次查询成功的服务器开始。
+// 服务器不可达、限流或返回错误时尝试下一个；返回了查询结果（包括没有 ECH 配置）时不再尝试其他服务器。
+// 返回给出结果的服务器
+func (s *ProxyServer) queryECHRecord(domain string) (httpsRecord, dohEndpoint, error) {
+	endpoints, err := parseDoHServers(s.GetConfig().DNSServer)
+	if err != nil {
+		return httpsRecord{}, dohEndpoint{}, err
+	}
+	if len(endpoints) == 0 {
+		return httpsRecord{}, dohEndpoint{}, errors.New("未设置 DNSServer")
+	}
+	s.echListMu.RLock()
+	preferred := s.dohPreferred
+	s.echListMu.RUnlock()
+	for i, e := range endpoints {
+		if e.name == preferred {
+			endpoints = append(append([]dohEndpoint{e}, endpoints[:i]...), endpoints[i+1:]...)
+			break
+		}
+	}
+
+	var errs []error
+	for i, e := range endpoints {
+		record, err := s.queryHTTPSRecord(domain, e)
+		if err == nil || errors.Is(err, errNoSuchDomain) || errors.Is(err, errNoHTTPSRecord) || errors.Is(err, errNoECHParam) {
+			if err == nil {
+				s.echListMu.Lock()
+				s.dohPreferred = e.name
+				s.echListMu.Unlock()
+			}
+			return record, e, err
+		}
+		if len(endpoints) == 1 {
+			return httpsRecord{}, e, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e.name, err))
+		if i < len(endpoints)-1 {
+			LogError("[ECH] DoH 服务器 %s 查询 %s 失败: %v，尝试下一个", e.name, domain, err)
+		}
+	}
+	return httpsRecord{}, dohEndpoint{}, errors.Join(errs...)
+}
+
+// bootstrapClient 返回连接 e.ip 而不解析主机名的 DoH 客户端，需要代理时同样经代理连接，用完后调用 release 关闭其连接
+func (s *ProxyServer) bootstrapClient(e dohEndpoint) (client *http.Client, release func()) {
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return s.dialUpstream(ctx, &net.Dialer{Timeout: s.dialTimeout()}, net.JoinHostPort(e.ip, port))
+	}}
+	return &http.Client{Transport: transport}, transport.CloseIdleConnections
+}
@@ -0,0 +1,14 @@
+//go:build go1.23
+
+package core
+
+import "crypto/tls"
+
+// echSupported 使用 Go 1.23+ 编译时为 true
+const echSupported = true
+
+// 编译期断言：tls.Config 必须包含 ECH 字段
+var _ = tls.Config{
+	EncryptedClientHelloConfigList:      nil,
+	EncryptedClientHelloRejectionVerify: nil,
+}
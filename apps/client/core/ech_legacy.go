@@ -0,0 +1,6 @@
+//go:build !go1.23
+
+package core
+
+// echSupported 低于 Go 1.23 的版本不支持 ECH
+const echSupported = false
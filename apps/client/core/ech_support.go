@@ -0,0 +1,30 @@
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+// echConfigFields setECHConfig 依赖的 tls.Config 字段
+var echConfigFields = []string{"EncryptedClientHelloConfigList", "EncryptedClientHelloRejectionVerify"}
+
+// hasECHFields 检查运行时的 tls.Config 是否包含 ECH 相关字段
+func hasECHFields() bool {
+	configType := reflect.TypeOf(tls.Config{})
+	for _, name := range echConfigFields {
+		if _, ok := configType.FieldByName(name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckECHSupport 检查当前构建的 Go/TLS 是否支持 ECH，在进行任何 DNS 查询之前调用
+func CheckECHSupport() error {
+	if !echSupported || !hasECHFields() {
+		return fmt.Errorf("当前构建的 Go/TLS 不支持 ECH (%s)，请使用 Go 1.23+ 重新编译", runtime.Version())
+	}
+	return nil
+}
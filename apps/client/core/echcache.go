@@ -0,0 +1,89 @@
+package core
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// echCacheFile StoreDir 中缓存 ECH 配置的文件。DoH 服务器暂时不可达时使用缓存的配置启动，
+// 而不是降级为普通 TLS 或（RequireECH 时）启动失败
+const echCacheFile = "ech_cache.json"
+
+// defaultECHCacheMaxAge 缓存的 ECH 配置默认可使用的最长时间
+const defaultECHCacheMaxAge = 7 * 24 * time.Hour
+
+// echCacheEntry 缓存文件中一个查询域名最近一次查询成功的结果
+type echCacheEntry struct {
+	List      []byte    `json:"list"`
+	ALPN      []string  `json:"alpn,omitempty"`
+	Hints     []string  `json:"hints,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// echCacheMaxAge 返回生效的 ECHCacheMaxAge，0 表示不使用缓存
+func (s *ProxyServer) echCacheMaxAge() time.Duration {
+	switch age := s.GetConfig().ECHCacheMaxAge; {
+	case age < 0:
+		return 0
+	case age == 0:
+		return defaultECHCacheMaxAge
+	default:
+		return age
+	}
+}
+
+func (s *ProxyServer) echCachePath() string {
+	return filepath.Join(s.GetConfig().StoreDir, echCacheFile)
+}
+
+// readECHCache 读取缓存文件，文件不存在或损坏时返回空缓存
+func (s *ProxyServer) readECHCache() map[string]echCacheEntry {
+	cache := make(map[string]echCacheEntry)
+	data, err := os.ReadFile(s.echCachePath())
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		LogError("[ECH] 缓存文件 %s 已损坏，忽略: %v", s.echCachePath(), err)
+		return make(map[string]echCacheEntry)
+	}
+	return cache
+}
+
+// cachedECH 返回 domain 未超过 ECHCacheMaxAge 的缓存
+func (s *ProxyServer) cachedECH(domain string) (echCacheEntry, bool) {
+	maxAge := s.echCacheMaxAge()
+	if maxAge == 0 {
+		return echCacheEntry{}, false
+	}
+	s.echCacheMu.Lock()
+	e, ok := s.readECHCache()[domain]
+	s.echCacheMu.Unlock()
+	if !ok || len(e.List) == 0 || time.Since(e.FetchedAt) > maxAge {
+		return echCacheEntry{}, false
+	}
+	return e, true
+}
+
+// saveECHCache 把 domain 查询成功的结果写入缓存文件，同时丢弃超过 ECHCacheMaxAge 的其他域名
+func (s *ProxyServer) saveECHCache(domain string, e echCacheEntry) {
+	maxAge := s.echCacheMaxAge()
+	if maxAge == 0 {
+		return
+	}
+	s.echCacheMu.Lock()
+	defer s.echCacheMu.Unlock()
+	cache := s.readECHCache()
+	maps.DeleteFunc(cache, func(_ string, e echCacheEntry) bool { return time.Since(e.FetchedAt) > maxAge })
+	cache[domain] = e
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.echCachePath(), data)
+	}
+	if err != nil {
+		LogError("[ECH] 保存缓存 %s 失败: %v", s.echCachePath(), err)
+	}
+}
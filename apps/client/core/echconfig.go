@@ -0,0 +1,66 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// echConfigVersion 当前 ECH 草案 (draft-ietf-tls-esni-18) 的 ECHConfig 版本，客户端会跳过其他版本的配置
+const echConfigVersion = 0xfe0d
+
+// echPublicNames 解析 ECHConfigList，返回其中各个可用配置的公开名称 (public_name)，即外层 ClientHello 的 SNI
+func echPublicNames(list []byte) ([]string, error) {
+	errMalformed := errors.New("ECH 配置格式错误")
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, errMalformed
+	}
+	var names []string
+	for rest := list[2:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, errMalformed
+		}
+		version, n := binary.BigEndian.Uint16(rest), int(binary.BigEndian.Uint16(rest[2:]))
+		if len(rest) < 4+n {
+			return nil, errMalformed
+		}
+		contents := rest[4 : 4+n]
+		rest = rest[4+n:]
+		if version != echConfigVersion {
+			continue
+		}
+		// config_id(1) kem_id(2) public_key(2+n) cipher_suites(2+n) maximum_name_length(1) public_name(1+n)
+		off := 3
+		for range 2 {
+			if len(contents) < off+2 {
+				return nil, errMalformed
+			}
+			off += 2 + int(binary.BigEndian.Uint16(contents[off:]))
+		}
+		off++
+		if len(contents) < off+1 || len(contents) < off+1+int(contents[off]) {
+			return nil, errMalformed
+		}
+		names = append(names, string(contents[off+1:off+1+int(contents[off])]))
+	}
+	if len(names) == 0 {
+		return nil, errors.New("ECH 配置中没有支持的版本")
+	}
+	return names, nil
+}
+
+// checkECHPublicName 检查 ECHConfigList 中每个可用配置的公开名称都是 want，不区分大小写
+func checkECHPublicName(list []byte, want string) error {
+	names, err := echPublicNames(list)
+	if err != nil {
+		return err
+	}
+	want = strings.TrimSuffix(want, ".")
+	for _, name := range names {
+		if !strings.EqualFold(strings.TrimSuffix(name, "."), want) {
+			return fmt.Errorf("ECH 配置的公开名称为 %s，与 ECHPublicName %s 不一致，请检查 ECHDomain 和 DNSServer", name, want)
+		}
+	}
+	return nil
+}
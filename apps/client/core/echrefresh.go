@@ -0,0 +1,149 @@
+package core
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// defaultECHRefreshInterval ECHRefreshInterval 为 0 时后台刷新 ECH 配置的间隔
+	defaultECHRefreshInterval = time.Hour
+	// echRefreshRetryDelay 刷新失败后首次重试前的等待时间，之后每次失败翻倍，不超过刷新间隔
+	echRefreshRetryDelay = time.Minute
+	// echRefreshPollInterval 检查 ECHRefreshInterval 是否被 Reload 修改的最长间隔
+	echRefreshPollInterval = time.Second
+)
+
+// ECHStatus 后台刷新 ECH 配置的状态，见 Config.ECHRefreshInterval
+type ECHStatus struct {
+	RefreshInterval     time.Duration     `json:"refreshInterval"`     // 生效的刷新间隔（纳秒），0 表示不在后台刷新
+	LastRefreshAt       time.Time         `json:"lastRefreshAt"`       // 最近一次后台刷新的时间，尚未刷新时为零值
+	NextRefreshAt       time.Time         `json:"nextRefreshAt"`       // 下一次后台刷新的时间，不刷新时为零值
+	ConsecutiveFailures int               `json:"consecutiveFailures"` // 后台刷新连续失败的次数，成功后清零
+	LastError           string            `json:"lastError"`           // 最近一次后台刷新失败的原因，成功后清空
+	Domains             []ECHDomainStatus `json:"domains"`             // 当前配置使用的各查询域名，按服务端顺序排列
+}
+
+// ECHDomainStatus 一个 ECH 查询域名当前使用的配置
+type ECHDomainStatus struct {
+	Domain     string    `json:"domain"`
+	ConfigSize int       `json:"configSize"` // ECH 配置的长度（字节），尚未加载时为 0
+	LoadedAt   time.Time `json:"loadedAt"`   // 配置最近一次加载成功的时间，来自缓存时为缓存中记录的查询时间
+	Cached     bool      `json:"cached"`     // 配置来自 StoreDir 中的缓存，见 Config.ECHCacheMaxAge
+	Resolver   string    `json:"resolver"`   // 查询到当前配置的 DoH 服务器（Config.DNSServer 中的写法），来自缓存或尚未加载时为空
+	LastError  string    `json:"lastError"`  // 最近一次加载失败的原因，成功后清空
+}
+
+// echRefreshState 后台刷新的进度，由 echListMu 保护
+type echRefreshState struct {
+	lastAt   time.Time
+	nextAt   time.Time
+	failures int
+	lastErr  string
+}
+
+// echRefreshInterval 后台刷新的间隔，0 表示不刷新
+func echRefreshInterval(cfg Config) time.Duration {
+	switch {
+	case cfg.ECHRefreshInterval < 0:
+		return 0
+	case cfg.ECHRefreshInterval == 0:
+		return defaultECHRefreshInterval
+	}
+	return cfg.ECHRefreshInterval
+}
+
+// echRefreshDelay 返回连续失败 failures 次后到下一次刷新的等待时间：成功后等待 interval，
+// 失败后从 echRefreshRetryDelay 开始每次翻倍，不超过 interval。在 ±10% 内随机抖动，避免大量客户端同时查询
+func echRefreshDelay(interval time.Duration, failures int) time.Duration {
+	d := interval
+	if failures > 0 {
+		d = min(echRefreshRetryDelay, interval)
+		for i := 1; i < failures && d < interval; i++ {
+			d *= 2
+		}
+		d = min(d, interval)
+	}
+	return d - d/10 + rand.N(d/5+1)
+}
+
+// refreshECHPeriodically 按 ECHRefreshInterval 在后台刷新全部 ECH 配置，密钥轮换后不必等到连接被拒绝才更新。
+// 每轮读取当前配置，Reload 修改间隔后重新计时；使用 ws:// 或当前构建不支持 ECH 时不刷新
+func (s *ProxyServer) refreshECHPeriodically(ctx context.Context) error {
+	interval := time.Duration(-1) // 首轮总是按当前配置重新计时
+	var next time.Time
+	failures := 0
+	for {
+		cfg := s.GetConfig()
+		servers := serverAddrs(cfg.ServerAddr)
+		current := echRefreshInterval(cfg)
+		if len(servers) > 0 && !addrUsesTLS(servers[0]) || CheckECHSupport() != nil {
+			current = 0
+		}
+		if current != interval {
+			interval, failures, next = current, 0, time.Time{}
+			if interval > 0 {
+				next = time.Now().Add(echRefreshDelay(interval, 0))
+			}
+			s.echListMu.Lock()
+			s.echRefresh.nextAt, s.echRefresh.failures, s.echRefresh.lastErr = next, 0, ""
+			s.echListMu.Unlock()
+		}
+
+		if interval > 0 && !time.Now().Before(next) {
+			err := s.refreshECH()
+			if err != nil {
+				failures++
+			} else {
+				failures = 0
+			}
+			next = time.Now().Add(echRefreshDelay(interval, failures))
+			s.echListMu.Lock()
+			s.echRefresh.lastAt, s.echRefresh.nextAt, s.echRefresh.failures = time.Now(), next, failures
+			s.echRefresh.lastErr = ""
+			if err != nil {
+				s.echRefresh.lastErr = err.Error()
+			}
+			s.echListMu.Unlock()
+			if err != nil {
+				LogError("[ECH] 后台刷新失败 (连续 %d 次): %v，%v 后重试", failures, err, time.Until(next).Round(time.Second))
+			}
+		}
+
+		wait := echRefreshPollInterval
+		if interval > 0 {
+			wait = max(min(time.Until(next), wait), time.Millisecond)
+		}
+		if !sleepContext(ctx, wait) {
+			return nil
+		}
+	}
+}
+
+// GetECHStatus 获取后台刷新 ECH 配置的状态和各查询域名当前使用的配置
+func (s *ProxyServer) GetECHStatus() ECHStatus {
+	cfg := s.GetConfig()
+	s.echListMu.RLock()
+	defer s.echListMu.RUnlock()
+	status := ECHStatus{
+		LastRefreshAt:       s.echRefresh.lastAt,
+		NextRefreshAt:       s.echRefresh.nextAt,
+		ConsecutiveFailures: s.echRefresh.failures,
+		LastError:           s.echRefresh.lastErr,
+	}
+	if !s.echRefresh.nextAt.IsZero() {
+		status.RefreshInterval = echRefreshInterval(cfg)
+	}
+	for _, domain := range echDomains(cfg) {
+		d := ECHDomainStatus{Domain: domain}
+		if e := s.echConfigs[domain]; e != nil {
+			d.ConfigSize, d.LoadedAt, d.Cached, d.Resolver = len(e.list), e.loadedAt, e.cached, e.resolver
+			if e.err != nil {
+				d.LastError = e.err.Error()
+			}
+		}
+		status.Domains = append(status.Domains, d)
+	}
+	return status
+}
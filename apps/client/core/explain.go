@@ -0,0 +1,236 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// explainAttempts ExplainHost 列出的最近连接数
+const explainAttempts = 5
+
+// ExplainHost 汇总最近几次访问 host 的连接，生成便于复制反馈的诊断文本：分流决策及规则、建立耗时、
+// 使用的服务端、失败分类和错误、该连接的日志，以及当前的上游健康和 ECH/DoH 状态。
+// host 可带端口，不区分大小写。各记录按连接 ID 关联，已被历史缓冲区淘汰的部分不再显示。
+// 文本格式供人阅读，可能随版本变化，程序不应解析
+func (s *ProxyServer) ExplainHost(host string) string {
+	host = normalizeExplainHost(host)
+	now := time.Now()
+	cfg := s.GetConfig()
+
+	decisions := map[uint64]RouteDecision{}
+	records := map[uint64]ConnectionRecord{}
+	active := map[uint64]ActiveConnection{}
+	var ids []uint64
+	for _, d := range s.GetRouteDecisions() {
+		if d.ConnID != 0 && normalizeExplainHost(d.Host) == host {
+			decisions[d.ConnID] = d
+			ids = append(ids, d.ConnID)
+		}
+	}
+	for _, r := range s.GetRecentConnections() {
+		if r.ConnID != 0 && normalizeExplainHost(r.Target) == host {
+			records[r.ConnID] = r
+			ids = append(ids, r.ConnID)
+		}
+	}
+	for _, c := range s.GetActiveConnections() {
+		if c.ConnID != 0 && normalizeExplainHost(c.Target) == host {
+			active[c.ConnID] = c
+			ids = append(ids, c.ConnID)
+		}
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	ids = ids[max(0, len(ids)-explainAttempts):]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "echPlus 连接诊断: %s\n", host)
+	fmt.Fprintf(&b, "生成时间: %s, core API %s, 分流模式: %s\n", now.Format(explainTimeFormat), Version, cfg.RoutingMode)
+
+	if len(ids) == 0 {
+		b.WriteString("\n没有该主机的连接记录\n")
+	} else {
+		fmt.Fprintf(&b, "\n最近 %d 次连接:\n", len(ids))
+	}
+	logs := recentLogs.Snapshot()
+	for _, id := range ids {
+		b.WriteString("\n")
+		s.explainConn(&b, id, decisions, records, active, logs)
+	}
+
+	b.WriteString("\n上游服务端:\n")
+	status := s.GetUpstreamStatus()
+	for _, h := range status.Servers {
+		current := ""
+		if h.Addr == status.ServerAddr {
+			current = " (当前)"
+		}
+		fmt.Fprintf(&b, "  %s%s 扣分 %d", h.Addr, current, h.Penalty)
+		if !h.LastDialAt.IsZero() {
+			fmt.Fprintf(&b, ", 最近连接 %s", h.LastDialAt.Format(explainTimeFormat))
+		}
+		if h.FailureClass != "" {
+			fmt.Fprintf(&b, ", 失败分类 %s", h.FailureClass)
+		}
+		if h.LastErrorCode != "" {
+			fmt.Fprintf(&b, ", 错误码 %s", h.LastErrorCode)
+		}
+		if h.Misconfigured {
+			b.WriteString(", 令牌被拒绝")
+		}
+		b.WriteString("\n")
+		if h.LastError != "" {
+			fmt.Fprintf(&b, "    错误: %s\n", h.LastError)
+		}
+	}
+	if status.Colo != "" {
+		fmt.Fprintf(&b, "  机房: %s\n", status.Colo)
+	}
+
+	b.WriteString("\nECH/DoH:\n")
+	s.explainECH(&b, cfg)
+	return b.String()
+}
+
+const explainTimeFormat = "2006-01-02 15:04:05.000"
+
+// normalizeExplainHost 去掉端口、方括号和末尾的点并转为小写，用于比较主机
+func normalizeExplainHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.ToLower(host)
+}
+
+// explainConn 输出一个连接的分流、耗时、结果和日志
+func (s *ProxyServer) explainConn(b *strings.Builder, id uint64, decisions map[uint64]RouteDecision,
+	records map[uint64]ConnectionRecord, active map[uint64]ActiveConnection, logs []logEntry) {
+	d, hasDecision := decisions[id]
+	r, ended := records[id]
+	c, running := active[id]
+	switch {
+	case ended:
+		fmt.Fprintf(b, "[#%d] %s %s -> %s\n", id, r.StartedAt.Format(explainTimeFormat), r.ClientAddr, r.Target)
+	case running:
+		fmt.Fprintf(b, "[#%d] %s %s -> %s\n", id, c.StartedAt.Format(explainTimeFormat), c.ClientAddr, c.Target)
+	default:
+		fmt.Fprintf(b, "[#%d] %s %s\n", id, d.Time.Format(explainTimeFormat), d.Host)
+	}
+	if hasDecision {
+		route := "通过代理"
+		if d.Direct {
+			route = "直连"
+		}
+		fmt.Fprintf(b, "  分流: %s (%s)\n", route, d.Reason)
+	}
+
+	switch {
+	case ended:
+		if hasDecision && !d.Direct && r.Direct {
+			b.WriteString("  服务端不可用，已降级为直连\n")
+		}
+		if r.Upstream != "" {
+			fmt.Fprintf(b, "  服务端: %s\n", r.Upstream)
+		}
+		fmt.Fprintf(b, "  耗时: %s\n", explainTiming(r.Direct, r.DialTime, r.HandshakeTime, r.EndedAt.Sub(r.StartedAt)))
+		result := fmt.Sprintf("  结果: %s", r.CloseReason)
+		if r.FailureClass != "" {
+			result += ", 失败分类 " + r.FailureClass
+		}
+		b.WriteString(result + "\n")
+		if r.Error != "" {
+			fmt.Fprintf(b, "  错误: %s\n", r.Error)
+		}
+		fmt.Fprintf(b, "  流量: 上传 %s, 下载 %s\n", FormatBytes(r.Upload), FormatBytes(r.Download))
+	case running:
+		fmt.Fprintf(b, "  状态: 进行中, 建立耗时 %s, 上传 %s, 下载 %s\n",
+			explainDuration(c.HandshakeTime), FormatBytes(c.Upload), FormatBytes(c.Download))
+	}
+
+	b.WriteString("  日志:\n")
+	found := false
+	for _, e := range logs {
+		if e.connID == id {
+			fmt.Fprintf(b, "    %s [%s] %s\n", e.time.Format("15:04:05.000"), e.level, e.msg)
+			found = true
+		}
+	}
+	if !found {
+		b.WriteString("    (没有相关日志，或已被淘汰)\n")
+	}
+}
+
+// explainTiming 按阶段描述建立和转发耗时，见 ConnectionRecord.HandshakeTime、DialTime
+func explainTiming(direct bool, dial, handshake, total time.Duration) string {
+	switch {
+	case direct && handshake > 0:
+		return fmt.Sprintf("连接目标 %s, 转发 %s", explainDuration(handshake), explainDuration(total-handshake))
+	case direct:
+		return fmt.Sprintf("连接目标失败, 共 %s", explainDuration(total))
+	case handshake > 0:
+		return fmt.Sprintf("建立 WebSocket %s, 等待 CONNECTED %s, 转发 %s",
+			explainDuration(dial), explainDuration(handshake-dial), explainDuration(total-handshake))
+	}
+	return fmt.Sprintf("建立 WebSocket %s, 建立失败, 共 %s", explainDuration(dial), explainDuration(total))
+}
+
+// explainDuration 毫秒以上保留到毫秒，以下保留到微秒
+func explainDuration(d time.Duration) string {
+	if d >= time.Millisecond {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// explainECH 输出 ECH 配置和 DoH 查询状态
+func (s *ProxyServer) explainECH(b *strings.Builder, cfg Config) {
+	if servers := serverAddrs(cfg.ServerAddr); len(servers) > 0 && !addrUsesTLS(servers[0]) {
+		b.WriteString("  服务端使用 ws://，不使用 ECH\n")
+		return
+	}
+	fmt.Fprintf(b, "  ECH 域名: %s, DoH 服务器: %s, RequireECH: %v", cfg.ECHDomain, cfg.DNSServer, cfg.RequireECH)
+	if cfg.ECHPublicName != "" {
+		fmt.Fprintf(b, ", ECHPublicName: %s", cfg.ECHPublicName)
+	}
+	b.WriteString("\n")
+
+	for _, domain := range echDomains(cfg) {
+		s.echListMu.RLock()
+		var e echEntry
+		if cached := s.echConfigs[domain]; cached != nil {
+			e = *cached
+		}
+		s.echListMu.RUnlock()
+		prefix := "  ECH 配置"
+		if cfg.ECHDomain == ECHDomainServer {
+			prefix = fmt.Sprintf("  ECH 配置 (%s)", domain)
+		}
+		if len(e.list) == 0 {
+			b.WriteString(prefix + ": 未加载\n")
+		} else {
+			fmt.Fprintf(b, "%s: %d 字节, 加载于 %s", prefix, len(e.list), e.loadedAt.Format(explainTimeFormat))
+			if e.cached {
+				b.WriteString(", 来自缓存")
+			} else if e.resolver != "" {
+				fmt.Fprintf(b, ", 来自 %s", e.resolver)
+			}
+			if names, err := echPublicNames(e.list); err == nil {
+				fmt.Fprintf(b, ", 公开名称 %s", strings.Join(names, ", "))
+			}
+			if len(e.alpn) > 0 {
+				fmt.Fprintf(b, ", ALPN %s", strings.Join(e.alpn, ", "))
+			}
+			if len(e.hints) > 0 {
+				fmt.Fprintf(b, ", 地址提示 %s", strings.Join(e.hints, ", "))
+			}
+			b.WriteString("\n")
+		}
+		if e.err != nil {
+			fmt.Fprintf(b, "  最近一次加载失败: %v\n", e.err)
+		}
+	}
+}
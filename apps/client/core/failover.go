@@ -0,0 +1,189 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ServerAddr 可以是逗号分隔的多个服务端地址，共用 ServerIP、Token 和 ECH 配置。
+// 建立隧道时按 BalanceStrategy 排列服务端依次尝试，令牌被拒绝的服务端不再尝试；
+// 全部失败且存在临时性错误时，按 DialRetries、DialRetryDelay 退避后再试一轮。
+// 可恢复的隧道断开后只向原服务端恢复，会话状态不跨服务端共享
+
+// BalanceStrategy 有多个服务端时新隧道选择服务端的方式，无论哪种方式，有健康扣分的服务端都排在无扣分的之后
+type BalanceStrategy string
+
+const (
+	// BalanceFailover 先尝试最近连接成功的服务端，失败后按健康扣分从低到高（同分按配置顺序）尝试其余服务端
+	BalanceFailover BalanceStrategy = "failover"
+	// BalanceRoundRobin 每条隧道从下一个服务端开始，按配置顺序轮流使用
+	BalanceRoundRobin BalanceStrategy = "round_robin"
+	// BalanceLatency 优先使用建立 WebSocket 耗时最短的服务端（见 ServerHealth.Latency），
+	// 尚未连接过的服务端先尝试一次以测得耗时
+	BalanceLatency BalanceStrategy = "latency"
+)
+
+// latencyWeight 平滑建立耗时时新样本的权重（分母为 4）
+const latencyWeight = 1
+
+// serverAddrs 拆分 ServerAddr 中逗号分隔的服务端地址，忽略空项
+func serverAddrs(addr string) []string {
+	var out []string
+	for _, a := range strings.Split(addr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// addrUsesTLS 服务端地址是否使用 TLS (wss://，默认)
+func addrUsesTLS(addr string) bool {
+	return !strings.HasPrefix(addr, "ws://")
+}
+
+// validateServerAddrs 检查多个服务端使用相同的协议，ECH 和 RequireECH 对全部服务端生效
+func validateServerAddrs(addr string) error {
+	servers := serverAddrs(addr)
+	for _, a := range servers[min(1, len(servers)):] {
+		if addrUsesTLS(a) != addrUsesTLS(servers[0]) {
+			return errors.New("多个服务端地址须全部使用 wss:// 或全部使用 ws://")
+		}
+	}
+	return nil
+}
+
+// currentServerLocked 当前使用的服务端：最近连接成功且仍在 servers 中的地址，否则为第一个。调用方需持有 upstreamMu
+func (s *ProxyServer) currentServerLocked(servers []string) string {
+	if slices.Contains(servers, s.upstreamCurrent) {
+		return s.upstreamCurrent
+	}
+	if len(servers) == 0 {
+		return ""
+	}
+	return servers[0]
+}
+
+// currentServer 当前使用的服务端，见 currentServerLocked
+func (s *ProxyServer) currentServer() string {
+	servers := serverAddrs(s.GetConfig().ServerAddr)
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+	return s.currentServerLocked(servers)
+}
+
+// upstreamCandidates 返回本次依次尝试的服务端，顺序见 BalanceStrategy，跳过拒绝了当前令牌的服务端
+func (s *ProxyServer) upstreamCandidates(cfg Config) []string {
+	servers := serverAddrs(cfg.ServerAddr)
+	if cfg.BalanceStrategy == BalanceRoundRobin && len(servers) > 1 {
+		// 先轮转再按扣分稳定排序，无扣分的服务端之间保持轮转顺序
+		n := int(s.upstreamNext.Add(1)-1) % len(servers)
+		servers = slices.Concat(servers[n:], servers[:n])
+	}
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+	current := s.currentServerLocked(servers)
+	health := func(addr string) ServerHealth {
+		if h := s.upstreamHealth[addr]; h != nil {
+			return h.ServerHealth
+		}
+		return ServerHealth{}
+	}
+	candidates := slices.DeleteFunc(servers, func(addr string) bool {
+		h := s.upstreamHealth[addr]
+		return h != nil && h.misconfigured(cfg.Token)
+	})
+	slices.SortStableFunc(candidates, func(a, b string) int {
+		ha, hb := health(a), health(b)
+		switch cfg.BalanceStrategy {
+		case BalanceRoundRobin:
+			return cmp.Compare(ha.Penalty, hb.Penalty)
+		case BalanceLatency:
+			return cmp.Or(cmp.Compare(ha.Penalty, hb.Penalty), cmp.Compare(ha.Latency, hb.Latency))
+		}
+		switch {
+		case a == b:
+			return 0
+		case a == current:
+			return -1
+		case b == current:
+			return 1
+		}
+		return cmp.Compare(ha.Penalty, hb.Penalty)
+	})
+	return candidates
+}
+
+// validBalanceStrategy 检查 BalanceStrategy 的取值，为空等同于 BalanceFailover
+func validBalanceStrategy(strategy BalanceStrategy) error {
+	switch strategy {
+	case "", BalanceFailover, BalanceRoundRobin, BalanceLatency:
+		return nil
+	}
+	return fmt.Errorf("未知的负载均衡方式: %s", strategy)
+}
+
+// dialServers 依次向 servers 建立转发到 target 的 WebSocket 连接，返回连接成功的服务端。
+// retry 为 true 时全部失败且存在临时性错误，按 DialRetries 和 dialBackoff 退避后仅重试出现临时性错误的服务端
+func (s *ProxyServer) dialServers(ctx context.Context, servers []string, target string, retry bool) (*websocket.Conn, string, map[string]string, error) {
+	if len(servers) == 0 {
+		return nil, "", nil, ErrUpstreamMisconfigured
+	}
+	retries := 0
+	var base time.Duration
+	if retry {
+		retries, base = dialRetryPolicy(s.GetConfig())
+	}
+
+	var lastErr error
+	for round := 0; ; round++ {
+		if round > 0 {
+			delay := dialBackoff(base, round)
+			logConnInfo(ctx, "[代理] 连接服务端失败: %v，%v 后重试 (%d/%d)", lastErr, delay.Round(time.Millisecond), round, retries)
+			if !sleepContext(ctx, delay) {
+				return nil, "", nil, lastErr
+			}
+		}
+		var transient []string // 本轮出现临时性错误、下一轮重试的服务端
+		var echFailed []string // 本轮因 ECH 失败、需要刷新的 ECH 查询域名
+		for i, server := range servers {
+			dialStart := time.Now()
+			wsConn, headers, err := s.dialWebSocket(ctx, server, target)
+			s.recordUpstreamDial(server, headers, time.Since(dialStart), err)
+			if err == nil {
+				return wsConn, server, headers, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, "", nil, err
+			}
+			if isTransientDialError(err) {
+				transient = append(transient, server)
+				if strings.Contains(err.Error(), "ECH") {
+					if host, port, _, perr := parseServerAddr(server); perr == nil {
+						echFailed = append(echFailed, echDomainFor(s.GetConfig(), host, port))
+					}
+				}
+			}
+			if i+1 < len(servers) {
+				logConnInfo(ctx, "[代理] 服务端 %s 连接失败: %v，尝试 %s", server, err, servers[i+1])
+			}
+		}
+		if round >= retries || len(transient) == 0 {
+			return nil, "", nil, lastErr
+		}
+		if len(echFailed) > 0 {
+			logConnInfo(ctx, "[ECH] 连接失败，刷新配置后重试")
+			slices.Sort(echFailed)
+			s.refreshECH(slices.Compact(echFailed)...)
+		}
+		servers = transient
+	}
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FlushCaches 清空运行时缓存，适用于切换网络（VPN、Wi-Fi）后无需重启即可重新建立状态：
+//   - DoH 代理客户端及其连接池（重新解析、重新握手）
+//   - 直连记住的主机 IP
+//   - 本地 DNS 服务缓存的应答
+//   - 下载 IP 列表等使用的 HTTP 空闲连接
+//   - ECH 配置（重新查询）
+//   - 中国 IP 列表（bypass_cn 模式下重新加载）
+//
+// 返回已清空的项目，部分项目失败时一并返回错误
+func (s *ProxyServer) FlushCaches() (flushed []string, err error) {
+	var errs []error
+
+	s.resetDoHProxyClient()
+	flushed = append(flushed, "DoH 代理连接")
+
+	s.dnsPins.reset()
+	flushed = append(flushed, "直连固定 IP")
+
+	s.dnsCache.reset()
+	flushed = append(flushed, "DNS 应答缓存")
+
+	defaultHTTPClient.CloseIdleConnections()
+	flushed = append(flushed, "HTTP 空闲连接")
+
+	cfg := s.GetConfig()
+	if s.IsRunning() && serverUsesTLS(cfg) {
+		if ferr := s.refreshECH(); ferr != nil {
+			errs = append(errs, fmt.Errorf("刷新 ECH 配置失败: %w", ferr))
+		} else {
+			flushed = append(flushed, "ECH 配置")
+		}
+	}
+
+	if cfg.RoutingMode == RoutingModeBypassCN {
+		if ferr := s.loadRoutingData(); ferr != nil {
+			errs = append(errs, fmt.Errorf("重新加载分流数据失败: %w", ferr))
+		} else {
+			flushed = append(flushed, "中国 IP 列表")
+		}
+	}
+
+	LogInfo("[缓存] 已清空: %s", strings.Join(flushed, ", "))
+	if err = errors.Join(errs...); err != nil {
+		LogError("[缓存] %v", err)
+	}
+	return flushed, err
+}
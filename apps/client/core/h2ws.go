@@ -0,0 +1,352 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP/2 WebSocket（RFC 8441）。gorilla/websocket 只会发起 HTTP/1.1 升级，
+// 这里交给 Dialer 一个 h2StreamConn：截获 Dialer 写出的升级请求，改为扩展 CONNECT 发出，
+// 再把服务端的 200 响应还原为 101 交给 Dialer 校验，之后 WebSocket 帧直接在 HTTP/2 流上收发
+
+// websocketGUID 计算 Sec-WebSocket-Accept 使用的固定 GUID（RFC 6455）
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// h2HandshakeEnd 升级请求头部的结束标记
+var h2HandshakeEnd = []byte("\r\n\r\n")
+
+// errH2WebSocketUnsupported 服务端协商了 HTTP/2 但没有启用扩展 CONNECT
+var errH2WebSocketUnsupported = errors.New("服务端不支持 HTTP/2 WebSocket (RFC 8441)，请在服务端启用 -h2c 或关闭 -h2")
+
+// h2WebSocketDialer 返回 websocket.Dialer 的 NetDialContext/NetDialTLSContext。
+// 每次拨号使用独立的 Transport，隧道关闭时一并关闭底层连接；tlsCfg 为 nil 时使用 h2c
+func (s *ProxyServer) h2WebSocketDialer(tlsCfg *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	httpScheme := "https"
+	if tlsCfg == nil {
+		httpScheme = "http"
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// net/http 的 Transport 不允许 :protocol 伪头部，扩展 CONNECT 需直接使用 x/net/http2
+		transport := &http2.Transport{
+			TLSClientConfig: tlsCfg,
+			AllowHTTP:       tlsCfg == nil,
+			DialTLSContext: func(ctx context.Context, network, address string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := s.serverDialContext(ctx, network, address)
+				if err != nil || tlsCfg == nil {
+					return conn, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				hctx, cancel := context.WithTimeout(ctx, s.tlsHandshakeTimeout())
+				defer cancel()
+				if err := tlsConn.HandshakeContext(hctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+					conn.Close()
+					return nil, fmt.Errorf("服务端未协商 HTTP/2 (ALPN: %q)", p)
+				}
+				return tlsConn, nil
+			},
+		}
+		return &h2StreamConn{transport: transport, scheme: httpScheme, addr: addr}, nil
+	}
+}
+
+// h2StreamConn 在一个 HTTP/2 扩展 CONNECT 流上实现 net.Conn。
+// 握手完成前 Write 缓存升级请求，Read 返回还原的响应；握手完成后读写流的响应体和请求体
+type h2StreamConn struct {
+	transport *http2.Transport
+	scheme    string
+	addr      string
+
+	handshake bytes.Buffer
+	pending   []byte
+	body      io.ReadCloser
+	upload    *io.PipeWriter
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	closed bool
+	local  net.Addr
+	remote net.Addr
+
+	readDeadline, writeDeadline streamDeadline
+}
+
+func (c *h2StreamConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.body == nil {
+		return 0, io.EOF
+	}
+	if c.readDeadline.begin() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.body.Read(p)
+	if c.readDeadline.end() && err != nil {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, c.closedErr(err)
+}
+
+func (c *h2StreamConn) Write(p []byte) (int, error) {
+	if c.writeDeadline.begin() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.write(p)
+	if c.writeDeadline.end() && err != nil {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, c.closedErr(err)
+}
+
+// closedErr 将关闭后流返回的错误统一为 net.ErrClosed，与 TCP 连接的行为一致
+func (c *h2StreamConn) closedErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *h2StreamConn) write(p []byte) (int, error) {
+	if c.upload != nil {
+		return c.upload.Write(p)
+	}
+	c.handshake.Write(p)
+	if !bytes.Contains(c.handshake.Bytes(), h2HandshakeEnd) {
+		return len(p), nil
+	}
+	if err := c.connect(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// connect 将缓存的升级请求改为扩展 CONNECT 发出，并把响应还原为 HTTP/1.1 格式
+func (c *h2StreamConn) connect() error {
+	upgrade, err := http.ReadRequest(bufio.NewReader(&c.handshake))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		cancel()
+		return net.ErrClosed
+	}
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			c.local, c.remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+			c.mu.Unlock()
+		},
+	})
+	pr, pw := io.Pipe()
+	target := &url.URL{Scheme: c.scheme, Host: c.addr, Path: upgrade.URL.Path, RawQuery: upgrade.URL.RawQuery}
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, target.String(), pr)
+	if err != nil {
+		cancel()
+		return err
+	}
+	req.Host = upgrade.Host
+	for k, v := range upgrade.Header {
+		switch k {
+		case "Upgrade", "Connection", "Sec-Websocket-Key":
+			continue
+		}
+		req.Header[k] = v
+	}
+	req.Header.Set(":protocol", "websocket")
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		cancel()
+		if strings.Contains(err.Error(), "extended connect not supported") {
+			return errH2WebSocketUnsupported
+		}
+		return fmt.Errorf("HTTP/2 WebSocket 握手失败: %w", err)
+	}
+
+	var b bytes.Buffer
+	skip := map[string]bool{"Content-Length": true, "Transfer-Encoding": true}
+	if resp.StatusCode == http.StatusOK {
+		fmt.Fprintf(&b, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n",
+			websocketAccept(upgrade.Header.Get("Sec-WebSocket-Key")))
+		resp.Header.WriteSubset(&b, skip)
+		b.WriteString("\r\n")
+		c.body, c.upload = resp.Body, pw
+	} else {
+		// 握手被拒绝时保留状态码和响应体，由 Dialer 返回 ErrBadHandshake
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		fmt.Fprintf(&b, "HTTP/1.1 %s\r\nContent-Length: %d\r\n", resp.Status, len(body))
+		resp.Header.WriteSubset(&b, skip)
+		b.WriteString("\r\n")
+		b.Write(body)
+	}
+	c.pending = b.Bytes()
+	return nil
+}
+
+// abort 中断流上阻塞的读写，截止时间到期时调用
+func (c *h2StreamConn) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+func (c *h2StreamConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	cancel := c.cancel
+	c.mu.Unlock()
+	if c.upload != nil {
+		c.upload.Close()
+	}
+	if cancel != nil {
+		cancel()
+	}
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.local == nil {
+		return h2Addr(c.addr)
+	}
+	return c.local
+}
+
+func (c *h2StreamConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote == nil {
+		return h2Addr(c.addr)
+	}
+	return c.remote
+}
+
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t, c.abort)
+	c.writeDeadline.set(t, c.abort)
+	return nil
+}
+
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t, c.abort)
+	return nil
+}
+
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t, c.abort)
+	return nil
+}
+
+// h2Addr 建立底层连接前 h2StreamConn 使用的地址
+type h2Addr string
+
+func (a h2Addr) Network() string { return "tcp" }
+func (a h2Addr) String() string  { return string(a) }
+
+// streamDeadline 为 HTTP/2 流实现 net.Conn 的截止时间。流无法在中断后恢复，
+// 所以只在有读写阻塞时到期才中断整个流；没有阻塞的读写时仅使之后的读写立即返回超时
+type streamDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	gen     int
+	pending int
+	expired bool
+}
+
+// set 设置截止时间，t 为零值时取消；到期且有阻塞的读写时调用 abort
+func (d *streamDeadline) set(t time.Time, abort func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.gen++
+	d.expired = false
+	if t.IsZero() {
+		return
+	}
+	gen := d.gen
+	d.timer = time.AfterFunc(time.Until(t), func() {
+		d.mu.Lock()
+		if d.gen != gen {
+			d.mu.Unlock()
+			return
+		}
+		d.expired = true
+		interrupt := d.pending > 0
+		d.mu.Unlock()
+		if interrupt {
+			abort()
+		}
+	})
+}
+
+// begin 标记一次读写开始，已到期时返回 true
+func (d *streamDeadline) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired {
+		return true
+	}
+	d.pending++
+	return false
+}
+
+// end 标记一次读写结束，返回截止时间是否已到期
+func (d *streamDeadline) end() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending--
+	return d.expired
+}
+
+// websocketAccept 计算 key 对应的 Sec-WebSocket-Accept
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
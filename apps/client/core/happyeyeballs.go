@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Happy Eyeballs (RFC 8305) 参数
+const (
+	connectionAttemptDelay = 250 * time.Millisecond // 上一个连接尝试未完成时发起下一个的间隔
+	resolutionDelay        = 50 * time.Millisecond  // A 记录先返回时等待 AAAA 记录的时间
+)
+
+// dialResult 一个连接尝试的结果
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs 按 RFC 8305 连接 address：同时查询 AAAA 和 A 记录，按 IPv6、IPv4 交替排列地址，
+// IPv6 先行；上一个尝试失败时立即、未完成时每隔 connectionAttemptDelay 发起下一个，
+// 使用最先建立的连接并取消其余尝试。不可用的 IPv6 线路只会增加一个间隔的延迟，而不是等待连接超时。
+// d 的 Timeout、Deadline 限制整个过程，Resolver 为 nil 时使用系统默认解析器；address 为 IP 时直接连接
+func dialHappyEyeballs(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, "tcp", address)
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if !d.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d.Deadline)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	type lookupResult struct {
+		v6  bool
+		ips []net.IP
+		err error
+	}
+	lookups := make(chan lookupResult, 2)
+	for _, v6 := range []bool{true, false} {
+		network := "ip4"
+		if v6 {
+			network = "ip6"
+		}
+		go func() {
+			ips, err := resolver.LookupIP(ctx, network, host)
+			lookups <- lookupResult{v6, ips, err}
+		}()
+	}
+
+	// 每个尝试单独计时，使用 IP 连接，不再经过 Dialer 的解析和双栈竞速
+	attempt := *d
+	attempt.Deadline, attempt.FallbackDelay = time.Time{}, -1
+	results := make(chan dialResult)
+	inflight := 0
+	start := func(ip net.IP) {
+		inflight++
+		go func() {
+			conn, err := attempt.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			select {
+			case results <- dialResult{conn, err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	var (
+		v6, v4        []net.IP
+		nextV6        = true // 下一个尝试优先使用的地址族
+		pendingLookup = 2
+		waitingAAAA   bool // A 记录已返回，在 resolutionDelay 内等待 AAAA 记录
+		started       bool // 已开始发起连接
+		firstErr      error
+		lookupErr     error
+	)
+	next := func() net.IP {
+		if len(v6) == 0 && len(v4) == 0 {
+			return nil
+		}
+		var ip net.IP
+		if nextV6 && len(v6) > 0 || len(v4) == 0 {
+			ip, v6 = v6[0], v6[1:]
+			nextV6 = false
+		} else {
+			ip, v4 = v4[0], v4[1:]
+			nextV6 = true
+		}
+		return ip
+	}
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	var timerC <-chan time.Time
+	tryNext := func() {
+		if ip := next(); ip != nil {
+			start(ip)
+			timer.Reset(connectionAttemptDelay)
+			timerC = timer.C
+		} else {
+			timerC = nil
+		}
+	}
+
+	for {
+		if started && inflight == 0 && pendingLookup == 0 && len(v6) == 0 && len(v4) == 0 {
+			switch {
+			case firstErr != nil:
+				return nil, firstErr
+			case lookupErr != nil:
+				return nil, lookupErr
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		select {
+		case r := <-lookups:
+			pendingLookup--
+			if r.err != nil && lookupErr == nil && !errors.Is(r.err, context.Canceled) {
+				lookupErr = r.err
+			}
+			if r.v6 {
+				v6 = append(v6, r.ips...)
+			} else {
+				v4 = append(v4, r.ips...)
+			}
+			switch {
+			case started:
+				// 之前的地址已全部发起，后返回的地址立即补上
+				if inflight == 0 || timerC == nil {
+					tryNext()
+				}
+			case r.v6 || pendingLookup == 0:
+				started, waitingAAAA = true, false
+				tryNext()
+			case len(r.ips) > 0:
+				// A 记录先返回，稍等 AAAA 记录以便 IPv6 先行
+				waitingAAAA = true
+				timer.Reset(resolutionDelay)
+				timerC = timer.C
+			}
+		case <-timerC:
+			if waitingAAAA {
+				started, waitingAAAA = true, false
+			}
+			tryNext()
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if started {
+				tryNext()
+			}
+		case <-ctx.Done():
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
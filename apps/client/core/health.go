@@ -0,0 +1,111 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultHealthCheckFailures HealthCheckFailures 为 0 时标记服务端不可用的连续失败次数
+	defaultHealthCheckFailures = 3
+	// healthPollInterval 健康检查关闭时检查 HealthCheckInterval 是否已开启的间隔
+	healthPollInterval = time.Second
+)
+
+// Health 后台健康检查的结果，见 Config.HealthCheckInterval
+type Health struct {
+	Server              string        `json:"server"`              // 最近一次检查的服务端
+	Healthy             bool          `json:"healthy"`             // 连续失败次数未达到 HealthCheckFailures，尚未检查时为 true
+	LastCheckAt         time.Time     `json:"lastCheckAt"`         // 最近一次检查的时间，尚未检查时为零值
+	ConsecutiveFailures int           `json:"consecutiveFailures"` // 连续失败次数，成功后清零
+	Latency             time.Duration `json:"latency"`             // 最近一次成功检查建立 WebSocket 的耗时（纳秒）
+	LastError           string        `json:"lastError"`           // 最近一次失败的原因，成功后清空
+}
+
+// HealthHandler 接收健康检查结果在可用与不可用之间的变化
+type HealthHandler func(Health)
+
+var healthHandler atomic.Pointer[HealthHandler]
+
+// SetHealthHandler 设置健康状态变化的处理函数，服务端变为不可用或恢复时各调用一次，nil 表示不通知
+func SetHealthHandler(handler HealthHandler) {
+	if handler == nil {
+		healthHandler.Store(nil)
+		return
+	}
+	healthHandler.Store(&handler)
+}
+
+// GetHealth 获取最近一次健康检查的结果，HealthCheckInterval 为 0 时不检查
+func (s *ProxyServer) GetHealth() Health {
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+	return s.health
+}
+
+// checkHealth 按 HealthCheckInterval 定期检查当前服务端，每次检查后读取当前配置，Reload 修改间隔即可开关
+func (s *ProxyServer) checkHealth(ctx context.Context) error {
+	for {
+		wait := healthPollInterval
+		if interval := s.GetConfig().HealthCheckInterval; interval > 0 {
+			s.probeHealth(ctx)
+			wait = interval
+		}
+		if !sleepContext(ctx, wait) {
+			return nil
+		}
+	}
+}
+
+// probeHealth 经与隧道相同的 ECH 路径向当前服务端建立 WebSocket 后立即关闭，结果计入上游健康状态，
+// 可用状态变化时记录日志并通知 HealthHandler
+func (s *ProxyServer) probeHealth(ctx context.Context) {
+	server := s.currentServer()
+	dialCtx, cancel := context.WithTimeout(ctx, s.dialTimeout()+s.tlsHandshakeTimeout())
+	defer cancel()
+	start := time.Now()
+	wsConn, headers, err := s.dialWebSocket(dialCtx, server, "")
+	elapsed := time.Since(start)
+	if err == nil {
+		wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		wsConn.Close()
+	}
+	if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		// 代理停止，不计入结果
+		return
+	}
+	s.recordUpstreamDial(server, headers, elapsed, err)
+
+	threshold := cmp.Or(s.GetConfig().HealthCheckFailures, defaultHealthCheckFailures)
+	s.upstreamMu.Lock()
+	h := &s.health
+	wasHealthy := h.Healthy
+	h.Server, h.LastCheckAt = server, time.Now()
+	if err == nil {
+		h.ConsecutiveFailures, h.Latency, h.LastError = 0, elapsed, ""
+		h.Healthy = true
+	} else {
+		h.ConsecutiveFailures++
+		h.LastError = err.Error()
+		h.Healthy = h.ConsecutiveFailures < threshold
+	}
+	health := *h
+	s.upstreamMu.Unlock()
+
+	if health.Healthy == wasHealthy {
+		return
+	}
+	if health.Healthy {
+		LogInfo("[健康检查] 服务端 %s 已恢复，延迟 %v", server, elapsed.Round(time.Millisecond))
+	} else {
+		LogError("[健康检查] 服务端 %s 连续 %d 次检查失败，已不可用: %v", server, health.ConsecutiveFailures, err)
+	}
+	if handler := healthHandler.Load(); handler != nil {
+		(*handler)(health)
+	}
+}
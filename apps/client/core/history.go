@@ -0,0 +1,95 @@
+package core
+
+import "time"
+
+// 历史记录缓冲区默认容量
+const (
+	defaultRouteDecisionLogSize  = 200
+	defaultRecentConnectionsSize = 100
+)
+
+// RouteDecision 一次分流决策
+type RouteDecision struct {
+	ConnID uint64    `json:"connId"` // 连接 ID，与 ConnectionRecord、ActiveConnection 及日志中的 "[#ID]" 对应
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	Direct bool      `json:"direct"` // true 为直连，false 为通过代理
+	Reason string    `json:"reason"`
+}
+
+// ConnectionRecord 已结束连接的记录
+type ConnectionRecord struct {
+	ConnID      uint64      `json:"connId"`
+	ClientAddr  string      `json:"clientAddr"`
+	Target      string      `json:"target"`
+	Direct      bool        `json:"direct"`
+	StartedAt   time.Time   `json:"startedAt"`
+	EndedAt     time.Time   `json:"endedAt"`
+	Error       string      `json:"error"`
+	CloseReason CloseReason `json:"closeReason"` // 建立阶段失败时为 error 或 timeout
+	Upstream    string      `json:"upstream"`    // 建立隧道使用的服务端，直连或建立失败时为空
+	// FailureClass 连接服务端失败的分类，见 UpstreamFailure* 常量，降级为直连时同样记录；其他失败时为空
+	FailureClass string `json:"failureClass"`
+
+	// HandshakeTime 建立耗时（纳秒）：通过代理时为建立 WebSocket（含 ECH、TLS 和重试）到收到 CONNECTED，
+	// 直连时为连接目标的耗时；建立失败时为 0
+	HandshakeTime time.Duration `json:"handshakeTime"`
+	DialTime      time.Duration `json:"dialTime"`   // 其中建立 WebSocket 的耗时（纳秒），含重试和切换服务端，建立失败时为失败前的耗时
+	Upload        int64         `json:"upload"`     // 上传字节数
+	Download      int64         `json:"download"`   // 下载字节数
+	Throughput    int64         `json:"throughput"` // 转发阶段的平均吞吐量（字节/秒，上传与下载之和）
+}
+
+// BufferStats 历史缓冲区的占用情况
+type BufferStats struct {
+	Name string `json:"name"`
+	Len  int    `json:"len"`
+	Cap  int    `json:"cap"`
+}
+
+// history 各类"最近 N 条"记录
+type history struct {
+	routeDecisions *ringBuffer[RouteDecision]
+	recentConns    *ringBuffer[ConnectionRecord]
+	handshakes     *ringBuffer[time.Duration] // 最近建立隧道的耗时，用于 GetHandshakeStats
+}
+
+func newHistory(cfg Config) *history {
+	decisions := cfg.RouteDecisionLogSize
+	if decisions <= 0 {
+		decisions = defaultRouteDecisionLogSize
+	}
+	conns := cfg.RecentConnectionsSize
+	if conns <= 0 {
+		conns = defaultRecentConnectionsSize
+	}
+	return &history{
+		routeDecisions: newRingBuffer[RouteDecision](decisions),
+		recentConns:    newRingBuffer[ConnectionRecord](conns),
+		handshakes:     newRingBuffer[time.Duration](handshakeSampleSize),
+	}
+}
+
+// GetRouteDecisions 获取最近的分流决策，按时间从旧到新排列
+func (s *ProxyServer) GetRouteDecisions() []RouteDecision {
+	return s.history.routeDecisions.Snapshot()
+}
+
+// GetRecentConnections 获取最近结束的连接，按时间从旧到新排列
+func (s *ProxyServer) GetRecentConnections() []ConnectionRecord {
+	return s.history.recentConns.Snapshot()
+}
+
+// GetBufferStats 获取各历史缓冲区的当前大小，用于调试内存占用。内部 API，条目可能随实现变化
+func (s *ProxyServer) GetBufferStats() []BufferStats {
+	pinCap := s.GetConfig().DNSPinMaxEntries
+	if pinCap <= 0 {
+		pinCap = defaultDNSPinMaxEntries
+	}
+	return []BufferStats{
+		{Name: "route_decisions", Len: s.history.routeDecisions.Len(), Cap: s.history.routeDecisions.Cap()},
+		{Name: "recent_connections", Len: s.history.recentConns.Len(), Cap: s.history.recentConns.Cap()},
+		{Name: "handshake_samples", Len: s.history.handshakes.Len(), Cap: s.history.handshakes.Cap()},
+		{Name: "dns_pins", Len: s.dnsPins.len(), Cap: pinCap},
+	}
+}
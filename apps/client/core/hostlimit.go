@@ -0,0 +1,165 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRateLimitAborted 限速等待期间连接已关闭
+var errRateLimitAborted = errors.New("限速等待被中断")
+
+// tokenBucket 令牌桶限速器，容量为一秒的流量。超出速率时阻塞等待而不是断开连接
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/s
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait 消耗 n 字节的令牌，不足时等待补充；done 关闭时提前返回 false。
+// nil 表示不限速
+func (b *tokenBucket) wait(n int, done <-chan struct{}) bool {
+	if b == nil || n <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	// 先预留令牌（可以为负），等待时间按欠额计算，并发连接按到达顺序排队
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// hostRateLimits 按目标主机限速的规则集，同一规则下的所有连接共享令牌桶，上传和下载各自一个，
+// 大量上传不会挤占同一主机的下载。规则键为主机名或 IP（如 dl.example.com），或以 *. 开头匹配所有子域名
+// （如 *.example.com，不含 example.com 本身）；精确匹配优先，其次是最长的通配后缀
+type hostRateLimits struct {
+	exact    map[string]*hostRateRule
+	wildcard map[string]*hostRateRule // 键为去掉 * 的后缀，如 .example.com
+}
+
+// hostRateRule 一条规则两个方向的令牌桶，速率相同
+type hostRateRule struct {
+	rate     int64
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+// bucket 返回 upload 方向的令牌桶，nil 表示不限速
+func (r *hostRateRule) bucket(upload bool) *tokenBucket {
+	switch {
+	case r == nil:
+		return nil
+	case upload:
+		return r.upload
+	}
+	return r.download
+}
+
+// newHostRateLimits 根据配置创建规则集，速率不变的规则沿用 prev 中的令牌桶。
+// 没有有效规则时返回 nil
+func newHostRateLimits(limits map[string]int64, prev *hostRateLimits) *hostRateLimits {
+	h := &hostRateLimits{
+		exact:    make(map[string]*hostRateRule),
+		wildcard: make(map[string]*hostRateRule),
+	}
+	for pattern, rate := range limits {
+		if rate <= 0 {
+			continue
+		}
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		wildcard := strings.HasPrefix(pattern, "*.")
+		rules := h.exact
+		if wildcard {
+			pattern = pattern[1:]
+			rules = h.wildcard
+		}
+		if pattern == "" || pattern == "." {
+			continue
+		}
+		if old := prev.rule(wildcard, pattern); old != nil && old.rate == rate {
+			rules[pattern] = old
+		} else {
+			rules[pattern] = &hostRateRule{rate: rate, upload: newTokenBucket(rate), download: newTokenBucket(rate)}
+		}
+	}
+	if len(h.exact) == 0 && len(h.wildcard) == 0 {
+		return nil
+	}
+	return h
+}
+
+// rule 按规则键查找规则
+func (h *hostRateLimits) rule(wildcard bool, pattern string) *hostRateRule {
+	if h == nil {
+		return nil
+	}
+	if wildcard {
+		return h.wildcard[pattern]
+	}
+	return h.exact[pattern]
+}
+
+// bucket 返回主机 upload 方向的令牌桶，不限速时返回 nil
+func (h *hostRateLimits) bucket(host string, upload bool) *tokenBucket {
+	return h.match(host).bucket(upload)
+}
+
+// match 返回主机匹配的规则，没有时返回 nil
+func (h *hostRateLimits) match(host string) *hostRateRule {
+	if h == nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if r, ok := h.exact[host]; ok {
+		return r
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		if r, ok := h.wildcard[host[i:]]; ok {
+			return r
+		}
+		next := strings.IndexByte(host[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil
+}
+
+// rateLimitedWriter 写入前等待限速令牌
+type rateLimitedWriter struct {
+	w    io.Writer
+	wait func(n int) bool
+}
+
+func (lw *rateLimitedWriter) Write(p []byte) (int, error) {
+	if !lw.wait(len(p)) {
+		return 0, errRateLimitAborted
+	}
+	return lw.w.Write(p)
+}
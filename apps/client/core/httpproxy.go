@@ -0,0 +1,277 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpProxy 普通 HTTP 代理的一条客户端连接。客户端可以在同一连接上依次发送多个请求（keep-alive），
+// 发往同一目标的请求复用一条隧道，目标改变时关闭原隧道并建立新隧道
+type httpProxy struct {
+	s          *ProxyServer
+	ctx        context.Context
+	conn       net.Conn
+	clientAddr string
+	reader     *bufio.Reader // 客户端连接的读取缓冲，可能已读入后续请求
+	sess       *httpSession
+}
+
+// httpSession 到一个目标的隧道。隧道由 handleTunnel 处理，读写的是管道的一端，
+// 请求循环在另一端写入请求、读取响应
+type httpSession struct {
+	target string
+	conn   net.Conn // 管道的请求循环一端
+	resp   *bufio.Reader
+	inner  net.Conn      // 管道的隧道一端
+	done   chan struct{} // handleTunnel 返回后关闭
+}
+
+// httpProxyConn 隧道看到的客户端连接：数据经管道与请求循环交换，地址和连接登记使用所属的客户端连接
+type httpProxyConn struct {
+	net.Conn
+	client net.Conn
+}
+
+func (c *httpProxyConn) LocalAddr() net.Addr  { return c.client.LocalAddr() }
+func (c *httpProxyConn) RemoteAddr() net.Addr { return c.client.RemoteAddr() }
+func (c *httpProxyConn) clientConn() net.Conn { return c.client }
+
+// deadlineWriter 每次写入前按 timeout 设置写截止时间，客户端长时间不读取响应时写入失败。timeout 为 0 时不限制
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	return w.conn.Write(p)
+}
+
+// serve 转发一个请求并把响应写回客户端，返回能否在连接上继续读取下一个请求
+func (p *httpProxy) serve(req *http.Request) bool {
+	logConnInfo(p.ctx, "[HTTP-%s] %s -> %s", req.Method, p.clientAddr, req.RequestURI)
+	target := httpProxyTarget(req)
+	if target == "" {
+		p.conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return false
+	}
+	// 请求头已读完，请求体和响应的转发不受握手阶段的截止时间限制
+	p.conn.SetDeadline(time.Time{})
+
+	head := httpRequestHead(req)
+	if p.sess != nil && !p.sess.reusable(target) {
+		p.closeSession()
+	}
+	if p.sess != nil {
+		if _, err := io.WriteString(p.sess.conn, head); err != nil {
+			// 隧道刚好关闭，请求还未发出，改用新隧道
+			p.closeSession()
+		}
+	}
+	if p.sess == nil {
+		// 请求头随 CONNECT 帧发送
+		p.sess = p.startSession(req.Method, target, head)
+	}
+	sess := p.sess
+
+	// 请求体与响应同时转发：目标可能先返回 100 Continue，或不读完请求体就响应
+	var bodyDone chan error
+	if req.Body != http.NoBody {
+		bodyDone = make(chan error, 1)
+		go func() { bodyDone <- writeRequestBody(sess.conn, req) }()
+	}
+
+	w := &deadlineWriter{conn: p.conn, timeout: p.s.phaseTimeout(phaseIdle)}
+	if prefix, err := sess.resp.Peek(5); err == nil && string(prefix) != "HTTP/" {
+		// 目标返回的不是 HTTP 响应，之后双向按原样转发
+		p.relayRaw(w, bodyDone)
+		return false
+	}
+	for {
+		resp, err := http.ReadResponse(sess.resp, req)
+		if err != nil {
+			p.conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return false
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// 协议升级（如 WebSocket）后连接不再是 HTTP，按原样转发到结束
+			if writeResponseHead(w, resp) == nil {
+				p.relayRaw(w, bodyDone)
+			}
+			return false
+		}
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 {
+			// 100 Continue 等中间响应，之后还有最终响应
+			if writeResponseHead(w, resp) != nil {
+				return false
+			}
+			continue
+		}
+		err = resp.Write(w)
+		resp.Body.Close()
+		// 任意一方要求关闭，或响应体以关闭连接表示结束时，不再读取后续请求
+		if err != nil || req.Close || resp.Close || resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+			return false
+		}
+		break
+	}
+	if bodyDone != nil {
+		select {
+		case err := <-bodyDone:
+			return err == nil
+		default:
+			// 目标未读完请求体就已响应，客户端连接上的下一个请求从哪里开始无法确定
+			return false
+		}
+	}
+	return true
+}
+
+// relayRaw 在客户端与隧道之间按原样转发剩余数据，直到隧道一侧结束
+func (p *httpProxy) relayRaw(w io.Writer, bodyDone chan error) {
+	sess := p.sess
+	go func() {
+		if bodyDone != nil && <-bodyDone != nil {
+			return
+		}
+		io.Copy(sess.conn, p.reader)
+	}()
+	io.Copy(w, sess.resp)
+}
+
+// startSession 建立到 target 的隧道，firstFrame 为首个请求的请求头
+func (p *httpProxy) startSession(method, target, firstFrame string) *httpSession {
+	inner, outer := net.Pipe()
+	sess := &httpSession{target: target, conn: outer, resp: bufio.NewReader(outer), inner: inner, done: make(chan struct{})}
+	go func() {
+		defer close(sess.done)
+		defer inner.Close()
+		if err := p.s.handleTunnel(p.ctx, &httpProxyConn{Conn: inner, client: p.conn}, target, p.clientAddr, modeHTTPProxy, firstFrame); err != nil {
+			if !isNormalCloseError(err) {
+				logConnError(p.ctx, "[HTTP-%s] %s 代理失败: %v", method, p.clientAddr, err)
+			}
+		}
+	}()
+	return sess
+}
+
+// reusable 隧道是否仍可用于发往 target 的请求
+func (sess *httpSession) reusable(target string) bool {
+	select {
+	case <-sess.done:
+		return false
+	default:
+		return sess.target == target
+	}
+}
+
+// closeSession 关闭当前隧道并等待 handleTunnel 返回，避免与下一条隧道同时关联到客户端连接
+func (p *httpProxy) closeSession() {
+	if p.sess == nil {
+		return
+	}
+	p.sess.inner.Close()
+	p.sess.conn.Close()
+	<-p.sess.done
+	p.sess = nil
+}
+
+// httpProxyTarget 返回请求的目标地址，格式错误时返回空字符串。CONNECT 使用请求行中的 authority，须给出端口；
+// 其他请求未指定端口时使用 80，absolute-form 请求使用请求行中的地址，否则使用 Host 头
+func httpProxyTarget(req *http.Request) string {
+	if req.Method == "CONNECT" {
+		return httpAuthority(req.RequestURI, "")
+	}
+	return httpAuthority(req.Host, "80")
+}
+
+// httpAuthority 把请求中的 authority（host[:port]）规范为可拨号的 host:port，格式错误时返回空字符串。
+// IPv6 地址须在方括号内，否则无法与端口区分；defaultPort 为空时要求给出端口（CONNECT）
+func httpAuthority(authority, defaultPort string) string {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		// 没有端口：[IPv6] 去掉方括号，仍含冒号的是未加方括号的 IPv6 地址或其他错误格式
+		host, port = authority, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		} else if strings.Contains(host, ":") {
+			return ""
+		}
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return ""
+	}
+	if host == "" || strings.ContainsAny(host, "[]") {
+		return ""
+	}
+	if _, err := netip.ParseAddr(host); err != nil && strings.Contains(host, ":") {
+		return ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// httpRequestHead 生成转发给目标的请求头：请求行使用 origin-form，去掉 Proxy-Connection 和 Proxy-Authorization。
+// chunked 请求体由 writeRequestBody 重新编码
+func httpRequestHead(req *http.Request) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Proto, req.Host)
+	if requestChunked(req) {
+		b.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+	header := req.Header.Clone()
+	header.Del("Proxy-Connection")
+	header.Del("Proxy-Authorization")
+	header.Write(&b)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// writeRequestBody 转发请求体，请求体不会整体缓存在内存中
+func writeRequestBody(w io.Writer, req *http.Request) error {
+	if !requestChunked(req) {
+		_, err := io.Copy(w, req.Body)
+		return err
+	}
+	cw := httputil.NewChunkedWriter(w)
+	if _, err := io.Copy(cw, req.Body); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := req.Trailer.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+func requestChunked(req *http.Request) bool {
+	return len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked"
+}
+
+// writeResponseHead 写出没有响应体的 1xx 响应
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "%s %s\r\n", resp.Proto, resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"bufio"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestHTTPProxyRequestParsing 普通 HTTP 代理请求的目标地址按 absolute-form 或 Host 头解析，
+// 转发的请求头使用 origin-form 并保留客户端发送的其他请求头；格式错误的请求不会得到目标地址
+func TestHTTPProxyRequestParsing(t *testing.T) {
+	for _, tc := range []struct {
+		name, request, target string
+		head                  []string // 转发的请求头中应包含的行
+	}{
+		{"host with port",
+			"GET http://203.0.113.13:8443/p?q=1 HTTP/1.1\r\nHost: 203.0.113.13:8443\r\nX-Time: 12:34:56\r\n" +
+				"Referer: http://a.echplus.test:81/x\r\nX-Dup: 1\r\nX-Dup: 2\r\nProxy-Connection: keep-alive\r\n\r\n",
+			"203.0.113.13:8443",
+			[]string{"GET /p?q=1 HTTP/1.1", "Host: 203.0.113.13:8443", "X-Time: 12:34:56", "Referer: http://a.echplus.test:81/x", "X-Dup: 1", "X-Dup: 2"}},
+		// absolute-form 的地址优先于 Host 头，转发时 Host 头改为该地址
+		{"absolute-form overrides Host",
+			"GET http://203.0.113.13/ HTTP/1.1\r\nHost: other.echplus.test:8080\r\n\r\n",
+			"203.0.113.13:80", []string{"GET / HTTP/1.1", "Host: 203.0.113.13"}},
+		{"origin-form uses Host",
+			"GET /index.html HTTP/1.1\r\nHost: a.echplus.test:8080\r\n\r\n",
+			"a.echplus.test:8080", []string{"GET /index.html HTTP/1.1", "Host: a.echplus.test:8080"}},
+		{"IPv6 with port",
+			"GET http://[2001:db8::13]:8080/v6 HTTP/1.1\r\nHost: [2001:db8::13]:8080\r\n\r\n",
+			"[2001:db8::13]:8080", []string{"GET /v6 HTTP/1.1", "Host: [2001:db8::13]:8080"}},
+		{"IPv6 without port",
+			"GET / HTTP/1.1\r\nHost: [2001:db8::13]\r\n\r\n",
+			"[2001:db8::13]:80", []string{"Host: [2001:db8::13]"}},
+		{"CONNECT",
+			"CONNECT a.echplus.test:443 HTTP/1.1\r\nHost: a.echplus.test:443\r\n\r\n",
+			"a.echplus.test:443", nil},
+		{"CONNECT IPv6",
+			"CONNECT [2001:db8::13]:443 HTTP/1.1\r\nHost: [2001:db8::13]:443\r\n\r\n",
+			"[2001:db8::13]:443", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tc.request)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := httpProxyTarget(req); got != tc.target {
+				t.Fatalf("target = %q, want %q", got, tc.target)
+			}
+			if tc.head == nil {
+				return
+			}
+			head := httpRequestHead(req)
+			lines := strings.Split(strings.TrimSuffix(head, "\r\n\r\n"), "\r\n")
+			for _, want := range tc.head {
+				if !slices.Contains(lines, want) {
+					t.Fatalf("forwarded head has no line %q:\n%s", want, head)
+				}
+			}
+			if strings.Contains(head, "Proxy-Connection") {
+				t.Fatalf("forwarded head keeps Proxy-Connection:\n%s", head)
+			}
+		})
+	}
+
+	// 请求行含空格、多个 Host 头在读取请求时出错；未加方括号的 IPv6、无效端口、CONNECT 未给出端口时没有目标地址
+	for name, request := range map[string]string{
+		"space in target":      "GET /a b HTTP/1.1\r\nHost: 203.0.113.13\r\n\r\n",
+		"duplicate Host":       "GET / HTTP/1.1\r\nHost: 203.0.113.13\r\nHost: 203.0.113.14\r\n\r\n",
+		"unbracketed IPv6":     "GET / HTTP/1.1\r\nHost: 2001:db8::13\r\n\r\n",
+		"invalid port":         "GET / HTTP/1.1\r\nHost: 203.0.113.13:http\r\n\r\n",
+		"port 0":               "GET / HTTP/1.1\r\nHost: 203.0.113.13:0\r\n\r\n",
+		"empty Host":           "GET / HTTP/1.1\r\nHost: \r\n\r\n",
+		"CONNECT without port": "CONNECT 203.0.113.13 HTTP/1.1\r\nHost: 203.0.113.13\r\n\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+			if err != nil {
+				return
+			}
+			if got := httpProxyTarget(req); got != "" {
+				t.Fatalf("target = %q for a malformed request", got)
+			}
+		})
+	}
+}
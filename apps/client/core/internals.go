@@ -0,0 +1,95 @@
+package core
+
+import (
+	"context"
+	"runtime"
+	"time"
+)
+
+// internalsPollInterval 检查 InternalsLogInterval 是否到期的间隔
+const internalsPollInterval = time.Second
+
+// Internals 运行时和各内部表的大小，用于排查长时间运行后的内存或 goroutine 增长。
+// 除堆内存外各项在负载结束后应回落，或不超过对应的容量上限
+type Internals struct {
+	Time        time.Time `json:"time"`
+	Goroutines  int       `json:"goroutines"`
+	HeapAlloc   uint64    `json:"heapAlloc"`   // 已分配的堆内存（字节）
+	HeapInuse   uint64    `json:"heapInuse"`   // 使用中的堆内存 span（字节）
+	HeapObjects uint64    `json:"heapObjects"` // 堆上的对象数
+	NumGC       uint32    `json:"numGC"`
+
+	Conns           int   `json:"conns"`           // 已接受、尚未结束的本地连接，含本地握手阶段
+	Upstreams       int   `json:"upstreams"`       // 其中已建立上游连接（隧道 WebSocket 或直连目标）的数量
+	UDPAssociations int64 `json:"udpAssociations"` // 进行中的 SOCKS5 UDP ASSOCIATE
+	DNSPins         int   `json:"dnsPins"`         // 直连记住的主机 IP，上限 DNSPinMaxEntries
+	StatsSites      int   `json:"statsSites"`      // 流量统计中的站点，上限 StatsMaxSites
+	HostRateLimits  int   `json:"hostRateLimits"`  // 按主机限速的规则
+	ECHConfigSize   int   `json:"echConfigSize"`   // 缓存的 ECH 配置（字节）
+}
+
+// GetInternals 获取当前的运行时和内部表大小。会短暂暂停所有 goroutine 以读取堆统计，不宜频繁调用
+func (s *ProxyServer) GetInternals() Internals {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	in := Internals{
+		Time:            time.Now(),
+		Goroutines:      runtime.NumGoroutine(),
+		HeapAlloc:       mem.HeapAlloc,
+		HeapInuse:       mem.HeapInuse,
+		HeapObjects:     mem.HeapObjects,
+		NumGC:           mem.NumGC,
+		UDPAssociations: s.udpAssociations.Load(),
+		DNSPins:         s.dnsPins.len(),
+	}
+
+	s.connsMu.Lock()
+	in.Conns = len(s.conns)
+	for _, tc := range s.conns {
+		tc.mu.Lock()
+		if tc.upstream != nil {
+			in.Upstreams++
+		}
+		tc.mu.Unlock()
+	}
+	s.connsMu.Unlock()
+
+	if s.trafficStats != nil {
+		in.StatsSites = s.trafficStats.SiteCount()
+	}
+	if h := s.hostLimits.Load(); h != nil {
+		in.HostRateLimits = len(h.exact) + len(h.wildcard)
+	}
+	s.echListMu.RLock()
+	for _, e := range s.echConfigs {
+		in.ECHConfigSize += len(e.list)
+	}
+	s.echListMu.RUnlock()
+	return in
+}
+
+// logInternals 按 InternalsLogInterval 定期记录 GetInternals 的结果。
+// 每次检查都读取当前配置，Reload 修改间隔即可开关
+func (s *ProxyServer) logInternals(ctx context.Context) error {
+	ticker := time.NewTicker(internalsPollInterval)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		interval := s.GetConfig().InternalsLogInterval
+		if interval <= 0 || time.Since(last) < interval {
+			continue
+		}
+		last = time.Now()
+		in := s.GetInternals()
+		LogInfo("[诊断] goroutine %d, 堆 %s (使用中 %s, 对象 %d, GC %d 次), 连接 %d (上游 %d), UDP 关联 %d, 固定 IP %d, 站点统计 %d, 限速规则 %d",
+			in.Goroutines, FormatBytes(int64(in.HeapAlloc)), FormatBytes(int64(in.HeapInuse)), in.HeapObjects, in.NumGC,
+			in.Conns, in.Upstreams, in.UDPAssociations, in.DNSPins, in.StatsSites, in.HostRateLimits)
+	}
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// 生命周期操作的错误，在当前状态不允许该操作时返回
+var (
+	ErrAlreadyRunning = errors.New("服务器已在运行")
+	ErrNotRunning     = errors.New("服务器未运行")
+	ErrAlreadyPaused  = errors.New("服务器已暂停")
+	ErrNotPaused      = errors.New("服务器未暂停")
+)
+
+// lifecycleState 服务器的生命周期状态。
+// 状态只在持有 lifecycleMu 时转换（stopped → starting → running → stopping → stopped，
+// 启动失败时 starting → stopped），读写 state 字段还需持有 mu。
+// Start、Stop、Restart、UpdateConfig、Reload 持有 lifecycleMu 完成整个转换，
+// 并发调用依次执行，后台任务组（见 goBackground）每个运行周期只创建和等待一次。
+// 暂停是 running 状态下的子状态，由 Pause、Resume 切换，Start 时清除
+type lifecycleState int
+
+const (
+	lifecycleStopped lifecycleState = iota
+	lifecycleStarting
+	lifecycleRunning
+	lifecycleStopping
+)
+
+// setState 转换生命周期状态，调用方需持有 lifecycleMu
+func (s *ProxyServer) setState(state lifecycleState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
+
+// goBackground 在当前运行周期的后台任务组中运行 fn，用于随服务器运行、Stop 时退出的常驻任务。
+// fn 应在 ctx 取消后尽快返回；Stop 取消 ctx 并等待组内所有任务退出后才处理剩余连接。
+// fn 返回错误时取消 ctx，停止整个运行周期的后台任务，错误由 Stop 记录。
+// 调用方需持有 lifecycleMu 且服务器正在启动或运行，新增的后台任务都应通过它启动，而不是自建停止信号
+func (s *ProxyServer) goBackground(name string, fn func(ctx context.Context) error) {
+	s.mu.RLock()
+	group, ctx := s.group, s.ctx
+	s.mu.RUnlock()
+	group.Go(func() error {
+		if err := fn(ctx); err != nil {
+			return fmt.Errorf("后台任务 %s 异常退出: %w", name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// connQueueTimeout 连接数达到上限时新连接排队等待空位的时间，超时后拒绝
+const connQueueTimeout = 500 * time.Millisecond
+
+// connLimiter 并发连接数限制，基于带缓冲的 channel 实现信号量
+type connLimiter struct {
+	slots chan struct{}
+}
+
+// newConnLimiter 创建上限为 max 的限制器，max 小于 1 时不限制，返回 nil
+func newConnLimiter(max int) *connLimiter {
+	if max < 1 {
+		return nil
+	}
+	return &connLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire 获取一个连接名额，最多等待 connQueueTimeout
+func (l *connLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(connQueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *connLimiter) release() {
+	<-l.slots
+}
+
+// acquireConnSlot 为新连接获取名额，成功时返回释放函数。
+// 名额从获取时的限制器中释放，Reload 修改上限不影响已有连接
+func (s *ProxyServer) acquireConnSlot(ctx context.Context) (release func(), ok bool) {
+	limiter := s.limiter.Load()
+	if limiter != nil && !limiter.acquire(ctx) {
+		return nil, false
+	}
+	s.activeConns.Add(1)
+	return func() {
+		s.activeConns.Add(-1)
+		if limiter != nil {
+			limiter.release()
+		}
+	}, true
+}
+
+// ActiveConnections 返回当前正在处理的连接数
+func (s *ProxyServer) ActiveConnections() int64 {
+	return s.activeConns.Load()
+}
+
+// rejectConnection 拒绝新连接（连接数达到上限或已暂停）：SOCKS5 回复 0x01，HTTP 返回 503
+func rejectConnection(conn net.Conn, firstByte byte) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if firstByte != 0x05 {
+		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	// SOCKS5 需先完成方法协商，才能在请求阶段返回失败
+	buf := make([]byte, 256)
+	if _, err := conn.Read(buf); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return
+	}
+	if _, err := conn.Read(buf); err != nil {
+		return
+	}
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+}
@@ -1,8 +1,11 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sync/atomic"
+	"time"
 )
 
 // LogHandler 日志处理接口，由外部实现
@@ -19,32 +22,77 @@ func SetLogHandler(handler LogHandler) {
 	logHandler = handler
 }
 
-// LogInfo 记录 info 日志
-func LogInfo(format string, v ...interface{}) {
+// recentLogSize 日志缓冲区保留的最近日志条数，供 ExplainHost 按连接 ID 查找相关日志
+const recentLogSize = 1000
+
+// logEntry 日志缓冲区中的一条日志，connID 为 0 表示与具体连接无关
+type logEntry struct {
+	time   time.Time
+	level  string
+	connID uint64
+	msg    string
+}
+
+// recentLogs 进程内所有 ProxyServer 共用的最近日志，连接 ID 在进程内唯一，不会混淆
+var recentLogs = newRingBuffer[logEntry](recentLogSize)
+
+// connIDSeq 分配连接 ID，从 1 开始
+var connIDSeq atomic.Uint64
+
+type connIDKey struct{}
+
+// withConnID 为一个本地连接分配连接 ID 并放入 ctx，该连接的分流决策、连接记录和日志共用此 ID
+func withConnID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, connIDKey{}, connIDSeq.Add(1))
+}
+
+// connIDFrom 返回 ctx 中的连接 ID，没有时为 0
+func connIDFrom(ctx context.Context) uint64 {
+	id, _ := ctx.Value(connIDKey{}).(uint64)
+	return id
+}
+
+// logf 格式化日志，写入日志缓冲区后交给 logHandler，未设置时输出到标准日志。
+// connID 不为 0 时消息以 "[#ID]" 开头，便于在日志文件中按连接检索
+func logf(level string, connID uint64, format string, v ...interface{}) {
 	msg := fmt.Sprintf(format, v...)
-	if logHandler != nil {
+	if connID != 0 {
+		msg = fmt.Sprintf("[#%d] %s", connID, msg)
+	}
+	recentLogs.Add(logEntry{time: time.Now(), level: level, connID: connID, msg: msg})
+	switch {
+	case logHandler == nil:
+		log.Printf("[%s] %s", level, msg)
+	case level == "ERROR":
+		logHandler.Error(msg)
+	case level == "DEBUG":
+		logHandler.Debug(msg)
+	default:
 		logHandler.Info(msg)
-	} else {
-		log.Printf("[INFO] %s", msg)
 	}
 }
 
-// LogError 记录 error 日志
+// LogInfo 记录 info 日志。内部 API，外部程序通过 SetLogHandler 接收日志
+func LogInfo(format string, v ...interface{}) {
+	logf("INFO", 0, format, v...)
+}
+
+// LogError 记录 error 日志。内部 API
 func LogError(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	if logHandler != nil {
-		logHandler.Error(msg)
-	} else {
-		log.Printf("[ERROR] %s", msg)
-	}
+	logf("ERROR", 0, format, v...)
 }
 
-// LogDebug 记录 debug 日志
+// LogDebug 记录 debug 日志。内部 API
 func LogDebug(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	if logHandler != nil {
-		logHandler.Debug(msg)
-	} else {
-		log.Printf("[DEBUG] %s", msg)
-	}
+	logf("DEBUG", 0, format, v...)
+}
+
+// logConnInfo 记录属于 ctx 中连接的 info 日志
+func logConnInfo(ctx context.Context, format string, v ...interface{}) {
+	logf("INFO", connIDFrom(ctx), format, v...)
+}
+
+// logConnError 记录属于 ctx 中连接的 error 日志
+func logConnError(ctx context.Context, format string, v ...interface{}) {
+	logf("ERROR", connIDFrom(ctx), format, v...)
 }
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 网络变化检测参数
+const (
+	networkPollInterval = 3 * time.Second // 网卡地址轮询间隔
+	networkSettleTime   = 5 * time.Second // 地址保持不变多久后才视为切换完成，合并连续变化
+)
+
+// watchNetwork 定期比较本机网卡地址，切换 Wi-Fi、连接或断开 VPN 后清空缓存并重新获取 ECH 配置，
+// 避免缓存的连接和 ECH 配置在新网络下不可用导致代理失效。
+// 每次轮询都读取当前配置，Reload 修改 WatchNetwork 即可开关
+func (s *ProxyServer) watchNetwork(ctx context.Context) error {
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+
+	var last string
+	var changedAt time.Time // 非零表示有未处理的变化
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if !s.GetConfig().WatchNetwork {
+			last, changedAt = "", time.Time{}
+			continue
+		}
+		current, err := networkFingerprint()
+		if err != nil {
+			continue
+		}
+		switch {
+		case last == "":
+			last = current
+		case current != last:
+			last = current
+			changedAt = time.Now()
+		case !changedAt.IsZero() && time.Since(changedAt) >= networkSettleTime:
+			changedAt = time.Time{}
+			LogInfo("[网络] 检测到网络变化，正在刷新缓存和 ECH 配置")
+			s.FlushCaches()
+		}
+	}
+}
+
+// networkFingerprint 返回已启用的非回环网卡及其地址的摘要，网络切换后会发生变化
+func networkFingerprint() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	var entries []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			entries = append(entries, iface.Name+"="+addr.String())
+		}
+	}
+	sort.Strings(entries)
+	// 没有任何地址时也要与初始状态区分
+	return "net:" + strings.Join(entries, ","), nil
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// NodeURIScheme 节点分享链接的协议名，格式见 ParseNodeURI
+const NodeURIScheme = "echplus"
+
+// Node 分享链接描述的一个节点，字段与桌面端的节点对应，命令行客户端和桌面端共用同一解析逻辑
+type Node struct {
+	Name               string   `json:"name"`               // 显示名称，链接中未指定时为 Address
+	Address            string   `json:"address"`            // 服务端主机名或 IP
+	Port               int64    `json:"port"`               // 服务端端口，链接中未指定时为 443
+	Token              string   `json:"token"`              // 身份验证令牌，可为空
+	ServerIP           string   `json:"serverIP"`           // 连接服务端使用的 IP，格式同 Config.ServerIP，为空时使用 HTTPS 记录中的地址提示或 FallbackServerHost
+	PinnedSPKI         []string `json:"pinnedSPKI"`         // 服务端证书的公钥固定值，见 Config.PinnedSPKI
+	PinAnyChain        bool     `json:"pinAnyChain"`        // 固定值可匹配证书链中的任一证书
+	HTTP2              bool     `json:"http2"`              // 通过 HTTP/2 扩展 CONNECT 建立 WebSocket
+	ECHDomain          string   `json:"echDomain"`          // 查询 ECH 配置的域名，为空时使用全局设置，可为 ECHDomainServer
+	FallbackServerHost string   `json:"fallbackServerHost"` // ServerIP 为空时连接服务端使用的域名，为空时使用默认值，见 Config.FallbackServerHost
+}
+
+// nodeURIParams 分享链接支持的查询参数
+var nodeURIParams = map[string]bool{"ip": true, "pin": true, "pinchain": true, "h2": true, "ech": true, "fallback": true}
+
+// ParseNodeURI 解析节点分享链接，格式为
+//
+//	echplus://[令牌@]主机[:端口][?ip=服务端IP&fallback=ServerIP为空时使用的域名&pin=公钥固定值&pinchain=1&h2=1&ech=ECH域名][#名称]
+//
+// 令牌、名称等按 URL 规则转义，pin 可出现多次，端口缺省为 443。
+// 不认识的参数视为错误而不是忽略，避免较新版本生成的链接中的公钥固定等安全设置被悄悄丢弃
+func ParseNodeURI(raw string) (Node, error) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Node{}, fmt.Errorf("无效的节点链接: %w", err)
+	}
+	if u.Scheme != NodeURIScheme {
+		return Node{}, fmt.Errorf("无效的节点链接 %q: 应以 %s:// 开头", raw, NodeURIScheme)
+	}
+	if u.Opaque != "" || (u.Path != "" && u.Path != "/") {
+		return Node{}, fmt.Errorf("无效的节点链接 %q: 不支持路径", raw)
+	}
+
+	n := Node{Address: u.Hostname(), Port: 443, Name: u.Fragment}
+	if p := u.Port(); p != "" {
+		if n.Port, err = strconv.ParseInt(p, 10, 64); err != nil {
+			return Node{}, fmt.Errorf("节点链接中的端口 %q 无效", p)
+		}
+	}
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return Node{}, fmt.Errorf("节点链接中的令牌不能包含未转义的 ':'")
+		}
+		n.Token = u.User.Username()
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Node{}, fmt.Errorf("节点链接的参数无效: %w", err)
+	}
+	for key := range query {
+		if !nodeURIParams[key] {
+			return Node{}, fmt.Errorf("节点链接包含不支持的参数 %q，可能由较新的版本生成", key)
+		}
+	}
+	n.ServerIP, n.FallbackServerHost, n.ECHDomain = query.Get("ip"), query.Get("fallback"), query.Get("ech")
+	for _, pin := range query["pin"] {
+		n.PinnedSPKI = append(n.PinnedSPKI, strings.Split(pin, ",")...)
+	}
+	if n.PinAnyChain, err = parseNodeBool(query, "pinchain"); err != nil {
+		return Node{}, err
+	}
+	if n.HTTP2, err = parseNodeBool(query, "h2"); err != nil {
+		return Node{}, err
+	}
+	if n.Name == "" {
+		n.Name = n.Address
+	}
+	if err := n.Validate(); err != nil {
+		return Node{}, err
+	}
+	return n, nil
+}
+
+// Validate 检查节点的各字段，返回第一个无效字段的说明。桌面端手动创建节点时同样调用
+func (n Node) Validate() error {
+	if strings.TrimSpace(n.Name) == "" {
+		return errors.New("节点名称不能为空")
+	}
+	if !validHost(n.Address) {
+		return fmt.Errorf("节点地址 %q 无效: 应为主机名或 IP，不含协议和端口", n.Address)
+	}
+	if n.Port < 1 || n.Port > 65535 {
+		return fmt.Errorf("节点端口 %d 无效: 应为 1-65535", n.Port)
+	}
+	if err := validToken(n.Token); err != nil {
+		return err
+	}
+	if n.ServerIP != "" {
+		entries, err := parseServerIPs(n.ServerIP)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.cidr == nil && !validHost(e.host) {
+				return fmt.Errorf("服务端 IP %q 无效", e.host)
+			}
+		}
+	}
+	if n.FallbackServerHost != "" && !validHost(n.FallbackServerHost) {
+		return fmt.Errorf("备用连接域名 %q 无效", n.FallbackServerHost)
+	}
+	if _, err := parseSPKIPins(n.PinnedSPKI); err != nil {
+		return err
+	}
+	if n.ECHDomain != "" && n.ECHDomain != ECHDomainServer && (!validHost(n.ECHDomain) || net.ParseIP(n.ECHDomain) != nil) {
+		return fmt.Errorf("ECH 域名 %q 无效", n.ECHDomain)
+	}
+	return nil
+}
+
+// parseNodeBool 解析布尔参数 key，未指定时为 false
+func parseNodeBool(query url.Values, key string) (bool, error) {
+	v := query.Get(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("节点链接的参数 %s=%q 无效: 应为 1 或 0", key, v)
+	}
+	return b, nil
+}
+
+// ParseNodeList 解析订阅内容：每行一个节点分享链接，忽略空行和以 # 开头的注释；
+// 整体为 base64 编码（标准或 URL 编码，可省略填充）时先解码。任一行无效时返回带行号的错误
+func ParseNodeList(data []byte) ([]Node, error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.Contains(data, []byte("://")) {
+		compact := bytes.Join(bytes.Fields(data), nil)
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if decoded, err := enc.DecodeString(string(compact)); err == nil {
+				data = decoded
+				break
+			}
+		}
+	}
+	var nodes []Node
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		n, err := ParseNodeURI(entry)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行: %w", line, err)
+		}
+		nodes = append(nodes, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("订阅中没有节点")
+	}
+	return nodes, nil
+}
+
+// URI 返回节点的分享链接，ParseNodeURI 解析后得到相同的节点
+func (n Node) URI() string {
+	u := url.URL{Scheme: NodeURIScheme, Host: net.JoinHostPort(n.Address, strconv.FormatInt(n.Port, 10)), Fragment: n.Name}
+	if n.Token != "" {
+		u.User = url.User(n.Token)
+	}
+	query := url.Values{}
+	if n.ServerIP != "" {
+		query.Set("ip", n.ServerIP)
+	}
+	if n.FallbackServerHost != "" {
+		query.Set("fallback", n.FallbackServerHost)
+	}
+	for _, pin := range n.PinnedSPKI {
+		query.Add("pin", pin)
+	}
+	if n.PinAnyChain {
+		query.Set("pinchain", "1")
+	}
+	if n.HTTP2 {
+		query.Set("h2", "1")
+	}
+	if n.ECHDomain != "" {
+		query.Set("ech", n.ECHDomain)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// ApplyTo 将节点的连接信息写入 cfg，ECHDomain 为空时保留 cfg 中的值
+func (n Node) ApplyTo(cfg *Config) {
+	cfg.ServerAddr = net.JoinHostPort(n.Address, strconv.FormatInt(n.Port, 10))
+	cfg.Token = n.Token
+	cfg.ServerIP = n.ServerIP
+	cfg.FallbackServerHost = n.FallbackServerHost
+	cfg.PinnedSPKI = n.PinnedSPKI
+	cfg.PinAnyChainCert = n.PinAnyChain
+	cfg.HTTP2WebSocket = n.HTTP2
+	if n.ECHDomain != "" {
+		cfg.ECHDomain = n.ECHDomain
+	}
+}
+
+// validToken 检查令牌：令牌作为 WebSocket 子协议发送，只能包含 HTTP token 字符
+func validToken(token string) error {
+	if i := strings.IndexFunc(token, func(r rune) bool { return r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, r) }); i >= 0 {
+		return fmt.Errorf("令牌包含不允许的字符 %q", token[i:i+1])
+	}
+	return nil
+}
+
+// validHost 判断 host 是否为 IP 或合法的主机名
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNodeURI(t *testing.T) {
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	t.Run("round trip", func(t *testing.T) {
+		want := Node{
+			Name:               "东京 1",
+			Address:            "ech.example.com",
+			Port:               8443,
+			Token:              "tok-en_1",
+			ServerIP:           "104.16.0.0/13,example.net",
+			PinnedSPKI:         []string{pin, pin},
+			PinAnyChain:        true,
+			HTTP2:              true,
+			ECHDomain:          ECHDomainServer,
+			FallbackServerHost: "www.example.org",
+		}
+		got, err := ParseNodeURI(want.URI())
+		if err != nil {
+			t.Fatalf("parse %s: %v", want.URI(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("round trip of %s = %+v, want %+v", want.URI(), got, want)
+		}
+
+		var cfg Config
+		cfg.ECHDomain = "global.example"
+		got.ECHDomain = ""
+		got.ApplyTo(&cfg)
+		if cfg.ServerAddr != "ech.example.com:8443" || cfg.Token != want.Token || cfg.ServerIP != want.ServerIP ||
+			len(cfg.PinnedSPKI) != 2 || !cfg.PinAnyChainCert || !cfg.HTTP2WebSocket || cfg.ECHDomain != "global.example" {
+			t.Fatalf("ApplyTo = %+v", cfg)
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		n, err := ParseNodeURI("echplus://[2001:db8::1]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Port != 443 || n.Name != "2001:db8::1" || n.Token != "" {
+			t.Fatalf("node = %+v, want port 443 named after the address", n)
+		}
+		var cfg Config
+		n.ApplyTo(&cfg)
+		if cfg.ServerAddr != "[2001:db8::1]:443" {
+			t.Fatalf("ServerAddr = %q", cfg.ServerAddr)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, tc := range []struct{ uri, want string }{
+			{"https://ech.example.com", "echplus://"},
+			{"echplus://ech.example.com:0", "端口"},
+			{"echplus://ech.example.com:70000", "端口"},
+			{"echplus://ech.example.com/path", "路径"},
+			{"echplus://ech.example.com?obfs=1", `"obfs"`},
+			{"echplus://ech.example.com?pin=sha256/short", "公钥固定值"},
+			{"echplus://ech.example.com?h2=maybe", "h2"},
+			{"echplus://ech.example.com?ech=1.2.3.4", "ECH"},
+			{"echplus://bad_host-.example", "地址"},
+			{"echplus://a:b@ech.example.com", "令牌"},
+			{"echplus://a%20b@ech.example.com", "令牌"},
+		} {
+			if _, err := ParseNodeURI(tc.uri); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("ParseNodeURI(%q) error = %v, want mention of %q", tc.uri, err, tc.want)
+			}
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		plain := "# 订阅\nvmess://x\n"
+		if _, err := ParseNodeList([]byte(plain)); err == nil || !strings.Contains(err.Error(), "第 2 行") {
+			t.Fatalf("invalid entry error = %v, want its line number", err)
+		}
+		list := "echplus://a.example#A\n\n# 注释\r\nechplus://t@b.example:2053?h2=1#B\n"
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(list))
+		nodes, err := ParseNodeList([]byte(encoded[:20] + "\n" + encoded[20:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 2 || nodes[0].Name != "A" || nodes[1].Port != 2053 || !nodes[1].HTTP2 || nodes[1].Token != "t" {
+			t.Fatalf("nodes = %+v", nodes)
+		}
+		if _, err := ParseNodeList([]byte("# 空\n")); err == nil {
+			t.Fatal("empty subscription accepted")
+		}
+	})
+}
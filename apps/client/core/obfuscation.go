@@ -0,0 +1,120 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+
+	"github.com/atticus6/echPlus/apps/client/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Obfuscation 隧道开头几帧的混淆方式
+type Obfuscation string
+
+const (
+	ObfuscationNone Obfuscation = "none" // 不混淆
+	// ObfuscationFragment 将握手后的第一个 WebSocket 帧拆成 64–512 字节的随机长度分片写入，
+	// wss:// 下每个分片为单独的 TLS 记录。服务端无需支持
+	ObfuscationFragment Obfuscation = "fragment"
+	// ObfuscationPad 在前 paddedFrames 个上传帧末尾附加随机填充，由服务端去除。
+	// 通过子协议 protocol.PaddingSuffix 协商，服务端不支持时不填充
+	ObfuscationPad Obfuscation = "pad"
+)
+
+// 混淆参数
+const (
+	fragmentMin  = 64  // 分片的最小长度
+	fragmentMax  = 512 // 分片的最大长度
+	paddedFrames = 3   // 填充的上传帧数，包括 CONNECT
+	maxPadding   = 512 // 每帧填充的最大字节数
+)
+
+// offerPadding 在每个帧格式子协议之前插入其填充版本，protocols[0] 为令牌
+func offerPadding(protocols []string) []string {
+	out := []string{protocols[0]}
+	for _, p := range protocols[1:] {
+		out = append(out, p+protocol.PaddingSuffix, p)
+	}
+	return out
+}
+
+// writePadded 编码帧并附加至多 maxPadding 字节的随机填充后写入 ws，见 protocol.Pad。只用于二进制帧格式
+func writePadded(ws *websocket.Conn, codec protocol.Codec, f protocol.Frame) error {
+	mt, data, err := codec.Encode(f)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(mt, protocol.Pad(data, rand.IntN(maxPadding+1)))
+}
+
+// fragmentConn 调用 arm 后，将下一次写入拆成随机长度的分片逐个写入底层连接，之后的写入不受影响
+type fragmentConn struct {
+	net.Conn
+	armed atomic.Bool
+}
+
+func (c *fragmentConn) arm() {
+	c.armed.Store(true)
+}
+
+func (c *fragmentConn) Write(p []byte) (int, error) {
+	if !c.armed.CompareAndSwap(true, false) {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		size := min(len(p)-written, fragmentMin+rand.IntN(fragmentMax-fragmentMin+1))
+		n, err := c.Conn.Write(p[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// fragmentDialer 使 dialer 返回 fragmentConn。wss:// 时改由这里完成 TLS 握手，
+// 以便分片写在 TLS 之上、每片成为单独的 TLS 记录；已设置 NetDialTLSContext（HTTP/2）时直接包装其返回的流
+func fragmentDialer(dialer *websocket.Dialer) {
+	wrap := func(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &fragmentConn{Conn: conn}, nil
+		}
+	}
+	if dialer.NetDialTLSContext != nil {
+		dialer.NetDialContext, dialer.NetDialTLSContext = wrap(dialer.NetDialContext), wrap(dialer.NetDialTLSContext)
+		return
+	}
+	dial := dialer.NetDialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tlsCfg := dialer.TLSClientConfig
+	dialer.NetDialContext = wrap(dial)
+	dialer.NetDialTLSContext = wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		raw, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := tlsCfg.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		conn := tls.Client(raw, cfg)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// pacPath 启用 ServePAC 时代理端口上提供自动配置脚本的路径
+const pacPath = "/proxy.pac"
+
+// buildPAC 按分流模式生成 PAC 脚本的规则部分，proxy 变量由 servePAC 按请求补上:
+//   - none 全部直连
+//   - global 除不带域名的主机和局域网 IP 外全部经代理，与 routeDecision 一致
+//   - bypass_cn 另外对解析到中国大陆 IPv4 地址的主机直连（dnsResolve 只返回 IPv4）
+func (s *ProxyServer) buildPAC(mode RoutingMode) string {
+	var b strings.Builder
+	if mode == RoutingModeNone {
+		b.WriteString("function FindProxyForURL(url, host) {\n\treturn \"DIRECT\";\n}\n")
+		return b.String()
+	}
+	b.WriteString("var lan = [[\"10.0.0.0\", \"255.0.0.0\"], [\"172.16.0.0\", \"255.240.0.0\"], [\"192.168.0.0\", \"255.255.0.0\"], " +
+		"[\"127.0.0.0\", \"255.0.0.0\"], [\"169.254.0.0\", \"255.255.0.0\"]];\n")
+	if mode == RoutingModeBypassCN {
+		// 中国大陆 IPv4 段按起止地址依次排列，二分查找
+		b.WriteString("var cn = [")
+		s.chinaIPRangesMu.RLock()
+		for i, r := range s.chinaIPRanges {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%d,%d", r.start, r.end)
+		}
+		s.chinaIPRangesMu.RUnlock()
+		b.WriteString("];\n")
+		b.WriteString(`function isChina(ip) {
+	var p = ip.split(".");
+	var n = ((p[0] << 24) >>> 0) + (p[1] << 16) + (p[2] << 8) + (p[3] | 0);
+	var lo = 0, hi = cn.length / 2;
+	while (lo < hi) {
+		var mid = (lo + hi) >> 1;
+		if (n < cn[2 * mid]) hi = mid;
+		else if (n > cn[2 * mid + 1]) lo = mid + 1;
+		else return true;
+	}
+	return false;
+}
+`)
+	}
+	// global 模式只按 IP 字面量判断局域网地址，不解析域名，避免浏览器在本地查询 DNS
+	resolve := "null"
+	if mode == RoutingModeBypassCN {
+		resolve = "dnsResolve(host)"
+	}
+	b.WriteString(`function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || host === "localhost") return "DIRECT";
+	var ip = /^\d+\.\d+\.\d+\.\d+$/.test(host) ? host : ` + resolve + `;
+	if (!ip) return proxy;
+	for (var i = 0; i < lan.length; i++) {
+		if (isInNet(ip, lan[i][0], lan[i][1])) return "DIRECT";
+	}
+`)
+	if mode == RoutingModeBypassCN {
+		b.WriteString("\tif (isChina(ip)) return \"DIRECT\";\n")
+	}
+	b.WriteString("\treturn proxy;\n}\n")
+	return b.String()
+}
+
+// refreshPAC 按当前分流模式重新生成 PAC 脚本，分流数据加载后调用
+func (s *ProxyServer) refreshPAC() {
+	pac := s.buildPAC(s.GetConfig().RoutingMode)
+	s.pac.Store(&pac)
+}
+
+// pacProxyAddr PAC 中代理的地址：监听在具体 IP 时使用该 IP，监听在 0.0.0.0 等地址时使用 requestHost
+// （浏览器获取 PAC 使用的主机），requestHost 为空时使用 127.0.0.1
+func pacProxyAddr(listen net.Addr, requestHost string) string {
+	addr, ok := listen.(*net.TCPAddr)
+	if !ok {
+		return listen.String()
+	}
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		if h, _, err := net.SplitHostPort(requestHost); err == nil {
+			requestHost = h
+		}
+		host = strings.Trim(requestHost, "[]")
+		if host == "" {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
+
+// servePAC 返回 PAC 脚本，代理地址为 SOCKS5 监听地址
+func (s *ProxyServer) servePAC(conn net.Conn, requestHost string) {
+	pac, listen := s.pac.Load(), s.Addr()
+	if pac == nil || listen == nil {
+		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return
+	}
+	addr := pacProxyAddr(listen, requestHost)
+	body := fmt.Sprintf("var proxy = \"SOCKS5 %s; SOCKS %s\";\n%s", addr, addr, *pac)
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\nContent-Length: %d\r\n"+
+		"Cache-Control: no-cache\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
+
+// PACURL 返回浏览器自动代理配置使用的 PAC 地址，如 http://127.0.0.1:30000/proxy.pac。
+// 未启用 ServePAC 或未运行时返回空字符串；监听在 0.0.0.0 时主机为 127.0.0.1，其他设备需替换为本机地址
+func (s *ProxyServer) PACURL() string {
+	listen := s.Addr()
+	if listen == nil || !s.GetConfig().ServePAC {
+		return ""
+	}
+	return "http://" + pacProxyAddr(listen, "") + pacPath
+}
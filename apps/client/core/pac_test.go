@@ -0,0 +1,71 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPACFile 启用 ServePAC 后代理端口提供 /proxy.pac，代理地址为 SOCKS5 监听地址，内容随分流模式变化
+func TestPACFile(t *testing.T) {
+	cfg := testConfig(t)
+	if err := os.WriteFile(filepath.Join(cfg.StoreDir, "chn_ip.txt"), []byte("1.2.3.0 1.2.3.255\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.StoreDir, "chn_ip_v6.txt"), []byte("2400:3200:: 2400:3200:ffff:ffff:ffff:ffff:ffff:ffff\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := startTestServer(t, cfg)
+	if url := client.PACURL(); url != "" {
+		t.Fatalf("PACURL with ServePAC off = %q", url)
+	}
+	fetch := func() (int, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + client.Addr().String() + "/proxy.pac")
+		if err != nil {
+			t.Fatalf("GET proxy.pac: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	cfg.ServePAC = true
+	if err := client.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	wantURL := "http://" + client.Addr().String() + "/proxy.pac"
+	if got := client.PACURL(); got != wantURL {
+		t.Fatalf("PACURL = %q, want %q", got, wantURL)
+	}
+	code, body := fetch()
+	if code != http.StatusOK {
+		t.Fatalf("GET proxy.pac = %d", code)
+	}
+	if want := `"SOCKS5 ` + client.Addr().String() + "; SOCKS " + client.Addr().String() + `"`; !strings.Contains(body, want) {
+		t.Fatalf("PAC does not use the proxy %s:\n%s", want, body)
+	}
+	if strings.Contains(body, "isChina") {
+		t.Fatal("global PAC bypasses China")
+	}
+
+	cfg.RoutingMode = RoutingModeBypassCN
+	if err := client.UpdateConfig(cfg); err != nil {
+		t.Fatalf("UpdateConfig: %v", err)
+	}
+	_, body = fetch()
+	// 1.2.3.0 - 1.2.3.255
+	if !strings.Contains(body, "var cn = [16909056,16909311];") || !strings.Contains(body, "if (isChina(ip)) return \"DIRECT\";") {
+		t.Fatalf("bypass_cn PAC does not go direct for China hosts:\n%s", body)
+	}
+
+	cfg.RoutingMode = RoutingModeNone
+	if err := client.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, body = fetch(); strings.Contains(body, "return proxy") {
+		t.Fatalf("none PAC uses the proxy:\n%s", body)
+	}
+}
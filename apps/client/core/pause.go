@@ -0,0 +1,83 @@
+package core
+
+// PauseMode 暂停期间新连接的处理方式
+type PauseMode string
+
+const (
+	PauseModeReject PauseMode = "reject" // 拒绝新连接（SOCKS5 回复 0x01，HTTP 返回 503）
+	PauseModeDirect PauseMode = "direct" // 新连接全部直连，不经过代理
+)
+
+// ServerState 代理服务器状态
+type ServerState string
+
+const (
+	StateStopped  ServerState = "stopped"
+	StateStarting ServerState = "starting"
+	StateRunning  ServerState = "running"
+	StatePaused   ServerState = "paused"
+	StateStopping ServerState = "stopping"
+)
+
+// Pause 暂停代理：监听继续接受连接，但按 PauseMode 拒绝或直连新连接。
+// ECH 配置、流量统计、系统代理设置均保留；PauseDrain 为 true 时关闭暂停时已有的连接
+// （等待 DrainTimeout 后强制关闭），暂停期间接受的连接不受影响，否则现有隧道继续运行。
+// 未运行时返回 ErrNotRunning，已暂停时返回 ErrAlreadyPaused
+func (s *ProxyServer) Pause() error {
+	s.mu.RLock()
+	state := s.state
+	drain, timeout := s.config.PauseDrain, s.config.DrainTimeout
+	s.mu.RUnlock()
+	if state != lifecycleRunning {
+		return ErrNotRunning
+	}
+	if !s.paused.CompareAndSwap(false, true) {
+		return ErrAlreadyPaused
+	}
+	LogInfo("[代理] 已暂停，新连接处理方式: %s", s.pauseMode())
+	if drain {
+		go drainTrackedConns(s.trackedConns(), timeout)
+	}
+	return nil
+}
+
+// Resume 恢复暂停的代理，未运行时返回 ErrNotRunning，未暂停时返回 ErrNotPaused
+func (s *ProxyServer) Resume() error {
+	s.mu.RLock()
+	state := s.state
+	s.mu.RUnlock()
+	if state != lifecycleRunning {
+		return ErrNotRunning
+	}
+	if !s.paused.CompareAndSwap(true, false) {
+		return ErrNotPaused
+	}
+	LogInfo("[代理] 已恢复")
+	return nil
+}
+
+// GetState 获取服务器状态
+func (s *ProxyServer) GetState() ServerState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch s.state {
+	case lifecycleStarting:
+		return StateStarting
+	case lifecycleStopping:
+		return StateStopping
+	case lifecycleStopped:
+		return StateStopped
+	}
+	if s.paused.Load() {
+		return StatePaused
+	}
+	return StateRunning
+}
+
+// pauseMode 返回暂停期间新连接的处理方式，未配置时为拒绝
+func (s *ProxyServer) pauseMode() PauseMode {
+	if s.GetConfig().PauseMode == PauseModeDirect {
+		return PauseModeDirect
+	}
+	return PauseModeReject
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// connPhase 客户端连接所处的阶段，每个阶段有独立的超时，进入新阶段时重置截止时间
+type connPhase int
+
+const (
+	phaseHandshake connPhase = iota // 本地 SOCKS5/HTTP 协议握手，直到解析出目标地址
+	phaseEstablish                  // 分流决策及上游连接建立，直到向客户端返回成功
+	phaseIdle                       // 数据转发，超过 IdleTimeout 无数据时关闭
+)
+
+func (p connPhase) String() string {
+	switch p {
+	case phaseHandshake:
+		return "本地握手"
+	case phaseEstablish:
+		return "建立连接"
+	default:
+		return "空闲"
+	}
+}
+
+// 阶段超时默认值
+const (
+	defaultLocalHandshakeTimeout = 10 * time.Second
+	defaultEstablishTimeout      = 30 * time.Second
+)
+
+// phaseTimeout 返回阶段的超时时间，0 表示不限制
+func (s *ProxyServer) phaseTimeout(p connPhase) time.Duration {
+	cfg := s.GetConfig()
+	switch p {
+	case phaseHandshake:
+		if cfg.HandshakeTimeout > 0 {
+			return cfg.HandshakeTimeout
+		}
+		return defaultLocalHandshakeTimeout
+	case phaseEstablish:
+		if cfg.EstablishTimeout > 0 {
+			return cfg.EstablishTimeout
+		}
+		return defaultEstablishTimeout
+	default:
+		return cfg.IdleTimeout
+	}
+}
+
+// dialTimeout 返回生效的 DialTimeout
+func (s *ProxyServer) dialTimeout() time.Duration {
+	return cmp.Or(s.GetConfig().DialTimeout, defaultDialTimeout)
+}
+
+// tlsHandshakeTimeout 返回生效的 TLSHandshakeTimeout
+func (s *ProxyServer) tlsHandshakeTimeout() time.Duration {
+	return cmp.Or(s.GetConfig().TLSHandshakeTimeout, defaultTLSHandshakeTimeout)
+}
+
+// dohTimeout 返回生效的 DoHTimeout
+func (s *ProxyServer) dohTimeout() time.Duration {
+	return cmp.Or(s.GetConfig().DoHTimeout, defaultDoHTimeout)
+}
+
+// enterPhase 进入新阶段并重置客户端连接的截止时间，返回该阶段的截止时间（零值表示不限制）。
+// 空闲阶段不设截止时间，由 idleTimer 按双向数据活动判断
+func (s *ProxyServer) enterPhase(conn net.Conn, p connPhase) time.Time {
+	var deadline time.Time
+	if timeout := s.phaseTimeout(p); timeout > 0 && p != phaseIdle {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	s.connsMu.Lock()
+	tc := s.conns[trackedKey(conn)]
+	s.connsMu.Unlock()
+	if tc != nil {
+		tc.mu.Lock()
+		tc.phase = p
+		tc.phaseDeadline = deadline
+		tc.mu.Unlock()
+	}
+	return deadline
+}
+
+// logPhaseTimeout 连接处理结束时，若已超过当前阶段的截止时间，记录超时的阶段
+func (s *ProxyServer) logPhaseTimeout(ctx context.Context, conn net.Conn, clientAddr string) {
+	s.connsMu.Lock()
+	tc := s.conns[trackedKey(conn)]
+	s.connsMu.Unlock()
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	p, deadline := tc.phase, tc.phaseDeadline
+	tc.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		logConnInfo(ctx, "[代理] %s %s阶段超时 (%v)", clientAddr, p, s.phaseTimeout(p))
+	}
+}
+
+// idleTimer 空闲超时。转发循环每次收发数据时调用 touch 更新最近活动时间，
+// 计时器到期时按最近活动时间判断是否已空闲，未空闲则顺延。nil 表示不限制
+type idleTimer struct {
+	timer        *time.Timer
+	timeout      time.Duration
+	lastActivity atomic.Int64 // UnixNano
+}
+
+// newIdleTimer 进入空闲阶段，双向超过 IdleTimeout 无数据时调用 onIdle 关闭隧道，
+// 未设置 IdleTimeout 时返回 nil
+func (s *ProxyServer) newIdleTimer(ctx context.Context, conn net.Conn, clientAddr string, onIdle func()) *idleTimer {
+	s.enterPhase(conn, phaseIdle)
+	timeout := s.phaseTimeout(phaseIdle)
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTimer{timeout: timeout}
+	t.touch()
+	t.timer = time.AfterFunc(timeout, func() {
+		if idle := time.Since(time.Unix(0, t.lastActivity.Load())); idle < timeout {
+			t.timer.Reset(timeout - idle)
+			return
+		}
+		logConnInfo(ctx, "[代理] %s %s阶段超时 (%v)，关闭连接", clientAddr, phaseIdle, timeout)
+		onIdle()
+	})
+	return t
+}
+
+// touch 记录一次数据活动
+func (t *idleTimer) touch() {
+	if t != nil {
+		t.lastActivity.Store(time.Now().UnixNano())
+	}
+}
+
+// stop 停止计时
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// PlaintextPolicy 经代理发送明文协议时的处理方式，见 Config.PlaintextPolicy
+type PlaintextPolicy string
+
+const (
+	PlaintextAllow PlaintextPolicy = "allow" // 不检查，与未设置相同
+	PlaintextWarn  PlaintextPolicy = "warn"  // 记录日志并通知 PlaintextHandler，连接照常建立
+	PlaintextBlock PlaintextPolicy = "block" // 拒绝连接，不连接服务端，返回 ErrPlaintextBlocked
+)
+
+// ErrPlaintextBlocked PlaintextPolicy 为 block 时拒绝了经代理发送的明文协议连接
+var ErrPlaintextBlocked = errors.New("明文协议连接已被 PlaintextPolicy 拒绝")
+
+// plaintextPorts 常见明文协议的端口，发往这些端口的连接除非首个数据包为 TLS ClientHello，否则按明文处理。
+// STARTTLS 要在明文交互后才升级，无法在首个数据包中识别，需要时将邮件服务器加入 PlaintextExempt
+var plaintextPorts = map[int]string{
+	21:   "FTP",
+	23:   "Telnet",
+	25:   "SMTP",
+	80:   "HTTP",
+	110:  "POP3",
+	143:  "IMAP",
+	8080: "HTTP",
+}
+
+// PlaintextEvent 一次经代理发送的明文协议连接
+type PlaintextEvent struct {
+	ConnID   uint64 `json:"connId"`   // 连接 ID，见 ActiveConnection
+	Target   string `json:"target"`   // 目标 host:port
+	Protocol string `json:"protocol"` // 识别出的协议，如 HTTP、FTP
+	Blocked  bool   `json:"blocked"`  // 是否已拒绝连接
+}
+
+// PlaintextHandler 接收 PlaintextPolicy 为 warn 或 block 时检查出的明文协议连接
+type PlaintextHandler func(PlaintextEvent)
+
+var plaintextHandler atomic.Pointer[PlaintextHandler]
+
+// SetPlaintextHandler 设置明文协议连接的处理函数，每次警告或拒绝调用一次，nil 表示不通知
+func SetPlaintextHandler(handler PlaintextHandler) {
+	if handler == nil {
+		plaintextHandler.Store(nil)
+		return
+	}
+	plaintextHandler.Store(&handler)
+}
+
+// validatePlaintextPolicy 校验 PlaintextPolicy 的取值
+func validatePlaintextPolicy(policy PlaintextPolicy) error {
+	switch policy {
+	case "", PlaintextAllow, PlaintextWarn, PlaintextBlock:
+		return nil
+	}
+	return fmt.Errorf("未知的明文协议处理方式: %s", policy)
+}
+
+// plaintextScreened 判断到 target 的代理连接是否需要按 PlaintextPolicy 检查：策略为 warn 或 block、
+// 主机 host 不在 PlaintextExempt 中，且为 HTTP 代理请求或目标端口在 plaintextPorts 中
+func plaintextScreened(cfg Config, target, host string, mode int) bool {
+	if cfg.PlaintextPolicy != PlaintextWarn && cfg.PlaintextPolicy != PlaintextBlock {
+		return false
+	}
+	if mode == modeSOCKS5Bind || matchHostPatterns(cfg.PlaintextExempt, host) {
+		return false
+	}
+	return mode == modeHTTPProxy || plaintextPortProtocol(target) != ""
+}
+
+// plaintextPortProtocol 返回 target 的端口对应的明文协议，不在 plaintextPorts 中时返回空
+func plaintextPortProtocol(target string) string {
+	_, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return ""
+	}
+	port, _ := strconv.Atoi(p)
+	return plaintextPorts[port]
+}
+
+// isTLSClientHello 判断 data 是否以 TLS 握手记录（类型 0x16，版本 3.x）开头
+func isTLSClientHello(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x16 && data[1] == 0x03
+}
+
+// plaintextProtocol 按首个数据包 first 识别到 target 的连接使用的明文协议，不是明文时返回空。
+// HTTP 代理请求总是明文 HTTP；其他连接的首个数据包为 TLS ClientHello 时不是明文，
+// 否则（包括客户端等待服务端先发送、没有首个数据包）按 plaintextPorts 中的端口识别
+func plaintextProtocol(target string, mode int, first []byte) string {
+	if mode == modeHTTPProxy {
+		return "HTTP"
+	}
+	if isTLSClientHello(first) {
+		return ""
+	}
+	return plaintextPortProtocol(target)
+}
+
+// checkPlaintext 按 PlaintextPolicy 处理到 target 的代理连接，first 为已读到的首个数据包。
+// 识别为明文时记录日志并通知 PlaintextHandler，策略为 block 时返回包装 ErrPlaintextBlocked 的错误
+func (s *ProxyServer) checkPlaintext(ctx context.Context, target string, mode int, first []byte) error {
+	protocol := plaintextProtocol(target, mode, first)
+	if protocol == "" {
+		return nil
+	}
+	blocked := s.GetConfig().PlaintextPolicy == PlaintextBlock
+	if blocked {
+		logConnError(ctx, "[明文] 已拒绝经代理发送的明文 %s 连接: %s", protocol, target)
+	} else {
+		logConnInfo(ctx, "[明文] %s 连接以明文 %s 经代理发送，服务端出口可以看到其内容", target, protocol)
+	}
+	if h := plaintextHandler.Load(); h != nil {
+		(*h)(PlaintextEvent{ConnID: connIDFrom(ctx), Target: target, Protocol: protocol, Blocked: blocked})
+	}
+	if blocked {
+		return fmt.Errorf("%w: %s (%s)", ErrPlaintextBlocked, target, protocol)
+	}
+	return nil
+}
+
+// sendBlockedResponse 通知本地客户端连接被规则拒绝：SOCKS5 回复 0x02，HTTP 返回 403
+func sendBlockedResponse(conn net.Conn, mode int) {
+	switch mode {
+	case modeSOCKS5:
+		conn.Write([]byte{0x05, 0x02, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	case modeHTTPConnect, modeHTTPProxy:
+		conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+	}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// errProcessLookupUnsupported 当前平台无法识别连接所属的进程
+var errProcessLookupUnsupported = errors.New("当前平台不支持识别连接所属的应用")
+
+// errNotLocalClient 客户端不在本机，无法识别所属进程
+var errNotLocalClient = errors.New("客户端不在本机")
+
+// processInfo 发起连接的本机进程
+type processInfo struct {
+	PID  int
+	Name string // 可执行文件名
+	Path string // 可执行文件完整路径，无权限读取时为空
+}
+
+// AppRule 按应用分流规则
+type AppRule struct {
+	// Pattern 应用匹配模式，支持 * 和 ? 通配符:
+	//   不含 / 时匹配可执行文件名（不区分大小写），如 firefox、*chrome*
+	//   含 / 时匹配可执行文件完整路径，如 /usr/bin/curl、/opt/*/bin/*
+	//   以 / 结尾时匹配该目录（含子目录）下的所有程序，如 /Applications/Steam.app/
+	Pattern string
+	Direct  bool // true 为直连，false 为通过代理
+}
+
+// ParseAppRules 解析逗号分隔的按应用分流规则，每条规则为 动作:模式，动作为 proxy 或 direct，
+// 如 "proxy:firefox,direct:steam,direct:/opt/games/"。按顺序匹配，第一条匹配的规则生效
+func ParseAppRules(s string) ([]AppRule, error) {
+	var rules []AppRule
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		action, pattern, ok := strings.Cut(item, ":")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("无效的应用规则 %q，格式为 proxy:应用 或 direct:应用", item)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("无效的应用规则 %q: %v", item, err)
+		}
+		switch strings.ToLower(strings.TrimSpace(action)) {
+		case "proxy":
+			rules = append(rules, AppRule{Pattern: pattern})
+		case "direct":
+			rules = append(rules, AppRule{Pattern: pattern, Direct: true})
+		default:
+			return nil, fmt.Errorf("无效的应用规则 %q，动作须为 proxy 或 direct", item)
+		}
+	}
+	return rules, nil
+}
+
+// match 判断进程是否匹配规则
+func (r AppRule) match(p processInfo) bool {
+	if strings.HasSuffix(r.Pattern, "/") {
+		return p.Path != "" && strings.HasPrefix(p.Path, r.Pattern)
+	}
+	if strings.Contains(r.Pattern, "/") {
+		ok, _ := filepath.Match(r.Pattern, p.Path)
+		return ok
+	}
+	ok, _ := filepath.Match(strings.ToLower(r.Pattern), strings.ToLower(p.Name))
+	return ok
+}
+
+// connProcess 查找客户端连接所属的本机进程，只能识别来自回环地址的连接
+func connProcess(conn net.Conn) (processInfo, error) {
+	local, ok1 := conn.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 || !remote.IP.IsLoopback() {
+		return processInfo{}, errNotLocalClient
+	}
+	// 应用一端的本地地址是我们看到的远端地址
+	return lookupProcess(remote, local)
+}
+
+// appRouteDecision 按发起连接的应用分流，未配置规则、无法识别应用或没有匹配的规则时 ok 为 false
+func (s *ProxyServer) appRouteDecision(conn net.Conn, rules []AppRule) (direct bool, reason string, ok bool) {
+	if len(rules) == 0 || !processLookupSupported || conn == nil {
+		return false, "", false
+	}
+	proc, err := connProcess(conn)
+	if err != nil {
+		if !errors.Is(err, errNotLocalClient) {
+			LogInfo("[分流] %s 无法识别来源应用: %v", conn.RemoteAddr(), err)
+		}
+		return false, "", false
+	}
+	for _, r := range rules {
+		if r.match(proc) {
+			return r.Direct, fmt.Sprintf("应用 %s", proc.Name), true
+		}
+	}
+	return false, "", false
+}
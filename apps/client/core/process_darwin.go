@@ -0,0 +1,59 @@
+//go:build darwin
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// processLookupSupported macOS 通过 lsof 识别连接所属的进程
+const processLookupSupported = true
+
+// lookupProcess 查找本地地址为 local、远端地址为 remote 的 TCP 连接所属的进程。
+// 每次调用都会执行 lsof，会给新连接增加几十毫秒延迟；
+// 非 root 运行时只能识别当前用户的进程
+func lookupProcess(local, remote *net.TCPAddr) (processInfo, error) {
+	out, err := exec.Command("lsof", "+c", "0", "-nP",
+		"-iTCP@"+local.String(), "-sTCP:ESTABLISHED", "-Fpcn").Output()
+	if err != nil && len(out) == 0 {
+		return processInfo{}, fmt.Errorf("lsof: %w", err)
+	}
+
+	// -F 输出每行一个字段: p<pid>、c<命令名>、n<本地地址>-><远端地址>
+	want := local.String() + "->" + remote.String()
+	var p processInfo
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			p = processInfo{}
+			p.PID, _ = strconv.Atoi(line[1:])
+		case 'c':
+			p.Name = line[1:]
+		case 'n':
+			if line[1:] != want {
+				continue
+			}
+			// ps 的 comm 在 macOS 上为可执行文件完整路径
+			if path, err := exec.Command("ps", "-o", "comm=", "-p", strconv.Itoa(p.PID)).Output(); err == nil {
+				p.Path = strings.TrimSpace(string(path))
+				if p.Path != "" {
+					p.Name = filepath.Base(p.Path)
+				}
+			}
+			return p, nil
+		}
+	}
+	return processInfo{}, fmt.Errorf("未找到连接 %s -> %s", local, remote)
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package core
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// processLookupSupported Linux 通过 /proc 识别连接所属的进程
+const processLookupSupported = true
+
+// lookupProcess 查找本地地址为 local、远端地址为 remote 的 TCP 连接所属的进程。
+// 先在 /proc/net/tcp{,6} 中找到套接字 inode，再遍历 /proc/<pid>/fd 找到持有者；
+// 没有权限读取其他用户进程的 fd 时无法识别（需要与应用相同的用户运行或 root）
+func lookupProcess(local, remote *net.TCPAddr) (processInfo, error) {
+	inode, err := findSocketInode(local, remote)
+	if err != nil {
+		return processInfo{}, err
+	}
+	pid, err := findInodeOwner(inode)
+	if err != nil {
+		return processInfo{}, err
+	}
+
+	p := processInfo{PID: pid}
+	if path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		p.Path = strings.TrimSuffix(path, " (deleted)")
+		p.Name = filepath.Base(p.Path)
+	} else if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		// comm 最多 15 个字符，仅在无权限读取 exe 时使用
+		p.Name = strings.TrimSpace(string(comm))
+	}
+	return p, nil
+}
+
+// findSocketInode 在 /proc/net/tcp 和 /proc/net/tcp6 中查找连接的套接字 inode
+func findSocketInode(local, remote *net.TCPAddr) (string, error) {
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // 表头
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[9] == "0" {
+				continue
+			}
+			if matchProcNetAddr(fields[1], local) && matchProcNetAddr(fields[2], remote) {
+				f.Close()
+				return fields[9], nil
+			}
+		}
+		f.Close()
+	}
+	return "", fmt.Errorf("未找到连接 %s -> %s", local, remote)
+}
+
+// matchProcNetAddr 判断 /proc/net/tcp 中的 "IP:端口" 十六进制地址是否为 addr。
+// IP 按 32 位字存储，每个字为主机字节序（小端）
+func matchProcNetAddr(s string, addr *net.TCPAddr) bool {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return false
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil || int(port) != addr.Port {
+		return false
+	}
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || len(raw)%4 != 0 {
+		return false
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return net.IP(raw).Equal(addr.IP)
+}
+
+// findInodeOwner 遍历 /proc/<pid>/fd 查找持有套接字 inode 的进程
+func findInodeOwner(inode string) (int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	target := "socket:[" + inode + "]"
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return pid, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("未找到套接字 %s 所属的进程（可能没有权限）", inode)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package core
+
+import "net"
+
+// processLookupSupported 其他平台暂不支持按应用分流
+const processLookupSupported = false
+
+func lookupProcess(local, remote *net.TCPAddr) (processInfo, error) {
+	return processInfo{}, errProcessLookupUnsupported
+}
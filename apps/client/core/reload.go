@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+)
+
+// Reload 在不中断已建立隧道的情况下应用新配置，新配置只影响之后建立的连接：
+//   - ListenAddr 变化时先在新地址监听，成功后再关闭旧监听；DNSListenAddr 同样，旧地址上进行中的 DNS 查询被中断，缓存的应答被丢弃
+//   - ServerAddr、DNSServer、ECHDomain、RequireECH、ECHPublicName、UpstreamProxy 变化时重新获取 ECH 配置；服务端列表变化时清空各服务端的健康状态
+//   - RoutingMode 变化时重新加载分流数据并重新生成 PAC 脚本，ServePAC 变化时立即生效
+//   - ServerIP、FallbackServerHost 或 HTTPS 记录中的地址提示（ServerIP 为空时）变化时重新生成候选地址、重建 DoH 代理客户端并清空测速结果，
+//     与 ServerIPProbeInterval 变化时均立即重新测速；
+//     UpstreamProxy 变化时重建 DoH 代理客户端并重新测速，之后建立的隧道和直连（UpstreamProxyDirect）经新的代理连接
+//   - MaxConnections 变化时新上限只约束之后的连接
+//   - WatchNetwork 变化时下次轮询即生效
+//   - BalanceStrategy、AppRules、Compression、CompressPorts、Obfuscation、ResumeGrace、PingInterval、PongTimeout、PinnedSPKI、PinAnyChainCert、
+//     RootCAs、PlaintextPolicy、PlaintextExempt 变化时对之后建立的隧道生效
+//   - DialTimeout、TLSHandshakeTimeout、DoHTimeout 变化时对之后的连接和查询生效
+//   - DNSPinTTL、DNSPinExclude、DNSPinMaxEntries、Resolver 变化时对之后的直连生效，已记住的 IP 保留到过期
+//   - HostRateLimits、TotalRateLimit 变化时立即对所有连接生效，速率未变的规则保留令牌桶状态
+//   - StatsMaxSites 变化时立即生效，超出新上限的站点统计被淘汰；InternalsLogInterval、HealthCheckInterval 变化时下次检查即生效，
+//     HealthCheckFailures 变化时从下次检查起按新阈值判断
+//
+// 公钥固定值、保活参数、超时、混淆方式或明文协议处理方式无效、重新监听或获取 ECH 配置失败时保留原配置并返回错误。
+// StoreDir、RouteDecisionLogSize、RecentConnectionsSize 在 NewProxyServer 时确定，
+// Reload 和 Restart 均不会应用，修改后需重新创建 ProxyServer（Settings 中标记为 RestartRequired）。
+// 服务器未运行时仅保存配置，等同于 UpdateConfig；正在启动或停止时等待其完成
+func (s *ProxyServer) Reload(cfg Config) error {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	s.mu.Lock()
+	if s.state != lifecycleRunning {
+		s.config = cfg
+		s.mu.Unlock()
+		return nil
+	}
+	old := s.config
+	s.mu.Unlock()
+
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+	cfg = normalizeConfig(cfg)
+
+	var newListener net.Listener
+	if cfg.ListenAddr != old.ListenAddr {
+		ln, err := net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("监听失败: %w", err)
+		}
+		newListener = ln
+	}
+	dnsChanged := cfg.DNSListenAddr != old.DNSListenAddr
+	var newDNS *localDNS
+	if dnsChanged && cfg.DNSListenAddr != "" {
+		d, err := listenDNS(cfg.DNSListenAddr)
+		if err != nil {
+			if newListener != nil {
+				newListener.Close()
+			}
+			return fmt.Errorf("DNS 监听失败: %w", err)
+		}
+		newDNS = d
+	}
+
+	s.mu.Lock()
+	s.config = cfg
+	s.mu.Unlock()
+
+	hints := s.serverIPHints(old)
+	if echConfigChanged(old, cfg) {
+		if err := s.setupECH(); err != nil {
+			s.mu.Lock()
+			s.config = old
+			s.mu.Unlock()
+			if newListener != nil {
+				newListener.Close()
+			}
+			if newDNS != nil {
+				newDNS.close()
+			}
+			return err
+		}
+	}
+	if !slices.Equal(serverAddrs(cfg.ServerAddr), serverAddrs(old.ServerAddr)) {
+		s.resetUpstreamHealth()
+	}
+	serverIPChanged := cfg.ServerIP != old.ServerIP || cfg.FallbackServerHost != old.FallbackServerHost ||
+		!slices.Equal(hints, s.serverIPHints(cfg))
+	if serverIPChanged {
+		s.resetServerIPs(cfg)
+	}
+	if serverIPChanged || cfg.UpstreamProxy != old.UpstreamProxy {
+		s.resetDoHProxyClient()
+	}
+	if serverIPChanged || cfg.ServerIPProbeInterval != old.ServerIPProbeInterval || cfg.UpstreamProxy != old.UpstreamProxy {
+		s.serverIPs.requestProbe()
+	}
+	if cfg.MaxConnections != old.MaxConnections {
+		s.limiter.Store(newConnLimiter(cfg.MaxConnections))
+	}
+	if !maps.Equal(cfg.HostRateLimits, old.HostRateLimits) {
+		s.hostLimits.Store(newHostRateLimits(cfg.HostRateLimits, s.hostLimits.Load()))
+	}
+	if cfg.StatsMaxSites != old.StatsMaxSites {
+		s.trafficStats.setMaxSites(cfg.StatsMaxSites)
+	}
+	if cfg.TotalRateLimit != old.TotalRateLimit || cfg.TotalRateLimitExemptDirect != old.TotalRateLimitExemptDirect {
+		s.totalLimit.Store(newTotalRateLimit(cfg.TotalRateLimit, cfg.TotalRateLimitExemptDirect, s.totalLimit.Load()))
+	}
+	if cfg.RoutingMode != old.RoutingMode {
+		if err := s.loadRoutingData(); err != nil {
+			LogError("[警告] 加载分流数据失败: %v", err)
+		}
+	}
+
+	if newListener != nil {
+		s.mu.Lock()
+		oldListener := s.listener
+		s.listener = newListener
+		s.mu.Unlock()
+
+		s.goBackground("accept", func(ctx context.Context) error { return s.acceptLoop(ctx, newListener) })
+		oldListener.Close()
+		LogInfo("[代理] 监听地址已切换: %s -> %s", old.ListenAddr, cfg.ListenAddr)
+	}
+	if dnsChanged {
+		s.mu.Lock()
+		oldDNS := s.dns
+		s.dns = newDNS
+		s.mu.Unlock()
+		s.dnsCache.reset()
+
+		if newDNS != nil {
+			s.goBackground("dns", func(ctx context.Context) error { return s.serveDNS(ctx, newDNS) })
+		}
+		if oldDNS != nil {
+			oldDNS.close()
+		}
+		LogInfo("[DNS] 本地 DNS 监听地址已切换: %q -> %q", old.DNSListenAddr, cfg.DNSListenAddr)
+	}
+
+	LogInfo("[代理] 配置已重新加载，现有连接不受影响")
+	return nil
+}
+
+// echConfigChanged 判断 ECH 相关配置是否变化
+func echConfigChanged(old, cfg Config) bool {
+	return old.ServerAddr != cfg.ServerAddr ||
+		old.DNSServer != cfg.DNSServer ||
+		old.ECHDomain != cfg.ECHDomain ||
+		old.RequireECH != cfg.RequireECH ||
+		old.ECHPublicName != cfg.ECHPublicName ||
+		old.UpstreamProxy != cfg.UpstreamProxy
+}
+
+// resetDoHProxyClient 丢弃缓存的 DoH 代理客户端，下次查询时按新配置重建
+func (s *ProxyServer) resetDoHProxyClient() {
+	s.dohProxyClientMu.Lock()
+	defer s.dohProxyClientMu.Unlock()
+	s.dohProxyClient = nil
+	s.dohProxyClientPort = ""
+}
@@ -0,0 +1,375 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const defaultResumeBufferSize = 256 * 1024
+
+// errResumeRejected 服务端拒绝恢复或已无法恢复，不再重试
+var errResumeRejected = errors.New("无法恢复隧道")
+
+// errInvalidFrame readFrame 解码失败
+var errInvalidFrame = errors.New("收到无效帧")
+
+// replayBuffer 环形缓冲区，保留最近发送的数据，恢复隧道后重发对方未收到的部分
+type replayBuffer struct {
+	data  []byte
+	start int   // 最早一个字节在 data 中的位置
+	n     int   // 缓冲的字节数
+	total int64 // 累计写入的字节数
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{data: make([]byte, max(size, 1))}
+}
+
+// write 追加数据，超出容量时丢弃最早的数据
+func (b *replayBuffer) write(p []byte) {
+	b.total += int64(len(p))
+	size := len(b.data)
+	if len(p) >= size {
+		copy(b.data, p[len(p)-size:])
+		b.start, b.n = 0, size
+		return
+	}
+	end := (b.start + b.n) % size
+	c := copy(b.data[end:], p)
+	copy(b.data, p[c:])
+	b.n += len(p)
+	if b.n > size {
+		b.start = (b.start + b.n - size) % size
+		b.n = size
+	}
+}
+
+// since 返回从累计偏移 offset 起的数据，缓冲区已不包含该位置时返回 false
+func (b *replayBuffer) since(offset int64) ([]byte, bool) {
+	oldest := b.total - int64(b.n)
+	if offset < oldest || offset > b.total {
+		return nil, false
+	}
+	skip := int(offset - oldest)
+	out := make([]byte, b.n-skip)
+	from := (b.start + skip) % len(b.data)
+	c := copy(out, b.data[from:])
+	copy(out[c:], b.data)
+	return out, true
+}
+
+// encodeOffset、decodeOffset RESUME/RESUMED 帧中的字节数
+func encodeOffset(n int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(n))
+}
+
+func decodeOffset(p []byte) (int64, error) {
+	if len(p) != 8 {
+		return 0, fmt.Errorf("无效的偏移长度 %d", len(p))
+	}
+	return int64(binary.BigEndian.Uint64(p)), nil
+}
+
+// 隧道保活参数
+const (
+	defaultPingInterval = 10 * time.Second
+	defaultPongTimeout  = 30 * time.Second // 读超时，收到 pong 或数据时重置
+	pingWriteTimeout    = 5 * time.Second
+)
+
+// keepaliveTimeouts 返回生效的 ping 间隔和 pong 超时，为 0 的字段使用默认值。
+// ping 间隔不小于 pong 超时时连接正常的隧道也会超时，返回错误
+func keepaliveTimeouts(cfg Config) (ping, pong time.Duration, err error) {
+	ping, pong = cfg.PingInterval, cfg.PongTimeout
+	if ping <= 0 {
+		ping = defaultPingInterval
+	}
+	if pong <= 0 {
+		pong = defaultPongTimeout
+	}
+	if ping >= pong {
+		return ping, pong, fmt.Errorf("ping 间隔 %v 必须小于 pong 超时 %v", ping, pong)
+	}
+	return ping, pong, nil
+}
+
+// tunnelLink 隧道的 WebSocket 连接。启用恢复后，连接异常断开时由下载 goroutine
+// 在 readFrame 中重新连接并恢复会话，上传 goroutine 写入失败时等待恢复结果
+type tunnelLink struct {
+	s        *ProxyServer
+	server   string // 建立隧道的服务端，恢复时只连接该服务端
+	target   string
+	codec    protocol.Codec
+	token    string // 恢复令牌，空表示不可恢复
+	received int64  // 已收到的下载数据字节数，仅下载 goroutine 访问
+
+	readBuf bytes.Buffer // readFrame 复用的读缓冲区，仅下载 goroutine 访问
+
+	pad int // 还需填充的上传帧数，见 ObfuscationPad，受 mu 保护
+
+	pingInterval time.Duration
+	pongTimeout  time.Duration // 超过该时间未收到 pong 或数据时读取失败
+
+	mu     sync.Mutex // 保护 ws 写入及以下字段
+	ws     *websocket.Conn
+	sent   *replayBuffer // 已发送的上传数据，仅启用恢复时记录
+	ready  chan struct{} // 当前连接断开后，恢复结束（成功或失败）时关闭
+	failed error         // 恢复失败的原因
+	closed bool
+}
+
+func newTunnelLink(s *ProxyServer, ws *websocket.Conn, server, target string) *tunnelLink {
+	// 参数已在 Start 和 Reload 时校验
+	ping, pong, _ := keepaliveTimeouts(s.GetConfig())
+	l := &tunnelLink{
+		s:            s,
+		server:       server,
+		target:       target,
+		codec:        protocol.CodecForSubprotocol(ws.Subprotocol()),
+		ws:           ws,
+		ready:        make(chan struct{}),
+		pingInterval: ping,
+		pongTimeout:  pong,
+	}
+	if _, padded := protocol.SplitSubprotocol(ws.Subprotocol()); padded {
+		l.pad = paddedFrames
+	}
+	return l
+}
+
+// watchLiveness 设置 ws 的读超时，收到 pong 时延长，与服务端的保活方式相同
+func (l *tunnelLink) watchLiveness(ws *websocket.Conn) {
+	ws.SetReadDeadline(time.Now().Add(l.pongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(l.pongTimeout))
+	})
+}
+
+// enableResume 收到带恢复令牌的 CONNECTED 后启用恢复，须在开始转发数据前调用
+func (l *tunnelLink) enableResume(token string, bufferSize int) {
+	if bufferSize <= 0 {
+		bufferSize = defaultResumeBufferSize
+	}
+	l.token = token
+	l.sent = newReplayBuffer(bufferSize)
+}
+
+// writeLocked 向当前连接写帧，调用方持有 mu
+func (l *tunnelLink) writeLocked(f protocol.Frame) error {
+	if l.pad > 0 {
+		l.pad--
+		return writePadded(l.ws, l.codec, f)
+	}
+	return protocol.WriteMessage(l.ws, l.codec, f)
+}
+
+// writeFrame 写控制帧，不等待恢复
+func (l *tunnelLink) writeFrame(f protocol.Frame) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.writeLocked(f)
+}
+
+// send 写上传方向的帧。启用恢复时 DATA 先记入重发缓冲区，写入失败后关闭当前连接，
+// 等待下载 goroutine 恢复：恢复成功后 DATA 已随重发送达，其他帧在新连接上重写一次
+func (l *tunnelLink) send(f protocol.Frame, done <-chan struct{}) error {
+	l.mu.Lock()
+	if l.sent != nil && f.Op == protocol.OpData {
+		l.sent.write(f.Payload)
+	}
+	err := l.writeLocked(f)
+	ws, ready := l.ws, l.ready
+	l.mu.Unlock()
+	if err == nil || l.token == "" {
+		return err
+	}
+
+	ws.Close()
+	select {
+	case <-ready:
+	case <-done:
+		return net.ErrClosed
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed != nil || f.Op == protocol.OpData {
+		return l.failed
+	}
+	return l.writeLocked(f)
+}
+
+// ping 发送 WebSocket ping，连接失效时最多阻塞 pingWriteTimeout
+func (l *tunnelLink) ping() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout))
+}
+
+// readFrame 读取下一帧，连接异常断开时尝试恢复，仅由下载 goroutine 调用。
+// 返回帧的 payload 复用读缓冲区，只在下次调用前有效
+func (l *tunnelLink) readFrame(done <-chan struct{}) (protocol.Frame, error) {
+	for {
+		mt, msg, err := protocol.ReadMessage(l.ws, &l.readBuf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = fmt.Errorf("%v 内未收到服务端响应: %w", l.pongTimeout, err)
+			}
+			if err := l.recover(err, done); err != nil {
+				return protocol.Frame{}, err
+			}
+			continue
+		}
+		l.ws.SetReadDeadline(time.Now().Add(l.pongTimeout))
+		f, err := l.codec.Decode(mt, msg)
+		if err != nil {
+			return protocol.Frame{}, fmt.Errorf("%w: %v", errInvalidFrame, err)
+		}
+		if f.Op == protocol.OpData {
+			l.received += int64(len(f.Payload))
+		}
+		return f, nil
+	}
+}
+
+// failLocked 记录恢复失败并唤醒等待的上传 goroutine，调用方持有 mu
+func (l *tunnelLink) failLocked(err error) {
+	if l.failed == nil {
+		l.failed = err
+		close(l.ready)
+	}
+}
+
+// recover 在 ResumeGrace 内重试恢复隧道，不可恢复或失败时返回错误
+func (l *tunnelLink) recover(cause error, done <-chan struct{}) error {
+	l.mu.Lock()
+	if l.token == "" || l.closed || l.failed != nil ||
+		websocket.IsCloseError(cause, websocket.CloseNormalClosure) {
+		l.failLocked(cause)
+		l.mu.Unlock()
+		return cause
+	}
+	old := l.ws
+	l.mu.Unlock()
+	old.Close()
+
+	grace := l.s.GetConfig().ResumeGrace
+	LogInfo("[代理] %s 隧道连接中断 (%v)，尝试在 %v 内恢复", l.target, cause, grace)
+	deadline := time.Now().Add(grace)
+	err := cause
+retry:
+	for attempt := 1; time.Now().Before(deadline); attempt++ {
+		if err = l.resume(deadline); err == nil {
+			LogInfo("[代理] %s 隧道已恢复 (第 %d 次尝试)", l.target, attempt)
+			return nil
+		}
+		if errors.Is(err, errResumeRejected) {
+			break
+		}
+		select {
+		case <-done:
+			err = net.ErrClosed
+			break retry
+		case <-time.After(min(time.Duration(attempt)*500*time.Millisecond, 2*time.Second)):
+		}
+	}
+
+	LogError("[代理] %s 隧道恢复失败: %v", l.target, err)
+	l.mu.Lock()
+	l.failLocked(err)
+	l.mu.Unlock()
+	return err
+}
+
+// resume 重新连接服务端并恢复会话，成功后重发服务端未收到的上传数据并切换到新连接
+func (l *tunnelLink) resume(deadline time.Time) error {
+	// 会话保存在原服务端，不故障转移
+	ws, _, _, err := l.s.dialServers(context.Background(), []string{l.server}, l.target, false)
+	if err != nil {
+		return err
+	}
+	switched := false
+	defer func() {
+		if !switched {
+			ws.Close()
+		}
+	}()
+	if base, _ := protocol.SplitSubprotocol(ws.Subprotocol()); base != protocol.ResumeSubprotocol {
+		return fmt.Errorf("%w: 服务端已不支持恢复", errResumeRejected)
+	}
+
+	write := func(f protocol.Frame) error {
+		mt, data, err := l.codec.Encode(f)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(mt, data)
+	}
+	if err := write(protocol.Frame{Op: protocol.OpResume, Target: l.token, Payload: encodeOffset(l.received)}); err != nil {
+		return err
+	}
+	ws.SetReadDeadline(deadline)
+	mt, msg, err := ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+	l.watchLiveness(ws)
+	f, err := l.codec.Decode(mt, msg)
+	if err != nil {
+		return fmt.Errorf("无效响应: %w", err)
+	}
+	switch f.Op {
+	case protocol.OpResumed:
+	case protocol.OpError:
+		return fmt.Errorf("%w: %s", errResumeRejected, f.Payload)
+	default:
+		return fmt.Errorf("意外响应: opcode 0x%02x", f.Op)
+	}
+	serverReceived, err := decodeOffset(f.Payload)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	replay, ok := l.sent.since(serverReceived)
+	if !ok {
+		return fmt.Errorf("%w: 重发缓冲区已不包含服务端缺失的数据", errResumeRejected)
+	}
+	for sent := 0; sent < len(replay); {
+		chunk := replay[sent:min(sent+readBufferSize, len(replay))]
+		if err := write(protocol.Frame{Op: protocol.OpData, Payload: chunk}); err != nil {
+			return err
+		}
+		sent += len(chunk)
+	}
+	l.ws = ws
+	switched = true
+	close(l.ready)
+	l.ready = make(chan struct{})
+	return nil
+}
+
+// Close 结束隧道，以 WebSocket 正常关闭通知服务端释放会话
+func (l *tunnelLink) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return l.ws.Close()
+}
@@ -0,0 +1,71 @@
+package core
+
+import "sync"
+
+// ringBuffer 固定容量的环形缓冲区，写满后覆盖最旧的记录。
+// 存储空间在创建时一次性分配，Add 为 O(1) 且不再分配内存
+type ringBuffer[T any] struct {
+	mu    sync.Mutex
+	items []T
+	next  int
+	full  bool
+}
+
+// newRingBuffer 创建容量为 capacity 的环形缓冲区，capacity 小于 1 时按 1 处理
+func newRingBuffer[T any](capacity int) *ringBuffer[T] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &ringBuffer[T]{items: make([]T, capacity)}
+}
+
+// Add 追加一条记录
+func (r *ringBuffer[T]) Add(v T) {
+	r.mu.Lock()
+	r.items[r.next] = v
+	r.next++
+	if r.next == len(r.items) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// Snapshot 按从旧到新的顺序返回当前所有记录的副本
+func (r *ringBuffer[T]) Snapshot() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]T(nil), r.items[:r.next]...)
+	}
+	result := make([]T, 0, len(r.items))
+	result = append(result, r.items[r.next:]...)
+	return append(result, r.items[:r.next]...)
+}
+
+// Len 返回当前记录数
+func (r *ringBuffer[T]) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		return len(r.items)
+	}
+	return r.next
+}
+
+// Cap 返回容量
+func (r *ringBuffer[T]) Cap() int {
+	return len(r.items)
+}
+
+// Reset 清空所有记录
+func (r *ringBuffer[T]) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var zero T
+	for i := range r.items {
+		r.items[i] = zero
+	}
+	r.next = 0
+	r.full = false
+}
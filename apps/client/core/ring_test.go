@@ -0,0 +1,122 @@
+package core
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRingBuffer 按从旧到新的顺序返回记录，写满后覆盖最旧的记录，Reset 后重新开始
+func TestRingBuffer(t *testing.T) {
+	r := newRingBuffer[int](3)
+	if got := r.Snapshot(); len(got) != 0 || r.Len() != 0 || r.Cap() != 3 {
+		t.Fatalf("empty: Snapshot = %v, Len = %d, Cap = %d", got, r.Len(), r.Cap())
+	}
+	for i, want := range [][]int{{1}, {1, 2}, {1, 2, 3}, {2, 3, 4}, {3, 4, 5}, {4, 5, 6}, {5, 6, 7}} {
+		r.Add(i + 1)
+		if got := r.Snapshot(); !slices.Equal(got, want) || r.Len() != len(want) {
+			t.Fatalf("after Add(%d): Snapshot = %v, Len = %d, want %v", i+1, got, r.Len(), want)
+		}
+	}
+	r.Reset()
+	if got := r.Snapshot(); len(got) != 0 || r.Len() != 0 {
+		t.Fatalf("after Reset: Snapshot = %v, Len = %d", got, r.Len())
+	}
+	r.Add(8)
+	if got := r.Snapshot(); !slices.Equal(got, []int{8}) {
+		t.Fatalf("Add after Reset: Snapshot = %v, want [8]", got)
+	}
+
+	// Snapshot 返回副本，之后的 Add 不影响已返回的结果
+	snap := r.Snapshot()
+	r.Add(9)
+	if !slices.Equal(snap, []int{8}) {
+		t.Fatalf("snapshot changed to %v after Add", snap)
+	}
+
+	if r := newRingBuffer[int](0); r.Cap() != 1 {
+		t.Fatalf("capacity 0: Cap = %d, want 1", r.Cap())
+	}
+}
+
+// TestRingBufferConcurrent 并发 Add 和 Snapshot（配合 -race）：每个快照不超过容量，
+// 同一写入者的记录在快照中保持写入顺序
+func TestRingBufferConcurrent(t *testing.T) {
+	const writers, adds, capacity = 4, 2000, 64
+	type record struct{ writer, seq int }
+	r := newRingBuffer[record](capacity)
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range adds {
+				r.Add(record{w, i})
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	check := func(snap []record) {
+		t.Helper()
+		if len(snap) > capacity {
+			t.Fatalf("snapshot has %d records, capacity %d", len(snap), capacity)
+		}
+		last := make([]int, writers)
+		for i := range last {
+			last[i] = -1
+		}
+		for _, rec := range snap {
+			if rec.seq <= last[rec.writer] {
+				t.Fatalf("writer %d: seq %d after %d in %v", rec.writer, rec.seq, last[rec.writer], snap)
+			}
+			last[rec.writer] = rec.seq
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		check(r.Snapshot())
+		r.Len()
+	}
+	snap := r.Snapshot()
+	check(snap)
+	if len(snap) != capacity || r.Len() != capacity {
+		t.Fatalf("after %d adds: %d records, Len = %d, want %d", writers*adds, len(snap), r.Len(), capacity)
+	}
+}
+
+// TestRingBufferAddAllocs 预热写满一轮后 Add 不再分配内存
+func TestRingBufferAddAllocs(t *testing.T) {
+	r := newRingBuffer[ConnectionRecord](16)
+	rec := ConnectionRecord{ClientAddr: "127.0.0.1:50000", Target: "example.com:443", StartedAt: time.Now()}
+	for range r.Cap() {
+		r.Add(rec)
+	}
+	if allocs := testing.AllocsPerRun(1000, func() { r.Add(rec) }); allocs != 0 {
+		t.Fatalf("Add allocates %v times per call, want 0", allocs)
+	}
+}
+
+// BenchmarkRingBufferAdd 写满后 Add 的耗时，分配次数应为 0
+func BenchmarkRingBufferAdd(b *testing.B) {
+	r := newRingBuffer[ConnectionRecord](defaultRecentConnectionsSize)
+	rec := ConnectionRecord{ClientAddr: "127.0.0.1:50000", Target: "example.com:443", StartedAt: time.Now()}
+	for range r.Cap() {
+		r.Add(rec)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		r.Add(rec)
+	}
+}
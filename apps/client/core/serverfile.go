@@ -0,0 +1,151 @@
+package core
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultIPListBaseURL IPListBaseURL 为空时下载中国 IP 列表的地址
+	defaultIPListBaseURL = "https://raw.githubusercontent.com/mayaxcn/china-ip-list/refs/heads/master/"
+	// serverFileMaxSize 从服务端下载的单个文件的大小上限
+	serverFileMaxSize = 64 << 20
+	// serverFileAttempts 从服务端下载时的最多请求次数，中断后按 Range 续传
+	serverFileAttempts = 3
+)
+
+// downloadRoutingFile 下载分流数据文件 name 保存到 StoreDir：先从 IPListBaseURL 下载，
+// 失败时经 ECH 从当前服务端的 /files/<name> 下载（需服务端 -files 列出该文件），两处都失败时返回两个错误
+func (s *ProxyServer) downloadRoutingFile(name string) error {
+	cfg := s.GetConfig()
+	filePath := filepath.Join(cfg.StoreDir, name)
+	base := cmp.Or(cfg.IPListBaseURL, defaultIPListBaseURL)
+	fileURL := strings.TrimSuffix(base, "/") + "/" + name
+	client, release := s.controlClient(defaultHTTPClient, fileURL)
+	defer release()
+	err := downloadIPList(client, fileURL, filePath)
+	if err == nil || cfg.Token == "" {
+		return err
+	}
+	LogError("[下载] %v，改为从服务端下载", err)
+	if serverErr := s.downloadServerFile(name, filePath); serverErr != nil {
+		return errors.Join(err, fmt.Errorf("从服务端下载失败: %w", serverErr))
+	}
+	return nil
+}
+
+// downloadServerFile 经与隧道相同的 ECH 连接从当前服务端的 /files/<name> 下载文件保存到 filePath，
+// 传输中断时按 ETag 续传，文件在此期间变化时服务端返回完整内容并从头写入
+func (s *ProxyServer) downloadServerFile(name, filePath string) error {
+	server := s.currentServer()
+	host, port, _, err := parseServerAddr(server)
+	if err != nil {
+		return err
+	}
+	cfg := s.GetConfig()
+	tlsCfg, err := s.buildUpstreamTLSConfig(cfg, host, port)
+	if err != nil {
+		return err
+	}
+	scheme := "https"
+	if !serverUsesTLS(cfg) {
+		scheme = "http"
+	}
+	transport := &http.Transport{TLSClientConfig: tlsCfg, TLSHandshakeTimeout: s.tlsHandshakeTimeout(), DialContext: s.serverDialContext}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: defaultHTTPTimeout}
+	fileURL := fmt.Sprintf("%s://%s/files/%s", scheme, net.JoinHostPort(host, port), url.PathEscape(name))
+	LogInfo("[下载] 正在从服务端下载: %s", fileURL)
+
+	tmpPath := filePath + ".part"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("保存文件失败: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	var offset int64
+	var etag string
+	for attempt := 1; ; attempt++ {
+		retry, err := s.getServerFileRange(client, fileURL, f, &offset, &etag)
+		if err == nil {
+			break
+		}
+		if !retry || attempt == serverFileAttempts {
+			return err
+		}
+		LogInfo("[下载] %s 在 %d 字节处中断，续传: %v", name, offset, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("保存文件失败: %w", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("保存文件失败: %w", err)
+	}
+	LogInfo("[下载] 已从服务端保存到: %s (%d 字节)", filePath, offset)
+	return nil
+}
+
+// getServerFileRange 从 offset 起请求 fileURL 写入 f 并推进 offset，offset 大于 0 时带 If-Range 续传。
+// retry 表示可以再次调用继续下载，服务端拒绝请求或文件超过上限时为 false
+func (s *ProxyServer) getServerFileRange(client *http.Client, fileURL string, f *os.File, offset *int64, etag *string) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return false, err
+	}
+	// 每次请求取当前令牌，续传期间 UpdateToken 更换的令牌随即生效
+	req.Header.Set("Authorization", "Bearer "+s.GetConfig().Token)
+	if *offset > 0 && *etag != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", *offset))
+		req.Header.Set("If-Range", *etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// 首次请求，或文件已变化、服务端不支持续传，从头写入
+		if err := truncateFile(f); err != nil {
+			return false, err
+		}
+		*offset, *etag = 0, resp.Header.Get("ETag")
+	case http.StatusPartialContent:
+		if want := fmt.Sprintf("bytes %d-", *offset); !strings.HasPrefix(resp.Header.Get("Content-Range"), want) {
+			return false, fmt.Errorf("续传范围不符: %s", resp.Header.Get("Content-Range"))
+		}
+	default:
+		return false, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if resp.ContentLength > serverFileMaxSize-*offset {
+		return false, fmt.Errorf("文件超过 %s 上限", FormatBytes(serverFileMaxSize))
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, serverFileMaxSize-*offset+1))
+	*offset += n
+	switch {
+	case *offset > serverFileMaxSize:
+		return false, fmt.Errorf("文件超过 %s 上限", FormatBytes(serverFileMaxSize))
+	case err != nil:
+		return true, fmt.Errorf("读取下载内容失败: %w", err)
+	}
+	return false, nil
+}
+
+// truncateFile 清空 f 并回到开头
+func truncateFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,386 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerIP 可以是逗号分隔的多个 IP、域名或 CIDR（如 104.16.0.0/24），连接服务端（WebSocket、HTTP/2 和 DoH 代理）
+// 时使用其中最快的一个。存在多个候选地址时后台测速：测量到首个服务端的 TCP 连接加 TLS 握手（含 ECH）耗时，
+// 启动时、每隔 ServerIPProbeInterval 以及当前地址连续 serverIPMaxFailures 次连接失败后重新测速；
+// CIDR 每轮测速随机抽取 serverIPScanSize 个地址，并保留当前选中的地址。只有一个候选地址时不测速
+
+// ServerIP 测速参数
+const (
+	defaultServerIPProbeInterval = 10 * time.Minute
+	serverIPProbeTimeout         = 5 * time.Second
+	serverIPProbeConcurrency     = 8
+	serverIPScanSize             = 16 // 每个 CIDR 每轮测速抽取的地址数
+	serverIPMaxFailures          = 3  // 连续失败达到该次数后不再选择该地址，并立即重新测速
+)
+
+// ServerIPStats 一个 ServerIP 候选地址的测速结果
+type ServerIPStats struct {
+	IP        string        `json:"ip"`
+	Latency   time.Duration `json:"latency"`   // 最近一次测得的 TCP 连接加 TLS 握手耗时（纳秒），0 表示尚未测速或测速失败
+	ProbedAt  time.Time     `json:"probedAt"`  // 最近一次测速的时间
+	LastError string        `json:"lastError"` // 最近一次测速或连接失败的原因，成功后清空
+	Failures  int           `json:"failures"`  // 连续失败次数（测速和实际连接），成功后清零
+	Selected  bool          `json:"selected"`  // 当前连接服务端使用的地址
+}
+
+// serverIPEntry ServerIP 中的一项，cidr 不为 nil 时为待抽样的网段
+type serverIPEntry struct {
+	host string
+	cidr *net.IPNet
+}
+
+// parseServerIPs 拆分 ServerIP 中逗号分隔的候选项，忽略空项
+func parseServerIPs(spec string) ([]serverIPEntry, error) {
+	var entries []serverIPEntry
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+		case strings.Contains(item, "/"):
+			_, cidr, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("无效的 ServerIP 网段 %s: %w", item, err)
+			}
+			entries = append(entries, serverIPEntry{cidr: cidr})
+		default:
+			entries = append(entries, serverIPEntry{host: strings.Trim(item, "[]")})
+		}
+	}
+	return entries, nil
+}
+
+// serverIPSpec 返回生成 ServerIP 候选地址的配置：ServerIP 为空时优先使用 hints（HTTPS 记录中的地址提示，见 serverIPHints），
+// 没有时解析 FallbackServerHost（默认 www.visa.com），使用解析出的全部 IP，解析失败时使用域名本身，由每次连接时解析
+func serverIPSpec(cfg Config, hints []string) string {
+	if cfg.ServerIP != "" {
+		return cfg.ServerIP
+	}
+	if len(hints) > 0 {
+		LogInfo("[代理] 未指定 ServerIP，使用 HTTPS 记录中的地址提示: %s", strings.Join(hints, ", "))
+		return strings.Join(hints, ",")
+	}
+	host := cmp.Or(cfg.FallbackServerHost, defaultFallbackServerHost)
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	resolver := cmp.Or(cfg.Resolver, net.DefaultResolver)
+	ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(cfg.DialTimeout, defaultDialTimeout))
+	defer cancel()
+	ips, err := resolver.LookupHost(ctx, host)
+	if err != nil || len(ips) == 0 {
+		LogError("[代理] 解析 %s 失败: %v，改为每次连接时解析", host, err)
+		return host
+	}
+	LogInfo("[代理] 未指定 ServerIP，使用 %s 的地址: %s", host, strings.Join(ips, ", "))
+	return strings.Join(ips, ",")
+}
+
+// resetServerIPs 按 cfg 和已加载的 HTTPS 地址提示重新生成 ServerIP 候选地址，需在获取 ECH 配置之后调用
+func (s *ProxyServer) resetServerIPs(cfg Config) {
+	s.serverIPs.reset(serverIPSpec(cfg, s.serverIPHints(cfg)))
+}
+
+// sampleCIDR 从网段中随机抽取最多 n 个不重复的地址，IPv4 网段跳过网络地址和广播地址
+func sampleCIDR(cidr *net.IPNet, n int) []string {
+	ones, bits := cidr.Mask.Size()
+	if hostBits := bits - ones; hostBits < 31 {
+		n = min(n, 1<<hostBits)
+	}
+	broadcast := slices.Clone(cidr.IP)
+	for i := range broadcast {
+		broadcast[i] |= ^cidr.Mask[i]
+	}
+	skipEnds := len(cidr.IP) == net.IPv4len && bits-ones >= 2
+
+	seen := map[string]bool{}
+	for attempts := 0; len(seen) < n && attempts < 4*n; attempts++ {
+		ip := slices.Clone(cidr.IP)
+		for i := range ip {
+			ip[i] |= byte(rand.IntN(256)) &^ cidr.Mask[i]
+		}
+		if skipEnds && (ip.Equal(cidr.IP) || ip.Equal(broadcast)) {
+			continue
+		}
+		seen[ip.String()] = true
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// serverIPSet ServerIP 的候选地址及测速结果
+type serverIPSet struct {
+	mu       sync.Mutex
+	entries  []serverIPEntry
+	stats    []ServerIPStats // 本轮候选地址，先按配置顺序排列明确指定的地址，再排列网段抽样
+	selected string
+	trigger  chan struct{} // 请求立即重新测速
+}
+
+func newServerIPSet() *serverIPSet {
+	return &serverIPSet{trigger: make(chan struct{}, 1)}
+}
+
+// reset 按 ServerIP 重新生成候选地址并清空测速结果，选择第一个候选地址
+func (set *serverIPSet) reset(spec string) {
+	entries, err := parseServerIPs(spec)
+	if err != nil || len(entries) == 0 {
+		entries = []serverIPEntry{{host: defaultFallbackServerHost}}
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.entries = entries
+	set.stats = nil
+	for _, ip := range set.candidatesLocked("") {
+		set.stats = append(set.stats, ServerIPStats{IP: ip})
+	}
+	set.selected = set.stats[0].IP
+}
+
+// candidatesLocked 返回本轮测速的地址：明确指定的地址加网段抽样，keep 为网段内需保留的地址。调用方需持有 mu
+func (set *serverIPSet) candidatesLocked(keep string) []string {
+	var hosts []string
+	for _, e := range set.entries {
+		if e.cidr == nil {
+			hosts = append(hosts, e.host)
+			continue
+		}
+		sample := sampleCIDR(e.cidr, serverIPScanSize)
+		if ip := net.ParseIP(keep); ip != nil && e.cidr.Contains(ip) && !slices.Contains(sample, keep) {
+			sample = append([]string{keep}, sample[:min(len(sample), serverIPScanSize-1)]...)
+		}
+		hosts = append(hosts, sample...)
+	}
+	return slices.Compact(hosts)
+}
+
+// needsProbe 是否有多个候选地址需要测速
+func (set *serverIPSet) needsProbe() bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return len(set.entries) > 1 || len(set.entries) == 1 && set.entries[0].cidr != nil
+}
+
+// pick 返回当前选中的地址
+func (set *serverIPSet) pick() string {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.selected
+}
+
+// selectLocked 选择测速最快且未连续失败的地址；都没有测速结果时选择第一个未连续失败的地址。调用方需持有 mu
+func (set *serverIPSet) selectLocked() {
+	usable := func(st ServerIPStats) bool { return st.Failures < serverIPMaxFailures }
+	best := -1
+	for i, st := range set.stats {
+		if !usable(st) {
+			continue
+		}
+		switch {
+		case best < 0:
+			best = i
+		case st.Latency > 0 && (set.stats[best].Latency == 0 || st.Latency < set.stats[best].Latency):
+			best = i
+		}
+	}
+	if best < 0 {
+		best = 0
+	}
+	set.selected = set.stats[best].IP
+}
+
+// recordDial 记录一次实际连接的结果，当前地址连续失败达到上限时改选其他地址，返回是否需要重新测速
+func (set *serverIPSet) recordDial(ip string, err error) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	i := slices.IndexFunc(set.stats, func(st ServerIPStats) bool { return st.IP == ip })
+	if i < 0 {
+		return false
+	}
+	st := &set.stats[i]
+	if err == nil {
+		st.Failures, st.LastError = 0, ""
+		return false
+	}
+	st.Failures++
+	st.LastError = err.Error()
+	if st.Failures < serverIPMaxFailures || len(set.stats) == 1 {
+		return false
+	}
+	set.selectLocked()
+	return true
+}
+
+// requestProbe 请求后台立即重新测速，已有待处理的请求时忽略
+func (set *serverIPSet) requestProbe() {
+	select {
+	case set.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// GetServerIPStats 获取 ServerIP 各候选地址的测速结果，按配置顺序排列
+func (s *ProxyServer) GetServerIPStats() []ServerIPStats {
+	set := s.serverIPs
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	stats := slices.Clone(set.stats)
+	for i := range stats {
+		stats[i].Selected = stats[i].IP == set.selected
+	}
+	return stats
+}
+
+// dialServerIP 通过当前选中的 ServerIP 连接服务端的 port 端口，并记录结果
+func (s *ProxyServer) dialServerIP(ctx context.Context, port string) (net.Conn, error) {
+	ip := s.serverIPs.pick()
+	conn, err := s.dialUpstream(ctx, &net.Dialer{Timeout: s.dialTimeout()}, net.JoinHostPort(ip, port))
+	if ctx.Err() == nil && s.serverIPs.recordDial(ip, err) {
+		LogInfo("[测速] ServerIP %s 连续 %d 次连接失败，改用 %s 并重新测速", ip, serverIPMaxFailures, s.serverIPs.pick())
+		s.serverIPs.requestProbe()
+	}
+	return conn, err
+}
+
+// serverIPProbeInterval 定期测速的间隔，0 表示只在启动和连续失败后测速
+func serverIPProbeInterval(cfg Config) time.Duration {
+	switch {
+	case cfg.ServerIPProbeInterval < 0:
+		return 0
+	case cfg.ServerIPProbeInterval == 0:
+		return defaultServerIPProbeInterval
+	}
+	return cfg.ServerIPProbeInterval
+}
+
+// probeServerIPs 后台定期为 ServerIP 的候选地址测速，每轮测速后按当前配置的 ServerIPProbeInterval 等待
+func (s *ProxyServer) probeServerIPs(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		case <-s.serverIPs.trigger:
+		}
+		if s.serverIPs.needsProbe() {
+			s.probeServerIPRound(ctx)
+		}
+		timer.Stop()
+		if interval := serverIPProbeInterval(s.GetConfig()); interval > 0 {
+			timer.Reset(interval)
+		}
+	}
+}
+
+// probeServerIPRound 对本轮候选地址并发测速并重新选择最快的地址
+func (s *ProxyServer) probeServerIPRound(ctx context.Context) {
+	set := s.serverIPs
+	set.mu.Lock()
+	entries := set.entries
+	hosts := set.candidatesLocked(set.selected)
+	previous := set.selected
+	set.mu.Unlock()
+
+	cfg := s.GetConfig()
+	servers := serverAddrs(cfg.ServerAddr)
+	if len(servers) == 0 {
+		return
+	}
+	host, port, _, err := parseServerAddr(servers[0])
+	if err != nil {
+		return
+	}
+	var tlsCfg *tls.Config
+	if addrUsesTLS(servers[0]) {
+		if tlsCfg, err = s.buildUpstreamTLSConfig(cfg, host, port); err != nil {
+			LogError("[测速] 构建 TLS 配置失败: %v", err)
+			return
+		}
+	}
+
+	results := make([]ServerIPStats, len(hosts))
+	sem := make(chan struct{}, serverIPProbeConcurrency)
+	var wg sync.WaitGroup
+	for i, ip := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.probeServerIP(ctx, ip, port, tlsCfg)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	reachable := 0
+	for _, st := range results {
+		if st.Latency > 0 {
+			reachable++
+		}
+	}
+
+	set.mu.Lock()
+	if !slices.Equal(set.entries, entries) {
+		// 测速期间 ServerIP 已变化，结果作废
+		set.mu.Unlock()
+		return
+	}
+	set.stats = results
+	set.selectLocked()
+	i := slices.IndexFunc(set.stats, func(st ServerIPStats) bool { return st.IP == set.selected })
+	selected := set.stats[i]
+	set.mu.Unlock()
+
+	switch {
+	case reachable == 0:
+		LogError("[测速] %d 个 ServerIP 候选地址均连接失败", len(results))
+	case selected.IP != previous:
+		LogInfo("[测速] 改用 ServerIP %s (%v，%d/%d 个地址可用)", selected.IP, selected.Latency.Round(time.Millisecond), reachable, len(results))
+	}
+}
+
+// probeServerIP 测量通过 ip 连接服务端 port 端口的 TCP 连接加 TLS 握手耗时，tlsCfg 为 nil 时只测 TCP 连接；
+// 设置了 UpstreamProxy 时经代理连接，测得的是经代理的耗时
+func (s *ProxyServer) probeServerIP(ctx context.Context, ip, port string, tlsCfg *tls.Config) ServerIPStats {
+	st := ServerIPStats{IP: ip, ProbedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(ctx, serverIPProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := s.dialUpstream(ctx, &net.Dialer{}, net.JoinHostPort(ip, port))
+	if err == nil {
+		if tlsCfg != nil {
+			tlsConn := tls.Client(conn, tlsCfg)
+			err = tlsConn.HandshakeContext(ctx)
+			conn = tlsConn
+		}
+		conn.Close()
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("超过 %v 未完成", serverIPProbeTimeout)
+		}
+		st.LastError, st.Failures = err.Error(), 1
+		return st
+	}
+	st.Latency = max(time.Since(start), time.Microsecond)
+	return st
+}
@@ -0,0 +1,455 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SettingType 配置项的值类型，决定 SettingValues 返回和 ApplySettings 接受的格式
+type SettingType string
+
+const (
+	SettingString     SettingType = "string"     // 字符串，Enum 不为空时只能取其中之一
+	SettingBool       SettingType = "bool"       // 布尔值
+	SettingInt        SettingType = "int"        // 整数
+	SettingDuration   SettingType = "duration"   // 时长字符串，如 "10s"、"1m30s"
+	SettingStringList SettingType = "stringList" // 字符串数组
+	SettingIntList    SettingType = "intList"    // 整数数组，Min、Max 限制每个元素
+	SettingIntMap     SettingType = "intMap"     // 字符串到整数的对象，如 {"*.example.com": 1048576}
+	SettingAppRules   SettingType = "appRules"   // ParseAppRules 格式的字符串
+	SettingOther      SettingType = "other"      // 无法序列化（如 *net.Resolver），只能直接设置 Config
+)
+
+// Setting 描述 Config 的一个字段，图形界面据此生成设置项、显示默认值并在提交前校验。
+// Settings 覆盖 Config 的全部字段，新增字段时须同时登记
+type Setting struct {
+	Name            string      `json:"name"`            // Config 字段名，也是 SettingValues、ApplySettings 的键
+	Type            SettingType `json:"type"`            // 值类型
+	Default         any         `json:"default"`         // 字段为零值时实际生效的值
+	Min             any         `json:"min,omitempty"`   // 取值下限（含），int 为整数，duration 为时长字符串
+	Max             any         `json:"max,omitempty"`   // 取值上限（含），格式同 Min
+	Enum            []string    `json:"enum,omitempty"`  // string 类型的可选值，另外可为空字符串（使用 Default）
+	Advanced        bool        `json:"advanced"`        // 高级设置，界面默认收起
+	RestartRequired bool        `json:"restartRequired"` // Reload 和 Restart 不会应用，需重新创建 ProxyServer
+	HelpKey         string      `json:"helpKey"`         // 帮助文本的本地化键
+	Help            string      `json:"help"`            // 帮助文本，没有对应翻译时显示
+}
+
+// settingDef 配置项定义，min、max 为 int 和 duration（纳秒）的取值范围
+type settingDef struct {
+	Setting
+	min, max *int64
+}
+
+func newSetting(name string, typ SettingType, def any, help string) settingDef {
+	key := "settings." + strings.ToLower(name[:1]) + name[1:]
+	return settingDef{Setting: Setting{Name: name, Type: typ, Default: def, HelpKey: key, Help: help}}
+}
+
+func (d settingDef) advanced() settingDef {
+	d.Advanced = true
+	return d
+}
+
+func (d settingDef) restart() settingDef {
+	d.RestartRequired = true
+	return d
+}
+
+func (d settingDef) enum(values ...string) settingDef {
+	d.Enum = values
+	return d
+}
+
+// between 设置取值范围，int 类型传整数，duration 类型传 time.Duration
+func (d settingDef) between(min, max int64) settingDef {
+	d.min, d.max = &min, &max
+	return d
+}
+
+// atLeast 只设置下限
+func (d settingDef) atLeast(min int64) settingDef {
+	d.min = &min
+	return d
+}
+
+// settingDefs 按 Config 字段顺序登记的全部配置项
+var settingDefs = []settingDef{
+	newSetting("ListenAddr", SettingString, "", "本地 SOCKS5/HTTP 代理监听地址，如 127.0.0.1:30000"),
+	newSetting("ServerAddr", SettingString, "", "服务端地址，如 your-worker.workers.dev:443，逗号分隔多个时自动故障转移"),
+	newSetting("ServerIP", SettingString, "", "连接服务端使用的 IP 或域名，绕过 DNS 解析；逗号分隔多个 IP、域名或网段时测速后使用最快的，为空时使用 ECH 查询域名 HTTPS 记录中的地址提示，没有时使用 FallbackServerHost"),
+	newSetting("FallbackServerHost", SettingString, defaultFallbackServerHost, "ServerIP 为空且 HTTPS 记录中没有地址提示时连接服务端使用的域名，启动时解析为 IP").advanced(),
+	newSetting("Token", SettingString, "", "服务端令牌"),
+	newSetting("DNSServer", SettingString, "", "查询 ECH 配置使用的 DoH 服务器，逗号分隔多个时依次尝试；主机后加 @IP 时直接连接该 IP，如 dns.alidns.com@223.5.5.5/dns-query"),
+	newSetting("ECHDomain", SettingString, "", "查询 ECH 配置的域名"),
+	newSetting("RoutingMode", SettingString, string(RoutingModeGlobal), "分流模式：全局代理、跳过中国大陆或直连").
+		enum(string(RoutingModeGlobal), string(RoutingModeBypassCN), string(RoutingModeNone)),
+	newSetting("StoreDir", SettingString, "", "分流数据和流量统计的保存目录").restart(),
+	newSetting("IPListBaseURL", SettingString, "", "下载中国 IP 列表的目录地址，为空时从 GitHub 下载，失败时从服务端下载").advanced(),
+	newSetting("ServePAC", SettingBool, false, "在代理端口上提供 /proxy.pac 自动配置脚本，按分流模式生成").advanced(),
+	newSetting("DNSListenAddr", SettingString, "", "本地 DNS 服务监听地址，如 127.0.0.1:5353，UDP/TCP 接受 DNS 查询、/dns-query 接受 DoH，经服务端解析，为空时不启动").advanced(),
+	newSetting("Transparent", SettingBool, false, "作为透明代理接收 iptables REDIRECT 重定向的连接，不再支持 SOCKS5/HTTP（仅 Linux）").advanced(),
+	newSetting("RequireECH", SettingBool, false, "无法获取 ECH 配置时拒绝启动，而不是降级为普通 TLS").advanced(),
+	newSetting("ECHPublicName", SettingString, "", "ECH 配置中公开名称（外层 SNI）的预期值，不一致时不使用该配置，为空不检查").advanced(),
+	newSetting("ECHCacheMaxAge", SettingDuration, defaultECHCacheMaxAge.String(), "DoH 查询失败时可使用的缓存 ECH 配置的最长时间，负数表示不使用缓存").advanced(),
+	newSetting("ECHRefreshInterval", SettingDuration, defaultECHRefreshInterval.String(), "后台重新查询 ECH 配置的间隔，负数表示只在连接被拒绝时刷新").advanced(),
+	newSetting("ServerIPProbeInterval", SettingDuration, defaultServerIPProbeInterval.String(), "ServerIP 有多个候选地址时重新测速的间隔，负数表示只在启动和连续失败后测速").advanced(),
+	newSetting("UpstreamProxy", SettingString, "", "连接服务端和 DoH 服务器时经过的代理，如 socks5://127.0.0.1:7890、http://proxy:3128，为空时使用环境变量中的代理，direct 表示直连").advanced(),
+	newSetting("UpstreamProxyDirect", SettingBool, false, "直连的 TCP 连接也经过上游代理").advanced(),
+	newSetting("BalanceStrategy", SettingString, string(BalanceFailover), "有多个服务端时新隧道选择服务端的方式：故障转移、轮流使用或优先延迟最低").
+		advanced().enum(string(BalanceFailover), string(BalanceRoundRobin), string(BalanceLatency)),
+	newSetting("MaxConnections", SettingInt, 0, "最大并发连接数，0 表示不限制").advanced().atLeast(0),
+	newSetting("HostRateLimits", SettingIntMap, nil, "按目标主机限速（字节/秒，上传和下载分别计算），键可为 *.example.com").advanced(),
+	newSetting("TotalRateLimit", SettingInt, 0, "所有连接共享的总带宽（字节/秒），0 表示不限制").advanced().atLeast(0),
+	newSetting("TotalRateLimitExemptDirect", SettingBool, false, "直连流量不计入总带宽限制").advanced(),
+	newSetting("WatchNetwork", SettingBool, false, "网络切换后自动清空缓存并重新获取 ECH 配置").advanced(),
+	newSetting("HandshakeTimeout", SettingDuration, defaultLocalHandshakeTimeout.String(), "本地 SOCKS5/HTTP 握手超时").
+		advanced().atLeast(0),
+	newSetting("EstablishTimeout", SettingDuration, defaultEstablishTimeout.String(), "分流决策及上游连接建立的超时").
+		advanced().atLeast(0),
+	newSetting("IdleTimeout", SettingDuration, "0s", "双向均无数据超过该时间则关闭隧道，0 表示不限制").advanced().atLeast(0),
+	newSetting("DialTimeout", SettingDuration, defaultDialTimeout.String(), "建立一个 TCP 连接（服务端、直连目标、上游代理）的超时").
+		advanced().atLeast(0),
+	newSetting("TLSHandshakeTimeout", SettingDuration, defaultTLSHandshakeTimeout.String(), "与服务端 TLS 握手及 WebSocket 升级的超时").
+		advanced().atLeast(0),
+	newSetting("DoHTimeout", SettingDuration, defaultDoHTimeout.String(), "一次 DoH 查询的超时").advanced().atLeast(0),
+	newSetting("AppRules", SettingAppRules, "", "按应用分流，如 proxy:firefox,direct:steam（仅 Linux 和 macOS）").advanced(),
+	newSetting("ResumeGrace", SettingDuration, "0s", "WebSocket 断开后在该时间内恢复隧道（需服务端支持），0 表示关闭").
+		advanced().atLeast(0),
+	newSetting("ResumeBufferSize", SettingInt, defaultResumeBufferSize, "每条可恢复隧道保留的上传数据量（字节）").
+		advanced().between(0, 64<<20),
+	newSetting("PingInterval", SettingDuration, defaultPingInterval.String(), "隧道 WebSocket 的 ping 间隔，须小于 PongTimeout").
+		advanced().atLeast(0),
+	newSetting("PongTimeout", SettingDuration, defaultPongTimeout.String(), "超过该时间未收到 pong 或数据则认为连接失效").
+		advanced().atLeast(0),
+	newSetting("DNSPinTTL", SettingDuration, defaultDNSPinTTL.String(), "直连成功后记住域名 IP 的时间，小于 0 表示不记住").advanced(),
+	newSetting("DNSPinExclude", SettingStringList, nil, "不记住 IP 的主机").advanced(),
+	newSetting("DNSPinMaxEntries", SettingInt, defaultDNSPinMaxEntries, "最多记住 IP 的主机数").advanced().between(0, 1<<20),
+	newSetting("Resolver", SettingOther, nil, "直连时使用的域名解析器"),
+	newSetting("PinnedSPKI", SettingStringList, nil, "服务端证书的公钥固定值（sha256/...）").advanced(),
+	newSetting("PinAnyChainCert", SettingBool, false, "公钥固定值可匹配证书链中的任一证书").advanced(),
+	newSetting("RootCAs", SettingOther, nil, "验证服务端证书使用的根证书"),
+	newSetting("Compression", SettingBool, false, "协商 permessage-deflate 压缩，仅对未加密的可压缩流量有效").advanced(),
+	newSetting("CompressPorts", SettingIntList, nil, "只对这些目标端口压缩，为空时跳过 443 等 TLS 端口").
+		advanced().between(1, 65535),
+	newSetting("HTTP2WebSocket", SettingBool, false, "通过 HTTP/2 扩展 CONNECT 建立 WebSocket（需服务端支持）").advanced(),
+	newSetting("Obfuscation", SettingString, string(ObfuscationNone), "隧道开头几帧的混淆方式：不混淆、拆分首帧或随机填充（需服务端支持）").
+		advanced().enum(string(ObfuscationNone), string(ObfuscationFragment), string(ObfuscationPad)),
+	newSetting("UploadCoalesceDelay", SettingDuration, defaultCoalesceDelay.String(), "合并小块上传数据的等待时间，小于 0 表示不合并").
+		advanced(),
+	newSetting("DialRetries", SettingInt, defaultDialRetries, "建立隧道遇到临时性错误时的重试次数，小于 0 表示不重试").
+		advanced().between(-1, 10),
+	newSetting("DialRetryDelay", SettingDuration, defaultDialRetryDelay.String(), "首次重试前的等待时间，之后每次翻倍并加入随机抖动").
+		advanced().between(0, int64(maxDialRetryDelay)),
+	newSetting("FallbackDirect", SettingBool, false, "服务端不可用时改为直连，会暴露真实 IP").advanced(),
+	newSetting("HealthCheckInterval", SettingDuration, "0s", "后台健康检查的间隔，0 表示关闭").advanced().atLeast(0),
+	newSetting("HealthCheckFailures", SettingInt, defaultHealthCheckFailures, "连续失败多少次后认为服务端不可用").
+		advanced().between(0, 100),
+	newSetting("PlaintextPolicy", SettingString, string(PlaintextAllow), "经代理发送明文协议（HTTP、FTP 等）时：允许、记录警告或拒绝").
+		advanced().enum(string(PlaintextAllow), string(PlaintextWarn), string(PlaintextBlock)),
+	newSetting("PlaintextExempt", SettingStringList, nil, "不检查明文协议的主机").advanced(),
+	newSetting("DrainTimeout", SettingDuration, defaultDrainTimeout.String(), "停止时等待连接优雅关闭的时间").advanced().atLeast(0),
+	newSetting("PauseMode", SettingString, string(PauseModeReject), "暂停期间新连接的处理方式").advanced().
+		enum(string(PauseModeReject), string(PauseModeDirect)),
+	newSetting("PauseDrain", SettingBool, false, "暂停时关闭现有连接").advanced(),
+	newSetting("RouteDecisionLogSize", SettingInt, defaultRouteDecisionLogSize, "保留的最近分流决策条数").
+		advanced().restart().between(0, 10000),
+	newSetting("RecentConnectionsSize", SettingInt, defaultRecentConnectionsSize, "保留的最近结束连接条数").
+		advanced().restart().between(0, 10000),
+	newSetting("StatsMaxSites", SettingInt, defaultMaxSiteStats, "流量统计最多保留的站点数，超出时淘汰最久未访问的站点").
+		advanced().between(0, 1<<20),
+	newSetting("InternalsLogInterval", SettingDuration, "0s", "定期记录 goroutine 数、堆内存及内部表大小的间隔，0 表示关闭").
+		advanced().atLeast(0),
+}
+
+// Settings 返回 Config 全部字段的描述，顺序与 Config 的字段顺序相同
+func Settings() []Setting {
+	out := make([]Setting, len(settingDefs))
+	for i, d := range settingDefs {
+		s := d.Setting
+		if d.min != nil {
+			s.Min = d.format(*d.min)
+		}
+		if d.max != nil {
+			s.Max = d.format(*d.max)
+		}
+		out[i] = s
+	}
+	return out
+}
+
+func (d settingDef) format(n int64) any {
+	if d.Type == SettingDuration {
+		return time.Duration(n).String()
+	}
+	return n
+}
+
+func lookupSetting(name string) (settingDef, bool) {
+	for _, d := range settingDefs {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return settingDef{}, false
+}
+
+// SettingValues 返回 cfg 中 names 对应字段的值，格式与 ApplySettings 接受的相同，
+// names 为空时返回全部可序列化的字段；SettingOther 类型和未知的字段被忽略
+func SettingValues(cfg Config, names ...string) map[string]any {
+	if len(names) == 0 {
+		for _, d := range settingDefs {
+			names = append(names, d.Name)
+		}
+	}
+	v := reflect.ValueOf(cfg)
+	values := make(map[string]any, len(names))
+	for _, name := range names {
+		d, ok := lookupSetting(name)
+		if !ok || d.Type == SettingOther {
+			continue
+		}
+		field := v.FieldByName(name)
+		switch d.Type {
+		case SettingString:
+			values[name] = field.String()
+		case SettingBool:
+			values[name] = field.Bool()
+		case SettingInt:
+			values[name] = field.Int()
+		case SettingDuration:
+			values[name] = time.Duration(field.Int()).String()
+		case SettingStringList:
+			values[name] = slices.Clone(field.Interface().([]string))
+		case SettingIntList:
+			values[name] = slices.Clone(field.Interface().([]int))
+		case SettingIntMap:
+			m := map[string]int64{}
+			for k, n := range field.Interface().(map[string]int64) {
+				m[k] = n
+			}
+			values[name] = m
+		case SettingAppRules:
+			values[name] = formatAppRules(field.Interface().([]AppRule))
+		}
+	}
+	return values
+}
+
+// ApplySettings 按 Settings 的定义校验 values 并写入 cfg，键为 Config 字段名。
+// 数值可为任意整数类型、整数值的 float64 或 json.Number，以兼容 JSON 解码的结果。
+// 写入后还会检查公钥固定值和保活参数等字段间的约束；任一值无效时返回错误且 cfg 不变
+func ApplySettings(cfg *Config, values map[string]any) error {
+	next := *cfg
+	v := reflect.ValueOf(&next).Elem()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		d, ok := lookupSetting(name)
+		if !ok {
+			return fmt.Errorf("未知的配置项 %s", name)
+		}
+		if err := d.apply(v.FieldByName(name), values[name]); err != nil {
+			return fmt.Errorf("配置项 %s: %w", name, err)
+		}
+	}
+	if err := validateConfig(next); err != nil {
+		return err
+	}
+	*cfg = next
+	return nil
+}
+
+// apply 将 raw 转换为字段类型并检查取值范围
+func (d settingDef) apply(field reflect.Value, raw any) error {
+	switch d.Type {
+	case SettingString:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("应为字符串，实际为 %T", raw)
+		}
+		// 空字符串为字段零值，即使用 Default
+		if len(d.Enum) > 0 && s != "" && !slices.Contains(d.Enum, s) {
+			return fmt.Errorf("%q 不是可选值 %s 之一", s, strings.Join(d.Enum, "、"))
+		}
+		field.SetString(s)
+	case SettingBool:
+		b, ok := raw.(bool)
+		if !ok {
+			return fmt.Errorf("应为布尔值，实际为 %T", raw)
+		}
+		field.SetBool(b)
+	case SettingInt:
+		n, err := settingInt(raw)
+		if err != nil {
+			return err
+		}
+		if err := d.checkRange(n); err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case SettingDuration:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("应为时长字符串（如 \"10s\"），实际为 %T", raw)
+		}
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("无效的时长 %q", s)
+		}
+		if err := d.checkRange(int64(dur)); err != nil {
+			return err
+		}
+		field.SetInt(int64(dur))
+	case SettingStringList:
+		list, err := settingStringList(raw)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(list))
+	case SettingIntList:
+		list, err := settingIntList(raw)
+		if err != nil {
+			return err
+		}
+		for _, n := range list {
+			if err := d.checkRange(int64(n)); err != nil {
+				return err
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	case SettingIntMap:
+		m, err := settingIntMap(raw)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(m))
+	case SettingAppRules:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("应为字符串，实际为 %T", raw)
+		}
+		rules, err := ParseAppRules(s)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(rules))
+	default:
+		return fmt.Errorf("只能通过 Config 设置")
+	}
+	return nil
+}
+
+func (d settingDef) checkRange(n int64) error {
+	if d.min != nil && n < *d.min {
+		return fmt.Errorf("%v 小于最小值 %v", d.format(n), d.format(*d.min))
+	}
+	if d.max != nil && n > *d.max {
+		return fmt.Errorf("%v 大于最大值 %v", d.format(n), d.format(*d.max))
+	}
+	return nil
+}
+
+func settingInt(raw any) (int64, error) {
+	switch n := raw.(type) {
+	case int:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case float64:
+		if n != math.Trunc(n) || math.Abs(n) > 1<<53 {
+			return 0, fmt.Errorf("%v 不是整数", n)
+		}
+		return int64(n), nil
+	case json.Number:
+		return n.Int64()
+	}
+	return 0, fmt.Errorf("应为整数，实际为 %T", raw)
+}
+
+func settingStringList(raw any) ([]string, error) {
+	switch list := raw.(type) {
+	case nil:
+		return nil, nil
+	case []string:
+		return slices.Clone(list), nil
+	case []any:
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("数组元素应为字符串，实际为 %T", item)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("应为字符串数组，实际为 %T", raw)
+}
+
+func settingIntList(raw any) ([]int, error) {
+	switch list := raw.(type) {
+	case nil:
+		return nil, nil
+	case []int:
+		return slices.Clone(list), nil
+	case []any:
+		out := make([]int, 0, len(list))
+		for _, item := range list {
+			n, err := settingInt(item)
+			if err != nil {
+				return nil, fmt.Errorf("数组元素%w", err)
+			}
+			out = append(out, int(n))
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("应为整数数组，实际为 %T", raw)
+}
+
+func settingIntMap(raw any) (map[string]int64, error) {
+	switch m := raw.(type) {
+	case nil:
+		return nil, nil
+	case map[string]int64:
+		out := make(map[string]int64, len(m))
+		for k, n := range m {
+			out[k] = n
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]int64, len(m))
+		for k, item := range m {
+			n, err := settingInt(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = n
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("应为对象，实际为 %T", raw)
+}
+
+// formatAppRules 将规则格式化为 ParseAppRules 接受的字符串
+func formatAppRules(rules []AppRule) string {
+	items := make([]string, len(rules))
+	for i, r := range rules {
+		action := "proxy"
+		if r.Direct {
+			action = "direct"
+		}
+		items[i] = action + ":" + r.Pattern
+	}
+	return strings.Join(items, ",")
+}
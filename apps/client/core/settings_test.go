@@ -0,0 +1,92 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSettingsSchema Settings 按顺序覆盖 Config 的全部字段，
+// ApplySettings 拒绝超出范围或不合法的值且不修改配置，合法值可经 SettingValues 读回
+func TestSettingsSchema(t *testing.T) {
+	settings := Settings()
+	typ := reflect.TypeOf(Config{})
+	if len(settings) != typ.NumField() {
+		t.Errorf("Settings() has %d entries, Config has %d fields", len(settings), typ.NumField())
+	}
+	for i := 0; i < typ.NumField() && i < len(settings); i++ {
+		if name := typ.Field(i).Name; settings[i].Name != name {
+			t.Errorf("setting %d = %s, want Config field %s", i, settings[i].Name, name)
+		}
+	}
+	for _, st := range settings {
+		if st.HelpKey == "" || st.Help == "" {
+			t.Errorf("%s: missing help", st.Name)
+		}
+		if st.Type != SettingOther {
+			if err := ApplySettings(&Config{}, map[string]any{st.Name: st.Default}); err != nil {
+				t.Errorf("%s: default %v rejected: %v", st.Name, st.Default, err)
+			}
+		}
+	}
+
+	base := testConfig(t)
+	for _, tc := range []struct {
+		name   string
+		values map[string]any
+	}{
+		{"above max", map[string]any{"RouteDecisionLogSize": 20000}},
+		{"below min", map[string]any{"MaxConnections": -1}},
+		{"negative duration", map[string]any{"IdleTimeout": "-1s"}},
+		{"bad duration", map[string]any{"DrainTimeout": "soon"}},
+		{"not in enum", map[string]any{"PauseMode": "queue"}},
+		{"fractional int", map[string]any{"TotalRateLimit": 1.5}},
+		{"wrong type", map[string]any{"Compression": "yes"}},
+		{"unknown name", map[string]any{"NoSuchField": 1}},
+		{"not serializable", map[string]any{"Resolver": nil}},
+		{"ping not below pong", map[string]any{"PingInterval": "2s", "PongTimeout": "1s"}},
+		{"one invalid among valid", map[string]any{"MaxConnections": 10, "ResumeBufferSize": 1 << 30}},
+	} {
+		cfg := base
+		if err := ApplySettings(&cfg, tc.values); err == nil {
+			t.Errorf("%s: ApplySettings(%v) accepted", tc.name, tc.values)
+		}
+		if !reflect.DeepEqual(cfg, base) {
+			t.Errorf("%s: config modified by rejected settings", tc.name)
+		}
+	}
+
+	// 数值按 JSON 解码的结果传入
+	var values map[string]any
+	raw := `{"MaxConnections": 64, "IdleTimeout": "90s", "PauseMode": "direct", "DNSPinExclude": ["a.example"],
+		"HostRateLimits": {"*.example.com": 1024}, "AppRules": "proxy:firefox,direct:steam", "RequireECH": true}`
+	if err := json.Unmarshal([]byte(raw), &values); err != nil {
+		t.Fatal(err)
+	}
+	cfg := base
+	if err := ApplySettings(&cfg, values); err != nil {
+		t.Fatalf("ApplySettings: %v", err)
+	}
+	if cfg.MaxConnections != 64 || cfg.IdleTimeout != 90*time.Second || cfg.PauseMode != PauseModeDirect {
+		t.Fatalf("settings not applied: %+v", cfg)
+	}
+	got := SettingValues(cfg, "MaxConnections", "IdleTimeout", "DNSPinExclude", "HostRateLimits", "AppRules", "Resolver")
+	want := map[string]any{
+		"MaxConnections": int64(64),
+		"IdleTimeout":    "1m30s",
+		"DNSPinExclude":  []string{"a.example"},
+		"HostRateLimits": map[string]int64{"*.example.com": 1024},
+		"AppRules":       "proxy:firefox,direct:steam",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SettingValues = %v, want %v", got, want)
+	}
+	again := base
+	if err := ApplySettings(&again, SettingValues(cfg)); err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	if !reflect.DeepEqual(SettingValues(again), SettingValues(cfg)) {
+		t.Fatal("settings changed after round trip")
+	}
+}
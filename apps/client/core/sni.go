@@ -0,0 +1,100 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"time"
+)
+
+// sniPeekLimit peekSNI 最多缓冲的数据：一个 TLS 记录头加最大记录长度
+const sniPeekLimit = 5 + 16384
+
+// peekSNI 在 wait 内读取 conn 的第一个 TLS 记录，从其中的 ClientHello 提取 SNI，不解密也不终止握手。
+// 返回读到的全部数据，调用方需原样作为首帧转发并恢复读取截止时间。首个记录不是 ClientHello、
+// 没有 SNI 或未在 wait 内读完时 sni 为空；读取出错时返回已读到的数据，错误留给之后的读取处理
+func peekSNI(conn net.Conn, wait time.Duration) (sni string, buffered []byte) {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 0, 1024)
+	want := 5 // 先读记录头，再按其中的长度读完整个记录
+	for len(buf) < want {
+		buf = slices.Grow(buf, want-len(buf))
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if want == 5 && len(buf) >= 5 {
+			if buf[0] != 0x16 { // 不是握手记录
+				return "", buf
+			}
+			if want = 5 + int(binary.BigEndian.Uint16(buf[3:5])); want > sniPeekLimit {
+				return "", buf
+			}
+		}
+		if err != nil {
+			return "", buf
+		}
+	}
+	return clientHelloSNI(buf[5:want]), buf
+}
+
+// clientHelloSNI 从握手记录的内容中解析 ClientHello 的 server_name 扩展，格式错误或没有 SNI 时返回空。
+// 只处理完整位于第一个记录中的 ClientHello，跨记录分片的极少见，按没有 SNI 处理
+func clientHelloSNI(msg []byte) string {
+	// msg_type(1) length(3)
+	if len(msg) < 4 || msg[0] != 0x01 {
+		return ""
+	}
+	n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+n {
+		return ""
+	}
+	body := msg[4 : 4+n]
+	// legacy_version(2) random(32) session_id(1+n) cipher_suites(2+n) compression_methods(1+n) extensions(2+n)
+	off := 34
+	if len(body) < off+1 {
+		return ""
+	}
+	off += 1 + int(body[off])
+	if len(body) < off+2 {
+		return ""
+	}
+	off += 2 + int(binary.BigEndian.Uint16(body[off:]))
+	if len(body) < off+1 {
+		return ""
+	}
+	off += 1 + int(body[off])
+	if len(body) < off+2 {
+		return ""
+	}
+	n = int(binary.BigEndian.Uint16(body[off:]))
+	if len(body) < off+2+n {
+		return ""
+	}
+	exts := body[off+2 : off+2+n]
+	for len(exts) >= 4 {
+		typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			return ""
+		}
+		data := exts[4 : 4+n]
+		exts = exts[4+n:]
+		if typ != 0 { // server_name
+			continue
+		}
+		// server_name_list(2+n): name_type(1) host_name(2+n)
+		if len(data) < 2 {
+			return ""
+		}
+		for list := data[2:]; len(list) >= 3; {
+			kind, n := list[0], int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+n {
+				return ""
+			}
+			if kind == 0 { // host_name
+				return string(list[3 : 3+n])
+			}
+			list = list[3+n:]
+		}
+		return ""
+	}
+	return ""
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -21,16 +22,35 @@ type SiteStats struct {
 	FirstAccess time.Time `json:"first_access"` // 首次访问时间
 }
 
+// ServerTraffic 经单个服务端转发的流量统计，ServerAddr 有多个服务端时用于查看负载分布
+type ServerTraffic struct {
+	Server      string `json:"server"`
+	Upload      int64  `json:"upload"`      // 上传字节数
+	Download    int64  `json:"download"`    // 下载字节数
+	Connections int64  `json:"connections"` // 经该服务端建立的隧道数
+}
+
+// defaultMaxSiteStats 默认最多保留的站点统计数
+const defaultMaxSiteStats = 10000
+
 // TrafficStats 流量统计管理器
 type TrafficStats struct {
 	mu       sync.RWMutex
 	sites    map[string]*SiteStats
+	other    SiteStats // 已淘汰的站点和保存时低于 minSaveThreshold 的站点合计，Host 为空
 	storeDir string
+	maxSites int // 站点数上限，超出时淘汰最久未访问的站点
 
-	// 全局统计
+	// 各服务端的隧道流量，键为服务端地址，不含直连流量
+	servers map[string]*ServerTraffic
+
+	// 全局统计，等于 sites 与 other 之和
 	totalUpload   int64
 	totalDownload int64
 
+	// 服务端不可用时降级为直连的连接数（FallbackDirect），不保存到文件
+	fallbackConnections int64
+
 	// 速度统计
 	lastUpload     int64
 	lastDownload   int64
@@ -39,17 +59,66 @@ type TrafficStats struct {
 	downloadSpeed  int64 // bytes/s
 }
 
-// NewTrafficStats 创建流量统计管理器
+// NewTrafficStats 创建流量统计管理器。内部 API，外部程序通过 ProxyServer.GetTrafficStats 获取
 func NewTrafficStats(storeDir string) *TrafficStats {
 	ts := &TrafficStats{
 		sites:    make(map[string]*SiteStats),
+		servers:  make(map[string]*ServerTraffic),
 		storeDir: storeDir,
+		maxSites: defaultMaxSiteStats,
 	}
 	ts.load()
 	return ts
 }
 
-// RecordConnection 记录新连接
+// setMaxSites 设置站点数上限，n 小于 1 时使用默认值，已超出的站点立即淘汰
+func (ts *TrafficStats) setMaxSites(n int) {
+	if n < 1 {
+		n = defaultMaxSiteStats
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.maxSites = n
+	if len(ts.sites) > n {
+		ts.evictLocked(n)
+	}
+}
+
+// evictLocked 按最后访问时间淘汰站点，直到剩余 keep 个。
+// 达到上限时一次淘汰十分之一，避免每个新站点都排序一次
+func (ts *TrafficStats) evictLocked(keep int) {
+	hosts := make([]string, 0, len(ts.sites))
+	for host := range ts.sites {
+		hosts = append(hosts, host)
+	}
+	slices.SortFunc(hosts, func(a, b string) int { return ts.sites[a].LastAccess.Compare(ts.sites[b].LastAccess) })
+	for _, host := range hosts[:len(hosts)-keep] {
+		ts.other.add(ts.sites[host])
+		delete(ts.sites, host)
+	}
+}
+
+// add 把 st 的流量和连接数计入 o，访问时间取两者的范围
+func (o *SiteStats) add(st *SiteStats) {
+	o.Upload += st.Upload
+	o.Download += st.Download
+	o.Connections += st.Connections
+	if o.FirstAccess.IsZero() || st.FirstAccess.Before(o.FirstAccess) {
+		o.FirstAccess = st.FirstAccess
+	}
+	if st.LastAccess.After(o.LastAccess) {
+		o.LastAccess = st.LastAccess
+	}
+}
+
+// SiteCount 返回当前保留的站点统计数
+func (ts *TrafficStats) SiteCount() int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return len(ts.sites)
+}
+
+// RecordConnection 记录新连接。内部 API
 func (ts *TrafficStats) RecordConnection(host string) {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
@@ -59,6 +128,9 @@ func (ts *TrafficStats) RecordConnection(host string) {
 		stats.Connections++
 		stats.LastAccess = now
 	} else {
+		if len(ts.sites) >= ts.maxSites {
+			ts.evictLocked(ts.maxSites - 1 - ts.maxSites/10)
+		}
 		ts.sites[host] = &SiteStats{
 			Host:        host,
 			Connections: 1,
@@ -68,30 +140,100 @@ func (ts *TrafficStats) RecordConnection(host string) {
 	}
 }
 
-// RecordUpload 记录上传流量
+// RecordUpload 记录上传流量。内部 API
 func (ts *TrafficStats) RecordUpload(host string, bytes int64) {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
+	ts.recordUploadLocked(host, bytes)
+}
 
+func (ts *TrafficStats) recordUploadLocked(host string, bytes int64) {
 	ts.totalUpload += bytes
 	if stats, ok := ts.sites[host]; ok {
 		stats.Upload += bytes
 		stats.LastAccess = time.Now()
+	} else {
+		// 连接仍在传输时站点已被淘汰
+		ts.other.Upload += bytes
 	}
 }
 
-// RecordDownload 记录下载流量
+// RecordDownload 记录下载流量。内部 API
 func (ts *TrafficStats) RecordDownload(host string, bytes int64) {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
+	ts.recordDownloadLocked(host, bytes)
+}
 
+func (ts *TrafficStats) recordDownloadLocked(host string, bytes int64) {
 	ts.totalDownload += bytes
 	if stats, ok := ts.sites[host]; ok {
 		stats.Download += bytes
 		stats.LastAccess = time.Now()
+	} else {
+		ts.other.Download += bytes
 	}
 }
 
+// serverLocked 返回 server 的流量统计，不存在时创建。调用方需持有 mu
+func (ts *TrafficStats) serverLocked(server string) *ServerTraffic {
+	st, ok := ts.servers[server]
+	if !ok {
+		st = &ServerTraffic{Server: server}
+		ts.servers[server] = st
+	}
+	return st
+}
+
+// RecordServerConnection 记录一条经 server 建立的隧道。内部 API
+func (ts *TrafficStats) RecordServerConnection(server string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.serverLocked(server).Connections++
+}
+
+// RecordTunnelUpload 记录经 server 转发的上传流量，同时计入站点和总流量。内部 API
+func (ts *TrafficStats) RecordTunnelUpload(host, server string, bytes int64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.recordUploadLocked(host, bytes)
+	ts.serverLocked(server).Upload += bytes
+}
+
+// RecordTunnelDownload 记录经 server 转发的下载流量，同时计入站点和总流量。内部 API
+func (ts *TrafficStats) RecordTunnelDownload(host, server string, bytes int64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.recordDownloadLocked(host, bytes)
+	ts.serverLocked(server).Download += bytes
+}
+
+// GetServerStats 获取各服务端的隧道流量，按服务端地址排序
+func (ts *TrafficStats) GetServerStats() []ServerTraffic {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	result := make([]ServerTraffic, 0, len(ts.servers))
+	for _, st := range ts.servers {
+		result = append(result, *st)
+	}
+	slices.SortFunc(result, func(a, b ServerTraffic) int { return strings.Compare(a.Server, b.Server) })
+	return result
+}
+
+// RecordFallback 记录一次服务端不可用时降级为直连的连接。内部 API
+func (ts *TrafficStats) RecordFallback() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.fallbackConnections++
+}
+
+// GetFallbackConnections 获取降级为直连的连接数
+func (ts *TrafficStats) GetFallbackConnections() int64 {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.fallbackConnections
+}
+
 // GetSiteStats 获取单个站点统计
 func (ts *TrafficStats) GetSiteStats(host string) *SiteStats {
 	ts.mu.RLock()
@@ -114,7 +256,11 @@ func (ts *TrafficStats) GetSiteStats(host string) *SiteStats {
 func (ts *TrafficStats) GetAllStats() []*SiteStats {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
+	return ts.allStatsLocked()
+}
 
+// allStatsLocked 返回各站点统计的副本，调用方需持有 ts.mu
+func (ts *TrafficStats) allStatsLocked() []*SiteStats {
 	result := make([]*SiteStats, 0, len(ts.sites))
 	for _, stats := range ts.sites {
 		result = append(result, &SiteStats{
@@ -129,18 +275,56 @@ func (ts *TrafficStats) GetAllStats() []*SiteStats {
 	return result
 }
 
+// GetOtherStats 获取未单独列出的站点合计：因超过 StatsMaxSites 被淘汰的站点，以及重启前流量低于 10KB、
+// 未单独保存的站点。GetAllStats 的各站点与之相加等于 GetTotalStats
+func (ts *TrafficStats) GetOtherStats() SiteStats {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.other
+}
+
 // GetTopSites 获取流量最大的 N 个站点
 func (ts *TrafficStats) GetTopSites(n int) []*SiteStats {
 	all := ts.GetAllStats()
-	sort.Slice(all, func(i, j int) bool {
-		return (all[i].Upload + all[i].Download) > (all[j].Upload + all[j].Download)
-	})
+	sortSitesByTraffic(all)
 	if n > len(all) {
 		n = len(all)
 	}
 	return all[:n]
 }
 
+// SiteBreakdown 同一时刻的总流量和站点明细，Top 与 Rest 相加等于 TotalUpload/TotalDownload
+type SiteBreakdown struct {
+	Top           []*SiteStats // 流量最大的若干站点，按流量降序
+	Rest          SiteStats    // 未在 Top 中列出的站点与 GetOtherStats 的合计，Host 为空
+	TotalUpload   int64
+	TotalDownload int64
+}
+
+// GetSiteBreakdown 在同一时刻读取总流量和流量最大的 n 个站点，其余流量计入 Rest，
+// 供同时显示总流量和站点排行的界面使用，分别调用 GetTopSites 和 GetTotalStats 时两者之间的流量会对不上
+func (ts *TrafficStats) GetSiteBreakdown(n int) SiteBreakdown {
+	ts.mu.RLock()
+	all := ts.allStatsLocked()
+	b := SiteBreakdown{Rest: ts.other, TotalUpload: ts.totalUpload, TotalDownload: ts.totalDownload}
+	ts.mu.RUnlock()
+
+	sortSitesByTraffic(all)
+	n = max(min(n, len(all)), 0)
+	b.Top = all[:n]
+	for _, st := range all[n:] {
+		b.Rest.add(st)
+	}
+	return b
+}
+
+// sortSitesByTraffic 按上传加下载的流量降序排列
+func sortSitesByTraffic(sites []*SiteStats) {
+	sort.Slice(sites, func(i, j int) bool {
+		return (sites[i].Upload + sites[i].Download) > (sites[j].Upload + sites[j].Download)
+	})
+}
+
 // GetTotalStats 获取总流量统计
 func (ts *TrafficStats) GetTotalStats() (upload, download int64) {
 	ts.mu.RLock()
@@ -177,33 +361,42 @@ func (ts *TrafficStats) Reset() {
 	defer ts.mu.Unlock()
 
 	ts.sites = make(map[string]*SiteStats)
+	ts.other = SiteStats{}
+	ts.servers = make(map[string]*ServerTraffic)
 	ts.totalUpload = 0
 	ts.totalDownload = 0
+	ts.fallbackConnections = 0
 }
 
 // 最小保存流量阈值 (10KB)
 const minSaveThreshold = 10 * 1024
 
-// Save 保存统计数据到文件
+// Save 保存统计数据到文件。小流量站点不单独保存，计入 other，加载后总流量仍等于各项之和
 func (ts *TrafficStats) Save() error {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 
-	// 过滤小流量站点
 	filteredSites := make(map[string]*SiteStats)
+	other := ts.other
 	for host, stats := range ts.sites {
 		if stats.Upload+stats.Download >= minSaveThreshold {
 			filteredSites[host] = stats
+		} else {
+			other.add(stats)
 		}
 	}
 
 	data := struct {
-		Sites         map[string]*SiteStats `json:"sites"`
-		TotalUpload   int64                 `json:"total_upload"`
-		TotalDownload int64                 `json:"total_download"`
-		SavedAt       time.Time             `json:"saved_at"`
+		Sites         map[string]*SiteStats     `json:"sites"`
+		Other         SiteStats                 `json:"other_sites"`
+		Servers       map[string]*ServerTraffic `json:"servers,omitempty"`
+		TotalUpload   int64                     `json:"total_upload"`
+		TotalDownload int64                     `json:"total_download"`
+		SavedAt       time.Time                 `json:"saved_at"`
 	}{
 		Sites:         filteredSites,
+		Other:         other,
+		Servers:       ts.servers,
 		TotalUpload:   ts.totalUpload,
 		TotalDownload: ts.totalDownload,
 		SavedAt:       time.Now(),
@@ -215,12 +408,37 @@ func (ts *TrafficStats) Save() error {
 	}
 
 	filePath := filepath.Join(ts.storeDir, "traffic_stats.json")
-	if err := os.WriteFile(filePath, jsonData, 0644); err != nil {
+	if err := writeFileAtomic(filePath, jsonData); err != nil {
 		return fmt.Errorf("保存统计数据失败: %w", err)
 	}
 	return nil
 }
 
+// writeFileAtomic 先写入同目录下的临时文件并同步到磁盘，再替换 path，写入中途退出不会留下不完整的文件。
+// 每次使用不同的临时文件，定期保存和停止时的保存可以同时进行
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 // load 从文件加载统计数据
 func (ts *TrafficStats) load() {
 	filePath := filepath.Join(ts.storeDir, "traffic_stats.json")
@@ -230,18 +448,35 @@ func (ts *TrafficStats) load() {
 	}
 
 	var saved struct {
-		Sites         map[string]*SiteStats `json:"sites"`
-		TotalUpload   int64                 `json:"total_upload"`
-		TotalDownload int64                 `json:"total_download"`
+		Sites         map[string]*SiteStats     `json:"sites"`
+		Other         SiteStats                 `json:"other_sites"`
+		Servers       map[string]*ServerTraffic `json:"servers"`
+		TotalUpload   int64                     `json:"total_upload"`
+		TotalDownload int64                     `json:"total_download"`
 	}
 
 	if err := json.Unmarshal(data, &saved); err != nil {
 		return
 	}
 
-	ts.sites = saved.Sites
-	ts.totalUpload = saved.TotalUpload
-	ts.totalDownload = saved.TotalDownload
+	if saved.Sites != nil {
+		ts.sites = saved.Sites
+	}
+	if saved.Servers != nil {
+		ts.servers = saved.Servers
+	}
+	// 按文件中的站点重新计算 other：旧版本的文件没有 other_sites，丢弃的小流量站点只计入了总流量
+	var upload, download int64
+	for _, stats := range ts.sites {
+		upload += stats.Upload
+		download += stats.Download
+	}
+	ts.other = saved.Other
+	ts.other.Host = ""
+	ts.other.Upload = max(saved.TotalUpload-upload, 0)
+	ts.other.Download = max(saved.TotalDownload-download, 0)
+	ts.totalUpload = upload + ts.other.Upload
+	ts.totalDownload = download + ts.other.Download
 }
 
 // FormatBytes 格式化字节数为可读字符串
@@ -278,6 +513,17 @@ func (ts *TrafficStats) PrintStats() string {
 	fmt.Fprintf(&sb, "总下载: %s\n", FormatBytes(download))
 	fmt.Fprintf(&sb, "总流量: %s\n", FormatBytes(upload+download))
 	fmt.Fprintf(&sb, "站点数: %d\n", len(ts.sites))
+	if fallback := ts.GetFallbackConnections(); fallback > 0 {
+		fmt.Fprintf(&sb, "降级直连: %d 次\n", fallback)
+	}
+
+	if servers := ts.GetServerStats(); len(servers) > 1 {
+		sb.WriteString("\n--- 服务端 ---\n")
+		for _, st := range servers {
+			fmt.Fprintf(&sb, "%s\n   ↑ %s  ↓ %s  隧道: %d\n",
+				st.Server, FormatBytes(st.Upload), FormatBytes(st.Download), st.Connections)
+		}
+	}
 
 	if len(topSites) > 0 {
 		fmt.Fprintf(&sb, "\n--- Top %d 站点 ---\n", len(topSites))
@@ -289,6 +535,10 @@ func (ts *TrafficStats) PrintStats() string {
 				FormatBytes(total), site.Connections)
 		}
 	}
+	if other := ts.GetOtherStats(); other.Upload+other.Download > 0 {
+		fmt.Fprintf(&sb, "其他站点 (小流量或已淘汰): ↑ %s  ↓ %s  连接: %d\n",
+			FormatBytes(other.Upload), FormatBytes(other.Download), other.Connections)
+	}
 	sb.WriteString("==============================\n")
 	return sb.String()
 }
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTrafficStatsReconcile 低于保存阈值的站点和被淘汰的站点计入 GetOtherStats，
+// 保存并重新加载后各站点与其他站点之和仍等于总流量；旧版本的文件按总流量补齐其他站点
+func TestTrafficStatsReconcile(t *testing.T) {
+	reconciled := func(t *testing.T, ts *TrafficStats) (upload, download int64) {
+		t.Helper()
+		other := ts.GetOtherStats()
+		upload, download = other.Upload, other.Download
+		for _, site := range ts.GetAllStats() {
+			upload += site.Upload
+			download += site.Download
+		}
+		if totalUp, totalDown := ts.GetTotalStats(); upload != totalUp || download != totalDown {
+			t.Fatalf("sites + other = %d/%d, totals = %d/%d", upload, download, totalUp, totalDown)
+		}
+		return upload, download
+	}
+
+	dir := t.TempDir()
+	ts := NewTrafficStats(dir)
+	ts.RecordConnection("big.echplus.test")
+	ts.RecordUpload("big.echplus.test", 8<<10)
+	ts.RecordDownload("big.echplus.test", 24<<10)
+	ts.RecordConnection("small.echplus.test")
+	ts.RecordConnection("small.echplus.test")
+	ts.RecordUpload("small.echplus.test", 100)
+	ts.RecordDownload("small.echplus.test", 300)
+	// 站点已被淘汰后仍在传输的连接
+	ts.RecordDownload("evicted.echplus.test", 50)
+	wantUp, wantDown := reconciled(t, ts)
+	if err := ts.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewTrafficStats(dir)
+	if up, down := reconciled(t, loaded); up != wantUp || down != wantDown {
+		t.Fatalf("totals after reload = %d/%d, want %d/%d", up, down, wantUp, wantDown)
+	}
+	if loaded.GetSiteStats("small.echplus.test") != nil || loaded.GetSiteStats("big.echplus.test") == nil {
+		t.Fatalf("sites after reload = %+v, want only the site above the save threshold", loaded.GetAllStats())
+	}
+	if other := loaded.GetOtherStats(); other.Upload != 100 || other.Download != 350 || other.Connections != 2 {
+		t.Fatalf("other sites after reload = %+v, want the small site and the evicted download", other)
+	}
+
+	t.Run("breakdown", func(t *testing.T) {
+		loaded.RecordConnection("medium.echplus.test")
+		loaded.RecordUpload("medium.echplus.test", 1000)
+		for _, n := range []int{0, 1, 10} {
+			b := loaded.GetSiteBreakdown(n)
+			up, down := b.Rest.Upload, b.Rest.Download
+			for _, site := range b.Top {
+				up += site.Upload
+				down += site.Download
+			}
+			if totalUp, totalDown := loaded.GetTotalStats(); up != b.TotalUpload || down != b.TotalDownload || up != totalUp || down != totalDown {
+				t.Fatalf("GetSiteBreakdown(%d): top + rest = %d/%d, breakdown totals = %d/%d, totals = %d/%d",
+					n, up, down, b.TotalUpload, b.TotalDownload, totalUp, totalDown)
+			}
+			if want := min(n, 2); len(b.Top) != want {
+				t.Fatalf("GetSiteBreakdown(%d) top = %d sites, want %d", n, len(b.Top), want)
+			}
+		}
+		b := loaded.GetSiteBreakdown(1)
+		if b.Top[0].Host != "big.echplus.test" || b.Rest.Host != "" || b.Rest.Upload != 1100 || b.Rest.Connections != 3 {
+			t.Fatalf("GetSiteBreakdown(1) = %+v / %+v, want the biggest site and the rest including reloaded small sites", b.Top[0], b.Rest)
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		cfg := testConfig(t)
+		cfg.StatsMaxSites = 2
+		ts := startTestServer(t, cfg).GetTrafficStats()
+		for i := range 3 {
+			host := fmt.Sprintf("site%d.echplus.test", i)
+			ts.RecordConnection(host)
+			ts.RecordUpload(host, int64(i+1))
+		}
+		if ts.SiteCount() != 2 {
+			t.Fatalf("sites = %d, want eviction down to the limit", ts.SiteCount())
+		}
+		reconciled(t, ts)
+		if other := ts.GetOtherStats(); other.Connections == 0 {
+			t.Fatalf("other sites = %+v, want the evicted site", other)
+		}
+	})
+
+	t.Run("legacy file", func(t *testing.T) {
+		dir := t.TempDir()
+		legacy := `{"sites": {"big.echplus.test": {"host": "big.echplus.test", "upload": 20480, "download": 40960, "connections": 1}},
+			"total_upload": 30000, "total_download": 50000}`
+		if err := os.WriteFile(filepath.Join(dir, "traffic_stats.json"), []byte(legacy), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ts := NewTrafficStats(dir)
+		if up, down := reconciled(t, ts); up != 30000 || down != 50000 {
+			t.Fatalf("totals = %d/%d, want the saved totals", up, down)
+		}
+		if other := ts.GetOtherStats(); other.Upload != 30000-20480 || other.Download != 50000-40960 {
+			t.Fatalf("other sites = %+v, want the difference to the saved totals", other)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrTokenRejected 服务端拒绝了 UpdateToken 的新令牌，令牌未修改
+var ErrTokenRejected = errors.New("服务端拒绝了新令牌")
+
+// UpdateToken 在不重启、不中断已建立隧道的情况下更换连接服务端的令牌。
+// 运行中时先用新令牌向当前服务端建立一次 WebSocket 验证，成功后才替换配置中的 Token，之后建立的隧道使用新令牌，
+// 已建立的隧道继续使用建立时的连接直到关闭。验证失败时保留原令牌并返回错误，服务端拒绝新令牌（401）时错误包装 ErrTokenRejected，
+// 验证结果不计入上游健康状态。所有服务端共用同一令牌，只验证当前服务端。
+// 未运行时仅保存令牌，正在启动或停止时等待其完成
+func (s *ProxyServer) UpdateToken(token string) error {
+	if err := validToken(token); err != nil {
+		return err
+	}
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	s.mu.Lock()
+	if s.state != lifecycleRunning {
+		s.config.Token = token
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	server := s.currentServer()
+	if err := s.probeToken(server, token); err != nil {
+		if upstreamFailureClass(err) == UpstreamFailureUnauthorized {
+			return fmt.Errorf("%w (%s): %v", ErrTokenRejected, server, err)
+		}
+		return fmt.Errorf("验证新令牌失败 (%s): %w", server, err)
+	}
+
+	s.mu.Lock()
+	s.config.Token = token
+	s.mu.Unlock()
+	LogInfo("[代理] 已更换令牌，之后建立的隧道使用新令牌")
+	return nil
+}
+
+// probeToken 以 token 向 server 建立 WebSocket 后立即关闭，与健康检查不同，结果不计入上游健康状态
+func (s *ProxyServer) probeToken(server, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout()+s.tlsHandshakeTimeout())
+	defer cancel()
+	wsConn, _, err := s.dialWebSocketToken(ctx, server, "", token)
+	if err != nil {
+		return err
+	}
+	wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return wsConn.Close()
+}
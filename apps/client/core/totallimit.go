@@ -0,0 +1,135 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// totalRateLimit 所有连接共享的总带宽限制。
+// 令牌桶按到达顺序预留令牌，每个连接每次最多预留一个读缓冲区大小的流量，
+// 等待完成后才能再次预留，因此持续传输的连接与其他连接按块轮流获得带宽，不会饿死其他连接
+type totalRateLimit struct {
+	bucket       *tokenBucket
+	rate         int64
+	exemptDirect bool
+	passed       atomic.Int64 // 通过限速的累计字节数
+
+	mu         sync.Mutex
+	lastPassed int64
+	lastTime   time.Time
+	current    int64 // bytes/s
+}
+
+// newTotalRateLimit 创建总带宽限制，速率不变时沿用 prev 的令牌桶。rate 小于 1 时返回 nil
+func newTotalRateLimit(rate int64, exemptDirect bool, prev *totalRateLimit) *totalRateLimit {
+	if rate < 1 {
+		return nil
+	}
+	l := &totalRateLimit{rate: rate, exemptDirect: exemptDirect, lastTime: time.Now()}
+	if prev != nil && prev.rate == rate {
+		l.bucket = prev.bucket
+	} else {
+		l.bucket = newTokenBucket(rate)
+	}
+	return l
+}
+
+// wait 等待 n 字节的令牌，direct 为直连流量；done 关闭时返回 false
+func (l *totalRateLimit) wait(n int, direct bool, done <-chan struct{}) bool {
+	if l == nil || (direct && l.exemptDirect) {
+		return true
+	}
+	if !l.bucket.wait(n, done) {
+		return false
+	}
+	l.passed.Add(int64(n))
+	return true
+}
+
+// TotalRateLimitStatus 总带宽限制状态
+type TotalRateLimitStatus struct {
+	Limit       int64   `json:"limit"`       // bytes/s，0 表示不限速
+	CurrentRate int64   `json:"currentRate"` // 受限流量的实时速率 bytes/s
+	Utilization float64 `json:"utilization"` // CurrentRate / Limit，0~1
+}
+
+// status 计算当前速率，采样间隔不足 1 秒时返回上次的结果
+func (l *totalRateLimit) status() TotalRateLimitStatus {
+	if l == nil {
+		return TotalRateLimitStatus{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(l.lastTime).Seconds(); elapsed >= 1.0 {
+		passed := l.passed.Load()
+		l.current = int64(float64(passed-l.lastPassed) / elapsed)
+		l.lastPassed = passed
+		l.lastTime = now
+	}
+	utilization := float64(l.current) / float64(l.rate)
+	if utilization > 1 {
+		utilization = 1
+	}
+	return TotalRateLimitStatus{Limit: l.rate, CurrentRate: l.current, Utilization: utilization}
+}
+
+// GetTotalRateLimitStatus 获取总带宽限制及当前利用率
+func (s *ProxyServer) GetTotalRateLimitStatus() TotalRateLimitStatus {
+	return s.totalLimit.Load().status()
+}
+
+// waitRateLimits 依次按目标主机 upload 方向的限速和总带宽限制等待 n 字节的令牌，done 关闭时返回 false。
+// 每次都读取当前规则，Reload 修改限速后对已建立的连接同样生效
+func (s *ProxyServer) waitRateLimits(host string, direct, upload bool, n int, done <-chan struct{}) bool {
+	if !s.hostLimits.Load().bucket(host, upload).wait(n, done) {
+		return false
+	}
+	return s.totalLimit.Load().wait(n, direct, done)
+}
+
+// rateUnits 带宽单位，比特单位按 1000 进制，字节单位与 FormatBytes 一致按 1024 进制
+var rateUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"gbps", 1e9 / 8},
+	{"mbps", 1e6 / 8},
+	{"kbps", 1e3 / 8},
+	{"bps", 1.0 / 8},
+	{"gb/s", 1 << 30},
+	{"mb/s", 1 << 20},
+	{"kb/s", 1 << 10},
+	{"b/s", 1},
+}
+
+// ParseRate 解析带宽字符串，返回 bytes/s。
+// 支持 5mbps、500kbps 等比特单位和 2MB/s、512KB/s 等字节单位（不区分大小写），
+// 不带单位时按 bytes/s 处理，0 表示不限速。负数、inf、nan 和超出 int64 的值返回错误
+func ParseRate(s string) (int64, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	factor := 1.0
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	// ParseFloat 接受 inf 和 nan，均不是有效的带宽
+	if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("无效的带宽: %q", s)
+	}
+	rate := value * factor
+	if rate >= math.MaxInt64 {
+		return 0, fmt.Errorf("带宽超出范围: %q", s)
+	}
+	return int64(rate), nil
+}
@@ -0,0 +1,44 @@
+package core
+
+import "testing"
+
+// TestParseRate 比特单位按 1000 进制、字节单位按 1024 进制换算为 bytes/s，拒绝负数、非有限值和超出 int64 的值
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "5mbps", want: 625000},
+		{in: "2MB/s", want: 2 << 20},
+		{in: "0", want: 0},
+		{in: "1024", want: 1024},
+		{in: " 500 Kbps ", want: 62500},
+		{in: "1.5kb/s", want: 1536},
+		{in: "1gbps", want: 125000000},
+		{in: "", wantErr: true},
+		{in: "fast", wantErr: true},
+		{in: "mbps", wantErr: true},
+		{in: "5 mbit", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "inf", wantErr: true},
+		{in: "+Inf", wantErr: true},
+		{in: "infinity", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "nanmbps", wantErr: true},
+		{in: "1e30", wantErr: true},
+		{in: "9223372036854775807", wantErr: true}, // 转为 float64 后等于 2^63，超出 int64
+		{in: "1e11gb/s", wantErr: true},
+	} {
+		got, err := ParseRate(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseRate(%q) = %d, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+}
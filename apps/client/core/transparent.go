@@ -0,0 +1,31 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errTransparentUnsupported 当前平台无法读取重定向前的目标地址
+var errTransparentUnsupported = errors.New("当前平台不支持透明代理（仅支持 Linux）")
+
+// handleTransparent 处理透明代理连接：读取 iptables REDIRECT 重定向前的目标地址，作为 CONNECT 目标建立隧道。
+// 客户端不知道自己经过了代理，出错时直接关闭连接
+func (s *ProxyServer) handleTransparent(ctx context.Context, conn net.Conn, clientAddr string) {
+	target, err := originalDst(conn)
+	if err != nil {
+		logConnError(ctx, "[透明代理] %s 获取原始目标地址失败: %v", clientAddr, err)
+		return
+	}
+	// 未经重定向直接连到监听地址时，原始目标即监听地址本身，转发会连回自己
+	if target == conn.LocalAddr().String() {
+		logConnError(ctx, "[透明代理] %s 直接连接了监听地址 %s，连接未经重定向", clientAddr, target)
+		return
+	}
+	logConnInfo(ctx, "[透明代理] %s -> %s", clientAddr, target)
+	if err := s.handleTunnel(ctx, conn, target, clientAddr, modeTransparent, ""); err != nil {
+		if !isNormalCloseError(err) {
+			logConnError(ctx, "[透明代理] %s 代理失败: %v", clientAddr, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+//go:build linux
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// transparentSupported Linux 通过 netfilter 的 SO_ORIGINAL_DST 读取重定向前的目标地址
+const transparentSupported = true
+
+// soOriginalDst SO_ORIGINAL_DST (linux/netfilter_ipv4.h)，IPv6 的 IP6T_SO_ORIGINAL_DST 取值相同
+const soOriginalDst = 80
+
+// originalDst 读取被 iptables REDIRECT/DNAT 重定向的连接的原始目标地址，格式为 host:port。
+// 依赖连接跟踪 (nf_conntrack)，未经重定向的连接返回监听地址本身，或在未加载连接跟踪时返回错误
+func originalDst(conn net.Conn) (string, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return "", fmt.Errorf("不支持的连接类型 %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	ipv4 := local == nil || local.IP.To4() != nil
+
+	var sa []byte
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// getsockopt 按值回填 sockaddr，这里借用大小足够的结构体接收：
+		// IPv6Mreq 20 字节容纳 sockaddr_in，IPv6MTUInfo 以 sockaddr_in6 开头
+		if ipv4 {
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); sockErr == nil {
+				sa = mreq.Multiaddr[:]
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); sockErr == nil {
+			sa = unsafe.Slice((*byte)(unsafe.Pointer(&info.Addr)), unsafe.Sizeof(info.Addr))
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOPROTOOPT) {
+			return "", fmt.Errorf("没有连接跟踪记录，连接未经 iptables 重定向或未加载 nf_conntrack: %w", err)
+		}
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", err)
+	}
+	return parseOriginalDst(sa)
+}
+
+// parseOriginalDst 解析 SO_ORIGINAL_DST 返回的 sockaddr_in 或 sockaddr_in6：
+// 地址族为本机字节序，端口和地址为网络字节序。IPv4 映射的 IPv6 地址按 IPv4 返回
+func parseOriginalDst(sa []byte) (string, error) {
+	if len(sa) < 2 {
+		return "", errors.New("原始目标地址过短")
+	}
+	var addr netip.Addr
+	switch family := binary.NativeEndian.Uint16(sa); family {
+	case syscall.AF_INET:
+		// family(2) port(2) addr(4)
+		if len(sa) < 8 {
+			return "", errors.New("原始目标地址过短")
+		}
+		addr = netip.AddrFrom4([4]byte(sa[4:8]))
+	case syscall.AF_INET6:
+		// family(2) port(2) flowinfo(4) addr(16) scope_id(4)
+		if len(sa) < 24 {
+			return "", errors.New("原始目标地址过短")
+		}
+		addr = netip.AddrFrom16([16]byte(sa[8:24])).Unmap()
+	default:
+		return "", fmt.Errorf("未知的地址族 %d", family)
+	}
+	port := binary.BigEndian.Uint16(sa[2:4])
+	if port == 0 || addr.IsUnspecified() {
+		return "", fmt.Errorf("无效的原始目标地址 %s", netip.AddrPortFrom(addr, port))
+	}
+	return netip.AddrPortFrom(addr, port).String(), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package core
+
+import "net"
+
+// transparentSupported 透明代理依赖 Linux netfilter 的 SO_ORIGINAL_DST
+const transparentSupported = false
+
+func originalDst(net.Conn) (string, error) {
+	return "", errTransparentUnsupported
+}
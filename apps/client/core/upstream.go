@@ -0,0 +1,289 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamHeaderKeys 升级响应中保留的边缘诊断头部
+var upstreamHeaderKeys = []string{"CF-Ray", "Cf-Cache-Status", "Server", "Date", "X-Session-ID", "Sec-WebSocket-Extensions"}
+
+// UpstreamStatus 上游服务端状态。ServerAddr 配置了多个服务端时，LastDialAt 至 Misconfigured
+// 描述当前使用的服务端，各服务端的状态见 Servers
+type UpstreamStatus struct {
+	ServerAddr    string            `json:"serverAddr"`    // 当前使用的服务端：最近一次连接成功的地址，尚未成功时为第一个
+	LastDialAt    time.Time         `json:"lastDialAt"`    // 最近一次建立 WebSocket 的时间
+	LastError     string            `json:"lastError"`     // 最近一次建立失败的原因，成功后清空
+	LastErrorCode string            `json:"lastErrorCode"` // 可识别的失败原因，见 UpstreamError* 常量
+	FailureClass  string            `json:"failureClass"`  // 最近一次建立失败的分类，见 UpstreamFailure* 常量，成功后清空
+	Penalty       int               `json:"penalty"`       // 健康扣分，计入扣分的失败各加 1，成功后清零
+	Misconfigured bool              `json:"misconfigured"` // 服务端拒绝了令牌，修改 ServerAddr、Token 或重新启动前不再连接
+	Colo          string            `json:"colo"`          // 从 CF-Ray 解析出的 Cloudflare 机房
+	Headers       map[string]string `json:"headers"`       // 最近一次成功升级的诊断头部
+	Servers       []ServerHealth    `json:"servers"`       // 按配置顺序排列的各服务端状态
+}
+
+// ServerHealth 单个服务端的健康状态，各字段含义同 UpstreamStatus
+type ServerHealth struct {
+	Addr          string    `json:"addr"`
+	LastDialAt    time.Time `json:"lastDialAt"`
+	LastError     string    `json:"lastError"`
+	LastErrorCode string    `json:"lastErrorCode"`
+	FailureClass  string    `json:"failureClass"`
+	Penalty       int       `json:"penalty"`
+	Misconfigured bool      `json:"misconfigured"`
+	// Latency 最近几次成功建立 WebSocket 的平滑耗时，尚未成功时为 0，用于 BalanceLatency
+	Latency time.Duration `json:"latency"`
+}
+
+// serverHealth 记录的服务端状态，rejectedToken 为被拒绝的令牌，Token 变化后不再视为配置错误
+type serverHealth struct {
+	ServerHealth
+	rejected      bool
+	rejectedToken string
+}
+
+func (h *serverHealth) misconfigured(token string) bool {
+	return h.rejected && h.rejectedToken == token
+}
+
+// UpstreamStatus.LastErrorCode 的取值
+const (
+	UpstreamErrorPinMismatch = "pin_mismatch" // 证书公钥与 PinnedSPKI 不匹配，见 ErrPinMismatch
+)
+
+// upstreamErrorCode 返回可识别的上游连接失败原因
+func upstreamErrorCode(err error) string {
+	if errors.Is(err, ErrPinMismatch) {
+		return UpstreamErrorPinMismatch
+	}
+	return ""
+}
+
+// UpstreamStatus.FailureClass 的取值，决定一次失败对上游健康的影响
+const (
+	// UpstreamFailureECHRejected 服务端拒绝 ECH，多为密钥已轮换：刷新 ECH 配置后立即重试一次，
+	// 不占用重试次数，不扣分
+	UpstreamFailureECHRejected = "ech_rejected"
+	// UpstreamFailureUnauthorized 升级请求返回 401，令牌被拒绝：标记为配置错误，不扣分，
+	// 配置修改前不再连接（见 ErrUpstreamMisconfigured）
+	UpstreamFailureUnauthorized = "unauthorized"
+	// UpstreamFailureTLS 证书校验、公钥固定、TLS 警报等握手失败，不重试，扣分
+	UpstreamFailureTLS = "tls"
+	// UpstreamFailureHTTPStatus 升级请求返回 401 以外的错误状态码，5xx、429、408 按退避重试，扣分
+	UpstreamFailureHTTPStatus = "http_status"
+	// UpstreamFailureNetwork DNS、连接被拒绝、超时等网络错误，按退避重试，扣分
+	UpstreamFailureNetwork = "network"
+	// UpstreamFailureOther 其他失败，扣分
+	UpstreamFailureOther = "other"
+)
+
+// ErrUpstreamMisconfigured 所有服务端都曾拒绝当前令牌，修改 ServerAddr、Token 或重新启动前不再连接
+var ErrUpstreamMisconfigured = errors.New("服务端拒绝了令牌，修改 Token 或服务器地址后才会重新连接")
+
+// upgradeStatusError WebSocket 升级请求被拒绝，保留状态码用于分类
+type upgradeStatusError struct {
+	err    error
+	status int
+}
+
+func (e *upgradeStatusError) Error() string { return fmt.Sprintf("%v (HTTP %d)", e.err, e.status) }
+func (e *upgradeStatusError) Unwrap() error { return e.err }
+
+// isECHRejection 判断错误是否为服务端拒绝 ECH 或 ECH 配置不可用
+func isECHRejection(err error) bool {
+	var echErr *tls.ECHRejectionError
+	return errors.As(err, &echErr) || strings.Contains(err.Error(), "ECH")
+}
+
+// upstreamFailureClass 返回建立 WebSocket 失败的分类，err 为 nil 时返回空字符串
+func upstreamFailureClass(err error) string {
+	var (
+		statusErr  *upgradeStatusError
+		verifyErr  *tls.CertificateVerificationError
+		alertErr   tls.AlertError
+		recordErr  tls.RecordHeaderError
+		unknownCA  x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		netErr     net.Error
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &statusErr):
+		if statusErr.status == http.StatusUnauthorized {
+			return UpstreamFailureUnauthorized
+		}
+		return UpstreamFailureHTTPStatus
+	case isECHRejection(err):
+		return UpstreamFailureECHRejected
+	case errors.Is(err, ErrPinMismatch),
+		errors.As(err, &verifyErr),
+		errors.As(err, &alertErr),
+		errors.As(err, &recordErr),
+		errors.As(err, &unknownCA),
+		errors.As(err, &hostErr),
+		errors.As(err, &invalidErr):
+		return UpstreamFailureTLS
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return UpstreamFailureNetwork
+	}
+	return UpstreamFailureOther
+}
+
+// UpstreamErrorHandler 接收可识别原因的上游连接失败，code 为 UpstreamError* 常量
+type UpstreamErrorHandler func(code string, err error)
+
+var upstreamErrorHandler atomic.Pointer[UpstreamErrorHandler]
+
+// SetUpstreamErrorHandler 设置上游连接失败的处理函数，每次可识别原因的失败调用一次，nil 表示不通知
+func SetUpstreamErrorHandler(handler UpstreamErrorHandler) {
+	if handler == nil {
+		upstreamErrorHandler.Store(nil)
+		return
+	}
+	upstreamErrorHandler.Store(&handler)
+}
+
+// captureUpstreamHeaders 从升级响应中提取诊断头部
+func captureUpstreamHeaders(resp *http.Response) map[string]string {
+	headers := make(map[string]string)
+	if resp == nil {
+		return headers
+	}
+	for _, key := range upstreamHeaderKeys {
+		if v := resp.Header.Get(key); v != "" {
+			headers[key] = v
+		}
+	}
+	return headers
+}
+
+// coloFromRay 解析 CF-Ray 中的机房代码，如 "8a1b2c3d4e5f6789-SJC" -> "SJC"
+func coloFromRay(ray string) string {
+	if idx := strings.LastIndex(ray, "-"); idx >= 0 && idx+1 < len(ray) {
+		return ray[idx+1:]
+	}
+	return ""
+}
+
+// upstreamTag 生成日志中附带的上游标识，便于与服务端日志关联
+func upstreamTag(headers map[string]string) string {
+	var parts []string
+	if ray := headers["CF-Ray"]; ray != "" {
+		parts = append(parts, "CF-Ray: "+ray)
+	}
+	if id := headers["X-Session-ID"]; id != "" {
+		parts = append(parts, "会话: "+id)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// recordUpstreamDial 记录一次到 server 的连接结果并按失败分类更新其健康扣分，elapsed 为建立耗时，
+// 成功时将其计入平滑耗时并设为当前服务端；失败原因可识别时通知 UpstreamErrorHandler
+func (s *ProxyServer) recordUpstreamDial(server string, headers map[string]string, elapsed time.Duration, err error) {
+	code := upstreamErrorCode(err)
+	class := upstreamFailureClass(err)
+	token := s.GetConfig().Token
+	s.upstreamMu.Lock()
+	h := s.upstreamHealth[server]
+	if h == nil {
+		h = &serverHealth{ServerHealth: ServerHealth{Addr: server}}
+		if s.upstreamHealth == nil {
+			s.upstreamHealth = make(map[string]*serverHealth)
+		}
+		s.upstreamHealth[server] = h
+	}
+	h.LastDialAt = time.Now()
+	h.LastErrorCode = code
+	h.FailureClass = class
+	switch class {
+	case "":
+		h.Penalty = 0
+	case UpstreamFailureECHRejected:
+	case UpstreamFailureUnauthorized:
+		h.rejected, h.rejectedToken = true, token
+	default:
+		h.Penalty++
+	}
+	switched := false
+	if err != nil {
+		h.LastError = err.Error()
+	} else {
+		h.LastError = ""
+		if h.Latency == 0 {
+			h.Latency = elapsed
+		} else {
+			h.Latency = (h.Latency*(4-latencyWeight) + elapsed*latencyWeight) / 4
+		}
+		s.upstreamHeaders = headers
+		switched = s.upstreamCurrent != "" && s.upstreamCurrent != server
+		s.upstreamCurrent = server
+	}
+	s.upstreamMu.Unlock()
+
+	if switched {
+		LogInfo("[代理] 已切换到服务端 %s", server)
+	}
+	if class == UpstreamFailureUnauthorized {
+		LogError("[代理] 服务端 %s 拒绝了令牌，修改 Token 或服务器地址前不再连接: %v", server, err)
+	}
+	if code == UpstreamErrorPinMismatch {
+		LogError("[安全] 服务端证书未通过公钥固定校验，可能遭到中间人攻击: %v", err)
+	}
+	if h := upstreamErrorHandler.Load(); h != nil && code != "" {
+		(*h)(code, err)
+	}
+}
+
+// resetUpstreamHealth 清空各服务端的健康状态、当前服务端和健康检查结果，启动时及 Reload 修改服务端列表时调用
+func (s *ProxyServer) resetUpstreamHealth() {
+	s.upstreamMu.Lock()
+	s.upstreamHealth = nil
+	s.upstreamCurrent = ""
+	s.health = Health{Healthy: true}
+	s.upstreamMu.Unlock()
+}
+
+// GetUpstreamStatus 获取上游服务端状态
+func (s *ProxyServer) GetUpstreamStatus() UpstreamStatus {
+	cfg := s.GetConfig()
+	servers := serverAddrs(cfg.ServerAddr)
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+	status := UpstreamStatus{
+		ServerAddr: s.currentServerLocked(servers),
+		Colo:       coloFromRay(s.upstreamHeaders["CF-Ray"]),
+		Headers:    maps.Clone(s.upstreamHeaders),
+		Servers:    make([]ServerHealth, 0, len(servers)),
+	}
+	if status.Headers == nil {
+		status.Headers = map[string]string{}
+	}
+	for _, addr := range servers {
+		health := ServerHealth{Addr: addr}
+		if h := s.upstreamHealth[addr]; h != nil {
+			health = h.ServerHealth
+			health.Misconfigured = h.misconfigured(cfg.Token)
+		}
+		status.Servers = append(status.Servers, health)
+		if addr == status.ServerAddr {
+			status.LastDialAt, status.LastError, status.LastErrorCode = health.LastDialAt, health.LastError, health.LastErrorCode
+			status.FailureClass, status.Penalty, status.Misconfigured = health.FailureClass, health.Penalty, health.Misconfigured
+		}
+	}
+	return status
+}
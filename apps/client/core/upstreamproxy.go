@@ -0,0 +1,253 @@
+package core
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamProxyNone 作为 Config.UpstreamProxy 时总是直接连接，不使用环境变量中的代理
+const UpstreamProxyNone = "direct"
+
+// upstreamProxy 解析后的 Config.UpstreamProxy
+type upstreamProxy struct {
+	scheme string // "http" 或 "socks5"
+	addr   string // 代理的 host:port
+	user   *url.Userinfo
+}
+
+// parseUpstreamProxy 解析 UpstreamProxy，格式为 http://[用户名:密码@]主机:端口 或 socks5://[用户名:密码@]主机:端口，
+// 省略端口时 http 使用 80、socks5 使用 1080；raw 为空或 UpstreamProxyNone 时返回 nil
+func parseUpstreamProxy(raw string) (*upstreamProxy, error) {
+	if raw == "" || raw == UpstreamProxyNone {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("无效的上游代理: %w", err)
+	}
+	var defaultPort string
+	switch u.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("无效的上游代理 %q: 只支持 http:// 和 socks5://", raw)
+	}
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("无效的上游代理 %q: 格式应为 %s://[用户名:密码@]主机:端口", raw, u.Scheme)
+	}
+	p := &upstreamProxy{scheme: u.Scheme, addr: u.Host, user: u.User}
+	if p.scheme == "socks5h" {
+		p.scheme = "socks5"
+	}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return p, nil
+}
+
+// dial 经代理连接 address，域名由代理解析。d 用于连接代理，其 Timeout、Deadline 同时限制与代理的握手
+func (p *upstreamProxy) dial(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if !d.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d.Deadline)
+		defer cancel()
+	}
+	if p.scheme == "socks5" {
+		var auth *proxy.Auth
+		if p.user != nil {
+			password, _ := p.user.Password()
+			auth = &proxy.Auth{User: p.user.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", p.addr, auth, proxyForward{d})
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("经上游代理 %s 连接 %s 失败: %w", p.addr, address, err)
+		}
+		return conn, nil
+	}
+
+	conn, err := dialHappyEyeballs(ctx, d, p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("连接上游代理 %s 失败: %w", p.addr, err)
+	}
+	tunnel, err := p.connect(ctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("经上游代理 %s 连接 %s 失败: %w", p.addr, address, err)
+	}
+	return tunnel, nil
+}
+
+// connect 在到 HTTP 代理的连接 conn 上发送 CONNECT address，ctx 结束时中断握手
+func (p *upstreamProxy) connect(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if p.user != nil {
+		password, _ := p.user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(p.user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		return nil, errors.New("代理认证失败 (HTTP 407)")
+	default:
+		return nil, fmt.Errorf("代理拒绝连接: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// 服务端要等客户端先发送数据，通常不会走到这里
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读出读取 CONNECT 响应时多读的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// proxyForward 供 proxy.SOCKS5 连接 SOCKS5 代理本身
+type proxyForward struct{ d *net.Dialer }
+
+func (f proxyForward) Dial(network, address string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, address)
+}
+
+func (f proxyForward) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialHappyEyeballs(ctx, f.d, address)
+}
+
+// envProxy 返回环境变量中连接 address 使用的代理：HTTPS_PROXY，未设置时 HTTP_PROXY（都经 CONNECT 连接，
+// 不区分 URL 协议），NO_PROXY 中的主机和回环地址不使用代理。代理指向本机的 listenAddr 端口时忽略，
+// 避免在设置了 HTTPS_PROXY 指向本代理的终端中启动时连接自己
+func envProxy(address, listenAddr string) (*upstreamProxy, error) {
+	env := httpproxy.FromEnvironment()
+	env.HTTPSProxy = cmp.Or(env.HTTPSProxy, env.HTTPProxy)
+	u, err := env.ProxyFunc()(&url.URL{Scheme: "https", Host: address})
+	if err != nil || u == nil {
+		return nil, err
+	}
+	p, err := parseUpstreamProxy(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("环境变量中的代理无效: %w", err)
+	}
+	if _, listenPort, err := net.SplitHostPort(listenAddr); err == nil && listenPort != "0" {
+		host, port, _ := net.SplitHostPort(p.addr)
+		ip := net.ParseIP(host)
+		if port == listenPort && (strings.EqualFold(host, "localhost") || ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+			return nil, nil
+		}
+	}
+	return p, nil
+}
+
+// upstreamProxyFor 返回连接 address 时经过的代理：UpstreamProxy 为空时使用环境变量中的代理（见 envProxy），
+// 为 UpstreamProxyNone 时不使用代理；不需要代理时返回 nil
+func (s *ProxyServer) upstreamProxyFor(address string) (*upstreamProxy, error) {
+	cfg := s.GetConfig()
+	if cfg.UpstreamProxy == "" {
+		return envProxy(address, cfg.ListenAddr)
+	}
+	return parseUpstreamProxy(cfg.UpstreamProxy)
+}
+
+// proxiedFor 判断连接 address 时是否需要经 upstreamProxyFor 的代理
+func (s *ProxyServer) proxiedFor(address string) bool {
+	p, err := s.upstreamProxyFor(address)
+	return p != nil || err != nil
+}
+
+// dialUpstream 连接服务端或 DoH 服务器的 address：需要代理时（见 upstreamProxyFor）经代理连接，否则按 Happy Eyeballs 直接连接
+func (s *ProxyServer) dialUpstream(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+	p, err := s.upstreamProxyFor(address)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return dialHappyEyeballs(ctx, d, address)
+	}
+	return p.dial(ctx, d, address)
+}
+
+// controlClient 返回访问 rawURL（DoH、IP 列表等控制面请求）使用的 HTTP 客户端：需要代理时返回经 dialUpstream
+// 连接的新客户端，超时与 direct 相同，用完后调用 release 关闭其连接；否则返回 direct
+func (s *ProxyServer) controlClient(direct *http.Client, rawURL string) (client *http.Client, release func()) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return direct, func() {}
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	if !s.proxiedFor(net.JoinHostPort(u.Hostname(), port)) {
+		return direct, func() {}
+	}
+	// 经代理的控制面请求很少（启动时下载、每个域名获取一次 ECH 配置），不保留空闲连接
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return s.dialUpstream(ctx, &net.Dialer{Timeout: s.dialTimeout()}, address)
+	}}
+	return &http.Client{Transport: transport, Timeout: direct.Timeout}, transport.CloseIdleConnections
+}
+
+// serverDialContext 供连接服务端的 HTTP Transport 和 WebSocket Dialer 使用：通过当前选中的 ServerIP 候选地址连接
+// （未设置 ServerIP 时为 FallbackServerHost 的地址，见 serverIPSpec），需要时经代理连接（见 upstreamProxyFor）
+func (s *ProxyServer) serverDialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	return s.dialServerIP(ctx, port)
+}
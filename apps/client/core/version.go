@@ -0,0 +1,32 @@
+// Package core echPlus 代理客户端核心，命令行客户端、桌面端及第三方程序通过 ProxyServer 嵌入使用。
+//
+// 导出的标识符默认为稳定 API，在同一 API 主版本内保持兼容；
+// 文档注释中标明"内部 API"的导出标识符仅供本仓库使用，可能在任意版本中变更或删除
+package core
+
+import "fmt"
+
+// Version core 公开 API 的版本，格式为 "主版本.次版本"，与应用版本（buildinfo.Version）无关，
+// 始终与 APIMajor、APIMinor 一致。兼容性约定:
+//   - 新增稳定 API（导出的类型、函数、方法、Config 字段等）时递增次版本
+//   - 删除或以不兼容方式修改稳定 API 时递增主版本，次版本归零
+//   - 内部 API 的变更不影响版本号
+//
+// 引用方可在编译期断言所需版本（见 apps/desktop/services/core_compat.go），
+// 版本不兼容时编译失败而不是在运行时出错
+const Version = "1.42"
+
+// APIMajor、APIMinor 公开 API 的主版本和次版本
+const (
+	APIMajor = 1
+	APIMinor = 42
+)
+
+// CheckAPIVersion 检查按 major.minor 版本编写的调用方能否使用当前 core：
+// 主版本必须相同，且 core 的次版本不低于 minor
+func CheckAPIVersion(major, minor int) error {
+	if major != APIMajor || minor > APIMinor {
+		return fmt.Errorf("core API 版本 %s 与所需的 %d.%d 不兼容", Version, major, minor)
+	}
+	return nil
+}
@@ -2,4 +2,10 @@ module github.com/atticus6/echPlus/apps/client
 
 go 1.25.0
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/net v0.37.0
+	golang.org/x/sync v0.15.0
+)
+
+require golang.org/x/text v0.23.0 // indirect
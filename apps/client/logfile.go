@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/client/logging"
+)
+
+// -log-file 的轮转参数
+const (
+	logFileMaxSize = 100 << 20 // 单个文件超过 100MB 时切换到新文件
+	logFileMaxAge  = 7         // 保留最近 7 天
+)
+
+// fileLogHandler 将 core 日志输出到标准错误，同时写入 -log-file
+type fileLogHandler struct {
+	logger *logging.Logger
+	stream string
+}
+
+// openLogFile 按 path 打开轮转日志并接管 core 日志。
+// 文件名中插入日期，如 logs/client.log 写入 logs/client_2006-01-02.log
+func openLogFile(path string) (*logging.Logger, error) {
+	logger, err := logging.New(filepath.Dir(path), logging.Options{MaxSize: logFileMaxSize, MaxAge: logFileMaxAge})
+	if err != nil {
+		return nil, err
+	}
+	stream := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	core.SetLogHandler(fileLogHandler{logger: logger, stream: stream})
+	return logger, nil
+}
+
+func (h fileLogHandler) write(level logging.Level, msg string) {
+	log.Printf("[%s] %s", level, msg)
+	if err := h.logger.Log(h.stream, level, msg); err != nil {
+		log.Printf("[ERROR] 写入日志文件失败: %v", err)
+	}
+}
+
+func (h fileLogHandler) Info(msg string)  { h.write(logging.LevelInfo, msg) }
+func (h fileLogHandler) Error(msg string) { h.write(logging.LevelError, msg) }
+func (h fileLogHandler) Debug(msg string) { h.write(logging.LevelDebug, msg) }
@@ -0,0 +1,180 @@
+// Package logging 按流拆分、按日期和大小轮转的日志文件，命令行客户端、服务端和桌面端共用。
+//
+// 每个流写入 <目录>/<流>_<日期>.log，超过 MaxSize 时当前文件改名为 <流>_<日期>_<序号>.log 后继续写入新文件，
+// 日期变化时切换到新日期的文件并删除超过 MaxAge 天的旧文件
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level 日志级别
+type Level string
+
+const (
+	LevelDebug Level = "DEBUG"
+	LevelInfo  Level = "INFO"
+	LevelWarn  Level = "WARN"
+	LevelError Level = "ERROR"
+)
+
+// Format 日志行格式
+type Format string
+
+const (
+	// FormatText [级别] 时:分:秒 消息 键=值 ...，日期见文件名
+	FormatText Format = "text"
+	// FormatJSON 每行一个 JSON 对象，包含 time、level、msg 及各字段
+	FormatJSON Format = "json"
+)
+
+// ParseFormat 解析 text 或 json，空字符串为 text
+func ParseFormat(s string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimSpace(s))) {
+	case "", FormatText:
+		return FormatText, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+	return "", fmt.Errorf("未知的日志格式 %q，可选 text 或 json", s)
+}
+
+// Field 日志的结构化字段
+type Field struct {
+	Key   string
+	Value any
+}
+
+// F 创建字段
+func F(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Options 日志文件的格式和轮转参数
+type Options struct {
+	Format  Format // 为空时使用 FormatText
+	MaxSize int64  // 单个文件的最大字节数，0 表示只按日期轮转
+	MaxAge  int    // 保留最近几天的文件，0 表示不删除
+
+	// Now 返回当前时间，为 nil 时使用 time.Now，用于测试按日期轮转
+	Now func() time.Time
+}
+
+// Logger 将日志按流写入目录下的轮转文件，可并发使用
+type Logger struct {
+	dir   string
+	opts  Options
+	mu    sync.Mutex
+	files map[string]*rotatingFile
+}
+
+// New 在 dir 下创建日志，目录不存在时创建。各流的文件在第一次写入时打开
+func New(dir string, opts Options) (*Logger, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if opts.Format == "" {
+		opts.Format = FormatText
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Logger{dir: dir, opts: opts, files: make(map[string]*rotatingFile)}, nil
+}
+
+// Log 向 stream 写入一条日志
+func (l *Logger) Log(stream string, level Level, msg string, fields ...Field) error {
+	now := l.opts.Now()
+	line := formatLine(l.opts.Format, now, level, msg, fields)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.files[stream]
+	if !ok {
+		f = &rotatingFile{dir: l.dir, name: stream}
+		l.files[stream] = f
+	}
+	return f.write(line, now, l.opts)
+}
+
+// Close 将所有打开的文件同步到磁盘后关闭，之后的 Log 会重新打开
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var firstErr error
+	for _, f := range l.files {
+		if err := f.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// CloseTimeout 与 Close 相同，但最多等待 timeout，用于退出进程时磁盘无响应也不会卡住
+func (l *Logger) CloseTimeout(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- l.Close() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("关闭日志文件超过 %v", timeout)
+	}
+}
+
+// formatLine 按格式生成一行日志，包含结尾换行
+func formatLine(format Format, now time.Time, level Level, msg string, fields []Field) []byte {
+	var b strings.Builder
+	if format == FormatJSON {
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level)
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for _, f := range fields {
+			b.WriteByte(',')
+			writeJSON(&b, f.Key)
+			b.WriteByte(':')
+			writeJSON(&b, f.Value)
+		}
+		b.WriteString("}\n")
+		return []byte(b.String())
+	}
+
+	fmt.Fprintf(&b, "[%s] %s %s", level, now.Format("15:04:05"), msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%s", f.Key, textValue(f.Value))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func writeJSON(b *strings.Builder, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// textValue 文本格式的字段值，含空白、引号或等号时加引号
+func textValue(v any) string {
+	var s string
+	switch v := v.(type) {
+	case time.Time:
+		s = v.Format(time.RFC3339Nano)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// rotatingFile 一个流的当前日志文件，由 Logger.mu 保护
+type rotatingFile struct {
+	dir  string
+	name string
+	date string
+	file *os.File
+	size int64
+}
+
+// path 返回 date 当天正在写入的文件路径
+func (f *rotatingFile) path(date string) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%s_%s.log", f.name, date))
+}
+
+// write 写入一行，日期变化或超过 MaxSize 时先轮转
+func (f *rotatingFile) write(line []byte, now time.Time, opts Options) error {
+	date := now.Format(dateLayout)
+	switch {
+	case f.file == nil || f.date != date:
+		if err := f.open(date); err != nil {
+			return err
+		}
+		f.prune(now, opts.MaxAge)
+	case opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(line)) > opts.MaxSize:
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// open 关闭当前文件并打开 date 当天的文件，已存在时追加
+func (f *rotatingFile) open(date string) error {
+	f.close()
+	file, err := os.OpenFile(f.path(date), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.date, f.size = file, date, info.Size()
+	return nil
+}
+
+// rotate 将当天已写满的文件改名为下一个未使用的序号，再打开新文件
+func (f *rotatingFile) rotate() error {
+	f.close()
+	current := f.path(f.date)
+	for n := 1; ; n++ {
+		target := filepath.Join(f.dir, fmt.Sprintf("%s_%s_%d.log", f.name, f.date, n))
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if err := os.Rename(current, target); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return f.open(f.date)
+}
+
+// prune 删除该流超过 maxAge 天的文件，maxAge 为 0 时不删除
+func (f *rotatingFile) prune(now time.Time, maxAge int) {
+	if maxAge <= 0 {
+		return
+	}
+	oldest := now.AddDate(0, 0, 1-maxAge).Format(dateLayout)
+	matches, _ := filepath.Glob(filepath.Join(f.dir, f.name+"_*.log"))
+	for _, path := range matches {
+		rest := strings.TrimPrefix(filepath.Base(path), f.name+"_")
+		if len(rest) < len(dateLayout) {
+			continue
+		}
+		date := rest[:len(dateLayout)]
+		if _, err := time.Parse(dateLayout, date); err == nil && date < oldest {
+			os.Remove(path)
+		}
+	}
+}
+
+// close 同步并关闭当前文件
+func (f *rotatingFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := errors.Join(f.file.Sync(), f.file.Close())
+	f.file = nil
+	return err
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLogRotation 日志文件超过 MaxSize 时切换到同一天的新文件，日期变化时切换文件并删除超过 MaxAge 的文件
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	logger, err := New(dir, Options{
+		Format:  FormatJSON,
+		MaxSize: 1,
+		MaxAge:  2,
+		Now:     func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("new logger: %v", err)
+	}
+	defer logger.Close()
+
+	files := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("read dir: %v", err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	write := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := logger.Log("info", LevelInfo, "rotation test", F("seq", i)); err != nil {
+				t.Fatalf("log: %v", err)
+			}
+		}
+	}
+
+	// MaxSize 小于一行，每个文件只写入一行
+	write(4)
+	want := []string{"info_2026-03-01.log", "info_2026-03-01_1.log", "info_2026-03-01_2.log", "info_2026-03-01_3.log"}
+	if got := files(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("files after size rotation = %v, want %v", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "info_2026-03-01_1.log"))
+	if err != nil {
+		t.Fatalf("read rotated file: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+			Seq   int    `json:"seq"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Level != "INFO" || entry.Msg != "rotation test" {
+			t.Fatalf("bad JSON line %q: %v", line, err)
+		}
+	}
+
+	now = now.AddDate(0, 0, 1)
+	write(1)
+	if got := files(); len(got) != 5 || got[4] != "info_2026-03-02.log" {
+		t.Fatalf("files after date change = %v, want a new info_2026-03-02.log", got)
+	}
+
+	// MaxAge 为 2 天：03-03 只保留 03-02 和 03-03
+	now = now.AddDate(0, 0, 1)
+	write(1)
+	want = []string{"info_2026-03-02.log", "info_2026-03-03.log"}
+	if got := files(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("files after retention = %v, want %v", got, want)
+	}
+}
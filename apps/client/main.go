@@ -10,30 +10,124 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/atticus6/echPlus/apps/client/buildinfo"
 	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/client/logging"
 )
 
 var (
 	listenAddr  string
 	serverAddr  string
+	nodeURI     string
 	serverIP    string
+	coverHost   string
+	ipProbe     time.Duration
 	token       string
 	dnsServer   string
 	echDomain   string
+	echPublic   string
+	echCacheAge time.Duration
+	echRefresh  time.Duration
 	routingMode string
+	ipListURL   string
+	upProxy     string
+	upProxyAll  bool
+	requireECH  bool
+	maxConns    int
+	limit       string
+	limitDirect bool
+	watchNet    bool
+	idleTimeout time.Duration
+	dialTO      time.Duration
+	tlsTO       time.Duration
+	dohTO       time.Duration
+	fallback    bool
+	healthEvery time.Duration
+	healthFails int
+	plaintext   string
+	plainExempt string
+	dialRetries int
+	retryDelay  time.Duration
+	resumeGrace time.Duration
+	pingEvery   time.Duration
+	pongTimeout time.Duration
+	compress    bool
+	compPorts   string
+	h2ws        bool
+	obfuscation string
+	coalesce    time.Duration
+	internals   time.Duration
+	pinTTL      time.Duration
+	pinExclude  string
+	showVersion bool
+	appRules    string
+	logFile     string
+	servePAC    bool
+	dnsListen   string
+	transparent bool
+	balance     string
+	spkiPins    string
+	pinChain    bool
 )
 
 func init() {
 	flag.StringVar(&listenAddr, "l", getEnv("ECHPLUS_LISTEN", "127.0.0.1:30000"), "代理监听地址 (支持 SOCKS5 和 HTTP) [环境变量: ECHPLUS_LISTEN]")
-	flag.StringVar(&serverAddr, "f", getEnv("ECHPLUS_SERVER", ""), "服务端地址 (格式: x.x.workers.dev:443) [环境变量: ECHPLUS_SERVER]")
-	flag.StringVar(&serverIP, "ip", getEnv("ECHPLUS_SERVER_IP", ""), "指定服务端 IP（绕过 DNS 解析）[环境变量: ECHPLUS_SERVER_IP]")
+	flag.StringVar(&serverAddr, "f", getEnv("ECHPLUS_SERVER", ""), "服务端地址 (格式: x.x.workers.dev:443)，逗号分隔多个时自动故障转移 [环境变量: ECHPLUS_SERVER]")
+	flag.StringVar(&nodeURI, "node", getEnv("ECHPLUS_NODE", ""), "节点分享链接 (echplus://令牌@主机:端口?...) 或 node add 保存的节点名称，指定时代替 -f、-token、-ip、-pin-spki 等服务端参数 [环境变量: ECHPLUS_NODE]")
+	flag.StringVar(&balance, "balance", getEnv("ECHPLUS_BALANCE", "failover"), "-f 有多个服务端时新隧道选择服务端的方式: failover(故障转移), round_robin(轮流使用), latency(优先延迟最低) [环境变量: ECHPLUS_BALANCE]")
+	flag.StringVar(&serverIP, "ip", getEnv("ECHPLUS_SERVER_IP", ""), "指定服务端 IP（绕过 DNS 解析），逗号分隔多个 IP、域名或网段时测速后使用最快的 [环境变量: ECHPLUS_SERVER_IP]")
+	flag.StringVar(&coverHost, "fallback-host", getEnv("ECHPLUS_FALLBACK_HOST", "www.visa.com"), "未指定 -ip 时连接服务端使用的域名，启动时解析为 IP，应为接入同一 CDN 的常见站点 [环境变量: ECHPLUS_FALLBACK_HOST]")
+	flag.DurationVar(&ipProbe, "ip-probe-interval", getEnvDuration("ECHPLUS_SERVER_IP_PROBE_INTERVAL", 10*time.Minute), "-ip 有多个候选地址时重新测速的间隔，负数表示只在启动和连续失败后测速 [环境变量: ECHPLUS_SERVER_IP_PROBE_INTERVAL]")
+	flag.StringVar(&upProxy, "upstream-proxy", getEnv("ECHPLUS_UPSTREAM_PROXY", ""), "连接服务端、DoH 服务器和下载 IP 列表时经过的代理，如 socks5://127.0.0.1:7890、http://用户名:密码@proxy:3128，为空时使用 HTTPS_PROXY/HTTP_PROXY 环境变量，direct 表示总是直连 [环境变量: ECHPLUS_UPSTREAM_PROXY]")
+	flag.BoolVar(&upProxyAll, "upstream-proxy-direct", getEnvBool("ECHPLUS_UPSTREAM_PROXY_DIRECT", false), "直连的 TCP 连接也经过 -upstream-proxy [环境变量: ECHPLUS_UPSTREAM_PROXY_DIRECT]")
 	flag.StringVar(&token, "token", getEnv("ECHPLUS_TOKEN", "147258369"), "身份验证令牌 [环境变量: ECHPLUS_TOKEN]")
-	flag.StringVar(&dnsServer, "dns", getEnv("ECHPLUS_DNS", "dns.alidns.com/dns-query"), "ECH 查询 DoH 服务器 [环境变量: ECHPLUS_DNS]")
-	flag.StringVar(&echDomain, "ech", getEnv("ECHPLUS_ECH_DOMAIN", "cloudflare-ech.com"), "ECH 查询域名 [环境变量: ECHPLUS_ECH_DOMAIN]")
+	flag.StringVar(&dnsServer, "dns", getEnv("ECHPLUS_DNS", "dns.alidns.com/dns-query"), "ECH 查询 DoH 服务器，逗号分隔多个时依次尝试；主机后加 @IP 时直接连接该 IP，如 dns.alidns.com@223.5.5.5/dns-query [环境变量: ECHPLUS_DNS]")
+	flag.StringVar(&echDomain, "ech", getEnv("ECHPLUS_ECH_DOMAIN", "cloudflare-ech.com"), "ECH 查询域名，@server 表示查询各服务端主机名 [环境变量: ECHPLUS_ECH_DOMAIN]")
+	flag.StringVar(&echPublic, "ech-public-name", getEnv("ECHPLUS_ECH_PUBLIC_NAME", ""), "ECH 配置中公开名称（外层 SNI）的预期值，不一致时报错，为空不检查 [环境变量: ECHPLUS_ECH_PUBLIC_NAME]")
+	flag.DurationVar(&echCacheAge, "ech-cache-max-age", getEnvDuration("ECHPLUS_ECH_CACHE_MAX_AGE", 7*24*time.Hour), "DoH 查询失败时使用存储目录中缓存的 ECH 配置，缓存超过该时间则不使用，负数表示不读写缓存 [环境变量: ECHPLUS_ECH_CACHE_MAX_AGE]")
+	flag.DurationVar(&echRefresh, "ech-refresh-interval", getEnvDuration("ECHPLUS_ECH_REFRESH_INTERVAL", time.Hour), "后台重新查询 ECH 配置的间隔，负数表示只在连接被拒绝时刷新 [环境变量: ECHPLUS_ECH_REFRESH_INTERVAL]")
 	flag.StringVar(&routingMode, "routing", getEnv("ECHPLUS_ROUTING", "global"), "分流模式: global(全局代理), bypass_cn(跳过中国大陆), none(不改变代理) [环境变量: ECHPLUS_ROUTING]")
+	flag.StringVar(&ipListURL, "ip-list-url", getEnv("ECHPLUS_IP_LIST_URL", ""), "bypass_cn 下载中国 IP 列表的目录地址，为空时从 GitHub 下载，失败时从服务端下载 [环境变量: ECHPLUS_IP_LIST_URL]")
+	flag.BoolVar(&servePAC, "pac", getEnvBool("ECHPLUS_PAC", false), "在代理端口上提供按分流模式生成的 PAC 自动配置脚本 (/proxy.pac)，地址见 status 命令 [环境变量: ECHPLUS_PAC]")
+	flag.StringVar(&dnsListen, "dns-listen", getEnv("ECHPLUS_DNS_LISTEN", ""), "本地 DNS 服务监听地址，如 127.0.0.1:5353，UDP/TCP 接受 DNS 查询、/dns-query 接受 DoH，经服务端解析并缓存，为空时不启动 [环境变量: ECHPLUS_DNS_LISTEN]")
+	flag.BoolVar(&transparent, "transparent", getEnvBool("ECHPLUS_TRANSPARENT", false), "作为透明代理接收 iptables REDIRECT 重定向的 TCP 连接，监听地址不再支持 SOCKS5 和 HTTP（仅 Linux）[环境变量: ECHPLUS_TRANSPARENT]")
+	flag.IntVar(&maxConns, "max-conns", getEnvInt("ECHPLUS_MAX_CONNECTIONS", 0), "最大并发连接数，0 表示不限制 [环境变量: ECHPLUS_MAX_CONNECTIONS]")
+	flag.StringVar(&limit, "limit", getEnv("ECHPLUS_LIMIT", "0"), "总带宽限制，如 5mbps、2MB/s，0 表示不限制 [环境变量: ECHPLUS_LIMIT]")
+	flag.BoolVar(&limitDirect, "limit-direct", getEnvBool("ECHPLUS_LIMIT_DIRECT", true), "总带宽限制是否包含直连流量 [环境变量: ECHPLUS_LIMIT_DIRECT]")
+	flag.BoolVar(&watchNet, "watch-network", getEnvBool("ECHPLUS_WATCH_NETWORK", true), "检测网络切换（Wi-Fi、VPN 等）后自动刷新缓存和 ECH 配置 [环境变量: ECHPLUS_WATCH_NETWORK]")
+	flag.DurationVar(&idleTimeout, "idle-timeout", getEnvDuration("ECHPLUS_IDLE_TIMEOUT", 10*time.Minute), "隧道双向无数据超过该时间则关闭，0 表示不限制 [环境变量: ECHPLUS_IDLE_TIMEOUT]")
+	flag.DurationVar(&dialTO, "dial-timeout", getEnvDuration("ECHPLUS_DIAL_TIMEOUT", 10*time.Second), "建立一个 TCP 连接（服务端、直连目标、上游代理）的超时 [环境变量: ECHPLUS_DIAL_TIMEOUT]")
+	flag.DurationVar(&tlsTO, "tls-timeout", getEnvDuration("ECHPLUS_TLS_TIMEOUT", 10*time.Second), "与服务端 TLS 握手及 WebSocket 升级的超时 [环境变量: ECHPLUS_TLS_TIMEOUT]")
+	flag.DurationVar(&dohTO, "doh-timeout", getEnvDuration("ECHPLUS_DOH_TIMEOUT", 10*time.Second), "一次 DoH 查询的超时 [环境变量: ECHPLUS_DOH_TIMEOUT]")
+	flag.BoolVar(&fallback, "fallback-direct", getEnvBool("ECHPLUS_FALLBACK_DIRECT", false), "服务端不可用时将需要代理的连接改为直连（会暴露真实 IP）[环境变量: ECHPLUS_FALLBACK_DIRECT]")
+	flag.DurationVar(&healthEvery, "health-interval", getEnvDuration("ECHPLUS_HEALTH_INTERVAL", 0), "后台检查服务端可用性的间隔，0 表示不检查 [环境变量: ECHPLUS_HEALTH_INTERVAL]")
+	flag.IntVar(&healthFails, "health-failures", getEnvInt("ECHPLUS_HEALTH_FAILURES", 3), "健康检查连续失败多少次后认为服务端不可用 [环境变量: ECHPLUS_HEALTH_FAILURES]")
+	flag.StringVar(&plaintext, "plaintext", getEnv("ECHPLUS_PLAINTEXT", "allow"), "经代理发送明文协议 (80 端口的 HTTP、FTP、SMTP 等) 时: allow(允许), warn(记录警告), block(拒绝连接) [环境变量: ECHPLUS_PLAINTEXT]")
+	flag.StringVar(&plainExempt, "plaintext-exempt", getEnv("ECHPLUS_PLAINTEXT_EXEMPT", ""), "不检查明文协议的主机，逗号分隔，支持 *.example.com [环境变量: ECHPLUS_PLAINTEXT_EXEMPT]")
+	flag.IntVar(&dialRetries, "dial-retries", getEnvInt("ECHPLUS_DIAL_RETRIES", 2), "连接服务端遇到临时性错误（DNS、连接被拒绝、超时、5xx）时的重试次数，负数表示不重试 [环境变量: ECHPLUS_DIAL_RETRIES]")
+	flag.DurationVar(&retryDelay, "dial-retry-delay", getEnvDuration("ECHPLUS_DIAL_RETRY_DELAY", 500*time.Millisecond), "首次重试前的等待时间，之后每次翻倍（上限 10s）并加入随机抖动 [环境变量: ECHPLUS_DIAL_RETRY_DELAY]")
+	flag.DurationVar(&resumeGrace, "resume-grace", getEnvDuration("ECHPLUS_RESUME_GRACE", 0), "隧道的 WebSocket 异常断开后在该时间内重连并恢复，需服务端支持，0 表示不恢复 [环境变量: ECHPLUS_RESUME_GRACE]")
+	flag.DurationVar(&pingEvery, "ping-interval", getEnvDuration("ECHPLUS_PING_INTERVAL", 10*time.Second), "隧道 WebSocket 的 ping 间隔 [环境变量: ECHPLUS_PING_INTERVAL]")
+	flag.DurationVar(&pongTimeout, "pong-timeout", getEnvDuration("ECHPLUS_PONG_TIMEOUT", 30*time.Second), "超过该时间未收到服务端响应则关闭隧道，必须大于 -ping-interval [环境变量: ECHPLUS_PONG_TIMEOUT]")
+	flag.BoolVar(&compress, "compress", getEnvBool("ECHPLUS_COMPRESSION", false), "与服务端协商 WebSocket 压缩，仅对未加密的可压缩流量有效 [环境变量: ECHPLUS_COMPRESSION]")
+	flag.StringVar(&compPorts, "compress-ports", getEnv("ECHPLUS_COMPRESS_PORTS", ""), "只对这些目标端口压缩，逗号分隔，如 80,8080；为空时跳过 443 等 TLS 端口 [环境变量: ECHPLUS_COMPRESS_PORTS]")
+	flag.BoolVar(&h2ws, "h2", getEnvBool("ECHPLUS_H2", false), "通过 HTTP/2 扩展 CONNECT 建立 WebSocket，需服务端启用 -h2c 或前置代理支持 RFC 8441 [环境变量: ECHPLUS_H2]")
+	flag.StringVar(&obfuscation, "obfuscation", getEnv("ECHPLUS_OBFUSCATION", "none"), "隧道开头几帧的混淆方式: none(不混淆), fragment(拆分首帧), pad(随机填充，需服务端支持) [环境变量: ECHPLUS_OBFUSCATION]")
+	flag.DurationVar(&coalesce, "coalesce", getEnvDuration("ECHPLUS_COALESCE", time.Millisecond), "上传的小块数据（小于 4KB）在该时间内合并为一个 WebSocket 消息，负数表示不合并，对延迟敏感时可关闭 [环境变量: ECHPLUS_COALESCE]")
+	flag.DurationVar(&pinTTL, "dns-pin-ttl", getEnvDuration("ECHPLUS_DNS_PIN_TTL", 10*time.Minute), "直连域名成功后记住可用 IP 的时间，负数表示不记住 [环境变量: ECHPLUS_DNS_PIN_TTL]")
+	flag.StringVar(&pinExclude, "dns-pin-exclude", getEnv("ECHPLUS_DNS_PIN_EXCLUDE", ""), "不记住 IP 的域名，逗号分隔，支持 *.example.com [环境变量: ECHPLUS_DNS_PIN_EXCLUDE]")
+	flag.StringVar(&appRules, "app-rules", getEnv("ECHPLUS_APP_RULES", ""), "按应用分流 (仅 Linux/macOS)，如 proxy:firefox,direct:steam [环境变量: ECHPLUS_APP_RULES]")
+	flag.StringVar(&spkiPins, "pin-spki", getEnv("ECHPLUS_PIN_SPKI", ""), "服务端证书的公钥固定值，逗号分隔，不匹配时拒绝连接，用 client pin -f 服务端地址 获取 [环境变量: ECHPLUS_PIN_SPKI]")
+	flag.BoolVar(&pinChain, "pin-any-chain", getEnvBool("ECHPLUS_PIN_ANY_CHAIN", false), "公钥固定值可匹配证书链中的任一证书，而不仅是服务端证书 [环境变量: ECHPLUS_PIN_ANY_CHAIN]")
+	flag.DurationVar(&internals, "internals-interval", getEnvDuration("ECHPLUS_INTERNALS_INTERVAL", 0), "按该间隔记录 goroutine 数、堆内存及内部表大小，用于排查内存增长，0 表示关闭 [环境变量: ECHPLUS_INTERNALS_INTERVAL]")
+	flag.StringVar(&logFile, "log-file", getEnv("ECHPLUS_LOG_FILE", ""), "同时将日志写入该文件，按日期和大小轮转，保留 7 天，如 logs/client.log 写入 logs/client_<日期>.log [环境变量: ECHPLUS_LOG_FILE]")
+	flag.BoolVar(&showVersion, "version", false, "显示版本、构建信息及 ECH 支持情况后退出")
+	flag.BoolVar(&requireECH, "require-ech", getEnvBool("ECHPLUS_REQUIRE_ECH", true), "必须使用 ECH，关闭后无法获取 ECH 配置时降级为普通 TLS [环境变量: ECHPLUS_REQUIRE_ECH]")
 }
 
 func getEnv(key, defaultValue string) string {
@@ -43,11 +137,137 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// splitList 解析逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parsePorts 解析逗号分隔的端口列表
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, item := range splitList(s) {
+		port, err := strconv.Atoi(item)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("无效的端口 %q", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// buildConfig 按命令行参数和环境变量生成代理配置，运行代理和子命令共用。
+// 指定 -node 时返回解析出的节点，其连接信息已写入配置
+func buildConfig(storeDir string) (core.Config, *core.Node, error) {
+	var node *core.Node
+	if nodeURI != "" {
+		n, err := resolveNode(storeDir, nodeURI)
+		if err != nil {
+			return core.Config{}, nil, fmt.Errorf("参数 -node 无效: %w", err)
+		}
+		node = &n
+	}
+	totalRateLimit, err := core.ParseRate(limit)
+	if err != nil {
+		return core.Config{}, nil, fmt.Errorf("参数 -limit 无效: %w", err)
+	}
+	rules, err := core.ParseAppRules(appRules)
+	if err != nil {
+		return core.Config{}, nil, fmt.Errorf("参数 -app-rules 无效: %w", err)
+	}
+	compressPorts, err := parsePorts(compPorts)
+	if err != nil {
+		return core.Config{}, nil, fmt.Errorf("参数 -compress-ports 无效: %w", err)
+	}
+
+	cfg := core.Config{
+		ListenAddr:         listenAddr,
+		ServerAddr:         serverAddr,
+		ServerIP:           serverIP,
+		Token:              token,
+		DNSServer:          dnsServer,
+		ECHDomain:          echDomain,
+		ECHPublicName:      echPublic,
+		ECHCacheMaxAge:     echCacheAge,
+		ECHRefreshInterval: echRefresh,
+		RoutingMode:        core.RoutingMode(routingMode),
+		StoreDir:           storeDir,
+		IPListBaseURL:      ipListURL,
+		ServePAC:           servePAC,
+		DNSListenAddr:      dnsListen,
+		Transparent:        transparent,
+		RequireECH:         requireECH,
+		MaxConnections:     maxConns,
+
+		ServerIPProbeInterval:      ipProbe,
+		FallbackServerHost:         coverHost,
+		UpstreamProxy:              upProxy,
+		UpstreamProxyDirect:        upProxyAll,
+		BalanceStrategy:            core.BalanceStrategy(balance),
+		TotalRateLimit:             totalRateLimit,
+		TotalRateLimitExemptDirect: !limitDirect,
+		WatchNetwork:               watchNet,
+		IdleTimeout:                idleTimeout,
+		DialTimeout:                dialTO,
+		TLSHandshakeTimeout:        tlsTO,
+		DoHTimeout:                 dohTO,
+		FallbackDirect:             fallback,
+		HealthCheckInterval:        healthEvery,
+		HealthCheckFailures:        healthFails,
+		PlaintextPolicy:            core.PlaintextPolicy(plaintext),
+		PlaintextExempt:            splitList(plainExempt),
+		DialRetries:                dialRetries,
+		DialRetryDelay:             retryDelay,
+		ResumeGrace:                resumeGrace,
+		PingInterval:               pingEvery,
+		PongTimeout:                pongTimeout,
+		Compression:                compress,
+		CompressPorts:              compressPorts,
+		HTTP2WebSocket:             h2ws,
+		Obfuscation:                core.Obfuscation(obfuscation),
+		UploadCoalesceDelay:        coalesce,
+		DNSPinTTL:                  pinTTL,
+		DNSPinExclude:              splitList(pinExclude),
+		AppRules:                   rules,
+		PinnedSPKI:                 splitList(spkiPins),
+		PinAnyChainCert:            pinChain,
+		InternalsLogInterval:       internals,
+	}
+	if node != nil {
+		node.ApplyTo(&cfg)
+	}
+	return cfg, node, nil
+}
+
 func main() {
+	flag.Usage = printUsage
 	flag.Parse()
-	if serverAddr == "" {
-		log.Fatal("必须指定服务端地址 -f\n\n示例:\n  ./client -l 127.0.0.1:1080 -f your-worker.workers.dev:443 -token your-token")
-	}
 
 	exePath, err := os.Executable()
 	if err != nil {
@@ -55,25 +275,43 @@ func main() {
 	}
 	storeDir := filepath.Join(filepath.Dir(exePath), ".echplus")
 
+	if showVersion {
+		fmt.Print(buildinfo.Get())
+		fmt.Printf("存储目录: %s\n", storeDir)
+		return
+	}
+	if flag.NArg() > 0 {
+		runSubcommand(storeDir, flag.Args())
+		return
+	}
+
+	cfg, node, err := buildConfig(storeDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.ServerAddr == "" {
+		log.Fatal("必须指定服务端地址 -f 或节点链接 -node\n\n示例:\n  ./client -l 127.0.0.1:1080 -f your-worker.workers.dev:443 -token your-token")
+	}
 	if err := os.MkdirAll(storeDir, 0755); err != nil {
 		log.Fatalf("创建存储目录失败: %v", err)
 	}
-
-	cfg := core.Config{
-		ListenAddr:  listenAddr,
-		ServerAddr:  serverAddr,
-		ServerIP:    serverIP,
-		Token:       token,
-		DNSServer:   dnsServer,
-		ECHDomain:   echDomain,
-		RoutingMode: core.RoutingMode(routingMode),
-		StoreDir:    storeDir,
+	var logger *logging.Logger
+	if logFile != "" {
+		if logger, err = openLogFile(logFile); err != nil {
+			log.Fatalf("打开日志文件失败: %v", err)
+		}
+	}
+	if node != nil {
+		log.Printf("[启动] 使用节点 %s (%s)", node.Name, cfg.ServerAddr)
 	}
 
 	server := core.NewProxyServer(cfg)
 	if err := server.Start(); err != nil {
 		log.Fatalf("[启动] 服务器启动失败: %v", err)
 	}
+	if pacURL := server.PACURL(); pacURL != "" {
+		log.Printf("[PAC] 浏览器自动代理配置地址: %s", pacURL)
+	}
 
 	// 使用 context 协调退出
 	ctx, cancel := context.WithCancel(context.Background())
@@ -91,12 +329,30 @@ func main() {
 	}
 
 	cancel()
-	server.Stop()
+	shutdown(server, logger)
+}
+
+// logCloseTimeout 退出时同步并关闭日志文件的时间上限
+const logCloseTimeout = 2 * time.Second
+
+// shutdown 按顺序退出：停止接受新连接、等待连接关闭并保存流量统计（均有时间上限，见 core.ShutdownTimeout），
+// 最后同步并关闭日志文件，任一步骤超时都不会阻止退出
+func shutdown(server *core.ProxyServer, logger *logging.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), core.ShutdownTimeout(server.GetConfig()))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[退出] 停止服务器失败: %v", err)
+	}
+	if logger != nil {
+		if err := logger.CloseTimeout(logCloseTimeout); err != nil {
+			log.Printf("[退出] %v", err)
+		}
+	}
 }
 
 func handleCommands(ctx context.Context, server *core.ProxyServer, cancel context.CancelFunc) {
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("\n[命令] 可用命令: restart, status, routing <mode>, stats, quit")
+	fmt.Println("\n[命令] 可用命令: restart, status, pause, resume, routing <mode>, stats, quit")
 
 	for {
 		select {
@@ -131,11 +387,155 @@ func handleCommands(ctx context.Context, server *core.ProxyServer, cancel contex
 		case "status":
 			cfg := server.GetConfig()
 			status := "运行中"
-			if !server.IsRunning() {
+			switch server.GetState() {
+			case core.StateStopped:
 				status = "已停止"
+			case core.StateStarting:
+				status = "正在启动"
+			case core.StatePaused:
+				status = "已暂停"
+			case core.StateStopping:
+				status = "正在停止"
 			}
 			fmt.Printf("[状态] %s\n  监听地址: %s\n  服务端: %s\n  分流模式: %s\n",
 				status, cfg.ListenAddr, cfg.ServerAddr, cfg.RoutingMode)
+			if pacURL := server.PACURL(); pacURL != "" {
+				fmt.Printf("  PAC 地址: %s\n", pacURL)
+			}
+			if addr := server.DNSAddr(); addr != nil {
+				fmt.Printf("  本地 DNS: %s (DoH: http://%s/dns-query)\n", addr, addr)
+			}
+			if cfg.MaxConnections > 0 {
+				fmt.Printf("  活动连接: %d / %d\n", server.ActiveConnections(), cfg.MaxConnections)
+			} else {
+				fmt.Printf("  活动连接: %d\n", server.ActiveConnections())
+			}
+			if rate := server.GetTotalRateLimitStatus(); rate.Limit > 0 {
+				fmt.Printf("  带宽限制: %s/s (当前 %s/s, %.0f%%)\n",
+					core.FormatBytes(rate.Limit), core.FormatBytes(rate.CurrentRate), rate.Utilization*100)
+			}
+			if hs := server.GetHandshakeStats(); hs.Samples > 0 {
+				fmt.Printf("  建立隧道耗时: p50 %v, p95 %v (最近 %d 次)\n",
+					hs.P50.Round(time.Millisecond), hs.P95.Round(time.Millisecond), hs.Samples)
+			}
+			if stats := server.GetTrafficStats(); stats != nil && cfg.FallbackDirect {
+				fmt.Printf("  降级直连: %d 次\n", stats.GetFallbackConnections())
+			}
+			if cfg.HealthCheckInterval > 0 {
+				switch h := server.GetHealth(); {
+				case h.LastCheckAt.IsZero():
+					fmt.Println("  健康检查: 尚未完成")
+				case !h.Healthy:
+					fmt.Printf("  健康检查: %s 不可用，连续失败 %d 次: %s\n", h.Server, h.ConsecutiveFailures, h.LastError)
+				case h.ConsecutiveFailures > 0:
+					fmt.Printf("  健康检查: %s 正常，最近失败 %d 次: %s\n", h.Server, h.ConsecutiveFailures, h.LastError)
+				default:
+					fmt.Printf("  健康检查: %s 正常，延迟 %v\n", h.Server, h.Latency.Round(time.Millisecond))
+				}
+			}
+			ech := server.GetECHStatus()
+			for _, d := range ech.Domains {
+				switch {
+				case d.ConfigSize > 0:
+					fmt.Printf("  ECH 配置: %s %d 字节，加载于 %s", d.Domain, d.ConfigSize, d.LoadedAt.Format(time.DateTime))
+					if d.Cached {
+						fmt.Print(" (来自缓存)")
+					} else if d.Resolver != "" {
+						fmt.Printf(" (DoH: %s)", d.Resolver)
+					}
+					if d.LastError != "" {
+						fmt.Printf("，最近刷新失败: %s", d.LastError)
+					}
+					fmt.Println()
+				case d.LastError != "":
+					fmt.Printf("  ECH 配置: %s 未加载: %s\n", d.Domain, d.LastError)
+				}
+			}
+			if ech.RefreshInterval > 0 {
+				last := "尚未刷新"
+				if !ech.LastRefreshAt.IsZero() {
+					last = "最近 " + ech.LastRefreshAt.Format(time.DateTime)
+				}
+				fmt.Printf("  ECH 后台刷新: 每 %v，%s，下次 %s\n", ech.RefreshInterval, last, ech.NextRefreshAt.Format(time.DateTime))
+			}
+			upstream := server.GetUpstreamStatus()
+			if len(upstream.Servers) > 1 {
+				fmt.Printf("  当前服务端: %s (负载均衡: %s)\n", upstream.ServerAddr, cfg.BalanceStrategy)
+				traffic := map[string]core.ServerTraffic{}
+				if stats := server.GetTrafficStats(); stats != nil {
+					for _, st := range stats.GetServerStats() {
+						traffic[st.Server] = st
+					}
+				}
+				for _, h := range upstream.Servers {
+					switch {
+					case h.Misconfigured:
+						fmt.Printf("    %s: 令牌被拒绝", h.Addr)
+					case h.LastError != "":
+						fmt.Printf("    %s: 扣分 %d，最近错误: %s (%s)", h.Addr, h.Penalty, h.LastError, h.FailureClass)
+					case !h.LastDialAt.IsZero():
+						fmt.Printf("    %s: 正常，建立耗时 %v", h.Addr, h.Latency.Round(time.Millisecond))
+					default:
+						fmt.Printf("    %s: 未连接", h.Addr)
+					}
+					if st, ok := traffic[h.Addr]; ok {
+						fmt.Printf("，隧道 %d 条，↑ %s  ↓ %s", st.Connections, core.FormatBytes(st.Upload), core.FormatBytes(st.Download))
+					}
+					fmt.Println()
+				}
+			}
+			if ips := server.GetServerIPStats(); len(ips) > 1 {
+				fmt.Println("  服务端 IP 测速:")
+				for _, ip := range ips {
+					mark := " "
+					if ip.Selected {
+						mark = "*"
+					}
+					switch {
+					case ip.Latency > 0:
+						fmt.Printf("   %s %s: %v\n", mark, ip.IP, ip.Latency.Round(time.Millisecond))
+					case ip.LastError != "":
+						fmt.Printf("   %s %s: 失败 %d 次，%s\n", mark, ip.IP, ip.Failures, ip.LastError)
+					default:
+						fmt.Printf("   %s %s: 尚未测速\n", mark, ip.IP)
+					}
+				}
+			}
+			if !upstream.LastDialAt.IsZero() {
+				fmt.Printf("  最近连接: %s\n", upstream.LastDialAt.Format("2006-01-02 15:04:05"))
+				if upstream.LastError != "" {
+					fmt.Printf("  最近错误: %s (%s)\n", upstream.LastError, upstream.FailureClass)
+				}
+				if upstream.Misconfigured {
+					fmt.Println("  服务端拒绝了令牌，修改配置前不再连接")
+				} else if upstream.Penalty > 0 {
+					fmt.Printf("  健康扣分: %d\n", upstream.Penalty)
+				}
+				if upstream.Colo != "" {
+					fmt.Printf("  机房: %s (CF-Ray: %s)\n", upstream.Colo, upstream.Headers["CF-Ray"])
+				}
+			}
+
+		case "pause":
+			if err := server.Pause(); err != nil {
+				fmt.Printf("[命令] 暂停失败: %v\n", err)
+			} else {
+				fmt.Println("[命令] 代理已暂停，输入 resume 恢复")
+			}
+
+		case "resume":
+			if err := server.Resume(); err != nil {
+				fmt.Printf("[命令] 恢复失败: %v\n", err)
+			} else {
+				fmt.Println("[命令] 代理已恢复")
+			}
+
+		case "flush":
+			flushed, err := server.FlushCaches()
+			fmt.Printf("[命令] 已清空: %s\n", strings.Join(flushed, ", "))
+			if err != nil {
+				fmt.Printf("[命令] 部分缓存清空失败: %v\n", err)
+			}
 
 		case "routing":
 			if len(parts) < 2 {
@@ -149,8 +549,8 @@ func handleCommands(ctx context.Context, server *core.ProxyServer, cancel contex
 			}
 			cfg := server.GetConfig()
 			cfg.RoutingMode = mode
-			fmt.Printf("[命令] 正在切换分流模式为 %s 并重启...\n", mode)
-			if err := server.UpdateConfig(cfg); err != nil {
+			fmt.Printf("[命令] 正在切换分流模式为 %s...\n", mode)
+			if err := server.Reload(cfg); err != nil {
 				fmt.Printf("[命令] 切换失败: %v\n", err)
 			} else {
 				fmt.Printf("[命令] 分流模式已切换为 %s\n", mode)
@@ -170,6 +570,64 @@ func handleCommands(ctx context.Context, server *core.ProxyServer, cancel contex
 				fmt.Print(server.GetTrafficStats().PrintStats())
 			}
 
+		case "conns":
+			conns := server.GetActiveConnections()
+			if len(conns) == 0 {
+				fmt.Println("[连接] 当前没有活动连接")
+			}
+			for _, c := range conns {
+				route := "代理"
+				if c.Direct {
+					route = "直连"
+				}
+				fmt.Printf("[连接] #%d %s -> %s (%s) 建立 %v, 已持续 %s, ↑%s ↓%s, 平均 %s/s\n",
+					c.ConnID, c.ClientAddr, c.Target, route, c.HandshakeTime.Round(time.Millisecond),
+					time.Since(c.StartedAt).Round(time.Second), core.FormatBytes(c.Upload), core.FormatBytes(c.Download),
+					core.FormatBytes(c.Throughput))
+			}
+
+		case "kill":
+			if len(parts) < 2 {
+				fmt.Println("[命令] 用法: kill <连接编号>，编号见 conns")
+				continue
+			}
+			id, err := strconv.ParseUint(strings.TrimPrefix(parts[1], "#"), 10, 64)
+			if err != nil {
+				fmt.Printf("[命令] 无效的连接编号: %s\n", parts[1])
+				continue
+			}
+			if server.CloseConnection(id) {
+				fmt.Printf("[连接] 已关闭连接 #%d\n", id)
+			} else {
+				fmt.Printf("[连接] 连接 #%d 不存在或已结束\n", id)
+			}
+
+		case "token":
+			if len(parts) < 2 {
+				fmt.Println("[命令] 用法: token <新令牌>")
+				continue
+			}
+			fmt.Println("[命令] 正在验证新令牌...")
+			if err := server.UpdateToken(parts[1]); err != nil {
+				fmt.Printf("[命令] 更换令牌失败，仍使用原令牌: %v\n", err)
+			} else {
+				fmt.Println("[命令] 令牌已更换，现有连接不受影响")
+			}
+
+		case "debug":
+			in := server.GetInternals()
+			fmt.Printf("[调试] goroutine %d, 堆 %s (使用中 %s, 对象 %d, GC %d 次)\n",
+				in.Goroutines, core.FormatBytes(int64(in.HeapAlloc)), core.FormatBytes(int64(in.HeapInuse)), in.HeapObjects, in.NumGC)
+			fmt.Printf("[调试] 连接 %d (上游 %d), UDP 关联 %d, 固定 IP %d, 站点统计 %d, 限速规则 %d, ECH 配置 %d 字节\n",
+				in.Conns, in.Upstreams, in.UDPAssociations, in.DNSPins, in.StatsSites, in.HostRateLimits, in.ECHConfigSize)
+			for _, b := range server.GetBufferStats() {
+				fmt.Printf("[调试] %s: %d/%d\n", b.Name, b.Len, b.Cap)
+			}
+			for _, pin := range server.GetDNSPins() {
+				fmt.Printf("[调试] 固定 IP %s -> %s (命中 %d 次, %s 后过期)\n",
+					pin.Host, pin.IP, pin.Hits, time.Until(pin.ExpiresAt).Round(time.Second))
+			}
+
 		case "quit", "exit", "q":
 			fmt.Println("[命令] 正在退出...")
 			cancel()
@@ -192,9 +650,16 @@ func printHelp() {
 	fmt.Println(`[命令] 可用命令:
   restart        - 重启代理服务器
   status         - 查看服务器状态
+  pause          - 暂停代理，保留 ECH 配置和统计
+  resume         - 恢复代理
+  flush          - 清空 DNS/ECH/IP 列表等缓存（切换网络后使用）
   routing <mode> - 切换分流模式 (global/bypass_cn/none)
   stats          - 查看流量统计
+  conns          - 查看活动连接的编号、建立耗时和吞吐量
+  kill <id>      - 强制关闭编号为 id 的活动连接
+  token <token>  - 验证并更换令牌，不重启、不中断现有连接
   stats reset    - 重置流量统计
   stats save     - 保存流量统计到文件
+  debug          - 查看 goroutine 数、堆内存、内部表大小及直连固定的 IP
   quit/exit/q    - 退出程序`)
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+)
+
+// nodesFile node add 保存的节点，位于存储目录下，每行一个分享链接，格式同订阅内容（见 core.ParseNodeList）
+const nodesFile = "nodes.txt"
+
+// loadNodes 读取已保存的节点，文件不存在时返回空列表
+func loadNodes(storeDir string) ([]core.Node, error) {
+	path := filepath.Join(storeDir, nodesFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	nodes, err := core.ParseNodeList(data)
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 失败: %w", path, err)
+	}
+	return nodes, nil
+}
+
+// saveNodes 保存节点列表，先写入临时文件再替换，写入中途退出不会损坏原文件
+func saveNodes(storeDir string, nodes []core.Node) error {
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, n := range nodes {
+		b.WriteString(n.URI() + "\n")
+	}
+	path := filepath.Join(storeDir, nodesFile)
+	tmp := path + ".tmp"
+	// 节点链接包含令牌，只允许当前用户读取
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// nodeIndex 返回名为 name 的节点的下标，不存在时返回 -1
+func nodeIndex(nodes []core.Node, name string) int {
+	return slices.IndexFunc(nodes, func(n core.Node) bool { return n.Name == name })
+}
+
+// resolveNode 将 arg 解析为节点：包含 "://" 时按分享链接解析，否则查找 node add 保存的同名节点
+func resolveNode(storeDir, arg string) (core.Node, error) {
+	if strings.Contains(arg, "://") {
+		return core.ParseNodeURI(arg)
+	}
+	nodes, err := loadNodes(storeDir)
+	if err != nil {
+		return core.Node{}, err
+	}
+	if i := nodeIndex(nodes, arg); i >= 0 {
+		return nodes[i], nil
+	}
+	return core.Node{}, fmt.Errorf("没有名为 %q 的节点，用 node list 查看已保存的节点", arg)
+}
+
+// runNode 实现 node 子命令：add 保存分享链接，list 列出已保存的节点（名称和链接以制表符分隔），
+// remove 按名称删除，test 按全局参数逐个测试连接，未指定节点时测试全部已保存的节点，任一失败时返回错误
+func runNode(storeDir string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("用法: node add <链接>... | list | remove <名称>... | test [名称或链接]...")
+	}
+	nodes, err := loadNodes(storeDir)
+	if err != nil {
+		return err
+	}
+	switch op, names := args[0], args[1:]; op {
+	case "add":
+		if len(names) == 0 {
+			return errors.New("用法: node add <链接>...")
+		}
+		for _, uri := range names {
+			n, err := core.ParseNodeURI(uri)
+			if err != nil {
+				return err
+			}
+			if nodeIndex(nodes, n.Name) >= 0 {
+				return fmt.Errorf("已存在名为 %q 的节点，可在链接末尾用 #名称 指定其他名称", n.Name)
+			}
+			nodes = append(nodes, n)
+		}
+		if err := saveNodes(storeDir, nodes); err != nil {
+			return err
+		}
+		for _, n := range nodes[len(nodes)-len(names):] {
+			fmt.Printf("已添加节点 %s (%s:%d)\n", n.Name, n.Address, n.Port)
+		}
+
+	case "list":
+		for _, n := range nodes {
+			fmt.Printf("%s\t%s\n", n.Name, n.URI())
+		}
+
+	case "remove":
+		if len(names) == 0 {
+			return errors.New("用法: node remove <名称>...")
+		}
+		for _, name := range names {
+			i := nodeIndex(nodes, name)
+			if i < 0 {
+				return fmt.Errorf("没有名为 %q 的节点", name)
+			}
+			nodes = slices.Delete(nodes, i, i+1)
+		}
+		if err := saveNodes(storeDir, nodes); err != nil {
+			return err
+		}
+		fmt.Printf("已删除 %d 个节点\n", len(names))
+
+	case "test":
+		targets := nodes
+		if len(names) > 0 {
+			targets = nil
+			for _, name := range names {
+				n, err := resolveNode(storeDir, name)
+				if err != nil {
+					return err
+				}
+				targets = append(targets, n)
+			}
+		}
+		if len(targets) == 0 {
+			return errors.New("没有已保存的节点，用 node add 添加")
+		}
+		base, _, err := buildConfig(storeDir)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, n := range targets {
+			cfg := base
+			n.ApplyTo(&cfg)
+			latency, err := core.TestConnection(context.Background(), cfg)
+			if err != nil {
+				failed++
+				fmt.Printf("%s\t失败\t%v\n", n.Name, err)
+				continue
+			}
+			fmt.Printf("%s\t可用\t%v\n", n.Name, latency.Round(time.Millisecond))
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d 个节点测试失败", failed)
+		}
+
+	default:
+		return fmt.Errorf("未知的操作 %q，可选: add, list, remove, test", op)
+	}
+	return nil
+}
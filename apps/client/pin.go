@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+)
+
+// pinDialTimeout pin 子命令连接服务端的超时
+const pinDialTimeout = 10 * time.Second
+
+// runPin 实现 pin 子命令：连接服务端，输出证书链中各证书的公钥固定值，供 -pin-spki 使用
+func runPin(args []string) {
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	addr := fs.String("f", getEnv("ECHPLUS_SERVER", ""), "服务端地址 (格式: x.x.workers.dev:443) [环境变量: ECHPLUS_SERVER]")
+	ip := fs.String("ip", getEnv("ECHPLUS_SERVER_IP", ""), "指定服务端 IP（绕过 DNS 解析）[环境变量: ECHPLUS_SERVER_IP]")
+	fs.Parse(args)
+	if *addr == "" {
+		log.Fatal("必须指定服务端地址 -f\n\n示例:\n  ./client pin -f your-worker.workers.dev:443")
+	}
+
+	host := strings.TrimPrefix(*addr, "wss://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	serverName, port, err := net.SplitHostPort(host)
+	if err != nil {
+		log.Fatalf("无效的服务器地址格式: %v", err)
+	}
+	dialAddr := host
+	if *ip != "" {
+		dialAddr = net.JoinHostPort(*ip, port)
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: pinDialTimeout},
+		Config:    &tls.Config{MinVersion: tls.VersionTLS13, ServerName: serverName},
+	}
+	conn, err := dialer.Dial("tcp", dialAddr)
+	if err != nil {
+		log.Fatalf("连接 %s 失败: %v", dialAddr, err)
+	}
+	defer conn.Close()
+
+	// 输出已验证的证书链，第一张为服务端证书
+	state := conn.(*tls.Conn).ConnectionState()
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+	for i, cert := range chain {
+		label := "证书链"
+		if i == 0 {
+			label = "服务端证书"
+		}
+		fmt.Fprintf(os.Stdout, "%s: %s\n  sha256/%s\n", label, cert.Subject, core.SPKIPin(cert))
+	}
+	fmt.Fprintf(os.Stdout, "\n使用 -pin-spki sha256/%s 固定服务端证书的公钥，"+
+		"加上 -pin-any-chain 后也可以填写证书链中其他证书的值\n", core.SPKIPin(chain[0]))
+}
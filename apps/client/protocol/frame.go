@@ -0,0 +1,230 @@
+// Package protocol 客户端与服务端共用的隧道帧格式、子协议协商及 WebSocket 消息读写。
+// 解码错误会由服务端作为 ERROR 帧的原因发回客户端，因此错误信息使用英文
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// FramingSubprotocol 二进制帧协议的子协议名。客户端在令牌之后附带该子协议时，
+// 服务端在响应中选中它并改用二进制帧；未附带的旧客户端（或回显令牌的旧服务端）继续使用文本控制消息
+const FramingSubprotocol = "echplus-binary.v1"
+
+// ResumeSubprotocol 可恢复隧道子协议，帧格式与 FramingSubprotocol 相同，另外:
+//
+//	CONNECTED  服务端 -> 客户端  payload 为恢复令牌
+//	RESUME     客户端 -> 服务端  WebSocket 异常断开后新连接的第一帧，target 为恢复令牌，
+//	                             payload 为客户端已收到的数据字节数（8 字节大端）
+//	RESUMED    服务端 -> 客户端  payload 为服务端已收到的数据字节数，
+//	                             随后双方从对方已收到的位置重发数据
+//
+// 客户端以 WebSocket 正常关闭（1000）结束会话，异常断开时服务端保留目标连接等待恢复。
+// 服务端未启用恢复时选中 FramingSubprotocol，隧道按原方式工作
+const ResumeSubprotocol = "echplus-binary.v2"
+
+// PaddingSuffix 附加在帧格式子协议之后（如 "echplus-binary.v1+pad"），选中时客户端可发送填充帧:
+// opcode 带 OpPadded 标志，消息末尾为随机填充及其长度（2 字节大端），解码时去除，见 Pad。
+// 不支持的旧服务端忽略带后缀的子协议，选中其后不带后缀的同一帧格式，客户端据此不再填充
+const PaddingSuffix = "+pad"
+
+// 二进制帧格式（均为 WebSocket 二进制消息）:
+//
+//	+--------+----------------+----------------+---------+
+//	| opcode | target length  | target         | payload |
+//	| 1 byte | 2 bytes (大端) | target length  | 剩余部分 |
+//	+--------+----------------+----------------+---------+
+//
+// 目标地址仅在 CONNECT 帧中出现，其余帧 target length 为 0（RESUME 帧的 target 为恢复令牌，
+// BIND 帧的 target 为客户端期望的对端地址，BOUND 帧的 target 为监听地址或对端地址）
+const (
+	OpConnect   byte = 0x01
+	OpData      byte = 0x02
+	OpClose     byte = 0x03
+	OpConnected byte = 0x04
+	OpError     byte = 0x05
+	OpResume    byte = 0x06 // 仅 ResumeSubprotocol
+	OpResumed   byte = 0x07
+	OpBind      byte = 0x08 // SOCKS5 BIND
+	OpBound     byte = 0x09
+
+	OpPadded byte = 0x80 // 填充帧标志，仅协商了 PaddingSuffix 时有效
+)
+
+// HeaderSize 二进制帧头部（opcode 和 target length）的长度
+const HeaderSize = 3
+
+// 文本控制消息，CONNECT 消息为 "CONNECT:<target>|<首帧数据>"
+const (
+	MsgConnect   = "CONNECT:"
+	MsgConnected = "CONNECTED"
+	MsgError     = "ERROR:"
+	MsgClose     = "CLOSE"
+)
+
+// Frame 隧道协议帧，ERROR 帧的 Payload 为错误原因
+type Frame struct {
+	Op      byte
+	Target  string
+	Payload []byte
+}
+
+// Codec 在协议帧和 WebSocket 消息之间转换
+type Codec interface {
+	Encode(f Frame) (messageType int, data []byte, err error)
+	// Decode 解码一条消息，无法识别的文本消息返回 Op 为 0 的帧，调用方应忽略
+	Decode(messageType int, data []byte) (Frame, error)
+}
+
+// SplitSubprotocol 去除 PaddingSuffix，返回帧格式子协议及是否接受填充帧
+func SplitSubprotocol(protocol string) (base string, padded bool) {
+	return strings.CutSuffix(protocol, PaddingSuffix)
+}
+
+// CodecForSubprotocol 根据协商出的子协议选择编解码器
+func CodecForSubprotocol(protocol string) Codec {
+	base, padded := SplitSubprotocol(protocol)
+	if base == FramingSubprotocol || base == ResumeSubprotocol {
+		return BinaryCodec{Padded: padded}
+	}
+	return TextCodec{}
+}
+
+// BinaryCodec 长度前缀二进制帧，Padded 为 true 时解码时去除填充帧的填充
+type BinaryCodec struct {
+	Padded bool
+}
+
+func (BinaryCodec) Encode(f Frame) (int, []byte, error) {
+	if len(f.Target) > 0xFFFF {
+		return 0, nil, fmt.Errorf("target too long: %d bytes", len(f.Target))
+	}
+	buf := make([]byte, HeaderSize+len(f.Target)+len(f.Payload))
+	buf[0] = f.Op
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(f.Target)))
+	n := copy(buf[HeaderSize:], f.Target)
+	copy(buf[HeaderSize+n:], f.Payload)
+	return websocket.BinaryMessage, buf, nil
+}
+
+func (c BinaryCodec) Decode(mt int, data []byte) (Frame, error) {
+	if mt != websocket.BinaryMessage {
+		return Frame{}, errors.New("unexpected text message in binary framing")
+	}
+	if len(data) < HeaderSize {
+		return Frame{}, fmt.Errorf("frame too short: %d bytes", len(data))
+	}
+	op := data[0]
+	if c.Padded && op&OpPadded != 0 {
+		// 末尾 2 字节为填充长度，去除后按普通帧解码
+		if len(data) < HeaderSize+2 {
+			return Frame{}, fmt.Errorf("padded frame too short: %d bytes", len(data))
+		}
+		end := len(data) - 2 - int(binary.BigEndian.Uint16(data[len(data)-2:]))
+		if end < HeaderSize {
+			return Frame{}, fmt.Errorf("padding exceeds frame: %d bytes", len(data))
+		}
+		op, data = op&^OpPadded, data[:end]
+	}
+	targetLen := int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < HeaderSize+targetLen {
+		return Frame{}, fmt.Errorf("truncated frame: target length %d, frame %d bytes", targetLen, len(data))
+	}
+	f := Frame{
+		Op:     op,
+		Target: string(data[HeaderSize : HeaderSize+targetLen]),
+	}
+	if rest := data[HeaderSize+targetLen:]; len(rest) > 0 {
+		f.Payload = rest
+	}
+	switch f.Op {
+	case OpConnect, OpData, OpClose, OpConnected, OpError, OpResume, OpResumed, OpBind, OpBound:
+		return f, nil
+	}
+	return Frame{}, fmt.Errorf("unknown opcode 0x%02x", f.Op)
+}
+
+// Pad 为 BinaryCodec 编码出的消息 data 附加 n 字节随机填充及其长度，并在 opcode 上设置 OpPadded。
+// 只能发给协商了 PaddingSuffix 的对端
+func Pad(data []byte, n int) []byte {
+	padding := make([]byte, n+2)
+	for i := range n {
+		padding[i] = byte(rand.Uint32())
+	}
+	binary.BigEndian.PutUint16(padding[n:], uint16(n))
+	data[0] |= OpPadded
+	return append(data, padding...)
+}
+
+// TextCodec 旧版文本控制消息，数据以二进制消息原样传输:
+//
+//	客户端 -> 服务端  文本  "CONNECT:<host:port>|<首帧数据>"
+//	服务端 -> 客户端  文本  "CONNECTED" 或 "ERROR:<原因>"
+//	双向              二进制  转发数据
+//	双向              文本  "CLOSE" 表示本方向数据已发送完毕
+//
+// 目标地址或首帧数据中的 "|" 会破坏解析，双方支持时改用 BinaryCodec
+type TextCodec struct{}
+
+func (TextCodec) Encode(f Frame) (int, []byte, error) {
+	switch f.Op {
+	case OpConnect:
+		return websocket.TextMessage, []byte(MsgConnect + f.Target + "|" + string(f.Payload)), nil
+	case OpData:
+		return websocket.BinaryMessage, f.Payload, nil
+	case OpClose:
+		return websocket.TextMessage, []byte(MsgClose), nil
+	case OpConnected:
+		return websocket.TextMessage, []byte(MsgConnected), nil
+	case OpError:
+		return websocket.TextMessage, append([]byte(MsgError), f.Payload...), nil
+	}
+	return 0, nil, fmt.Errorf("unknown opcode 0x%02x", f.Op)
+}
+
+func (TextCodec) Decode(mt int, data []byte) (Frame, error) {
+	if mt == websocket.BinaryMessage {
+		return Frame{Op: OpData, Payload: data}, nil
+	}
+	s := string(data)
+	switch {
+	case s == MsgClose:
+		return Frame{Op: OpClose}, nil
+	case s == MsgConnected:
+		return Frame{Op: OpConnected}, nil
+	case strings.HasPrefix(s, MsgError):
+		return Frame{Op: OpError, Payload: data[len(MsgError):]}, nil
+	case strings.HasPrefix(s, MsgConnect):
+		target, payload, err := ParseConnectMessage(data)
+		if err != nil {
+			return Frame{}, err
+		}
+		return Frame{Op: OpConnect, Target: target, Payload: payload}, nil
+	}
+	return Frame{}, nil
+}
+
+// ParseConnectMessage 解析文本 CONNECT 消息，返回目标地址和首帧数据
+func ParseConnectMessage(msg []byte) (target string, payload []byte, err error) {
+	s := string(msg)
+	if !strings.HasPrefix(s, MsgConnect) {
+		return "", nil, fmt.Errorf("unexpected message: %.32q", s)
+	}
+	target, rest, ok := strings.Cut(strings.TrimPrefix(s, MsgConnect), "|")
+	if !ok {
+		return "", nil, errors.New("malformed CONNECT message")
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", nil, fmt.Errorf("invalid target %q: %v", target, err)
+	}
+	if rest != "" {
+		payload = []byte(rest)
+	}
+	return target, payload, nil
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestCodecForSubprotocol 帧格式子协议选择二进制帧并识别填充后缀，其他子协议（回显的令牌）使用文本控制消息
+func TestCodecForSubprotocol(t *testing.T) {
+	for _, tc := range []struct {
+		protocol string
+		want     Codec
+	}{
+		{FramingSubprotocol, BinaryCodec{}},
+		{FramingSubprotocol + PaddingSuffix, BinaryCodec{Padded: true}},
+		{ResumeSubprotocol, BinaryCodec{}},
+		{ResumeSubprotocol + PaddingSuffix, BinaryCodec{Padded: true}},
+		{"token", TextCodec{}},
+		{"", TextCodec{}},
+	} {
+		if got := CodecForSubprotocol(tc.protocol); got != tc.want {
+			t.Errorf("CodecForSubprotocol(%q) = %#v, want %#v", tc.protocol, got, tc.want)
+		}
+	}
+}
+
+// TestBinaryCodec 各操作码的帧编码后按相同内容解码，带 OpPadded 的帧仅在协商了填充时去除填充
+func TestBinaryCodec(t *testing.T) {
+	frames := []Frame{
+		{Op: OpConnect, Target: "example.com:443", Payload: []byte("GET / HTTP/1.1\r\n")},
+		{Op: OpConnect, Target: "[2001:db8::1]:443"},
+		{Op: OpData, Payload: []byte("data|with|pipes")},
+		{Op: OpClose},
+		{Op: OpConnected, Payload: []byte("resume-token")},
+		{Op: OpError, Payload: []byte("forbidden")},
+		{Op: OpResume, Target: "resume-token", Payload: []byte{0, 0, 0, 0, 0, 0, 0, 42}},
+		{Op: OpResumed, Payload: []byte{0, 0, 0, 0, 0, 0, 0, 7}},
+		{Op: OpBind, Target: "198.51.100.1:0"},
+		{Op: OpBound, Target: "203.0.113.1:40000"},
+	}
+	for _, f := range frames {
+		mt, data, err := BinaryCodec{}.Encode(f)
+		if err != nil || mt != websocket.BinaryMessage {
+			t.Fatalf("Encode(%+v) = %d, %v", f, mt, err)
+		}
+		if got, err := (BinaryCodec{}).Decode(mt, data); err != nil || !reflect.DeepEqual(got, f) {
+			t.Errorf("Decode(Encode(%+v)) = %+v, %v", f, got, err)
+		}
+		for _, n := range []int{0, 1, 512} {
+			_, data, _ := BinaryCodec{}.Encode(f)
+			padded := Pad(data, n)
+			if got, err := (BinaryCodec{Padded: true}).Decode(mt, padded); err != nil || !reflect.DeepEqual(got, f) {
+				t.Errorf("padded Decode(%+v, %d bytes padding) = %+v, %v", f, n, got, err)
+			}
+			if _, err := (BinaryCodec{}).Decode(mt, padded); err == nil || !strings.Contains(err.Error(), "unknown opcode") {
+				t.Errorf("padded frame without negotiated padding: err = %v, want unknown opcode", err)
+			}
+		}
+	}
+
+	if _, _, err := (BinaryCodec{}).Encode(Frame{Op: OpConnect, Target: strings.Repeat("a", 0x10000)}); err == nil {
+		t.Error("Encode accepted a target longer than 0xFFFF bytes")
+	}
+}
+
+// TestBinaryCodecMalformed 截断、填充长度越界、未知操作码和文本消息均返回错误
+func TestBinaryCodecMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mt   int
+		data []byte
+		want string
+	}{
+		{"text message", websocket.TextMessage, []byte(MsgClose), "text message"},
+		{"empty", websocket.BinaryMessage, nil, "too short"},
+		{"short header", websocket.BinaryMessage, []byte{OpData, 0x00}, "too short"},
+		{"truncated target", websocket.BinaryMessage, []byte{OpConnect, 0x00, 0x10, 'a'}, "truncated"},
+		{"unknown opcode", websocket.BinaryMessage, []byte{0x7f, 0x00, 0x00}, "unknown opcode"},
+		{"short padded", websocket.BinaryMessage, []byte{OpData | OpPadded, 0x00, 0x00, 0x00}, "padded frame too short"},
+		{"padding exceeds frame", websocket.BinaryMessage, []byte{OpData | OpPadded, 0x00, 0x00, 0x00, 0x10}, "padding exceeds"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if f, err := (BinaryCodec{Padded: true}).Decode(tc.mt, tc.data); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Decode(%x) = %+v, %v, want error containing %q", tc.data, f, err, tc.want)
+			}
+		})
+	}
+}
+
+// TestTextCodec 文本控制消息的编解码，数据按二进制消息原样传输，无法识别的文本消息解码为 Op 为 0 的帧
+func TestTextCodec(t *testing.T) {
+	for _, f := range []Frame{
+		{Op: OpConnect, Target: "example.com:443", Payload: []byte("hello")},
+		{Op: OpConnect, Target: "[2001:db8::1]:443"},
+		{Op: OpData, Payload: []byte("raw")},
+		{Op: OpClose},
+		{Op: OpConnected},
+		{Op: OpError, Payload: []byte("forbidden")},
+	} {
+		mt, data, err := TextCodec{}.Encode(f)
+		if err != nil {
+			t.Fatalf("Encode(%+v): %v", f, err)
+		}
+		if got, err := (TextCodec{}).Decode(mt, data); err != nil || !reflect.DeepEqual(got, f) {
+			t.Errorf("Decode(Encode(%+v)) = %+v, %v", f, got, err)
+		}
+	}
+	if _, _, err := (TextCodec{}).Encode(Frame{Op: OpResume}); err == nil {
+		t.Error("Encode(RESUME) succeeded, want an error: text framing has no RESUME message")
+	}
+	if f, err := (TextCodec{}).Decode(websocket.TextMessage, []byte("PING")); err != nil || f.Op != 0 {
+		t.Errorf("Decode(unknown text) = %+v, %v, want an empty frame", f, err)
+	}
+}
+
+// TestParseConnectMessage 首帧数据中的 "|" 原样保留，缺少分隔符或目标不含端口时返回错误
+func TestParseConnectMessage(t *testing.T) {
+	target, payload, err := ParseConnectMessage([]byte(MsgConnect + "example.com:80|a|b"))
+	if err != nil || target != "example.com:80" || !bytes.Equal(payload, []byte("a|b")) {
+		t.Fatalf("got %q, %q, %v", target, payload, err)
+	}
+	for _, msg := range []string{"CONNECTED", MsgConnect + "example.com:80", MsgConnect + "example.com|"} {
+		if _, _, err := ParseConnectMessage([]byte(msg)); err == nil {
+			t.Errorf("ParseConnectMessage(%q) succeeded, want an error", msg)
+		}
+	}
+}
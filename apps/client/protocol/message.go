@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// MaxMessageSize 读取单条 WebSocket 消息的上限，远大于双方每个 DATA 帧的大小。
+// 双方以此调用 SetReadLimit，超过时 gorilla 以 1009 关闭连接，ReadMessage 不会为一条超大的消息无限增长缓冲区
+const MaxMessageSize = 1 << 20
+
+// ReadMessage 读取下一条消息到 buf，返回的数据在下次调用前有效，
+// 与 websocket.Conn.ReadMessage 相比不再为每条消息分配新的切片
+func ReadMessage(ws *websocket.Conn, buf *bytes.Buffer) (int, []byte, error) {
+	mt, r, err := ws.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+	buf.Reset()
+	// SetReadLimit 按线上的帧长计算，压缩的消息解压后另按 MaxMessageSize 限制
+	n, err := buf.ReadFrom(io.LimitReader(r, MaxMessageSize+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > MaxMessageSize {
+		return 0, nil, websocket.ErrReadLimit
+	}
+	return mt, buf.Bytes(), nil
+}
+
+// WriteMessage 编码帧并写入 ws。二进制 DATA 帧的头部和数据直接写入 WebSocket 的写缓冲区，
+// 不再拼接成新的消息
+func WriteMessage(ws *websocket.Conn, codec Codec, f Frame) error {
+	if _, ok := codec.(BinaryCodec); !ok || f.Op != OpData {
+		mt, data, err := codec.Encode(f)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(mt, data)
+	}
+	w, err := ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	header := [HeaderSize]byte{OpData}
+	if _, err := w.Write(header[:]); err != nil {
+		w.Close()
+		return err
+	}
+	if _, err := w.Write(f.Payload); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,163 @@
+// Package apply 按顺序把桌面端的操作应用到代理核心、系统代理和配置文件，失败时恢复操作前的状态。
+// 只通过 Core、SystemProxy 两个小接口和保存函数访问外部，不依赖 Wails，可以单独测试
+package apply
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/desktop/config"
+	"github.com/atticus6/echPlus/apps/desktop/logger"
+)
+
+// Core 代理核心，*core.ProxyServer 实现该接口
+type Core interface {
+	GetConfig() core.Config
+	Reload(cfg core.Config) error
+	Start() error
+	Stop() error
+	IsRunning() bool
+}
+
+// SystemProxy 系统的 SOCKS5 代理设置
+type SystemProxy interface {
+	Set(host, port string) error
+	Disable() error
+}
+
+// Result 操作结果，services 将其转换为发给前端的 ActionResult
+type Result struct {
+	Err               error    // 失败原因，为 nil 时操作成功
+	Warnings          []string // 不影响操作成功的问题
+	RollbackPerformed bool     // 失败后是否已恢复到操作前的状态
+}
+
+// warn 记录一条警告，操作本身仍视为成功
+func (r *Result) warn(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Info("[警告] %s", msg)
+	r.Warnings = append(r.Warnings, msg)
+}
+
+// fail 记录失败原因
+func (r *Result) fail(err error) {
+	logger.Error("%s", err.Error())
+	r.Err = err
+}
+
+// Start 启动核心后把系统代理设为 host:port。核心启动失败时不修改系统代理，设置系统代理失败只记录警告
+func Start(c Core, proxy SystemProxy, host, port string) (r Result) {
+	if err := c.Start(); err != nil {
+		r.fail(err)
+		return r
+	}
+	if err := proxy.Set(host, port); err != nil {
+		r.warn("设置系统代理失败: %s", err.Error())
+	}
+	return r
+}
+
+// Stop 停止核心后关闭系统代理。核心停止失败时保留系统代理设置，核心未运行时只关闭系统代理
+func Stop(c Core, proxy SystemProxy) (r Result) {
+	if c.IsRunning() {
+		if err := c.Stop(); err != nil {
+			r.fail(err)
+			return r
+		}
+	} else {
+		r.warn("代理未运行")
+	}
+	if err := proxy.Disable(); err != nil {
+		r.warn("关闭系统代理失败: %s", err.Error())
+	}
+	return r
+}
+
+// Config 桌面端配置与核心配置。对两者的修改都经 Update 串行执行，保证两者一致，
+// 并发的修改按顺序进行而不会互相覆盖或回滚到对方的中间状态
+type Config struct {
+	mu    sync.Mutex
+	core  Core
+	state *config.ConfigType
+	save  func(config.ConfigType) error
+}
+
+// NewConfig 创建 Config。state 为桌面端配置（通常为 &config.ConfigState），之后只应经 Config 修改；
+// save 持久化修改后的桌面端配置
+func NewConfig(c Core, state *config.ConfigType, save func(config.ConfigType) error) *Config {
+	return &Config{core: c, state: state, save: save}
+}
+
+// State 返回桌面端配置的副本，进行中的修改完成后才返回
+func (c *Config) State() config.ConfigType {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.state
+}
+
+// Do 在锁内以桌面端配置的副本调用 fn，fn 返回前不会进行其他修改。
+// 用于读取一致的状态，或修改核心中不属于桌面端配置的部分（如令牌）
+func (c *Config) Do(fn func(state config.ConfigType)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn(*c.state)
+}
+
+// Update 在锁内以桌面端配置和核心配置的副本调用 change，再按顺序应用修改：
+//   - change 返回错误时不做任何修改
+//   - 核心配置有变化时 Reload 核心，失败时恢复原核心配置，桌面端配置保持不变，恢复成功时 RollbackPerformed 为 true
+//   - 之后更新并保存桌面端配置，保存失败只记录警告，核心和内存中的配置保留修改后的值，下次保存时一并写入
+func (c *Config) Update(change func(state *config.ConfigType, cfg *core.Config) error) (r Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := *c.state
+	prevConfig := c.core.GetConfig()
+	cfg := prevConfig
+	if err := change(&state, &cfg); err != nil {
+		r.fail(err)
+		return r
+	}
+	if !reflect.DeepEqual(cfg, prevConfig) {
+		if err := c.core.Reload(cfg); err != nil {
+			r.fail(err)
+			if err := c.core.Reload(prevConfig); err != nil {
+				r.warn("恢复原配置失败: %s", err.Error())
+			} else {
+				r.RollbackPerformed = true
+			}
+			return r
+		}
+	}
+	*c.state = state
+	if err := c.save(state); err != nil {
+		r.warn("保存配置失败: %s", err.Error())
+	}
+	return r
+}
+
+// SelectNode 选中节点 id：经 lookup 取得节点，把其连接信息写入核心配置并 Reload，成功后保存选择。
+// 在 Update 内完成，并发的切换按顺序进行，保存的选择始终与核心应用的节点一致；失败时保持原选择和原核心配置
+func (c *Config) SelectNode(id int64, lookup func(id int64) (core.Node, error)) Result {
+	return c.Update(func(state *config.ConfigType, cfg *core.Config) error {
+		if id == 0 {
+			return errors.New("未选择节点")
+		}
+		n, err := lookup(id)
+		if err != nil {
+			return err
+		}
+		ApplyNode(cfg, *state, n)
+		state.SelectNodeId = id
+		return nil
+	})
+}
+
+// ApplyNode 将 n 的连接信息写入代理配置，节点未指定 ECH 域名时使用 state 中的全局设置
+func ApplyNode(cfg *core.Config, state config.ConfigType, n core.Node) {
+	n.ApplyTo(cfg)
+	cfg.ECHDomain = cmp.Or(n.ECHDomain, state.ECHDomain)
+}
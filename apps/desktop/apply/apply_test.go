@@ -0,0 +1,329 @@
+package apply
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/desktop/config"
+)
+
+// fakeCore 记录调用顺序的代理核心，对应的 err 字段不为 nil 时该操作失败
+type fakeCore struct {
+	mu        sync.Mutex
+	cfg       core.Config
+	running   bool
+	calls     []string
+	startErr  error
+	stopErr   error
+	reloadErr func(cfg core.Config) error
+}
+
+func (c *fakeCore) record(call string) {
+	c.calls = append(c.calls, call)
+}
+
+func (c *fakeCore) GetConfig() core.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
+func (c *fakeCore) Reload(cfg core.Config) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record("reload " + cfg.ServerAddr)
+	if c.reloadErr != nil {
+		if err := c.reloadErr(cfg); err != nil {
+			return err
+		}
+	}
+	c.cfg = cfg
+	return nil
+}
+
+func (c *fakeCore) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record("start")
+	if c.startErr != nil {
+		return c.startErr
+	}
+	c.running = true
+	return nil
+}
+
+func (c *fakeCore) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record("stop")
+	if c.stopErr != nil {
+		return c.stopErr
+	}
+	c.running = false
+	return nil
+}
+
+func (c *fakeCore) IsRunning() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
+
+// fakeProxy 记录对系统代理的设置
+type fakeProxy struct {
+	core       *fakeCore // 调用记录写入 core.calls，便于检查先后顺序
+	set        string
+	setErr     error
+	disableErr error
+}
+
+func (p *fakeProxy) Set(host, port string) error {
+	p.core.record("proxy set")
+	if p.setErr != nil {
+		return p.setErr
+	}
+	p.set = host + ":" + port
+	return nil
+}
+
+func (p *fakeProxy) Disable() error {
+	p.core.record("proxy disable")
+	if p.disableErr != nil {
+		return p.disableErr
+	}
+	p.set = ""
+	return nil
+}
+
+// TestStart 核心启动成功后才设置系统代理，核心失败时不修改系统代理，系统代理失败只是警告
+func TestStart(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		c := &fakeCore{}
+		p := &fakeProxy{core: c}
+		r := Start(c, p, "127.0.0.1", "1080")
+		if r.Err != nil || len(r.Warnings) != 0 || !slices.Equal(c.calls, []string{"start", "proxy set"}) || p.set != "127.0.0.1:1080" {
+			t.Fatalf("Start = %+v, calls %q, proxy %q", r, c.calls, p.set)
+		}
+	})
+	t.Run("core fails", func(t *testing.T) {
+		c := &fakeCore{startErr: errors.New("监听失败")}
+		p := &fakeProxy{core: c}
+		r := Start(c, p, "127.0.0.1", "1080")
+		if r.Err == nil || !slices.Equal(c.calls, []string{"start"}) || p.set != "" {
+			t.Fatalf("Start = %+v, calls %q, proxy %q, want the system proxy untouched", r, c.calls, p.set)
+		}
+	})
+	t.Run("proxy set fails", func(t *testing.T) {
+		c := &fakeCore{}
+		p := &fakeProxy{core: c, setErr: errors.New("gsettings 不可用")}
+		r := Start(c, p, "127.0.0.1", "1080")
+		if r.Err != nil || len(r.Warnings) != 1 || !c.running {
+			t.Fatalf("Start = %+v, running %v, want success with a warning", r, c.running)
+		}
+	})
+}
+
+// TestStop 核心停止成功后才关闭系统代理，核心停止失败时保留系统代理，未运行时只关闭系统代理
+func TestStop(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		c := &fakeCore{running: true}
+		p := &fakeProxy{core: c, set: "127.0.0.1:1080"}
+		r := Stop(c, p)
+		if r.Err != nil || len(r.Warnings) != 0 || !slices.Equal(c.calls, []string{"stop", "proxy disable"}) || p.set != "" {
+			t.Fatalf("Stop = %+v, calls %q, proxy %q", r, c.calls, p.set)
+		}
+	})
+	t.Run("core fails", func(t *testing.T) {
+		c := &fakeCore{running: true, stopErr: errors.New("停止超时")}
+		p := &fakeProxy{core: c, set: "127.0.0.1:1080"}
+		r := Stop(c, p)
+		if r.Err == nil || !slices.Equal(c.calls, []string{"stop"}) || p.set != "127.0.0.1:1080" {
+			t.Fatalf("Stop = %+v, calls %q, proxy %q, want the system proxy kept", r, c.calls, p.set)
+		}
+	})
+	t.Run("not running", func(t *testing.T) {
+		c := &fakeCore{}
+		p := &fakeProxy{core: c, set: "127.0.0.1:1080", disableErr: errors.New("gsettings 不可用")}
+		r := Stop(c, p)
+		if r.Err != nil || len(r.Warnings) != 2 || !slices.Equal(c.calls, []string{"proxy disable"}) {
+			t.Fatalf("Stop = %+v, calls %q, want two warnings and no core call", r, c.calls)
+		}
+	})
+}
+
+// newTestConfig 创建 Config，保存的配置记录在 saved 中，saveErr 不为 nil 时保存失败
+func newTestConfig(c *fakeCore, state *config.ConfigType, saved *[]config.ConfigType, saveErr *error) *Config {
+	return NewConfig(c, state, func(st config.ConfigType) error {
+		if *saveErr != nil {
+			return *saveErr
+		}
+		*saved = append(*saved, st)
+		return nil
+	})
+}
+
+// selectNode 选中节点 id 并把核心的服务端改为 addr 的修改
+func selectNode(id int64, addr string) func(*config.ConfigType, *core.Config) error {
+	return func(state *config.ConfigType, cfg *core.Config) error {
+		state.SelectNodeId = id
+		cfg.ServerAddr = addr
+		return nil
+	}
+}
+
+// TestUpdate 修改失败时桌面端配置和核心配置都保持原值，保存失败时保留修改并给出警告
+func TestUpdate(t *testing.T) {
+	prev := core.Config{ServerAddr: "wss://a.example.com/"}
+
+	t.Run("ok", func(t *testing.T) {
+		c := &fakeCore{cfg: prev}
+		state, saved, saveErr := config.ConfigType{SelectNodeId: 1}, []config.ConfigType(nil), error(nil)
+		r := newTestConfig(c, &state, &saved, &saveErr).Update(selectNode(2, "wss://b.example.com/"))
+		if r.Err != nil || len(r.Warnings) != 0 || state.SelectNodeId != 2 || c.cfg.ServerAddr != "wss://b.example.com/" {
+			t.Fatalf("Update = %+v, state %+v, core %q", r, state, c.cfg.ServerAddr)
+		}
+		if len(saved) != 1 || saved[0].SelectNodeId != 2 {
+			t.Fatalf("saved %+v, want the new selection once", saved)
+		}
+	})
+
+	t.Run("change fails", func(t *testing.T) {
+		c := &fakeCore{cfg: prev}
+		state, saved, saveErr := config.ConfigType{SelectNodeId: 1}, []config.ConfigType(nil), error(nil)
+		r := newTestConfig(c, &state, &saved, &saveErr).Update(func(state *config.ConfigType, cfg *core.Config) error {
+			state.SelectNodeId = 2
+			cfg.ServerAddr = "wss://b.example.com/"
+			return errors.New("节点不存在: 2")
+		})
+		if r.Err == nil || r.RollbackPerformed || state.SelectNodeId != 1 || len(c.calls) != 0 || len(saved) != 0 {
+			t.Fatalf("Update = %+v, state %+v, calls %q, saved %+v, want nothing applied", r, state, c.calls, saved)
+		}
+	})
+
+	t.Run("core fails", func(t *testing.T) {
+		c := &fakeCore{cfg: prev, reloadErr: func(cfg core.Config) error {
+			if cfg.ServerAddr != prev.ServerAddr {
+				return errors.New("获取 ECH 配置失败")
+			}
+			return nil
+		}}
+		state, saved, saveErr := config.ConfigType{SelectNodeId: 1}, []config.ConfigType(nil), error(nil)
+		r := newTestConfig(c, &state, &saved, &saveErr).Update(selectNode(2, "wss://b.example.com/"))
+		if r.Err == nil || !r.RollbackPerformed || len(r.Warnings) != 0 {
+			t.Fatalf("Update = %+v, want a failure with the rollback performed", r)
+		}
+		if state.SelectNodeId != 1 || !reflect.DeepEqual(c.cfg, prev) || len(saved) != 0 {
+			t.Fatalf("after failed Update: state %+v, core %+v, saved %+v, want the previous values", state, c.cfg, saved)
+		}
+		if want := []string{"reload wss://b.example.com/", "reload " + prev.ServerAddr}; !slices.Equal(c.calls, want) {
+			t.Fatalf("calls %q, want %q", c.calls, want)
+		}
+	})
+
+	t.Run("rollback fails", func(t *testing.T) {
+		c := &fakeCore{cfg: prev, reloadErr: func(core.Config) error { return errors.New("监听失败") }}
+		state, saved, saveErr := config.ConfigType{SelectNodeId: 1}, []config.ConfigType(nil), error(nil)
+		r := newTestConfig(c, &state, &saved, &saveErr).Update(selectNode(2, "wss://b.example.com/"))
+		if r.Err == nil || r.RollbackPerformed || len(r.Warnings) != 1 || state.SelectNodeId != 1 || len(saved) != 0 {
+			t.Fatalf("Update = %+v, state %+v, want a failure with a rollback warning", r, state)
+		}
+	})
+
+	t.Run("persist fails", func(t *testing.T) {
+		c := &fakeCore{cfg: prev}
+		state, saved, saveErr := config.ConfigType{SelectNodeId: 1}, []config.ConfigType(nil), errors.New("磁盘已满")
+		r := newTestConfig(c, &state, &saved, &saveErr).Update(selectNode(2, "wss://b.example.com/"))
+		if r.Err != nil || r.RollbackPerformed || len(r.Warnings) != 1 {
+			t.Fatalf("Update = %+v, want success with a warning", r)
+		}
+		if state.SelectNodeId != 2 || c.cfg.ServerAddr != "wss://b.example.com/" {
+			t.Fatalf("after failed save: state %+v, core %q, want the new values kept", state, c.cfg.ServerAddr)
+		}
+	})
+
+	t.Run("core unchanged", func(t *testing.T) {
+		c := &fakeCore{cfg: prev}
+		state, saved, saveErr := config.ConfigType{}, []config.ConfigType(nil), error(nil)
+		r := newTestConfig(c, &state, &saved, &saveErr).Update(func(state *config.ConfigType, cfg *core.Config) error {
+			state.Advanced = map[string]any{"StoreDir": "/tmp"}
+			return nil
+		})
+		if r.Err != nil || len(c.calls) != 0 || len(saved) != 1 {
+			t.Fatalf("Update = %+v, calls %q, saved %d, want saved without a reload", r, c.calls, len(saved))
+		}
+	})
+}
+
+// TestSelectNodeConcurrent 并发切换节点：每次保存的选择都与此时核心应用的节点一致，
+// 结束时保存的选择、内存中的选择和核心配置三者一致；应用失败的节点不被保存
+func TestSelectNodeConcurrent(t *testing.T) {
+	nodes := map[int64]core.Node{}
+	for id := int64(1); id <= 4; id++ {
+		nodes[id] = core.Node{Address: fmt.Sprintf("node%d.example.com", id), Port: 443, Token: fmt.Sprint("token-", id)}
+	}
+	lookup := func(id int64) (core.Node, error) {
+		n, ok := nodes[id]
+		if !ok {
+			return core.Node{}, fmt.Errorf("节点不存在: %d", id)
+		}
+		return n, nil
+	}
+	addrOf := func(id int64) string {
+		var cfg core.Config
+		ApplyNode(&cfg, config.ConfigType{}, nodes[id])
+		return cfg.ServerAddr
+	}
+
+	c := &fakeCore{cfg: core.Config{}, reloadErr: func(cfg core.Config) error {
+		// 让出执行，使并发的切换有机会交错；节点 4 总是应用失败
+		runtime.Gosched()
+		if cfg.ServerAddr == addrOf(4) {
+			return errors.New("获取 ECH 配置失败")
+		}
+		return nil
+	}}
+	state := config.ConfigType{}
+	var saved []int64
+	configs := NewConfig(c, &state, func(st config.ConfigType) error {
+		// 保存时核心已应用的节点必须就是要保存的选择
+		runtime.Gosched()
+		if got, want := c.GetConfig().ServerAddr, addrOf(st.SelectNodeId); got != want {
+			t.Errorf("saving node %d while the core serves %q, want %q", st.SelectNodeId, got, want)
+		}
+		saved = append(saved, st.SelectNodeId)
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				id := int64((g+i)%5 + 1) // 节点 5 不存在
+				r := configs.SelectNode(id, lookup)
+				if (id <= 3) != (r.Err == nil) {
+					t.Errorf("SelectNode(%d) = %+v", id, r)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	final := configs.State().SelectNodeId
+	if len(saved) == 0 || saved[len(saved)-1] != final {
+		t.Fatalf("last saved selection %v, in memory %d", saved, final)
+	}
+	if got := c.GetConfig(); got.ServerAddr != addrOf(final) || got.Token != nodes[final].Token {
+		t.Fatalf("core serves %q with token %q, selection is node %d", got.ServerAddr, got.Token, final)
+	}
+	if slices.Contains(saved, 4) || slices.Contains(saved, 5) {
+		t.Fatalf("saved selections %v include a node that failed to apply", saved)
+	}
+}
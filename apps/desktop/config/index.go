@@ -2,10 +2,12 @@ package config
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/atticus6/echPlus/apps/client/core"
 )
@@ -17,6 +19,8 @@ type ConfigType struct {
 	ECHDomain    string
 	RoutingMode  core.RoutingMode
 	SelectNodeId int64
+	// Advanced 高级设置，键为 core.Config 字段名，值的格式见 core.SettingValues
+	Advanced map[string]any `json:",omitempty"`
 }
 
 var StoreDir string
@@ -56,12 +60,24 @@ func init() {
 }
 
 func (d *ConfigType) GetproxyConfig() core.Config {
+	cfg := d.BaseProxyConfig()
+	if err := core.ApplySettings(&cfg, d.Advanced); err != nil {
+		log.Printf("高级设置无效，已忽略: %v", err)
+	}
+	return cfg
+}
+
+// BaseProxyConfig 不含高级设置的代理配置，即高级设置在桌面端的默认值
+func (d *ConfigType) BaseProxyConfig() core.Config {
 	return core.Config{
-		ListenAddr:  fmt.Sprintf("%s:%d", d.ListenAddr, d.ListenPort),
-		DNSServer:   d.DNSServer,
-		RoutingMode: d.RoutingMode,
-		ECHDomain:   d.ECHDomain,
-		StoreDir:    StoreDir,
+		ListenAddr:   net.JoinHostPort(d.ListenAddr, strconv.FormatInt(d.ListenPort, 10)),
+		DNSServer:    d.DNSServer,
+		RoutingMode:  d.RoutingMode,
+		ECHDomain:    d.ECHDomain,
+		StoreDir:     StoreDir,
+		RequireECH:   true,
+		WatchNetwork: true,
+		IdleTimeout:  10 * time.Minute,
 	}
 }
 
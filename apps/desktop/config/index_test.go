@@ -0,0 +1,20 @@
+package config
+
+import "testing"
+
+// TestBaseProxyConfigListenAddr IPv6 监听地址加方括号后再拼接端口
+func TestBaseProxyConfigListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1", "127.0.0.1:1080"},
+		{"::1", "[::1]:1080"},
+		{"localhost", "localhost:1080"},
+	} {
+		d := ConfigType{ListenAddr: tc.addr, ListenPort: 1080}
+		if got := d.BaseProxyConfig().ListenAddr; got != tc.want {
+			t.Errorf("ListenAddr %q: got %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
@@ -2,5 +2,9 @@
 // This file is automatically generated. DO NOT EDIT
 
 export {
-    RoutingMode
+    RoutingMode,
+    ServerState,
+    Setting,
+    SettingType,
+    UpstreamStatus
 } from "./models.js";
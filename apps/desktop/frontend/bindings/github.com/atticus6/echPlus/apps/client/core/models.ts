@@ -5,6 +5,280 @@
 // @ts-ignore: Unused imports
 import { Create as $Create } from "@wailsio/runtime";
 
+/**
+ * ActiveConnection 正在处理的连接
+ */
+export class ActiveConnection {
+    "connId": number;
+    "clientAddr": string;
+    "target": string;
+    "direct": boolean;
+    "startedAt": any;
+
+    /**
+     * 建立耗时（纳秒），尚未建立完成时为 0，见 ConnectionRecord
+     */
+    "handshakeTime": number;
+
+    /**
+     * 已上传字节数
+     */
+    "upload": number;
+
+    /**
+     * 已下载字节数
+     */
+    "download": number;
+
+    /**
+     * 转发阶段至今的平均吞吐量（字节/秒，上传与下载之和）
+     */
+    "throughput": number;
+
+    /** Creates a new ActiveConnection instance. */
+    constructor($$source: Partial<ActiveConnection> = {}) {
+        if (!("connId" in $$source)) {
+            this["connId"] = 0;
+        }
+        if (!("clientAddr" in $$source)) {
+            this["clientAddr"] = "";
+        }
+        if (!("target" in $$source)) {
+            this["target"] = "";
+        }
+        if (!("direct" in $$source)) {
+            this["direct"] = false;
+        }
+        if (!("startedAt" in $$source)) {
+            this["startedAt"] = null;
+        }
+        if (!("handshakeTime" in $$source)) {
+            this["handshakeTime"] = 0;
+        }
+        if (!("upload" in $$source)) {
+            this["upload"] = 0;
+        }
+        if (!("download" in $$source)) {
+            this["download"] = 0;
+        }
+        if (!("throughput" in $$source)) {
+            this["throughput"] = 0;
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new ActiveConnection instance from a string or object.
+     */
+    static createFrom($$source: any = {}): ActiveConnection {
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        return new ActiveConnection($$parsedSource as Partial<ActiveConnection>);
+    }
+}
+
+/**
+ * ECHDomainStatus 一个 ECH 查询域名当前使用的配置
+ */
+export class ECHDomainStatus {
+    "domain": string;
+
+    /**
+     * ECH 配置的长度（字节），尚未加载时为 0
+     */
+    "configSize": number;
+
+    /**
+     * 配置最近一次加载成功的时间，来自缓存时为缓存中记录的查询时间
+     */
+    "loadedAt": any;
+
+    /**
+     * 配置来自 StoreDir 中的缓存，见 Config.ECHCacheMaxAge
+     */
+    "cached": boolean;
+
+    /**
+     * 查询到当前配置的 DoH 服务器（Config.DNSServer 中的写法），来自缓存或尚未加载时为空
+     */
+    "resolver": string;
+
+    /**
+     * 最近一次加载失败的原因，成功后清空
+     */
+    "lastError": string;
+
+    /** Creates a new ECHDomainStatus instance. */
+    constructor($$source: Partial<ECHDomainStatus> = {}) {
+        if (!("domain" in $$source)) {
+            this["domain"] = "";
+        }
+        if (!("configSize" in $$source)) {
+            this["configSize"] = 0;
+        }
+        if (!("loadedAt" in $$source)) {
+            this["loadedAt"] = null;
+        }
+        if (!("cached" in $$source)) {
+            this["cached"] = false;
+        }
+        if (!("resolver" in $$source)) {
+            this["resolver"] = "";
+        }
+        if (!("lastError" in $$source)) {
+            this["lastError"] = "";
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new ECHDomainStatus instance from a string or object.
+     */
+    static createFrom($$source: any = {}): ECHDomainStatus {
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        return new ECHDomainStatus($$parsedSource as Partial<ECHDomainStatus>);
+    }
+}
+
+/**
+ * ECHStatus 后台刷新 ECH 配置的状态，见 Config.ECHRefreshInterval
+ */
+export class ECHStatus {
+    /**
+     * 生效的刷新间隔（纳秒），0 表示不在后台刷新
+     */
+    "refreshInterval": number;
+
+    /**
+     * 最近一次后台刷新的时间，尚未刷新时为零值
+     */
+    "lastRefreshAt": any;
+
+    /**
+     * 下一次后台刷新的时间，不刷新时为零值
+     */
+    "nextRefreshAt": any;
+
+    /**
+     * 后台刷新连续失败的次数，成功后清零
+     */
+    "consecutiveFailures": number;
+
+    /**
+     * 最近一次后台刷新失败的原因，成功后清空
+     */
+    "lastError": string;
+
+    /**
+     * 当前配置使用的各查询域名，按服务端顺序排列
+     */
+    "domains": ECHDomainStatus[];
+
+    /** Creates a new ECHStatus instance. */
+    constructor($$source: Partial<ECHStatus> = {}) {
+        if (!("refreshInterval" in $$source)) {
+            this["refreshInterval"] = 0;
+        }
+        if (!("lastRefreshAt" in $$source)) {
+            this["lastRefreshAt"] = null;
+        }
+        if (!("nextRefreshAt" in $$source)) {
+            this["nextRefreshAt"] = null;
+        }
+        if (!("consecutiveFailures" in $$source)) {
+            this["consecutiveFailures"] = 0;
+        }
+        if (!("lastError" in $$source)) {
+            this["lastError"] = "";
+        }
+        if (!("domains" in $$source)) {
+            this["domains"] = [];
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new ECHStatus instance from a string or object.
+     */
+    static createFrom($$source: any = {}): ECHStatus {
+        const $$createField5_0 = $$createType5;
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        if ("domains" in $$parsedSource) {
+            $$parsedSource["domains"] = $$createField5_0($$parsedSource["domains"]);
+        }
+        return new ECHStatus($$parsedSource as Partial<ECHStatus>);
+    }
+}
+
+/**
+ * Health 后台健康检查的结果，见 Config.HealthCheckInterval
+ */
+export class Health {
+    /**
+     * 最近一次检查的服务端
+     */
+    "server": string;
+
+    /**
+     * 连续失败次数未达到 HealthCheckFailures，尚未检查时为 true
+     */
+    "healthy": boolean;
+
+    /**
+     * 最近一次检查的时间，尚未检查时为零值
+     */
+    "lastCheckAt": any;
+
+    /**
+     * 连续失败次数，成功后清零
+     */
+    "consecutiveFailures": number;
+
+    /**
+     * 最近一次成功检查建立 WebSocket 的耗时（纳秒）
+     */
+    "latency": number;
+
+    /**
+     * 最近一次失败的原因，成功后清空
+     */
+    "lastError": string;
+
+    /** Creates a new Health instance. */
+    constructor($$source: Partial<Health> = {}) {
+        if (!("server" in $$source)) {
+            this["server"] = "";
+        }
+        if (!("healthy" in $$source)) {
+            this["healthy"] = false;
+        }
+        if (!("lastCheckAt" in $$source)) {
+            this["lastCheckAt"] = null;
+        }
+        if (!("consecutiveFailures" in $$source)) {
+            this["consecutiveFailures"] = 0;
+        }
+        if (!("latency" in $$source)) {
+            this["latency"] = 0;
+        }
+        if (!("lastError" in $$source)) {
+            this["lastError"] = "";
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new Health instance from a string or object.
+     */
+    static createFrom($$source: any = {}): Health {
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        return new Health($$parsedSource as Partial<Health>);
+    }
+}
+
 /**
  * RoutingMode 路由模式常量
  */
@@ -29,3 +303,405 @@ export enum RoutingMode {
      */
     RoutingModeNone = "none",
 };
+
+/**
+ * ServerState 代理服务器状态
+ */
+export enum ServerState {
+    /**
+     * The Go zero value for the underlying type of the enum.
+     */
+    $zero = "",
+
+    StateStopped = "stopped",
+    StateStarting = "starting",
+    StateRunning = "running",
+    StatePaused = "paused",
+    StateStopping = "stopping",
+};
+
+/**
+ * ServerHealth 单个服务端的健康状态，各字段含义同 UpstreamStatus
+ */
+export class ServerHealth {
+    "addr": string;
+    "lastDialAt": any;
+    "lastError": string;
+    "lastErrorCode": string;
+    "failureClass": string;
+    "penalty": number;
+    "misconfigured": boolean;
+
+    /**
+     * Latency 最近几次成功建立 WebSocket 的平滑耗时，尚未成功时为 0，用于 BalanceLatency
+     */
+    "latency": number;
+
+    /** Creates a new ServerHealth instance. */
+    constructor($$source: Partial<ServerHealth> = {}) {
+        if (!("addr" in $$source)) {
+            this["addr"] = "";
+        }
+        if (!("lastDialAt" in $$source)) {
+            this["lastDialAt"] = null;
+        }
+        if (!("lastError" in $$source)) {
+            this["lastError"] = "";
+        }
+        if (!("lastErrorCode" in $$source)) {
+            this["lastErrorCode"] = "";
+        }
+        if (!("failureClass" in $$source)) {
+            this["failureClass"] = "";
+        }
+        if (!("penalty" in $$source)) {
+            this["penalty"] = 0;
+        }
+        if (!("misconfigured" in $$source)) {
+            this["misconfigured"] = false;
+        }
+        if (!("latency" in $$source)) {
+            this["latency"] = 0;
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new ServerHealth instance from a string or object.
+     */
+    static createFrom($$source: any = {}): ServerHealth {
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        return new ServerHealth($$parsedSource as Partial<ServerHealth>);
+    }
+}
+
+/**
+ * ServerIPStats 一个 ServerIP 候选地址的测速结果
+ */
+export class ServerIPStats {
+    "ip": string;
+
+    /**
+     * 最近一次测得的 TCP 连接加 TLS 握手耗时（纳秒），0 表示尚未测速或测速失败
+     */
+    "latency": number;
+
+    /**
+     * 最近一次测速的时间
+     */
+    "probedAt": any;
+
+    /**
+     * 最近一次测速或连接失败的原因，成功后清空
+     */
+    "lastError": string;
+
+    /**
+     * 连续失败次数（测速和实际连接），成功后清零
+     */
+    "failures": number;
+
+    /**
+     * 当前连接服务端使用的地址
+     */
+    "selected": boolean;
+
+    /** Creates a new ServerIPStats instance. */
+    constructor($$source: Partial<ServerIPStats> = {}) {
+        if (!("ip" in $$source)) {
+            this["ip"] = "";
+        }
+        if (!("latency" in $$source)) {
+            this["latency"] = 0;
+        }
+        if (!("probedAt" in $$source)) {
+            this["probedAt"] = null;
+        }
+        if (!("lastError" in $$source)) {
+            this["lastError"] = "";
+        }
+        if (!("failures" in $$source)) {
+            this["failures"] = 0;
+        }
+        if (!("selected" in $$source)) {
+            this["selected"] = false;
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new ServerIPStats instance from a string or object.
+     */
+    static createFrom($$source: any = {}): ServerIPStats {
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        return new ServerIPStats($$parsedSource as Partial<ServerIPStats>);
+    }
+}
+
+/**
+ * Setting 描述 Config 的一个字段，图形界面据此生成设置项、显示默认值并在提交前校验。
+ * Settings 覆盖 Config 的全部字段，新增字段时须同时登记
+ */
+export class Setting {
+    /**
+     * Config 字段名，也是 SettingValues、ApplySettings 的键
+     */
+    "name": string;
+
+    /**
+     * 值类型
+     */
+    "type": SettingType;
+
+    /**
+     * 字段为零值时实际生效的值
+     */
+    "default": any;
+
+    /**
+     * 取值下限（含），int 为整数，duration 为时长字符串
+     */
+    "min"?: any;
+
+    /**
+     * 取值上限（含），格式同 Min
+     */
+    "max"?: any;
+
+    /**
+     * string 类型的可选值
+     */
+    "enum"?: string[];
+
+    /**
+     * 高级设置，界面默认收起
+     */
+    "advanced": boolean;
+
+    /**
+     * Reload 和 Restart 不会应用，需重新创建 ProxyServer
+     */
+    "restartRequired": boolean;
+
+    /**
+     * 帮助文本的本地化键
+     */
+    "helpKey": string;
+
+    /**
+     * 帮助文本，没有对应翻译时显示
+     */
+    "help": string;
+
+    /** Creates a new Setting instance. */
+    constructor($$source: Partial<Setting> = {}) {
+        if (!("name" in $$source)) {
+            this["name"] = "";
+        }
+        if (!("type" in $$source)) {
+            this["type"] = SettingType.$zero;
+        }
+        if (!("default" in $$source)) {
+            this["default"] = null;
+        }
+        if (!("advanced" in $$source)) {
+            this["advanced"] = false;
+        }
+        if (!("restartRequired" in $$source)) {
+            this["restartRequired"] = false;
+        }
+        if (!("helpKey" in $$source)) {
+            this["helpKey"] = "";
+        }
+        if (!("help" in $$source)) {
+            this["help"] = "";
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new Setting instance from a string or object.
+     */
+    static createFrom($$source: any = {}): Setting {
+        const $$createField5_0 = $$createType1;
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        if ("enum" in $$parsedSource) {
+            $$parsedSource["enum"] = $$createField5_0($$parsedSource["enum"]);
+        }
+        return new Setting($$parsedSource as Partial<Setting>);
+    }
+}
+
+/**
+ * SettingType 配置项的值类型，决定 SettingValues 返回和 ApplySettings 接受的格式
+ */
+export enum SettingType {
+    /**
+     * The Go zero value for the underlying type of the enum.
+     */
+    $zero = "",
+
+    /**
+     * 字符串，Enum 不为空时只能取其中之一
+     */
+    SettingString = "string",
+
+    /**
+     * 布尔值
+     */
+    SettingBool = "bool",
+
+    /**
+     * 整数
+     */
+    SettingInt = "int",
+
+    /**
+     * 时长字符串，如 "10s"、"1m30s"
+     */
+    SettingDuration = "duration",
+
+    /**
+     * 字符串数组
+     */
+    SettingStringList = "stringList",
+
+    /**
+     * 整数数组，Min、Max 限制每个元素
+     */
+    SettingIntList = "intList",
+
+    /**
+     * 字符串到整数的对象，如 {"*.example.com": 1048576}
+     */
+    SettingIntMap = "intMap",
+
+    /**
+     * ParseAppRules 格式的字符串
+     */
+    SettingAppRules = "appRules",
+
+    /**
+     * 无法序列化（如 *net.Resolver），只能直接设置 Config
+     */
+    SettingOther = "other",
+};
+
+/**
+ * UpstreamStatus 上游服务端状态。ServerAddr 配置了多个服务端时，LastDialAt 至 Misconfigured
+ * 描述当前使用的服务端，各服务端的状态见 Servers
+ */
+export class UpstreamStatus {
+    /**
+     * 当前使用的服务端：最近一次连接成功的地址，尚未成功时为第一个
+     */
+    "serverAddr": string;
+
+    /**
+     * 最近一次建立 WebSocket 的时间
+     */
+    "lastDialAt": any;
+
+    /**
+     * 最近一次建立失败的原因，成功后清空
+     */
+    "lastError": string;
+
+    /**
+     * 可识别的失败原因，见 UpstreamError* 常量
+     */
+    "lastErrorCode": string;
+
+    /**
+     * 最近一次建立失败的分类，见 UpstreamFailure* 常量，成功后清空
+     */
+    "failureClass": string;
+
+    /**
+     * 健康扣分，计入扣分的失败各加 1，成功后清零
+     */
+    "penalty": number;
+
+    /**
+     * 服务端拒绝了令牌，修改 ServerAddr、Token 或重新启动前不再连接
+     */
+    "misconfigured": boolean;
+
+    /**
+     * 从 CF-Ray 解析出的 Cloudflare 机房
+     */
+    "colo": string;
+
+    /**
+     * 最近一次成功升级的诊断头部
+     */
+    "headers": { [_: string]: string };
+
+    /**
+     * 按配置顺序排列的各服务端状态
+     */
+    "servers": ServerHealth[];
+
+    /** Creates a new UpstreamStatus instance. */
+    constructor($$source: Partial<UpstreamStatus> = {}) {
+        if (!("serverAddr" in $$source)) {
+            this["serverAddr"] = "";
+        }
+        if (!("lastDialAt" in $$source)) {
+            this["lastDialAt"] = null;
+        }
+        if (!("lastError" in $$source)) {
+            this["lastError"] = "";
+        }
+        if (!("lastErrorCode" in $$source)) {
+            this["lastErrorCode"] = "";
+        }
+        if (!("failureClass" in $$source)) {
+            this["failureClass"] = "";
+        }
+        if (!("penalty" in $$source)) {
+            this["penalty"] = 0;
+        }
+        if (!("misconfigured" in $$source)) {
+            this["misconfigured"] = false;
+        }
+        if (!("colo" in $$source)) {
+            this["colo"] = "";
+        }
+        if (!("headers" in $$source)) {
+            this["headers"] = {};
+        }
+        if (!("servers" in $$source)) {
+            this["servers"] = [];
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new UpstreamStatus instance from a string or object.
+     */
+    static createFrom($$source: any = {}): UpstreamStatus {
+        const $$createField8_0 = $$createType0;
+        const $$createField9_0 = $$createType3;
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        if ("headers" in $$parsedSource) {
+            $$parsedSource["headers"] = $$createField8_0($$parsedSource["headers"]);
+        }
+        if ("servers" in $$parsedSource) {
+            $$parsedSource["servers"] = $$createField9_0($$parsedSource["servers"]);
+        }
+        return new UpstreamStatus($$parsedSource as Partial<UpstreamStatus>);
+    }
+}
+
+// Private type creation functions
+const $$createType0 = $Create.Map($Create.Any, $Create.Any);
+const $$createType1 = $Create.Array($Create.Any);
+const $$createType2 = ServerHealth.createFrom;
+const $$createType3 = $Create.Array($$createType2);
+const $$createType4 = ECHDomainStatus.createFrom;
+const $$createType5 = $Create.Array($$createType4);
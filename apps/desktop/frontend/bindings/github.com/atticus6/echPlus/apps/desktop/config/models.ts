@@ -17,6 +17,11 @@ export class ConfigType {
     "RoutingMode": core$0.RoutingMode;
     "SelectNodeId": number;
 
+    /**
+     * Advanced 高级设置，键为 core.Config 字段名，值的格式见 core.SettingValues
+     */
+    "Advanced"?: { [_: string]: any };
+
     /** Creates a new ConfigType instance. */
     constructor($$source: Partial<ConfigType> = {}) {
         if (!("ListenAddr" in $$source)) {
@@ -45,7 +50,14 @@ export class ConfigType {
      * Creates a new ConfigType instance from a string or object.
      */
     static createFrom($$source: any = {}): ConfigType {
+        const $$createField6_0 = $$createType0;
         let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        if ("Advanced" in $$parsedSource) {
+            $$parsedSource["Advanced"] = $$createField6_0($$parsedSource["Advanced"]);
+        }
         return new ConfigType($$parsedSource as Partial<ConfigType>);
     }
 }
+
+// Private type creation functions
+const $$createType0 = $Create.Map($Create.Any, $Create.Any);
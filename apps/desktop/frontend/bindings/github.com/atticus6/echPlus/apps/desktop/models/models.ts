@@ -19,6 +19,11 @@ export class Node {
     "token": string;
     "address": string;
     "port": number;
+    "pinnedSPKI": string;
+    "pinAnyChain": boolean;
+    "http2": boolean;
+    "echDomain": string;
+    "fallbackServerHost": string;
     "created_at": time$0.Time;
     "updated_at": time$0.Time;
 
@@ -42,6 +47,21 @@ export class Node {
         if (!("port" in $$source)) {
             this["port"] = 0;
         }
+        if (!("pinnedSPKI" in $$source)) {
+            this["pinnedSPKI"] = "";
+        }
+        if (!("pinAnyChain" in $$source)) {
+            this["pinAnyChain"] = false;
+        }
+        if (!("http2" in $$source)) {
+            this["http2"] = false;
+        }
+        if (!("echDomain" in $$source)) {
+            this["echDomain"] = "";
+        }
+        if (!("fallbackServerHost" in $$source)) {
+            this["fallbackServerHost"] = "";
+        }
         if (!("created_at" in $$source)) {
             this["created_at"] = null;
         }
@@ -5,19 +5,63 @@
 // @ts-ignore: Unused imports
 import { Call as $Call, CancellablePromise as $CancellablePromise, Create as $Create } from "@wailsio/runtime";
 
+// eslint-disable-next-line @typescript-eslint/ban-ts-comment
+// @ts-ignore: Unused imports
+import * as core$0 from "../../client/core/models.js";
 // eslint-disable-next-line @typescript-eslint/ban-ts-comment
 // @ts-ignore: Unused imports
 import * as config$0 from "../config/models.js";
 
-export function ChangeValue(v: config$0.ConfigType): $CancellablePromise<void> {
-    return $Call.ByID(534687797, v);
+// eslint-disable-next-line @typescript-eslint/ban-ts-comment
+// @ts-ignore: Unused imports
+import * as $models from "./models.js";
+
+/**
+ * ChangeValue 修改配置并应用到代理，应用失败时恢复原配置
+ */
+export function ChangeValue(v: config$0.ConfigType): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(534687797, v).then(($result: any) => {
+        return $$createType0($result);
+    });
+}
+
+/**
+ * DescribeSettings 返回高级设置的描述，Default 为桌面端未修改该项时实际使用的值
+ */
+export function DescribeSettings(): $CancellablePromise<core$0.Setting[]> {
+    return $Call.ByID(623635008).then(($result: any) => {
+        return $$createType2($result);
+    });
+}
+
+/**
+ * GetAdvanced 返回高级设置的当前值；需重启生效的设置返回已保存的值
+ */
+export function GetAdvanced(): $CancellablePromise<{ [_: string]: any }> {
+    return $Call.ByID(2541246442).then(($result: any) => {
+        return $$createType3($result);
+    });
 }
 
 export function GetValue(): $CancellablePromise<config$0.ConfigType> {
     return $Call.ByID(3966410473).then(($result: any) => {
+        return $$createType4($result);
+    });
+}
+
+/**
+ * SetAdvanced 校验并保存高级设置，可立即生效的设置通过 Reload 应用，失败时恢复原配置；
+ * 需重启生效的设置只保存，下次启动应用时生效
+ */
+export function SetAdvanced(values: { [_: string]: any }): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(713176398, values).then(($result: any) => {
         return $$createType0($result);
     });
 }
 
 // Private type creation functions
-const $$createType0 = config$0.ConfigType.createFrom;
+const $$createType0 = $models.ActionResult.createFrom;
+const $$createType1 = core$0.Setting.createFrom;
+const $$createType2 = $Create.Array($$createType1);
+const $$createType3 = $Create.Map($Create.Any, $Create.Any);
+const $$createType4 = config$0.ConfigType.createFrom;
@@ -1,13 +1,17 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+import * as AppInfoService from "./appinfoservice.js";
 import * as ConfigService from "./configservice.js";
+import * as DiagnosticsService from "./diagnosticsservice.js";
 import * as LogService from "./logservice.js";
 import * as NodeService from "./nodeservice.js";
 import * as ProxyServerDesktop from "./proxyserverdesktop.js";
 import * as UserService from "./userservice.js";
 export {
+    AppInfoService,
     ConfigService,
+    DiagnosticsService,
     LogService,
     NodeService,
     ProxyServerDesktop,
@@ -15,9 +19,12 @@ export {
 };
 
 export {
+    ActionResult,
+    BuildInfo,
     LogEntry,
     LogFile,
     ProxyConfig,
     SiteStatsResponse,
+    TestedNode,
     TrafficStatsResponse
 } from "./models.js";
@@ -5,6 +5,126 @@
 // @ts-ignore: Unused imports
 import { Create as $Create } from "@wailsio/runtime";
 
+// eslint-disable-next-line @typescript-eslint/ban-ts-comment
+// @ts-ignore: Unused imports
+import * as models$0 from "../models/models.js";
+
+/**
+ * ActionResult 操作结果，前端据此展示提示
+ */
+export class ActionResult {
+    "ok": boolean;
+    "warnings": string[];
+    "error": string;
+
+    /**
+     * 失败后是否已恢复到操作前的状态
+     */
+    "rollbackPerformed": boolean;
+
+    /** Creates a new ActionResult instance. */
+    constructor($$source: Partial<ActionResult> = {}) {
+        if (!("ok" in $$source)) {
+            this["ok"] = false;
+        }
+        if (!("warnings" in $$source)) {
+            this["warnings"] = [];
+        }
+        if (!("error" in $$source)) {
+            this["error"] = "";
+        }
+        if (!("rollbackPerformed" in $$source)) {
+            this["rollbackPerformed"] = false;
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new ActionResult instance from a string or object.
+     */
+    static createFrom($$source: any = {}): ActionResult {
+        const $$createField1_0 = $$createType0;
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        if ("warnings" in $$parsedSource) {
+            $$parsedSource["warnings"] = $$createField1_0($$parsedSource["warnings"]);
+        }
+        return new ActionResult($$parsedSource as Partial<ActionResult>);
+    }
+}
+
+/**
+ * BuildInfo 构建元数据及运行环境能力，与命令行 -version 输出的信息一致
+ */
+export class BuildInfo {
+    "version": string;
+    "commit": string;
+    "date": string;
+    "goVersion": string;
+    "platform": string;
+    "coreApi": string;
+    "echSupported": boolean;
+    "echError": string;
+    "wailsVersion": string;
+    "storeDir": string;
+    "logDir": string;
+
+    /**
+     * 纯文本报告，用于复制到问题反馈
+     */
+    "report": string;
+
+    /** Creates a new BuildInfo instance. */
+    constructor($$source: Partial<BuildInfo> = {}) {
+        if (!("version" in $$source)) {
+            this["version"] = "";
+        }
+        if (!("commit" in $$source)) {
+            this["commit"] = "";
+        }
+        if (!("date" in $$source)) {
+            this["date"] = "";
+        }
+        if (!("goVersion" in $$source)) {
+            this["goVersion"] = "";
+        }
+        if (!("platform" in $$source)) {
+            this["platform"] = "";
+        }
+        if (!("coreApi" in $$source)) {
+            this["coreApi"] = "";
+        }
+        if (!("echSupported" in $$source)) {
+            this["echSupported"] = false;
+        }
+        if (!("echError" in $$source)) {
+            this["echError"] = "";
+        }
+        if (!("wailsVersion" in $$source)) {
+            this["wailsVersion"] = "";
+        }
+        if (!("storeDir" in $$source)) {
+            this["storeDir"] = "";
+        }
+        if (!("logDir" in $$source)) {
+            this["logDir"] = "";
+        }
+        if (!("report" in $$source)) {
+            this["report"] = "";
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new BuildInfo instance from a string or object.
+     */
+    static createFrom($$source: any = {}): BuildInfo {
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        return new BuildInfo($$parsedSource as Partial<BuildInfo>);
+    }
+}
+
 export class LogEntry {
     "time": string;
     "level": string;
@@ -127,6 +247,42 @@ export class SiteStatsResponse {
     }
 }
 
+/**
+ * TestedNode CreateNodeTested 创建的节点及测试结果
+ */
+export class TestedNode {
+    "node": models$0.Node | null;
+
+    /**
+     * 建立 WebSocket 的耗时（纳秒）
+     */
+    "latency": number;
+
+    /** Creates a new TestedNode instance. */
+    constructor($$source: Partial<TestedNode> = {}) {
+        if (!("node" in $$source)) {
+            this["node"] = null;
+        }
+        if (!("latency" in $$source)) {
+            this["latency"] = 0;
+        }
+
+        Object.assign(this, $$source);
+    }
+
+    /**
+     * Creates a new TestedNode instance from a string or object.
+     */
+    static createFrom($$source: any = {}): TestedNode {
+        const $$createField0_0 = $$createType4;
+        let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
+        if ("node" in $$parsedSource) {
+            $$parsedSource["node"] = $$createField0_0($$parsedSource["node"]);
+        }
+        return new TestedNode($$parsedSource as Partial<TestedNode>);
+    }
+}
+
 /**
  * TrafficStatsResponse 流量统计响应
  */
@@ -143,8 +299,43 @@ export class TrafficStatsResponse {
      * bytes/s
      */
     "downloadSpeed": number;
+
+    /**
+     * 当前正在处理的连接数
+     */
+    "activeConnections": number;
+
+    /**
+     * 总带宽限制 bytes/s，0 表示不限制
+     */
+    "totalRateLimit": number;
+
+    /**
+     * 总带宽利用率 0~1
+     */
+    "rateUtilization": number;
+
+    /**
+     * 服务端不可用时降级为直连的连接数
+     */
+    "fallbackConns": number;
+
+    /**
+     * 最近建立隧道耗时的中位数（毫秒），0 表示尚无数据
+     */
+    "handshakeP50": number;
+
+    /**
+     * 最近建立隧道耗时的 p95（毫秒）
+     */
+    "handshakeP95": number;
     "sites": SiteStatsResponse[];
 
+    /**
+     * 未在 Sites 中列出的其余站点合计，与 Sites 相加等于总流量
+     */
+    "other": SiteStatsResponse;
+
     /** Creates a new TrafficStatsResponse instance. */
     constructor($$source: Partial<TrafficStatsResponse> = {}) {
         if (!("totalUpload" in $$source)) {
@@ -159,9 +350,30 @@ export class TrafficStatsResponse {
         if (!("downloadSpeed" in $$source)) {
             this["downloadSpeed"] = 0;
         }
+        if (!("activeConnections" in $$source)) {
+            this["activeConnections"] = 0;
+        }
+        if (!("totalRateLimit" in $$source)) {
+            this["totalRateLimit"] = 0;
+        }
+        if (!("rateUtilization" in $$source)) {
+            this["rateUtilization"] = 0;
+        }
+        if (!("fallbackConns" in $$source)) {
+            this["fallbackConns"] = 0;
+        }
+        if (!("handshakeP50" in $$source)) {
+            this["handshakeP50"] = 0;
+        }
+        if (!("handshakeP95" in $$source)) {
+            this["handshakeP95"] = 0;
+        }
         if (!("sites" in $$source)) {
             this["sites"] = [];
         }
+        if (!("other" in $$source)) {
+            this["other"] = (new SiteStatsResponse());
+        }
 
         Object.assign(this, $$source);
     }
@@ -170,15 +382,22 @@ export class TrafficStatsResponse {
      * Creates a new TrafficStatsResponse instance from a string or object.
      */
     static createFrom($$source: any = {}): TrafficStatsResponse {
-        const $$createField4_0 = $$createType1;
+        const $$createField8_0 = $$createType2;
+        const $$createField9_0 = $$createType1;
         let $$parsedSource = typeof $$source === 'string' ? JSON.parse($$source) : $$source;
         if ("sites" in $$parsedSource) {
-            $$parsedSource["sites"] = $$createField4_0($$parsedSource["sites"]);
+            $$parsedSource["sites"] = $$createField8_0($$parsedSource["sites"]);
+        }
+        if ("other" in $$parsedSource) {
+            $$parsedSource["other"] = $$createField9_0($$parsedSource["other"]);
         }
         return new TrafficStatsResponse($$parsedSource as Partial<TrafficStatsResponse>);
     }
 }
 
 // Private type creation functions
-const $$createType0 = SiteStatsResponse.createFrom;
-const $$createType1 = $Create.Array($$createType0);
+const $$createType0 = $Create.Array($Create.Any);
+const $$createType1 = SiteStatsResponse.createFrom;
+const $$createType2 = $Create.Array($$createType1);
+const $$createType3 = models$0.Node.createFrom;
+const $$createType4 = $Create.Nullable($$createType3);
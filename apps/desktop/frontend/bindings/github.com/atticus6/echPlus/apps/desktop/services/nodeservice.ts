@@ -9,19 +9,57 @@ import { Call as $Call, CancellablePromise as $CancellablePromise, Create as $Cr
 // @ts-ignore: Unused imports
 import * as models$0 from "../models/models.js";
 
-export function CreateNode(name: string, token: string, address: string, serverIP: string, port: number): $CancellablePromise<models$0.Node | null> {
-    return $Call.ByID(3039531582, name, token, address, serverIP, port).then(($result: any) => {
+// eslint-disable-next-line @typescript-eslint/ban-ts-comment
+// @ts-ignore: Unused imports
+import * as $models from "./models.js";
+
+/**
+ * CreateNode 创建节点，pinnedSPKI 为逗号分隔的公钥固定值，可为空；echDomain 为空时使用全局的 ECH 查询域名；
+ * fallbackServerHost 为 serverIP 为空时连接服务端使用的域名，可为空。各字段按 core.Node.Validate 校验，与从分享链接导入的节点规则相同
+ */
+export function CreateNode(name: string, token: string, address: string, serverIP: string, port: number, pinnedSPKI: string, pinAnyChain: boolean, http2: boolean, echDomain: string, fallbackServerHost: string): $CancellablePromise<models$0.Node | null> {
+    return $Call.ByID(3039531582, name, token, address, serverIP, port, pinnedSPKI, pinAnyChain, http2, echDomain, fallbackServerHost).then(($result: any) => {
+        return $$createType1($result);
+    });
+}
+
+/**
+ * CreateNodeFromURI 从节点分享链接 (echplus://...) 创建节点，链接格式见 core.ParseNodeURI
+ */
+export function CreateNodeFromURI(uri: string): $CancellablePromise<models$0.Node | null> {
+    return $Call.ByID(2368465532, uri).then(($result: any) => {
         return $$createType1($result);
     });
 }
 
+/**
+ * CreateNodeTested 先按当前的全局设置（DNS、ECH、上游代理、超时等）向节点建立一次连接，成功后才创建节点并返回耗时，
+ * 地址、令牌或服务端 IP 填写错误时返回错误且不保存。参数同 CreateNode，离线配置时使用 CreateNode 跳过测试
+ */
+export function CreateNodeTested(name: string, token: string, address: string, serverIP: string, port: number, pinnedSPKI: string, pinAnyChain: boolean, http2: boolean, echDomain: string, fallbackServerHost: string): $CancellablePromise<$models.TestedNode | null> {
+    return $Call.ByID(3160099335, name, token, address, serverIP, port, pinnedSPKI, pinAnyChain, http2, echDomain, fallbackServerHost).then(($result: any) => {
+        return $$createType4($result);
+    });
+}
+
 export function GetNodes(): $CancellablePromise<models$0.Node[]> {
     return $Call.ByID(12233975).then(($result: any) => {
         return $$createType2($result);
     });
 }
 
+/**
+ * ImportNodes 导入订阅内容中的全部节点，任一节点无效时不导入任何节点。格式见 core.ParseNodeList
+ */
+export function ImportNodes(data: string): $CancellablePromise<models$0.Node[]> {
+    return $Call.ByID(1334711672, data).then(($result: any) => {
+        return $$createType2($result);
+    });
+}
+
 // Private type creation functions
 const $$createType0 = models$0.Node.createFrom;
 const $$createType1 = $Create.Nullable($$createType0);
 const $$createType2 = $Create.Array($$createType0);
+const $$createType3 = $models.TestedNode.createFrom;
+const $$createType4 = $Create.Nullable($$createType3);
@@ -5,10 +5,21 @@
 // @ts-ignore: Unused imports
 import { Call as $Call, CancellablePromise as $CancellablePromise, Create as $Create } from "@wailsio/runtime";
 
+// eslint-disable-next-line @typescript-eslint/ban-ts-comment
+// @ts-ignore: Unused imports
+import * as core$0 from "../../client/core/models.js";
+
 // eslint-disable-next-line @typescript-eslint/ban-ts-comment
 // @ts-ignore: Unused imports
 import * as $models from "./models.js";
 
+/**
+ * CloseConnection 强制关闭 ConnID 为 connID 的连接，连接已结束时返回 false
+ */
+export function CloseConnection(connID: number): $CancellablePromise<boolean> {
+    return $Call.ByID(2112936898, connID);
+}
+
 /**
  * DisableSOCKS5ForService 为指定网络服务禁用 SOCKS5 代理 (macOS)
  */
@@ -23,21 +34,82 @@ export function DisableSOCKS5Proxy(): $CancellablePromise<void> {
     return $Call.ByID(2086950662);
 }
 
+/**
+ * FlushCaches 清空 DNS、ECH、IP 列表等运行时缓存，切换网络后使用
+ */
+export function FlushCaches(): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(2894976799).then(($result: any) => {
+        return $$createType0($result);
+    });
+}
+
+/**
+ * GetActiveConnections 获取正在处理的连接，按开始时间从旧到新排列
+ */
+export function GetActiveConnections(): $CancellablePromise<core$0.ActiveConnection[]> {
+    return $Call.ByID(4044170833).then(($result: any) => {
+        return $$createType8($result);
+    });
+}
+
+/**
+ * GetECHStatus 获取后台刷新 ECH 配置的状态和各查询域名当前使用的配置
+ */
+export function GetECHStatus(): $CancellablePromise<core$0.ECHStatus> {
+    return $Call.ByID(4040491820).then(($result: any) => {
+        return $$createType10($result);
+    });
+}
+
+/**
+ * GetHealth 获取后台健康检查的结果，未开启 HealthCheckInterval 时不检查
+ */
+export function GetHealth(): $CancellablePromise<core$0.Health> {
+    return $Call.ByID(779552673).then(($result: any) => {
+        return $$createType9($result);
+    });
+}
+
 /**
  * GetNetworkServices 获取所有网络服务 (macOS)
  */
 export function GetNetworkServices(): $CancellablePromise<string[]> {
     return $Call.ByID(1327509692).then(($result: any) => {
-        return $$createType0($result);
+        return $$createType1($result);
     });
 }
 
+/**
+ * GetServerIPStats 获取 ServerIP 各候选地址的测速结果，只有一个候选地址时不测速
+ */
+export function GetServerIPStats(): $CancellablePromise<core$0.ServerIPStats[]> {
+    return $Call.ByID(3013968907).then(($result: any) => {
+        return $$createType3($result);
+    });
+}
+
+/**
+ * GetState 获取代理状态: stopped/running/paused/stopping
+ */
+export function GetState(): $CancellablePromise<core$0.ServerState> {
+    return $Call.ByID(1947878603);
+}
+
 /**
  * GetTrafficStats 获取流量统计
  */
 export function GetTrafficStats(): $CancellablePromise<$models.TrafficStatsResponse | null> {
     return $Call.ByID(615760542).then(($result: any) => {
-        return $$createType2($result);
+        return $$createType5($result);
+    });
+}
+
+/**
+ * GetUpstreamStatus 获取上游服务端状态（机房、CF-Ray 等诊断信息）
+ */
+export function GetUpstreamStatus(): $CancellablePromise<core$0.UpstreamStatus> {
+    return $Call.ByID(1388653077).then(($result: any) => {
+        return $$createType6($result);
     });
 }
 
@@ -45,6 +117,24 @@ export function IsRunning(): $CancellablePromise<boolean> {
     return $Call.ByID(1480221581);
 }
 
+/**
+ * Pause 暂停代理，保留系统代理设置，新连接按配置拒绝或直连
+ */
+export function Pause(): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(2502540844).then(($result: any) => {
+        return $$createType0($result);
+    });
+}
+
+/**
+ * Resume 恢复暂停的代理
+ */
+export function Resume(): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(2538323349).then(($result: any) => {
+        return $$createType0($result);
+    });
+}
+
 /**
  * SetSOCKS5ForService 为指定网络服务设置 SOCKS5 代理 (macOS)
  */
@@ -59,19 +149,53 @@ export function SetSOCKS5Proxy(config: $models.ProxyConfig): $CancellablePromise
     return $Call.ByID(4147263774, config);
 }
 
-export function Start(): $CancellablePromise<void> {
-    return $Call.ByID(962235586);
+/**
+ * Start 启动代理并设置系统代理，核心启动失败时不修改系统代理
+ */
+export function Start(): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(962235586).then(($result: any) => {
+        return $$createType0($result);
+    });
+}
+
+/**
+ * Stop 停止代理并关闭系统代理，核心停止失败时保留系统代理设置
+ */
+export function Stop(): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(3109470018).then(($result: any) => {
+        return $$createType0($result);
+    });
 }
 
-export function Stop(): $CancellablePromise<void> {
-    return $Call.ByID(3109470018);
+/**
+ * SwitchNode 切换节点并立即保存选择，应用失败时恢复原节点，前端据 OK 为 false 恢复显示的选择
+ */
+export function SwitchNode(nodeId: number): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(1938259646, nodeId).then(($result: any) => {
+        return $$createType0($result);
+    });
 }
 
-export function SwitchNode(nodeId: number): $CancellablePromise<void> {
-    return $Call.ByID(1938259646, nodeId);
+/**
+ * UpdateNodeToken 修改节点的令牌。节点为当前选中的节点时：applyNow 为 true 或代理未运行时经 core.ProxyServer.UpdateToken
+ * 立即生效，不重启、不中断已建立的隧道，服务端拒绝新令牌时保留原令牌并返回失败；applyNow 为 false 且代理运行中时只保存，
+ * 重新选择该节点后生效
+ */
+export function UpdateNodeToken(nodeId: number, token: string, applyNow: boolean): $CancellablePromise<$models.ActionResult> {
+    return $Call.ByID(1236570848, nodeId, token, applyNow).then(($result: any) => {
+        return $$createType0($result);
+    });
 }
 
 // Private type creation functions
-const $$createType0 = $Create.Array($Create.Any);
-const $$createType1 = $models.TrafficStatsResponse.createFrom;
-const $$createType2 = $Create.Nullable($$createType1);
+const $$createType0 = $models.ActionResult.createFrom;
+const $$createType1 = $Create.Array($Create.Any);
+const $$createType2 = core$0.ServerIPStats.createFrom;
+const $$createType3 = $Create.Array($$createType2);
+const $$createType4 = $models.TrafficStatsResponse.createFrom;
+const $$createType5 = $Create.Nullable($$createType4);
+const $$createType6 = core$0.UpstreamStatus.createFrom;
+const $$createType7 = core$0.ActiveConnection.createFrom;
+const $$createType8 = $Create.Array($$createType7);
+const $$createType9 = core$0.Health.createFrom;
+const $$createType10 = core$0.ECHStatus.createFrom;
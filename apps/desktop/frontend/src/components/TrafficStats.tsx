@@ -1,6 +1,6 @@
 import { useQuery } from "@tanstack/react-query";
-import { trafficStatsOptions } from "@/querys/proxy";
-import { ArrowUp, ArrowDown, ChartBar } from "lucide-react";
+import { serverIPStatsOptions, trafficStatsOptions } from "@/querys/proxy";
+import { ArrowUp, ArrowDown, ChartBar, Cable } from "lucide-react";
 import { useState } from "react";
 import {
   Dialog,
@@ -26,6 +26,7 @@ function formatSpeed(bytesPerSec: number): string {
 export function TrafficStats() {
   const { data: stats } = useQuery(trafficStatsOptions());
   const [open, setOpen] = useState(false);
+  const { data: serverIPs } = useQuery({ ...serverIPStatsOptions(), enabled: open });
 
   if (!stats) return null;
 
@@ -46,6 +47,12 @@ export function TrafficStats() {
               {formatSpeed(stats.downloadSpeed || 0)}
             </span>
           </div>
+          <div className="flex items-center gap-1" title="活动连接">
+            <Cable className="w-4 h-4 text-gray-500" />
+            <span className="text-gray-600 dark:text-gray-400">
+              {stats.activeConnections || 0}
+            </span>
+          </div>
         </div>
 
         <Dialog open={open} onOpenChange={setOpen}>
@@ -81,6 +88,61 @@ export function TrafficStats() {
                 </div>
               </div>
 
+              {/* 总带宽限制 */}
+              {stats.totalRateLimit > 0 && (
+                <div className="flex items-center justify-between text-sm text-gray-500 dark:text-gray-400">
+                  <span>带宽限制 {formatSpeed(stats.totalRateLimit)}</span>
+                  <span>已使用 {Math.round((stats.rateUtilization || 0) * 100)}%</span>
+                </div>
+              )}
+
+              {/* 最近建立隧道的耗时 */}
+              {stats.handshakeP50 > 0 && (
+                <div className="flex items-center justify-between text-sm text-gray-500 dark:text-gray-400">
+                  <span>建立隧道耗时</span>
+                  <span>
+                    p50 {stats.handshakeP50} ms / p95 {stats.handshakeP95} ms
+                  </span>
+                </div>
+              )}
+
+              {/* ServerIP 有多个候选地址时的测速结果 */}
+              {serverIPs && serverIPs.length > 1 && (
+                <div>
+                  <div className="text-sm text-gray-500 dark:text-gray-400 mb-2">
+                    服务端 IP 测速
+                  </div>
+                  <div className="bg-gray-50 dark:bg-gray-800/50 rounded-lg max-h-40 overflow-y-auto">
+                    {serverIPs.map((ip) => (
+                      <div
+                        key={ip.ip}
+                        className="flex items-center justify-between px-3 py-1.5 text-xs border-b border-gray-100 dark:border-gray-700 last:border-0"
+                        title={ip.lastError || undefined}
+                      >
+                        <span className={ip.selected ? "font-semibold text-gray-800 dark:text-gray-200" : "text-gray-600 dark:text-gray-400"}>
+                          {ip.ip}
+                          {ip.selected && " (使用中)"}
+                        </span>
+                        <span className="text-gray-500 dark:text-gray-400">
+                          {ip.latency > 0
+                            ? `${Math.round(ip.latency / 1e6)} ms`
+                            : ip.lastError
+                              ? "失败"
+                              : "尚未测速"}
+                        </span>
+                      </div>
+                    ))}
+                  </div>
+                </div>
+              )}
+
+              {/* 服务端不可用时降级为直连 */}
+              {stats.fallbackConns > 0 && (
+                <div className="text-sm text-amber-600 dark:text-amber-400">
+                  服务端不可用，已有 {stats.fallbackConns} 个连接降级为直连
+                </div>
+              )}
+
               {/* 站点列表 */}
               {stats.sites && stats.sites.length > 0 && (
                 <div>
@@ -111,6 +173,25 @@ export function TrafficStats() {
                         </div>
                       </div>
                     ))}
+                    {stats.other &&
+                      stats.other.upload + stats.other.download > 0 && (
+                        <div className="flex items-center justify-between px-3 py-2">
+                          <div className="flex items-center gap-2 min-w-0">
+                            <span className="text-xs text-gray-400 w-5" />
+                            <span className="text-sm text-gray-500 dark:text-gray-400 truncate">
+                              其他站点
+                            </span>
+                          </div>
+                          <div className="flex items-center gap-3 text-xs text-gray-500 dark:text-gray-400 shrink-0">
+                            <span className="text-green-600 dark:text-green-400">
+                              ↑{formatBytes(stats.other.upload || 0)}
+                            </span>
+                            <span className="text-blue-600 dark:text-blue-400">
+                              ↓{formatBytes(stats.other.download || 0)}
+                            </span>
+                          </div>
+                        </div>
+                      )}
                   </div>
                 </div>
               )}
@@ -0,0 +1,22 @@
+import { toast } from "sonner";
+import type { ActionResult } from "../../bindings/github.com/atticus6/echPlus/apps/desktop/services";
+
+// 根据后端返回的操作结果展示提示，返回操作是否成功
+export function showActionResult(result: ActionResult | null, successMessage?: string): boolean {
+  if (!result) {
+    return false;
+  }
+  if (!result.ok) {
+    toast.error(result.error, {
+      description: result.rollbackPerformed ? "已恢复到修改前的配置" : undefined,
+    });
+    return false;
+  }
+  for (const warning of result.warnings ?? []) {
+    toast.warning(warning);
+  }
+  if (successMessage && !result.warnings?.length) {
+    toast.success(successMessage);
+  }
+  return true;
+}
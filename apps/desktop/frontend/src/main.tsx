@@ -7,9 +7,32 @@ import { routeTree } from "./routeTree.gen";
 import { ThemeProvider } from "@/components/theme-provider";
 import { QueryClient, QueryClientProvider } from "@tanstack/react-query";
 import { Toaster } from "@/components/ui/sonner";
+import { Events } from "@wailsio/runtime";
+import { toast } from "sonner";
 
 const queryClient = new QueryClient();
 
+// 服务端证书未通过节点的公钥固定校验，隧道连接已被拒绝
+Events.On("upstream:pinMismatch", (event) => {
+  toast.error("服务端证书公钥不匹配，已拒绝连接", { description: event.data?.error });
+});
+
+// 后台健康检查发现服务端不可用或已恢复
+Events.On("upstream:health", (event) => {
+  if (event.data?.healthy) {
+    toast.success("服务端已恢复");
+  } else {
+    toast.error("服务端不可用", { description: event.data?.lastError });
+  }
+});
+
+// 按明文协议处理方式拒绝了经代理发送的明文连接，只记录警告时不提示
+Events.On("proxy:plaintext", (event) => {
+  if (event.data?.blocked) {
+    toast.warning(`已拒绝明文 ${event.data.protocol} 连接`, { description: event.data.target });
+  }
+});
+
 // Create a new router instance
 const router = createRouter({
   routeTree,
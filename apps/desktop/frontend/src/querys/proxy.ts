@@ -12,3 +12,17 @@ export const trafficStatsOptions = () =>
     queryFn: () => ProxyServerDesktop.GetTrafficStats(),
     refetchInterval: 1000, // 每1秒刷新
   });
+
+export const serverIPStatsOptions = () =>
+  queryOptions({
+    queryKey: ["serverIPStats"],
+    queryFn: () => ProxyServerDesktop.GetServerIPStats(),
+    refetchInterval: 5000,
+  });
+
+export const activeConnectionsOptions = () =>
+  queryOptions({
+    queryKey: ["activeConnections"],
+    queryFn: () => ProxyServerDesktop.GetActiveConnections(),
+    refetchInterval: 1000,
+  });
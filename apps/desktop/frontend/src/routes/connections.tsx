@@ -0,0 +1,89 @@
+import { createFileRoute } from "@tanstack/react-router";
+import { useQuery, useQueryClient } from "@tanstack/react-query";
+import { X } from "lucide-react";
+import { toast } from "sonner";
+import { Button } from "@/components/ui/button";
+import { Badge } from "@/components/ui/badge";
+import { activeConnectionsOptions } from "@/querys/proxy";
+import { ProxyServerDesktop } from "../../bindings/github.com/atticus6/echPlus/apps/desktop/services";
+
+function formatBytes(bytes: number): string {
+  if (bytes === 0) return "0 B";
+  const k = 1024;
+  const sizes = ["B", "KB", "MB", "GB", "TB"];
+  const i = Math.floor(Math.log(bytes) / Math.log(k));
+  return parseFloat((bytes / Math.pow(k, i)).toFixed(2)) + " " + sizes[i];
+}
+
+// 连接已持续的时间，startedAt 为 RFC 3339 时间字符串
+function formatAge(startedAt: string): string {
+  const seconds = Math.max(0, Math.floor((Date.now() - new Date(startedAt).getTime()) / 1000));
+  if (seconds < 60) return `${seconds}秒`;
+  if (seconds < 3600) return `${Math.floor(seconds / 60)}分${seconds % 60}秒`;
+  return `${Math.floor(seconds / 3600)}时${Math.floor((seconds % 3600) / 60)}分`;
+}
+
+export const Route = createFileRoute("/connections")({
+  component: ConnectionsPage,
+});
+
+function ConnectionsPage() {
+  const queryClient = useQueryClient();
+  const { data: conns } = useQuery(activeConnectionsOptions());
+
+  const closeConnection = async (connId: number, target: string) => {
+    try {
+      if (!(await ProxyServerDesktop.CloseConnection(connId))) {
+        toast.info(`连接 ${target} 已结束`);
+      }
+    } catch (err) {
+      toast.error(`关闭连接失败: ${err}`);
+    }
+    queryClient.invalidateQueries({ queryKey: ["activeConnections"] });
+  };
+
+  return (
+    <div className="p-6 h-full flex flex-col">
+      <h1 className="text-xl font-semibold mb-6">
+        活动连接
+        <span className="ml-2 text-sm font-normal text-gray-500">{conns?.length || 0}</span>
+      </h1>
+
+      <div className="flex-1 overflow-y-auto bg-white dark:bg-gray-800 rounded-xl border border-gray-200 dark:border-gray-700">
+        {conns && conns.length > 0 ? (
+          conns.map((conn) => (
+            <div
+              key={conn.connId}
+              className="flex items-center justify-between px-4 py-3 border-b border-gray-100 dark:border-gray-700 last:border-0"
+            >
+              <div className="flex items-center gap-3 min-w-0">
+                <Badge variant={conn.direct ? "secondary" : "default"}>{conn.direct ? "直连" : "代理"}</Badge>
+                <div className="min-w-0">
+                  <div className="text-sm text-gray-700 dark:text-gray-300 truncate">{conn.target}</div>
+                  <div className="text-xs text-gray-400 truncate">
+                    #{conn.connId} {conn.clientAddr} · {formatAge(conn.startedAt)}
+                  </div>
+                </div>
+              </div>
+              <div className="flex items-center gap-4 text-sm shrink-0">
+                <span className="text-green-600 dark:text-green-400">↑ {formatBytes(conn.upload || 0)}</span>
+                <span className="text-blue-600 dark:text-blue-400">↓ {formatBytes(conn.download || 0)}</span>
+                <Button
+                  variant="ghost"
+                  size="icon"
+                  className="h-7 w-7"
+                  title="关闭连接"
+                  onClick={() => closeConnection(conn.connId, conn.target)}
+                >
+                  <X className="w-4 h-4" />
+                </Button>
+              </div>
+            </div>
+          ))
+        ) : (
+          <div className="text-center text-gray-400 py-8">暂无活动连接</div>
+        )}
+      </div>
+    </div>
+  );
+}
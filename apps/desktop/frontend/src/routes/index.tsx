@@ -7,6 +7,7 @@ import {
 import { createFileRoute } from "@tanstack/react-router";
 import { useState } from "react";
 import { nodesQueryOptions } from "@/querys/nodes";
+import { showActionResult } from "@/lib/action-result";
 import {
   useSuspenseQuery,
   useQueryClient,
@@ -15,8 +16,9 @@ import {
 import { useForm } from "react-hook-form";
 import { zodResolver } from "@hookform/resolvers/zod";
 import { z } from "zod";
+import { toast } from "sonner";
 
-import { Check, ChevronsUpDown, CirclePlus, Plus } from "lucide-react";
+import { Check, ChevronsUpDown, CirclePlus, KeyRound, Plus } from "lucide-react";
 import { Switch } from "@/components/ui/switch";
 import {
   Dialog,
@@ -63,6 +65,12 @@ const formSchema = z.object({
   address: z.string().min(1, "地址不能为空"),
   serverIP: z.string(),
   port: z.number().min(1).max(65535),
+  pinnedSPKI: z.string(),
+  pinAnyChain: z.boolean(),
+  http2: z.boolean(),
+  echDomain: z.string(),
+  fallbackServerHost: z.string(),
+  testBeforeSave: z.boolean(),
 });
 
 type FormValues = z.infer<typeof formSchema>;
@@ -86,6 +94,9 @@ function RouteComponent() {
 
   const queryClient = useQueryClient();
   const [showCreate, setShowCreate] = useState(false);
+  const [shareLink, setShareLink] = useState("");
+  const [showToken, setShowToken] = useState(false);
+  const [newToken, setNewToken] = useState("");
 
   const [open, setOpen] = useState(false);
 
@@ -94,11 +105,44 @@ function RouteComponent() {
     mutationFn: (v: Partial<ConfigType>) => {
       return ConfigService.ChangeValue(v as any);
     },
-    onSuccess() {
+    onSuccess(result) {
+      showActionResult(result);
       queryClient.invalidateQueries({ queryKey: configOptions().queryKey });
     },
   });
 
+  const { mutate: SwitchNode } = useMutation({
+    mutationKey: ["proxy", "SwitchNode"],
+    mutationFn: (nodeId: number) => {
+      return ProxyServerDesktop.SwitchNode(nodeId);
+    },
+    onSuccess(result) {
+      showActionResult(result);
+      // 切换失败时后端已恢复原节点，重新获取配置使显示的选择随之恢复
+      queryClient.invalidateQueries({ queryKey: configOptions().queryKey });
+    },
+  });
+
+  // 修改选中节点的令牌，立即应用时不重启代理，服务端拒绝新令牌时后端保留原令牌
+  const { mutate: UpdateNodeToken } = useMutation({
+    mutationKey: ["proxy", "UpdateNodeToken"],
+    mutationFn: (applyNow: boolean) => {
+      return ProxyServerDesktop.UpdateNodeToken(
+        config.SelectNodeId,
+        newToken.trim(),
+        applyNow
+      );
+    },
+    onSuccess(result) {
+      showActionResult(result);
+      if (result.ok) {
+        setShowToken(false);
+        setNewToken("");
+        queryClient.invalidateQueries({ queryKey: ["nodes"] });
+      }
+    },
+  });
+
   const form = useForm<FormValues>({
     resolver: zodResolver(formSchema),
     defaultValues: {
@@ -107,28 +151,93 @@ function RouteComponent() {
       address: "",
       serverIP: "",
       port: 443,
+      pinnedSPKI: "",
+      pinAnyChain: false,
+      http2: false,
+      echDomain: "",
+      fallbackServerHost: "",
+      testBeforeSave: true,
     },
   });
 
   const onSubmit = async (values: FormValues) => {
+    const args = [
+      values.name,
+      values.token,
+      values.address,
+      values.serverIP || "",
+      values.port,
+      values.pinnedSPKI.trim(),
+      values.pinAnyChain,
+      values.http2,
+      values.echDomain.trim(),
+      values.fallbackServerHost.trim(),
+    ] as const;
     try {
-      await NodeService.CreateNode(
-        values.name,
-        values.token,
-        values.address,
-        values.serverIP || "",
-        values.port
-      );
+      // 先测试连接，失败时后端不保存；离线配置时可关闭测试直接保存
+      if (values.testBeforeSave) {
+        const tested = await NodeService.CreateNodeTested(...args);
+        toast.success(
+          `节点可用，延迟 ${Math.round((tested?.latency ?? 0) / 1e6)} ms`
+        );
+      } else {
+        await NodeService.CreateNode(...args);
+      }
       setShowCreate(false);
       form.reset();
       queryClient.invalidateQueries({ queryKey: ["nodes"] });
     } catch (error) {
-      console.error("创建节点失败:", error);
+      toast.error(`创建节点失败: ${error}`);
+    }
+  };
+
+  // 从分享链接创建节点，链接无效时后端返回具体的错误字段
+  const onImport = async () => {
+    try {
+      await NodeService.CreateNodeFromURI(shareLink.trim());
+      setShowCreate(false);
+      setShareLink("");
+      form.reset();
+      queryClient.invalidateQueries({ queryKey: ["nodes"] });
+    } catch (error) {
+      toast.error(`导入节点失败: ${error}`);
     }
   };
 
   return (
     <div className="h-full flex justify-center items-center">
+      <Dialog open={showToken} onOpenChange={setShowToken}>
+        <DialogContent className="sm:max-w-[425px]">
+          <DialogHeader>
+            <DialogTitle>修改令牌</DialogTitle>
+            <DialogDescription>
+              立即应用时先验证新令牌，不重启代理，已建立的连接不受影响。
+            </DialogDescription>
+          </DialogHeader>
+          <Input
+            placeholder="新的访问令牌"
+            value={newToken}
+            onChange={(e) => setNewToken(e.target.value)}
+          />
+          <DialogFooter>
+            <Button
+              type="button"
+              variant="outline"
+              disabled={!newToken.trim()}
+              onClick={() => UpdateNodeToken(false)}
+            >
+              保存
+            </Button>
+            <Button
+              type="button"
+              disabled={!newToken.trim()}
+              onClick={() => UpdateNodeToken(true)}
+            >
+              立即应用
+            </Button>
+          </DialogFooter>
+        </DialogContent>
+      </Dialog>
       <Dialog open={showCreate} onOpenChange={setShowCreate}>
         <DialogContent className="sm:max-w-[425px]">
           <DialogHeader>
@@ -137,6 +246,21 @@ function RouteComponent() {
               填写节点信息，点击创建完成添加。
             </DialogDescription>
           </DialogHeader>
+          <div className="flex gap-2">
+            <Input
+              placeholder="粘贴分享链接 echplus://..."
+              value={shareLink}
+              onChange={(e) => setShareLink(e.target.value)}
+            />
+            <Button
+              type="button"
+              variant="outline"
+              disabled={!shareLink.trim()}
+              onClick={onImport}
+            >
+              导入
+            </Button>
+          </div>
           <Form {...form}>
             <form onSubmit={form.handleSubmit(onSubmit)} className="space-y-4">
               <FormField
@@ -185,7 +309,20 @@ function RouteComponent() {
                   <FormItem>
                     <FormLabel>服务器IP</FormLabel>
                     <FormControl>
-                      <Input placeholder="可选" {...field} />
+                      <Input placeholder="可选，逗号分隔多个 IP 或网段时自动选择最快的" {...field} />
+                    </FormControl>
+                    <FormMessage />
+                  </FormItem>
+                )}
+              />
+              <FormField
+                control={form.control}
+                name="fallbackServerHost"
+                render={({ field }) => (
+                  <FormItem>
+                    <FormLabel>备用连接域名</FormLabel>
+                    <FormControl>
+                      <Input placeholder="可选，服务器IP为空时解析该域名连接，默认 www.visa.com" {...field} />
                     </FormControl>
                     <FormMessage />
                   </FormItem>
@@ -209,6 +346,68 @@ function RouteComponent() {
                   </FormItem>
                 )}
               />
+              <FormField
+                control={form.control}
+                name="pinnedSPKI"
+                render={({ field }) => (
+                  <FormItem>
+                    <FormLabel>证书公钥固定</FormLabel>
+                    <FormControl>
+                      <Input placeholder="可选，sha256/...，多个用逗号分隔" {...field} />
+                    </FormControl>
+                    <FormMessage />
+                  </FormItem>
+                )}
+              />
+              <FormField
+                control={form.control}
+                name="pinAnyChain"
+                render={({ field }) => (
+                  <FormItem className="flex items-center justify-between">
+                    <FormLabel>匹配证书链中的任一证书</FormLabel>
+                    <FormControl>
+                      <Switch checked={field.value} onCheckedChange={field.onChange} />
+                    </FormControl>
+                  </FormItem>
+                )}
+              />
+              <FormField
+                control={form.control}
+                name="http2"
+                render={({ field }) => (
+                  <FormItem className="flex items-center justify-between">
+                    <FormLabel>使用 HTTP/2 WebSocket (需服务端支持)</FormLabel>
+                    <FormControl>
+                      <Switch checked={field.value} onCheckedChange={field.onChange} />
+                    </FormControl>
+                  </FormItem>
+                )}
+              />
+              <FormField
+                control={form.control}
+                name="echDomain"
+                render={({ field }) => (
+                  <FormItem>
+                    <FormLabel>ECH 查询域名</FormLabel>
+                    <FormControl>
+                      <Input placeholder="可选，为空时使用全局设置，@server 表示节点地址" {...field} />
+                    </FormControl>
+                    <FormMessage />
+                  </FormItem>
+                )}
+              />
+              <FormField
+                control={form.control}
+                name="testBeforeSave"
+                render={({ field }) => (
+                  <FormItem className="flex items-center justify-between">
+                    <FormLabel>保存前测试连接 (离线配置时关闭)</FormLabel>
+                    <FormControl>
+                      <Switch checked={field.value} onCheckedChange={field.onChange} />
+                    </FormControl>
+                  </FormItem>
+                )}
+              />
               <DialogFooter>
                 <DialogClose asChild>
                   <Button type="button" variant="outline">
@@ -236,9 +435,9 @@ function RouteComponent() {
             checked={isRunning}
             onCheckedChange={async (v) => {
               if (v) {
-                await ProxyServerDesktop.Start();
+                showActionResult(await ProxyServerDesktop.Start(), "代理已启动");
               } else {
-                await ProxyServerDesktop.Stop();
+                showActionResult(await ProxyServerDesktop.Stop(), "代理已停止");
               }
               queryClient.invalidateQueries({
                 queryKey: isRunningoptions().queryKey,
@@ -293,6 +492,16 @@ function RouteComponent() {
                 >
                   <Plus />
                 </Button>
+                <Button
+                  variant="outline"
+                  size="icon"
+                  disabled={!config.SelectNodeId}
+                  onClick={() => {
+                    setShowToken(true);
+                  }}
+                >
+                  <KeyRound />
+                </Button>
               </ButtonGroup>
 
               <PopoverContent className="w-[200px] p-0">
@@ -309,9 +518,7 @@ function RouteComponent() {
                           key={node.id}
                           value={String(node.id)}
                           onSelect={(currentValue) => {
-                            ChangeConfig({
-                              SelectNodeId: node.id,
-                            });
+                            SwitchNode(node.id);
 
                             // setValue(currentValue === value ? "" : currentValue);
                             setOpen(false);
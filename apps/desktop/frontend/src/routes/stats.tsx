@@ -1,7 +1,10 @@
 import { createFileRoute } from "@tanstack/react-router";
 import { useQuery } from "@tanstack/react-query";
 import { trafficStatsOptions } from "@/querys/proxy";
-import { ArrowUp, ArrowDown } from "lucide-react";
+import { ArrowUp, ArrowDown, ClipboardCopy } from "lucide-react";
+import { toast } from "sonner";
+import { Button } from "@/components/ui/button";
+import { DiagnosticsService } from "../../bindings/github.com/atticus6/echPlus/apps/desktop/services";
 
 function formatBytes(bytes: number): string {
   if (bytes === 0) return "0 B";
@@ -15,6 +18,16 @@ function formatSpeed(bytesPerSec: number): string {
   return formatBytes(bytesPerSec) + "/s";
 }
 
+// 复制该站点最近几次连接的诊断信息，用于反馈单个站点无法访问的问题
+async function copyDiagnostics(host: string) {
+  try {
+    await navigator.clipboard.writeText(await DiagnosticsService.ExplainHost(host));
+    toast.success(`已复制 ${host} 的诊断信息`);
+  } catch (err) {
+    toast.error(`复制诊断信息失败: ${err}`);
+  }
+}
+
 export const Route = createFileRoute("/stats")({
   component: StatsPage,
 });
@@ -61,30 +74,64 @@ function StatsPage() {
         </h2>
         <div className="flex-1 overflow-y-auto bg-white dark:bg-gray-800 rounded-xl border border-gray-200 dark:border-gray-700">
           {stats?.sites && stats.sites.length > 0 ? (
-            stats.sites.map((site, index) => (
-              <div
-                key={site.host}
-                className="flex items-center justify-between px-4 py-3 border-b border-gray-100 dark:border-gray-700 last:border-0"
-              >
-                <div className="flex items-center gap-3 min-w-0">
-                  <span className="text-sm text-gray-400 w-6">{index + 1}</span>
-                  <span className="text-sm text-gray-700 dark:text-gray-300 truncate">
-                    {site.host}
-                  </span>
-                </div>
-                <div className="flex items-center gap-4 text-sm shrink-0">
-                  <span className="text-green-600 dark:text-green-400">
-                    ↑ {formatBytes(site.upload || 0)}
-                  </span>
-                  <span className="text-blue-600 dark:text-blue-400">
-                    ↓ {formatBytes(site.download || 0)}
-                  </span>
-                  <span className="text-gray-500 w-20 text-right">
-                    {formatBytes((site.upload || 0) + (site.download || 0))}
-                  </span>
+            <>
+              {stats.sites.map((site, index) => (
+                <div
+                  key={site.host}
+                  className="flex items-center justify-between px-4 py-3 border-b border-gray-100 dark:border-gray-700 last:border-0"
+                >
+                  <div className="flex items-center gap-3 min-w-0">
+                    <span className="text-sm text-gray-400 w-6">{index + 1}</span>
+                    <span className="text-sm text-gray-700 dark:text-gray-300 truncate">
+                      {site.host}
+                    </span>
+                  </div>
+                  <div className="flex items-center gap-4 text-sm shrink-0">
+                    <span className="text-green-600 dark:text-green-400">
+                      ↑ {formatBytes(site.upload || 0)}
+                    </span>
+                    <span className="text-blue-600 dark:text-blue-400">
+                      ↓ {formatBytes(site.download || 0)}
+                    </span>
+                    <span className="text-gray-500 w-20 text-right">
+                      {formatBytes((site.upload || 0) + (site.download || 0))}
+                    </span>
+                    <Button
+                      variant="ghost"
+                      size="icon"
+                      className="h-7 w-7"
+                      title="复制诊断信息"
+                      onClick={() => copyDiagnostics(site.host)}
+                    >
+                      <ClipboardCopy className="w-4 h-4" />
+                    </Button>
+                  </div>
                 </div>
-              </div>
-            ))
+              ))}
+              {stats.other &&
+                stats.other.upload + stats.other.download > 0 && (
+                  <div className="flex items-center justify-between px-4 py-3">
+                    <div className="flex items-center gap-3 min-w-0">
+                      <span className="text-sm text-gray-400 w-6" />
+                      <span className="text-sm text-gray-500 dark:text-gray-400 truncate">
+                        其他站点
+                      </span>
+                    </div>
+                    <div className="flex items-center gap-4 text-sm shrink-0">
+                      <span className="text-green-600 dark:text-green-400">
+                        ↑ {formatBytes(stats.other.upload || 0)}
+                      </span>
+                      <span className="text-blue-600 dark:text-blue-400">
+                        ↓ {formatBytes(stats.other.download || 0)}
+                      </span>
+                      <span className="text-gray-500 w-20 text-right">
+                        {formatBytes((stats.other.upload || 0) + (stats.other.download || 0))}
+                      </span>
+                      <span className="h-7 w-7" />
+                    </div>
+                  </div>
+                )}
+            </>
           ) : (
             <div className="text-center text-gray-400 py-8">暂无流量数据</div>
           )}
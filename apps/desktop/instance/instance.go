@@ -0,0 +1,195 @@
+// Package instance 保证桌面端只运行一个实例：第一个实例持有锁文件并在本机回环地址上监听，
+// 之后启动的实例按锁文件找到它、通知其显示主窗口后退出，避免两个代理争用端口和系统代理设置
+package instance
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lockName 锁文件名，位于数据目录下
+	lockName = "desktop.lock"
+	// signalTimeout 向已运行的实例发送信号、等待其应答的时间上限，超时视为锁文件残留
+	signalTimeout = 2 * time.Second
+	// cmdShow 通知已运行的实例显示主窗口
+	cmdShow = "show"
+)
+
+// ErrRunning 已有实例在运行，已通知其显示主窗口，当前进程应退出
+var ErrRunning = errors.New("已有实例在运行")
+
+// lockInfo 锁文件的内容
+type lockInfo struct {
+	PID   int    `json:"pid"`
+	Addr  string `json:"addr"`  // 接收信号的回环地址
+	Token string `json:"token"` // 信号须携带的随机令牌，避免本机其他程序冒充
+}
+
+// Instance 当前进程持有的单实例锁
+type Instance struct {
+	path   string
+	info   lockInfo
+	ln     net.Listener
+	onShow func()
+	wg     sync.WaitGroup
+}
+
+// Acquire 在 dir 下获取单实例锁，之后其他实例启动时在独立的 goroutine 中调用 onShow。
+// 已有实例在运行时通知其显示主窗口并返回 ErrRunning；锁文件损坏或其实例已不响应（崩溃后残留）时接管锁
+func Acquire(dir string, onShow func()) (*Instance, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("监听单实例信号失败: %w", err)
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	inst := &Instance{
+		path:   filepath.Join(dir, lockName),
+		info:   lockInfo{PID: os.Getpid(), Addr: ln.Addr().String(), Token: hex.EncodeToString(token)},
+		ln:     ln,
+		onShow: onShow,
+	}
+
+	// 第一次失败时可能是崩溃残留的锁文件，清除后再试一次
+	for attempt := 0; attempt < 2; attempt++ {
+		err := writeLock(inst.path, inst.info)
+		if err == nil {
+			inst.wg.Add(1)
+			go inst.serve()
+			return inst, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			ln.Close()
+			return nil, fmt.Errorf("创建锁文件失败: %w", err)
+		}
+		existing, err := readLock(inst.path)
+		if err == nil && signal(existing, cmdShow) == nil {
+			ln.Close()
+			return nil, fmt.Errorf("%w (PID %d)", ErrRunning, existing.PID)
+		}
+		removeStale(inst.path, existing)
+	}
+	ln.Close()
+	return nil, fmt.Errorf("无法获取单实例锁 %s", inst.path)
+}
+
+// Close 停止接收信号并删除锁文件，应用退出时调用；锁文件已被其他实例接管时保留。i 为 nil 时不做任何事
+func (i *Instance) Close() error {
+	if i == nil {
+		return nil
+	}
+	err := i.ln.Close()
+	i.wg.Wait()
+	if current, readErr := readLock(i.path); readErr == nil && current.Token == i.info.Token {
+		os.Remove(i.path)
+	}
+	return err
+}
+
+// serve 逐个处理其他实例发来的信号，监听关闭后返回
+func (i *Instance) serve() {
+	defer i.wg.Done()
+	for {
+		conn, err := i.ln.Accept()
+		if err != nil {
+			return
+		}
+		i.handle(conn)
+	}
+}
+
+// handle 读取一行 "<令牌> <命令>"，令牌正确且为 cmdShow 时应答 "ok" 并调用 onShow
+func (i *Instance) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(signalTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	token, cmd, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(i.info.Token)) != 1 || cmd != cmdShow {
+		conn.Write([]byte("error\n"))
+		return
+	}
+	conn.Write([]byte("ok\n"))
+	if i.onShow != nil {
+		go i.onShow()
+	}
+}
+
+// signal 向锁文件 info 指向的实例发送 cmd，对方应答 "ok" 时返回 nil
+func signal(info lockInfo, cmd string) error {
+	conn, err := net.DialTimeout("tcp", info.Addr, signalTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(signalTimeout))
+	if _, err := fmt.Fprintf(conn, "%s %s\n", info.Token, cmd); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "ok" {
+		return fmt.Errorf("实例拒绝了信号: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// writeLock 以 info 创建锁文件，已存在时返回 fs.ErrExist。先写入临时文件再硬链接到 path，
+// 其他实例读到的锁文件总是完整的
+func writeLock(path string, info lockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), lockName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(tmp.Name(), path)
+}
+
+// readLock 读取锁文件
+func readLock(path string) (lockInfo, error) {
+	var info lockInfo
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil || info.Addr == "" {
+		return info, fmt.Errorf("锁文件损坏: %s", path)
+	}
+	return info, nil
+}
+
+// removeStale 删除残留的锁文件。只在其内容仍为 stale 时删除，避免误删同时启动的其他实例刚创建的锁
+func removeStale(path string, stale lockInfo) {
+	if current, err := readLock(path); err == nil && current != stale {
+		return
+	}
+	os.Remove(path)
+}
@@ -0,0 +1,128 @@
+package instance
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// acquire 获取 dir 下的锁，测试结束时释放
+func acquire(t *testing.T, dir string, onShow func()) *Instance {
+	t.Helper()
+	inst, err := Acquire(dir, onShow)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	t.Cleanup(func() { inst.Close() })
+	return inst
+}
+
+// TestAcquireRunning 第二个实例得到 ErrRunning，已运行的实例收到显示主窗口的信号并保留锁
+func TestAcquireRunning(t *testing.T) {
+	dir := t.TempDir()
+	shown := make(chan struct{}, 1)
+	first := acquire(t, dir, func() { shown <- struct{}{} })
+
+	second, err := Acquire(dir, nil)
+	if !errors.Is(err, ErrRunning) {
+		second.Close()
+		t.Fatalf("second Acquire = %v, want ErrRunning", err)
+	}
+	select {
+	case <-shown:
+	case <-time.After(signalTimeout):
+		t.Fatal("running instance was not asked to show its window")
+	}
+	if info, err := readLock(first.path); err != nil || info.Token != first.info.Token {
+		t.Fatalf("lock after second Acquire = %+v, %v, want the first instance's", info, err)
+	}
+}
+
+// TestSignalWrongToken 令牌不符的信号被拒绝，不显示主窗口
+func TestSignalWrongToken(t *testing.T) {
+	shown := make(chan struct{}, 1)
+	inst := acquire(t, t.TempDir(), func() { shown <- struct{}{} })
+
+	forged := inst.info
+	forged.Token = "forged"
+	if err := signal(forged, cmdShow); err == nil {
+		t.Fatal("signal with a wrong token was accepted")
+	}
+	if err := signal(inst.info, "quit"); err == nil {
+		t.Fatal("unknown command was accepted")
+	}
+	select {
+	case <-shown:
+		t.Fatal("rejected signal showed the window")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestAcquireStaleLock 锁文件损坏或其实例已不在监听（崩溃后残留）时接管锁
+func TestAcquireStaleLock(t *testing.T) {
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goneAddr := gone.Addr().String()
+	gone.Close()
+
+	for name, content := range map[string]string{
+		"corrupt":       "{not json",
+		"empty":         "",
+		"listener gone": `{"pid": 1, "addr": "` + goneAddr + `", "token": "stale"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, lockName), []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			inst := acquire(t, dir, nil)
+			if info, err := readLock(inst.path); err != nil || info != inst.info {
+				t.Fatalf("lock after takeover = %+v, %v, want %+v", info, err, inst.info)
+			}
+		})
+	}
+}
+
+// TestClose 关闭时删除自己的锁文件，锁文件已被其他实例接管时保留
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, lockName)
+	inst, err := Acquire(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("lock after Close: %v, want removed", err)
+	}
+	if err := signal(inst.info, cmdShow); err == nil {
+		t.Fatal("closed instance still answers signals")
+	}
+
+	inst, err = Acquire(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := lockInfo{PID: 1, Addr: "127.0.0.1:1", Token: "other"}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLock(path, other); err != nil {
+		t.Fatal(err)
+	}
+	inst.Close()
+	if info, err := readLock(path); err != nil || info != other {
+		t.Fatalf("lock after Close = %+v, %v, want the other instance's lock kept", info, err)
+	}
+	var nilInst *Instance
+	if err := nilInst.Close(); err != nil {
+		t.Fatalf("nil Close = %v", err)
+	}
+}
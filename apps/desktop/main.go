@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	_ "embed"
+	"errors"
 	"log"
 	"log/slog"
 	"path/filepath"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/atticus6/echPlus/apps/desktop/config"
 	"github.com/atticus6/echPlus/apps/desktop/database"
+	"github.com/atticus6/echPlus/apps/desktop/instance"
 	"github.com/atticus6/echPlus/apps/desktop/logger"
 	"github.com/atticus6/echPlus/apps/desktop/services"
 	"github.com/atticus6/echPlus/apps/desktop/views"
@@ -38,7 +40,18 @@ func main() {
 	}
 	defer logger.Close()
 
+	// 只运行一个实例：已有实例在运行时通知其显示主窗口后退出
+	inst, err := instance.Acquire(config.StoreDir, views.ShowMainWindow)
+	if errors.Is(err, instance.ErrRunning) {
+		logger.Info("%v，已通知其显示主窗口", err)
+		return
+	}
+	if err != nil {
+		logger.Error("获取单实例锁失败，继续启动: %v", err)
+	}
+
 	logger.Info("应用启动，数据库路径: %s", dbPath)
+	services.CheckCoreAPI()
 
 	if err := database.Init(dbPath); err != nil {
 		logger.Fatal("数据库初始化失败: %v", err)
@@ -60,6 +73,8 @@ func main() {
 			application.NewService(&services.ProxyServerInstance),
 			application.NewService(&services.ConfigService{}),
 			application.NewService(&services.LogService{}),
+			application.NewService(&services.AppInfoService{}),
+			application.NewService(&services.DiagnosticsService{}),
 		},
 		Assets: application.AssetOptions{
 			Handler: application.AssetFileServerFS(assets),
@@ -74,28 +89,17 @@ func main() {
 			if err := config.ConfigState.SaveConfig(); err != nil {
 				logger.Error("保存配置失败: %s", err.Error())
 			}
-			err := services.ProxyServerInstance.Stop()
-			if err != nil {
-				logger.Error("%s", err.Error())
-			}
+			// 停止代理、保存流量统计并关闭系统代理，各步骤均有时间上限
+			services.Shutdown()
+			// 停止接收单实例信号并删除锁文件
+			inst.Close()
+			// 最后同步并关闭日志文件，之后的日志会重新打开文件，由 main 返回时再次关闭
+			logger.Close()
 		},
 	})
 
-	// Create a new window with the necessary options.
-	// 'Title' is the title of the window.
-	// 'Mac' options tailor the window when running on macOS.
-	// 'BackgroundColour' is the background colour of the window.
-	// 'URL' is the URL that will be loaded into the webview.
-	views.MainView.Window.NewWithOptions(application.WebviewWindowOptions{
-		Title: "Window 1",
-		Mac: application.MacWindow{
-			InvisibleTitleBarHeight: 50,
-			Backdrop:                application.MacBackdropTranslucent,
-			TitleBar:                application.MacTitleBarHiddenInset,
-		},
-		BackgroundColour: application.NewRGB(27, 38, 54),
-		URL:              "/",
-	})
+	// 创建主窗口，之后其他实例启动时由单实例信号再次显示
+	views.ShowMainWindow()
 
 	// Create a goroutine that emits an event containing the current time every second.
 	// The frontend can listen to this event and update the UI accordingly.
@@ -108,7 +112,7 @@ func main() {
 	}()
 
 	// Run the application. This blocks until the application has been exited.
-	err := views.MainView.Run()
+	err = views.MainView.Run()
 
 	// If an error occurred while running the application, log it and exit.
 	if err != nil {
@@ -16,12 +16,17 @@ type User struct {
 }
 
 type Node struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Name      string    `json:"name" gorm:"size:100;not null"`
-	ServerIP  string    `json:"serverIP" `
-	Token     string    `json:"token"`
-	Address   string    `json:"address"`
-	Port      int64     `json:"port"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                 uint      `json:"id" gorm:"primaryKey"`
+	Name               string    `json:"name" gorm:"size:100;not null"`
+	ServerIP           string    `json:"serverIP" `
+	Token              string    `json:"token"`
+	Address            string    `json:"address"`
+	Port               int64     `json:"port"`
+	PinnedSPKI         string    `json:"pinnedSPKI"`         // 服务端证书的公钥固定值，逗号分隔，为空时不校验
+	PinAnyChain        bool      `json:"pinAnyChain"`        // 固定值可匹配证书链中的任一证书
+	HTTP2              bool      `json:"http2"`              // 通过 HTTP/2 扩展 CONNECT 建立 WebSocket
+	ECHDomain          string    `json:"echDomain"`          // 查询 ECH 配置的域名，为空时使用全局设置，core.ECHDomainServer 表示节点主机名
+	FallbackServerHost string    `json:"fallbackServerHost"` // ServerIP 为空且 HTTPS 记录中没有地址提示时连接服务端使用的域名，为空时使用 core 的默认值
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
 }
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/atticus6/echPlus/apps/desktop/apply"
+	"github.com/atticus6/echPlus/apps/desktop/logger"
+	"github.com/atticus6/echPlus/apps/desktop/views"
+)
+
+// ActionResult 操作结果，前端据此展示提示
+type ActionResult struct {
+	OK                bool     `json:"ok"`
+	Warnings          []string `json:"warnings"`
+	Error             string   `json:"error"`
+	RollbackPerformed bool     `json:"rollbackPerformed"` // 失败后是否已恢复到操作前的状态
+}
+
+// 操作完成后发送的事件名，事件数据为 ActionResult
+const (
+	EventStartResult       = "action:start"
+	EventStopResult        = "action:stop"
+	EventSwitchNodeResult  = "action:switchNode"
+	EventChangeValueResult = "action:changeValue"
+	EventPauseResult       = "action:pause"
+	EventResumeResult      = "action:resume"
+	EventFlushCachesResult = "action:flushCaches"
+	EventSetAdvancedResult = "action:setAdvanced"
+	EventUpdateTokenResult = "action:updateToken"
+)
+
+// warn 记录一条警告，操作本身仍视为成功
+func (r *ActionResult) warn(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Info("[警告] %s", msg)
+	r.Warnings = append(r.Warnings, msg)
+}
+
+// fail 记录失败原因
+func (r *ActionResult) fail(err error) {
+	logger.Error("%s", err.Error())
+	r.OK = false
+	r.Error = err.Error()
+}
+
+// newActionResult 创建默认成功的操作结果
+func newActionResult() ActionResult {
+	return ActionResult{OK: true, Warnings: []string{}}
+}
+
+// fromApply 将 apply 的操作结果转换为 ActionResult，日志已由 apply 记录
+func fromApply(r apply.Result) ActionResult {
+	result := newActionResult()
+	result.Warnings = append(result.Warnings, r.Warnings...)
+	result.RollbackPerformed = r.RollbackPerformed
+	if r.Err != nil {
+		result.OK = false
+		result.Error = r.Err.Error()
+	}
+	return result
+}
+
+// emitActionResult 向前端发送操作结果事件
+func emitActionResult(event string, r ActionResult) ActionResult {
+	if views.MainView != nil {
+		views.MainView.Event.Emit(event, r)
+	}
+	return r
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"path/filepath"
+
+	"github.com/atticus6/echPlus/apps/client/buildinfo"
+	"github.com/atticus6/echPlus/apps/desktop/config"
+)
+
+type AppInfoService struct{}
+
+// BuildInfo 构建元数据及运行环境能力，与命令行 -version 输出的信息一致
+type BuildInfo struct {
+	Version      string `json:"version"`
+	Commit       string `json:"commit"`
+	Date         string `json:"date"`
+	GoVersion    string `json:"goVersion"`
+	Platform     string `json:"platform"`
+	CoreAPI      string `json:"coreApi"`
+	ECHSupported bool   `json:"echSupported"`
+	ECHError     string `json:"echError"`
+	WailsVersion string `json:"wailsVersion"`
+	StoreDir     string `json:"storeDir"`
+	LogDir       string `json:"logDir"`
+	Report       string `json:"report"` // 纯文本报告，用于复制到问题反馈
+}
+
+// GetBuildInfo 获取版本、构建信息、ECH 支持情况及存储路径
+func (s *AppInfoService) GetBuildInfo() BuildInfo {
+	info := buildinfo.Get()
+	result := BuildInfo{
+		Version:      info.Version,
+		Commit:       info.Commit,
+		Date:         info.Date,
+		GoVersion:    info.GoVersion,
+		Platform:     info.Platform,
+		CoreAPI:      info.CoreAPI,
+		ECHSupported: info.ECHSupported,
+		ECHError:     info.ECHError,
+		WailsVersion: buildinfo.ModuleVersion("github.com/wailsapp/wails/v3"),
+		StoreDir:     config.StoreDir,
+		LogDir:       filepath.Join(config.StoreDir, "logs"),
+	}
+	result.Report = info.String() +
+		"Wails:    " + result.WailsVersion + "\n" +
+		"存储目录: " + result.StoreDir + "\n" +
+		"日志目录: " + result.LogDir + "\n"
+	return result
+}
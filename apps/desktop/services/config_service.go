@@ -2,9 +2,15 @@ package services
 
 import (
 	"fmt"
+	"maps"
 	"reflect"
+	"slices"
+	"strings"
 
+	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/desktop/apply"
 	"github.com/atticus6/echPlus/apps/desktop/config"
+	"github.com/atticus6/echPlus/apps/desktop/logger"
 )
 
 func MergeStructs(dst, src any) {
@@ -26,19 +32,139 @@ func MergeStructs(dst, src any) {
 type ConfigService struct{}
 
 func (c *ConfigService) GetValue() config.ConfigType {
-	return config.ConfigState
+	return currentState()
 }
 
-func (c *ConfigService) ChangeValue(v config.ConfigType) {
-	MergeStructs(&config.ConfigState, &v)
-	if v.SelectNodeId != 0 {
-		ProxyServerInstance.SwitchNode(v.SelectNodeId)
-	} else {
-		origonCfg := s.GetConfig()
-		v2 := config.ConfigState.GetproxyConfig()
-		MergeStructs(&origonCfg, &v2)
-		s.UpdateConfig(origonCfg)
+// currentState 返回 config.ConfigState 的副本，进行中的修改完成后才返回
+func currentState() config.ConfigType {
+	return configs.State()
+}
+
+// selectedNode 返回当前选中的节点，0 表示未选择
+func selectedNode() int64 {
+	return currentState().SelectNodeId
+}
+
+// ChangeValue 修改配置、应用到代理并立即保存，应用失败时恢复原配置
+func (c *ConfigService) ChangeValue(v config.ConfigType) ActionResult {
+	r := configs.Update(func(state *config.ConfigType, cfg *core.Config) error {
+		advanced := state.Advanced
+		MergeStructs(state, &v)
+		// 高级设置只能通过 SetAdvanced 修改
+		state.Advanced = advanced
+		v2 := state.GetproxyConfig()
+		MergeStructs(cfg, &v2)
+		if v.SelectNodeId != 0 {
+			n, err := lookupNode(v.SelectNodeId)
+			if err != nil {
+				return err
+			}
+			apply.ApplyNode(cfg, *state, n)
+		}
+		return nil
+	})
+	if r.Err == nil {
+		logger.Info("配置已更新: %+v", currentState())
+	}
+	return emitActionResult(EventChangeValueResult, fromApply(r))
+}
+
+// nodeSettings 由节点配置决定的字段，切换节点时覆盖，不作为高级设置提供
+var nodeSettings = map[string]bool{"PinnedSPKI": true, "PinAnyChainCert": true, "HTTP2WebSocket": true}
+
+// advancedSettings 桌面端提供的高级设置：core 标记为高级、可序列化且不由节点决定
+func advancedSettings() []core.Setting {
+	var out []core.Setting
+	for _, st := range core.Settings() {
+		if st.Advanced && st.Type != core.SettingOther && !nodeSettings[st.Name] {
+			out = append(out, st)
+		}
+	}
+	return out
+}
+
+// DescribeSettings 返回高级设置的描述，Default 为桌面端未修改该项时实际使用的值
+func (c *ConfigService) DescribeSettings() []core.Setting {
+	settings := advancedSettings()
+	names := make([]string, len(settings))
+	for i, st := range settings {
+		names[i] = st.Name
+	}
+	state := currentState()
+	base := core.SettingValues(state.BaseProxyConfig(), names...)
+	zero := core.SettingValues(core.Config{}, names...)
+	for i, st := range settings {
+		// 桌面端覆盖了 core 默认值的字段（如 RequireECH、IdleTimeout）以桌面端的值为准
+		if !reflect.DeepEqual(base[st.Name], zero[st.Name]) {
+			settings[i].Default = base[st.Name]
+		}
 	}
+	return settings
+}
+
+// GetAdvanced 返回高级设置的当前值；需重启生效的设置返回已保存的值
+func (c *ConfigService) GetAdvanced() map[string]any {
+	settings := advancedSettings()
+	names := make([]string, len(settings))
+	for i, st := range settings {
+		names[i] = st.Name
+	}
+	values := core.SettingValues(s.GetConfig(), names...)
+	saved := currentState().Advanced
+	for _, st := range settings {
+		if v, ok := saved[st.Name]; ok && st.RestartRequired {
+			values[st.Name] = v
+		}
+	}
+	return values
+}
 
-	fmt.Println(config.ConfigState, config.ConfigState)
+// SetAdvanced 校验并保存高级设置，可立即生效的设置通过 Reload 应用，失败时恢复原配置；
+// 需重启生效的设置只保存，下次启动应用时生效
+func (c *ConfigService) SetAdvanced(values map[string]any) ActionResult {
+	result := newActionResult()
+	allowed := map[string]core.Setting{}
+	for _, st := range advancedSettings() {
+		allowed[st.Name] = st
+	}
+	hot := map[string]any{}
+	var pending []string
+	for name, v := range values {
+		st, ok := allowed[name]
+		if !ok {
+			result.fail(fmt.Errorf("不支持的高级设置: %s", name))
+			return emitActionResult(EventSetAdvancedResult, result)
+		}
+		if st.RestartRequired {
+			pending = append(pending, name)
+			continue
+		}
+		hot[name] = v
+	}
+
+	r := configs.Update(func(state *config.ConfigType, cfg *core.Config) error {
+		// 先在当前配置上校验全部设置，任一无效时不做任何修改
+		check := *cfg
+		if err := core.ApplySettings(&check, values); err != nil {
+			return err
+		}
+		advanced := maps.Clone(state.Advanced)
+		if advanced == nil {
+			advanced = map[string]any{}
+		}
+		maps.Copy(advanced, values)
+		state.Advanced = advanced
+		// 需重启生效的设置不改变核心配置，没有可立即生效的设置时不 Reload
+		return core.ApplySettings(cfg, hot)
+	})
+	result = fromApply(r)
+	if r.Err != nil {
+		return emitActionResult(EventSetAdvancedResult, result)
+	}
+	if len(pending) > 0 {
+		slices.Sort(pending)
+		result.warn("%s 需重启应用后生效", strings.Join(pending, "、"))
+	}
+	logger.Info("高级设置已更新: %v", values)
+	return emitActionResult(EventSetAdvancedResult, result)
 }
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/desktop/logger"
+)
+
+// 桌面端适配的 core API 版本，使用 core 新增的 API 时同步提高
+const (
+	coreAPIMajor = 1
+	coreAPIMinor = 42
+)
+
+// 编译期断言：core 主版本不同或次版本低于 coreAPIMinor 时数组长度为负，编译失败
+var (
+	_ [core.APIMajor - coreAPIMajor]struct{}
+	_ [coreAPIMajor - core.APIMajor]struct{}
+	_ [core.APIMinor - coreAPIMinor]struct{}
+)
+
+// CheckCoreAPI 启动时记录 core API 版本，core 比桌面端适配的版本新时给出提示
+func CheckCoreAPI() {
+	if core.APIMinor > coreAPIMinor {
+		logger.Error("[警告] core API 版本 %s 高于桌面端适配的 %d.%d，新增功能在桌面端不可用", core.Version, coreAPIMajor, coreAPIMinor)
+		return
+	}
+	logger.Info("core API 版本: %s", core.Version)
+}
@@ -0,0 +1,21 @@
+package services
+
+import (
+	"strings"
+
+	"github.com/atticus6/echPlus/apps/client/buildinfo"
+)
+
+type DiagnosticsService struct{}
+
+// ExplainHost 汇总最近几次访问 host 的分流决策、建立耗时、服务端、错误和相关日志，
+// 以及上游健康和 ECH/DoH 状态，生成用于复制到问题反馈的纯文本
+func (d *DiagnosticsService) ExplainHost(host string) string {
+	host = strings.TrimSpace(host)
+	info := buildinfo.Get()
+	header := "echPlus " + info.Version + " (" + info.Platform + ")\n"
+	if !s.IsRunning() {
+		header += "代理未运行，以下为停止前的记录\n"
+	}
+	return header + s.ExplainHost(host)
+}
@@ -1,27 +1,104 @@
 package services
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/core"
 	"github.com/atticus6/echPlus/apps/desktop/database"
 	"github.com/atticus6/echPlus/apps/desktop/models"
+	"gorm.io/gorm"
 )
 
 type NodeService struct{}
 
-func (s *NodeService) CreateNode(name, token, address, serverIP string, port int64) (*models.Node, error) {
+// CreateNode 创建节点，pinnedSPKI 为逗号分隔的公钥固定值，可为空；echDomain 为空时使用全局的 ECH 查询域名；
+// fallbackServerHost 为 serverIP 为空时连接服务端使用的域名，可为空。各字段按 core.Node.Validate 校验，与从分享链接导入的节点规则相同
+func (s *NodeService) CreateNode(name, token, address, serverIP string, port int64, pinnedSPKI string, pinAnyChain, http2 bool, echDomain, fallbackServerHost string) (*models.Node, error) {
+	n := newCoreNode(name, token, address, serverIP, port, pinnedSPKI, pinAnyChain, http2, echDomain, fallbackServerHost)
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+	return saveNode(n)
+}
 
-	node := &models.Node{
-		Name:     name,
-		ServerIP: serverIP,
-		Token:    token,
-		Port:     port,
-		Address:  address,
+// TestedNode CreateNodeTested 创建的节点及测试结果
+type TestedNode struct {
+	Node    *models.Node  `json:"node"`
+	Latency time.Duration `json:"latency"` // 建立 WebSocket 的耗时（纳秒）
+}
+
+// CreateNodeTested 先按当前的全局设置（DNS、ECH、上游代理、超时等）向节点建立一次连接，成功后才创建节点并返回耗时，
+// 地址、令牌或服务端 IP 填写错误时返回错误且不保存。参数同 CreateNode，离线配置时使用 CreateNode 跳过测试
+func (s *NodeService) CreateNodeTested(name, token, address, serverIP string, port int64, pinnedSPKI string, pinAnyChain, http2 bool, echDomain, fallbackServerHost string) (*TestedNode, error) {
+	n := newCoreNode(name, token, address, serverIP, port, pinnedSPKI, pinAnyChain, http2, echDomain, fallbackServerHost)
+	if err := n.Validate(); err != nil {
+		return nil, err
 	}
+	latency, err := core.TestConnection(context.Background(), nodeTestConfig(n))
+	if err != nil {
+		return nil, fmt.Errorf("节点测试失败，未保存: %w", err)
+	}
+	node, err := saveNode(n)
+	if err != nil {
+		return nil, err
+	}
+	return &TestedNode{Node: node, Latency: latency}, nil
+}
+
+// newCoreNode 按表单字段创建节点，去除各字段首尾的空白（令牌除外）
+func newCoreNode(name, token, address, serverIP string, port int64, pinnedSPKI string, pinAnyChain, http2 bool, echDomain, fallbackServerHost string) core.Node {
+	return core.Node{
+		Name:               strings.TrimSpace(name),
+		Address:            strings.TrimSpace(address),
+		Port:               port,
+		Token:              token,
+		ServerIP:           strings.TrimSpace(serverIP),
+		PinnedSPKI:         splitPins(pinnedSPKI),
+		PinAnyChain:        pinAnyChain,
+		HTTP2:              http2,
+		ECHDomain:          strings.TrimSpace(echDomain),
+		FallbackServerHost: strings.TrimSpace(fallbackServerHost),
+	}
+}
 
+// saveNode 保存已校验的节点
+func saveNode(n core.Node) (*models.Node, error) {
+	node := nodeModel(n)
 	if err := database.GetDB().Create(node).Error; err != nil {
 		return nil, err
 	}
 	return node, nil
+}
 
+// CreateNodeFromURI 从节点分享链接 (echplus://...) 创建节点，链接格式见 core.ParseNodeURI
+func (s *NodeService) CreateNodeFromURI(uri string) (*models.Node, error) {
+	n, err := core.ParseNodeURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	return saveNode(n)
+}
+
+// ImportNodes 导入订阅内容中的全部节点，任一节点无效时不导入任何节点。格式见 core.ParseNodeList
+func (s *NodeService) ImportNodes(data string) ([]models.Node, error) {
+	list, err := core.ParseNodeList([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]models.Node, 0, len(list))
+	for _, n := range list {
+		nodes = append(nodes, *nodeModel(n))
+	}
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&nodes).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
 }
 
 func (s *NodeService) GetNodes() ([]models.Node, error) {
@@ -31,3 +108,40 @@ func (s *NodeService) GetNodes() ([]models.Node, error) {
 	}
 	return nodes, nil
 }
+
+// nodeModel 将解析出的节点转换为数据库模型，公钥固定值以逗号连接
+func nodeModel(n core.Node) *models.Node {
+	return &models.Node{
+		Name:               n.Name,
+		ServerIP:           n.ServerIP,
+		Token:              n.Token,
+		Port:               n.Port,
+		Address:            n.Address,
+		PinnedSPKI:         strings.Join(n.PinnedSPKI, ","),
+		PinAnyChain:        n.PinAnyChain,
+		HTTP2:              n.HTTP2,
+		ECHDomain:          n.ECHDomain,
+		FallbackServerHost: n.FallbackServerHost,
+	}
+}
+
+// coreNode 将数据库中的节点转换为 core.Node
+func coreNode(node models.Node) core.Node {
+	return core.Node{
+		Name:               node.Name,
+		Address:            node.Address,
+		Port:               node.Port,
+		Token:              node.Token,
+		ServerIP:           node.ServerIP,
+		PinnedSPKI:         splitPins(node.PinnedSPKI),
+		PinAnyChain:        node.PinAnyChain,
+		HTTP2:              node.HTTP2,
+		ECHDomain:          node.ECHDomain,
+		FallbackServerHost: node.FallbackServerHost,
+	}
+}
+
+// splitPins 拆分以逗号或空格分隔的公钥固定值
+func splitPins(pins string) []string {
+	return strings.FieldsFunc(pins, func(r rune) bool { return r == ',' || r == ' ' })
+}
@@ -1,9 +1,12 @@
 package services
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/desktop/apply"
 	"github.com/atticus6/echPlus/apps/desktop/config"
 	"github.com/atticus6/echPlus/apps/desktop/database"
 	"github.com/atticus6/echPlus/apps/desktop/logger"
@@ -12,71 +15,180 @@ import (
 
 var s *core.ProxyServer
 
+// configs 串行化修改 config.ConfigState 和核心配置的操作，保证两者一致，
+// 并发的切换节点、修改配置按顺序执行而不会互相覆盖或回滚到对方的中间状态
+var configs *apply.Config
+
 func init() {
 	// 设置 client 日志处理器，将日志输出到 desktop
 	core.SetLogHandler(&ClientLogHandler{})
+	core.SetUpstreamErrorHandler(emitUpstreamError)
+	core.SetHealthHandler(emitHealth)
+	core.SetPlaintextHandler(emitPlaintext)
 	s = core.NewProxyServer(config.ConfigState.GetproxyConfig())
+	configs = apply.NewConfig(s, &config.ConfigState, func(state config.ConfigType) error { return state.SaveConfig() })
 }
 
 type ProxyServerDesktop struct {
 }
 
+// systemProxyTimeout 退出时关闭系统代理的时间上限
+const systemProxyTimeout = 5 * time.Second
+
+// Shutdown 应用退出时按顺序停止代理：停止接受新连接、等待连接关闭并保存流量统计（时间上限见 core.ShutdownTimeout），
+// 再关闭系统代理。各步骤超时时记录日志后继续，不会阻止退出
+func Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), core.ShutdownTimeout(s.GetConfig()))
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("停止代理失败: %v", err)
+	}
+	if err := withTimeout(systemProxyTimeout, ProxyServerInstance.DisableSOCKS5Proxy); err != nil {
+		logger.Error("关闭系统代理失败: %v", err)
+	}
+}
+
+// withTimeout 最多等待 timeout 让 fn 返回，超时时 fn 在后台继续
+func withTimeout(timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("超过 %v 未完成", timeout)
+	}
+}
+
 // ProxyConfig 代理配置
 type ProxyConfig struct {
 	Host string
 	Port string
 }
 
-func (p *ProxyServerDesktop) Start() (err error) {
+// systemProxy 经 ProxyServerDesktop 的平台实现设置系统代理，供 apply 使用
+type systemProxy struct{ p *ProxyServerDesktop }
+
+func (sp systemProxy) Set(host, port string) error {
+	return sp.p.SetSOCKS5Proxy(ProxyConfig{Host: host, Port: port})
+}
+
+func (sp systemProxy) Disable() error {
+	return sp.p.DisableSOCKS5Proxy()
+}
 
+// Start 启动代理并设置系统代理，核心启动失败时不修改系统代理
+func (p *ProxyServerDesktop) Start() ActionResult {
 	if s.GetConfig().ServerAddr == "" {
-		p.SwitchNode(config.ConfigState.SelectNodeId)
+		if r := p.switchNode(selectedNode()); !r.OK {
+			return emitActionResult(EventStartResult, r)
+		}
 	}
 
-	err = s.Start()
-	if err != nil {
-		logger.Error("%s", err)
-		return
+	state := currentState()
+	r := apply.Start(s, systemProxy{p}, state.ListenAddr, fmt.Sprint(state.ListenPort))
+	return emitActionResult(EventStartResult, fromApply(r))
+}
+
+// Stop 停止代理并关闭系统代理，核心停止失败时保留系统代理设置
+func (p *ProxyServerDesktop) Stop() ActionResult {
+	return emitActionResult(EventStopResult, fromApply(apply.Stop(s, systemProxy{p})))
+}
+
+// SwitchNode 切换节点并立即保存选择，应用失败时恢复原节点，前端据 OK 为 false 恢复显示的选择
+func (p *ProxyServerDesktop) SwitchNode(nodeId int64) ActionResult {
+	return emitActionResult(EventSwitchNodeResult, p.switchNode(nodeId))
+}
+
+// switchNode 经 configs 更新选中的节点和核心配置，成功后写入配置文件
+func (p *ProxyServerDesktop) switchNode(nodeId int64) ActionResult {
+	return fromApply(configs.SelectNode(nodeId, lookupNode))
+}
+
+// UpdateNodeToken 修改节点的令牌。节点为当前选中的节点时：applyNow 为 true 或代理未运行时经 core.ProxyServer.UpdateToken
+// 立即生效，不重启、不中断已建立的隧道，服务端拒绝新令牌时保留原令牌并返回失败；applyNow 为 false 且代理运行中时只保存，
+// 重新选择该节点后生效
+func (p *ProxyServerDesktop) UpdateNodeToken(nodeId int64, token string, applyNow bool) ActionResult {
+	result := newActionResult()
+	var node models.Node
+	if err := database.GetDB().First(&node, nodeId).Error; err != nil {
+		result.fail(fmt.Errorf("节点不存在: %d", nodeId))
+		return emitActionResult(EventUpdateTokenResult, result)
+	}
+	n := coreNode(node)
+	n.Token = token
+	if err := n.Validate(); err != nil {
+		result.fail(err)
+		return emitActionResult(EventUpdateTokenResult, result)
 	}
 
-	err = p.SetSOCKS5Proxy(ProxyConfig{
-		Host: config.ConfigState.ListenAddr,
-		Port: fmt.Sprint(config.ConfigState.ListenPort),
+	configs.Do(func(state config.ConfigType) {
+		if state.SelectNodeId == nodeId {
+			if applyNow || !s.IsRunning() {
+				if err := s.UpdateToken(token); err != nil {
+					result.fail(err)
+					return
+				}
+			} else {
+				result.warn("新令牌已保存，重新选择该节点后生效")
+			}
+		}
+		if err := database.GetDB().Model(&node).Update("token", token).Error; err != nil {
+			result.warn("保存令牌失败: %s", err.Error())
+		}
 	})
-	if err != nil {
-		logger.Error("%s", err)
-	}
-	return
+	return emitActionResult(EventUpdateTokenResult, result)
 }
 
-func (p *ProxyServerDesktop) Stop() (err error) {
-	err = s.Stop()
-	if err != nil {
-		logger.Error("%s", err.Error())
+// lookupNode 从数据库读取节点
+func lookupNode(nodeId int64) (core.Node, error) {
+	var node models.Node
+	if err := database.GetDB().First(&node, nodeId).Error; err != nil {
+		return core.Node{}, fmt.Errorf("节点不存在: %d", nodeId)
 	}
-	err = p.DisableSOCKS5Proxy()
-	return
+	return coreNode(node), nil
 }
 
-func (p *ProxyServerDesktop) SwitchNode(nodeId int64) {
-	if nodeId == 0 {
-		return
+// nodeTestConfig 以当前代理配置为基础写入 n 的连接信息，用于测试尚未保存的节点
+func nodeTestConfig(n core.Node) core.Config {
+	var cfg core.Config
+	configs.Do(func(state config.ConfigType) {
+		cfg = s.GetConfig()
+		apply.ApplyNode(&cfg, state, n)
+	})
+	return cfg
+}
+
+// Pause 暂停代理，保留系统代理设置，新连接按配置拒绝或直连
+func (p *ProxyServerDesktop) Pause() ActionResult {
+	result := newActionResult()
+	if err := s.Pause(); err != nil {
+		result.fail(err)
 	}
-	var node models.Node
-	if err := database.GetDB().Find(&node, nodeId).Error; err != nil {
-		logger.Error("节点不存在")
-		return
+	return emitActionResult(EventPauseResult, result)
+}
+
+// Resume 恢复暂停的代理
+func (p *ProxyServerDesktop) Resume() ActionResult {
+	result := newActionResult()
+	if err := s.Resume(); err != nil {
+		result.fail(err)
 	}
-	config.ConfigState.SelectNodeId = nodeId
-	orgionConfig := s.GetConfig()
-	orgionConfig.Token = node.Token
-	orgionConfig.ServerAddr = fmt.Sprintf("%s:%d", node.Address, node.Port)
-	orgionConfig.ServerIP = node.ServerIP
-	err := s.UpdateConfig(orgionConfig)
-	if err != nil {
-		logger.Error("%s", err.Error())
+	return emitActionResult(EventResumeResult, result)
+}
+
+// FlushCaches 清空 DNS、ECH、IP 列表等运行时缓存，切换网络后使用
+func (p *ProxyServerDesktop) FlushCaches() ActionResult {
+	result := newActionResult()
+	if _, err := s.FlushCaches(); err != nil {
+		result.warn("%s", err.Error())
 	}
+	return emitActionResult(EventFlushCachesResult, result)
+}
 
+// GetState 获取代理状态: stopped/running/paused/stopping
+func (p *ProxyServerDesktop) GetState() core.ServerState {
+	return s.GetState()
 }
 
 func (p *ProxyServerDesktop) IsRunning() bool {
@@ -89,13 +201,14 @@ func (p *ProxyServerDesktop) GetTrafficStats() *TrafficStatsResponse {
 	if stats == nil {
 		return &TrafficStatsResponse{}
 	}
-	
-	upload, download := stats.GetTotalStats()
+
+	breakdown := stats.GetSiteBreakdown(10)
 	uploadSpeed, downloadSpeed := stats.GetSpeed()
-	topSites := stats.GetTopSites(10)
-	
-	sites := make([]SiteStatsResponse, 0, len(topSites))
-	for _, site := range topSites {
+	rateLimit := s.GetTotalRateLimitStatus()
+	handshake := s.GetHandshakeStats()
+
+	sites := make([]SiteStatsResponse, 0, len(breakdown.Top))
+	for _, site := range breakdown.Top {
 		sites = append(sites, SiteStatsResponse{
 			Host:        site.Host,
 			Upload:      site.Upload,
@@ -103,23 +216,71 @@ func (p *ProxyServerDesktop) GetTrafficStats() *TrafficStatsResponse {
 			Connections: site.Connections,
 		})
 	}
-	
+
 	return &TrafficStatsResponse{
-		TotalUpload:   upload,
-		TotalDownload: download,
-		UploadSpeed:   uploadSpeed,
-		DownloadSpeed: downloadSpeed,
-		Sites:         sites,
+		TotalUpload:       breakdown.TotalUpload,
+		TotalDownload:     breakdown.TotalDownload,
+		UploadSpeed:       uploadSpeed,
+		DownloadSpeed:     downloadSpeed,
+		ActiveConnections: s.ActiveConnections(),
+		TotalRateLimit:    rateLimit.Limit,
+		RateUtilization:   rateLimit.Utilization,
+		FallbackConns:     stats.GetFallbackConnections(),
+		HandshakeP50:      handshake.P50.Milliseconds(),
+		HandshakeP95:      handshake.P95.Milliseconds(),
+		Sites:             sites,
+		Other: SiteStatsResponse{
+			Upload:      breakdown.Rest.Upload,
+			Download:    breakdown.Rest.Download,
+			Connections: breakdown.Rest.Connections,
+		},
 	}
 }
 
+// GetUpstreamStatus 获取上游服务端状态（机房、CF-Ray 等诊断信息）
+func (p *ProxyServerDesktop) GetUpstreamStatus() core.UpstreamStatus {
+	return s.GetUpstreamStatus()
+}
+
+// GetHealth 获取后台健康检查的结果，未开启 HealthCheckInterval 时不检查
+func (p *ProxyServerDesktop) GetHealth() core.Health {
+	return s.GetHealth()
+}
+
+// GetECHStatus 获取后台刷新 ECH 配置的状态和各查询域名当前使用的配置
+func (p *ProxyServerDesktop) GetECHStatus() core.ECHStatus {
+	return s.GetECHStatus()
+}
+
+// GetServerIPStats 获取 ServerIP 各候选地址的测速结果，只有一个候选地址时不测速
+func (p *ProxyServerDesktop) GetServerIPStats() []core.ServerIPStats {
+	return s.GetServerIPStats()
+}
+
+// GetActiveConnections 获取正在处理的连接，按开始时间从旧到新排列
+func (p *ProxyServerDesktop) GetActiveConnections() []core.ActiveConnection {
+	return s.GetActiveConnections()
+}
+
+// CloseConnection 强制关闭 ConnID 为 connID 的连接，连接已结束时返回 false
+func (p *ProxyServerDesktop) CloseConnection(connID uint64) bool {
+	return s.CloseConnection(connID)
+}
+
 // TrafficStatsResponse 流量统计响应
 type TrafficStatsResponse struct {
-	TotalUpload   int64               `json:"totalUpload"`
-	TotalDownload int64               `json:"totalDownload"`
-	UploadSpeed   int64               `json:"uploadSpeed"`   // bytes/s
-	DownloadSpeed int64               `json:"downloadSpeed"` // bytes/s
-	Sites         []SiteStatsResponse `json:"sites"`
+	TotalUpload       int64               `json:"totalUpload"`
+	TotalDownload     int64               `json:"totalDownload"`
+	UploadSpeed       int64               `json:"uploadSpeed"`       // bytes/s
+	DownloadSpeed     int64               `json:"downloadSpeed"`     // bytes/s
+	ActiveConnections int64               `json:"activeConnections"` // 当前正在处理的连接数
+	TotalRateLimit    int64               `json:"totalRateLimit"`    // 总带宽限制 bytes/s，0 表示不限制
+	RateUtilization   float64             `json:"rateUtilization"`   // 总带宽利用率 0~1
+	FallbackConns     int64               `json:"fallbackConns"`     // 服务端不可用时降级为直连的连接数
+	HandshakeP50      int64               `json:"handshakeP50"`      // 最近建立隧道耗时的中位数（毫秒），0 表示尚无数据
+	HandshakeP95      int64               `json:"handshakeP95"`      // 最近建立隧道耗时的 p95（毫秒）
+	Sites             []SiteStatsResponse `json:"sites"`
+	Other             SiteStatsResponse   `json:"other"` // 未在 Sites 中列出的其余站点合计，与 Sites 相加等于总流量
 }
 
 // SiteStatsResponse 站点统计响应
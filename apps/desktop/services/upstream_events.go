@@ -0,0 +1,50 @@
+package services
+
+import (
+	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/desktop/views"
+)
+
+// EventPinMismatch 服务端证书未通过节点的公钥固定校验时发送的事件，事件数据为 UpstreamErrorEvent
+const EventPinMismatch = "upstream:pinMismatch"
+
+// EventHealth 后台健康检查发现服务端变为不可用或已恢复时发送的事件，事件数据为 core.Health
+const EventHealth = "upstream:health"
+
+// EventPlaintext 按 PlaintextPolicy 警告或拒绝了经代理发送的明文协议连接时发送的事件，事件数据为 core.PlaintextEvent
+const EventPlaintext = "proxy:plaintext"
+
+// UpstreamErrorEvent 上游连接失败的事件数据
+type UpstreamErrorEvent struct {
+	Code   string `json:"code"` // core.UpstreamError* 常量
+	Error  string `json:"error"`
+	NodeID int64  `json:"nodeId"` // 发生失败时选中的节点
+}
+
+// emitUpstreamError 将 core 报告的上游连接失败转发给前端
+func emitUpstreamError(code string, err error) {
+	if code != core.UpstreamErrorPinMismatch || views.MainView == nil {
+		return
+	}
+	views.MainView.Event.Emit(EventPinMismatch, UpstreamErrorEvent{
+		Code:   code,
+		Error:  err.Error(),
+		NodeID: selectedNode(),
+	})
+}
+
+// emitHealth 将健康检查的状态变化转发给前端
+func emitHealth(health core.Health) {
+	if views.MainView == nil {
+		return
+	}
+	views.MainView.Event.Emit(EventHealth, health)
+}
+
+// emitPlaintext 将明文协议连接的警告或拒绝转发给前端
+func emitPlaintext(event core.PlaintextEvent) {
+	if views.MainView == nil {
+		return
+	}
+	views.MainView.Event.Emit(EventPlaintext, event)
+}
@@ -1,5 +1,44 @@
 package views
 
-import "github.com/wailsapp/wails/v3/pkg/application"
+import (
+	"sync"
+
+	"github.com/wailsapp/wails/v3/pkg/application"
+)
 
 var MainView *application.App
+
+// mainWindowName 主窗口的名称，用于查找已创建的主窗口
+const mainWindowName = "main"
+
+// mainWindowMu 串行化 ShowMainWindow，同时收到多个显示请求时只创建一个主窗口
+var mainWindowMu sync.Mutex
+
+// ShowMainWindow 显示主窗口并置于前台，主窗口尚未创建或已关闭时创建。
+// 启动时及其他实例启动时调用，MainView 尚未创建时不做任何事
+func ShowMainWindow() {
+	mainWindowMu.Lock()
+	defer mainWindowMu.Unlock()
+	if MainView == nil {
+		return
+	}
+	if w, ok := MainView.Window.GetByName(mainWindowName); ok {
+		if w.IsMinimised() {
+			w.UnMinimise()
+		}
+		w.Show()
+		w.Focus()
+		return
+	}
+	MainView.Window.NewWithOptions(application.WebviewWindowOptions{
+		Name:  mainWindowName,
+		Title: "echPlus",
+		Mac: application.MacWindow{
+			InvisibleTitleBarHeight: 50,
+			Backdrop:                application.MacBackdropTranslucent,
+			TitleBar:                application.MacTitleBarHiddenInset,
+		},
+		BackgroundColour: application.NewRGB(27, 38, 54),
+		URL:              "/",
+	})
+}
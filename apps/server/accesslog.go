@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// accessRecord 访问日志记录，每个会话结束时写入一行 JSON
+type accessRecord struct {
+	Session     string    `json:"session"`
+	Protocol    string    `json:"protocol"` // echplus 或 vless
+	Client      string    `json:"client"`
+	Target      string    `json:"target,omitempty"` // 未收到 CONNECT 时为空
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	DurationMs  int64     `json:"duration_ms"`
+	BytesUp     int64     `json:"bytes_up"`   // 客户端 -> 目标
+	BytesDown   int64     `json:"bytes_down"` // 目标 -> 客户端
+	CloseReason string    `json:"close_reason"`
+}
+
+// accessLogger 追加写入 JSON Lines 访问日志。
+// 文件以 O_APPEND 打开，每条记录一次写入，多个进程写同一文件也不会交错；
+// 超过 maxSize 时轮转为 <path>.1（只保留一个），收到 SIGHUP 时重新打开，便于配合 logrotate
+type accessLogger struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // 字节，0 表示不轮转
+	file    *os.File
+	size    int64
+}
+
+// accessLog 为 nil 时不记录访问日志
+var accessLog *accessLogger
+
+// openAccessLog 打开访问日志，maxSize 为轮转大小（字节）
+func openAccessLog(path string, maxSize int64) (*accessLogger, error) {
+	l := &accessLogger{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open 打开或创建日志文件，调用方持有 mu 或尚未共享 l
+func (l *accessLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// reopen 关闭并重新打开日志文件，外部工具移走文件后调用
+func (l *accessLogger) reopen() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+	return l.open()
+}
+
+// rotate 将当前文件重命名为 <path>.1 并新建文件，调用方持有 mu
+func (l *accessLogger) rotate() error {
+	l.file.Close()
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		logWarn("Failed to rotate access log: %v", err)
+	}
+	return l.open()
+}
+
+// write 写入一条记录，写入失败只记录到标准日志，不影响会话
+func (l *accessLogger) write(r accessRecord) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		logWarn("Failed to encode access log record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			logWarn("Failed to reopen access log: %v", err)
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		logWarn("Failed to write access log: %v", err)
+	}
+}
+
+// close 关闭日志文件
+func (l *accessLogger) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// closeReason 由会话读写循环中的错误得出关闭原因，side 为 client 或 remote
+func closeReason(side string, err error) string {
+	if err == nil || errors.Is(err, io.EOF) ||
+		websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return side + " closed"
+	}
+	return fmt.Sprintf("%s error: %v", side, err)
+}
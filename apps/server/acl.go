@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errForbidden 目标被访问控制规则拒绝，客户端收到 "ERROR:forbidden"
+var errForbidden = errors.New("forbidden")
+
+// errPrivateTarget 目标为内网、回环或链路本地地址，未设置 -allow-private 时拒绝，防止 SSRF
+var errPrivateTarget = errors.New("forbidden: private address")
+
+// resolveTimeout 解析目标域名的超时
+const resolveTimeout = 5 * time.Second
+
+// lookupIP 解析目标域名，测试时可替换
+var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// defaultDeniedPorts 默认拒绝的端口（SMTP），防止被用于转发垃圾邮件，匹配 -allow 规则时放行
+var defaultDeniedPorts = []int{25}
+
+// targetRule 目标访问规则，格式为 [主机][:端口]:
+//
+//	主机  CIDR (10.0.0.0/8)、IP、域名（匹配自身及所有子域名，可写作 example.com 或 *.example.com），
+//	      省略或 * 表示任意主机；IPv6 需带端口时用方括号，如 [2001:db8::/32]:443
+//	端口  单个端口 (25)、范围 (8000-9000)，省略或 * 表示任意端口
+type targetRule struct {
+	network  *net.IPNet
+	ip       net.IP
+	domain   string
+	anyHost  bool
+	portFrom int
+	portTo   int
+}
+
+// parseTargetRule 解析单条规则
+func parseTargetRule(pattern string) (targetRule, error) {
+	var r targetRule
+	host, port := pattern, ""
+	switch {
+	case strings.HasPrefix(pattern, "["):
+		end := strings.Index(pattern, "]")
+		if end < 0 {
+			return r, fmt.Errorf("invalid rule %q: missing ]", pattern)
+		}
+		host = pattern[1:end]
+		if rest := pattern[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return r, fmt.Errorf("invalid rule %q", pattern)
+			}
+			port = rest[1:]
+		}
+	case strings.Count(pattern, ":") == 1:
+		host, port, _ = strings.Cut(pattern, ":")
+	}
+
+	r.portFrom, r.portTo = 0, 65535
+	if port != "" && port != "*" {
+		from, to, isRange := strings.Cut(port, "-")
+		var err error
+		if r.portFrom, err = strconv.Atoi(from); err != nil {
+			return r, fmt.Errorf("invalid port in rule %q", pattern)
+		}
+		r.portTo = r.portFrom
+		if isRange {
+			if r.portTo, err = strconv.Atoi(to); err != nil || r.portTo < r.portFrom {
+				return r, fmt.Errorf("invalid port range in rule %q", pattern)
+			}
+		}
+	}
+
+	host = strings.ToLower(host)
+	switch {
+	case host == "" || host == "*":
+		r.anyHost = true
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return r, fmt.Errorf("invalid CIDR in rule %q: %v", pattern, err)
+		}
+		r.network = network
+	case net.ParseIP(host) != nil:
+		r.ip = net.ParseIP(host)
+	default:
+		r.domain = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+	}
+	return r, nil
+}
+
+// matchPort 判断端口是否在规则范围内
+func (r targetRule) matchPort(port int) bool {
+	return port >= r.portFrom && port <= r.portTo
+}
+
+// match 判断目标是否匹配规则，host 为域名或 IP
+func (r targetRule) match(host string, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	if r.anyHost {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return r.matchIP(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return r.domain != "" && (host == r.domain || strings.HasSuffix(host, "."+r.domain))
+}
+
+// matchIP 判断 IP 是否匹配规则的 CIDR 或 IP
+func (r targetRule) matchIP(ip net.IP) bool {
+	if r.network != nil {
+		return r.network.Contains(ip)
+	}
+	return r.ip != nil && r.ip.Equal(ip)
+}
+
+// targetACL 目标访问控制:
+//  1. 匹配 deny 规则的目标一律拒绝
+//  2. 设置了 allow 规则时，只允许匹配的目标
+//  3. defaultDeniedPorts 中的端口需匹配 allow 规则才放行
+type targetACL struct {
+	allow []targetRule
+	deny  []targetRule
+}
+
+var acl = &targetACL{}
+
+// parseTargetRules 解析逗号分隔的规则列表
+func parseTargetRules(list string) ([]targetRule, error) {
+	var rules []targetRule
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		r, err := parseTargetRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// newTargetACL 根据 -allow、-deny 创建访问控制
+func newTargetACL(allow, deny string) (*targetACL, error) {
+	a := &targetACL{}
+	var err error
+	if a.allow, err = parseTargetRules(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseTargetRules(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// check 在连接前检查目标地址，拒绝时返回 errForbidden
+func (a *targetACL) check(target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	for _, r := range a.deny {
+		if r.match(host, port) {
+			return errForbidden
+		}
+	}
+	allowed := false
+	for _, r := range a.allow {
+		if r.match(host, port) {
+			allowed = true
+			break
+		}
+	}
+	if allowed {
+		return nil
+	}
+	if len(a.allow) > 0 {
+		return errForbidden
+	}
+	for _, p := range defaultDeniedPorts {
+		if port == p {
+			return errForbidden
+		}
+	}
+	return nil
+}
+
+// checkResolved 连接建立后按实际 IP 再检查一次 deny 中的 CIDR/IP 规则，
+// 防止通过解析到内网地址的域名绕过
+func (a *targetACL) checkResolved(addr net.Addr) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	for _, r := range a.deny {
+		if (r.network != nil || r.ip != nil) && r.matchPort(tcpAddr.Port) && r.matchIP(tcpAddr.IP) {
+			return errForbidden
+		}
+	}
+	return nil
+}
+
+// isPrivateIP 判断是否为内网、回环或链路本地地址，与客户端 isPrivateIPAddress 的判断一致，
+// 另外拒绝 0.0.0.0 和 ::（连接时等同于本机）
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// resolvePublic 解析目标并确认所有地址都不是内网地址，返回可连接的地址列表。
+// 检查所有解析结果，并直接连接检查过的 IP，DNS 重绑定无法在检查和连接之间换成内网地址
+func resolvePublic(target string) ([]string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		if ips, err = lookupIP(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return nil, errPrivateTarget
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs, nil
+}
+
+// dialTarget 检查访问控制后连接目标，失败时计入 metrics.dialFailures
+func dialTarget(target string) (net.Conn, error) {
+	conn, err := dialAllowedTarget(target)
+	if err != nil {
+		metrics.dialFailures.Add(1)
+	}
+	return conn, err
+}
+
+// dialAllowedTarget 检查访问控制，通过后依次连接目标的各地址
+func dialAllowedTarget(target string) (net.Conn, error) {
+	if err := acl.check(target); err != nil {
+		return nil, err
+	}
+	addrs := []string{target}
+	if !allowPrivate {
+		var err error
+		if addrs, err = resolvePublic(target); err != nil {
+			return nil, err
+		}
+	}
+	var conn net.Conn
+	var err error
+	for _, addr := range addrs {
+		if conn, err = dialRemote("tcp", addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := acl.checkResolved(conn.RemoteAddr()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
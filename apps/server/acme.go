@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// letsEncryptStagingURL Let's Encrypt 测试环境的目录地址，签发的证书不受浏览器信任，但没有严格的频率限制
+const letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// acmeOptions 自动证书的配置
+type acmeOptions struct {
+	domains   []string
+	cacheDir  string
+	email     string
+	staging   bool
+	directory string // ACME 目录地址，为空时使用 Let's Encrypt（staging 为 true 时使用其测试环境）
+}
+
+// acmeTLS 通过 ACME 自动获取和续期本机 TLS 监听使用的证书。
+// 证书和账户密钥保存在 cacheDir，重启后直接复用，到期前 30 天在后台续期
+type acmeTLS struct {
+	manager  *autocert.Manager
+	domains  []string
+	fallback *tls.Certificate // staging 模式下获取证书失败时使用的自签名证书
+}
+
+func newACME(opts acmeOptions) (*acmeTLS, error) {
+	if len(opts.domains) == 0 {
+		return nil, errors.New("no ACME domain")
+	}
+	for i, d := range opts.domains {
+		opts.domains[i] = strings.TrimSuffix(strings.ToLower(d), ".")
+	}
+	if opts.cacheDir == "" {
+		return nil, errors.New("-acme-cache is required")
+	}
+	// 提前创建缓存目录，不可写时在启动时而不是首次握手时报错
+	if err := os.MkdirAll(opts.cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("create ACME cache directory: %w", err)
+	}
+	directory := opts.directory
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+		if opts.staging {
+			directory = letsEncryptStagingURL
+		}
+	}
+
+	a := &acmeTLS{
+		domains: opts.domains,
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.cacheDir),
+			HostPolicy: autocert.HostWhitelist(opts.domains...),
+			Email:      opts.email,
+			Client:     &acme.Client{DirectoryURL: directory},
+		},
+	}
+	if opts.staging {
+		cert, err := selfSignedCert(opts.domains)
+		if err != nil {
+			return nil, err
+		}
+		a.fallback = cert
+	}
+	return a, nil
+}
+
+// tlsConfig 本机 TLS 监听的配置，同时响应 TLS-ALPN-01 验证
+func (a *acmeTLS) tlsConfig() *tls.Config {
+	cfg := a.manager.TLSConfig()
+	cfg.GetCertificate = a.getCertificate
+	return cfg
+}
+
+// getCertificate 返回缓存的证书，没有或即将到期时向 ACME 服务器申请。
+// 配置的域名申请失败时记录原因，staging 模式下改用自签名证书以便继续测试
+func (a *acmeTLS) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := a.manager.GetCertificate(hello)
+	if err == nil {
+		return cert, nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if !slices.Contains(a.domains, name) {
+		// 扫描器等以 IP 或其他域名访问，不记录
+		return nil, err
+	}
+	logError("Failed to obtain certificate for %s: %v (the CA must reach this host on port 80 for HTTP-01 or port 443 for TLS-ALPN-01)", name, err)
+	if a.fallback != nil {
+		logWarn("Serving a self-signed certificate for %s (-acme-staging)", name)
+		return a.fallback, nil
+	}
+	return nil, err
+}
+
+// selfSignedCert 生成覆盖 domains 的自签名证书
+func selfSignedCert(domains []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domains[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     domains,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("create self-signed certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// checkACMEDomains 启动时检查各域名已解析到本机：无法解析时返回错误；
+// 解析结果不含本机接口地址时只记录警告，本机可能位于 NAT 或端口转发之后
+func checkACMEDomains(ctx context.Context, resolver *net.Resolver, domains []string) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	local := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+	for _, domain := range domains {
+		ips, err := resolver.LookupIPAddr(ctx, domain)
+		if err != nil {
+			return fmt.Errorf("%s does not resolve: %w", domain, err)
+		}
+		found := false
+		names := make([]string, len(ips))
+		for i, ip := range ips {
+			names[i] = ip.IP.String()
+			found = found || local[names[i]]
+		}
+		if !found {
+			logWarn("%s resolves to %s, which is not an address of this host; certificates can only be issued if it forwards ports 80/443 here", domain, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// listenHint 说明监听端口失败的常见原因
+func listenHint(port int64, err error) string {
+	switch {
+	case errors.Is(err, syscall.EACCES) && port < 1024:
+		return " (ports below 1024 need root or CAP_NET_BIND_SERVICE)"
+	case errors.Is(err, syscall.EADDRINUSE):
+		return " (another process is using this port)"
+	}
+	return ""
+}
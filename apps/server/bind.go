@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SOCKS5 BIND（如主动模式 FTP 的数据连接）由服务端监听、目标主动连入，仅二进制帧格式支持，需启用 -bind:
+//
+//	客户端 -> 服务端  BIND       target 为预期连入的对端地址（SOCKS5 请求中的 DST.ADDR:DST.PORT）
+//	服务端 -> 客户端  BOUND      target 为服务端监听的地址，客户端据此发送 SOCKS5 的第一个应答
+//	服务端 -> 客户端  CONNECTED  target 为实际连入的对端地址，之后与 CONNECT 会话相同地转发数据
+//
+// 只接受来自对端主机（任意端口）的一个连接，主机为 0.0.0.0 或 :: 时接受任意地址；
+// 对端主机同样受 -allow、-deny、-allow-private 约束。
+// 等待期间服务端不读取 WebSocket，客户端断开要到 bindAcceptTimeout 后才会发现
+const bindAcceptTimeout = 60 * time.Second
+
+var errBindDisabled = errors.New("BIND is disabled on this server (-bind)")
+
+// bindPortRange 解析 -bind-ports 的 "起始-结束" 端口范围，为空时返回 0, 0 表示由系统分配
+func bindPortRange(s string) (lo, hi int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		to = from
+	}
+	if lo, err = strconv.Atoi(strings.TrimSpace(from)); err == nil {
+		hi, err = strconv.Atoi(strings.TrimSpace(to))
+	}
+	if err != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// listenBind 在 -bind-ports 范围内随机选择一个空闲端口监听
+func listenBind() (*net.TCPListener, error) {
+	if bindPortLo == 0 {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		return ln.(*net.TCPListener), nil
+	}
+	n := bindPortHi - bindPortLo + 1
+	start := rand.IntN(n)
+	var lastErr error
+	for i := range n {
+		port := bindPortLo + (start+i)%n
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			return ln.(*net.TCPListener), nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no free port in -bind-ports %d-%d: %w", bindPortLo, bindPortHi, lastErr)
+}
+
+// bindPeers 返回允许连入的对端 IP，nil 表示不限制
+func bindPeers(target string) ([]net.IP, error) {
+	if err := acl.check(target); err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] != nil && ips[0].IsUnspecified() {
+		return nil, nil
+	}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		if ips, err = lookupIP(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	if !allowPrivate && slices.ContainsFunc(ips, isPrivateIP) {
+		return nil, errPrivateTarget
+	}
+	return ips, nil
+}
+
+// bindAdvertiseHost BOUND 中告知客户端的监听主机：-bind-host，未设置时为 WebSocket 连接的本地 IP
+func bindAdvertiseHost(ws *websocket.Conn) string {
+	if bindHost != "" {
+		return bindHost
+	}
+	if addr, ok := ws.NetConn().LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return "0.0.0.0"
+}
+
+// acceptBind 为 BIND 请求监听，通过 announce 发送 BOUND，在 bindAcceptTimeout 内等待对端连入
+func acceptBind(target, advertise string, announce func(bound string) error) (net.Conn, error) {
+	if !bindEnabled {
+		return nil, errBindDisabled
+	}
+	peers, err := bindPeers(target)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listenBind()
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	bound := net.JoinHostPort(advertise, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+	if err := announce(bound); err != nil {
+		return nil, err
+	}
+	logInfo("BIND listening on %s for %s", bound, target)
+
+	ln.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, fmt.Errorf("no connection from %s within %v", target, bindAcceptTimeout)
+			}
+			return nil, err
+		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		allowed := peers == nil && (allowPrivate || !isPrivateIP(peer.IP)) ||
+			slices.ContainsFunc(peers, peer.IP.Equal)
+		if allowed && acl.checkResolved(peer) == nil {
+			return conn, nil
+		}
+		logAccess("Rejected BIND connection from %s on %s, expected %s", peer, bound, target)
+		conn.Close()
+	}
+}
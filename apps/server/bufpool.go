@@ -0,0 +1,17 @@
+package main
+
+import "sync"
+
+// relayBufferSize 转发缓冲区大小，与 WebSocket 读写缓冲区相同
+const relayBufferSize = 32 * 1024
+
+// relayBuffers 转发数据使用的缓冲区，连接结束后放回复用
+var relayBuffers = sync.Pool{New: func() any { return new([relayBufferSize]byte) }}
+
+func getRelayBuffer() *[relayBufferSize]byte {
+	return relayBuffers.Get().(*[relayBufferSize]byte)
+}
+
+func putRelayBuffer(buf *[relayBufferSize]byte) {
+	relayBuffers.Put(buf)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// activeLogInterval 定期输出活动连接数的间隔
+const activeLogInterval = time.Minute
+
+// connLimiter 并发连接数上限，达到上限时拒绝新的 WebSocket 升级，避免耗尽文件描述符
+type connLimiter struct {
+	max    int64
+	active atomic.Int64
+}
+
+var connections = &connLimiter{}
+
+// acquire 占用一个连接名额，已达上限时返回 false。max 小于 1 时不限制
+func (l *connLimiter) acquire() bool {
+	if n := l.active.Add(1); l.max > 0 && n > l.max {
+		l.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release 释放 acquire 占用的名额
+func (l *connLimiter) release() {
+	l.active.Add(-1)
+}
+
+// sessionLease WebSocket 会话占用的连接名额和限速令牌桶，由处理函数在返回时释放。
+// 可恢复会话经 take 接管，断开等待恢复期间仍占用，会话结束时释放
+type sessionLease struct {
+	key      string
+	limiter  *tokenBucket
+	released bool
+}
+
+// release 释放连接名额和令牌桶，已释放或已被 take 接管时无效果
+func (l *sessionLease) release() {
+	if l.released {
+		return
+	}
+	l.released = true
+	rateLimiters.release(l.key, l.limiter)
+	connections.release()
+}
+
+// take 转移所有权，之后由返回值负责释放，l 的 release 不再有效果
+func (l *sessionLease) take() *sessionLease {
+	owned := *l
+	l.released = true
+	return &owned
+}
+
+// logActive 定期输出活动连接数，直到 ctx 取消
+func (l *connLimiter) logActive(ctx context.Context) {
+	ticker := time.NewTicker(activeLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if l.max > 0 {
+				logInfo("Active connections: %d/%d", l.active.Load(), l.max)
+			} else {
+				logInfo("Active connections: %d", l.active.Load())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
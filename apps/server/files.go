@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileShare /files/<name> 提供的文件：只开放 -files-dir 目录下 -files 列出的普通文件，
+// 让无法访问 GitHub 的客户端经服务端获取 IP 列表等文件
+type fileShare struct {
+	root    *os.Root
+	names   map[string]bool
+	maxSize int64
+}
+
+// files 为 nil 时 /files/ 返回 404
+var files *fileShare
+
+// newFileShare 按 -files-dir、-files 和 -files-max-size 创建文件共享，dir 或 names 为空时返回 nil。
+// names 只能是目录下的文件名，不能包含路径
+func newFileShare(dir, names string, maxSize int64) (*fileShare, error) {
+	if dir == "" || names == "" {
+		return nil, nil
+	}
+	if authToken == "" {
+		return nil, errors.New("requires -token")
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid max size %d", maxSize)
+	}
+	share := &fileShare{names: map[string]bool{}, maxSize: maxSize}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid file name %q: must not contain a path", name)
+		}
+		share.names[name] = true
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	share.root = root
+	return share, nil
+}
+
+// filesAuthorized 校验 Authorization: Bearer <客户端令牌>，不接受查询参数，避免令牌出现在 CDN 日志中
+func filesAuthorized(r *http.Request) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && validClientToken(got)
+}
+
+// filesHandler 提供 fileShare 中的文件，支持 Range、If-Range 和 If-None-Match。
+// 先校验令牌再查找文件，未授权的请求无法探测哪些文件存在；未列出、不存在或超过大小上限的文件均返回 404
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	share := files
+	if share == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !filesAuthorized(r) {
+		logAccess("Invalid file token from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	if !share.names[name] {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := share.root.Open(name)
+	if err != nil {
+		logError("Failed to open shared file %s: %v", name, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	if info.Size() > share.maxSize {
+		logWarn("Shared file %s is %d bytes, over -files-max-size", name, info.Size())
+		http.NotFound(w, r)
+		return
+	}
+
+	// 文件较大或客户端较慢时可能超过服务器的 WriteTimeout，断开后客户端按 Range 续传
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(10 * time.Minute))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	logAccess("Serving file %s to %s (Range: %q)", name, r.RemoteAddr, r.Header.Get("Range"))
+	// 只提供检查过大小的部分，文件随后变大也不会超过上限
+	http.ServeContent(w, r, name, info.ModTime(), io.NewSectionReader(f, 0, info.Size()))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 中继汇总报告（默认关闭）：-report-to 定期将本中继的汇总计数 POST 到收集端，
+// -collector 让本进程作为收集端接收报告，并在 /fleet 输出各中继及合计。
+// 报告只包含计数和版本，不包含目标地址、客户端 IP、会话 ID 或令牌
+
+// version 服务端版本，发布构建通过 -ldflags "-X main.version=..." 注入
+var version = "dev"
+
+// startTime 进程启动时间，用于报告运行时长
+var startTime = time.Now()
+
+// 报告参数，见 init 中的 -report-* 和 -collector* 参数
+var (
+	reportTo        string
+	reportInterval  time.Duration
+	reportName      string
+	collectorMode   bool
+	collectorTokens string
+)
+
+const (
+	fleetReportPath      = "/fleet/report"
+	fleetTimestampHeader = "X-Echplus-Timestamp" // 发送时的 Unix 秒
+	fleetSignatureHeader = "X-Echplus-Signature" // 见 signFleetReport
+	fleetMaxSkew         = 5 * time.Minute       // 收集端接受的时间戳与本地时钟的最大偏差
+	fleetMaxBody         = 64 << 10
+	fleetMaxNameLen      = 64
+	fleetStaleIntervals  = 3              // 超过这么多个报告间隔未收到报告的中继不计入合计
+	fleetForgetAfter     = 24 * time.Hour // 超过该时长未收到报告的中继从 /fleet 中移除
+	fleetSendTimeout     = 10 * time.Second
+	minReportInterval    = 10 * time.Second
+)
+
+// fleetReport 报告的 JSON 格式（fleetReportPath 的请求体），计数均为进程启动以来的累计值，重启后从 0 开始。
+// 请求头 fleetTimestampHeader 为发送时的 Unix 秒，fleetSignatureHeader 为 signFleetReport 的结果，
+// 收集端以 -collector-tokens 中的令牌校验签名，拒绝时间戳偏差超过 fleetMaxSkew 或早于该中继上次报告的请求
+type fleetReport struct {
+	Relay           string           `json:"relay"`           // 中继名称（-report-name），收集端按名称区分中继
+	Version         string           `json:"version"`         // 服务端版本
+	IntervalSeconds int64            `json:"intervalSeconds"` // 报告间隔，收集端据此判断中继是否失联
+	UptimeSeconds   int64            `json:"uptimeSeconds"`
+	SessionsActive  int64            `json:"sessionsActive"` // 当前打开的 WebSocket 会话数
+	SessionsTotal   int64            `json:"sessionsTotal"`
+	BytesUp         int64            `json:"bytesUp"`   // 客户端 -> 目标
+	BytesDown       int64            `json:"bytesDown"` // 目标 -> 客户端
+	Errors          map[string]int64 `json:"errors"`    // 按原因的错误计数，键见 fleetErrorCounts
+}
+
+// fleetErrorCounts 报告中的错误计数，与 /metrics 中的计数相同
+func fleetErrorCounts() map[string]int64 {
+	return map[string]int64{
+		"upgradeFailures": metrics.upgradeFailures.Load(),
+		"unauthorized":    metrics.unauthorized.Load(),
+		"connectionLimit": metrics.connLimitRejects.Load(),
+		"dialFailures":    metrics.dialFailures.Load(),
+	}
+}
+
+// newFleetReport 汇总当前的计数
+func newFleetReport(name string, interval time.Duration) fleetReport {
+	return fleetReport{
+		Relay:           name,
+		Version:         version,
+		IntervalSeconds: int64(interval / time.Second),
+		UptimeSeconds:   int64(time.Since(startTime) / time.Second),
+		SessionsActive:  int64(sessions.count()),
+		SessionsTotal:   metrics.sessionsTotal.Load(),
+		BytesUp:         metrics.bytesUp.Load(),
+		BytesDown:       metrics.bytesDown.Load(),
+		Errors:          fleetErrorCounts(),
+	}
+}
+
+// signFleetReport 返回 hex(HMAC-SHA256(token, timestamp + "\n" + body))
+func signFleetReport(token string, timestamp int64, body []byte) string {
+	return hex.EncodeToString(fleetMAC([]byte(token), timestamp, body))
+}
+
+// fleetMAC 计算报告签名的 HMAC
+func fleetMAC(token []byte, timestamp int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, token)
+	fmt.Fprintf(mac, "%d\n", timestamp)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// validateReportTo 检查 -report-to 的收集端地址，应为收集端的 fleetReportPath 完整 URL
+func validateReportTo(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	return nil
+}
+
+// sendFleetReport 以 now 为时间戳签名并发送一次报告
+func sendFleetReport(ctx context.Context, client *http.Client, target, token string, report fleetReport, now time.Time) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, fleetSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(fleetTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(fleetSignatureHeader, signFleetReport(token, timestamp, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// runReporter 启动后立即发送一次报告，之后每隔 interval 发送，直到 ctx 取消。失败只记录日志，下次照常发送。
+// 每次发送时调用 token 取签名令牌，令牌文件重新加载后随之更换
+func runReporter(ctx context.Context, target, name string, token func() string, interval time.Duration) {
+	client := &http.Client{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		err := sendFleetReport(ctx, client, target, token(), newFleetReport(name, interval), time.Now())
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil && !failing:
+			logWarn("Failed to send fleet report to %s: %v", target, err)
+		case err == nil && failing:
+			logInfo("Fleet reports to %s are delivered again", target)
+		}
+		failing = err != nil
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fleetRelay 收集端记录的一个中继
+type fleetRelay struct {
+	fleetReport
+	ReceivedAt time.Time `json:"receivedAt"`
+	Stale      bool      `json:"stale"` // 超过 fleetStaleIntervals 个报告间隔未收到报告，不计入合计
+
+	timestamp int64 // 最近一次报告的时间戳，用于拒绝重放旧报告
+}
+
+// fleetTotal /fleet 中未失联中继的合计
+type fleetTotal struct {
+	Relays         int              `json:"relays"`
+	SessionsActive int64            `json:"sessionsActive"`
+	SessionsTotal  int64            `json:"sessionsTotal"`
+	BytesUp        int64            `json:"bytesUp"`
+	BytesDown      int64            `json:"bytesDown"`
+	Errors         map[string]int64 `json:"errors"`
+}
+
+// fleetCollector 收集端，保存各中继最近一次的报告
+type fleetCollector struct {
+	tokens [][]byte // 为 nil 时校验 serverToken 的签名
+	now    func() time.Time
+
+	mu     sync.Mutex
+	relays map[string]*fleetRelay
+}
+
+// collector 为 nil 时 fleetReportPath 和 /fleet 返回 404
+var collector *fleetCollector
+
+// newFleetCollector 创建收集端，tokens 为逗号分隔的中继令牌，为空时只接受 serverToken 签名的报告
+func newFleetCollector(tokens string) (*fleetCollector, error) {
+	c := &fleetCollector{now: time.Now, relays: map[string]*fleetRelay{}}
+	if tokens == "" {
+		if serverToken() == "" {
+			return nil, errors.New("requires -collector-tokens or -token")
+		}
+		return c, nil
+	}
+	for _, token := range strings.Split(tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			c.tokens = append(c.tokens, []byte(token))
+		}
+	}
+	if len(c.tokens) == 0 {
+		return nil, errors.New("requires -collector-tokens or -token")
+	}
+	return c, nil
+}
+
+// verify 校验时间戳和签名，任一令牌签名一致即通过
+func (c *fleetCollector) verify(r *http.Request, body []byte) (int64, error) {
+	timestamp, err := strconv.ParseInt(r.Header.Get(fleetTimestampHeader), 10, 64)
+	if err != nil {
+		return 0, errors.New("missing or invalid timestamp")
+	}
+	if skew := c.now().Sub(time.Unix(timestamp, 0)).Abs(); skew > fleetMaxSkew {
+		return 0, fmt.Errorf("timestamp is %v off, more than %v", skew.Round(time.Second), fleetMaxSkew)
+	}
+	got, err := hex.DecodeString(r.Header.Get(fleetSignatureHeader))
+	if err != nil {
+		return 0, errors.New("invalid signature")
+	}
+	tokens := c.tokens
+	if tokens == nil {
+		tokens = [][]byte{[]byte(serverToken())}
+	}
+	for _, token := range tokens {
+		if hmac.Equal(got, fleetMAC(token, timestamp, body)) {
+			return timestamp, nil
+		}
+	}
+	return 0, errors.New("invalid signature")
+}
+
+// handleReport 接收一个中继的报告，成功时返回 204
+func (c *fleetCollector) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, fleetMaxBody))
+	if err != nil {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	timestamp, err := c.verify(r, body)
+	if err != nil {
+		logAccess("Rejected fleet report from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var report fleetReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.Relay == "" || len(report.Relay) > fleetMaxNameLen {
+		http.Error(w, fmt.Sprintf("Bad Request: relay name must be 1-%d bytes", fleetMaxNameLen), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev := c.relays[report.Relay]; prev != nil && timestamp < prev.timestamp {
+		http.Error(w, "Conflict: report is older than the last one from this relay", http.StatusConflict)
+		return
+	}
+	c.relays[report.Relay] = &fleetRelay{fleetReport: report, ReceivedAt: c.now(), timestamp: timestamp}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fleet 返回按名称排序的中继和未失联中继的合计，同时移除超过 fleetForgetAfter 未报告的中继
+func (c *fleetCollector) fleet() ([]fleetRelay, fleetTotal) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	total := fleetTotal{Errors: map[string]int64{}}
+	relays := make([]fleetRelay, 0, len(c.relays))
+	for name, relay := range c.relays {
+		age := now.Sub(relay.ReceivedAt)
+		if age > fleetForgetAfter {
+			delete(c.relays, name)
+			continue
+		}
+		r := *relay
+		r.Stale = age > fleetStaleIntervals*time.Duration(max(r.IntervalSeconds, 1))*time.Second
+		relays = append(relays, r)
+		if r.Stale {
+			continue
+		}
+		total.Relays++
+		total.SessionsActive += r.SessionsActive
+		total.SessionsTotal += r.SessionsTotal
+		total.BytesUp += r.BytesUp
+		total.BytesDown += r.BytesDown
+		for k, v := range r.Errors {
+			total.Errors[k] += v
+		}
+	}
+	slices.SortFunc(relays, func(a, b fleetRelay) int { return strings.Compare(a.Relay, b.Relay) })
+	return relays, total
+}
+
+// fleetReportHandler 收集端接收报告的处理器，未启用 -collector 时返回 404
+func fleetReportHandler(w http.ResponseWriter, r *http.Request) {
+	c := collector
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	c.handleReport(w, r)
+}
+
+// fleetHandler 以 JSON 输出各中继最近一次的报告及合计，令牌同 /metrics，未启用 -collector 时返回 404
+func fleetHandler(w http.ResponseWriter, r *http.Request) {
+	c := collector
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !metricsAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	relays, total := c.fleet()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Relays []fleetRelay `json:"relays"`
+		Total  fleetTotal   `json:"total"`
+	}{relays, total})
+}
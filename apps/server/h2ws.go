@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP/2 WebSocket（RFC 8441）。客户端以扩展 CONNECT（:protocol = websocket）建立流，
+// 这里把请求改写为等价的 HTTP/1.1 升级请求，并由 Hijack 返回基于该流的连接，
+// upgrader 和会话处理无需区分 HTTP/1.1 与 HTTP/2。
+// Go 的 HTTP/2 服务端需设置 GODEBUG=http2xconnect=1 才会通告扩展 CONNECT 支持
+
+// h2xconnectEnabled 报告当前进程是否通过 GODEBUG 启用了 HTTP/2 扩展 CONNECT
+func h2xconnectEnabled(godebug string) bool {
+	for _, kv := range strings.Split(godebug, ",") {
+		if strings.TrimSpace(kv) == "http2xconnect=1" {
+			return true
+		}
+	}
+	return false
+}
+
+// isExtendedConnect 判断请求是否为 HTTP/2 扩展 CONNECT 发起的 WebSocket
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+}
+
+// adaptExtendedConnect 返回改写后的升级请求和支持 Hijack 的 ResponseWriter。
+// 扩展 CONNECT 不携带 Sec-WebSocket-Key，改写时生成一个，其 Accept 值在转换响应时丢弃
+func adaptExtendedConnect(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	upgrade := r.Clone(r.Context())
+	upgrade.Method = http.MethodGet
+	upgrade.Header.Del(":protocol")
+	upgrade.Header.Set("Upgrade", "websocket")
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	return &h2UpgradeWriter{ResponseWriter: w, body: r.Body}, upgrade
+}
+
+// h2UpgradeWriter 升级前的错误响应直接写入 HTTP/2 流，Hijack 后由 h2StreamConn 接管
+type h2UpgradeWriter struct {
+	http.ResponseWriter
+	body io.ReadCloser
+}
+
+func (w *h2UpgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c := &h2StreamConn{w: w.ResponseWriter, rc: http.NewResponseController(w.ResponseWriter), body: w.body}
+	return c, bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)), nil
+}
+
+// h2StreamConn 在扩展 CONNECT 流上实现 net.Conn：读取请求体，写入响应体并立即刷新。
+// upgrader 写出的第一段数据是 101 响应，转换为 200 响应头发出
+type h2StreamConn struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	body io.ReadCloser
+
+	wmu        sync.Mutex // 串行化写入，Close 借此等待进行中的写入结束
+	headerSent bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *h2StreamConn) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if err != nil && c.isClosed() {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *h2StreamConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if !c.headerSent {
+		if err := c.writeHeader(p); err != nil {
+			return 0, err
+		}
+		c.headerSent = true
+		return len(p), nil
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// writeHeader 将 upgrader 写出的 101 响应转换为扩展 CONNECT 的 200 响应头
+func (c *h2StreamConn) writeHeader(p []byte) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(p)), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return errors.New("unexpected upgrade response: " + resp.Status)
+	}
+	header := c.w.Header()
+	for k, v := range resp.Header {
+		switch k {
+		case "Upgrade", "Connection", "Sec-Websocket-Accept":
+			continue
+		}
+		header[k] = v
+	}
+	c.w.WriteHeader(http.StatusOK)
+	return c.rc.Flush()
+}
+
+func (c *h2StreamConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Close 中断进行中的读写并等待写入结束。流本身在处理函数返回时关闭，
+// 之后不能再使用 ResponseWriter，所以处理函数返回前必须先关闭连接
+func (c *h2StreamConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	err := c.body.Close()
+	c.rc.SetWriteDeadline(time.Now())
+	c.wmu.Lock()
+	c.wmu.Unlock()
+	return err
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr  { return h2Addr("local") }
+func (c *h2StreamConn) RemoteAddr() net.Addr { return h2Addr("remote") }
+
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// h2Addr HTTP/2 流没有独立的网络地址，客户端地址以 Request.RemoteAddr 为准
+type h2Addr string
+
+func (a h2Addr) Network() string { return "h2" }
+func (a h2Addr) String() string  { return string(a) }
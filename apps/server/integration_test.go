@@ -0,0 +1,6604 @@
+//go:build integration
+
+// 端到端集成测试：在进程内启动服务端和客户端，通过 SOCKS5 经隧道访问本地 echo 服务。
+//
+// 测试依赖 go.work 中的 apps/client 模块，需在工作区模式下运行:
+//
+//	cd apps/server && go test -tags integration ./...
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/core"
+	"github.com/atticus6/echPlus/apps/client/logging"
+	"github.com/atticus6/echPlus/apps/client/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const testToken = "integration-token"
+
+// remoteTarget 隧道目标地址 (TEST-NET-3)，由 dialRemote 重定向到本地 echo 服务，
+// 使用公网地址以避免客户端将其识别为局域网地址而直连
+const remoteTarget = "203.0.113.10:7"
+
+// startEchoServer 启动 echo 服务
+func startEchoServer(t testing.TB) string {
+	t.Helper()
+	return listenEcho(t, "127.0.0.1:0").Addr().String()
+}
+
+// listenEcho 在 addr 上启动 echo 服务
+func listenEcho(t testing.TB, addr string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen echo: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// startTunnelServer 启动进程内服务端，并将 remoteTarget 重定向到 echoAddr
+func startTunnelServer(t testing.TB, echoAddr string) string {
+	t.Helper()
+	return serveTunnel(t, echoAddr, nil, nil)
+}
+
+// startTLSTunnelServer 与 startTunnelServer 相同，但使用 cert 提供 wss://
+func startTLSTunnelServer(t testing.TB, echoAddr string, cert tls.Certificate) string {
+	t.Helper()
+	return serveTunnel(t, echoAddr, &cert, nil)
+}
+
+// serveTunnel 启动进程内服务端，cert 不为 nil 时使用 TLS，configure 不为 nil 时在启动前调整服务端
+func serveTunnel(t testing.TB, echoAddr string, cert *tls.Certificate, configure func(*httptest.Server)) string {
+	t.Helper()
+	prevToken, prevDial := authToken, dialRemote
+	authToken = testToken
+	dialRemote = func(network, addr string) (net.Conn, error) {
+		if addr == remoteTarget {
+			addr = echoAddr
+		}
+		return net.DialTimeout(network, addr, 5*time.Second)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+	if cert != nil {
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+	if configure != nil {
+		configure(srv)
+	}
+	if cert != nil {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(func() {
+		srv.Close()
+		authToken, dialRemote = prevToken, prevDial
+	})
+	return srv.Listener.Addr().String()
+}
+
+// testCertChain 生成自签名 CA 及其签发的 127.0.0.1 服务端证书，返回服务端使用的证书链、服务端证书和 CA 证书。
+// 证书同时对 cloudflare-dns.com 有效，供经服务端 IP 的 DoH 查询（queryDoHForProxy）使用
+func testCertChain(t testing.TB) (tls.Certificate, *x509.Certificate, *x509.Certificate) {
+	t.Helper()
+	issue := func(tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(crand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatalf("create certificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("parse certificate: %v", err)
+		}
+		return cert, key
+	}
+	now := time.Now()
+	ca, caKey := issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "echPlus test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	leaf, leafKey := issue(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"cloudflare-dns.com"},
+	}, ca, caKey)
+	chain := tls.Certificate{Certificate: [][]byte{leaf.Raw, ca.Raw}, PrivateKey: leafKey}
+	return chain, leaf, ca
+}
+
+// clientConfig 连接到 serverAddr 的进程内客户端配置
+func clientConfig(t testing.TB, serverAddr, token string) core.Config {
+	return core.Config{
+		ListenAddr:  "127.0.0.1:0",
+		ServerAddr:  "ws://" + serverAddr + "/",
+		ServerIP:    "127.0.0.1",
+		Token:       token,
+		RoutingMode: core.RoutingModeGlobal,
+		StoreDir:    t.TempDir(),
+		RequireECH:  false,
+	}
+}
+
+// startClient 启动进程内客户端，返回 SOCKS5 监听地址
+func startClient(t testing.TB, serverAddr, token string) string {
+	t.Helper()
+	return startClientWithConfig(t, clientConfig(t, serverAddr, token))
+}
+
+// startClientWithConfig 按 cfg 启动进程内客户端，返回 SOCKS5 监听地址
+func startClientWithConfig(t testing.TB, cfg core.Config) string {
+	t.Helper()
+	return startProxyServer(t, cfg).Addr().String()
+}
+
+// echoClientConfig 启动 echo 服务和进程内服务端，返回连接该服务端的客户端配置
+func echoClientConfig(t testing.TB) core.Config {
+	t.Helper()
+	return clientConfig(t, startTunnelServer(t, startEchoServer(t)), testToken)
+}
+
+// startEchoClient 与 echoClientConfig 相同，但直接启动客户端并返回 SOCKS5 监听地址
+func startEchoClient(t testing.TB) string {
+	t.Helper()
+	return startClientWithConfig(t, echoClientConfig(t))
+}
+
+// startProxyServer 按 cfg 启动进程内客户端
+func startProxyServer(t testing.TB, cfg core.Config) *core.ProxyServer {
+	t.Helper()
+	client := core.NewProxyServer(cfg)
+	if err := client.Start(); err != nil {
+		t.Fatalf("start client: %v", err)
+	}
+	t.Cleanup(func() { client.Stop() })
+	return client
+}
+
+// dialSOCKS5 通过 SOCKS5 代理连接 target (IPv4 或域名)
+func dialSOCKS5(t testing.TB, proxyAddr, target string) (net.Conn, error) {
+	t.Helper()
+	return dialSOCKS5Paused(t, proxyAddr, target, 0)
+}
+
+// openTunnel 通过 SOCKS5 代理连接 target，失败时终止测试，测试结束时关闭连接
+func openTunnel(t testing.TB, proxyAddr, target string) net.Conn {
+	t.Helper()
+	conn, err := dialSOCKS5(t, proxyAddr, target)
+	if err != nil {
+		t.Fatalf("dial %s via SOCKS5 %s: %v", target, proxyAddr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// dialSOCKS5Paused 与 dialSOCKS5 相同，但在方法协商和连接请求之间停顿 pause，模拟慢速客户端
+func dialSOCKS5Paused(t testing.TB, proxyAddr, target string, pause time.Duration) (net.Conn, error) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[1] != 0x00 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected auth method %d", reply[1])
+	}
+	time.Sleep(pause)
+
+	host, portStr, _ := net.SplitHostPort(target)
+	var port uint16
+	fmt.Sscanf(portStr, "%d", &port)
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(append(req, 0x01), ip...)
+	} else {
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp := make([]byte, 10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp[1] != 0x00 {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 connect failed: reply %d", resp[1])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// waitNoSessions 等待之前建立的会话全部结束
+func waitNoSessions(t *testing.T) {
+	t.Helper()
+	for wait := time.Now().Add(5 * time.Second); sessions.count() > 0 && time.Now().Before(wait); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSessionOutlivesServerTimeouts 会话的存活时间远超 http.Server 的 ReadTimeout/WriteTimeout 时不会被断开，
+// 期间持续传输并有超过超时时间的空闲；超时按比例缩短，避免测试运行一分钟
+func TestSessionOutlivesServerTimeouts(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	serverAddr := serveTunnel(t, startEchoServer(t), nil, func(srv *httptest.Server) {
+		srv.Config = newHTTPServer("", srv.Config.Handler)
+		srv.Config.ReadTimeout, srv.Config.WriteTimeout = timeout, timeout
+	})
+	proxyAddr := startClient(t, serverAddr, testToken)
+	waitNoSessions(t)
+	started := metrics.sessionsTotal.Load()
+
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+	for deadline := time.Now().Add(10 * timeout); time.Now().Before(deadline); time.Sleep(timeout / 5) {
+		echoLarge(t, conn, bytes.Repeat([]byte("long-lived "), 1000))
+	}
+	time.Sleep(3 * timeout)
+	echoLarge(t, conn, []byte("after idle"))
+	if n := metrics.sessionsTotal.Load() - started; n != 1 {
+		t.Fatalf("sessions started = %d, want the original session kept without reconnecting", n)
+	}
+}
+
+func TestTunnelEcho(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+	proxyAddr := startClient(t, serverAddr, testToken)
+
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+
+	for i := 0; i < 3; i++ {
+		msg := []byte(fmt.Sprintf("hello|echPlus|#%d", i))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("echo mismatch: got %q, want %q", got, msg)
+		}
+	}
+}
+
+// cutProxy TCP 转发器，cut 断开所有已转发的连接，模拟网络切换导致 WebSocket 异常断开；
+// stall 之后丢弃服务端发往客户端的数据而不断开，模拟服务端失去响应；
+// relayed 为双向转发的字节数，用于测量线路上的流量
+type cutProxy struct {
+	addr    string
+	relayed atomic.Int64
+	stalled atomic.Bool
+	mu      sync.Mutex
+	conns   []net.Conn
+}
+
+func startCutProxy(t testing.TB, upstream string) *cutProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	p := &cutProxy{addr: ln.Addr().String()}
+	t.Cleanup(func() {
+		ln.Close()
+		p.cut()
+	})
+	go func() {
+		for {
+			down, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", upstream)
+			if err != nil {
+				down.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, down, up)
+			p.mu.Unlock()
+			go func() { io.Copy(countWriter{up, &p.relayed}, down); up.Close() }()
+			go func() { io.Copy(stallWriter{countWriter{down, &p.relayed}, &p.stalled}, up); down.Close() }()
+		}
+	}()
+	return p
+}
+
+// countWriter 累计写入的字节数
+type countWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// stallWriter stalled 为 true 时丢弃写入的数据
+type stallWriter struct {
+	w       io.Writer
+	stalled *atomic.Bool
+}
+
+func (s stallWriter) Write(p []byte) (int, error) {
+	if s.stalled.Load() {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+func (p *cutProxy) stall() {
+	p.stalled.Store(true)
+}
+
+func (p *cutProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// TestTunnelResume WebSocket 异常断开后客户端重连并恢复会话，目标连接不中断，
+// 断开期间写入的数据不丢失
+func TestTunnelResume(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+	var remoteDials atomic.Int32
+	dial := dialRemote
+	dialRemote = func(network, addr string) (net.Conn, error) {
+		remoteDials.Add(1)
+		return dial(network, addr)
+	}
+	proxy := startCutProxy(t, serverAddr)
+	cfg := clientConfig(t, proxy.addr, testToken)
+	cfg.ResumeGrace = 10 * time.Second
+	proxyAddr := startClientWithConfig(t, cfg)
+
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+
+	echo := func(msg []byte) {
+		t.Helper()
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("echo mismatch after %d bytes", len(got))
+		}
+	}
+	echo([]byte("before|cut"))
+	for i := 0; i < 3; i++ {
+		proxy.cut()
+		echo(bytes.Repeat([]byte{byte('a' + i)}, 100*1024))
+	}
+	if n := remoteDials.Load(); n != 1 {
+		t.Fatalf("remote dialed %d times, want 1", n)
+	}
+
+	// 客户端关闭隧道时以正常关闭通知服务端，会话立即释放而不等待恢复
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resumables.mu.Lock()
+		n := len(resumables.sessions)
+		resumables.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d resumable sessions still held after close", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echoLarge 通过 conn 发送 payload 并读回，写入与读取并发进行以免 echo 缓冲区填满后阻塞
+func echoLarge(t *testing.T, conn net.Conn, payload []byte) {
+	t.Helper()
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		writeErr <- err
+	}()
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echo mismatch")
+	}
+}
+
+// TestCompression 双方启用 permessage-deflate 后二进制帧正常转发，可压缩数据在线路上明显变小，
+// 随机数据（相当于已加密的流量）基本不变
+func TestCompression(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	upgrader.EnableCompression = true
+	t.Cleanup(func() { upgrader.EnableCompression = false })
+	proxy := startCutProxy(t, serverAddr)
+	cfg := clientConfig(t, proxy.addr, testToken)
+	cfg.Compression = true
+	client := startProxyServer(t, cfg)
+
+	conn := openTunnel(t, client.Addr().String(), remoteTarget)
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	if ext := client.GetUpstreamStatus().Headers["Sec-WebSocket-Extensions"]; !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Sec-WebSocket-Extensions = %q, want permessage-deflate", ext)
+	}
+
+	text := bytes.Repeat([]byte(`{"id":12345,"name":"echPlus","tags":["proxy","ech"],"ok":true}`+"\n"), 16*1024)
+	random := make([]byte, 1<<20)
+	rand.Read(random)
+	for _, tc := range []struct {
+		name     string
+		payload  []byte
+		maxRatio float64 // 线路字节数 / 明文字节数的上限
+	}{
+		{"text", text, 0.2},
+		{"random", random, 1.1},
+	} {
+		before := proxy.relayed.Load()
+		echoLarge(t, conn, tc.payload)
+		ratio := float64(proxy.relayed.Load()-before) / float64(2*len(tc.payload))
+		t.Logf("%s: %d bytes each way, wire/payload = %.3f", tc.name, len(tc.payload), ratio)
+		if ratio > tc.maxRatio {
+			t.Errorf("%s: wire/payload = %.3f, want <= %.2f", tc.name, ratio, tc.maxRatio)
+		}
+	}
+}
+
+// TestCompressionPorts 未设置 CompressPorts 时跳过 TLS 端口，设置后只对其中的端口协商压缩
+func TestCompressionPorts(t *testing.T) {
+	serverAddr := startTestNetServer(t)
+	upgrader.EnableCompression = true
+	t.Cleanup(func() { upgrader.EnableCompression = false })
+
+	for _, tc := range []struct {
+		name  string
+		ports []int
+		want  map[string]bool // 目标端口 -> 是否协商压缩
+	}{
+		{"default", nil, map[string]bool{"80": true, "443": false, "8443": false, "6379": true}},
+		{"listed", []int{8080}, map[string]bool{"80": false, "443": false, "8080": true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := clientConfig(t, serverAddr, testToken)
+			cfg.Compression = true
+			cfg.CompressPorts = tc.ports
+			client := startProxyServer(t, cfg)
+			for port, want := range tc.want {
+				conn := openTunnel(t, client.Addr().String(), net.JoinHostPort("203.0.113.20", port))
+				echoLarge(t, conn, []byte("ping"))
+				conn.Close()
+				ext := client.GetUpstreamStatus().Headers["Sec-WebSocket-Extensions"]
+				if got := strings.Contains(ext, "permessage-deflate"); got != want {
+					t.Errorf("port %s: Sec-WebSocket-Extensions = %q, want compressed = %v", port, ext, want)
+				}
+			}
+		})
+	}
+}
+
+// TestResumeUnknownSession 未知恢复令牌返回 ERROR
+func TestResumeUnknownSession(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	dialer := websocket.Dialer{Subprotocols: []string{testToken, protocol.ResumeSubprotocol}, HandshakeTimeout: 5 * time.Second}
+	ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	if got := ws.Subprotocol(); got != protocol.ResumeSubprotocol {
+		t.Fatalf("subprotocol = %q, want %q", got, protocol.ResumeSubprotocol)
+	}
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	codec := protocol.CodecForSubprotocol(protocol.ResumeSubprotocol)
+	mt, data, _ := codec.Encode(protocol.Frame{Op: protocol.OpResume, Target: "no-such-token", Payload: encodeOffset(0)})
+	if err := ws.WriteMessage(mt, data); err != nil {
+		t.Fatalf("write RESUME: %v", err)
+	}
+	mt, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	f, err := codec.Decode(mt, msg)
+	if err != nil || f.Op != protocol.OpError {
+		t.Fatalf("RESUME response = %+v %v, want ERROR", f, err)
+	}
+}
+
+// TestResumeLease 可恢复会话断开等待恢复期间仍占用连接名额和令牌桶，第一个连接的处理函数返回后
+// 同一令牌的新会话与其共用令牌桶，恢复后的连接使用会话的令牌桶，会话结束时一并释放
+func TestResumeLease(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	prevRate := rateLimit
+	rateLimit = 1 << 30
+	t.Cleanup(func() { rateLimit = prevRate })
+	codec := protocol.CodecForSubprotocol(protocol.ResumeSubprotocol)
+	key := "token:" + testToken
+
+	dial := func() *websocket.Conn {
+		t.Helper()
+		dialer := websocket.Dialer{Subprotocols: []string{testToken, protocol.ResumeSubprotocol}, HandshakeTimeout: 5 * time.Second}
+		ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+		return ws
+	}
+	send := func(ws *websocket.Conn, f protocol.Frame) {
+		t.Helper()
+		mt, data, _ := codec.Encode(f)
+		if err := ws.WriteMessage(mt, data); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	read := func(ws *websocket.Conn, op byte) protocol.Frame {
+		t.Helper()
+		mt, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		f, err := codec.Decode(mt, msg)
+		if err != nil || f.Op != op {
+			t.Fatalf("got %+v %v, want opcode 0x%02x", f, err, op)
+		}
+		return f
+	}
+	bucket := func() *tokenBucket {
+		rateLimiters.mu.Lock()
+		defer rateLimiters.mu.Unlock()
+		return rateLimiters.buckets[key]
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	first := dial()
+	send(first, protocol.Frame{Op: protocol.OpConnect, Target: remoteTarget})
+	rs := resumables.get(string(read(first, protocol.OpConnected).Payload))
+	if rs == nil || rs.limiter == nil || rs.limiter != bucket() {
+		t.Fatalf("session limiter = %p, registry bucket = %p", rs.limiter, bucket())
+	}
+	shared := rs.limiter
+
+	// 异常断开，等待第一个连接的处理函数返回
+	first.NetConn().Close()
+	waitFor("detach", func() bool {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		return rs.ws == nil
+	})
+	waitFor("handler return", func() bool { return sessions.count() == 0 })
+	if n := connections.active.Load(); n != 1 {
+		t.Fatalf("detached session holds %d connection slots, want 1", n)
+	}
+	if b := bucket(); b != shared {
+		t.Fatalf("bucket released while detached: registry %p, session %p", b, shared)
+	}
+
+	resumed := dial()
+	send(resumed, protocol.Frame{Op: protocol.OpResume, Target: rs.token, Payload: encodeOffset(0)})
+	read(resumed, protocol.OpResumed)
+	send(resumed, protocol.Frame{Op: protocol.OpData, Payload: []byte("after resume")})
+	if f := read(resumed, protocol.OpData); string(f.Payload) != "after resume" {
+		t.Fatalf("echo = %q", f.Payload)
+	}
+	if rs.limiter != shared || bucket() != shared {
+		t.Fatalf("resumed session limiter %p, registry %p, want %p", rs.limiter, bucket(), shared)
+	}
+	if n := connections.active.Load(); n != 1 {
+		t.Fatalf("resumed session holds %d connection slots, want 1", n)
+	}
+
+	resumed.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	waitFor("session end", func() bool { return resumables.get(rs.token) == nil })
+	waitFor("slot release", func() bool { return connections.active.Load() == 0 })
+	if b := bucket(); b != nil {
+		t.Fatalf("bucket still registered after session end (refs %d)", b.refs)
+	}
+}
+
+// startFakeDNS 启动 DNS 服务，A、AAAA 查询分别返回 answers() 中的 IPv4、IPv6 地址，其他查询返回空应答。
+// 返回使用该服务的解析器和 A 查询次数
+func startFakeDNS(t *testing.T, answers func() []net.IP) (*net.Resolver, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen dns: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// 头部 12 字节，问题为 QNAME + QTYPE + QCLASS
+			q := buf[:n]
+			end := 12
+			for end < len(q) && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			end += 5
+			if end > len(q) {
+				continue
+			}
+			var ips [][]byte
+			switch qtype := binary.BigEndian.Uint16(q[end-4:]); qtype {
+			case 1:
+				queries.Add(1)
+				for _, ip := range answers() {
+					if ip4 := ip.To4(); ip4 != nil {
+						ips = append(ips, ip4)
+					}
+				}
+			case 28:
+				for _, ip := range answers() {
+					if ip.To4() == nil {
+						ips = append(ips, ip.To16())
+					}
+				}
+			}
+			resp := append([]byte{}, q[:2]...)
+			resp = append(resp, 0x81, 0x80, 0, 1, 0, byte(len(ips)), 0, 0, 0, 0)
+			resp = append(resp, q[12:end]...)
+			for _, ip := range ips {
+				resp = append(resp, 0xc0, 0x0c)
+				resp = append(resp, q[end-4:end]...) // 与问题相同的 TYPE 和 CLASS
+				resp = append(resp, 0, 0, 0, 60, 0, byte(len(ip)))
+				resp = append(resp, ip...)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+	return resolver, &queries
+}
+
+// TestDNSPinning 域名解析到一个不可用和一个可用 IP 时，直连收敛到可用 IP 后不再重新解析；
+// 可用 IP 失效后重新解析并改用新的可用 IP，排除的域名每次都重新解析
+func TestDNSPinning(t *testing.T) {
+	good := listenEcho(t, "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(good.Addr().String())
+	listenEcho(t, net.JoinHostPort("127.0.0.3", port))
+	bad := net.ParseIP("127.0.0.2") // 未监听，连接被拒绝
+
+	var answersMu sync.Mutex
+	answers := []net.IP{bad, good.Addr().(*net.TCPAddr).IP}
+	resolver, queries := startFakeDNS(t, func() []net.IP {
+		answersMu.Lock()
+		defer answersMu.Unlock()
+		return answers
+	})
+
+	cfg := clientConfig(t, "127.0.0.1:1", testToken)
+	cfg.RoutingMode = core.RoutingModeNone
+	cfg.Resolver = resolver
+	cfg.DNSPinExclude = []string{"*.nopin.test"}
+	client := startProxyServer(t, cfg)
+	proxyAddr := client.Addr().String()
+
+	echo := func(host string) {
+		t.Helper()
+		conn := openTunnel(t, proxyAddr, net.JoinHostPort(host, port))
+		msg := []byte("pin|" + host)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("echo via %s = %q %v", host, got, err)
+		}
+	}
+	pinnedIP := func(host string) string {
+		for _, pin := range client.GetDNSPins() {
+			if pin.Host == host {
+				return pin.IP
+			}
+		}
+		return ""
+	}
+
+	for i := 0; i < 5; i++ {
+		echo("pinned.test")
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("A queries = %d, want 1 (later dials should use the pinned IP)", n)
+	}
+	if ip := pinnedIP("pinned.test"); ip != "127.0.0.1" {
+		t.Fatalf("pinned IP = %q, want 127.0.0.1", ip)
+	}
+
+	// 可用 IP 失效，DNS 轮换到新的可用 IP
+	good.Close()
+	answersMu.Lock()
+	answers = []net.IP{bad, net.ParseIP("127.0.0.3")}
+	answersMu.Unlock()
+	echo("pinned.test")
+	echo("pinned.test")
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("A queries = %d, want 2 (one re-resolution after the pinned IP failed)", n)
+	}
+	if ip := pinnedIP("pinned.test"); ip != "127.0.0.3" {
+		t.Fatalf("pinned IP after failover = %q, want 127.0.0.3", ip)
+	}
+
+	before := queries.Load()
+	echo("cdn.nopin.test")
+	echo("cdn.nopin.test")
+	if n := queries.Load() - before; n != 2 {
+		t.Fatalf("A queries for excluded host = %d, want 2", n)
+	}
+	if ip := pinnedIP("cdn.nopin.test"); ip != "" {
+		t.Fatalf("excluded host pinned to %s", ip)
+	}
+}
+
+// TestHappyEyeballs 域名的 IPv6 地址不可达（文档地址段，SYN 无响应或立即失败）时，
+// 直连在一个连接尝试间隔后改用 IPv4 地址，而不是等待 IPv6 连接超时
+func TestHappyEyeballs(t *testing.T) {
+	good := listenEcho(t, "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(good.Addr().String())
+	resolver, _ := startFakeDNS(t, func() []net.IP {
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("127.0.0.1")}
+	})
+
+	cfg := clientConfig(t, "127.0.0.1:1", testToken)
+	cfg.RoutingMode = core.RoutingModeNone
+	cfg.Resolver = resolver
+	cfg.DNSPinTTL = -1
+	proxyAddr := startClientWithConfig(t, cfg)
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		conn := openTunnel(t, proxyAddr, net.JoinHostPort("dual.test", port))
+		elapsed := time.Since(start)
+		echoLarge(t, conn, []byte("happy eyeballs"))
+		conn.Close()
+		// IPv6 先行，250ms 后发起 IPv4 连接
+		if elapsed > 2*time.Second {
+			t.Fatalf("dial took %v with unreachable IPv6, want about one attempt delay", elapsed)
+		}
+	}
+
+	// 只有不可达的 IPv6 地址时返回连接错误
+	v6only, _ := startFakeDNS(t, func() []net.IP { return []net.IP{net.ParseIP("::1")} })
+	cfg.Resolver = v6only
+	proxyAddr = startClientWithConfig(t, cfg)
+	if conn, err := dialSOCKS5(t, proxyAddr, net.JoinHostPort("v6only.test", "1")); err == nil {
+		conn.Close()
+		t.Fatal("dial to closed IPv6 port succeeded")
+	}
+}
+
+// TestMetrics /metrics 需要令牌，会话结束后计入会话总数和双向字节数
+func TestMetrics(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+	proxyAddr := startClient(t, serverAddr, testToken)
+
+	scrape := func(req *http.Request) (int, string) {
+		rec := httptest.NewRecorder()
+		metricsHandler(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	waitNoSessions(t)
+	if code, _ := scrape(httptest.NewRequest("GET", "/metrics", nil)); code != http.StatusUnauthorized {
+		t.Fatalf("/metrics without token = %d, want 401", code)
+	}
+	value := func(body, name string) int64 {
+		t.Helper()
+		for _, line := range strings.Split(body, "\n") {
+			if v, ok := strings.CutPrefix(line, name+" "); ok {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					t.Fatalf("parse %s: %v", line, err)
+				}
+				return n
+			}
+		}
+		t.Fatalf("metric %s missing:\n%s", name, body)
+		return 0
+	}
+	read := func() string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		code, body := scrape(req)
+		if code != http.StatusOK {
+			t.Fatalf("/metrics = %d, want 200", code)
+		}
+		return body
+	}
+	before := read()
+
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+	msg := bytes.Repeat([]byte("m"), 1000)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	conn.Close()
+	waitNoSessions(t)
+
+	after := read()
+	for _, m := range []struct {
+		name string
+		want int64
+	}{
+		{"echplus_sessions_total", 1},
+		{`echplus_relay_bytes_total{direction="up"}`, int64(len(msg))},
+		{`echplus_relay_bytes_total{direction="down"}`, int64(len(msg))},
+	} {
+		if got := value(after, m.name) - value(before, m.name); got != m.want {
+			t.Errorf("%s grew by %d, want %d", m.name, got, m.want)
+		}
+	}
+	if got := value(after, "echplus_sessions_active"); got != 0 {
+		t.Errorf("echplus_sessions_active = %d, want 0", got)
+	}
+}
+
+// TestFleetReport -report-to 的报告只含汇总计数并以令牌签名，-collector 校验签名和时间戳后在 /fleet 汇总各中继，
+// 时钟偏差在 fleetMaxSkew 内的报告被接受，超过的、签名错误的和早于上次报告的被拒绝，失联的中继不计入合计
+func TestFleetReport(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+	proxyAddr := startClient(t, serverAddr, testToken)
+
+	c, err := newFleetCollector(testToken + ", other-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offset atomic.Int64 // 收集端时钟相对真实时间的偏移
+	c.now = func() time.Time { return time.Now().Add(time.Duration(offset.Load())) }
+	prevCollector := collector
+	collector = c
+	t.Cleanup(func() { collector = prevCollector })
+	srv := httptest.NewServer(newMux())
+	t.Cleanup(srv.Close)
+	reportURL := srv.URL + fleetReportPath
+
+	type fleetView struct {
+		Relays []fleetRelay `json:"relays"`
+		Total  fleetTotal   `json:"total"`
+	}
+	fleet := func(t *testing.T) fleetView {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/fleet", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var v fleetView
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("/fleet = %d, want 200", resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// post 发送已签名的请求体，返回状态码
+	post := func(t *testing.T, body []byte, timestamp int64, signature string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, reportURL, bytes.NewReader(body))
+		req.Header.Set(fleetTimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(fleetSignatureHeader, signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("payload", func(t *testing.T) {
+		waitNoSessions(t)
+		before := newFleetReport("relay-a", time.Minute)
+		conn := openTunnel(t, proxyAddr, remoteTarget)
+		echoLarge(t, conn, []byte("fleet"))
+		conn.Close()
+		waitNoSessions(t)
+		if _, err := dialSOCKS5(t, startClient(t, serverAddr, "wrong-token"), remoteTarget); err == nil {
+			t.Fatal("connected with a wrong token")
+		}
+
+		var body []byte
+		capture := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			ts, _ := strconv.ParseInt(r.Header.Get(fleetTimestampHeader), 10, 64)
+			if r.Header.Get(fleetSignatureHeader) != signFleetReport(testToken, ts, body) {
+				t.Error("report signature does not match the body")
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer capture.Close()
+		if err := sendFleetReport(context.Background(), http.DefaultClient, capture.URL, testToken, newFleetReport("relay-a", time.Minute), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"bytesDown", "bytesUp", "errors", "intervalSeconds", "relay", "sessionsActive", "sessionsTotal", "uptimeSeconds", "version"}
+		if got := slices.Sorted(maps.Keys(fields)); !slices.Equal(got, want) {
+			t.Fatalf("report fields = %q, want %q", got, want)
+		}
+		for _, secret := range []string{"203.0.113.10", "127.0.0.1", testToken} {
+			if bytes.Contains(body, []byte(secret)) {
+				t.Fatalf("report contains %q: %s", secret, body)
+			}
+		}
+		var report fleetReport
+		json.Unmarshal(body, &report)
+		if report.SessionsTotal-before.SessionsTotal < 1 || report.BytesUp-before.BytesUp < 5 || report.BytesDown-before.BytesDown < 5 {
+			t.Fatalf("report %+v did not count the session after %+v", report, before)
+		}
+		if report.Errors["unauthorized"]-before.Errors["unauthorized"] < 1 {
+			t.Fatalf("unauthorized count %d did not grow from %d", report.Errors["unauthorized"], before.Errors["unauthorized"])
+		}
+	})
+
+	t.Run("collect", func(t *testing.T) {
+		if err := sendFleetReport(context.Background(), http.DefaultClient, reportURL, testToken, fleetReport{Relay: "relay-a", IntervalSeconds: 60, SessionsActive: 2, BytesUp: 100, Errors: map[string]int64{"dialFailures": 1}}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		// runReporter 启动后立即以另一个被接受的令牌发送报告
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runReporter(ctx, reportURL, "relay-b", func() string { return "other-token" }, time.Minute)
+		}()
+		var v fleetView
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if v = fleet(t); len(v.Relays) == 2 {
+				break
+			}
+		}
+		cancel()
+		<-done
+		if len(v.Relays) != 2 || v.Relays[0].Relay != "relay-a" || v.Relays[1].Relay != "relay-b" || v.Relays[1].Version != version {
+			t.Fatalf("/fleet relays = %+v, want relay-a and relay-b", v.Relays)
+		}
+		b := v.Relays[1]
+		if v.Total.Relays != 2 || v.Total.SessionsActive != 2+b.SessionsActive || v.Total.BytesUp != 100+b.BytesUp ||
+			v.Total.Errors["dialFailures"] != 1+b.Errors["dialFailures"] {
+			t.Fatalf("/fleet total = %+v, want the sum of %+v and %+v", v.Total, v.Relays[0], b)
+		}
+
+		resp, err := http.Get(srv.URL + "/fleet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("/fleet without token = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("signature", func(t *testing.T) {
+		body := []byte(`{"relay":"relay-c","intervalSeconds":60}`)
+		now := time.Now().Unix()
+		for name, code := range map[string]int{
+			"wrong token": post(t, body, now, signFleetReport("wrong-token", now, body)),
+			"tampered":    post(t, []byte(`{"relay":"relay-c","intervalSeconds":61}`), now, signFleetReport(testToken, now, body)),
+			"timestamp":   post(t, body, now+1, signFleetReport(testToken, now, body)),
+			"missing":     post(t, body, now, ""),
+		} {
+			if code != http.StatusUnauthorized {
+				t.Errorf("%s: status %d, want 401", name, code)
+			}
+		}
+		if code := post(t, []byte(`{"relay":""}`), now, signFleetReport(testToken, now, []byte(`{"relay":""}`))); code != http.StatusBadRequest {
+			t.Errorf("empty relay name: status %d, want 400", code)
+		}
+		for _, r := range fleet(t).Relays {
+			if r.Relay == "relay-c" || r.Relay == "" {
+				t.Fatalf("rejected report recorded: %+v", r)
+			}
+		}
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		body := []byte(`{"relay":"relay-d","intervalSeconds":60}`)
+		now := time.Now()
+		for _, tc := range []struct {
+			skew time.Duration
+			want int
+		}{
+			{-fleetMaxSkew + 30*time.Second, http.StatusNoContent}, // 中继时钟慢 4 分 30 秒
+			{fleetMaxSkew - 30*time.Second, http.StatusNoContent},  // 中继时钟快 4 分 30 秒
+			{fleetMaxSkew + 30*time.Second, http.StatusUnauthorized},
+			{-fleetMaxSkew - 30*time.Second, http.StatusUnauthorized},
+		} {
+			ts := now.Add(tc.skew).Unix()
+			if code := post(t, body, ts, signFleetReport(testToken, ts, body)); code != tc.want {
+				t.Errorf("skew %v: status %d, want %d", tc.skew, code, tc.want)
+			}
+		}
+		// 早于该中继上次报告的请求视为重放
+		ts := now.Add(-time.Minute).Unix()
+		if code := post(t, body, ts, signFleetReport(testToken, ts, body)); code != http.StatusConflict {
+			t.Errorf("older report: status %d, want 409", code)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		// 3 个报告间隔后失联的中继仍列出但不计入合计，24 小时后移除
+		offset.Store(int64(3*time.Minute + 10*time.Second))
+		v := fleet(t)
+		if v.Total.Relays != 0 || v.Total.SessionsActive != 0 || len(v.Relays) != 3 || !v.Relays[0].Stale {
+			t.Fatalf("after 3 intervals: %+v, want all relays stale", v)
+		}
+		offset.Store(int64(25 * time.Hour))
+		if v := fleet(t); len(v.Relays) != 0 {
+			t.Fatalf("after 25h relays = %+v, want none", v.Relays)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		collector = nil
+		defer func() { collector = c }()
+		for _, path := range []string{"/fleet", fleetReportPath} {
+			resp, err := http.Post(srv.URL+path, "application/json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("%s without -collector = %d, want 404", path, resp.StatusCode)
+			}
+		}
+	})
+}
+
+// TestAccessLog 每个会话结束时写入一行 JSON 访问日志，包含目标和双向字节数
+func TestAccessLog(t *testing.T) {
+	// 等待之前测试的会话结束，避免其记录写入本测试的日志
+	waitNoSessions(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openAccessLog(path, 0)
+	if err != nil {
+		t.Fatalf("open access log: %v", err)
+	}
+	prev := accessLog
+	accessLog = l
+	t.Cleanup(func() {
+		accessLog = prev
+		l.close()
+	})
+
+	proxyAddr := startEchoClient(t)
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+	msg := []byte("access-log")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	conn.Close()
+
+	var rec accessRecord
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		data, _ := os.ReadFile(path)
+		if line, _, ok := bytes.Cut(data, []byte("\n")); ok {
+			if err := json.Unmarshal(line, &rec); err != nil {
+				t.Fatalf("decode record %q: %v", line, err)
+			}
+			break
+		}
+	}
+	if rec.Session == "" {
+		t.Fatal("no access log record written after the session ended")
+	}
+	if rec.Protocol != "echplus" || rec.Target != remoteTarget {
+		t.Fatalf("record = %+v, want echplus session to %s", rec, remoteTarget)
+	}
+	if rec.BytesUp != int64(len(msg)) || rec.BytesDown != int64(len(msg)) {
+		t.Fatalf("bytes up/down = %d/%d, want %d/%d", rec.BytesUp, rec.BytesDown, len(msg), len(msg))
+	}
+	if rec.CloseReason == "" || rec.End.Before(rec.Start) {
+		t.Fatalf("record = %+v, want close reason and end after start", rec)
+	}
+}
+
+// TestSlowSOCKSHandshake 本地握手有独立的超时：慢速 SOCKS5 协商在握手超时内成功，超过时失败
+func TestSlowSOCKSHandshake(t *testing.T) {
+	cfg := echoClientConfig(t)
+	cfg.HandshakeTimeout = time.Second
+	cfg.EstablishTimeout = time.Second
+	proxyAddr := startClientWithConfig(t, cfg)
+
+	conn, err := dialSOCKS5Paused(t, proxyAddr, remoteTarget, 700*time.Millisecond)
+	if err != nil {
+		t.Fatalf("slow handshake within HandshakeTimeout failed: %v", err)
+	}
+	conn.Close()
+
+	if conn, err := dialSOCKS5Paused(t, proxyAddr, remoteTarget, 1500*time.Millisecond); err == nil {
+		conn.Close()
+		t.Fatal("handshake slower than HandshakeTimeout succeeded")
+	}
+}
+
+// TestStalledUpstreamEstablishTimeout 服务端接受升级后不响应 CONNECT 时，在建立阶段截止时间失败
+func TestStalledUpstreamEstablishTimeout(t *testing.T) {
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, http.Header{"Sec-WebSocket-Protocol": {testToken}})
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(stalled.Close)
+
+	cfg := clientConfig(t, strings.TrimPrefix(stalled.URL, "http://"), testToken)
+	cfg.HandshakeTimeout = 5 * time.Second
+	cfg.EstablishTimeout = time.Second
+	proxyAddr := startClientWithConfig(t, cfg)
+
+	start := time.Now()
+	conn, err := dialSOCKS5(t, proxyAddr, remoteTarget)
+	elapsed := time.Since(start)
+	if err == nil {
+		conn.Close()
+		t.Fatal("SOCKS5 connect through a stalled upstream succeeded")
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 4*time.Second {
+		t.Fatalf("stalled upstream failed after %v, want about EstablishTimeout (1s)", elapsed)
+	}
+}
+
+// TestIdleTunnelTimeout 双向无数据超过 IdleTimeout 的隧道被关闭，持续有数据的隧道不受影响
+func TestIdleTunnelTimeout(t *testing.T) {
+	cfg := echoClientConfig(t)
+	cfg.IdleTimeout = 600 * time.Millisecond
+	proxyAddr := startClientWithConfig(t, cfg)
+
+	idle := openTunnel(t, proxyAddr, remoteTarget)
+	active := openTunnel(t, proxyAddr, remoteTarget)
+
+	// 活动隧道每 200ms 收发一次，持续超过 IdleTimeout 两倍
+	active.SetDeadline(time.Now().Add(10 * time.Second))
+	msg := []byte("ping")
+	for end := time.Now().Add(1500 * time.Millisecond); time.Now().Before(end); time.Sleep(200 * time.Millisecond) {
+		if _, err := active.Write(msg); err != nil {
+			t.Fatalf("active tunnel write: %v", err)
+		}
+		if _, err := io.ReadFull(active, make([]byte, len(msg))); err != nil {
+			t.Fatalf("active tunnel closed while in use: %v", err)
+		}
+	}
+
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle tunnel read = %v, want EOF after IdleTimeout", err)
+	}
+}
+
+// TestIdleTunnelOutlivesPhaseTimeouts 握手和建立阶段的超时只约束协议识别和连接建立：未设置 IdleTimeout 时，
+// 建立后长时间无数据的 SOCKS5、HTTP CONNECT 隧道和 UDP ASSOCIATE 控制连接都保持打开。
+// 阶段超时缩短到 300ms，空闲 1.5s 相当于默认 30s 建立超时的五倍
+func TestIdleTunnelOutlivesPhaseTimeouts(t *testing.T) {
+	cfg := echoClientConfig(t)
+	cfg.HandshakeTimeout = 300 * time.Millisecond
+	cfg.EstablishTimeout = 300 * time.Millisecond
+	proxyAddr := startClientWithConfig(t, cfg)
+
+	socks := openTunnel(t, proxyAddr, remoteTarget)
+
+	httpConn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer httpConn.Close()
+	fmt.Fprintf(httpConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", remoteTarget, remoteTarget)
+	httpReader := bufio.NewReader(httpConn)
+	resp, err := http.ReadResponse(httpReader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("HTTP CONNECT = %v, %v, want 200", resp, err)
+	}
+
+	udpCtl, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer udpCtl.Close()
+	udpCtl.SetDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 10)
+	udpCtl.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(udpCtl, reply[:2]); err != nil {
+		t.Fatalf("SOCKS5 greeting: %v", err)
+	}
+	udpCtl.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if _, err := io.ReadFull(udpCtl, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE reply = %v, %v", reply, err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	socks.SetDeadline(time.Now().Add(5 * time.Second))
+	echoLarge(t, socks, []byte("socks after idle"))
+
+	msg := []byte("connect after idle")
+	httpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := httpConn.Write(msg); err != nil {
+		t.Fatalf("HTTP CONNECT tunnel write after idle: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(httpReader, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("HTTP CONNECT tunnel echo after idle = %q, %v", got, err)
+	}
+
+	// 控制连接仍打开：读取应超时而不是 EOF
+	udpCtl.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var netErr net.Error
+	if _, err := udpCtl.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("UDP ASSOCIATE control connection read after idle = %v, want timeout", err)
+	}
+}
+
+// TestCloseReasons 最近连接记录中区分客户端关闭、目标关闭和空闲超时
+func TestCloseReasons(t *testing.T) {
+	// 接受连接后立即关闭的目标
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer closing.Close()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg := echoClientConfig(t)
+	cfg.IdleTimeout = 500 * time.Millisecond
+	client := startProxyServer(t, cfg)
+	proxyAddr := client.Addr().String()
+
+	waitRecord := func(n int) core.ConnectionRecord {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if records := client.GetRecentConnections(); len(records) >= n {
+				return records[n-1]
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("connection %d not recorded", n)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+	conn.Close()
+	if r := waitRecord(1); r.CloseReason != core.CloseClient {
+		t.Fatalf("client close reason = %q, want %q", r.CloseReason, core.CloseClient)
+	}
+
+	// 局域网目标强制直连。目标先关闭，客户端读到 EOF 后再关闭，原因归属先关闭的目标
+	conn, err = dialSOCKS5(t, proxyAddr, closing.Addr().String())
+	if err != nil {
+		t.Fatalf("dial closing target: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("closing target read = %v, want EOF", err)
+	}
+	conn.Close()
+	if r := waitRecord(2); r.CloseReason != core.CloseRemote {
+		t.Fatalf("target close reason = %q, want %q", r.CloseReason, core.CloseRemote)
+	}
+
+	conn, err = dialSOCKS5(t, proxyAddr, remoteTarget)
+	if err != nil {
+		t.Fatalf("dial idle tunnel: %v", err)
+	}
+	defer conn.Close()
+	if r := waitRecord(3); r.CloseReason != core.CloseIdle {
+		t.Fatalf("idle close reason = %q, want %q", r.CloseReason, core.CloseIdle)
+	}
+}
+
+// TestConnectionTiming 活动连接和最近连接记录建立耗时、转发字节数和平均吞吐量，
+// GetHandshakeStats 汇总建立隧道耗时的分位数
+func TestConnectionTiming(t *testing.T) {
+	client := startProxyServer(t, echoClientConfig(t))
+	proxyAddr := client.Addr().String()
+
+	payload := bytes.Repeat([]byte("timing"), 10000)
+	for i := 0; i < 3; i++ {
+		conn := openTunnel(t, proxyAddr, remoteTarget)
+		echoLarge(t, conn, payload)
+
+		active := client.GetActiveConnections()
+		if len(active) != 1 {
+			t.Fatalf("active connections = %d, want 1", len(active))
+		}
+		if a := active[0]; a.Target != remoteTarget || a.Direct || a.HandshakeTime <= 0 ||
+			a.Upload != int64(len(payload)) || a.Download != int64(len(payload)) || a.Throughput <= 0 {
+			t.Fatalf("active connection = %+v", a)
+		}
+		conn.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(client.GetRecentConnections()) <= i {
+			if time.Now().After(deadline) {
+				t.Fatalf("connection %d not recorded", i+1)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	for _, r := range client.GetRecentConnections() {
+		if r.HandshakeTime <= 0 || r.Upload != int64(len(payload)) || r.Download != int64(len(payload)) || r.Throughput <= 0 {
+			t.Fatalf("recent connection = %+v", r)
+		}
+		if elapsed := r.EndedAt.Sub(r.StartedAt); r.HandshakeTime > elapsed {
+			t.Fatalf("handshake %v longer than connection %v", r.HandshakeTime, elapsed)
+		}
+	}
+	if n := len(client.GetActiveConnections()); n != 0 {
+		t.Fatalf("active connections after close = %d, want 0", n)
+	}
+	hs := client.GetHandshakeStats()
+	if hs.Samples != 3 || hs.P50 <= 0 || hs.P95 < hs.P50 {
+		t.Fatalf("handshake stats = %+v", hs)
+	}
+}
+
+// TestCloseConnection CloseConnection 按 ConnID 关闭单个隧道或直连连接，不影响其他连接
+func TestCloseConnection(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	client := startProxyServer(t, clientConfig(t, startTunnelServer(t, echoAddr), testToken))
+	proxyAddr := client.Addr().String()
+
+	// echoAddr 为局域网地址，强制直连
+	for _, target := range []string{remoteTarget, echoAddr} {
+		kept := openTunnel(t, proxyAddr, remoteTarget)
+		echoLarge(t, kept, []byte("kept"))
+		killed := openTunnel(t, proxyAddr, target)
+		echoLarge(t, killed, []byte("killed"))
+
+		var id uint64
+		for _, c := range client.GetActiveConnections() {
+			if c.ClientAddr == killed.LocalAddr().String() {
+				id = c.ConnID
+			}
+		}
+		if !client.CloseConnection(id) {
+			t.Fatalf("CloseConnection(%d) for %s = false", id, target)
+		}
+		killed.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := killed.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read after CloseConnection = %d, %v; want the connection closed", n, err)
+		}
+		echoLarge(t, kept, []byte("still open"))
+
+		var record core.ConnectionRecord
+		for deadline := time.Now().Add(5 * time.Second); record.ConnID != id && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, r := range client.GetRecentConnections() {
+				if r.ConnID == id {
+					record = r
+				}
+			}
+		}
+		if record.ConnID != id || record.CloseReason != core.CloseKilled || record.Error != "" || record.Direct != (target == echoAddr) {
+			t.Fatalf("record of the killed connection = %+v, want %q without error", record, core.CloseKilled)
+		}
+		if client.CloseConnection(id) {
+			t.Fatalf("CloseConnection(%d) succeeded again after the connection ended", id)
+		}
+	}
+}
+
+// TestUploadCoalescing 合并小块上传数据时数据完整、顺序不变，合并等待期间客户端半关闭时
+// 已读数据先送达；关闭合并时行为相同
+func TestUploadCoalescing(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	for _, tc := range []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"default", 0},
+		{"long window", 50 * time.Millisecond},
+		{"disabled", -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := clientConfig(t, serverAddr, testToken)
+			cfg.UploadCoalesceDelay = tc.delay
+			conn := openTunnel(t, startClientWithConfig(t, cfg), remoteTarget)
+
+			// 交互式往返：每次只发送几个字节，合并等待不应阻塞应答
+			for i := 0; i < 5; i++ {
+				msg := []byte(fmt.Sprintf("key-%d", i))
+				if _, err := conn.Write(msg); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				got := make([]byte, len(msg))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatalf("echo = %q, want %q", got, msg)
+				}
+			}
+
+			var want bytes.Buffer
+			for i := 0; i < 2000; i++ {
+				chunk := []byte(fmt.Sprintf("<%d>", i))
+				want.Write(chunk)
+				if _, err := conn.Write(chunk); err != nil {
+					t.Fatalf("write chunk %d: %v", i, err)
+				}
+			}
+			conn.(*net.TCPConn).CloseWrite()
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("read echo: %v", err)
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Fatalf("echo of %d bytes differs from %d bytes sent", len(got), want.Len())
+			}
+		})
+	}
+}
+
+// TestPongTimeout 服务端停止响应 ping 后，客户端在 PongTimeout 后关闭隧道和本地连接；
+// 服务端正常响应时空闲隧道不受 PongTimeout 影响
+func TestPongTimeout(t *testing.T) {
+	const pongTimeout = 500 * time.Millisecond
+	proxy := startCutProxy(t, startTunnelServer(t, startEchoServer(t)))
+	cfg := clientConfig(t, proxy.addr, testToken)
+	cfg.PingInterval = 100 * time.Millisecond
+	cfg.PongTimeout = pongTimeout
+	client := startProxyServer(t, cfg)
+
+	conn := openTunnel(t, client.Addr().String(), remoteTarget)
+	time.Sleep(3 * pongTimeout)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write after idle: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("idle tunnel closed while server answers pings: %v", err)
+	}
+
+	proxy.stall()
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded on a stalled tunnel")
+	}
+	if elapsed := time.Since(start); elapsed > 2*pongTimeout {
+		t.Fatalf("tunnel closed after %v, want within %v", elapsed, 2*pongTimeout)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(client.GetRecentConnections()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not recorded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if r := client.GetRecentConnections()[0]; r.CloseReason != core.CloseTimeout {
+		t.Fatalf("close reason = %q, want %q", r.CloseReason, core.CloseTimeout)
+	}
+}
+
+// TestKeepaliveValidation ping 间隔不小于读超时时服务端参数校验失败，客户端拒绝启动和重载
+func TestKeepaliveValidation(t *testing.T) {
+	for _, tc := range []struct {
+		interval, timeout time.Duration
+		ok                bool
+	}{
+		{30 * time.Second, 60 * time.Second, true},
+		{time.Second, 2 * time.Second, true},
+		{60 * time.Second, 60 * time.Second, false},
+		{90 * time.Second, 60 * time.Second, false},
+		{100 * time.Millisecond, time.Second, false},
+	} {
+		if err := validateKeepalive(tc.interval, tc.timeout); (err == nil) != tc.ok {
+			t.Errorf("validateKeepalive(%v, %v) = %v, want ok=%v", tc.interval, tc.timeout, err, tc.ok)
+		}
+	}
+
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	for _, tc := range []struct {
+		name          string
+		ping, timeout time.Duration
+	}{
+		{"equal", time.Second, time.Second},
+		{"ping above default pong timeout", 40 * time.Second, 0},
+		{"pong timeout below default ping", 0, 5 * time.Second},
+	} {
+		cfg := clientConfig(t, serverAddr, testToken)
+		cfg.PingInterval, cfg.PongTimeout = tc.ping, tc.timeout
+		client := core.NewProxyServer(cfg)
+		if err := client.Start(); err == nil {
+			client.Stop()
+			t.Errorf("%s: client started with ping %v and pong timeout %v", tc.name, tc.ping, tc.timeout)
+		}
+	}
+
+	client := startProxyServer(t, clientConfig(t, serverAddr, testToken))
+	cfg := client.GetConfig()
+	cfg.PingInterval, cfg.PongTimeout = 2*time.Second, time.Second
+	if err := client.Reload(cfg); err == nil {
+		t.Fatal("reload accepted ping interval above pong timeout")
+	}
+	if got := client.GetConfig().PingInterval; got != 0 {
+		t.Fatalf("ping interval after rejected reload = %v, want unchanged 0", got)
+	}
+}
+
+// TestLifecycleConcurrency 并发调用 Start、Stop、Restart、UpdateConfig、Reload、Pause 不会重复关闭 stopChan
+// 或留下不一致的状态：每次调用要么成功，要么返回 ErrAlreadyRunning / ErrNotRunning，结束后仍可正常启动和转发
+func TestLifecycleConcurrency(t *testing.T) {
+	cfg := echoClientConfig(t)
+	cfg.DrainTimeout = 100 * time.Millisecond
+	client := core.NewProxyServer(cfg)
+	t.Cleanup(func() { client.Stop() })
+
+	const workers, rounds = 6, 40
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < rounds; i++ {
+				var err error
+				switch op := rng.Intn(7); op {
+				case 0, 1:
+					err = client.Start()
+				case 2, 3:
+					err = client.Stop()
+				case 4:
+					err = client.Restart()
+				case 5:
+					err = client.UpdateConfig(cfg)
+				case 6:
+					err = client.Reload(cfg)
+					client.Pause()
+					client.GetState()
+					client.Addr()
+				}
+				if err != nil && !errors.Is(err, core.ErrAlreadyRunning) && !errors.Is(err, core.ErrNotRunning) {
+					t.Errorf("lifecycle call: %v", err)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	if err := client.Stop(); err != nil && !errors.Is(err, core.ErrNotRunning) {
+		t.Fatalf("final stop: %v", err)
+	}
+	if state := client.GetState(); state != core.StateStopped {
+		t.Fatalf("state after stop = %s, want stopped", state)
+	}
+	if err := client.Stop(); !errors.Is(err, core.ErrNotRunning) {
+		t.Fatalf("second stop = %v, want ErrNotRunning", err)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatalf("start after hammering: %v", err)
+	}
+	if err := client.Start(); !errors.Is(err, core.ErrAlreadyRunning) {
+		t.Fatalf("second start = %v, want ErrAlreadyRunning", err)
+	}
+	conn := openTunnel(t, client.Addr().String(), remoteTarget)
+	echoLarge(t, conn, []byte("still alive"))
+}
+
+// TestReloadUnderTraffic 连接处理期间并发 Reload、FlushCaches 不产生数据竞争（配合 -race），
+// 未知的 RoutingMode 在保存前按 global 处理，之后不再被修改
+func TestReloadUnderTraffic(t *testing.T) {
+	client := startProxyServer(t, echoClientConfig(t))
+	proxyAddr := client.Addr().String()
+
+	done := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		modes := []core.RoutingMode{core.RoutingModeGlobal, "", "bogus"}
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cfg := client.GetConfig()
+			cfg.RoutingMode = modes[i%len(modes)]
+			cfg.DialTimeout = time.Duration(5+i%2) * time.Second
+			cfg.PinAnyChainCert = i%2 == 0
+			if err := client.Reload(cfg); err != nil {
+				t.Errorf("reload: %v", err)
+				return
+			}
+			if i%5 == 0 {
+				client.FlushCaches()
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for range 4 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for range 15 {
+				conn, err := dialSOCKS5(t, proxyAddr, remoteTarget)
+				if err != nil {
+					t.Errorf("dial during reload: %v", err)
+					return
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				msg := []byte("reload")
+				_, err = conn.Write(msg)
+				buf := make([]byte, len(msg))
+				if err == nil {
+					_, err = io.ReadFull(conn, buf)
+				}
+				conn.Close()
+				if err != nil || !bytes.Equal(buf, msg) {
+					t.Errorf("echo during reload = %q, %v", buf, err)
+					return
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	close(done)
+	reloads.Wait()
+
+	cfg := client.GetConfig()
+	cfg.RoutingMode = "bogus"
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.GetConfig().RoutingMode; got != core.RoutingModeGlobal {
+		t.Fatalf("routing mode after reload with an unknown mode = %q, want global", got)
+	}
+}
+
+// coreGoroutines 返回调用栈中含有 core 包函数的 goroutine，用于检查 Stop 后是否有泄漏
+func coreGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		if n := runtime.Stack(buf, true); n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var leaked []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "/apps/client/core.") {
+			leaked = append(leaked, g)
+		}
+	}
+	return leaked
+}
+
+// TestLifecycleLeaks 反复 Start、Stop、Restart 后不残留后台任务和连接的 goroutine，堆内存不随周期数增长
+func TestLifecycleLeaks(t *testing.T) {
+	cfg := echoClientConfig(t)
+	// 启用所有按配置生效的后台任务
+	cfg.ServerIP = "127.0.0.1,localhost"
+	cfg.WatchNetwork = true
+	cfg.InternalsLogInterval = time.Hour
+	cfg.DrainTimeout = 100 * time.Millisecond
+	client := core.NewProxyServer(cfg)
+	t.Cleanup(func() { client.Stop() })
+
+	waitNoCore := func(t *testing.T) {
+		t.Helper()
+		var leaked []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if leaked = coreGoroutines(); len(leaked) == 0 {
+				return
+			}
+		}
+		t.Fatalf("%d goroutines left after stop:\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+	heap := func() uint64 {
+		runtime.GC()
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		return mem.HeapAlloc
+	}
+	cycle := func(t *testing.T, i int) {
+		t.Helper()
+		var err error
+		if i%2 == 0 {
+			err = client.Start()
+		} else {
+			err = client.Restart()
+		}
+		if err != nil {
+			t.Fatalf("cycle %d: start: %v", i, err)
+		}
+		conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget)
+		if err != nil {
+			t.Fatalf("cycle %d: dial: %v", i, err)
+		}
+		echoLarge(t, conn, []byte("cycle"))
+		// 留一条连接给 Stop 关闭
+		if i%3 != 0 {
+			conn.Close()
+		}
+		if err := client.Stop(); err != nil {
+			t.Fatalf("cycle %d: stop: %v", i, err)
+		}
+		conn.Close()
+	}
+
+	waitNoCore(t)
+	const warmup, cycles = 10, 100
+	for i := range warmup {
+		cycle(t, i)
+	}
+	waitNoCore(t)
+	before := heap()
+	for i := range cycles {
+		cycle(t, i)
+	}
+	waitNoCore(t)
+	after := heap()
+	t.Logf("heap after %d cycles: %s -> %s", cycles, core.FormatBytes(int64(before)), core.FormatBytes(int64(after)))
+	if after > before+2<<20 {
+		t.Fatalf("heap grew from %s to %s over %d cycles", core.FormatBytes(int64(before)), core.FormatBytes(int64(after)), cycles)
+	}
+}
+
+// TestLifecycleTransitions 每个生命周期操作在各状态下的结果：允许的转换到达预期状态，
+// 不允许的返回对应的错误且状态不变，启动失败后回到 stopped 并可再次启动
+func TestLifecycleTransitions(t *testing.T) {
+	cfg := echoClientConfig(t)
+	client := core.NewProxyServer(cfg)
+	t.Cleanup(func() { client.Stop() })
+
+	for i, step := range []struct {
+		op      string
+		wantErr error
+		want    core.ServerState
+	}{
+		{"stop", core.ErrNotRunning, core.StateStopped},
+		{"pause", core.ErrNotRunning, core.StateStopped},
+		{"resume", core.ErrNotRunning, core.StateStopped},
+		{"update", nil, core.StateStopped},
+		{"start", nil, core.StateRunning},
+		{"start", core.ErrAlreadyRunning, core.StateRunning},
+		{"resume", core.ErrNotPaused, core.StateRunning},
+		{"pause", nil, core.StatePaused},
+		{"pause", core.ErrAlreadyPaused, core.StatePaused},
+		{"resume", nil, core.StateRunning},
+		{"pause", nil, core.StatePaused},
+		{"restart", nil, core.StateRunning},
+		{"update", nil, core.StateRunning},
+		{"stop", nil, core.StateStopped},
+		{"restart", nil, core.StateRunning},
+		{"stop", nil, core.StateStopped},
+	} {
+		var err error
+		switch step.op {
+		case "start":
+			err = client.Start()
+		case "stop":
+			err = client.Stop()
+		case "restart":
+			err = client.Restart()
+		case "update":
+			err = client.UpdateConfig(cfg)
+		case "pause":
+			err = client.Pause()
+		case "resume":
+			err = client.Resume()
+		}
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("step %d: %s = %v, want %v", i, step.op, err, step.wantErr)
+		}
+		if state := client.GetState(); state != step.want {
+			t.Fatalf("step %d: state after %s = %s, want %s", i, step.op, state, step.want)
+		}
+	}
+
+	// 启动失败时回到 stopped
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	failing := cfg
+	failing.ListenAddr = busy.Addr().String()
+	if err := client.UpdateConfig(failing); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := client.Start(); err == nil || errors.Is(err, core.ErrAlreadyRunning) {
+		t.Fatalf("start on a busy address = %v, want a listen error", err)
+	}
+	if state := client.GetState(); state != core.StateStopped || client.IsRunning() {
+		t.Fatalf("state after failed start = %s, want stopped", state)
+	}
+
+	if err := client.UpdateConfig(cfg); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatalf("start after a failed start: %v", err)
+	}
+	conn := openTunnel(t, client.Addr().String(), remoteTarget)
+	echoLarge(t, conn, []byte("transitions"))
+}
+
+// TestPauseModes 暂停期间按 PauseMode 拒绝或直连新连接；PauseDrain 为 true 时在 DrainTimeout 后
+// 只关闭暂停时已有的连接，暂停期间直连的连接不受影响
+func TestPauseModes(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+
+	t.Run("reject", func(t *testing.T) {
+		client := startProxyServer(t, clientConfig(t, serverAddr, testToken))
+		proxyAddr := client.Addr().String()
+		existing := openTunnel(t, proxyAddr, remoteTarget)
+		if err := client.Pause(); err != nil {
+			t.Fatal(err)
+		}
+
+		if conn, err := dialSOCKS5(t, proxyAddr, remoteTarget); err == nil {
+			conn.Close()
+			t.Fatal("SOCKS5 connection accepted while paused")
+		}
+		conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("HTTP request while paused = %v, %v, want 503", resp, err)
+		}
+		echoLarge(t, existing, []byte("kept while paused"))
+
+		if err := client.Resume(); err != nil {
+			t.Fatal(err)
+		}
+		resumed := openTunnel(t, proxyAddr, remoteTarget)
+		echoLarge(t, resumed, []byte("resumed"))
+	})
+
+	t.Run("direct with drain", func(t *testing.T) {
+		cfg := clientConfig(t, serverAddr, testToken)
+		cfg.PauseMode, cfg.PauseDrain, cfg.DrainTimeout = core.PauseModeDirect, true, 300*time.Millisecond
+		client := startProxyServer(t, cfg)
+		proxyAddr := client.Addr().String()
+		existing := openTunnel(t, proxyAddr, remoteTarget)
+		echoLarge(t, existing, []byte("before pause"))
+		if err := client.Pause(); err != nil {
+			t.Fatal(err)
+		}
+
+		direct := openTunnel(t, proxyAddr, echoAddr)
+		echoLarge(t, direct, []byte("direct while paused"))
+		decisions := client.GetRouteDecisions()
+		if d := decisions[len(decisions)-1]; !d.Direct || d.Reason != "代理已暂停" {
+			t.Fatalf("route decision while paused = %+v, want direct because of the pause", d)
+		}
+
+		existing.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var netErr net.Error
+		if _, err := existing.Read(make([]byte, 1)); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatalf("read on the connection from before the pause = %v, want it closed after DrainTimeout", err)
+		}
+		echoLarge(t, direct, []byte("still open after drain"))
+	})
+}
+
+// TestHostRateLimits 100KB/s 的主机限速使经隧道和直连回显 1MB 都至少需要约 9 秒；
+// 上传和下载各有令牌桶，回显时两个方向同时进行，不会因共用一个桶而翻倍
+func TestHostRateLimits(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+	const rate, size = 100 << 10, 1 << 20
+	cfg := clientConfig(t, serverAddr, testToken)
+	cfg.HostRateLimits = map[string]int64{"203.0.113.10": rate, "127.0.0.1": rate}
+	client := startProxyServer(t, cfg)
+	payload := bytes.Repeat([]byte("limited "), size/8)
+	// 桶初始装满一秒的流量，剩余部分按速率发送
+	minElapsed := time.Duration(float64(size-rate) / rate * float64(time.Second))
+
+	// 两条路径同时回显，各自的规则互不影响
+	echo := func(target string) (time.Duration, error) {
+		conn, err := dialSOCKS5(t, client.Addr().String(), target)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		start := time.Now()
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(payload)
+			writeErr <- err
+		}()
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return 0, err
+		}
+		if err := <-writeErr; err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(got, payload) {
+			return 0, errors.New("echo mismatch")
+		}
+		return time.Since(start), nil
+	}
+	paths := map[string]string{"tunnel": remoteTarget, "direct": echoAddr}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	elapsed := make(map[string]time.Duration)
+	for name, target := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := echo(target)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			mu.Lock()
+			elapsed[name] = d
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for name := range paths {
+		if d := elapsed[name]; d < minElapsed || d > minElapsed*3/2 {
+			t.Errorf("%s: echoing %d bytes at %d B/s took %v, want between %v and %v", name, size, rate, d, minElapsed, minElapsed*3/2)
+		}
+	}
+}
+
+// TestPinnedSPKI wss:// 隧道的服务端证书公钥与 PinnedSPKI 匹配时正常转发，
+// 不匹配时握手失败，上游状态和 UpstreamErrorHandler 报告 pin_mismatch
+func TestPinnedSPKI(t *testing.T) {
+	chain, leaf, ca := testCertChain(t)
+	serverAddr := startTLSTunnelServer(t, startEchoServer(t), chain)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	var mismatches atomic.Int32
+	core.SetUpstreamErrorHandler(func(code string, err error) {
+		if code == core.UpstreamErrorPinMismatch && errors.Is(err, core.ErrPinMismatch) {
+			mismatches.Add(1)
+		}
+	})
+	t.Cleanup(func() { core.SetUpstreamErrorHandler(nil) })
+
+	otherPin := core.SPKIPin(&x509.Certificate{RawSubjectPublicKeyInfo: []byte("other key")})
+	pinnedConfig := func(t *testing.T, pins []string, anyChain bool) core.Config {
+		cfg := clientConfig(t, serverAddr, testToken)
+		cfg.ServerAddr = "wss://" + serverAddr + "/"
+		cfg.RootCAs = roots
+		cfg.PinnedSPKI = pins
+		cfg.PinAnyChainCert = anyChain
+		return cfg
+	}
+
+	cases := []struct {
+		name     string
+		pins     []string
+		anyChain bool
+		ok       bool
+	}{
+		{"leaf", []string{core.SPKIPin(leaf)}, false, true},
+		{"leaf with prefix among others", []string{otherPin, "sha256/" + core.SPKIPin(leaf)}, false, true},
+		{"mismatch", []string{otherPin}, false, false},
+		{"ca without any-chain", []string{core.SPKIPin(ca)}, false, false},
+		{"ca with any-chain", []string{core.SPKIPin(ca)}, true, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := startProxyServer(t, pinnedConfig(t, tc.pins, tc.anyChain))
+			before := mismatches.Load()
+			conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget)
+			status := client.GetUpstreamStatus()
+			if !tc.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("tunnel established despite pin mismatch")
+				}
+				if status.LastErrorCode != core.UpstreamErrorPinMismatch {
+					t.Fatalf("last error code = %q (%s), want %q", status.LastErrorCode, status.LastError, core.UpstreamErrorPinMismatch)
+				}
+				if mismatches.Load() == before {
+					t.Fatal("pin mismatch not reported to the upstream error handler")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial via SOCKS5: %v (upstream: %s)", err, status.LastError)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			echoLarge(t, conn, []byte("pinned tunnel"))
+			if status.LastErrorCode != "" {
+				t.Fatalf("last error code = %q, want empty", status.LastErrorCode)
+			}
+		})
+	}
+
+	if err := core.NewProxyServer(pinnedConfig(t, []string{"not-a-pin"}, false)).Start(); err == nil {
+		t.Fatal("client started with an invalid pin")
+	}
+}
+
+// startFakeACME 启动对所有请求返回 404 的 ACME 目录，返回目录地址和收到的请求数
+func startFakeACME(t *testing.T) (string, *atomic.Int32) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/directory", &hits
+}
+
+// serveACME 在本机 TLS 监听上提供与 main 相同的处理器，证书由 a 管理
+func serveACME(t *testing.T, a *acmeTLS) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := newHTTPServer("", newMux())
+	srv.TLSConfig = a.tlsConfig()
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// putACMECache 以 autocert 的缓存格式（PEM 私钥后接证书链）写入 domain 的 90 天自签名证书
+func putACMECache(t *testing.T, dir, domain string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	now := time.Now()
+	der, err := x509.CreateCertificate(crand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 90),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{domain},
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: domain}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(filepath.Join(dir, domain), data, 0600); err != nil {
+		t.Fatalf("write cache: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+// TestACMECertificateCache 缓存中未到续期时间的证书直接用于本机 TLS 监听，不访问 ACME 服务器；
+// 隧道和健康检查都经该监听提供，未配置的域名握手失败
+func TestACMECertificateCache(t *testing.T) {
+	startTunnelServer(t, startEchoServer(t)) // 设置测试令牌
+	directory, hits := startFakeACME(t)
+	cacheDir := filepath.Join(t.TempDir(), "acme")
+	a, err := newACME(acmeOptions{domains: []string{"echplus.test"}, cacheDir: cacheDir, directory: directory})
+	if err != nil {
+		t.Fatalf("newACME: %v", err)
+	}
+	if info, err := os.Stat(cacheDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("cache directory not created with mode 0700: %v, %v", info, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(putACMECache(t, cacheDir, "echplus.test"))
+	addr := serveACME(t, a)
+	tlsCfg := &tls.Config{ServerName: "echplus.test", RootCAs: roots}
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}, Timeout: 5 * time.Second}
+	resp, err := httpClient.Get("https://" + addr + "/health")
+	if err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Fatalf("GET /health = %d %q, want 200 OK", resp.StatusCode, body)
+	}
+
+	dialer := websocket.Dialer{TLSClientConfig: tlsCfg, Subprotocols: []string{testToken, protocol.FramingSubprotocol}, HandshakeTimeout: 5 * time.Second}
+	ws, _, err := dialer.Dial("wss://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("dial tunnel over the ACME listener: %v", err)
+	}
+	ws.Close()
+
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true}); err == nil {
+		conn.Close()
+		t.Fatal("handshake succeeded for a domain outside -acme-domain")
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("ACME directory received %d requests, want 0 with a cached certificate", n)
+	}
+}
+
+// TestACMEStagingFallback 申请证书失败时 staging 模式改用自签名证书且不写入缓存，非 staging 模式握手失败
+func TestACMEStagingFallback(t *testing.T) {
+	directory, hits := startFakeACME(t)
+	for _, staging := range []bool{true, false} {
+		t.Run(fmt.Sprintf("staging=%v", staging), func(t *testing.T) {
+			cacheDir := t.TempDir()
+			a, err := newACME(acmeOptions{domains: []string{"EchPlus.test."}, cacheDir: cacheDir, staging: staging, directory: directory})
+			if err != nil {
+				t.Fatalf("newACME: %v", err)
+			}
+			before := hits.Load()
+			conn, err := tls.Dial("tcp", serveACME(t, a), &tls.Config{ServerName: "echplus.test", InsecureSkipVerify: true})
+			if hits.Load() == before {
+				t.Error("ACME directory not contacted")
+			}
+			if !staging {
+				if err == nil {
+					conn.Close()
+					t.Fatal("handshake succeeded without a certificate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			defer conn.Close()
+			leaf := conn.ConnectionState().PeerCertificates[0]
+			if err := leaf.VerifyHostname("echplus.test"); err != nil {
+				t.Fatalf("fallback certificate: %v", err)
+			}
+			if err := leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature); err != nil {
+				t.Fatalf("fallback certificate is not self-signed: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(cacheDir, "echplus.test")); !os.IsNotExist(err) {
+				t.Fatalf("fallback certificate written to the cache: %v", err)
+			}
+		})
+	}
+}
+
+// TestHTTP2WebSocket 客户端经 HTTP/2 扩展 CONNECT 建立隧道，wss:// 协商 h2，ws:// 使用 h2c。
+// Go 的 HTTP/2 服务端只在启动时读取 GODEBUG，未设置 http2xconnect=1 时在子进程中重新运行本测试
+func TestHTTP2WebSocket(t *testing.T) {
+	if !h2xconnectEnabled(os.Getenv("GODEBUG")) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHTTP2WebSocket$", "-test.v", "-test.count=1")
+		cmd.Env = append(os.Environ(), "GODEBUG="+strings.TrimPrefix(os.Getenv("GODEBUG")+",http2xconnect=1", ","))
+		out, err := cmd.CombinedOutput()
+		if err != nil || !bytes.Contains(out, []byte("--- PASS: TestHTTP2WebSocket")) {
+			t.Fatalf("subprocess with GODEBUG=http2xconnect=1 failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	echoAddr := startEchoServer(t)
+	var streams atomic.Int32
+	enableH2 := func(srv *httptest.Server) {
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isExtendedConnect(r) {
+				streams.Add(1)
+			}
+			handler(w, r)
+		})
+		srv.Config.Protocols = new(http.Protocols)
+		srv.Config.Protocols.SetHTTP1(true)
+		srv.Config.Protocols.SetHTTP2(true)
+		srv.Config.Protocols.SetUnencryptedHTTP2(true)
+		if srv.TLS != nil {
+			srv.TLS.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	chain, _, ca := testCertChain(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	h2cAddr := serveTunnel(t, echoAddr, nil, enableH2)
+	tlsAddr := serveTunnel(t, echoAddr, &chain, enableH2)
+
+	cases := []struct {
+		name       string
+		serverAddr string
+		resume     bool
+		idle       time.Duration // 收发前空闲的时间，期间隧道只有 ping/pong
+	}{
+		{"h2c", "ws://" + h2cAddr + "/", false, 0},
+		{"h2 over TLS", "wss://" + tlsAddr + "/", false, 0},
+		{"h2c resumable", "ws://" + h2cAddr + "/", true, 0},
+		{"h2c keepalive", "ws://" + h2cAddr + "/", false, time.Second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := clientConfig(t, h2cAddr, testToken)
+			cfg.ServerAddr = tc.serverAddr
+			cfg.RootCAs = roots
+			cfg.HTTP2WebSocket = true
+			if tc.resume {
+				cfg.ResumeGrace = 5 * time.Second
+			}
+			if tc.idle > 0 {
+				cfg.PingInterval, cfg.PongTimeout = 100*time.Millisecond, 300*time.Millisecond
+			}
+			client := startProxyServer(t, cfg)
+			before := streams.Load()
+			conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget)
+			if err != nil {
+				t.Fatalf("dial via SOCKS5: %v (upstream: %s)", err, client.GetUpstreamStatus().LastError)
+			}
+			defer conn.Close()
+			time.Sleep(tc.idle)
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			payload := make([]byte, 1<<20)
+			rand.Read(payload)
+			echoLarge(t, conn, payload)
+			if streams.Load() == before {
+				t.Fatal("tunnel did not use an HTTP/2 extended CONNECT stream")
+			}
+			if id := client.GetUpstreamStatus().Headers["X-Session-ID"]; id == "" {
+				t.Fatalf("X-Session-ID not passed through the HTTP/2 response: %v", client.GetUpstreamStatus().Headers)
+			}
+		})
+	}
+
+	t.Run("server without h2", func(t *testing.T) {
+		cfg := clientConfig(t, startTunnelServer(t, echoAddr), testToken)
+		cfg.HTTP2WebSocket = true
+		client := startProxyServer(t, cfg)
+		if conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget); err == nil {
+			conn.Close()
+			t.Fatal("tunnel established over HTTP/2 to a server without h2c")
+		}
+	})
+	t.Run("bad token", func(t *testing.T) {
+		cfg := clientConfig(t, h2cAddr, "wrong-token")
+		cfg.HTTP2WebSocket = true
+		client := startProxyServer(t, cfg)
+		if conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget); err == nil {
+			conn.Close()
+			t.Fatal("tunnel established with a bad token")
+		}
+		if status := client.GetUpstreamStatus(); !strings.Contains(status.LastError, "bad handshake") {
+			t.Fatalf("last error = %q, want a rejected handshake", status.LastError)
+		}
+	})
+}
+
+func TestTunnelRejectsBadToken(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+	proxyAddr := startClient(t, serverAddr, "wrong-token")
+
+	conn, err := dialSOCKS5(t, proxyAddr, remoteTarget)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected SOCKS5 connect to fail with a bad token")
+	}
+}
+
+// TestUpdateToken 服务端轮换令牌后 UpdateToken 先验证新令牌再生效：已建立的隧道不受影响，
+// 之后的隧道使用新令牌；服务端拒绝的令牌不生效，也不把服务端标记为配置错误
+func TestUpdateToken(t *testing.T) {
+	var accepted atomic.Value
+	accepted.Store("old-token")
+	var seen sync.Map
+	echoAddr := startEchoServer(t)
+	serverAddr := serveTunnel(t, echoAddr, nil, func(srv *httptest.Server) {
+		// 按 accepted 校验令牌后改写为服务端配置的 testToken，测试中轮换令牌无需修改 authToken
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if protocols := websocket.Subprotocols(r); len(protocols) > 0 {
+				seen.Store(protocols[0], true)
+				if protocols[0] != accepted.Load().(string) {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				protocols[0] = testToken
+				r.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+			}
+			handler(w, r)
+		})
+	})
+	client := startProxyServer(t, clientConfig(t, serverAddr, "old-token"))
+	proxyAddr := client.Addr().String()
+
+	inFlight := openTunnel(t, proxyAddr, remoteTarget)
+	echoLarge(t, inFlight, []byte("before rotation"))
+
+	if err := client.UpdateToken("bad token"); err == nil {
+		t.Fatal("expected token with a space to be rejected")
+	}
+	if err := client.UpdateToken("wrong-token"); !errors.Is(err, core.ErrTokenRejected) {
+		t.Fatalf("UpdateToken(wrong-token) = %v, want ErrTokenRejected", err)
+	}
+	if got := client.GetConfig().Token; got != "old-token" {
+		t.Fatalf("token after rejected update = %q, want old-token", got)
+	}
+	if _, ok := seen.Load("wrong-token"); !ok {
+		t.Fatal("rejected token was not probed")
+	}
+	if status := client.GetUpstreamStatus(); status.Misconfigured {
+		t.Fatalf("rejected probe marked server misconfigured: %+v", status)
+	}
+
+	// 服务端轮换令牌：旧令牌不再能建立新隧道，已建立的隧道继续转发
+	accepted.Store("new-token")
+	if err := client.UpdateToken("new-token"); err != nil {
+		t.Fatalf("UpdateToken(new-token): %v", err)
+	}
+	if got := client.GetConfig().Token; got != "new-token" {
+		t.Fatalf("token after update = %q, want new-token", got)
+	}
+	echoLarge(t, inFlight, []byte("after rotation"))
+
+	seen.Delete("new-token")
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+	echoLarge(t, conn, []byte("new tunnel"))
+	if _, ok := seen.Load("new-token"); !ok {
+		t.Fatal("new tunnel did not use the new token")
+	}
+
+	// 未运行时只保存令牌
+	stopped := core.NewProxyServer(clientConfig(t, serverAddr, "old-token"))
+	if err := stopped.UpdateToken("offline-token"); err != nil {
+		t.Fatalf("UpdateToken on stopped server: %v", err)
+	}
+	if got := stopped.GetConfig().Token; got != "offline-token" {
+		t.Fatalf("token on stopped server = %q, want offline-token", got)
+	}
+}
+
+// TestConnectionCheck core.TestConnection 不启动代理即可验证节点：连接成功时返回耗时，
+// 令牌错误、端口无人监听或未设置服务端地址时返回错误
+func TestConnectionCheck(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	ctx := context.Background()
+
+	latency, err := core.TestConnection(ctx, clientConfig(t, serverAddr, testToken))
+	if err != nil || latency <= 0 {
+		t.Fatalf("TestConnection = %v, %v, want positive latency", latency, err)
+	}
+	if _, err := core.TestConnection(ctx, clientConfig(t, serverAddr, "wrong-token")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("TestConnection with wrong token = %v, want 401 error", err)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+	cfg := clientConfig(t, closedAddr, testToken)
+	if _, err := core.TestConnection(ctx, cfg); err == nil {
+		t.Fatal("TestConnection to a closed port succeeded")
+	}
+
+	cfg.ServerAddr = ""
+	if _, err := core.TestConnection(ctx, cfg); err == nil {
+		t.Fatal("TestConnection without ServerAddr succeeded")
+	}
+}
+
+// TestDialRetry 建立隧道遇到 5xx 时按退避重试直到成功，401 和 DialRetries 小于 0 时不重试，
+// 连接被拒绝时重试前等待退避时间
+func TestDialRetry(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	var attempts, failures atomic.Int32
+	serverAddr := serveTunnel(t, echoAddr, nil, func(srv *httptest.Server) {
+		next := srv.Config.Handler
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			if failures.Load() > 0 {
+				failures.Add(-1)
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	dial := func(t *testing.T, cfg core.Config) error {
+		t.Helper()
+		conn, err := dialSOCKS5(t, startClientWithConfig(t, cfg), remoteTarget)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		echoLarge(t, conn, []byte("retry"))
+		return nil
+	}
+
+	t.Run("retries 5xx", func(t *testing.T) {
+		attempts.Store(0)
+		failures.Store(2)
+		cfg := clientConfig(t, serverAddr, testToken)
+		cfg.DialRetries, cfg.DialRetryDelay = 2, 10*time.Millisecond
+		if err := dial(t, cfg); err != nil {
+			t.Fatalf("connect after transient failures: %v", err)
+		}
+		if got := attempts.Load(); got != 3 {
+			t.Fatalf("attempts = %d, want 3", got)
+		}
+	})
+
+	t.Run("gives up after retries", func(t *testing.T) {
+		attempts.Store(0)
+		failures.Store(10)
+		cfg := clientConfig(t, serverAddr, testToken)
+		cfg.DialRetries, cfg.DialRetryDelay = 1, 10*time.Millisecond
+		if err := dial(t, cfg); err == nil {
+			t.Fatal("connected although every attempt failed")
+		}
+		if got := attempts.Load(); got != 2 {
+			t.Fatalf("attempts = %d, want 2", got)
+		}
+	})
+
+	t.Run("retries disabled", func(t *testing.T) {
+		attempts.Store(0)
+		failures.Store(1)
+		cfg := clientConfig(t, serverAddr, testToken)
+		cfg.DialRetries = -1
+		if err := dial(t, cfg); err == nil {
+			t.Fatal("connected although retries are disabled")
+		}
+		if got := attempts.Load(); got != 1 {
+			t.Fatalf("attempts = %d, want 1", got)
+		}
+	})
+
+	t.Run("unauthorized fails fast", func(t *testing.T) {
+		attempts.Store(0)
+		failures.Store(0)
+		cfg := clientConfig(t, serverAddr, "wrong-token")
+		cfg.DialRetries, cfg.DialRetryDelay = 3, 10*time.Millisecond
+		if err := dial(t, cfg); err == nil {
+			t.Fatal("connected with a bad token")
+		}
+		if got := attempts.Load(); got != 1 {
+			t.Fatalf("attempts = %d, want 1", got)
+		}
+	})
+
+	t.Run("connection refused backs off", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closedAddr := ln.Addr().String()
+		ln.Close()
+		cfg := clientConfig(t, closedAddr, testToken)
+		cfg.DialRetries, cfg.DialRetryDelay = 2, 100*time.Millisecond
+		start := time.Now()
+		if err := dial(t, cfg); err == nil {
+			t.Fatal("connected to a closed port")
+		}
+		// 两次重试至少等待 50ms + 100ms（一半的退避时间加抖动）
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Fatalf("failed after %v, want backoff of at least 150ms", elapsed)
+		}
+	})
+}
+
+// TestUpstreamHealth 建立隧道的失败按分类影响上游健康：网络、TLS、HTTP 状态码错误扣分，
+// 令牌被拒绝标记为配置错误且修改令牌前不再连接，ECH 被拒绝时刷新配置后免费重试一次且不扣分
+func TestUpstreamHealth(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	var attempts, failures atomic.Int32
+	serverAddr := serveTunnel(t, echoAddr, nil, func(srv *httptest.Server) {
+		next := srv.Config.Handler
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			if failures.Load() > 0 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	dial := func(t *testing.T, proxyAddr string) error {
+		t.Helper()
+		conn, err := dialSOCKS5(t, proxyAddr, remoteTarget)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		echoLarge(t, conn, []byte("health"))
+		return nil
+	}
+	expect := func(t *testing.T, client *core.ProxyServer, class string, penalty int, misconfigured bool) {
+		t.Helper()
+		status := client.GetUpstreamStatus()
+		if status.FailureClass != class || status.Penalty != penalty || status.Misconfigured != misconfigured {
+			t.Fatalf("status = {class %q, penalty %d, misconfigured %v} (%s), want {%q, %d, %v}",
+				status.FailureClass, status.Penalty, status.Misconfigured, status.LastError, class, penalty, misconfigured)
+		}
+	}
+
+	t.Run("http status", func(t *testing.T) {
+		failures.Store(1)
+		t.Cleanup(func() { failures.Store(0) })
+		cfg := clientConfig(t, serverAddr, testToken)
+		cfg.DialRetries = -1
+		client := startProxyServer(t, cfg)
+		for i := 1; i <= 2; i++ {
+			if err := dial(t, client.Addr().String()); err == nil {
+				t.Fatal("connected although the server returned 503")
+			}
+			expect(t, client, core.UpstreamFailureHTTPStatus, i, false)
+		}
+		if got := client.GetUpstreamStatus().LastError; !strings.Contains(got, "HTTP 503") {
+			t.Fatalf("last error %q does not name the status code", got)
+		}
+		failures.Store(0)
+		if err := dial(t, client.Addr().String()); err != nil {
+			t.Fatalf("connect after recovery: %v", err)
+		}
+		expect(t, client, "", 0, false)
+	})
+
+	t.Run("network", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closedAddr := ln.Addr().String()
+		ln.Close()
+		cfg := clientConfig(t, closedAddr, testToken)
+		cfg.DialRetries = -1
+		client := startProxyServer(t, cfg)
+		if err := dial(t, client.Addr().String()); err == nil {
+			t.Fatal("connected to a closed port")
+		}
+		expect(t, client, core.UpstreamFailureNetwork, 1, false)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		chain, _, _ := testCertChain(t)
+		cfg := clientConfig(t, startTLSTunnelServer(t, echoAddr, chain), testToken)
+		cfg.ServerAddr = strings.Replace(cfg.ServerAddr, "ws://", "wss://", 1)
+		cfg.DialRetries = 2
+		client := startProxyServer(t, cfg)
+		if err := dial(t, client.Addr().String()); err == nil {
+			t.Fatal("connected to a server with an untrusted certificate")
+		}
+		expect(t, client, core.UpstreamFailureTLS, 1, false)
+	})
+
+	t.Run("token rejected", func(t *testing.T) {
+		attempts.Store(0)
+		cfg := clientConfig(t, serverAddr, "wrong-token")
+		cfg.DialRetries, cfg.DialRetryDelay = 3, 10*time.Millisecond
+		client := startProxyServer(t, cfg)
+		for range 3 {
+			if err := dial(t, client.Addr().String()); err == nil {
+				t.Fatal("connected with a bad token")
+			}
+		}
+		if got := attempts.Load(); got != 1 {
+			t.Fatalf("attempts = %d, want 1: a rejected token must not be retried", got)
+		}
+		expect(t, client, core.UpstreamFailureUnauthorized, 0, true)
+
+		// 配置未变时保持标记
+		if err := client.Reload(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := dial(t, client.Addr().String()); err == nil || attempts.Load() != 1 {
+			t.Fatalf("dialed again with the rejected token (err %v, attempts %d)", err, attempts.Load())
+		}
+
+		cfg.Token = testToken
+		if err := client.Reload(cfg); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, client, core.UpstreamFailureUnauthorized, 0, false)
+		if err := dial(t, client.Addr().String()); err != nil {
+			t.Fatalf("connect after fixing the token: %v", err)
+		}
+		expect(t, client, "", 0, false)
+	})
+
+	t.Run("ech rejected", func(t *testing.T) {
+		chain, _, ca := testCertChain(t)
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		var handshakes atomic.Int32
+		tlsAddr := serveTunnel(t, echoAddr, &chain, func(srv *httptest.Server) {
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					handshakes.Add(1)
+				}
+			}
+		})
+		var lookups atomic.Int32
+		doh := startECHDoH(t, testECHConfigList(t, "public.echplus.test"), &lookups)
+
+		cfg := clientConfig(t, tlsAddr, testToken)
+		cfg.ServerAddr = "wss://" + tlsAddr + "/"
+		cfg.RootCAs = roots
+		cfg.DNSServer, cfg.ECHDomain = doh, "echplus.test"
+		cfg.DialRetries = -1
+		client := startProxyServer(t, cfg)
+		if got := lookups.Load(); got != 1 {
+			t.Fatalf("ECH lookups at start = %d, want 1", got)
+		}
+		// 测试服务端不支持 ECH，每次都会拒绝：立即刷新并重试一次，即使禁用了重试
+		if err := dial(t, client.Addr().String()); err == nil {
+			t.Fatal("connected although the server rejects ECH")
+		}
+		if l, h := lookups.Load(), handshakes.Load(); l != 2 || h != 2 {
+			t.Fatalf("ECH lookups = %d, handshakes = %d, want 2 and 2", l, h)
+		}
+		expect(t, client, core.UpstreamFailureECHRejected, 0, false)
+	})
+}
+
+// TestServerFailover 配置多个服务端时依次故障转移，之后优先使用最近成功的服务端，
+// Reload 修改服务端列表时清空健康状态
+func TestServerFailover(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	type upstream struct {
+		addr     string
+		attempts atomic.Int32
+		down     atomic.Bool
+	}
+	start := func() *upstream {
+		u := &upstream{}
+		u.addr = serveTunnel(t, echoAddr, nil, func(srv *httptest.Server) {
+			next := srv.Config.Handler
+			srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				u.attempts.Add(1)
+				if u.down.Load() {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		return u
+	}
+	a, b := start(), start()
+	a.down.Store(true)
+
+	cfg := clientConfig(t, a.addr, testToken)
+	cfg.ServerAddr = "ws://" + a.addr + "/, ws://" + b.addr + "/"
+	cfg.DialRetries = -1
+	client := startProxyServer(t, cfg)
+	dial := func(t *testing.T) {
+		t.Helper()
+		conn := openTunnel(t, client.Addr().String(), remoteTarget)
+		echoLarge(t, conn, []byte("failover"))
+	}
+	expect := func(t *testing.T, current string, attemptsA, attemptsB int32, penaltyA, penaltyB int) {
+		t.Helper()
+		status := client.GetUpstreamStatus()
+		if status.ServerAddr != "ws://"+current+"/" {
+			t.Fatalf("current server = %q, want %s", status.ServerAddr, current)
+		}
+		if len(status.Servers) != 2 {
+			t.Fatalf("servers = %+v, want 2 entries", status.Servers)
+		}
+		if a.attempts.Load() != attemptsA || b.attempts.Load() != attemptsB {
+			t.Fatalf("attempts = %d, %d, want %d, %d", a.attempts.Load(), b.attempts.Load(), attemptsA, attemptsB)
+		}
+		if status.Servers[0].Penalty != penaltyA || status.Servers[1].Penalty != penaltyB {
+			t.Fatalf("penalties = %d, %d, want %d, %d", status.Servers[0].Penalty, status.Servers[1].Penalty, penaltyA, penaltyB)
+		}
+	}
+
+	// 第一个服务端不可用时转移到第二个，之后直接使用第二个
+	dial(t)
+	expect(t, b.addr, 1, 1, 1, 0)
+	if got := client.GetUpstreamStatus().Servers[0].FailureClass; got != core.UpstreamFailureHTTPStatus {
+		t.Fatalf("failure class of the first server = %q, want %q", got, core.UpstreamFailureHTTPStatus)
+	}
+	dial(t)
+	expect(t, b.addr, 1, 2, 1, 0)
+
+	// 当前服务端也不可用时切回恢复的第一个
+	a.down.Store(false)
+	b.down.Store(true)
+	dial(t)
+	expect(t, a.addr, 2, 3, 0, 1)
+
+	// 全部不可用时连接失败，两个服务端各尝试一次
+	a.down.Store(true)
+	if conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget); err == nil {
+		conn.Close()
+		t.Fatal("connected although every server is down")
+	}
+	expect(t, a.addr, 3, 4, 1, 2)
+
+	// 修改服务端列表后健康状态清零，按新顺序从第一个开始
+	a.down.Store(false)
+	b.down.Store(false)
+	cfg.ServerAddr = "ws://" + b.addr + "/,ws://" + a.addr + "/"
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	status := client.GetUpstreamStatus()
+	if status.ServerAddr != "ws://"+b.addr+"/" || status.Servers[0].Penalty != 0 || status.Servers[1].Penalty != 0 {
+		t.Fatalf("status after reload = %+v, want fresh health starting at %s", status, b.addr)
+	}
+	dial(t)
+	if a.attempts.Load() != 3 || b.attempts.Load() != 5 {
+		t.Fatalf("attempts after reload = %d, %d, want 3, 5", a.attempts.Load(), b.attempts.Load())
+	}
+
+	cfg.ServerAddr = "ws://" + a.addr + "/,wss://" + b.addr + "/"
+	if err := client.Reload(cfg); err == nil {
+		t.Fatal("Reload accepted servers with mixed ws:// and wss://")
+	}
+}
+
+// TestBalanceStrategy 按 BalanceStrategy 在多个服务端之间分配新隧道，Reload 切换方式不重新监听，流量按服务端分别统计
+func TestBalanceStrategy(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	type upstream struct {
+		addr     string
+		attempts atomic.Int32
+		down     atomic.Bool
+	}
+	// 各服务端处理升级请求前的延迟不同，b 最快
+	start := func(delay time.Duration) *upstream {
+		u := &upstream{}
+		u.addr = serveTunnel(t, echoAddr, nil, func(srv *httptest.Server) {
+			next := srv.Config.Handler
+			srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				u.attempts.Add(1)
+				time.Sleep(delay)
+				if u.down.Load() {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		return u
+	}
+	servers := []*upstream{start(40 * time.Millisecond), start(0), start(20 * time.Millisecond)}
+	a, b, c := servers[0], servers[1], servers[2]
+
+	cfg := clientConfig(t, a.addr, testToken)
+	cfg.ServerAddr = "ws://" + a.addr + "/, ws://" + b.addr + "/, ws://" + c.addr + "/"
+	cfg.DialRetries = -1
+	client := startProxyServer(t, cfg)
+	listenAddr := client.Addr().String()
+	payload := []byte("balance")
+	dial := func(t *testing.T, n int) {
+		t.Helper()
+		for range n {
+			conn := openTunnel(t, client.Addr().String(), remoteTarget)
+			echoLarge(t, conn, payload)
+			conn.Close()
+		}
+	}
+	expect := func(t *testing.T, want ...int32) {
+		t.Helper()
+		for i, u := range servers {
+			if got := u.attempts.Load(); got != want[i] {
+				t.Fatalf("attempts = %d, %d, %d, want %v", a.attempts.Load(), b.attempts.Load(), c.attempts.Load(), want)
+			}
+		}
+	}
+	reload := func(t *testing.T, strategy core.BalanceStrategy) {
+		t.Helper()
+		cfg.BalanceStrategy = strategy
+		if err := client.Reload(cfg); err != nil {
+			t.Fatalf("reload %s: %v", strategy, err)
+		}
+		if got := client.Addr().String(); got != listenAddr {
+			t.Fatalf("listener changed from %s to %s", listenAddr, got)
+		}
+	}
+
+	// 默认故障转移：一直使用第一个服务端
+	dial(t, 3)
+	expect(t, 3, 0, 0)
+
+	// 轮流使用：每个服务端各分到两条
+	reload(t, core.BalanceRoundRobin)
+	dial(t, 6)
+	expect(t, 5, 2, 2)
+
+	// 各服务端的流量分别统计，隧道数与成功的连接数一致
+	var stats []core.ServerTraffic
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if stats = client.GetTrafficStats().GetServerStats(); len(stats) == 3 && stats[0].Download+stats[1].Download+stats[2].Download == 9*int64(len(payload)) {
+			break
+		}
+	}
+	for _, st := range stats {
+		i := slices.IndexFunc(servers, func(u *upstream) bool { return st.Server == "ws://"+u.addr+"/" })
+		if i < 0 || st.Connections != int64(servers[i].attempts.Load()) || st.Upload != st.Connections*int64(len(payload)) {
+			t.Fatalf("server stats = %+v, attempts = %d, %d, %d", stats, a.attempts.Load(), b.attempts.Load(), c.attempts.Load())
+		}
+	}
+	if len(stats) != 3 {
+		t.Fatalf("server stats = %+v, want 3 servers", stats)
+	}
+
+	// 延迟最低：均使用最快的 b，b 不可用时改用次快的 c
+	reload(t, core.BalanceLatency)
+	for _, h := range client.GetUpstreamStatus().Servers {
+		if h.Latency <= 0 {
+			t.Fatalf("latency of %s not measured: %+v", h.Addr, h)
+		}
+	}
+	dial(t, 3)
+	expect(t, 5, 5, 2)
+	b.down.Store(true)
+	dial(t, 2)
+	expect(t, 5, 6, 4)
+
+	t.Run("invalid", func(t *testing.T) {
+		cfg := cfg
+		cfg.BalanceStrategy = "random"
+		if err := client.Reload(cfg); err == nil || !strings.Contains(err.Error(), "random") {
+			t.Fatalf("reload with an unknown strategy: %v", err)
+		}
+	})
+}
+
+// TestECHPublicName 设置 ECHPublicName 时校验获取到的 ECH 配置中的公开名称，不一致或配置格式错误时拒绝使用
+func TestECHPublicName(t *testing.T) {
+	var lookups atomic.Int32
+	echList := testECHConfigList(t, "public.echplus.test")
+	start := func(t *testing.T, list []byte, publicName string) (*core.ProxyServer, error) {
+		t.Helper()
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.ServerAddr = "wss://127.0.0.1:1/"
+		cfg.DNSServer, cfg.ECHDomain = startECHDoH(t, list, &lookups), "echplus.test"
+		cfg.ECHPublicName = publicName
+		cfg.RequireECH = true
+		client := core.NewProxyServer(cfg)
+		err := client.Start()
+		if err == nil {
+			t.Cleanup(func() { client.Stop() })
+		}
+		return client, err
+	}
+
+	t.Run("match", func(t *testing.T) {
+		if _, err := start(t, echList, "PUBLIC.echplus.test."); err != nil {
+			t.Fatalf("start with matching public name: %v", err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		_, err := start(t, echList, "ech.example.com")
+		if err == nil || !strings.Contains(err.Error(), "public.echplus.test") || !strings.Contains(err.Error(), "ech.example.com") {
+			t.Fatalf("start error = %v, want a mismatch naming both public names", err)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		if _, err := start(t, echList[:len(echList)-3], "public.echplus.test"); err == nil {
+			t.Fatal("started with a truncated ECH config")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		client, err := start(t, echList, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := client.GetConfig()
+		cfg.ECHPublicName = "ech.example.com"
+		if err := client.Reload(cfg); err == nil {
+			t.Fatal("Reload accepted a mismatching public name")
+		}
+		if got := client.GetConfig().ECHPublicName; got != "" {
+			t.Fatalf("ECHPublicName after failed reload = %q, want the previous value", got)
+		}
+	})
+}
+
+// TestECHDomainServer ECHDomain 为 ECHDomainServer 时各服务端查询自身主机名（非 443 端口按 RFC 9460 加前缀），
+// 各域名的配置分别缓存、刷新，服务端变化后丢弃不再使用的域名
+func TestECHDomainServer(t *testing.T) {
+	var mu sync.Mutex
+	lookups := map[string]int{}
+	lists := map[string][]byte{
+		"a.echplus.test":              testECHConfigList(t, "public-a.echplus.test"),
+		"_8443._https.b.echplus.test": testECHConfigList(t, "public-b.echplus.test"),
+	}
+	dns := startECHDoHFunc(t, func(name string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups[name]++
+		return lists[name]
+	})
+	snapshot := func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(lookups)
+	}
+
+	cfg := clientConfig(t, "127.0.0.1:1", testToken)
+	cfg.ServerAddr = "wss://a.echplus.test:443/,wss://b.echplus.test:8443/"
+	cfg.DNSServer, cfg.ECHDomain = dns, core.ECHDomainServer
+	cfg.RequireECH = true
+	client := startProxyServer(t, cfg)
+	if got, want := snapshot(), map[string]int{"a.echplus.test": 1, "_8443._https.b.echplus.test": 1}; !maps.Equal(got, want) {
+		t.Fatalf("lookups after start = %v, want %v", got, want)
+	}
+	explain := client.ExplainHost("example.com")
+	for _, want := range []string{"(a.echplus.test)", "public-a.echplus.test", "(_8443._https.b.echplus.test)", "public-b.echplus.test"} {
+		if !strings.Contains(explain, want) {
+			t.Errorf("ExplainHost does not mention %q:\n%s", want, explain)
+		}
+	}
+	if got, want := client.GetInternals().ECHConfigSize, len(lists["a.echplus.test"])*2; got != want {
+		t.Errorf("ECHConfigSize = %d, want %d", got, want)
+	}
+
+	if _, err := client.FlushCaches(); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshot(); got["a.echplus.test"] != 2 || got["_8443._https.b.echplus.test"] != 2 {
+		t.Fatalf("lookups after FlushCaches = %v, want each domain refreshed once", got)
+	}
+
+	cfg = client.GetConfig()
+	cfg.ServerAddr = "wss://a.echplus.test:443/"
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := client.GetInternals().ECHConfigSize, len(lists["a.echplus.test"]); got != want {
+		t.Errorf("ECHConfigSize after dropping a server = %d, want %d", got, want)
+	}
+
+	t.Run("missing record", func(t *testing.T) {
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.ServerAddr = "wss://a.echplus.test:443/,wss://c.echplus.test:443/"
+		cfg.DNSServer, cfg.ECHDomain = dns, core.ECHDomainServer
+		cfg.RequireECH = true
+		client := core.NewProxyServer(cfg)
+		err := client.Start()
+		if err == nil {
+			client.Stop()
+			t.Fatal("started without an ECH config for c.echplus.test")
+		}
+		if !strings.Contains(err.Error(), "c.echplus.test") {
+			t.Fatalf("start error = %v, want it to name the failing domain", err)
+		}
+	})
+}
+
+// TestECHMissingConfig 区分 ECH 域名没有 HTTPS 记录和记录中没有 ech 参数；
+// 刷新时记录暂时没有 ech 参数（密钥轮换中）则保留之前加载的配置
+func TestECHMissingConfig(t *testing.T) {
+	echList := testECHConfigList(t, "public.echplus.test")
+	var rotating atomic.Bool
+	dns := startECHDoHFunc(t, func(name string) []byte {
+		switch {
+		case name == "nodata.echplus.test":
+			return nil
+		case name == "noech.echplus.test", rotating.Load():
+			return []byte{}
+		}
+		return echList
+	})
+	start := func(domain string) (*core.ProxyServer, error) {
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.ServerAddr = "wss://127.0.0.1:1/"
+		cfg.DNSServer, cfg.ECHDomain = dns, domain
+		cfg.RequireECH = true
+		client := core.NewProxyServer(cfg)
+		err := client.Start()
+		if err == nil {
+			t.Cleanup(func() { client.Stop() })
+		}
+		return client, err
+	}
+
+	for domain, want := range map[string]string{
+		"nodata.echplus.test": "没有 HTTPS 记录",
+		"noech.echplus.test":  "没有 ECH 参数",
+	} {
+		if _, err := start(domain); err == nil || !strings.Contains(err.Error(), domain) || !strings.Contains(err.Error(), want) {
+			t.Errorf("start with ECHDomain %s: %v, want an error saying %q", domain, err, want)
+		}
+	}
+
+	client, err := start("echplus.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotating.Store(true)
+	if _, err := client.FlushCaches(); err == nil || !strings.Contains(err.Error(), "没有 ECH 参数") {
+		t.Fatalf("FlushCaches during rotation: %v, want the missing ECH parameter reported", err)
+	}
+	explain := client.ExplainHost("example.com")
+	if !strings.Contains(explain, fmt.Sprintf("ECH 配置: %d 字节", len(echList))) || !strings.Contains(explain, "最近一次加载失败") {
+		t.Fatalf("ECH config not kept during rotation:\n%s", explain)
+	}
+}
+
+// testECHConfigList 生成公开名称为 publicName 的 ECHConfigList (draft-ietf-tls-esni，DHKEM(X25519) + AES-128-GCM)
+func testECHConfigList(t testing.TB, publicName string) []byte {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.PublicKey().Bytes()
+	contents := []byte{1} // config_id
+	contents = binary.BigEndian.AppendUint16(contents, 0x0020)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = binary.BigEndian.AppendUint16(contents, 4)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // HKDF-SHA256
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // AES-128-GCM
+	contents = append(contents, 0, byte(len(publicName)))      // maximum_name_length, public_name
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // extensions
+
+	config := binary.BigEndian.AppendUint16(nil, 0xfe0d)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...)
+}
+
+// startECHDoH 启动返回 echList 的 DoH 服务端，每次查询 lookups 加 1，返回 DNSServer 地址
+func startECHDoH(t testing.TB, echList []byte, lookups *atomic.Int32) string {
+	t.Helper()
+	return startECHDoHFunc(t, func(string) []byte {
+		lookups.Add(1)
+		return echList
+	})
+}
+
+// startECHDoHFunc 启动按查询名称应答 HTTPS 记录的 DoH 服务，ECH 配置由 echList 按名称返回。
+// echList 返回 nil 时应答没有记录 (NODATA)，返回空切片时 HTTPS 记录中没有 ech 参数
+func startECHDoHFunc(t testing.TB, echList func(name string) []byte) string {
+	t.Helper()
+	return startHTTPSDoH(t, func(name string) []byte {
+		list := echList(name)
+		if list == nil {
+			return nil
+		}
+		rdata := []byte{0, 1, 0} // SvcPriority 1，TargetName "."
+		if len(list) > 0 {
+			rdata = binary.BigEndian.AppendUint16(rdata, 5) // ech
+			rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(list)))
+			rdata = append(rdata, list...)
+		} else {
+			rdata = append(rdata, 0, 1, 0, 3, 2, 'h', '2') // 只有 alpn
+		}
+		return rdata
+	})
+}
+
+// startHTTPSDoH 启动按查询名称应答一条 HTTPS 记录的 DoH 服务，记录的 RDATA 由 rdata 按名称返回，返回 nil 时应答没有记录 (NODATA)
+func startHTTPSDoH(t testing.TB, rdata func(name string) []byte) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(query) < 12 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		var labels []string
+		for off := 12; off < len(query) && query[off] != 0; off += 1 + int(query[off]) {
+			labels = append(labels, string(query[off+1:min(len(query), off+1+int(query[off]))]))
+		}
+		data := rdata(strings.Join(labels, "."))
+		resp := []byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}
+		resp = append(resp, query[12:]...)
+		if data != nil {
+			resp[7] = 1                                               // ANCOUNT
+			resp = append(resp, 0xc0, 0x0c, 0, 65, 0, 1, 0, 0, 0, 60) // 名称指针、HTTPS、IN、TTL
+			resp = binary.BigEndian.AppendUint16(resp, uint16(len(data)))
+			resp = append(resp, data...)
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/dns-query"
+}
+
+// TestExplainHost 诊断文本按连接 ID 汇总分流决策、连接记录和日志
+func TestExplainHost(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	var down atomic.Bool
+	down.Store(true)
+	addr := serveTunnel(t, echoAddr, nil, func(srv *httptest.Server) {
+		next := srv.Config.Handler
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down.Load() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	cfg := clientConfig(t, addr, testToken)
+	cfg.DialRetries = -1
+	client := startProxyServer(t, cfg)
+	host, _, _ := net.SplitHostPort(remoteTarget)
+
+	// 连接记录和失败日志在向客户端返回错误之后写入
+	waitExplain := func(t *testing.T, want ...string) string {
+		t.Helper()
+		var text string
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			text = client.ExplainHost(remoteTarget)
+			if !slices.ContainsFunc(want, func(s string) bool { return !strings.Contains(text, s) }) {
+				return text
+			}
+		}
+		t.Fatalf("explanation missing one of %q:\n%s", want, text)
+		return ""
+	}
+
+	if conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget); err == nil {
+		conn.Close()
+		t.Fatal("connect succeeded while the server is down")
+	}
+	text := waitExplain(t, "通过代理 (全局代理)", "HTTP 503", "失败分类 "+core.UpstreamFailureHTTPStatus, "代理失败")
+
+	decisions, records := client.GetRouteDecisions(), client.GetRecentConnections()
+	if len(decisions) != 1 || len(records) != 1 {
+		t.Fatalf("decisions = %+v, records = %+v, want one each", decisions, records)
+	}
+	id := decisions[0].ConnID
+	if id == 0 || records[0].ConnID != id {
+		t.Fatalf("connection IDs = %d, %d, want the same non-zero ID", id, records[0].ConnID)
+	}
+	if want := fmt.Sprintf("[#%d] [SOCKS5]", id); !strings.Contains(text, want) {
+		t.Fatalf("explanation missing log line %q:\n%s", want, text)
+	}
+	if !strings.Contains(text, "ws://"+addr+"/ (当前) 扣分 1") {
+		t.Fatalf("explanation missing upstream health:\n%s", text)
+	}
+
+	// 恢复后的成功连接列在失败连接之后，记录使用的服务端
+	down.Store(false)
+	conn := openTunnel(t, client.Addr().String(), remoteTarget)
+	echoLarge(t, conn, []byte("explain"))
+	conn.Close()
+	text = waitExplain(t, "最近 2 次连接", "服务端: ws://"+addr+"/", "已断开")
+	if strings.Index(text, fmt.Sprintf("[#%d]", id)) > strings.Index(text, "服务端: ws://") {
+		t.Fatalf("attempts out of order:\n%s", text)
+	}
+
+	if text := client.ExplainHost("unknown.example"); !strings.Contains(text, "没有该主机的连接记录") || strings.Contains(text, host) {
+		t.Fatalf("explanation of an unknown host:\n%s", text)
+	}
+}
+
+// TestServerIPSelection ServerIP 有多个候选地址时测速后使用最快的，当前地址连续失败后改用其他地址
+func TestServerIPSelection(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	addr := startTunnelServer(t, echoAddr)
+	_, port, _ := net.SplitHostPort(addr)
+	// forward 在同一端口的另一个回环地址上转发到服务端，返回的监听关闭后该地址连接被拒绝
+	forward := func(ip string) net.Listener {
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("listen on %s: %v", ip, err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				down, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				up, err := net.Dial("tcp", addr)
+				if err != nil {
+					down.Close()
+					continue
+				}
+				go func() { io.Copy(up, down); up.Close() }()
+				go func() { io.Copy(down, up); down.Close() }()
+			}
+		}()
+		return ln
+	}
+	listeners := map[string]net.Listener{"127.0.0.2": forward("127.0.0.2"), "127.0.0.3": forward("127.0.0.3")}
+
+	// 127.0.0.4 上没有监听，测速失败
+	cfg := clientConfig(t, addr, testToken)
+	cfg.ServerIP = "127.0.0.4, 127.0.0.2, 127.0.0.3"
+	cfg.ServerIPProbeInterval = -1
+	cfg.DialRetries = -1
+	client := startProxyServer(t, cfg)
+	waitStats := func(t *testing.T, ok func([]core.ServerIPStats) bool) []core.ServerIPStats {
+		t.Helper()
+		var stats []core.ServerIPStats
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if stats = client.GetServerIPStats(); ok(stats) {
+				return stats
+			}
+		}
+		t.Fatalf("server IP stats = %+v", stats)
+		return nil
+	}
+	selected := func(stats []core.ServerIPStats) string {
+		for _, st := range stats {
+			if st.Selected {
+				return st.IP
+			}
+		}
+		return ""
+	}
+	dial := func(t *testing.T) error {
+		t.Helper()
+		conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget)
+		if err == nil {
+			echoLarge(t, conn, []byte("server ip"))
+			conn.Close()
+		}
+		return err
+	}
+
+	stats := waitStats(t, func(stats []core.ServerIPStats) bool {
+		return len(stats) == 3 && stats[0].LastError != "" && stats[1].Latency > 0 && stats[2].Latency > 0
+	})
+	if stats[0].IP != "127.0.0.4" || stats[0].Latency != 0 || stats[0].ProbedAt.IsZero() {
+		t.Fatalf("failed candidate = %+v", stats[0])
+	}
+	first := selected(stats)
+	if first != "127.0.0.2" && first != "127.0.0.3" {
+		t.Fatalf("selected %q, want one of the reachable candidates", first)
+	}
+	if err := dial(t); err != nil {
+		t.Fatalf("connect through %s: %v", first, err)
+	}
+
+	// 当前地址连续失败 3 次后改用另一个可用地址
+	listeners[first].Close()
+	for i := range 3 {
+		if err := dial(t); err == nil {
+			t.Fatalf("connect %d through closed %s succeeded", i+1, first)
+		}
+	}
+	if got := selected(client.GetServerIPStats()); got == first || got == "127.0.0.4" || got == "" {
+		t.Fatalf("selected %q after %s failed, want the other reachable candidate", got, first)
+	}
+	if err := dial(t); err != nil {
+		t.Fatalf("connect after switching: %v", err)
+	}
+	// 失败后立即重新测速，关闭的地址测速失败
+	waitStats(t, func(stats []core.ServerIPStats) bool {
+		return slices.ContainsFunc(stats, func(st core.ServerIPStats) bool {
+			return st.IP == first && st.Latency == 0 && st.Failures == 1
+		})
+	})
+
+	// 网段按抽样测速，跳过网络地址和广播地址
+	t.Run("cidr", func(t *testing.T) {
+		cfg := cfg
+		cfg.ServerIP = "127.0.0.0/30"
+		if err := client.Reload(cfg); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+		stats := waitStats(t, func(stats []core.ServerIPStats) bool {
+			return len(stats) == 2 && !stats[0].ProbedAt.IsZero()
+		})
+		if stats[0].IP != "127.0.0.1" || stats[1].IP != "127.0.0.2" {
+			t.Fatalf("sampled %+v, want 127.0.0.1 and 127.0.0.2", stats)
+		}
+		if err := dial(t); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cfg := cfg
+		cfg.ServerIP = "127.0.0.1, 10.0.0.0/33"
+		if err := client.Reload(cfg); err == nil || !strings.Contains(err.Error(), "10.0.0.0/33") {
+			t.Fatalf("reload with an invalid CIDR: %v", err)
+		}
+	})
+}
+
+// TestHTTPProxyRequestBody HTTP 代理请求的请求体随请求头原样转发：chunked 编码分多次到达、
+// 以及超过 10MB 的 Content-Length 请求体都完整到达目标，目标（echo 服务）收到的正是改写后的请求
+func TestHTTPProxyRequestBody(t *testing.T) {
+	addr := startTunnelServer(t, startEchoServer(t))
+	client := startProxyServer(t, clientConfig(t, addr, testToken))
+	// request 发送请求头和请求体的开头，二者一次写入，代理读取请求头时会一并读入请求体的开头
+	request := func(t *testing.T, extraHeader, bodyStart string) (net.Conn, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", client.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		head := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: %s\r\n%s\r\n\r\n", remoteTarget, extraHeader)
+		if _, err := fmt.Fprintf(conn, "POST http://%s/upload HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n%s\r\n\r\n%s",
+			remoteTarget, remoteTarget, extraHeader, bodyStart); err != nil {
+			t.Fatal(err)
+		}
+		return conn, head
+	}
+	readForwarded := func(t *testing.T, conn net.Conn, want string) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read forwarded request: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("forwarded request = %.200q, want %.200q", got, want)
+		}
+	}
+
+	t.Run("chunked", func(t *testing.T) {
+		chunks := []string{"5\r\nhello\r\n", "6\r\n world\r\n", "0\r\n\r\n"}
+		conn, head := request(t, "Transfer-Encoding: chunked", chunks[0])
+		for _, c := range chunks[1:] {
+			// 请求头之后分批到达的块也要转发
+			time.Sleep(20 * time.Millisecond)
+			if _, err := conn.Write([]byte(c)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		readForwarded(t, conn, head+strings.Join(chunks, ""))
+	})
+
+	t.Run("large", func(t *testing.T) {
+		body := make([]byte, 11<<20)
+		crand.Read(body)
+		conn, head := request(t, fmt.Sprintf("Content-Length: %d", len(body)), string(body[:1000]))
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(body[1000:])
+			writeErr <- err
+		}()
+		readForwarded(t, conn, head+string(body))
+		if err := <-writeErr; err != nil {
+			t.Fatalf("write body: %v", err)
+		}
+	})
+}
+
+// TestHTTPProxyKeepAlive 普通 HTTP 代理在同一客户端连接上依次转发多个请求：发往同一目标的请求复用隧道，
+// 目标改变时建立新隧道，Connection: close 结束连接
+func TestHTTPProxyKeepAlive(t *testing.T) {
+	addr := startTunnelServer(t, startEchoServer(t))
+	targets := map[string]string{}
+	for name, target := range map[string]string{"a": "203.0.113.11:80", "b": "203.0.113.12:80"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if r.URL.Path == "/stream" {
+				// 未指定长度并分次刷新，响应使用 chunked 编码
+				fmt.Fprintf(w, "%s %s ", name, r.RemoteAddr)
+				w.(http.Flusher).Flush()
+			}
+			fmt.Fprintf(w, "%s %s %s", name, r.RemoteAddr, body)
+		}))
+		t.Cleanup(srv.Close)
+		targets[target] = srv.Listener.Addr().String()
+	}
+	prevDial := dialRemote
+	t.Cleanup(func() { dialRemote = prevDial })
+	dialRemote = func(network, a string) (net.Conn, error) {
+		if target, ok := targets[a]; ok {
+			a = target
+		}
+		return prevDial(network, a)
+	}
+	client := startProxyServer(t, clientConfig(t, addr, testToken))
+
+	conn, err := net.Dial("tcp", client.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	// roundTrip 发送请求并读取响应体，返回目标名称和目标看到的来源地址
+	roundTrip := func(t *testing.T, request string) (name, remote, rest string) {
+		t.Helper()
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+		fields := strings.SplitN(string(body), " ", 3)
+		if len(fields) != 3 {
+			t.Fatalf("body = %q", body)
+		}
+		return fields[0], fields[1], fields[2]
+	}
+
+	name, first, _ := roundTrip(t, "GET http://203.0.113.11/ HTTP/1.1\r\nHost: 203.0.113.11\r\nProxy-Connection: keep-alive\r\n\r\n")
+	if name != "a" {
+		t.Fatalf("first request reached %q, want a", name)
+	}
+	// 紧接着发送的两个请求一次写入，第二个请求在读取第一个时已进入缓冲区
+	pipelined := "GET http://203.0.113.11/stream HTTP/1.1\r\nHost: 203.0.113.11\r\n\r\n" +
+		"POST http://203.0.113.12/ HTTP/1.1\r\nHost: 203.0.113.12\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+	name, remote, rest := roundTrip(t, pipelined)
+	if name != "a" || remote != first || !strings.HasPrefix(rest, "a "+first) {
+		t.Fatalf("same-host request = %q %q %q, want the tunnel from %s reused", name, remote, rest, first)
+	}
+	name, _, rest = roundTrip(t, "")
+	if name != "b" || rest != "hello" {
+		t.Fatalf("other-host request = %q %q, want b hello", name, rest)
+	}
+	name, remote, _ = roundTrip(t, "GET http://203.0.113.11/ HTTP/1.1\r\nHost: 203.0.113.11\r\nConnection: close\r\n\r\n")
+	if name != "a" || remote == first {
+		t.Fatalf("request after switching hosts = %q %q, want a new tunnel to a", name, remote)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after Connection: close = %d, %v; want EOF", n, err)
+	}
+
+	waitNoSessions(t)
+	if conns := client.GetRecentConnections(); len(conns) != 3 {
+		t.Fatalf("recent connections = %d, want one per tunnel (3)", len(conns))
+	}
+}
+
+// TestIPv6Targets SOCKS5 以 IPv6 地址 (ATYP 0x04) 请求的目标：CONNECT 直连 [::1] 正常转发，
+// UDP ASSOCIATE 中发往 [::1]:53 的数据报按 DNS 查询经 DoH 发出，其他端口和不完整的头部被丢弃
+func TestIPv6Targets(t *testing.T) {
+	probe, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	probe.Close()
+	echoPort := listenEcho(t, "[::1]:0").Addr().(*net.TCPAddr).Port
+
+	// 代替服务端接收 DoH 连接，记录 TLS 握手的 SNI 后断开
+	doh, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { doh.Close() })
+	snis := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := doh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				tls.Server(conn, &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					snis <- hello.ServerName
+					return nil, errors.New("not a DoH server")
+				}}).Handshake()
+			}()
+		}
+	}()
+	proxyAddr := startClient(t, doh.Addr().String(), testToken)
+
+	v6Header := func(port uint16) []byte {
+		h := append([]byte{0x00, 0x00, 0x00, 0x04}, net.IPv6loopback...)
+		return binary.BigEndian.AppendUint16(h, port)
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 10)
+		conn.Write([]byte{0x05, 0x01, 0x00})
+		if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+			t.Fatalf("SOCKS5 greeting: %v", err)
+		}
+		req := append([]byte{0x05, 0x01}, v6Header(uint16(echoPort))[2:]...)
+		conn.Write(req)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x00 {
+			t.Fatalf("CONNECT [::1]:%d reply = %v, %v", echoPort, reply, err)
+		}
+		echoLarge(t, conn, []byte("ipv6 direct"))
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		ctl, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctl.Close()
+		ctl.SetDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 10)
+		ctl.Write([]byte{0x05, 0x01, 0x00})
+		if _, err := io.ReadFull(ctl, reply[:2]); err != nil {
+			t.Fatalf("SOCKS5 greeting: %v", err)
+		}
+		ctl.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		if _, err := io.ReadFull(ctl, reply); err != nil || reply[1] != 0x00 {
+			t.Fatalf("UDP ASSOCIATE reply = %v, %v", reply, err)
+		}
+		relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+		udp, err := net.DialUDP("udp", nil, relay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer udp.Close()
+
+		query := []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x00, 0x00, 0x01, 0x00, 0x01}
+		udp.Write(v6Header(53)[:21])                // 不完整的 IPv6 头部
+		udp.Write(append(v6Header(5353), query...)) // 非 DNS 端口
+		udp.Write(append(v6Header(53), query...))
+		select {
+		case sni := <-snis:
+			if sni != "cloudflare-dns.com" {
+				t.Fatalf("DoH SNI = %q, want cloudflare-dns.com", sni)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("DNS datagram to [::1]:53 was not forwarded over DoH")
+		}
+		select {
+		case sni := <-snis:
+			t.Fatalf("unexpected extra DoH connection (SNI %q)", sni)
+		case <-time.After(300 * time.Millisecond):
+		}
+	})
+	waitNoSessions(t)
+}
+
+// TestTransparentProxy 透明代理按 SO_ORIGINAL_DST 读取的原始目标建立隧道。
+// 经 iptables 重定向的子测试需要 root 和 iptables，否则跳过
+func TestTransparentProxy(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	addr := startTunnelServer(t, echoAddr)
+	cfg := clientConfig(t, addr, testToken)
+	cfg.Transparent = true
+	if runtime.GOOS != "linux" {
+		if err := core.NewProxyServer(cfg).Start(); err == nil || !strings.Contains(err.Error(), "Linux") {
+			t.Fatalf("start transparent proxy on %s: %v", runtime.GOOS, err)
+		}
+		return
+	}
+	client := startProxyServer(t, cfg)
+	_, port, _ := net.SplitHostPort(client.Addr().String())
+
+	t.Run("not redirected", func(t *testing.T) {
+		// 直接连到监听地址没有可用的原始目标，连接被关闭而不是连回自己
+		conn, err := net.Dial("tcp", client.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		if n, err := conn.Read(make([]byte, 64)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read = %d, %v; want the connection closed", n, err)
+		}
+		if conns := client.GetRecentConnections(); len(conns) != 0 {
+			t.Fatalf("recent connections = %+v, want none", conns)
+		}
+	})
+
+	t.Run("redirected", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("iptables requires root")
+		}
+		if _, err := exec.LookPath("iptables"); err != nil {
+			t.Skip("iptables not found")
+		}
+		host, dport, _ := net.SplitHostPort(remoteTarget)
+		rule := []string{"OUTPUT", "-p", "tcp", "-d", host, "--dport", dport, "-j", "REDIRECT", "--to-ports", port}
+		if out, err := exec.Command("iptables", append([]string{"-t", "nat", "-A"}, rule...)...).CombinedOutput(); err != nil {
+			t.Skipf("iptables: %v: %s", err, out)
+		}
+		t.Cleanup(func() { exec.Command("iptables", append([]string{"-t", "nat", "-D"}, rule...)...).Run() })
+
+		conn, err := net.DialTimeout("tcp", remoteTarget, 5*time.Second)
+		if err != nil {
+			t.Skipf("dial %s: %v", remoteTarget, err)
+		}
+		echoLarge(t, conn, []byte("transparent"))
+		conn.Close()
+
+		var conns []core.ConnectionRecord
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if conns = client.GetRecentConnections(); len(conns) > 0 {
+				break
+			}
+		}
+		if len(conns) != 1 || conns[0].Target != remoteTarget || conns[0].Direct {
+			t.Fatalf("recent connections = %+v, want one tunnel to %s", conns, remoteTarget)
+		}
+	})
+}
+
+// TestSNIRouting bypass_cn 下客户端随 SOCKS5 请求发出 ClientHello 时，IP 目标按其中的 SNI 分流，
+// ClientHello 原样转发；首个数据包不是 ClientHello 时仍按 IP 分流
+func TestSNIRouting(t *testing.T) {
+	addr := startTunnelServer(t, startEchoServer(t))
+	cfg := clientConfig(t, addr, testToken)
+	cfg.RoutingMode = core.RoutingModeBypassCN
+	if err := os.WriteFile(filepath.Join(cfg.StoreDir, "chn_ip.txt"), []byte("1.2.3.0 1.2.3.255\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.StoreDir, "chn_ip_v6.txt"), []byte("2400:3200:: 2400:3200:ffff:ffff:ffff:ffff:ffff:ffff\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := startProxyServer(t, cfg)
+	hello := testClientHello(t, "sni.echplus.invalid")
+
+	// dial 发出完整的 SOCKS5 请求并立即附带 data，不等待应答
+	dial := func(t *testing.T, target string, data []byte) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", client.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		host, port, _ := net.SplitHostPort(target)
+		p, _ := strconv.Atoi(port)
+		req := append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01}, net.ParseIP(host).To4()...)
+		req = binary.BigEndian.AppendUint16(req, uint16(p))
+		if _, err := conn.Write(append(req, data...)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	decision := func(t *testing.T, host string) core.RouteDecision {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, d := range client.GetRouteDecisions() {
+				if d.Host == host {
+					return d
+				}
+			}
+		}
+		t.Fatalf("no route decision for %s", host)
+		return core.RouteDecision{}
+	}
+
+	t.Run("forwarded", func(t *testing.T) {
+		conn := dial(t, remoteTarget, hello)
+		reply := make([]byte, 2+10+len(hello))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[3] != 0x00 || !bytes.Equal(reply[12:], hello) {
+			t.Fatalf("reply %x, echo differs from the ClientHello", reply[:12])
+		}
+		host, _, _ := net.SplitHostPort(remoteTarget)
+		if d := decision(t, host); d.Direct || !strings.Contains(d.Reason, "SNI sni.echplus.invalid") {
+			t.Fatalf("decision = %+v, want proxied by SNI", d)
+		}
+	})
+
+	t.Run("china IP with SNI", func(t *testing.T) {
+		dial(t, "1.2.3.4:443", hello)
+		if d := decision(t, "1.2.3.4"); d.Direct || !strings.Contains(d.Reason, "SNI sni.echplus.invalid") {
+			t.Fatalf("decision = %+v, want proxied by SNI", d)
+		}
+	})
+
+	t.Run("not TLS", func(t *testing.T) {
+		dial(t, "1.2.3.5:443", []byte("GET / HTTP/1.1\r\n\r\n"))
+		if d := decision(t, "1.2.3.5"); !d.Direct || strings.Contains(d.Reason, "SNI") {
+			t.Fatalf("decision = %+v, want direct by IP", d)
+		}
+	})
+}
+
+// testClientHello 返回 crypto/tls 以 serverName 为 SNI 发出的第一个 TLS 记录
+func testClientHello(t testing.TB, serverName string) []byte {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go tls.Client(c2, &tls.Config{ServerName: serverName}).Handshake()
+	defer c2.Close()
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c1, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(c1, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// TestLegacyTextFraming 未声明二进制帧子协议的旧客户端仍使用文本控制消息
+func TestLegacyTextFraming(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+
+	dialer := websocket.Dialer{Subprotocols: []string{testToken}, HandshakeTimeout: 5 * time.Second}
+	ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	if got := ws.Subprotocol(); got != testToken {
+		t.Fatalf("subprotocol = %q, want token echoed", got)
+	}
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(protocol.MsgConnect+remoteTarget+"|first|frame")); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	mt, msg, err := ws.ReadMessage()
+	if err != nil || mt != websocket.TextMessage || string(msg) != protocol.MsgConnected {
+		t.Fatalf("CONNECT response = %d %q %v, want CONNECTED", mt, msg, err)
+	}
+	want := "first|frame"
+	var got []byte
+	for len(got) < len(want) {
+		mt, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if mt != websocket.BinaryMessage {
+			t.Fatalf("unexpected text message %q", msg)
+		}
+		got = append(got, msg...)
+	}
+	if string(got) != want {
+		t.Fatalf("echo = %q, want %q", got, want)
+	}
+}
+
+// TestForbiddenTarget 被访问控制拒绝的目标返回 ERROR:forbidden，默认拒绝 SMTP 端口 25
+func TestForbiddenTarget(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	prevACL := acl
+	t.Cleanup(func() { acl = prevACL })
+	rules, err := newTargetACL("", "198.51.100.0/24")
+	if err != nil {
+		t.Fatalf("newTargetACL: %v", err)
+	}
+	acl = rules
+
+	for _, target := range []string{"203.0.113.10:25", "198.51.100.7:443"} {
+		if got, want := connectResponse(t, serverAddr, target), protocol.MsgError+"forbidden"; got != want {
+			t.Fatalf("CONNECT %s response = %q, want %q", target, got, want)
+		}
+	}
+}
+
+// connectResponse 以文本帧发送 CONNECT，返回服务端的响应
+func connectResponse(t *testing.T, serverAddr, target string) string {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{testToken}, HandshakeTimeout: 5 * time.Second}
+	ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(protocol.MsgConnect+target+"|")); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	return string(msg)
+}
+
+// TestPrivateTargetRejected 默认拒绝内网、回环和链路本地目标，域名的任一解析结果为内网地址时同样拒绝
+func TestPrivateTargetRejected(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	prevLookup := lookupIP
+	t.Cleanup(func() { lookupIP = prevLookup })
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		if host == "rebind.test" {
+			return []net.IP{net.ParseIP("203.0.113.5"), net.ParseIP("10.0.0.1")}, nil
+		}
+		return prevLookup(ctx, host)
+	}
+
+	for _, target := range []string{"127.0.0.1:80", "[::1]:80", "169.254.169.254:80", "0.0.0.0:80", "rebind.test:80"} {
+		if got, want := connectResponse(t, serverAddr, target), protocol.MsgError+errPrivateTarget.Error(); got != want {
+			t.Fatalf("CONNECT %s response = %q, want %q", target, got, want)
+		}
+	}
+}
+
+// TestConnectionLimit 达到 -maxconns 上限后新的升级请求返回 503，连接关闭后名额释放
+func TestConnectionLimit(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	for wait := time.Now().Add(5 * time.Second); connections.active.Load() > 0 && time.Now().Before(wait); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	prevMax := connections.max
+	connections.max = 2
+	t.Cleanup(func() { connections.max = prevMax })
+
+	dialer := websocket.Dialer{Subprotocols: []string{testToken, protocol.FramingSubprotocol}, HandshakeTimeout: 5 * time.Second}
+	var conns []*websocket.Conn
+	t.Cleanup(func() {
+		for _, ws := range conns {
+			ws.Close()
+		}
+	})
+	for i := 0; i < 2; i++ {
+		ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+		if err != nil {
+			t.Fatalf("dial session %d: %v", i, err)
+		}
+		conns = append(conns, ws)
+	}
+
+	_, resp, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("dial over limit = %v %v, want 503", resp, err)
+	}
+
+	conns[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for connections.active.Load() >= 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+	if err != nil {
+		t.Fatalf("dial after release: %v", err)
+	}
+	conns = append(conns, ws)
+}
+
+// TestMessageSizeLimit 双方读取的单条 WebSocket 消息不超过 protocol.MaxMessageSize，对端发送更大的消息时以 1009 关闭连接
+func TestMessageSizeLimit(t *testing.T) {
+	huge := make([]byte, 2*protocol.MaxMessageSize)
+	// closeCode 向 ws 写入超大消息，返回对端关闭连接的状态码
+	closeCode := func(ws *websocket.Conn) int {
+		ws.NetConn().SetDeadline(time.Now().Add(10 * time.Second))
+		ws.WriteMessage(websocket.BinaryMessage, huge)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) {
+					return ce.Code
+				}
+				return -1
+			}
+		}
+	}
+
+	t.Run("server", func(t *testing.T) {
+		serverAddr := startTunnelServer(t, startEchoServer(t))
+		dialer := websocket.Dialer{Subprotocols: []string{testToken}, HandshakeTimeout: 5 * time.Second}
+		ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer ws.Close()
+		if code := closeCode(ws); code != websocket.CloseMessageTooBig {
+			t.Fatalf("server closed with %d, want %d", code, websocket.CloseMessageTooBig)
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		codes := make(chan int, 1)
+		upgrader := websocket.Upgrader{Subprotocols: []string{testToken}}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			select {
+			case codes <- closeCode(ws):
+			default:
+			}
+		}))
+		t.Cleanup(srv.Close)
+		proxyAddr := startClient(t, strings.TrimPrefix(srv.URL, "http://"), testToken)
+		if conn, err := dialSOCKS5(t, proxyAddr, remoteTarget); err == nil {
+			conn.Close()
+		}
+		select {
+		case code := <-codes:
+			if code != websocket.CloseMessageTooBig {
+				t.Fatalf("client closed with %d, want %d", code, websocket.CloseMessageTooBig)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("client did not close the connection")
+		}
+	})
+}
+
+// TestIdleSessionGoroutines 大量空闲会话的 goroutine 开销：保活由共享时间轮调度，
+// 每个空闲会话只剩阻塞读的连接 goroutine。会话数可通过 ECHPLUS_IDLE_SESSIONS 调整，
+// 客户端和服务端在同一进程内，每个会话占用两个文件描述符，10000 个会话需 ulimit -n 大于 20000
+func TestIdleSessionGoroutines(t *testing.T) {
+	n := 1000
+	if v, err := strconv.Atoi(os.Getenv("ECHPLUS_IDLE_SESSIONS")); err == nil && v > 0 {
+		n = v
+	}
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	dialer := websocket.Dialer{Subprotocols: []string{testToken, protocol.FramingSubprotocol}, HandshakeTimeout: 5 * time.Second}
+
+	// 等待之前测试的会话结束，避免干扰基线
+	waitNoSessions(t)
+	baseGoroutines := runtime.NumGoroutine()
+	baseSessions := keepalive.count()
+	var cpuBefore, cpuAfter runtime.MemStats
+	runtime.ReadMemStats(&cpuBefore)
+
+	conns := make([]*websocket.Conn, 0, n)
+	t.Cleanup(func() {
+		for _, ws := range conns {
+			ws.Close()
+		}
+	})
+	for i := 0; i < n; i++ {
+		ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+		if err != nil {
+			t.Fatalf("dial session %d: %v", i, err)
+		}
+		conns = append(conns, ws)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for keepalive.count()-baseSessions < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := keepalive.count() - baseSessions; got != n {
+		t.Fatalf("keepalive sessions = %d, want %d", got, n)
+	}
+
+	perSession := float64(runtime.NumGoroutine()-baseGoroutines) / float64(n)
+	runtime.ReadMemStats(&cpuAfter)
+	t.Logf("%d idle sessions: %.2f goroutines/session, %d GC cycles", n, perSession, cpuAfter.NumGC-cpuBefore.NumGC)
+	if perSession > 1.5 {
+		t.Fatalf("%.2f goroutines per idle session, want at most one blocked reader", perSession)
+	}
+}
+
+// TestKeepaliveWheelCadence 时间轮按固定间隔调度每个会话的 ping
+func TestKeepaliveWheelCadence(t *testing.T) {
+	wheel := newKeepaliveWheel(100*time.Millisecond, 10*time.Millisecond)
+	var pings atomic.Int32
+	remove := wheel.add(func() { pings.Add(1) })
+
+	time.Sleep(550 * time.Millisecond)
+	if got := pings.Load(); got < 4 || got > 6 {
+		t.Fatalf("pings in 550ms = %d, want ~5 at 100ms interval", got)
+	}
+
+	remove()
+	before := pings.Load()
+	time.Sleep(250 * time.Millisecond)
+	if got := pings.Load(); got != before {
+		t.Fatalf("pings after remove = %d, want %d", got, before)
+	}
+}
+
+// startTestNetServer 启动进程内服务端，将所有 TEST-NET-3 (203.0.113.0/24) 地址重定向到 echo 服务，
+// 每个目标 IP 在客户端的流量统计中是一个站点
+func startTestNetServer(t testing.TB) string {
+	t.Helper()
+	echoAddr := startEchoServer(t)
+	serverAddr := startTunnelServer(t, echoAddr)
+	// 由 serveTunnel 在服务端关闭后恢复
+	prevDial := dialRemote
+	dialRemote = func(network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "203.0.113.") {
+			addr = echoAddr
+		}
+		return prevDial(network, addr)
+	}
+	return serverAddr
+}
+
+// TestInternals GetInternals 反映进行中的 UDP 关联，站点统计超过 StatsMaxSites 时淘汰最久未访问的站点
+func TestInternals(t *testing.T) {
+	cfg := clientConfig(t, startTestNetServer(t), testToken)
+	cfg.StatsMaxSites = 10
+	client := startProxyServer(t, cfg)
+	proxyAddr := client.Addr().String()
+
+	for i := 1; i <= 30; i++ {
+		conn := openTunnel(t, proxyAddr, fmt.Sprintf("203.0.113.%d:7", i))
+		echoLarge(t, conn, []byte("ping"))
+		conn.Close()
+	}
+	in := client.GetInternals()
+	if in.StatsSites == 0 || in.StatsSites > 10 {
+		t.Fatalf("stats sites = %d, want 1..10", in.StatsSites)
+	}
+	if client.GetTrafficStats().GetSiteStats("203.0.113.30") == nil {
+		t.Fatal("most recent site was evicted")
+	}
+	if client.GetTrafficStats().GetSiteStats("203.0.113.1") != nil {
+		t.Fatal("oldest site was not evicted")
+	}
+
+	ctrl, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 12)
+	ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[3] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE reply %v: %v", reply, err)
+	}
+	if in := client.GetInternals(); in.UDPAssociations != 1 {
+		t.Fatalf("udp associations = %d, want 1", in.UDPAssociations)
+	}
+	ctrl.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for in := client.GetInternals(); (in.UDPAssociations != 0 || in.Conns != 0) && time.Now().Before(deadline); in = client.GetInternals() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if in := client.GetInternals(); in.UDPAssociations != 0 || in.Conns != 0 {
+		t.Fatalf("after close: udp associations %d, conns %d, want 0", in.UDPAssociations, in.Conns)
+	}
+}
+
+// soakDuration TestSoak 的运行时长，为 0 时跳过
+var soakDuration = flag.Duration("soak", 0, "run TestSoak with synthetic traffic for this long, e.g. -soak 2h (0 skips it)")
+
+// TestSoak 长时间稳定性测试：多个 worker 持续经隧道访问不断变化的目标 IP（每个 IP 是流量统计中的一个站点）
+// 并穿插 UDP ASSOCIATE，定期检查客户端的 GetInternals：连接、UDP 关联、站点统计不超过上限，
+// GC 后的堆内存不持续增长；负载结束后连接、UDP 关联、goroutine 和 socket 回落到基线。
+// 默认跳过，用 -soak 指定时长运行:
+//
+//	cd apps/server && go test -tags integration -run TestSoak -soak 2h -timeout 0 .
+func TestSoak(t *testing.T) {
+	if *soakDuration <= 0 {
+		t.Skip("soak test disabled, run with -soak <duration>")
+	}
+	const (
+		workers  = 8
+		maxSites = 64
+	)
+	cfg := clientConfig(t, startTestNetServer(t), testToken)
+	cfg.StatsMaxSites = maxSites
+	cfg.InternalsLogInterval = max(*soakDuration/20, time.Second)
+	client := startProxyServer(t, cfg)
+	proxyAddr := client.Addr().String()
+
+	waitNoSessions(t)
+	runtime.GC()
+	base := client.GetInternals()
+	baseSockets := openSockets()
+
+	var tunnels, udps atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if i%16 == 15 {
+					if err := soakUDPAssociate(proxyAddr); err != nil {
+						t.Errorf("udp associate: %v", err)
+						return
+					}
+					udps.Add(1)
+					continue
+				}
+				target := fmt.Sprintf("203.0.113.%d:7", 1+rng.Intn(254))
+				conn, err := dialSOCKS5(t, proxyAddr, target)
+				if err != nil {
+					t.Errorf("dial %s: %v", target, err)
+					return
+				}
+				payload := make([]byte, 1+rng.Intn(16<<10))
+				rng.Read(payload)
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				_, err = conn.Write(payload)
+				if err == nil {
+					_, err = io.ReadFull(conn, payload)
+				}
+				conn.Close()
+				if err != nil {
+					t.Errorf("echo via %s: %v", target, err)
+					return
+				}
+				tunnels.Add(1)
+			}
+		}(int64(w))
+	}
+
+	// 运行十分之一时长后记录预热后的堆内存，之后每次检查前 GC，比较存活对象占用的堆
+	checkEvery := min(max(*soakDuration/50, time.Second), time.Minute)
+	warmupAt := time.Now().Add(*soakDuration / 10)
+	var warmHeap uint64
+	for deadline := time.Now().Add(*soakDuration); time.Now().Before(deadline) && !t.Failed(); {
+		time.Sleep(checkEvery)
+		runtime.GC()
+		in := client.GetInternals()
+		if in.Conns > workers || in.Upstreams > workers || in.UDPAssociations > workers {
+			t.Errorf("conns %d, upstreams %d, udp associations %d with %d workers", in.Conns, in.Upstreams, in.UDPAssociations, workers)
+		}
+		if in.StatsSites > maxSites {
+			t.Errorf("stats sites = %d, want at most %d", in.StatsSites, maxSites)
+		}
+		if limit := base.Goroutines + workers*20; in.Goroutines > limit {
+			t.Errorf("goroutines = %d, want at most %d", in.Goroutines, limit)
+		}
+		switch {
+		case warmHeap == 0 && time.Now().After(warmupAt):
+			warmHeap = in.HeapAlloc
+		case warmHeap > 0 && in.HeapAlloc > warmHeap*3/2+8<<20:
+			t.Errorf("live heap grew from %s to %s", core.FormatBytes(int64(warmHeap)), core.FormatBytes(int64(in.HeapAlloc)))
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	waitNoSessions(t)
+	var final core.Internals
+	for wait := time.Now().Add(5 * time.Second); time.Now().Before(wait); {
+		runtime.GC()
+		final = client.GetInternals()
+		if final.Conns == 0 && final.UDPAssociations == 0 && final.Goroutines <= base.Goroutines+5 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Logf("%d tunnels, %d UDP associations in %v; base %+v; final %+v", tunnels.Load(), udps.Load(), *soakDuration, base, final)
+	if final.Conns != 0 || final.Upstreams != 0 || final.UDPAssociations != 0 {
+		t.Errorf("after load: conns %d, upstreams %d, udp associations %d, want 0", final.Conns, final.Upstreams, final.UDPAssociations)
+	}
+	if final.Goroutines > base.Goroutines+5 {
+		t.Errorf("goroutines after load = %d, base %d", final.Goroutines, base.Goroutines)
+	}
+	if final.StatsSites == 0 || final.StatsSites > maxSites {
+		t.Errorf("stats sites = %d, want 1..%d", final.StatsSites, maxSites)
+	}
+	if sockets := openSockets(); sockets > baseSockets {
+		t.Errorf("open sockets = %d, base %d", sockets, baseSockets)
+	}
+}
+
+// openSockets 返回进程打开的 socket 数，无法获取（非 Linux）时返回 0。
+// 不统计其他文件描述符，splice 转发缓存的管道由运行时回收
+func openSockets() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if link, err := os.Readlink("/proc/self/fd/" + e.Name()); err == nil && strings.HasPrefix(link, "socket:") {
+			n++
+		}
+	}
+	return n
+}
+
+// soakUDPAssociate 建立一次 SOCKS5 UDP ASSOCIATE，向分配的中继端口发送一个非 DNS 数据报后关闭控制连接
+func soakUDPAssociate(proxyAddr string) error {
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reply := make([]byte, 10)
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("UDP ASSOCIATE failed: reply %d", reply[1])
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+	udp, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+	_, err = udp.Write([]byte{0, 0, 0, 0x01, 203, 0, 113, 10, 0, 9, 'x'})
+	return err
+}
+
+// TestLogStreams 指定 -log-dir 时会话记录和接入拒绝只写入 access 流，错误只写入 error 流，其余只写入 info 流
+func TestLogStreams(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := logging.New(dir, logging.Options{Format: logging.FormatJSON})
+	if err != nil {
+		t.Fatalf("new logger: %v", err)
+	}
+	serverLog.Store(logger)
+	t.Cleanup(func() {
+		serverLog.Store(nil)
+		logger.Close()
+	})
+
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	proxyAddr := startClient(t, serverAddr, testToken)
+
+	conn := openTunnel(t, proxyAddr, remoteTarget)
+	conn.Close()
+	// 25 端口默认被 ACL 拒绝，服务端记录连接失败
+	if conn, err := dialSOCKS5(t, proxyAddr, "203.0.113.10:25"); err == nil {
+		conn.Close()
+		t.Fatal("expected port 25 to be denied")
+	}
+	if conn, err := dialSOCKS5(t, startClient(t, serverAddr, "wrong-token"), remoteTarget); err == nil {
+		conn.Close()
+		t.Fatal("expected bad token to be rejected")
+	}
+	waitNoSessions(t)
+
+	streams := map[string]string{}
+	for _, stream := range []string{"access", "error", "info"} {
+		data, err := os.ReadFile(filepath.Join(dir, stream+"_"+time.Now().Format("2006-01-02")+".log"))
+		if err != nil {
+			t.Fatalf("read %s log: %v", stream, err)
+		}
+		streams[stream] = string(data)
+	}
+	for event, want := range map[string]string{
+		`"msg":"session closed"`:       "access",
+		`"msg":"Invalid token from `:   "access",
+		`"msg":"Failed to connect to `: "error",
+		`"msg":"Connected to remote: `: "info",
+		`"msg":"New connection from `:  "info",
+		`"close_reason":`:              "access",
+	} {
+		for stream, data := range streams {
+			if found := strings.Contains(data, event); found != (stream == want) {
+				t.Errorf("%s in %s stream = %v, want only in %s", event, stream, found, want)
+			}
+		}
+	}
+}
+
+// BenchmarkTunnelThroughput 经本地隧道往返 100MB，统计吞吐量和内存分配（客户端和服务端在同一进程内）:
+//
+//	cd apps/server && go test -tags integration -run '^$' -bench TunnelThroughput -benchmem .
+func BenchmarkTunnelThroughput(b *testing.B) {
+	const total = 100 << 20
+	serverAddr := startTunnelServer(b, startEchoServer(b))
+	proxyAddr := startClient(b, serverAddr, testToken)
+	chunk := make([]byte, 32*1024)
+	rand.New(rand.NewSource(1)).Read(chunk)
+
+	b.SetBytes(total)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := dialSOCKS5(b, proxyAddr, remoteTarget)
+		if err != nil {
+			b.Fatalf("dial: %v", err)
+		}
+		written := make(chan error, 1)
+		go func() {
+			for sent := 0; sent < total; sent += len(chunk) {
+				if _, err := conn.Write(chunk); err != nil {
+					written <- err
+					return
+				}
+			}
+			written <- nil
+		}()
+		if _, err := io.CopyN(io.Discard, conn, total); err != nil {
+			b.Fatalf("read echo: %v", err)
+		}
+		if err := <-written; err != nil {
+			b.Fatalf("write: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+// BenchmarkTunnelSmallWrites 以约 10µs 的间隔写入 64 字节的小块（模拟交互式流量）经本地隧道往返 128KB，
+// 比较合并小块上传数据前后的内存分配和线路流量（wire-B/op，含 WebSocket 和隧道帧开销）。
+// 写入间隔依赖 time.Sleep 的精度，客户端和写入方在同一进程内时 ns/op 主要取决于调度，不宜直接比较:
+//
+//	cd apps/server && go test -tags integration -run '^$' -bench TunnelSmallWrites -benchmem .
+func BenchmarkTunnelSmallWrites(b *testing.B) {
+	const total = 128 << 10
+	proxy := startCutProxy(b, startTunnelServer(b, startEchoServer(b)))
+	chunk := make([]byte, 64)
+	rand.New(rand.NewSource(1)).Read(chunk)
+
+	for _, bc := range []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"coalesce", 0},
+		{"no-coalesce", -1},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := clientConfig(b, proxy.addr, testToken)
+			cfg.UploadCoalesceDelay = bc.delay
+			proxyAddr := startClientWithConfig(b, cfg)
+
+			b.SetBytes(total)
+			b.ReportAllocs()
+			before := proxy.relayed.Load()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn, err := dialSOCKS5(b, proxyAddr, remoteTarget)
+				if err != nil {
+					b.Fatalf("dial: %v", err)
+				}
+				written := make(chan error, 1)
+				go func() {
+					for sent := 0; sent < total; sent += len(chunk) {
+						if _, err := conn.Write(chunk); err != nil {
+							written <- err
+							return
+						}
+						time.Sleep(10 * time.Microsecond)
+					}
+					written <- nil
+				}()
+				if _, err := io.CopyN(io.Discard, conn, total); err != nil {
+					b.Fatalf("read echo: %v", err)
+				}
+				if err := <-written; err != nil {
+					b.Fatalf("write: %v", err)
+				}
+				conn.Close()
+			}
+			b.ReportMetric(float64(proxy.relayed.Load()-before)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+// BenchmarkTunnelCompression 比较启用 permessage-deflate（服务端默认压缩级别 1）前后经本地隧道往返 1MB
+// 可压缩 JSON 文本和随机数据（相当于已加密的流量）的耗时与线路流量（wire-B/op，含 WebSocket 和隧道帧开销），
+// 以及整个进程的 CPU 时间（cpu-ns/op，客户端和服务端的压缩、解压都计入）。往返受本地回环延迟限制，ns/op 差别不大:
+//
+//	cd apps/server && go test -tags integration -run '^$' -bench TunnelCompression -benchmem .
+func BenchmarkTunnelCompression(b *testing.B) {
+	const total = 1 << 20
+	proxy := startCutProxy(b, startTunnelServer(b, startEchoServer(b)))
+	upgrader.EnableCompression = true
+	b.Cleanup(func() { upgrader.EnableCompression = false })
+	line := []byte(`{"id":12345,"name":"echPlus","tags":["proxy","ech"],"ok":true}` + "\n")
+	text := bytes.Repeat(line, total/len(line)+1)[:total]
+	random := make([]byte, total)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, bc := range []struct {
+		name     string
+		payload  []byte
+		compress bool
+	}{
+		{"text/off", text, false},
+		{"text/on", text, true},
+		{"random/off", random, false},
+		{"random/on", random, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := clientConfig(b, proxy.addr, testToken)
+			cfg.Compression = bc.compress
+			proxyAddr := startClientWithConfig(b, cfg)
+
+			b.SetBytes(total)
+			b.ReportAllocs()
+			before, cpuBefore := proxy.relayed.Load(), processCPUTime(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn, err := dialSOCKS5(b, proxyAddr, remoteTarget)
+				if err != nil {
+					b.Fatalf("dial: %v", err)
+				}
+				written := make(chan error, 1)
+				go func() {
+					_, err := conn.Write(bc.payload)
+					written <- err
+				}()
+				if _, err := io.CopyN(io.Discard, conn, total); err != nil {
+					b.Fatalf("read echo: %v", err)
+				}
+				if err := <-written; err != nil {
+					b.Fatalf("write: %v", err)
+				}
+				conn.Close()
+			}
+			b.ReportMetric(float64(proxy.relayed.Load()-before)/float64(b.N), "wire-B/op")
+			b.ReportMetric(float64(processCPUTime(b)-cpuBefore)/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
+
+// processCPUTime 进程累计占用的用户态和内核态 CPU 时间
+func processCPUTime(t testing.TB) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		t.Fatalf("getrusage: %v", err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// TestSOCKS5Bind BIND 请求由服务端监听，第一个应答为监听地址，只接受预期对端连入，连入后第二个应答为对端地址并双向转发；
+// 未启用 -bind 时返回失败应答
+func TestSOCKS5Bind(t *testing.T) {
+	proxyAddr := startEchoClient(t)
+	prevEnabled, prevPrivate := bindEnabled, allowPrivate
+	t.Cleanup(func() { bindEnabled, allowPrivate = prevEnabled, prevPrivate })
+	allowPrivate = true
+
+	bindEnabled = false
+	if _, _, err := socks5Bind(t, proxyAddr, "127.0.0.1:0"); err == nil {
+		t.Fatal("BIND succeeded with -bind disabled")
+	}
+
+	bindEnabled = true
+	conn, bound, err := socks5Bind(t, proxyAddr, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("BIND: %v", err)
+	}
+	defer conn.Close()
+	host, _, _ := net.SplitHostPort(bound)
+	if host != "127.0.0.1" {
+		t.Fatalf("BND.ADDR = %s, want the server address 127.0.0.1", bound)
+	}
+
+	peer, err := net.DialTimeout("tcp", bound, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial bound address: %v", err)
+	}
+	defer peer.Close()
+	connected, err := readSOCKS5Reply(conn)
+	if err != nil {
+		t.Fatalf("second reply: %v", err)
+	}
+	if connected != peer.LocalAddr().String() {
+		t.Fatalf("second reply BND = %s, want peer %s", connected, peer.LocalAddr())
+	}
+
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := peer.Write([]byte("hello")); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("client read = %q, %v", buf, err)
+	}
+	if _, err := conn.Write([]byte("world")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "world" {
+		t.Fatalf("peer read = %q, %v", buf, err)
+	}
+
+	// 预期对端为 203.0.113.10 时拒绝来自 127.0.0.1 的连接
+	other, bound, err := socks5Bind(t, proxyAddr, "203.0.113.10:0")
+	if err != nil {
+		t.Fatalf("BIND: %v", err)
+	}
+	defer other.Close()
+	stranger, err := net.DialTimeout("tcp", bound, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial bound address: %v", err)
+	}
+	defer stranger.Close()
+	stranger.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stranger.Read(buf); err == nil {
+		t.Fatal("unexpected peer was not rejected")
+	}
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := readSOCKS5Reply(other); err == nil {
+		t.Fatal("second reply sent for a rejected peer")
+	}
+}
+
+// socks5Bind 通过 SOCKS5 代理发送 BIND 请求，返回连接和第一个应答中的监听地址
+func socks5Bind(t testing.TB, proxyAddr, target string) (net.Conn, string, error) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	host, portStr, _ := net.SplitHostPort(target)
+	var port uint16
+	fmt.Sscanf(portStr, "%d", &port)
+	req := append([]byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01}, net.ParseIP(host).To4()...)
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	bound, err := readSOCKS5Reply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, bound, nil
+}
+
+// readSOCKS5Reply 读取 IPv4 或 IPv6 地址的 SOCKS5 应答，返回 BND.ADDR:BND.PORT
+func readSOCKS5Reply(conn net.Conn) (string, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	if head[1] != 0x00 {
+		return "", fmt.Errorf("SOCKS5 reply %d", head[1])
+	}
+	size := net.IPv4len
+	if head[3] == 0x04 {
+		size = net.IPv6len
+	}
+	addr := make([]byte, size+2)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(addr[size:])
+	return net.JoinHostPort(net.IP(addr[:size]).String(), strconv.Itoa(int(port))), nil
+}
+
+// TestObfuscation 各混淆方式下隧道均正常往返：fragment 将携带首包数据的 CONNECT 帧拆成不超过 512 字节的 TLS 记录，
+// 之后的大块数据不受影响；pad 与服务端协商填充，服务端去除填充后数据不变
+func TestObfuscation(t *testing.T) {
+	chain, _, ca := testCertChain(t)
+	serverAddr := startTLSTunnelServer(t, startEchoServer(t), chain)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	first := bytes.Repeat([]byte("first-flight "), 300)
+	large := make([]byte, 1<<20)
+	crand.Read(large)
+
+	for _, mode := range []core.Obfuscation{core.ObfuscationNone, core.ObfuscationFragment, core.ObfuscationPad} {
+		t.Run(string(mode), func(t *testing.T) {
+			proxy := startRecordProxy(t, serverAddr)
+			cfg := clientConfig(t, proxy.addr, testToken)
+			cfg.ServerAddr = "wss://" + proxy.addr + "/"
+			cfg.RootCAs = roots
+			cfg.Obfuscation = mode
+			proxyAddr := startClientWithConfig(t, cfg)
+
+			// 在 SOCKS5 应答之前发送数据，使其随 CONNECT 帧一起发送
+			conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+			if err != nil {
+				t.Fatalf("dial proxy: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			req := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 203, 0, 113, 10, 0, 7}
+			if _, err := conn.Write(append(req, first...)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+				t.Fatalf("read SOCKS5 replies: %v", err)
+			}
+			got := make([]byte, len(first))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, first) {
+				t.Fatalf("first flight echo = %d bytes, %v", len(got), err)
+			}
+			firstRecord := slices.Max(proxy.clientRecords())
+			echoLarge(t, conn, large)
+
+			// TLS 1.3 记录另有 1 字节内容类型和 16 字节认证标签
+			if fragmented := firstRecord <= 512+17; fragmented != (mode == core.ObfuscationFragment) {
+				t.Fatalf("largest record before the bulk data = %d bytes, fragmented = %v", firstRecord, fragmented)
+			}
+			if slices.Max(proxy.clientRecords()) < 4096 {
+				t.Fatal("bulk data was fragmented")
+			}
+		})
+	}
+}
+
+// TestPaddedFrames 协商了填充的会话中服务端去除填充帧的填充，未协商时填充帧无效
+func TestPaddedFrames(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	padded := func(op byte, target string, payload []byte, padding int) []byte {
+		msg := []byte{op | 0x80}
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(target)))
+		msg = append(append(append(msg, target...), payload...), make([]byte, padding)...)
+		return binary.BigEndian.AppendUint16(msg, uint16(padding))
+	}
+
+	for _, tc := range []struct {
+		protocol string
+		ok       bool
+	}{
+		{"echplus-binary.v1+pad", true},
+		{"echplus-binary.v1", false},
+	} {
+		dialer := websocket.Dialer{Subprotocols: []string{testToken, tc.protocol}, HandshakeTimeout: 5 * time.Second}
+		ws, _, err := dialer.Dial("ws://"+serverAddr+"/", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer ws.Close()
+		if ws.Subprotocol() != tc.protocol {
+			t.Fatalf("selected subprotocol = %q, want %q", ws.Subprotocol(), tc.protocol)
+		}
+		ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if err := ws.WriteMessage(websocket.BinaryMessage, padded(0x01, remoteTarget, []byte("hello"), 300)); err != nil {
+			t.Fatalf("write CONNECT: %v", err)
+		}
+		_, msg, err := ws.ReadMessage()
+		if !tc.ok {
+			if err == nil && msg[0] == 0x04 {
+				t.Fatalf("%s: padded CONNECT accepted without negotiation", tc.protocol)
+			}
+			continue
+		}
+		if err != nil || msg[0] != 0x04 {
+			t.Fatalf("%s: CONNECT response = %q, %v", tc.protocol, msg, err)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, padded(0x02, "", []byte(" world"), 0)); err != nil {
+			t.Fatalf("write DATA: %v", err)
+		}
+		var echoed []byte
+		for len(echoed) < len("hello world") {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("read DATA: %v", err)
+			}
+			echoed = append(echoed, msg[3:]...)
+		}
+		if string(echoed) != "hello world" {
+			t.Fatalf("echo = %q, want padding stripped", echoed)
+		}
+	}
+}
+
+// recordProxy 转发 TCP 连接，并记录客户端发往服务端的 TLS 记录长度
+type recordProxy struct {
+	addr    string
+	mu      sync.Mutex
+	records []int
+}
+
+func startRecordProxy(t testing.TB, upstream string) *recordProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &recordProxy{addr: ln.Addr().String()}
+	go func() {
+		for {
+			down, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", upstream)
+			if err != nil {
+				down.Close()
+				continue
+			}
+			t.Cleanup(func() { down.Close(); up.Close() })
+			go func() {
+				defer up.Close()
+				header := make([]byte, 5)
+				for {
+					if _, err := io.ReadFull(down, header); err != nil {
+						return
+					}
+					body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+					if _, err := io.ReadFull(down, body); err != nil {
+						return
+					}
+					if header[0] == 0x17 { // application_data
+						p.mu.Lock()
+						p.records = append(p.records, len(body))
+						p.mu.Unlock()
+					}
+					if _, err := up.Write(append(header, body...)); err != nil {
+						return
+					}
+				}
+			}()
+			go func() { io.Copy(down, up); down.Close() }()
+		}
+	}()
+	return p
+}
+
+// clientRecords 返回已记录的客户端 TLS 记录长度
+func (p *recordProxy) clientRecords() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.records)
+}
+
+// TestLocalDNS DNSListenAddr 上的本地 DNS 服务经服务端的 DoH 解析 UDP、TCP 和 DoH 查询：
+// 应答按 TTL 缓存并改写 ID，超过 512 字节的 UDP 应答截断，上游失败返回 SERVFAIL，Reload 可关闭和重新监听；
+// 更换监听地址、FlushCaches 和重新启动时丢弃缓存的应答
+func TestLocalDNS(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries = map[string]int{}
+	)
+	// 服务端所在的 IP 同时提供 DoH：fail.test 返回 502，big.test 返回 40 条 A 记录，其他名称返回一条 TTL 300 的 A 记录
+	doh := func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		var labels []string
+		for off := 12; off < len(query) && query[off] != 0; off += int(query[off]) + 1 {
+			labels = append(labels, string(query[off+1:min(len(query), off+1+int(query[off]))]))
+		}
+		name := strings.Join(labels, ".")
+		mu.Lock()
+		queries[name]++
+		mu.Unlock()
+		if name == "fail.test" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		count := 1
+		if name == "big.test" {
+			count = 40
+		}
+		resp := []byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, byte(count), 0, 0, 0, 0}
+		resp = append(resp, query[12:]...)
+		for i := range count {
+			resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0x01, 0x2c, 0, 4, 192, 0, 2, byte(i+1)) // 名称指针、A、IN、TTL 300
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}
+	upstream := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[name]
+	}
+
+	chain, _, ca := testCertChain(t)
+	serverAddr := serveTunnel(t, startEchoServer(t), &chain, func(srv *httptest.Server) {
+		tunnel := srv.Config.Handler
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/dns-query" {
+				doh(w, r)
+				return
+			}
+			tunnel.ServeHTTP(w, r)
+		})
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	cfg := clientConfig(t, serverAddr, testToken)
+	cfg.ServerAddr = "wss://" + serverAddr + "/"
+	cfg.RootCAs = roots
+	cfg.DNSListenAddr = "127.0.0.1:0"
+	client := startProxyServer(t, cfg)
+	addr := client.DNSAddr().String()
+
+	query := func(id uint16, name string) []byte {
+		q := binary.BigEndian.AppendUint16(nil, id)
+		q = append(q, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+		for label := range strings.SplitSeq(name, ".") {
+			q = append(append(q, byte(len(label))), label...)
+		}
+		return append(q, 0, 0, 1, 0, 1)
+	}
+	// answer 应答的 ID、RCODE、TC 以及 A 记录的地址和最小 TTL
+	type answer struct {
+		id        uint16
+		rcode     byte
+		truncated bool
+		ips       []string
+		ttl       uint32
+	}
+	parse := func(t *testing.T, resp []byte) answer {
+		t.Helper()
+		if len(resp) < 12 {
+			t.Fatalf("response too short: %x", resp)
+		}
+		a := answer{id: binary.BigEndian.Uint16(resp), rcode: resp[3] & 0x0f, truncated: resp[2]&0x02 != 0, ttl: ^uint32(0)}
+		skipName := func(off int) int {
+			for off < len(resp) {
+				switch l := int(resp[off]); {
+				case l == 0:
+					return off + 1
+				case l&0xc0 == 0xc0:
+					return off + 2
+				default:
+					off += l + 1
+				}
+			}
+			return off
+		}
+		off := skipName(12) + 4
+		for range binary.BigEndian.Uint16(resp[6:8]) {
+			off = skipName(off)
+			if off+10 > len(resp) {
+				t.Fatalf("truncated record in %x", resp)
+			}
+			typ, ttl, n := binary.BigEndian.Uint16(resp[off:]), binary.BigEndian.Uint32(resp[off+4:]), int(binary.BigEndian.Uint16(resp[off+8:]))
+			off += 10
+			if typ == 1 && n == 4 && off+4 <= len(resp) {
+				a.ips = append(a.ips, net.IP(resp[off:off+4]).String())
+				a.ttl = min(a.ttl, ttl)
+			}
+			off += n
+		}
+		return a
+	}
+	exchangeUDP := func(t *testing.T, addr string, q []byte) ([]byte, error) {
+		t.Helper()
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		conn.Write(q)
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	udp := func(t *testing.T, id uint16, name string) answer {
+		t.Helper()
+		resp, err := exchangeUDP(t, addr, query(id, name))
+		if err != nil {
+			t.Fatalf("UDP query %s: %v", name, err)
+		}
+		return parse(t, resp)
+	}
+
+	t.Run("udp cache", func(t *testing.T) {
+		if a := udp(t, 1, "a.test"); a.id != 1 || a.rcode != 0 || !slices.Equal(a.ips, []string{"192.0.2.1"}) || a.ttl > 300 {
+			t.Fatalf("first answer = %+v", a)
+		}
+		if a := udp(t, 2, "A.Test"); a.id != 2 || !slices.Equal(a.ips, []string{"192.0.2.1"}) || a.ttl > 300 {
+			t.Fatalf("cached answer = %+v", a)
+		}
+		if n := upstream("a.test") + upstream("A.Test"); n != 1 {
+			t.Fatalf("upstream queries for a.test = %d, want 1 (second answered from cache)", n)
+		}
+	})
+
+	t.Run("doh", func(t *testing.T) {
+		resp, err := http.Get("http://" + addr + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query(3, "a.test")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/dns-message" {
+			t.Fatalf("GET = %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if a := parse(t, body); a.id != 3 || !slices.Equal(a.ips, []string{"192.0.2.1"}) {
+			t.Fatalf("GET answer = %+v", a)
+		}
+		resp, err = http.Post("http://"+addr+"/dns-query", "application/dns-message", bytes.NewReader(query(4, "b.test")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if a := parse(t, body); resp.StatusCode != http.StatusOK || a.id != 4 || !slices.Equal(a.ips, []string{"192.0.2.1"}) {
+			t.Fatalf("POST = %d, answer %+v", resp.StatusCode, a)
+		}
+		if resp, err := http.Get("http://" + addr + "/other"); err != nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("GET /other = %v, %v, want 404", resp, err)
+		}
+		if n := upstream("a.test"); n != 1 {
+			t.Fatalf("upstream queries for a.test = %d, want 1", n)
+		}
+	})
+
+	t.Run("truncate and tcp", func(t *testing.T) {
+		if a := udp(t, 5, "big.test"); !a.truncated || len(a.ips) != 0 {
+			t.Fatalf("UDP answer for big.test = %+v, want truncated", a)
+		}
+		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		for _, id := range []uint16{6, 7} {
+			q := query(id, "big.test")
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(q))), q...))
+			var n uint16
+			if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+				t.Fatalf("TCP length: %v", err)
+			}
+			resp := make([]byte, n)
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				t.Fatalf("TCP response: %v", err)
+			}
+			if a := parse(t, resp); a.id != id || a.truncated || len(a.ips) != 40 {
+				t.Fatalf("TCP answer %d = id %d, truncated %v, %d records", id, a.id, a.truncated, len(a.ips))
+			}
+		}
+	})
+
+	t.Run("servfail", func(t *testing.T) {
+		for id := uint16(8); id < 10; id++ {
+			if a := udp(t, id, "fail.test"); a.id != id || a.rcode != 2 {
+				t.Fatalf("answer = %+v, want SERVFAIL", a)
+			}
+		}
+		if n := upstream("fail.test"); n != 2 {
+			t.Fatalf("upstream queries for fail.test = %d, want 2 (failures are not cached)", n)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		cfg.DNSListenAddr = ""
+		if err := client.Reload(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if a := client.DNSAddr(); a != nil {
+			t.Fatalf("DNSAddr after disabling = %v", a)
+		}
+		if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			t.Fatal("old DNS address still accepts connections")
+		}
+		cfg.DNSListenAddr = "127.0.0.1:0"
+		if err := client.Reload(cfg); err != nil {
+			t.Fatal(err)
+		}
+		addr = client.DNSAddr().String()
+		if a := udp(t, 10, "c.test"); a.id != 10 || !slices.Equal(a.ips, []string{"192.0.2.1"}) {
+			t.Fatalf("answer after Reload = %+v", a)
+		}
+		udp(t, 11, "a.test")
+		if n := upstream("a.test"); n != 2 {
+			t.Fatalf("upstream queries for a.test = %d, want 2 (cache dropped with the old address)", n)
+		}
+	})
+
+	// FlushCaches 和重新启动都丢弃缓存的应答
+	t.Run("flush and restart", func(t *testing.T) {
+		udp(t, 12, "d.test")
+		udp(t, 13, "d.test")
+		if n := upstream("d.test"); n != 1 {
+			t.Fatalf("upstream queries for d.test = %d, want 1", n)
+		}
+		// 未启用 ECH，刷新 ECH 配置的错误与此无关
+		if flushed, _ := client.FlushCaches(); !slices.Contains(flushed, "DNS 应答缓存") {
+			t.Fatalf("FlushCaches flushed %q, want the DNS cache", flushed)
+		}
+		udp(t, 14, "d.test")
+		if n := upstream("d.test"); n != 2 {
+			t.Fatalf("upstream queries for d.test after FlushCaches = %d, want 2", n)
+		}
+		if err := client.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		addr = client.DNSAddr().String()
+		udp(t, 15, "d.test")
+		if n := upstream("d.test"); n != 3 {
+			t.Fatalf("upstream queries for d.test after Restart = %d, want 3", n)
+		}
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	var down atomic.Bool
+	addr := serveTunnel(t, echoAddr, nil, func(srv *httptest.Server) {
+		next := srv.Config.Handler
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down.Load() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	events := make(chan core.Health, 4)
+	core.SetHealthHandler(func(h core.Health) { events <- h })
+	t.Cleanup(func() { core.SetHealthHandler(nil) })
+
+	cfg := clientConfig(t, addr, testToken)
+	cfg.DialRetries = -1
+	cfg.HealthCheckInterval = 20 * time.Millisecond
+	cfg.HealthCheckFailures = 2
+	client := startProxyServer(t, cfg)
+	server := "ws://" + addr + "/"
+
+	waitHealth := func(t *testing.T, ok func(core.Health) bool) core.Health {
+		t.Helper()
+		var h core.Health
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if h = client.GetHealth(); ok(h) {
+				return h
+			}
+		}
+		t.Fatalf("health = %+v", h)
+		return h
+	}
+	waitEvent := func(t *testing.T) core.Health {
+		t.Helper()
+		select {
+		case h := <-events:
+			return h
+		case <-time.After(2 * time.Second):
+			t.Fatal("no health event")
+			return core.Health{}
+		}
+	}
+
+	h := waitHealth(t, func(h core.Health) bool { return !h.LastCheckAt.IsZero() })
+	if !h.Healthy || h.Server != server || h.Latency <= 0 || h.ConsecutiveFailures != 0 || h.LastError != "" {
+		t.Fatalf("health = %+v, want healthy with latency", h)
+	}
+	if got := client.GetUpstreamStatus().ServerAddr; got != server {
+		t.Fatalf("upstream server = %q, want %q", got, server)
+	}
+	select {
+	case h := <-events:
+		t.Fatalf("event %+v without a state change", h)
+	default:
+	}
+
+	// 第一次失败仍为可用，达到阈值后通知一次
+	down.Store(true)
+	h = waitEvent(t)
+	if h.Healthy || h.ConsecutiveFailures != 2 || !strings.Contains(h.LastError, "503") {
+		t.Fatalf("event = %+v, want unhealthy after 2 failures", h)
+	}
+	waitHealth(t, func(h core.Health) bool { return h.ConsecutiveFailures > 2 && !h.Healthy })
+	select {
+	case h := <-events:
+		t.Fatalf("repeated event %+v while still unhealthy", h)
+	default:
+	}
+
+	down.Store(false)
+	h = waitEvent(t)
+	if !h.Healthy || h.ConsecutiveFailures != 0 || h.Latency <= 0 || h.LastError != "" {
+		t.Fatalf("event = %+v, want recovered", h)
+	}
+
+	// 关闭检查后不再更新
+	cfg.HealthCheckInterval = 0
+	if err := client.Reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	last := client.GetHealth().LastCheckAt
+	time.Sleep(100 * time.Millisecond)
+	if got := client.GetHealth().LastCheckAt; got.After(last.Add(50 * time.Millisecond)) {
+		t.Fatalf("checked at %v after disabling, last %v", got, last)
+	}
+}
+
+func TestFileShare(t *testing.T) {
+	var mu sync.Mutex
+	var hits []string // 按顺序记录主下载地址和服务端 /files/ 收到的请求
+	hit := func(r *http.Request) {
+		mu.Lock()
+		hits = append(hits, r.URL.Path)
+		mu.Unlock()
+	}
+	takeHits := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := hits
+		hits = nil
+		return got
+	}
+	addr := serveTunnel(t, startEchoServer(t), nil, func(srv *httptest.Server) {
+		mux := newMux()
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/files/") {
+				hit(r)
+			}
+			mux.ServeHTTP(w, r)
+		})
+	})
+
+	dir := t.TempDir()
+	ipv4 := []byte("1.2.3.0 1.2.3.255\n5.6.7.0 5.6.7.255\n")
+	ipv6 := []byte("2400:3200:: 2400:3200:ffff:ffff:ffff:ffff:ffff:ffff\n")
+	for name, data := range map[string][]byte{
+		"chn_ip.txt":    ipv4,
+		"chn_ip_v6.txt": ipv6,
+		"secret.txt":    []byte("not listed"),
+		"big.bin":       make([]byte, 2048),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	share, err := newFileShare(dir, "chn_ip.txt, chn_ip_v6.txt,big.bin,missing.txt", 1024)
+	if err != nil {
+		t.Fatalf("newFileShare: %v", err)
+	}
+	prevFiles := files
+	files = share
+	t.Cleanup(func() { files = prevFiles })
+	if _, err := newFileShare(dir, "../secret.txt", 1024); err == nil {
+		t.Fatal("newFileShare accepted a path")
+	}
+
+	get := func(t *testing.T, method, name, token string, header map[string]string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+addr+"/files/"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, name, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	t.Run("auth", func(t *testing.T) {
+		for _, token := range []string{"", "wrong"} {
+			if resp, _ := get(t, http.MethodGet, "chn_ip.txt", token, nil); resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("token %q: status %d, want 401", token, resp.StatusCode)
+			}
+		}
+		// 未授权时未列出的文件同样返回 401，无法探测文件是否存在
+		if resp, _ := get(t, http.MethodGet, "secret.txt", "", nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("unlisted without token: status %d, want 401", resp.StatusCode)
+		}
+		if resp, _ := get(t, http.MethodGet, "chn_ip.txt?token="+testToken, "", nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("query token: status %d, want 401", resp.StatusCode)
+		}
+		if resp, _ := get(t, http.MethodPost, "chn_ip.txt", testToken, nil); resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("POST: status %d, want 405", resp.StatusCode)
+		}
+	})
+
+	t.Run("whitelist", func(t *testing.T) {
+		for _, name := range []string{"secret.txt", "missing.txt", "big.bin", "%2e%2e%2fsecret.txt", "..%5cchn_ip.txt", ""} {
+			if resp, _ := get(t, http.MethodGet, name, testToken, nil); resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("%q: status %d, want 404", name, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		resp, body := get(t, http.MethodGet, "chn_ip.txt", testToken, nil)
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || body != string(ipv4) || etag == "" || resp.Header.Get("Accept-Ranges") != "bytes" {
+			t.Fatalf("status %d, ETag %q, Accept-Ranges %q, body %q", resp.StatusCode, etag, resp.Header.Get("Accept-Ranges"), body)
+		}
+		resp, body = get(t, http.MethodGet, "chn_ip.txt", testToken, map[string]string{"Range": "bytes=18-", "If-Range": etag})
+		if resp.StatusCode != http.StatusPartialContent || body != string(ipv4[18:]) {
+			t.Fatalf("range: status %d, body %q, want 206 %q", resp.StatusCode, body, ipv4[18:])
+		}
+		if want := fmt.Sprintf("bytes 18-%d/%d", len(ipv4)-1, len(ipv4)); resp.Header.Get("Content-Range") != want {
+			t.Fatalf("Content-Range = %q, want %q", resp.Header.Get("Content-Range"), want)
+		}
+		resp, body = get(t, http.MethodGet, "chn_ip.txt", testToken, map[string]string{"Range": "bytes=0-6"})
+		if resp.StatusCode != http.StatusPartialContent || body != "1.2.3.0" {
+			t.Fatalf("bounded range: status %d, body %q", resp.StatusCode, body)
+		}
+		// If-Range 不匹配时返回完整内容
+		resp, body = get(t, http.MethodGet, "chn_ip.txt", testToken, map[string]string{"Range": "bytes=18-", "If-Range": `"stale"`})
+		if resp.StatusCode != http.StatusOK || body != string(ipv4) {
+			t.Fatalf("stale If-Range: status %d, body %q, want full content", resp.StatusCode, body)
+		}
+		if resp, _ = get(t, http.MethodGet, "chn_ip.txt", testToken, map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("If-None-Match: status %d, want 304", resp.StatusCode)
+		}
+		if resp, _ = get(t, http.MethodGet, "chn_ip.txt", testToken, map[string]string{"Range": "bytes=1000-"}); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("out of range: status %d, want 416", resp.StatusCode)
+		}
+	})
+
+	// 客户端先从 IPListBaseURL 下载，失败时才从服务端下载
+	var primaryDown atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit(r)
+		if primaryDown.Load() {
+			http.Error(w, "blocked", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("9.9.9.0 9.9.9.255\n"))
+	}))
+	t.Cleanup(primary.Close)
+	startBypass := func(t *testing.T) core.Config {
+		t.Helper()
+		takeHits()
+		cfg := clientConfig(t, addr, testToken)
+		cfg.RoutingMode = core.RoutingModeBypassCN
+		cfg.IPListBaseURL = primary.URL + "/lists/"
+		startProxyServer(t, cfg)
+		return cfg
+	}
+	readStored := func(t *testing.T, cfg core.Config, name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(cfg.StoreDir, name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.StoreDir, name+".part")); !os.IsNotExist(err) {
+			t.Fatalf("%s.part left behind: %v", name, err)
+		}
+		return string(data)
+	}
+
+	t.Run("primary", func(t *testing.T) {
+		cfg := startBypass(t)
+		if got, want := takeHits(), []string{"/lists/chn_ip.txt", "/lists/chn_ip_v6.txt"}; !slices.Equal(got, want) {
+			t.Fatalf("requests = %q, want %q", got, want)
+		}
+		if got := readStored(t, cfg, "chn_ip.txt"); got != "9.9.9.0 9.9.9.255\n" {
+			t.Fatalf("chn_ip.txt = %q, want the primary list", got)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		primaryDown.Store(true)
+		cfg := startBypass(t)
+		want := []string{"/lists/chn_ip.txt", "/files/chn_ip.txt", "/lists/chn_ip_v6.txt", "/files/chn_ip_v6.txt"}
+		if got := takeHits(); !slices.Equal(got, want) {
+			t.Fatalf("requests = %q, want %q", got, want)
+		}
+		if got := readStored(t, cfg, "chn_ip.txt"); got != string(ipv4) {
+			t.Fatalf("chn_ip.txt = %q, want the server's list", got)
+		}
+		if got := readStored(t, cfg, "chn_ip_v6.txt"); got != string(ipv6) {
+			t.Fatalf("chn_ip_v6.txt = %q, want the server's list", got)
+		}
+	})
+
+	t.Run("fallback wrong token", func(t *testing.T) {
+		primaryDown.Store(true)
+		takeHits()
+		cfg := clientConfig(t, addr, "wrong")
+		cfg.RoutingMode = core.RoutingModeBypassCN
+		cfg.IPListBaseURL = primary.URL + "/lists/"
+		startProxyServer(t, cfg)
+		if got := len(takeHits()); got != 4 {
+			t.Fatalf("%d requests, want 4", got)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.StoreDir, "chn_ip.txt")); !os.IsNotExist(err) {
+			t.Fatalf("chn_ip.txt saved after a rejected download: %v", err)
+		}
+	})
+
+	// 从服务端下载与 UpdateToken 同时进行，在 -race 下检查令牌的读写
+	t.Run("fallback during token update", func(t *testing.T) {
+		primaryDown.Store(true)
+		cfg := clientConfig(t, addr, testToken)
+		cfg.RoutingMode = core.RoutingModeBypassCN
+		cfg.IPListBaseURL = primary.URL + "/lists/"
+		client := startProxyServer(t, cfg)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range 50 {
+				if err := client.UpdateToken(testToken); err != nil {
+					t.Errorf("UpdateToken: %v", err)
+				}
+			}
+		}()
+		for range 20 {
+			os.Remove(filepath.Join(cfg.StoreDir, "chn_ip.txt"))
+			if _, err := client.FlushCaches(); err != nil {
+				t.Errorf("FlushCaches: %v", err)
+			}
+		}
+		<-done
+		if got := readStored(t, cfg, "chn_ip.txt"); got != string(ipv4) {
+			t.Fatalf("chn_ip.txt = %q, want the server's list", got)
+		}
+	})
+}
+
+// testProxy 记录经过的连接的测试用上游代理
+type testProxy struct {
+	addr    string
+	mu      sync.Mutex
+	targets []string // 认证通过的连接目标
+	denied  int      // 认证失败次数
+}
+
+func (p *testProxy) record(target string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		p.targets = append(p.targets, target)
+	} else {
+		p.denied++
+	}
+}
+
+func (p *testProxy) take() (targets []string, denied int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	targets, denied = p.targets, p.denied
+	p.targets, p.denied = nil, 0
+	return targets, denied
+}
+
+// relayTo 连接 target 并在 conn 与其之间双向转发，ready 在连接成功后调用
+func relayTo(conn net.Conn, target string, ready func() error) {
+	defer conn.Close()
+	remote, err := net.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	if ready() != nil {
+		return
+	}
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	io.Copy(conn, remote)
+}
+
+// startHTTPConnectProxy 启动要求 Basic 认证 user:pass 的 HTTP CONNECT 代理
+func startHTTPConnectProxy(t *testing.T, user, pass string) *testProxy {
+	t.Helper()
+	p := &testProxy{}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != want {
+			p.record(r.Host, false)
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			http.Error(w, "auth required", http.StatusProxyAuthRequired)
+			return
+		}
+		p.record(r.Host, true)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		relayTo(conn, r.Host, func() error {
+			_, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return err
+		})
+	}))
+	t.Cleanup(srv.Close)
+	p.addr = srv.Listener.Addr().String()
+	return p
+}
+
+// startSOCKS5Proxy 启动要求用户名密码认证 (RFC 1929) 的 SOCKS5 代理，只支持 CONNECT
+func startSOCKS5Proxy(t *testing.T, user, pass string) *testProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &testProxy{addr: ln.Addr().String()}
+	serve := func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		readN := func(n int) []byte {
+			b := make([]byte, n)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return nil
+			}
+			return b
+		}
+		head := readN(2)
+		if head == nil || head[0] != 0x05 || readN(int(head[1])) == nil {
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{0x05, 0x02})
+		authHead := readN(2)
+		if authHead == nil {
+			conn.Close()
+			return
+		}
+		gotUser := readN(int(authHead[1]))
+		passLen := readN(1)
+		if gotUser == nil || passLen == nil {
+			conn.Close()
+			return
+		}
+		gotPass := readN(int(passLen[0]))
+		if string(gotUser) != user || string(gotPass) != pass {
+			p.record("", false)
+			conn.Write([]byte{0x01, 0x01})
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+		req := readN(4)
+		if req == nil || req[1] != 0x01 {
+			conn.Close()
+			return
+		}
+		var host string
+		switch req[3] {
+		case 0x01:
+			host = net.IP(readN(4)).String()
+		case 0x03:
+			n := readN(1)
+			host = string(readN(int(n[0])))
+		case 0x04:
+			host = net.IP(readN(16)).String()
+		}
+		port := readN(2)
+		target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		p.record(target, true)
+		conn.SetDeadline(time.Time{})
+		relayTo(&bufferedTestConn{Conn: conn, r: br}, target, func() error {
+			_, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return err
+		})
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return p
+}
+
+// bufferedTestConn 先读出 bufio.Reader 中已缓冲的数据
+type bufferedTestConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedTestConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func TestUpstreamProxy(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	addr := startTunnelServer(t, echoAddr)
+	proxies := map[string]*testProxy{
+		"http":   startHTTPConnectProxy(t, "alice", "s3cret"),
+		"socks5": startSOCKS5Proxy(t, "alice", "s3cret"),
+	}
+	for _, scheme := range []string{"http", "socks5"} {
+		p := proxies[scheme]
+		t.Run(scheme, func(t *testing.T) {
+			cfg := clientConfig(t, addr, testToken)
+			cfg.DialRetries = -1
+			cfg.UpstreamProxy = scheme + "://alice:s3cret@" + p.addr
+			client := startProxyServer(t, cfg)
+			conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget)
+			if err != nil {
+				t.Fatalf("connect through %s proxy: %v", scheme, err)
+			}
+			echoLarge(t, conn, []byte("via "+scheme))
+			conn.Close()
+			_, port, _ := net.SplitHostPort(addr)
+			if targets, denied := p.take(); len(targets) != 1 || targets[0] != "127.0.0.1:"+port || denied != 0 {
+				t.Fatalf("proxy saw %q (%d denied), want one connection to the server", targets, denied)
+			}
+
+			// 直连默认不经过代理，UpstreamProxyDirect 为 true 时经过
+			cfg.RoutingMode = core.RoutingModeNone
+			if err := client.Reload(cfg); err != nil {
+				t.Fatal(err)
+			}
+			for _, viaProxy := range []bool{false, true} {
+				cfg.UpstreamProxyDirect = viaProxy
+				if err := client.Reload(cfg); err != nil {
+					t.Fatal(err)
+				}
+				conn, err := dialSOCKS5(t, client.Addr().String(), echoAddr)
+				if err != nil {
+					t.Fatalf("direct connect (UpstreamProxyDirect %v): %v", viaProxy, err)
+				}
+				echoLarge(t, conn, []byte("direct"))
+				conn.Close()
+				var want []string
+				if viaProxy {
+					want = []string{echoAddr}
+				}
+				if targets, _ := p.take(); !slices.Equal(targets, want) {
+					t.Fatalf("UpstreamProxyDirect %v: proxy saw %q, want %q", viaProxy, targets, want)
+				}
+			}
+
+			cfg.RoutingMode, cfg.UpstreamProxyDirect = core.RoutingModeGlobal, false
+			cfg.UpstreamProxy = scheme + "://alice:wrong@" + p.addr
+			if err := client.Reload(cfg); err != nil {
+				t.Fatal(err)
+			}
+			if conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget); err == nil {
+				conn.Close()
+				t.Fatal("connect succeeded with wrong proxy credentials")
+			}
+			if targets, denied := p.take(); len(targets) != 0 || denied == 0 {
+				t.Fatalf("proxy saw %q (%d denied), want only denied attempts", targets, denied)
+			}
+		})
+	}
+
+	// 获取 ECH 配置的 DoH 查询同样经过代理
+	t.Run("doh", func(t *testing.T) {
+		var lookups atomic.Int32
+		dns := startECHDoH(t, testECHConfigList(t, "public.echplus.test"), &lookups)
+		u, _ := url.Parse(dns)
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.ServerAddr = "wss://a.echplus.test:443/"
+		cfg.DNSServer, cfg.ECHDomain, cfg.RequireECH = dns, core.ECHDomainServer, true
+		cfg.UpstreamProxy = "socks5://alice:s3cret@" + proxies["socks5"].addr
+		startProxyServer(t, cfg)
+		if targets, _ := proxies["socks5"].take(); !slices.Contains(targets, u.Host) || lookups.Load() != 1 {
+			t.Fatalf("proxy saw %q with %d lookups, want the DoH server %s", targets, lookups.Load(), u.Host)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, raw := range []string{"ftp://proxy:21", "http://", "socks5://proxy:1080/path"} {
+			cfg := clientConfig(t, addr, testToken)
+			cfg.UpstreamProxy = raw
+			if err := core.NewProxyServer(cfg).Start(); err == nil {
+				t.Errorf("UpstreamProxy %q accepted", raw)
+			}
+		}
+	})
+}
+
+// TestPlaintextPolicy 按首个数据包和目标端口识别经代理发送的明文协议，按 PlaintextPolicy 警告或拒绝，PlaintextExempt 中的主机不检查
+func TestPlaintextPolicy(t *testing.T) {
+	echo := startEchoServer(t)
+	addr := startTunnelServer(t, echo)
+	const httpTarget = "203.0.113.10:80"
+	prevDial := dialRemote
+	dialRemote = func(network, a string) (net.Conn, error) {
+		if a == httpTarget || a == "203.0.113.11:80" {
+			a = echo
+		}
+		return prevDial(network, a)
+	}
+	t.Cleanup(func() { dialRemote = prevDial })
+
+	events := make(chan core.PlaintextEvent, 16)
+	core.SetPlaintextHandler(func(e core.PlaintextEvent) { events <- e })
+	t.Cleanup(func() { core.SetPlaintextHandler(nil) })
+	noEvent := func(t *testing.T) {
+		t.Helper()
+		select {
+		case e := <-events:
+			t.Fatalf("unexpected plaintext event %+v", e)
+		default:
+		}
+	}
+	wantEvent := func(t *testing.T, target, protocol string, blocked bool) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Target != target || e.Protocol != protocol || e.Blocked != blocked || e.ConnID == 0 {
+				t.Fatalf("event = %+v, want %s %s blocked=%v", e, target, protocol, blocked)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no plaintext event")
+		}
+	}
+
+	echoRoundTrip := func(t *testing.T, conn net.Conn, msg []byte) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("echo = %q, %v; want %q", got, err, msg)
+		}
+	}
+
+	cfg := clientConfig(t, addr, testToken)
+	cfg.PlaintextPolicy = core.PlaintextBlock
+	cfg.PlaintextExempt = []string{"203.0.113.11"}
+	client := startProxyServer(t, cfg)
+
+	// dial 发出 SOCKS5 请求并立即附带 data，返回连接和应答码
+	dial := func(t *testing.T, target string, data []byte) (net.Conn, byte) {
+		t.Helper()
+		conn, err := net.Dial("tcp", client.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		host, port, _ := net.SplitHostPort(target)
+		p, _ := strconv.Atoi(port)
+		req := append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01}, net.ParseIP(host).To4()...)
+		req = binary.BigEndian.AppendUint16(req, uint16(p))
+		if _, err := conn.Write(append(req, data...)); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 12)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply[3]
+	}
+
+	t.Run("http blocked", func(t *testing.T) {
+		if _, code := dial(t, httpTarget, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); code != 0x02 {
+			t.Fatalf("reply %d, want 2 (not allowed)", code)
+		}
+		wantEvent(t, httpTarget, "HTTP", true)
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			conns := client.GetRecentConnections()
+			if n := len(conns); n > 0 && conns[n-1].Target == httpTarget {
+				if !strings.Contains(conns[n-1].Error, core.ErrPlaintextBlocked.Error()) || conns[n-1].Upstream != "" {
+					t.Fatalf("record = %+v, want blocked before dialing the server", conns[n-1])
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("no connection record")
+			}
+		}
+	})
+
+	t.Run("tls allowed", func(t *testing.T) {
+		hello := testClientHello(t, "tls.example.com")
+		conn, code := dial(t, httpTarget, hello)
+		if code != 0x00 {
+			t.Fatalf("reply %d, want success", code)
+		}
+		got := make([]byte, len(hello))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, hello) {
+			t.Fatalf("echo = %v, want the ClientHello", err)
+		}
+		noEvent(t)
+	})
+
+	// 客户端等待应答后才发送数据时没有首个数据包，按端口识别
+	t.Run("no first bytes", func(t *testing.T) {
+		if _, err := dialSOCKS5(t, client.Addr().String(), httpTarget); err == nil || !strings.Contains(err.Error(), "reply 2") {
+			t.Fatalf("dial = %v, want reply 2", err)
+		}
+		wantEvent(t, httpTarget, "HTTP", true)
+	})
+
+	t.Run("exempt", func(t *testing.T) {
+		conn := openTunnel(t, client.Addr().String(), "203.0.113.11:80")
+		echoRoundTrip(t, conn, []byte("GET / HTTP/1.1\r\n\r\n"))
+		noEvent(t)
+	})
+
+	t.Run("other port", func(t *testing.T) {
+		conn := openTunnel(t, client.Addr().String(), remoteTarget)
+		echoRoundTrip(t, conn, []byte("plain text"))
+		noEvent(t)
+	})
+
+	// HTTP 代理请求总是明文，warn 只记录不拒绝
+	t.Run("http proxy warn", func(t *testing.T) {
+		cfg.PlaintextPolicy = core.PlaintextWarn
+		if err := client.Reload(cfg); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", client.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", httpTarget, httpTarget)
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "GET " {
+			t.Fatalf("echo = %q, %v; want the forwarded request", got, err)
+		}
+		wantEvent(t, httpTarget, "HTTP", false)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cfg := clientConfig(t, addr, testToken)
+		cfg.PlaintextPolicy = "deny"
+		if err := core.NewProxyServer(cfg).Start(); err == nil {
+			t.Fatal("PlaintextPolicy deny accepted")
+		}
+	})
+}
+
+// TestShutdown Shutdown 在 DrainTimeout 内关闭未结束的隧道，完整保存流量统计，未运行时返回 nil
+func TestShutdown(t *testing.T) {
+	addr := startTunnelServer(t, startEchoServer(t))
+	cfg := clientConfig(t, addr, testToken)
+	cfg.DrainTimeout = 200 * time.Millisecond
+	client := startProxyServer(t, cfg)
+
+	conn := openTunnel(t, client.Addr().String(), remoteTarget)
+	msg := bytes.Repeat([]byte("x"), 4096)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), core.ShutdownTimeout(cfg))
+	defer cancel()
+	start := time.Now()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Shutdown took %v with DrainTimeout %v", elapsed, cfg.DrainTimeout)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("tunnel still open after Shutdown")
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.StoreDir, "traffic_stats.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved struct {
+		TotalUpload   int64 `json:"total_upload"`
+		TotalDownload int64 `json:"total_download"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("stats file: %v", err)
+	}
+	if saved.TotalUpload < int64(len(msg)) || saved.TotalDownload < int64(len(msg)) {
+		t.Fatalf("saved stats %+v, want at least %d bytes each way", saved, len(msg))
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(cfg.StoreDir, "*.tmp")); len(tmp) > 0 {
+		t.Fatalf("temporary files left behind: %v", tmp)
+	}
+
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown when stopped: %v", err)
+	}
+}
+
+// TestUpstreamTimeouts TLSHandshakeTimeout 限制 WebSocket 升级，DoHTimeout 限制获取 ECH 配置的查询，负数被拒绝
+func TestUpstreamTimeouts(t *testing.T) {
+	// hang 接受连接后不作任何响应
+	hang := func(t *testing.T) string {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { conn.Close() })
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	t.Run("tls handshake", func(t *testing.T) {
+		cfg := clientConfig(t, hang(t), testToken)
+		cfg.TLSHandshakeTimeout = 300 * time.Millisecond
+		cfg.DialRetries = -1
+		proxyAddr := startClientWithConfig(t, cfg)
+		start := time.Now()
+		if conn, err := dialSOCKS5(t, proxyAddr, remoteTarget); err == nil {
+			conn.Close()
+			t.Fatal("connect through an unresponsive server succeeded")
+		}
+		if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 3*time.Second {
+			t.Fatalf("failed after %v, want about TLSHandshakeTimeout (300ms)", elapsed)
+		}
+	})
+
+	t.Run("doh", func(t *testing.T) {
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.ServerAddr = "wss://127.0.0.1:1/"
+		cfg.DNSServer, cfg.ECHDomain, cfg.RequireECH = "http://"+hang(t)+"/dns-query", "echplus.test", true
+		cfg.DoHTimeout = 300 * time.Millisecond
+		start := time.Now()
+		if err := core.NewProxyServer(cfg).Start(); err == nil {
+			t.Fatal("start with an unresponsive DoH server succeeded")
+		}
+		if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 3*time.Second {
+			t.Fatalf("start failed after %v, want about DoHTimeout (300ms) per query", elapsed)
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.DialTimeout = -time.Second
+		if err := core.NewProxyServer(cfg).Start(); err == nil {
+			t.Fatal("negative DialTimeout accepted")
+		}
+	})
+}
+
+// TestUpstreamProxyEnv UpstreamProxy 为空时按 HTTPS_PROXY、HTTP_PROXY 和 NO_PROXY 经代理查询 DoH，为 direct 时不经过代理
+func TestUpstreamProxyEnv(t *testing.T) {
+	p := startHTTPConnectProxy(t, "alice", "s3cret")
+	proxyURL := "http://alice:s3cret@" + p.addr
+	// 回环地址不使用环境变量中的代理，DoH 服务器用域名，代理收到的 CONNECT 目标即为该域名
+	const dohHost = "doh.echplus.test:8053"
+
+	for _, tc := range []struct {
+		name                  string
+		httpsProxy, httpProxy string
+		noProxy, upstream     string
+		want                  []string
+	}{
+		{name: "https_proxy", httpsProxy: proxyURL, want: []string{dohHost}},
+		{name: "http_proxy fallback", httpProxy: proxyURL, want: []string{dohHost}},
+		{name: "no_proxy", httpsProxy: proxyURL, noProxy: "echplus.test"},
+		{name: "direct", httpsProxy: proxyURL, upstream: core.UpstreamProxyNone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, k := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"} {
+				t.Setenv(k, "")
+			}
+			t.Setenv("HTTPS_PROXY", tc.httpsProxy)
+			t.Setenv("HTTP_PROXY", tc.httpProxy)
+			t.Setenv("NO_PROXY", tc.noProxy)
+
+			cfg := clientConfig(t, "127.0.0.1:1", testToken)
+			cfg.ServerAddr = "wss://a.echplus.test:443/"
+			cfg.DNSServer, cfg.ECHDomain, cfg.RequireECH = "http://"+dohHost+"/dns-query", "echplus.test", true
+			cfg.UpstreamProxy = tc.upstream
+			cfg.DoHTimeout = time.Second
+			// 代理无法连接虚构的 DoH 服务器，启动失败，只检查查询是否经过代理
+			core.NewProxyServer(cfg).Start()
+			if targets, _ := p.take(); !slices.Equal(slices.Compact(targets), tc.want) {
+				t.Fatalf("proxy saw %q, want %q", targets, tc.want)
+			}
+		})
+	}
+}
+
+// TestFallbackServerHost ServerIP 为空时启动时解析 FallbackServerHost 并连接解析出的 IP，GetConfig 返回的配置不被修改
+func TestFallbackServerHost(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	addr := startTunnelServer(t, echoAddr)
+	cfg := clientConfig(t, addr, testToken)
+	cfg.ServerIP, cfg.FallbackServerHost = "", "localhost"
+	cfg.DialRetries = -1
+	client := startProxyServer(t, cfg)
+
+	if got := client.GetConfig(); got.ServerIP != "" || got.FallbackServerHost != "localhost" {
+		t.Fatalf("GetConfig ServerIP %q FallbackServerHost %q, want the configured values", got.ServerIP, got.FallbackServerHost)
+	}
+	var ips []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ips = nil
+		selected := ""
+		for _, st := range client.GetServerIPStats() {
+			ips = append(ips, st.IP)
+			if st.Selected {
+				selected = st.IP
+			}
+		}
+		if selected == "127.0.0.1" {
+			break
+		}
+	}
+	if !slices.Contains(ips, "127.0.0.1") || slices.Contains(ips, "localhost") {
+		t.Fatalf("ServerIP candidates %q, want the resolved addresses of localhost", ips)
+	}
+	conn := openTunnel(t, client.Addr().String(), remoteTarget)
+	echoLarge(t, conn, []byte("fallback host"))
+	conn.Close()
+
+	// Reload 修改后重新解析，IP 直接使用
+	cfg.FallbackServerHost = "127.0.0.2"
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.GetServerIPStats(); len(stats) != 1 || stats[0].IP != "127.0.0.2" {
+		t.Fatalf("after reload ServerIP candidates = %+v, want 127.0.0.2", stats)
+	}
+
+	cfg.FallbackServerHost = "bad host"
+	if err := client.Reload(cfg); err == nil {
+		t.Fatal("invalid FallbackServerHost accepted")
+	}
+}
+
+// TestServerIPHints ServerIP 为空时使用 ECH 查询域名 HTTPS 记录中 ipv4hint、ipv6hint 给出的地址连接服务端，优先于 FallbackServerHost；
+// 设置 ServerIP 时不使用，记录中没有地址提示时仍使用 FallbackServerHost
+func TestServerIPHints(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	chain, _, ca := testCertChain(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	var accepted atomic.Int32
+	tlsAddr := serveTunnel(t, echoAddr, &chain, func(srv *httptest.Server) {
+		srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				accepted.Add(1)
+			}
+		}
+	})
+	echList := testECHConfigList(t, "public.echplus.test")
+	// 按 Cloudflare 应答的格式抓取的 HTTPS 记录 RDATA，ech 参数替换为测试配置，地址提示替换为本机地址
+	hinted := slices.Concat([]byte{
+		0x00, 0x01, 0x00, // SvcPriority 1，TargetName "."
+		0x00, 0x01, 0x00, 0x06, 0x02, 'h', '3', 0x02, 'h', '2', // alpn h3,h2
+		0x00, 0x04, 0x00, 0x08, 0x7f, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x02, // ipv4hint 127.0.0.1,127.0.0.2
+		0x00, 0x05,
+	}, binary.BigEndian.AppendUint16(nil, uint16(len(echList))), echList, []byte{
+		0x00, 0x06, 0x00, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, // ipv6hint ::1
+	})
+	plain := slices.Concat([]byte{0x00, 0x01, 0x00, 0x00, 0x05}, binary.BigEndian.AppendUint16(nil, uint16(len(echList))), echList)
+	records := map[string][]byte{"hinted.echplus.test": hinted, "plain.echplus.test": plain}
+	dns := startHTTPSDoH(t, func(name string) []byte { return records[name] })
+
+	ips := func(client *core.ProxyServer) []string {
+		var ips []string
+		for _, st := range client.GetServerIPStats() {
+			ips = append(ips, st.IP)
+		}
+		return ips
+	}
+	cfg := clientConfig(t, tlsAddr, testToken)
+	cfg.ServerAddr = "wss://" + tlsAddr + "/"
+	cfg.RootCAs = roots
+	cfg.DNSServer, cfg.ECHDomain = dns, "hinted.echplus.test"
+	cfg.ServerIP, cfg.FallbackServerHost = "", "192.0.2.1"
+	cfg.DialRetries = -1
+	client := startProxyServer(t, cfg)
+
+	if got, want := ips(client), []string{"127.0.0.1", "127.0.0.2", "::1"}; !slices.Equal(got, want) {
+		t.Fatalf("ServerIP candidates = %q, want the HTTPS record hints %q", got, want)
+	}
+	if got := client.GetConfig().ServerIP; got != "" {
+		t.Fatalf("GetConfig ServerIP = %q, want it left empty", got)
+	}
+	// 测试服务端不支持 ECH，连接会失败，但只在 127.0.0.1 监听：收到连接说明使用了地址提示而不是 FallbackServerHost
+	if conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget); err == nil {
+		conn.Close()
+	}
+	if accepted.Load() == 0 {
+		t.Fatal("the server hinted by ipv4hint was never dialed")
+	}
+	if text := client.ExplainHost("hinted.echplus.test"); !strings.Contains(text, "地址提示 127.0.0.1, 127.0.0.2, ::1") {
+		t.Fatalf("explain text does not list the hints:\n%s", text)
+	}
+
+	// 设置 ServerIP 时不使用地址提示，清空后恢复
+	cfg.ServerIP = "127.0.0.3"
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := ips(client); !slices.Equal(got, []string{"127.0.0.3"}) {
+		t.Fatalf("ServerIP candidates with ServerIP set = %q, want 127.0.0.3", got)
+	}
+	cfg.ServerIP = ""
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := ips(client); !slices.Equal(got, []string{"127.0.0.1", "127.0.0.2", "::1"}) {
+		t.Fatalf("ServerIP candidates after clearing ServerIP = %q, want the hints", got)
+	}
+
+	// 换用没有地址提示的 ECH 域名后使用 FallbackServerHost
+	cfg.ECHDomain = "plain.echplus.test"
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := ips(client); !slices.Equal(got, []string{"192.0.2.1"}) {
+		t.Fatalf("ServerIP candidates without hints = %q, want FallbackServerHost", got)
+	}
+}
+
+// TestHTTPSRecordALPN 与服务端握手时按 HTTPS 记录的 alpn 参数提供 ALPN：只提供连接能使用的协议，顺序与记录一致
+func TestHTTPSRecordALPN(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	chain, _, ca := testCertChain(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	offered := make(chan []string, 16)
+	tlsAddr := serveTunnel(t, echoAddr, &chain, func(srv *httptest.Server) {
+		srv.TLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case offered <- hello.SupportedProtos:
+			default:
+			}
+			return nil, nil
+		}
+	})
+	echList := testECHConfigList(t, "public.echplus.test")
+	// 与 cloudflare-ech.com 发布的 HTTPS 记录相同的参数和顺序，ech 参数替换为测试配置
+	cloudflare := slices.Concat([]byte{
+		0x00, 0x01, 0x00, // SvcPriority 1，TargetName "."
+		0x00, 0x01, 0x00, 0x06, 0x02, 'h', '3', 0x02, 'h', '2', // alpn h3,h2
+		0x00, 0x04, 0x00, 0x08, 104, 18, 10, 118, 104, 18, 11, 118, // ipv4hint 104.18.10.118,104.18.11.118
+		0x00, 0x05,
+	}, binary.BigEndian.AppendUint16(nil, uint16(len(echList))), echList, []byte{
+		0x00, 0x06, 0x00, 0x20, // ipv6hint 2606:4700::6812:a76,2606:4700::6812:b76
+		0x26, 0x06, 0x47, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0x68, 0x12, 0x0a, 0x76,
+		0x26, 0x06, 0x47, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0x68, 0x12, 0x0b, 0x76,
+	})
+	h2Only := slices.Concat([]byte{
+		0x00, 0x01, 0x00,
+		0x00, 0x01, 0x00, 0x03, 0x02, 'h', '2', // alpn h2
+		0x00, 0x02, 0x00, 0x00, // no-default-alpn
+		0x00, 0x05,
+	}, binary.BigEndian.AppendUint16(nil, uint16(len(echList))), echList)
+	records := map[string][]byte{"cloudflare-ech.com": cloudflare, "h2only.echplus.test": h2Only}
+	dns := startHTTPSDoH(t, func(name string) []byte { return records[name] })
+
+	for _, tc := range []struct {
+		domain string
+		h2     bool
+		want   []string
+	}{
+		// WebSocket 经 HTTP/1.1 升级，不能提供 h2；记录未禁用默认协议，http/1.1 可用
+		{"cloudflare-ech.com", false, []string{"http/1.1"}},
+		{"cloudflare-ech.com", true, []string{"h2", "http/1.1"}},
+		// 记录只支持 h2 时不提供 ALPN
+		{"h2only.echplus.test", false, nil},
+		{"h2only.echplus.test", true, []string{"h2"}},
+	} {
+		t.Run(fmt.Sprintf("%s h2=%v", tc.domain, tc.h2), func(t *testing.T) {
+			cfg := clientConfig(t, tlsAddr, testToken)
+			cfg.ServerAddr = "wss://" + tlsAddr + "/"
+			cfg.RootCAs = roots
+			cfg.DNSServer, cfg.ECHDomain = dns, tc.domain
+			cfg.HTTP2WebSocket = tc.h2
+			cfg.DialRetries = -1
+			client := startProxyServer(t, cfg)
+			for len(offered) > 0 {
+				<-offered
+			}
+			// 测试服务端不支持 ECH，连接会失败，只检查 ClientHello
+			if conn, err := dialSOCKS5(t, client.Addr().String(), remoteTarget); err == nil {
+				conn.Close()
+			}
+			select {
+			case got := <-offered:
+				if !slices.Equal(got, tc.want) {
+					t.Fatalf("offered ALPN = %q, want %q", got, tc.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the server received no ClientHello")
+			}
+		})
+	}
+
+	cfg := clientConfig(t, tlsAddr, testToken)
+	cfg.ServerAddr = "wss://" + tlsAddr + "/"
+	cfg.DNSServer, cfg.ECHDomain = dns, "cloudflare-ech.com"
+	client := startProxyServer(t, cfg)
+	text := client.ExplainHost("cloudflare-ech.com")
+	for _, want := range []string{"ALPN h3, h2, http/1.1", "地址提示 104.18.10.118, 104.18.11.118, 2606:4700::6812:a76, 2606:4700::6812:b76"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("explain text does not contain %q:\n%s", want, text)
+		}
+	}
+}
+
+// TestECHCache 查询成功的 ECH 配置写入 StoreDir，DoH 不可用时启动使用未过期的缓存
+func TestECHCache(t *testing.T) {
+	echList := testECHConfigList(t, "public.echplus.test")
+	var noECH atomic.Bool
+	dns := startHTTPSDoH(t, func(string) []byte {
+		if noECH.Load() {
+			return []byte{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2'} // 只有 alpn
+		}
+		rdata := []byte{0, 1, 0, 0, 5} // SvcPriority 1，TargetName "."，ech
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(echList)))
+		return append(rdata, echList...)
+	})
+	brokenDNS := "http://127.0.0.1:1/dns-query"
+	storeDir := t.TempDir()
+	start := func(dnsServer string, maxAge time.Duration) (*core.ProxyServer, error) {
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.ServerAddr = "wss://127.0.0.1:1/"
+		cfg.StoreDir = storeDir
+		cfg.DNSServer, cfg.ECHDomain = dnsServer, "cache.echplus.test"
+		cfg.ECHCacheMaxAge = maxAge
+		cfg.RequireECH = true
+		cfg.DialRetries = -1
+		client := core.NewProxyServer(cfg)
+		err := client.Start()
+		if err == nil {
+			t.Cleanup(func() { client.Stop() })
+		}
+		return client, err
+	}
+
+	client, err := start(dns, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Stop()
+	path := filepath.Join(storeDir, "ech_cache.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ECH cache not written: %v", err)
+	}
+	if !strings.Contains(string(data), `"cache.echplus.test"`) {
+		t.Fatalf("ECH cache does not contain the domain:\n%s", data)
+	}
+
+	client, err = start(brokenDNS, 0)
+	if err != nil {
+		t.Fatalf("start with the DoH server down and a cached config: %v", err)
+	}
+	if text := client.ExplainHost("example.com"); !strings.Contains(text, "来自缓存") {
+		t.Errorf("ExplainHost does not mark the config as cached:\n%s", text)
+	}
+	client.Stop()
+
+	// 记录暂时没有 ech 参数时同样使用缓存
+	noECH.Store(true)
+	if client, err = start(dns, 0); err != nil {
+		t.Fatalf("start with no ech parameter and a cached config: %v", err)
+	}
+	client.Stop()
+
+	t.Run("expired", func(t *testing.T) {
+		time.Sleep(20 * time.Millisecond)
+		if client, err := start(brokenDNS, 10*time.Millisecond); err == nil {
+			client.Stop()
+			t.Fatal("started with an expired cached config")
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		if client, err := start(brokenDNS, -1); err == nil {
+			client.Stop()
+			t.Fatal("started from the cache with ECHCacheMaxAge < 0")
+		}
+	})
+}
+
+// TestTokenFileReload -token-file 中的多个令牌均可握手；文件改变或收到 SIGHUP 时重新加载，
+// 只影响之后的握手，已建立的会话保持连接；无效的文件不替换当前令牌；
+// 重新加载后 /metrics 的默认令牌和 fleet 报告的签名改用新的第一个令牌
+func TestTokenFileReload(t *testing.T) {
+	serverAddr := startTunnelServer(t, startEchoServer(t))
+	prevToken := authToken
+	ctx, cancel := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-watching
+		authToken, tokenFile = prevToken, ""
+		clientTokens.Store(nil)
+	})
+	tokenFile = filepath.Join(t.TempDir(), "tokens")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(tokenFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# relay users\ntoken-a\n\ntoken-b\n")
+	content, err := readSecretFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadClientTokens(content); err != nil {
+		t.Fatal(err)
+	}
+	if authToken != "token-a" {
+		t.Fatalf("authToken = %q, want the first token", authToken)
+	}
+	hup := make(chan os.Signal, 1)
+	go func() {
+		defer close(watching)
+		watchTokenFile(ctx, 10*time.Millisecond, hup)
+	}()
+
+	connect := func(token string) (net.Conn, error) {
+		conn, err := dialSOCKS5(t, startClient(t, serverAddr, token), remoteTarget)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+		}
+		return conn, err
+	}
+	inFlight, err := connect("token-a")
+	if err != nil {
+		t.Fatalf("token-a: %v", err)
+	}
+	defer inFlight.Close()
+	if conn, err := connect("token-b"); err != nil {
+		t.Fatalf("token-b: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	waitReloaded := func(token string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !validClientToken(token); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not accepted after reload", token)
+			}
+		}
+	}
+	write("token-b\ntoken-c\n")
+	waitReloaded("token-c")
+	echoLarge(t, inFlight, []byte("still connected"))
+	// 未设置 -metrics-token 和 -collector-tokens 时，/metrics、收集端和报告签名都跟随当前文件的第一个令牌
+	prevMetricsToken, prevCollector := metricsToken, collector
+	defer func() { metricsToken, collector = prevMetricsToken, prevCollector }()
+	metricsToken = ""
+	if collector, err = newFleetCollector(""); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+	for token, want := range map[string]bool{"token-a": false, "token-b": true, "token-c": false} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if got := metricsAuthorized(req); got != want {
+			t.Errorf("metricsAuthorized(%s) = %v after reload, want %v", token, got, want)
+		}
+	}
+	report := fleetReport{Relay: "relay-a", IntervalSeconds: 60}
+	if err := sendFleetReport(context.Background(), http.DefaultClient, srv.URL+fleetReportPath, "token-a", report, time.Now()); err == nil {
+		t.Error("collector accepted a report signed with the revoked token-a")
+	}
+	reportCtx, stopReporter := context.WithCancel(context.Background())
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		runReporter(reportCtx, srv.URL+fleetReportPath, "relay-b", serverToken, time.Minute)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if relays, _ := collector.fleet(); len(relays) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("report signed by serverToken after reload was not accepted")
+		}
+	}
+	stopReporter()
+	<-reported
+	if conn, err := connect("token-a"); err == nil {
+		conn.Close()
+		t.Fatal("revoked token-a still accepted")
+	}
+	if conn, err := connect("token-c"); err != nil {
+		t.Fatalf("token-c: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// 大小和修改时间都不变时只有 SIGHUP 触发重新加载
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("token-b\ntoken-d\n")
+	if err := os.Chtimes(tokenFile, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if validClientToken("token-d") {
+		t.Fatal("reloaded without a change or SIGHUP")
+	}
+	hup <- syscall.SIGHUP
+	waitReloaded("token-d")
+
+	for name, content := range map[string]string{"empty": "\n", "comments only": "# none\n"} {
+		write(content)
+		if err := reloadTokenFile(); err == nil {
+			t.Fatalf("reloading an %s file succeeded", name)
+		}
+		if !validClientToken("token-d") {
+			t.Fatalf("tokens replaced by an %s file", name)
+		}
+	}
+}
+
+// TestECHRefresh 后台按 ECHRefreshInterval 刷新 ECH 配置：密钥轮换后无需连接失败即更新，
+// 刷新失败时保留当前配置并计入 GetECHStatus，间隔改为负数后停止刷新
+func TestECHRefresh(t *testing.T) {
+	var mu sync.Mutex
+	list, lookups := testECHConfigList(t, "public-a.echplus.test"), 0
+	dns := startECHDoHFunc(t, func(string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups++
+		return list
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return lookups
+	}
+	waitFor := func(what string, cond func(core.ECHStatus) bool, client *core.ProxyServer) core.ECHStatus {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if status := client.GetECHStatus(); cond(status) {
+				return status
+			} else if time.Now().After(deadline) {
+				t.Fatalf("%s: status %+v", what, status)
+			}
+		}
+	}
+
+	cfg := clientConfig(t, "127.0.0.1:1", testToken)
+	cfg.ServerAddr = "wss://127.0.0.1:1/"
+	cfg.DNSServer, cfg.ECHDomain = dns, "refresh.echplus.test"
+	cfg.ECHRefreshInterval = 50 * time.Millisecond
+	cfg.RequireECH = true
+	client := startProxyServer(t, cfg)
+	status := waitFor("background refresh", func(s core.ECHStatus) bool { return !s.LastRefreshAt.IsZero() }, client)
+	if status.RefreshInterval != cfg.ECHRefreshInterval || status.NextRefreshAt.IsZero() || len(status.Domains) != 1 ||
+		status.Domains[0].Domain != "refresh.echplus.test" || status.Domains[0].ConfigSize != len(list) {
+		t.Fatalf("status after refresh = %+v", status)
+	}
+	if n := count(); n < 2 {
+		t.Fatalf("lookups = %d, want the startup query and at least one refresh", n)
+	}
+
+	mu.Lock()
+	list = testECHConfigList(t, "public-b.echplus.test")
+	mu.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(client.ExplainHost("example.com"), "public-b.echplus.test"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated ECH config not picked up by the background refresh")
+		}
+	}
+
+	mu.Lock()
+	list = nil
+	mu.Unlock()
+	status = waitFor("failed refresh", func(s core.ECHStatus) bool { return s.ConsecutiveFailures > 0 }, client)
+	if status.LastError == "" || status.Domains[0].ConfigSize == 0 || status.Domains[0].LastError == "" {
+		t.Fatalf("status after a failed refresh = %+v, want the error recorded and the config kept", status)
+	}
+	mu.Lock()
+	list = testECHConfigList(t, "public-c.echplus.test")
+	mu.Unlock()
+	waitFor("recovery", func(s core.ECHStatus) bool { return s.ConsecutiveFailures == 0 && s.LastError == "" }, client)
+
+	cfg = client.GetConfig()
+	cfg.ECHRefreshInterval = -1
+	if err := client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("disabled", func(s core.ECHStatus) bool { return s.RefreshInterval == 0 && s.NextRefreshAt.IsZero() }, client)
+	before := count()
+	time.Sleep(200 * time.Millisecond)
+	if n := count(); n != before {
+		t.Fatalf("lookups went from %d to %d after disabling the background refresh", before, n)
+	}
+}
+
+// TestDoHServerFallback DNSServer 列出多个 DoH 服务器时跳过出错的服务器，之后从最近一次成功的开始查询；
+// 得到没有 HTTPS 记录的明确结果时不再尝试后面的服务器。主机@IP 直接连接该 IP，不解析主机
+func TestDoHServerFallback(t *testing.T) {
+	var goodLookups, badLookups atomic.Int32
+	list := testECHConfigList(t, "public.echplus.test")
+	good := startECHDoHFunc(t, func(string) []byte {
+		goodLookups.Add(1)
+		return list
+	})
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badLookups.Add(1)
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+	}))
+	t.Cleanup(bad.Close)
+	nodata := startECHDoHFunc(t, func(string) []byte { return nil })
+
+	echConfig := func(t *testing.T, dns string) core.Config {
+		cfg := clientConfig(t, "127.0.0.1:1", testToken)
+		cfg.ServerAddr = "wss://127.0.0.1:1/"
+		cfg.DNSServer, cfg.ECHDomain, cfg.RequireECH = dns, "fallback.echplus.test", true
+		return cfg
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		cfg := echConfig(t, bad.URL+"/dns-query, "+good)
+		cfg.ECHRefreshInterval = 20 * time.Millisecond
+		client := startProxyServer(t, cfg)
+		if d := client.GetECHStatus().Domains; len(d) != 1 || d[0].Resolver != good || d[0].ConfigSize != len(list) {
+			t.Fatalf("domains = %+v, want config from %s", d, good)
+		}
+		if n := badLookups.Load(); n != 1 {
+			t.Fatalf("rate limited server queried %d times at startup, want 1", n)
+		}
+		for deadline := time.Now().Add(5 * time.Second); goodLookups.Load() < 4; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("background refreshes did not reach %s", good)
+			}
+		}
+		if n := badLookups.Load(); n != 1 {
+			t.Fatalf("rate limited server queried %d times, want refreshes to start from the server that answered", n)
+		}
+		if text := client.ExplainHost("example.com"); !strings.Contains(text, "来自 "+good) {
+			t.Fatalf("explain does not name the resolver:\n%s", text)
+		}
+	})
+
+	t.Run("definite answer", func(t *testing.T) {
+		before := goodLookups.Load()
+		client := core.NewProxyServer(echConfig(t, nodata+","+good))
+		if err := client.Start(); err == nil {
+			client.Stop()
+			t.Fatal("client started without an HTTPS record")
+		}
+		if n := goodLookups.Load(); n != before {
+			t.Fatalf("second server queried %d times after a NODATA answer, want 0", n-before)
+		}
+	})
+
+	t.Run("bootstrap ip", func(t *testing.T) {
+		u, _ := url.Parse(good)
+		resolver := "http://doh.echplus.test:" + u.Port() + "@127.0.0.1/dns-query"
+		client := startProxyServer(t, echConfig(t, resolver))
+		if d := client.GetECHStatus().Domains; len(d) != 1 || d[0].Resolver != resolver || d[0].ConfigSize != len(list) {
+			t.Fatalf("domains = %+v, want config from %s", d, resolver)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		client := core.NewProxyServer(echConfig(t, good+",dns.echplus.test@not-an-ip/dns-query"))
+		if err := client.Start(); err == nil || !strings.Contains(err.Error(), "not-an-ip") {
+			client.Stop()
+			t.Fatalf("Start with an invalid bootstrap IP = %v", err)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 保活参数
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongWait     = 60 * time.Second
+	pingWriteTimeout    = 5 * time.Second
+	keepaliveTick       = time.Second // 时间轮精度
+)
+
+// 由 -ping-interval、-pong-timeout 设置，启动后不再修改
+var (
+	pingInterval = defaultPingInterval // 每个会话的 ping 间隔
+	pongWait     = defaultPongWait     // 读超时，收到 pong 或数据时重置
+)
+
+// validateKeepalive 检查保活参数：ping 间隔不小于时间轮精度，且必须小于读超时，
+// 否则连接正常的会话也会在两次 ping 之间超时
+func validateKeepalive(interval, timeout time.Duration) error {
+	if interval < keepaliveTick {
+		return fmt.Errorf("-ping-interval %v must be at least %v", interval, keepaliveTick)
+	}
+	if interval >= timeout {
+		return fmt.Errorf("-ping-interval %v must be less than -pong-timeout %v", interval, timeout)
+	}
+	return nil
+}
+
+// keepaliveWheel 所有会话共享的时间轮，由单个 goroutine 按 pingInterval 调度 ping，
+// 空闲会话不再各自持有 ticker goroutine。
+// 会话登记在当前槽位，时间轮转一圈（pingInterval）后再次到达该槽位时发送 ping
+type keepaliveWheel struct {
+	mu     sync.Mutex
+	slots  []map[uint64]func()
+	pos    int
+	nextID uint64
+	start  sync.Once
+	tick   time.Duration
+}
+
+// keepalive 默认间隔的时间轮，main 解析参数后按 -ping-interval 重建
+var keepalive = newKeepaliveWheel(pingInterval, keepaliveTick)
+
+func newKeepaliveWheel(interval, tick time.Duration) *keepaliveWheel {
+	n := int(interval / tick)
+	if n < 1 {
+		n = 1
+	}
+	slots := make([]map[uint64]func(), n)
+	for i := range slots {
+		slots[i] = make(map[uint64]func())
+	}
+	return &keepaliveWheel{slots: slots, tick: tick}
+}
+
+// add 登记 ping 回调，返回注销函数
+func (w *keepaliveWheel) add(ping func()) (remove func()) {
+	w.start.Do(func() { go w.run() })
+
+	w.mu.Lock()
+	id := w.nextID
+	w.nextID++
+	slot := w.pos
+	w.slots[slot][id] = ping
+	w.mu.Unlock()
+
+	return func() {
+		w.mu.Lock()
+		delete(w.slots[slot], id)
+		w.mu.Unlock()
+	}
+}
+
+// count 返回登记的会话数
+func (w *keepaliveWheel) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, slot := range w.slots {
+		n += len(slot)
+	}
+	return n
+}
+
+func (w *keepaliveWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.mu.Lock()
+		w.pos = (w.pos + 1) % len(w.slots)
+		due := make([]func(), 0, len(w.slots[w.pos]))
+		for _, ping := range w.slots[w.pos] {
+			due = append(due, ping)
+		}
+		w.mu.Unlock()
+
+		// 写 ping 可能阻塞到 pingWriteTimeout，放到独立 goroutine 避免拖慢时间轮
+		for _, ping := range due {
+			go ping()
+		}
+	}
+}
+
+// startKeepalive 设置读超时和 pong 处理，并在时间轮上登记定期 ping。
+// mu 和 closed 为会话保护 ws 写入的锁和关闭标记
+func startKeepalive(ws *websocket.Conn, mu *sync.Mutex, closed *bool) (stop func()) {
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	return keepalive.add(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if *closed {
+			return
+		}
+		ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout))
+	})
+}
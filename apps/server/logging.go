@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/atticus6/echPlus/apps/client/logging"
+)
+
+// 日志流。指定 -log-dir 时每条日志只写入其中一个流:
+//   - access: 会话结束记录、令牌错误和连接数超限等接入事件
+//   - error:  WARN 和 ERROR 级别的日志
+//   - info:   其余日志
+const (
+	streamAccess = "access"
+	streamError  = "error"
+	streamInfo   = "info"
+)
+
+// serverLog 未设置时日志写入标准错误
+var serverLog atomic.Pointer[logging.Logger]
+
+// logEvent 写入一条日志，未指定 -log-dir 时保持原有的 "[级别] 消息" 格式输出到标准错误
+func logEvent(stream string, level logging.Level, msg string, fields ...logging.Field) {
+	l := serverLog.Load()
+	if l == nil {
+		for _, f := range fields {
+			msg += fmt.Sprintf(" %s=%v", f.Key, f.Value)
+		}
+		log.Printf("[%s] %s", level, msg)
+		return
+	}
+	if err := l.Log(stream, level, msg, fields...); err != nil {
+		log.Printf("[WARN] Failed to write %s log: %v", stream, err)
+	}
+}
+
+func logInfo(format string, v ...any) {
+	logEvent(streamInfo, logging.LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func logWarn(format string, v ...any) {
+	logEvent(streamError, logging.LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func logError(format string, v ...any) {
+	logEvent(streamError, logging.LevelError, fmt.Sprintf(format, v...))
+}
+
+// logFatal 记录错误后退出，指定 -log-dir 时同时写入 error 流和标准错误
+func logFatal(format string, v ...any) {
+	if l := serverLog.Load(); l != nil {
+		logError(format, v...)
+		l.Close()
+	}
+	log.Fatalf(format, v...)
+}
+
+// logAccess 记录被拒绝的接入请求
+func logAccess(format string, v ...any) {
+	logEvent(streamAccess, logging.LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// logSession 将会话结束记录写入 access 流，字段与 -accesslog 的 JSON 相同。
+// 未指定 -log-dir 时不输出，会话结束已由 "Session ended" 记录
+func logSession(r accessRecord) {
+	if serverLog.Load() == nil {
+		return
+	}
+	logEvent(streamAccess, logging.LevelInfo, "session closed",
+		logging.F("session", r.Session),
+		logging.F("protocol", r.Protocol),
+		logging.F("client", r.Client),
+		logging.F("target", r.Target),
+		logging.F("start", r.Start),
+		logging.F("end", r.End),
+		logging.F("duration_ms", r.DurationMs),
+		logging.F("bytes_up", r.BytesUp),
+		logging.F("bytes_down", r.BytesDown),
+		logging.F("close_reason", r.CloseReason))
+}
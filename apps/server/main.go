@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
 	"context"
 	"encoding/binary"
 	"flag"
@@ -10,11 +12,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/atticus6/echPlus/apps/client/logging"
+	"github.com/atticus6/echPlus/apps/client/protocol"
 	"github.com/atticus6/echPlus/apps/server/tunnel"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -24,6 +29,37 @@ var (
 	uuidStr      string
 	port         int64
 	enableTunnel bool
+	authToken    string
+	rateLimit    int64
+	rateKey      string
+	trustProxies string
+	maxConns     int64
+	allowTargets string
+	denyTargets  string
+	allowPrivate bool
+	bindEnabled  bool
+	bindHost     string
+	bindPorts    string
+	bindPortLo   int
+	bindPortHi   int
+	accessPath   string
+	accessMaxMB  int64
+	logDir       string
+	logFormat    string
+	logMaxMB     int64
+	logMaxAge    int64
+	compression  bool
+	compLevel    int64
+	h2c          bool
+	acmeDomains  string
+	acmeCache    string
+	acmeEmail    string
+	acmeHTTPPort int64
+	acmeStaging  bool
+	tlsPort      int64
+	filesDir     string
+	fileNames    string
+	filesMaxMB   int64
 	userUUID     uuid.UUID
 )
 
@@ -32,11 +68,111 @@ func init() {
 	defaultUUID := "147258369-1234-5678-9abc-def012345678"
 	defaultPort := int64(3325)
 	defaultTunnel := true
+	defaultToken := "147258369"
+	defaultRate := int64(0)
+	defaultRateKey := rateKeyToken
+	defaultMaxConns := int64(0)
+	defaultAccessMaxMB := int64(100)
+	defaultLogMaxMB := int64(100)
+	defaultLogMaxAge := int64(7)
+	defaultResumeGrace := 30 * time.Second
+	defaultResumeBuffer := int64(1 << 20)
+	defaultCompLevel := int64(flate.BestSpeed)
+	defaultACMEHTTPPort := int64(80)
+	defaultFilesMaxMB := int64(64)
+	defaultTLSPort := int64(443)
+	defaultACMECache := "acme-cache"
+	if envCache := os.Getenv("ACME_CACHE"); envCache != "" {
+		defaultACMECache = envCache
+	}
+	defaultPing := defaultPingInterval
+	defaultReportInterval := time.Minute
+	defaultReportName, _ := os.Hostname()
+	defaultPong := defaultPongWait
 
 	// 环境变量覆盖默认值
 	if envUUID := os.Getenv("UUID"); envUUID != "" {
 		defaultUUID = envUUID
 	}
+	if envToken := os.Getenv("TOKEN"); envToken != "" {
+		defaultToken = envToken
+	}
+	if envRate := os.Getenv("RATE"); envRate != "" {
+		if r, err := parseInt64(envRate); err == nil {
+			defaultRate = r
+		}
+	}
+	if envRateKey := os.Getenv("RATE_KEY"); envRateKey != "" {
+		defaultRateKey = envRateKey
+	}
+	if envMaxConns := os.Getenv("MAX_CONNS"); envMaxConns != "" {
+		if n, err := parseInt64(envMaxConns); err == nil {
+			defaultMaxConns = n
+		}
+	}
+	if envMaxMB := os.Getenv("ACCESS_LOG_MAX_SIZE"); envMaxMB != "" {
+		if n, err := parseInt64(envMaxMB); err == nil {
+			defaultAccessMaxMB = n
+		}
+	}
+	if envMaxMB := os.Getenv("LOG_MAX_SIZE"); envMaxMB != "" {
+		if n, err := parseInt64(envMaxMB); err == nil {
+			defaultLogMaxMB = n
+		}
+	}
+	if envMaxAge := os.Getenv("LOG_MAX_AGE"); envMaxAge != "" {
+		if n, err := parseInt64(envMaxAge); err == nil {
+			defaultLogMaxAge = n
+		}
+	}
+	if envGrace := os.Getenv("RESUME_GRACE"); envGrace != "" {
+		if d, err := time.ParseDuration(envGrace); err == nil {
+			defaultResumeGrace = d
+		}
+	}
+	if envBuffer := os.Getenv("RESUME_BUFFER"); envBuffer != "" {
+		if n, err := parseInt64(envBuffer); err == nil {
+			defaultResumeBuffer = n
+		}
+	}
+	if envLevel := os.Getenv("COMPRESSION_LEVEL"); envLevel != "" {
+		if n, err := parseInt64(envLevel); err == nil {
+			defaultCompLevel = n
+		}
+	}
+	if envPort := os.Getenv("ACME_HTTP_PORT"); envPort != "" {
+		if n, err := parseInt64(envPort); err == nil {
+			defaultACMEHTTPPort = n
+		}
+	}
+	if envMaxMB := os.Getenv("FILES_MAX_SIZE"); envMaxMB != "" {
+		if n, err := parseInt64(envMaxMB); err == nil {
+			defaultFilesMaxMB = n
+		}
+	}
+	if envPort := os.Getenv("TLS_PORT"); envPort != "" {
+		if n, err := parseInt64(envPort); err == nil {
+			defaultTLSPort = n
+		}
+	}
+	if envPing := os.Getenv("PING_INTERVAL"); envPing != "" {
+		if d, err := time.ParseDuration(envPing); err == nil {
+			defaultPing = d
+		}
+	}
+	if envPong := os.Getenv("PONG_TIMEOUT"); envPong != "" {
+		if d, err := time.ParseDuration(envPong); err == nil {
+			defaultPong = d
+		}
+	}
+	if envInterval := os.Getenv("REPORT_INTERVAL"); envInterval != "" {
+		if d, err := time.ParseDuration(envInterval); err == nil {
+			defaultReportInterval = d
+		}
+	}
+	if envName := os.Getenv("REPORT_NAME"); envName != "" {
+		defaultReportName = envName
+	}
 	if envPort := os.Getenv("PORT"); envPort != "" {
 		if p, err := parseInt64(envPort); err == nil {
 			defaultPort = p
@@ -46,6 +182,48 @@ func init() {
 	flag.StringVar(&uuidStr, "uuid", defaultUUID, "VLESS UUID (env: UUID)")
 	flag.Int64Var(&port, "port", defaultPort, "Server Port (env: PORT)")
 	flag.BoolVar(&enableTunnel, "tunnel", defaultTunnel, "Enable Argo Tunnel (env: TUNNEL)")
+	flag.StringVar(&authToken, "token", defaultToken, "echPlus client token; prefer -token-file or TOKEN, since flags show up in ps and shell history (env: TOKEN)")
+	flag.StringVar(&tokenFile, "token-file", os.Getenv("TOKEN_FILE"), "Read client tokens from this file, one per line; reloaded on change or SIGHUP without dropping sessions, the first token of the current file also signs fleet reports; it must not be readable by all users (env: TOKEN_FILE)")
+	flag.Int64Var(&rateLimit, "rate", defaultRate, "Bandwidth limit in bytes/sec per token or IP, 0 = unlimited (env: RATE)")
+	flag.StringVar(&rateKey, "rate-key", defaultRateKey, "Share the rate limit per \"token\" or per \"ip\" (env: RATE_KEY)")
+	flag.StringVar(&trustProxies, "trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Comma-separated CIDRs or IPs whose CF-Connecting-IP header is used as the client IP for -rate-key ip, e.g. \"127.0.0.1\" behind a local cloudflared; the header is ignored from other peers (env: TRUSTED_PROXIES)")
+	flag.StringVar(&allowTargets, "allow", os.Getenv("ALLOW"), "Comma-separated target allowlist, e.g. \"*.example.com,10.0.0.0/8:443\" (env: ALLOW)")
+	flag.StringVar(&denyTargets, "deny", os.Getenv("DENY"), "Comma-separated target denylist; port 25 is denied unless allowed (env: DENY)")
+	flag.BoolVar(&allowPrivate, "allow-private", os.Getenv("ALLOW_PRIVATE") == "true", "Allow connecting to private, loopback and link-local addresses (env: ALLOW_PRIVATE)")
+	flag.BoolVar(&bindEnabled, "bind", os.Getenv("BIND") == "true", "Accept SOCKS5 BIND: listen on this server for one inbound connection from the target (e.g. active FTP); the port must be reachable directly, not through a CDN or Argo tunnel (env: BIND)")
+	flag.StringVar(&bindHost, "bind-host", os.Getenv("BIND_HOST"), "Public address reported to BIND clients, defaults to the local IP of the WebSocket connection (env: BIND_HOST)")
+	flag.StringVar(&bindPorts, "bind-ports", os.Getenv("BIND_PORTS"), "Port range for BIND listeners, e.g. \"40000-40100\", defaults to any free port (env: BIND_PORTS)")
+	flag.Int64Var(&maxConns, "maxconns", defaultMaxConns, "Max concurrent WebSocket connections, 0 = unlimited (env: MAX_CONNS)")
+	flag.DurationVar(&resumeGrace, "resume-grace", defaultResumeGrace, "Keep the target connection this long after a client WebSocket drops so it can resume, 0 = disable (env: RESUME_GRACE)")
+	flag.Int64Var(&resumeBuffer, "resume-buffer", defaultResumeBuffer, "Bytes of downstream data kept per resumable session for replay (env: RESUME_BUFFER)")
+	flag.DurationVar(&pingInterval, "ping-interval", defaultPing, "WebSocket ping interval per session (env: PING_INTERVAL)")
+	flag.DurationVar(&pongWait, "pong-timeout", defaultPong, "Close a session when the client sends no pong or data for this long; must exceed -ping-interval (env: PONG_TIMEOUT)")
+	flag.BoolVar(&compression, "compression", os.Getenv("COMPRESSION") == "true", "Accept permessage-deflate from clients that request it; only helps uncompressed, unencrypted traffic (env: COMPRESSION)")
+	flag.Int64Var(&compLevel, "compression-level", defaultCompLevel, "Deflate level for -compression: 1 (fastest) to 9 (smallest), -2 = Huffman only (env: COMPRESSION_LEVEL)")
+	flag.BoolVar(&h2c, "h2c", os.Getenv("H2C") == "true", "Also accept cleartext HTTP/2 (h2c) and WebSocket over HTTP/2 extended CONNECT (RFC 8441); requires GODEBUG=http2xconnect=1 (env: H2C)")
+	flag.StringVar(&acmeDomains, "acme-domain", os.Getenv("ACME_DOMAIN"), "Comma-separated domains to get Let's Encrypt certificates for; serves TLS on -tls-port alongside the plaintext -port (env: ACME_DOMAIN)")
+	flag.StringVar(&acmeCache, "acme-cache", defaultACMECache, "Directory that keeps ACME certificates and the account key across restarts (env: ACME_CACHE)")
+	flag.StringVar(&acmeEmail, "acme-email", os.Getenv("ACME_EMAIL"), "Contact email for the ACME account, used for expiry notices (env: ACME_EMAIL)")
+	flag.Int64Var(&acmeHTTPPort, "acme-http-port", defaultACMEHTTPPort, "Port answering HTTP-01 challenges, 0 = use TLS-ALPN-01 on -tls-port only (env: ACME_HTTP_PORT)")
+	flag.BoolVar(&acmeStaging, "acme-staging", os.Getenv("ACME_STAGING") == "true", "Use the Let's Encrypt staging CA and fall back to a self-signed certificate when issuance fails, for testing (env: ACME_STAGING)")
+	flag.Int64Var(&tlsPort, "tls-port", defaultTLSPort, "Native TLS port used with -acme-domain (env: TLS_PORT)")
+	flag.StringVar(&metricsToken, "metrics-token", os.Getenv("METRICS_TOKEN"), "Token required by /metrics (Bearer header or ?token=), defaults to -token (env: METRICS_TOKEN)")
+	flag.StringVar(&metricsTokenFile, "metrics-token-file", os.Getenv("METRICS_TOKEN_FILE"), "Read -metrics-token from this file; it must not be readable by all users (env: METRICS_TOKEN_FILE)")
+	flag.StringVar(&filesDir, "files-dir", os.Getenv("FILES_DIR"), "Directory of files listed in -files, served to clients with the -token at /files/<name> (env: FILES_DIR)")
+	flag.StringVar(&fileNames, "files", os.Getenv("FILES"), "Comma-separated file names in -files-dir that clients may download, e.g. \"chn_ip.txt,chn_ip_v6.txt\"; other files are never served (env: FILES)")
+	flag.Int64Var(&filesMaxMB, "files-max-size", defaultFilesMaxMB, "Refuse to serve -files larger than this many MB (env: FILES_MAX_SIZE)")
+	flag.StringVar(&accessPath, "accesslog", os.Getenv("ACCESS_LOG"), "Append a JSON line per session to this file, reopened on SIGHUP (env: ACCESS_LOG)")
+	flag.Int64Var(&accessMaxMB, "accesslog-max-size", defaultAccessMaxMB, "Rotate the access log to <file>.1 after this many MB, 0 = never (env: ACCESS_LOG_MAX_SIZE)")
+	flag.StringVar(&logDir, "log-dir", os.Getenv("LOG_DIR"), "Write logs to daily access_<date>.log, error_<date>.log and info_<date>.log files in this directory instead of stderr (env: LOG_DIR)")
+	flag.StringVar(&logFormat, "log-format", os.Getenv("LOG_FORMAT"), "Format of -log-dir files: text or json (env: LOG_FORMAT)")
+	flag.Int64Var(&logMaxMB, "log-max-size", defaultLogMaxMB, "Start a new -log-dir file after this many MB, 0 = rotate daily only (env: LOG_MAX_SIZE)")
+	flag.StringVar(&reportTo, "report-to", os.Getenv("REPORT_TO"), "Periodically POST an aggregate report (sessions, bytes, error counts, version; no targets or client IPs) signed with -token to this collector URL, e.g. \"https://fleet.example.com/fleet/report\"; off by default (env: REPORT_TO)")
+	flag.DurationVar(&reportInterval, "report-interval", defaultReportInterval, "Interval between -report-to reports, at least 10s (env: REPORT_INTERVAL)")
+	flag.StringVar(&reportName, "report-name", defaultReportName, "Relay name sent with -report-to reports, defaults to the hostname (env: REPORT_NAME)")
+	flag.BoolVar(&collectorMode, "collector", os.Getenv("COLLECTOR") == "true", "Accept -report-to reports at /fleet/report and serve the combined view at /fleet, authorized like /metrics (env: COLLECTOR)")
+	flag.StringVar(&collectorTokens, "collector-tokens", os.Getenv("COLLECTOR_TOKENS"), "Comma-separated relay tokens whose signed reports -collector accepts, defaults to -token (env: COLLECTOR_TOKENS)")
+	flag.StringVar(&collectorTokensFile, "collector-tokens-file", os.Getenv("COLLECTOR_TOKENS_FILE"), "Read -collector-tokens from this file; it must not be readable by all users (env: COLLECTOR_TOKENS_FILE)")
+	flag.Int64Var(&logMaxAge, "log-max-age", defaultLogMaxAge, "Delete -log-dir files older than this many days, 0 = keep all (env: LOG_MAX_AGE)")
 }
 
 func parseInt64(s string) (int64, error) {
@@ -56,44 +234,166 @@ func parseInt64(s string) (int64, error) {
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
-	ReadBufferSize:  32 * 1024,
-	WriteBufferSize: 32 * 1024,
+	ReadBufferSize:  relayBufferSize,
+	WriteBufferSize: relayBufferSize,
 }
 
 func main() {
 	flag.Parse()
 
+	// 凭据文件先于其他依赖 -token 的设置读取，命令行上直接给出的凭据在日志初始化后提示
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	plainSecrets, err := loadSecretFiles(set)
+	if err != nil {
+		log.Fatalf("Invalid secret settings: %v", err)
+	}
+	if tokenFile != "" {
+		if err := loadClientTokens(authToken); err != nil {
+			log.Fatalf("Invalid -token-file: %v", err)
+		}
+	}
+
 	// 解析 UUID
-	var err error
 	userUUID, err = uuid.Parse(uuidStr)
 	if err != nil {
 		log.Fatalf("Invalid UUID: %v", err)
 	}
+	if acl, err = newTargetACL(allowTargets, denyTargets); err != nil {
+		log.Fatalf("Invalid target rules: %v", err)
+	}
+	if files, err = newFileShare(filesDir, fileNames, filesMaxMB<<20); err != nil {
+		log.Fatalf("Invalid -files settings: %v", err)
+	}
+	if bindPortLo, bindPortHi, err = bindPortRange(bindPorts); err != nil {
+		log.Fatalf("Invalid -bind-ports: %v", err)
+	}
+	if err := validRateKey(rateKey); err != nil {
+		log.Fatalf("Invalid -rate-key %q: %v", rateKey, err)
+	}
+	if trustedProxies, err = parseTrustedProxies(trustProxies); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	upgrader.EnableCompression = compression
+	if compLevel != flate.HuffmanOnly && (compLevel < flate.BestSpeed || compLevel > flate.BestCompression) {
+		log.Fatalf("Invalid compression level %d: must be 1-9 or -2", compLevel)
+	}
+	if err := validateKeepalive(pingInterval, pongWait); err != nil {
+		log.Fatalf("Invalid keepalive: %v", err)
+	}
+	keepalive = newKeepaliveWheel(pingInterval, keepaliveTick)
+	// Go 的 HTTP/2 服务端只在启动时读取 GODEBUG，无法在进程内开启扩展 CONNECT
+	if h2c && !h2xconnectEnabled(os.Getenv("GODEBUG")) {
+		log.Fatal("-h2c requires GODEBUG=http2xconnect=1 in the environment")
+	}
+
+	if logDir != "" {
+		format, err := logging.ParseFormat(logFormat)
+		if err != nil {
+			log.Fatalf("Invalid log format: %v", err)
+		}
+		opts := logging.Options{Format: format, MaxSize: logMaxMB << 20, MaxAge: int(logMaxAge)}
+		l, err := logging.New(logDir, opts)
+		if err != nil {
+			log.Fatalf("Failed to open log directory: %v", err)
+		}
+		serverLog.Store(l)
+		defer l.Close()
+		log.Printf("Logging to %s", logDir)
+	}
+
+	for _, f := range plainSecrets {
+		logWarn("-%s on the command line is visible to other local users in ps and shell history; use -%s-file or %s instead", f.name, f.name, f.env)
+	}
+
+	if files != nil {
+		logInfo("Serving %d file(s) from %s at /files/", len(files.names), filesDir)
+	}
+	if collectorMode {
+		if collector, err = newFleetCollector(collectorTokens); err != nil {
+			log.Fatalf("Invalid -collector settings: %v", err)
+		}
+		logInfo("Collecting fleet reports at %s, combined view at /fleet", fleetReportPath)
+	}
+	if reportTo != "" {
+		if err := validateReportTo(reportTo); err != nil {
+			log.Fatalf("Invalid -report-to: %v", err)
+		}
+		if authToken == "" {
+			log.Fatal("-report-to requires -token to sign reports")
+		}
+		if reportInterval < minReportInterval {
+			log.Fatalf("Invalid -report-interval %v: must be at least %v", reportInterval, minReportInterval)
+		}
+		if reportName == "" || len(reportName) > fleetMaxNameLen {
+			log.Fatalf("Invalid -report-name %q: must be 1-%d bytes", reportName, fleetMaxNameLen)
+		}
+	}
+
+	if accessPath != "" {
+		if accessLog, err = openAccessLog(accessPath, accessMaxMB<<20); err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		defer accessLog.close()
+		logInfo("Access log: %s", accessPath)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := accessLog.reopen(); err != nil {
+					logWarn("Failed to reopen access log: %v", err)
+				}
+			}
+		}()
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// 启动 Argo 隧道
+	connections.max = maxConns
+	go connections.logActive(ctx)
+
+	if tokenFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go watchTokenFile(ctx, tokenFilePollInterval, hup)
+		logInfo("Accepting %d client token(s) from %s, reloaded on change or SIGHUP", len(*clientTokens.Load()), tokenFile)
+	}
+
+	if reportTo != "" {
+		logInfo("Sending fleet reports as %q to %s every %v", reportName, reportTo, reportInterval)
+		go runReporter(ctx, reportTo, reportName, serverToken, reportInterval)
+	}
+
+	// 启动 Argo 隧道，tunnelDone 在隧道建立或失败后关闭
 	var tun *tunnel.Tunnel
+	tunnelDone := make(chan struct{})
 	if enableTunnel {
 		tun = tunnel.New(int(port))
 		go func() {
+			defer close(tunnelDone)
 			if err := tun.Start(ctx); err != nil {
-				log.Printf("[WARN] Failed to start Argo tunnel: %v", err)
+				logWarn("Failed to start Argo tunnel: %v", err)
 			}
 		}()
+	} else {
+		close(tunnelDone)
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handler)
-	mux.HandleFunc("/health", healthHandler)
+	mux := newMux()
+	server := newHTTPServer(fmt.Sprintf(":%d", port), mux)
+	if h2c {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		logInfo("Accepting WebSocket over HTTP/2 (h2c)")
+	}
 
-	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	// 本机 TLS 监听与明文监听共用同一组处理器，CDN 前置的部署仍可使用明文端口
+	var tlsServer, challengeServer *http.Server
+	if acmeDomains != "" {
+		tlsServer, challengeServer = startACME(ctx, server, mux)
 	}
 
 	// 优雅关闭
@@ -102,7 +402,10 @@ func main() {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 
-		log.Println("Shutting down server...")
+		logInfo("Shutting down server...")
+		if _, err := sdNotify(sdStopping); err != nil {
+			logWarn("Failed to notify systemd: %v", err)
+		}
 		cancel()
 
 		if tun != nil {
@@ -112,20 +415,127 @@ func main() {
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer shutdownCancel()
 
+		for _, srv := range []*http.Server{tlsServer, challengeServer} {
+			if srv != nil {
+				srv.Shutdown(shutdownCtx)
+			}
+		}
 		if err := server.Shutdown(shutdownCtx); err != nil {
-			log.Printf("Server shutdown error: %v", err)
+			logError("Server shutdown error: %v", err)
 		}
 	}()
 
-	log.Printf("VLESS Server listening on :%d", port)
-	log.Printf("UUID: %s", userUUID.String())
+	logInfo("VLESS Server listening on :%d", port)
+	logInfo("UUID: %s", userUUID.String())
 	if enableTunnel {
-		log.Println("Argo tunnel enabled, waiting for URL...")
+		logInfo("Argo tunnel enabled, waiting for URL...")
 	}
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logFatal("Server error: %v", err)
+	}
+
+	// 监听和隧道就绪后通知 systemd（Type=notify），启用 WatchdogSec 时定期自检并发送心跳
+	go func() {
+		select {
+		case <-tunnelDone:
+		case <-ctx.Done():
+			return
+		}
+		if sent, err := sdNotify(sdReady); err != nil {
+			logWarn("Failed to notify systemd: %v", err)
+		} else if sent {
+			logInfo("Notified systemd: ready")
+		}
+		if interval := watchdogInterval(); interval > 0 {
+			go runWatchdog(ctx, interval, healthCheck(fmt.Sprintf("127.0.0.1:%d", port), interval/2))
+		}
+	}()
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		logFatal("Server error: %v", err)
+	}
+	logInfo("Server stopped")
+}
+
+// newMux 隧道、伪装页面、健康检查、指标、文件下载和中继报告的处理器，明文和 TLS 监听共用
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/files/", filesHandler)
+	mux.HandleFunc(fleetReportPath, fleetReportHandler)
+	mux.HandleFunc("/fleet", fleetHandler)
+	return mux
+}
+
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      h,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  120 * time.Second,
 	}
-	log.Println("Server stopped")
+}
+
+// startACME 按 -acme-* 参数在 -tls-port 上启动自动证书的 TLS 监听，并在 -acme-http-port 上响应 HTTP-01 验证。
+// -acme-http-port 与 -port 相同时由明文监听 plain 响应验证，不再单独监听。监听失败时退出
+func startACME(ctx context.Context, plain *http.Server, mux http.Handler) (tlsServer, challengeServer *http.Server) {
+	a, err := newACME(acmeOptions{
+		domains:  strings.Split(acmeDomains, ","),
+		cacheDir: acmeCache,
+		email:    acmeEmail,
+		staging:  acmeStaging,
+	})
+	if err != nil {
+		logFatal("Invalid ACME settings: %v", err)
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	err = checkACMEDomains(checkCtx, net.DefaultResolver, a.domains)
+	cancel()
+	if err != nil {
+		if !acmeStaging {
+			logFatal("ACME domain check failed: %v", err)
+		}
+		logWarn("ACME domain check failed: %v", err)
+	}
+	if acmeHTTPPort != 80 && tlsPort != 443 {
+		logWarn("Let's Encrypt validates only on ports 80 and 443; forward one of them to -acme-http-port %d or -tls-port %d", acmeHTTPPort, tlsPort)
+	}
+
+	switch {
+	case acmeHTTPPort == 0:
+	case acmeHTTPPort == port:
+		plain.Handler = a.manager.HTTPHandler(plain.Handler)
+	default:
+		// 验证以外的请求重定向到 HTTPS
+		challengeServer = newHTTPServer(fmt.Sprintf(":%d", acmeHTTPPort), a.manager.HTTPHandler(nil))
+		ln, err := net.Listen("tcp", challengeServer.Addr)
+		if err != nil {
+			logFatal("Failed to listen for ACME HTTP-01 challenges on port %d: %v%s; set -acme-http-port 0 to use TLS-ALPN-01 only", acmeHTTPPort, err, listenHint(acmeHTTPPort, err))
+		}
+		go func() {
+			if err := challengeServer.Serve(ln); err != http.ErrServerClosed {
+				logFatal("ACME challenge server error: %v", err)
+			}
+		}()
+	}
+
+	tlsServer = newHTTPServer(fmt.Sprintf(":%d", tlsPort), mux)
+	tlsServer.TLSConfig = a.tlsConfig()
+	ln, err := net.Listen("tcp", tlsServer.Addr)
+	if err != nil {
+		logFatal("Failed to listen on TLS port %d: %v%s", tlsPort, err, listenHint(tlsPort, err))
+	}
+	go func() {
+		if err := tlsServer.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+			logFatal("TLS server error: %v", err)
+		}
+	}()
+	logInfo("TLS listening on :%d for %s (ACME cache %s)", tlsPort, strings.Join(a.domains, ", "), acmeCache)
+	return tlsServer, challengeServer
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -134,26 +544,97 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	if isExtendedConnect(r) {
+		w, r = adaptExtendedConnect(w, r)
+	}
 	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
 
 	if upgrade != "websocket" {
 		if r.URL.Path == "/" {
 			w.Write([]byte("Bad Request"))
 		} else {
-			log.Printf("[WARN] Expected WebSocket, got Upgrade: %s", r.Header.Get("Upgrade"))
+			logAccess("Expected WebSocket, got Upgrade: %s", r.Header.Get("Upgrade"))
 			http.Error(w, "Expected WebSocket", http.StatusUpgradeRequired)
 		}
 		return
 	}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	// echPlus 客户端通过子协议携带令牌，未携带子协议的按 VLESS 处理
+	protocols := websocket.Subprotocols(r)
+	echPlusClient := len(protocols) > 0
+	if echPlusClient && !validClientToken(protocols[0]) {
+		metrics.unauthorized.Add(1)
+		logAccess("Invalid token from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !connections.acquire() {
+		metrics.connLimitRejects.Add(1)
+		logAccess("Connection limit reached (%d), rejecting %s", connections.max, r.RemoteAddr)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	lease := &sessionLease{}
+	defer lease.release()
+
+	sessionID := newSessionID()
+	responseHeader := http.Header{"X-Session-ID": {sessionID}}
+	var codec protocol.Codec = protocol.TextCodec{}
+	if echPlusClient {
+		// 客户端在令牌之后按优先顺序列出支持的帧格式，选中第一个支持的子协议
+		// （ResumeSubprotocol 需启用 -resume-grace，均可带 PaddingSuffix），都不支持时回显令牌
+		selected := protocols[0]
+		for _, p := range protocols[1:] {
+			if base, _ := protocol.SplitSubprotocol(p); base == protocol.FramingSubprotocol || (base == protocol.ResumeSubprotocol && resumeGrace > 0) {
+				selected = p
+				break
+			}
+		}
+		responseHeader.Set("Sec-WebSocket-Protocol", selected)
+		codec = protocol.CodecForSubprotocol(selected)
+	}
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		log.Printf("[ERROR] WebSocket upgrade failed: %v", err)
+		metrics.upgradeFailures.Add(1)
+		logError("WebSocket upgrade failed: %v", err)
 		return
 	}
+	// 未协商压缩时设置无效果
+	ws.SetCompressionLevel(int(compLevel))
+	ws.SetReadLimit(protocol.MaxMessageSize)
+	// net/http 在劫持连接时已清除 ReadTimeout/WriteTimeout 的截止时间，长连接不受其限制
+	// （见 TestSessionOutlivesServerTimeouts），保活由会话自身的读超时负责
+
+	kind := "vless"
+	if echPlusClient {
+		kind = "echplus"
+	}
+	info := sessions.add(sessionID, kind, r.RemoteAddr)
+	defer func() {
+		record := info.accessRecord()
+		accessLog.write(record)
+		logSession(record)
+		sessions.remove(sessionID)
+	}()
 
-	log.Printf("[INFO] New connection from %s", r.RemoteAddr)
-	handleVLESSSession(ws, r.RemoteAddr)
+	credential := uuidStr
+	if echPlusClient {
+		credential = protocols[0]
+	}
+	lease.key = rateLimitKey(r, credential)
+	lease.limiter = rateLimiters.acquire(lease.key)
+
+	logInfo("New connection from %s (session %s)", r.RemoteAddr, sessionID)
+	if echPlusClient {
+		if base, _ := protocol.SplitSubprotocol(ws.Subprotocol()); base == protocol.ResumeSubprotocol {
+			handleResumableSession(ws, info, lease)
+			return
+		}
+		handleSession(ws, info, codec, lease.limiter, nil)
+		return
+	}
+	handleVLESSSession(ws, info, lease.limiter)
 }
 
 // VLESS 协议常量
@@ -175,7 +656,8 @@ const (
 	cmdMux = 3
 )
 
-func handleVLESSSession(ws *websocket.Conn, clientAddr string) {
+func handleVLESSSession(ws *websocket.Conn, info *sessionInfo, limiter *tokenBucket) {
+	clientAddr, sessionID := info.ClientAddr, info.ID
 	var (
 		remoteConn net.Conn
 		mu         sync.Mutex
@@ -194,60 +676,48 @@ func handleVLESSSession(ws *websocket.Conn, clientAddr string) {
 			remoteConn = nil
 		}
 		ws.Close()
-		log.Printf("[INFO] Connection closed: %s", clientAddr)
+		logInfo("Connection closed: %s (session %s)", clientAddr, sessionID)
 	}
 	defer cleanup()
 
 	// 设置 ping/pong 保活
-	ws.SetReadDeadline(time.Now().Add(60 * time.Second))
-	ws.SetPongHandler(func(string) error {
-		ws.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
-
-	// 定期发送 ping
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-		for {
-			<-ticker.C
-			mu.Lock()
-			if closed {
-				mu.Unlock()
-				return
-			}
-			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
-				mu.Unlock()
-				return
-			}
-			mu.Unlock()
-		}
-	}()
+	stopKeepalive := startKeepalive(ws, &mu, &closed)
+	defer stopKeepalive()
 
 	// 读取第一个消息（VLESS 请求头）
 	_, headerData, err := ws.ReadMessage()
 	if err != nil {
-		log.Printf("[ERROR] Failed to read VLESS header: %v", err)
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			// 客户端健康检查建立连接后不发送请求即正常关闭
+			logInfo("Connection closed before VLESS header: %s", clientAddr)
+		} else {
+			logError("Failed to read VLESS header: %v", err)
+		}
+		info.closeWith(closeReason("client", err))
 		return
 	}
 
 	// 解析 VLESS 请求
 	targetAddr, command, payload, err := parseVLESSRequest(headerData)
 	if err != nil {
-		log.Printf("[ERROR] Invalid VLESS request from %s: %v", clientAddr, err)
+		logError("Invalid VLESS request from %s: %v", clientAddr, err)
+		info.closeWith("invalid request")
 		return
 	}
 
+	sessions.setTarget(sessionID, targetAddr)
+
 	if command != cmdTCP {
-		log.Printf("[WARN] Unsupported command: %d", command)
+		logWarn("Unsupported command: %d", command)
+		info.closeWith(fmt.Sprintf("unsupported command %d", command))
 		return
 	}
 
 	// 连接目标服务器
-	dialer := net.Dialer{Timeout: 10 * time.Second}
-	conn, err := dialer.Dial("tcp", targetAddr)
+	conn, err := dialTarget(targetAddr)
 	if err != nil {
-		log.Printf("[ERROR] Failed to connect to %s: %v", targetAddr, err)
+		logError("Failed to connect to %s: %v", targetAddr, err)
+		info.closeWith("connect failed: " + err.Error())
 		return
 	}
 
@@ -255,7 +725,7 @@ func handleVLESSSession(ws *websocket.Conn, clientAddr string) {
 	remoteConn = conn
 	mu.Unlock()
 
-	log.Printf("[INFO] Connected to remote: %s", targetAddr)
+	logInfo("Connected to remote: %s", targetAddr)
 
 	// 发送 VLESS 响应头
 	responseHeader := []byte{vlessVersion, 0} // version + addon length (0)
@@ -263,15 +733,19 @@ func handleVLESSSession(ws *websocket.Conn, clientAddr string) {
 	err = ws.WriteMessage(websocket.BinaryMessage, responseHeader)
 	mu.Unlock()
 	if err != nil {
-		log.Printf("[ERROR] Failed to send VLESS response: %v", err)
+		logError("Failed to send VLESS response: %v", err)
+		info.closeWith(closeReason("client", err))
 		return
 	}
 
 	// 如果有 payload，先发送到目标服务器
 	if len(payload) > 0 {
 		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		if _, err := conn.Write(payload); err != nil {
-			log.Printf("[ERROR] Failed to write payload: %v", err)
+		n, err := conn.Write(payload)
+		info.addUp(int64(n))
+		if err != nil {
+			logError("Failed to write payload: %v", err)
+			info.closeWith(closeReason("remote", err))
 			return
 		}
 		conn.SetWriteDeadline(time.Time{})
@@ -284,13 +758,18 @@ func handleVLESSSession(ws *websocket.Conn, clientAddr string) {
 
 	// Remote -> WebSocket
 	go func() {
-		buf := make([]byte, 32*1024)
+		buf := getRelayBuffer()
+		defer putRelayBuffer(buf)
 		for {
-			n, err := conn.Read(buf)
+			n, err := conn.Read(buf[:])
 			if err != nil {
+				info.closeWith(closeReason("remote", err))
 				closeDone()
 				return
 			}
+			if !limiter.wait(n, done) {
+				return
+			}
 			mu.Lock()
 			if closed {
 				mu.Unlock()
@@ -300,30 +779,39 @@ func handleVLESSSession(ws *websocket.Conn, clientAddr string) {
 			err = ws.WriteMessage(websocket.BinaryMessage, buf[:n])
 			mu.Unlock()
 			if err != nil {
+				info.closeWith(closeReason("client", err))
 				closeDone()
 				return
 			}
+			info.addDown(int64(n))
 		}
 	}()
 
 	// WebSocket -> Remote
 	go func() {
+		var readBuf bytes.Buffer
 		for {
-			_, data, err := ws.ReadMessage()
+			_, data, err := protocol.ReadMessage(ws, &readBuf)
 			if err != nil {
+				info.closeWith(closeReason("client", err))
 				closeDone()
 				return
 			}
-			ws.SetReadDeadline(time.Now().Add(60 * time.Second))
+			ws.SetReadDeadline(time.Now().Add(pongWait))
+			if !limiter.wait(len(data), done) {
+				return
+			}
 			mu.Lock()
 			if closed || remoteConn == nil {
 				mu.Unlock()
 				closeDone()
 				return
 			}
-			_, err = remoteConn.Write(data)
+			n, err := remoteConn.Write(data)
 			mu.Unlock()
+			info.addUp(int64(n))
 			if err != nil {
+				info.closeWith(closeReason("remote", err))
 				closeDone()
 				return
 			}
@@ -331,7 +819,8 @@ func handleVLESSSession(ws *websocket.Conn, clientAddr string) {
 	}()
 
 	<-done
-	log.Printf("[INFO] Session ended: %s -> %s", clientAddr, targetAddr)
+	logInfo("Session ended: %s -> %s (session %s, up %d, down %d, %s)",
+		clientAddr, targetAddr, sessionID, info.BytesUp.Load(), info.BytesDown.Load(), info.reason())
 }
 
 // parseVLESSRequest 解析 VLESS 请求
@@ -409,7 +898,7 @@ func parseVLESSRequest(data []byte) (addr string, command byte, payload []byte,
 		return "", 0, nil, fmt.Errorf("unsupported address type: %d", addrType)
 	}
 
-	addr = fmt.Sprintf("%s:%d", host, port)
+	addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
 
 	// 剩余数据作为 payload
 	if offset < len(data) {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// relayMetrics 进程启动以来的累计计数，由 /metrics 以 Prometheus 文本格式输出
+type relayMetrics struct {
+	sessionsTotal    atomic.Int64
+	bytesUp          atomic.Int64 // 客户端 -> 目标
+	bytesDown        atomic.Int64 // 目标 -> 客户端
+	upgradeFailures  atomic.Int64
+	unauthorized     atomic.Int64 // 令牌错误被拒绝的 WebSocket 请求
+	connLimitRejects atomic.Int64 // 超过 -maxconns 被拒绝的 WebSocket 请求
+	dialFailures     atomic.Int64 // 被访问控制拒绝或连接失败的目标
+}
+
+var metrics relayMetrics
+
+// metricsToken 访问 /metrics 的令牌，为空时使用 serverToken
+var metricsToken string
+
+// metricsAuthorized 校验 Authorization: Bearer <令牌> 或 ?token=<令牌>
+func metricsAuthorized(r *http.Request) bool {
+	want := metricsToken
+	if want == "" {
+		want = serverToken()
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		got = r.URL.Query().Get("token")
+	}
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// metricsHandler 输出 Prometheus 文本格式的指标
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b strings.Builder
+	metric := func(name, typ, help string, samples ...string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, sample := range samples {
+			fmt.Fprintf(&b, "%s%s\n", name, sample)
+		}
+	}
+	metric("echplus_sessions_active", "gauge", "WebSocket sessions currently open.",
+		fmt.Sprintf(" %d", sessions.count()))
+	metric("echplus_sessions_total", "counter", "WebSocket sessions accepted since start.",
+		fmt.Sprintf(" %d", metrics.sessionsTotal.Load()))
+	metric("echplus_relay_bytes_total", "counter", "Payload bytes relayed between clients and targets.",
+		fmt.Sprintf(`{direction="up"} %d`, metrics.bytesUp.Load()),
+		fmt.Sprintf(`{direction="down"} %d`, metrics.bytesDown.Load()))
+	metric("echplus_upgrade_failures_total", "counter", "WebSocket upgrade attempts that failed.",
+		fmt.Sprintf(" %d", metrics.upgradeFailures.Load()))
+	metric("echplus_rejected_total", "counter", "WebSocket requests rejected before upgrade.",
+		fmt.Sprintf(`{reason="unauthorized"} %d`, metrics.unauthorized.Load()),
+		fmt.Sprintf(`{reason="connection_limit"} %d`, metrics.connLimitRejects.Load()))
+	metric("echplus_dial_failures_total", "counter", "Target connections denied by -allow/-deny or that failed.",
+		fmt.Sprintf(" %d", metrics.dialFailures.Load()))
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 限速维度
+const (
+	rateKeyToken = "token" // 按令牌（VLESS 按 UUID）共享
+	rateKeyIP    = "ip"    // 按客户端 IP 共享
+)
+
+// tokenBucket 令牌桶限速器，容量为一秒的流量。同一令牌的所有会话共享一个桶，
+// 多开会话无法绕过限速；超出速率时阻塞等待而不是断开连接
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/s
+	tokens float64
+	last   time.Time
+	refs   int
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait 消耗 n 字节的令牌，不足时等待补充；done 关闭时提前返回 false。
+// nil 表示不限速
+func (b *tokenBucket) wait(n int, done <-chan struct{}) bool {
+	if b == nil || n <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	// 先预留令牌（可以为负），等待时间按欠额计算，避免并发会话互相饿死
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// rateLimiterRegistry 按限速键共享令牌桶，最后一个会话结束时释放
+type rateLimiterRegistry struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var rateLimiters = &rateLimiterRegistry{buckets: make(map[string]*tokenBucket)}
+
+// acquire 获取 key 对应的令牌桶，未启用限速时返回 nil。调用方结束后需调用 release
+func (r *rateLimiterRegistry) acquire(key string) *tokenBucket {
+	if rateLimit <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		b = newTokenBucket(rateLimit)
+		r.buckets[key] = b
+	}
+	b.refs++
+	return b
+}
+
+// release 释放 acquire 获取的令牌桶
+func (r *rateLimiterRegistry) release(key string, b *tokenBucket) {
+	if b == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b.refs--
+	if b.refs <= 0 && r.buckets[key] == b {
+		delete(r.buckets, key)
+	}
+}
+
+// rateLimitKey 计算会话的限速键，credential 为令牌或 VLESS 标识
+func rateLimitKey(r *http.Request, credential string) string {
+	if rateKey == rateKeyIP {
+		return "ip:" + clientIP(r)
+	}
+	return "token:" + credential
+}
+
+// trustedProxies -trusted-proxies 解析出的网段，只有来自这些地址的请求才使用 CF-Connecting-IP
+var trustedProxies []*net.IPNet
+
+// validRateKey 检查 -rate-key 的取值
+func validRateKey(key string) error {
+	if key != rateKeyToken && key != rateKeyIP {
+		return fmt.Errorf("must be %q or %q", rateKeyToken, rateKeyIP)
+	}
+	return nil
+}
+
+// parseTrustedProxies 解析逗号分隔的 CIDR 或 IP，单个 IP 视为只含该地址的网段
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for entry := range strings.SplitSeq(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR or IP %q", entry)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// clientIP 获取客户端 IP。连接来自 -trusted-proxies（如本机的 cloudflared）时使用 CF-Connecting-IP，
+// 其他来源的该头部由客户端任意填写，不予采信，否则按 IP 限速可以每次换一个值绕过
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if peer := net.ParseIP(host); peer != nil {
+		for _, network := range trustedProxies {
+			if !network.Contains(peer) {
+				continue
+			}
+			if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); ip != nil {
+				return ip.String()
+			}
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRateLimitKeyIP 按 IP 限速时只采信 -trusted-proxies 转发的 CF-Connecting-IP，
+// 其他客户端无法通过改写该头部换一个令牌桶；-rate-key 只接受 token 和 ip
+func TestRateLimitKeyIP(t *testing.T) {
+	oldKey, oldTrusted := rateKey, trustedProxies
+	t.Cleanup(func() { rateKey, trustedProxies = oldKey, oldTrusted })
+	rateKey = rateKeyIP
+	var err error
+	if trustedProxies, err = parseTrustedProxies("127.0.0.1, 10.1.0.0/16,::1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remote, header, want string
+	}{
+		{"198.51.100.7:4000", "", "ip:198.51.100.7"},
+		{"198.51.100.7:4000", "203.0.113.1", "ip:198.51.100.7"},
+		{"127.0.0.1:4000", "203.0.113.1", "ip:203.0.113.1"},
+		{"[::1]:4000", "2001:db8::1", "ip:2001:db8::1"},
+		{"10.1.2.3:4000", "203.0.113.2", "ip:203.0.113.2"},
+		{"10.2.0.1:4000", "203.0.113.2", "ip:10.2.0.1"},
+		{"127.0.0.1:4000", "not-an-ip", "ip:127.0.0.1"},
+		{"127.0.0.1:4000", "", "ip:127.0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.header != "" {
+			r.Header.Set("CF-Connecting-IP", tc.header)
+		}
+		if got := rateLimitKey(r, "token"); got != tc.want {
+			t.Errorf("rateLimitKey(%s, CF-Connecting-IP %q) = %q, want %q", tc.remote, tc.header, got, tc.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parseTrustedProxies accepted an invalid CIDR")
+	}
+	for key, valid := range map[string]bool{"token": true, "ip": true, "": false, "tokne": false} {
+		if err := validRateKey(key); (err == nil) != valid {
+			t.Errorf("validRateKey(%q) = %v, want valid %v", key, err, valid)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// 可恢复会话参数，resumeGrace 为 0 时不接受 protocol.ResumeSubprotocol。
+// 异常断开时服务端保留目标连接 resumeGrace，期间暂停读取目标，超时仍未恢复则关闭；
+// 重发缓冲区已不包含对方缺失的数据时恢复失败
+var (
+	resumeGrace  time.Duration
+	resumeBuffer int64
+)
+
+// resumeWait 恢复时等待旧连接读循环退出的时间
+const resumeWait = 5 * time.Second
+
+// replayBuffer 环形缓冲区，保留最近发送的数据，恢复会话后重发对方未收到的部分
+type replayBuffer struct {
+	data  []byte
+	start int   // 最早一个字节在 data 中的位置
+	n     int   // 缓冲的字节数
+	total int64 // 累计写入的字节数
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{data: make([]byte, max(size, 1))}
+}
+
+// write 追加数据，超出容量时丢弃最早的数据
+func (b *replayBuffer) write(p []byte) {
+	b.total += int64(len(p))
+	size := len(b.data)
+	if len(p) >= size {
+		copy(b.data, p[len(p)-size:])
+		b.start, b.n = 0, size
+		return
+	}
+	end := (b.start + b.n) % size
+	c := copy(b.data[end:], p)
+	copy(b.data, p[c:])
+	b.n += len(p)
+	if b.n > size {
+		b.start = (b.start + b.n - size) % size
+		b.n = size
+	}
+}
+
+// since 返回从累计偏移 offset 起的数据，缓冲区已不包含该位置时返回 false
+func (b *replayBuffer) since(offset int64) ([]byte, bool) {
+	oldest := b.total - int64(b.n)
+	if offset < oldest || offset > b.total {
+		return nil, false
+	}
+	skip := int(offset - oldest)
+	out := make([]byte, b.n-skip)
+	from := (b.start + skip) % len(b.data)
+	c := copy(out, b.data[from:])
+	copy(out[c:], b.data)
+	return out, true
+}
+
+// encodeOffset、decodeOffset RESUME/RESUMED 帧中的字节数
+func encodeOffset(n int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(n))
+}
+
+func decodeOffset(p []byte) (int64, error) {
+	if len(p) != 8 {
+		return 0, fmt.Errorf("invalid offset length %d", len(p))
+	}
+	return int64(binary.BigEndian.Uint64(p)), nil
+}
+
+// resumableRegistry 等待或可以恢复的会话，按恢复令牌索引
+type resumableRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*resumableSession
+}
+
+var resumables = &resumableRegistry{sessions: make(map[string]*resumableSession)}
+
+func (r *resumableRegistry) add(rs *resumableSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[rs.token] = rs
+}
+
+func (r *resumableRegistry) get(token string) *resumableSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[token]
+}
+
+func (r *resumableRegistry) remove(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, token)
+}
+
+// newResumeToken 生成恢复令牌
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// resumableSession 可恢复会话。目标连接的生命周期与 WebSocket 分离，
+// 由 pump 单独转发目标数据，每个 WebSocket 连接由 serve 读取客户端数据。
+// 会话接管第一个连接的 lease，断开期间仍占用连接名额，恢复后的连接共用其令牌桶
+type resumableSession struct {
+	token    string
+	target   string
+	remote   net.Conn
+	lease    *sessionLease // 会话结束时释放
+	limiter  *tokenBucket
+	codec    protocol.Codec
+	done     chan struct{} // 会话结束时关闭
+	received atomic.Int64  // 从客户端收到并写入目标的数据字节数
+
+	mu         sync.Mutex      // 保护 ws 写入及以下字段
+	ws         *websocket.Conn // 当前连接，nil 表示已断开、等待恢复
+	info       *sessionInfo    // 当前连接的会话信息
+	closed     *bool           // 当前连接的关闭标记，供保活使用
+	attached   chan struct{}   // 断开后重新连接时关闭
+	readerDone chan struct{}   // 当前连接的读循环退出时关闭
+	grace      *time.Timer
+	sent       *replayBuffer // 发往客户端的数据
+	remoteEOF  bool          // 目标已关闭，恢复后需重发 CLOSE
+	ended      bool
+}
+
+// attachLocked 切换到新连接，调用方持有 mu
+func (rs *resumableSession) attachLocked(ws *websocket.Conn, info *sessionInfo) {
+	rs.ws, rs.info = ws, info
+	rs.closed = new(bool)
+	rs.readerDone = make(chan struct{})
+	if rs.grace != nil {
+		rs.grace.Stop()
+		rs.grace = nil
+	}
+	close(rs.attached)
+}
+
+// detachLocked 连接 ws 异常断开，保留目标连接等待恢复，调用方持有 mu
+func (rs *resumableSession) detachLocked(ws *websocket.Conn, reason string) {
+	if rs.ended || rs.ws != ws {
+		return
+	}
+	*rs.closed = true
+	ws.Close()
+	rs.info.closeWith("detached: " + reason)
+	rs.ws, rs.info = nil, nil
+	rs.attached = make(chan struct{})
+	rs.grace = time.AfterFunc(resumeGrace, func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		if rs.ws == nil {
+			rs.endLocked("resume timeout")
+		}
+	})
+	logInfo("Session to %s detached (%s), holding for %v", rs.target, reason, resumeGrace)
+}
+
+// end 结束会话，关闭目标连接和当前连接
+func (rs *resumableSession) end(reason string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.endLocked(reason)
+}
+
+func (rs *resumableSession) endLocked(reason string) {
+	if rs.ended {
+		return
+	}
+	rs.ended = true
+	close(rs.done)
+	rs.remote.Close()
+	if rs.grace != nil {
+		rs.grace.Stop()
+	}
+	if rs.ws != nil {
+		*rs.closed = true
+		rs.info.closeWith(reason)
+		rs.ws.Close()
+	}
+	resumables.remove(rs.token)
+	rs.lease.release()
+	logInfo("Resumable session to %s ended: %s", rs.target, reason)
+}
+
+// writeLocked 向当前连接写帧，调用方持有 mu
+func (rs *resumableSession) writeLocked(f protocol.Frame) error {
+	if rs.ws == nil {
+		return net.ErrClosed
+	}
+	return protocol.WriteMessage(rs.ws, rs.codec, f)
+}
+
+// waitAttached 等待连接可用，会话结束时返回 false
+func (rs *resumableSession) waitAttached() bool {
+	rs.mu.Lock()
+	attached := rs.attached
+	rs.mu.Unlock()
+	select {
+	case <-attached:
+		return true
+	case <-rs.done:
+		return false
+	}
+}
+
+// pump 将目标数据记入重发缓冲区并转发到当前连接，断开期间暂停读取目标
+func (rs *resumableSession) pump() {
+	buf := getRelayBuffer()
+	defer putRelayBuffer(buf)
+	for rs.waitAttached() {
+		n, err := rs.remote.Read(buf[:])
+		if n > 0 {
+			if !rs.limiter.wait(n, rs.done) {
+				return
+			}
+			rs.mu.Lock()
+			rs.sent.write(buf[:n])
+			if ws := rs.ws; ws != nil {
+				if werr := rs.writeLocked(protocol.Frame{Op: protocol.OpData, Payload: buf[:n]}); werr != nil {
+					rs.detachLocked(ws, closeReason("client", werr))
+				} else {
+					rs.info.addDown(int64(n))
+				}
+			}
+			rs.mu.Unlock()
+		}
+		if err != nil {
+			rs.mu.Lock()
+			rs.remoteEOF = true
+			if ws := rs.ws; ws != nil {
+				rs.info.closeWith(closeReason("remote", err))
+				if werr := rs.writeLocked(protocol.Frame{Op: protocol.OpClose}); werr != nil {
+					rs.detachLocked(ws, closeReason("client", werr))
+				}
+			}
+			rs.mu.Unlock()
+			return
+		}
+	}
+}
+
+// serve 读取连接 ws 上的客户端数据并写入目标，连接断开或会话结束时返回
+func (rs *resumableSession) serve(ws *websocket.Conn, info *sessionInfo, closed *bool, readerDone chan struct{}) {
+	defer close(readerDone)
+	stopKeepalive := startKeepalive(ws, &rs.mu, closed)
+	defer stopKeepalive()
+
+	var readBuf bytes.Buffer
+	for {
+		mt, data, err := protocol.ReadMessage(ws, &readBuf)
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				rs.end(closeReason("client", err))
+				return
+			}
+			rs.mu.Lock()
+			rs.detachLocked(ws, closeReason("client", err))
+			rs.mu.Unlock()
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		f, err := rs.codec.Decode(mt, data)
+		if err != nil {
+			logError("Invalid frame from %s: %v (session %s)", info.ClientAddr, err, info.ID)
+			rs.end("invalid frame")
+			return
+		}
+		switch f.Op {
+		case protocol.OpData:
+			if !rs.limiter.wait(len(f.Payload), rs.done) {
+				return
+			}
+			n, err := rs.remote.Write(f.Payload)
+			rs.received.Add(int64(n))
+			info.addUp(int64(n))
+			if err != nil {
+				rs.end(closeReason("remote", err))
+				return
+			}
+		case protocol.OpClose:
+			// 客户端数据已发送完毕：半关闭目标写方向，继续回传剩余数据
+			if cw, ok := rs.remote.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				continue
+			}
+			rs.end("client closed")
+			return
+		}
+	}
+}
+
+// handleResumableSession 处理协商了 protocol.ResumeSubprotocol 的 echPlus 客户端会话，
+// 第一帧为 CONNECT 时建立新会话，为 RESUME 时恢复已断开的会话
+func handleResumableSession(ws *websocket.Conn, info *sessionInfo, lease *sessionLease) {
+	defer ws.Close()
+	codec := protocol.CodecForSubprotocol(ws.Subprotocol())
+	writeError := func(reason string) {
+		if mt, data, err := codec.Encode(protocol.Frame{Op: protocol.OpError, Payload: []byte(reason)}); err == nil {
+			ws.WriteMessage(mt, data)
+		}
+	}
+
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	mt, msg, err := ws.ReadMessage()
+	if err != nil {
+		logError("Failed to read CONNECT message: %v", err)
+		info.closeWith(closeReason("client", err))
+		return
+	}
+	f, err := codec.Decode(mt, msg)
+	if err != nil {
+		logError("Invalid CONNECT from %s: %v", info.ClientAddr, err)
+		info.closeWith("invalid connect")
+		writeError(err.Error())
+		return
+	}
+	switch f.Op {
+	case protocol.OpConnect:
+		startResumableSession(ws, info, lease, codec, f, writeError)
+	case protocol.OpResume:
+		resumeSession(ws, info, lease, f, writeError)
+	case protocol.OpBind:
+		// 对端连入的连接不可恢复，按普通会话处理
+		handleSession(ws, info, codec, lease.limiter, &f)
+	default:
+		logError("Invalid first frame from %s: opcode 0x%02x", info.ClientAddr, f.Op)
+		info.closeWith("invalid connect")
+		writeError("expected CONNECT or RESUME")
+	}
+}
+
+// startResumableSession 连接目标，返回带恢复令牌的 CONNECTED 后开始转发。连接目标成功后会话接管 lease
+func startResumableSession(ws *websocket.Conn, info *sessionInfo, lease *sessionLease, codec protocol.Codec, connect protocol.Frame, writeError func(string)) {
+	target := connect.Target
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		logError("Invalid CONNECT from %s: %v", info.ClientAddr, err)
+		info.closeWith("invalid connect")
+		writeError(fmt.Sprintf("invalid target %q", target))
+		return
+	}
+	sessions.setTarget(info.ID, target)
+
+	remote, err := connectToRemote(target, connect.Payload)
+	if err != nil {
+		logError("Failed to connect to %s: %v", target, err)
+		info.closeWith("connect failed: " + err.Error())
+		writeError(err.Error())
+		return
+	}
+	info.addUp(int64(len(connect.Payload)))
+
+	rs := &resumableSession{
+		token:    newResumeToken(),
+		target:   target,
+		remote:   remote,
+		lease:    lease.take(),
+		limiter:  lease.limiter,
+		codec:    codec,
+		done:     make(chan struct{}),
+		attached: make(chan struct{}),
+		sent:     newReplayBuffer(int(resumeBuffer)),
+	}
+	resumables.add(rs)
+
+	rs.mu.Lock()
+	rs.attachLocked(ws, info)
+	closed, readerDone := rs.closed, rs.readerDone
+	err = rs.writeLocked(protocol.Frame{Op: protocol.OpConnected, Payload: []byte(rs.token)})
+	rs.mu.Unlock()
+	if err != nil {
+		logError("Failed to send CONNECTED: %v", err)
+		rs.end(closeReason("client", err))
+		return
+	}
+	logInfo("Connected to remote: %s (session %s, resumable)", target, info.ID)
+
+	go rs.pump()
+	rs.serve(ws, info, closed, readerDone)
+}
+
+// resumeSession 将新连接接入令牌对应的会话，重发客户端未收到的数据后继续转发。
+// 接入后连接由会话的名额和令牌桶覆盖，立即释放 lease
+func resumeSession(ws *websocket.Conn, info *sessionInfo, lease *sessionLease, resume protocol.Frame, writeError func(string)) {
+	fail := func(reason string) {
+		logWarn("Resume from %s failed: %s (session %s)", info.ClientAddr, reason, info.ID)
+		info.closeWith("resume failed: " + reason)
+		writeError("resume failed: " + reason)
+	}
+	rs := resumables.get(resume.Target)
+	clientReceived, err := decodeOffset(resume.Payload)
+	if rs == nil || err != nil {
+		fail("unknown session")
+		return
+	}
+	sessions.setTarget(info.ID, rs.target)
+
+	// 客户端可能先于服务端发现断开，此时旧连接仍在读取；关闭后等待其读循环退出，保证已收到的字节数准确
+	rs.mu.Lock()
+	if rs.ws != nil {
+		rs.detachLocked(rs.ws, "superseded by resume")
+	}
+	readerDone := rs.readerDone
+	rs.mu.Unlock()
+	select {
+	case <-readerDone:
+	case <-rs.done:
+		fail("session closed")
+		return
+	case <-time.After(resumeWait):
+		fail("previous connection still busy")
+		return
+	}
+
+	rs.mu.Lock()
+	if rs.ended || rs.ws != nil {
+		rs.mu.Unlock()
+		fail("session closed")
+		return
+	}
+	replay, ok := rs.sent.since(clientReceived)
+	if !ok {
+		rs.endLocked("resume failed: replay buffer exceeded")
+		rs.mu.Unlock()
+		fail("replay buffer exceeded")
+		return
+	}
+	rs.attachLocked(ws, info)
+	lease.release()
+	closed, readerDone := rs.closed, rs.readerDone
+	err = rs.writeLocked(protocol.Frame{Op: protocol.OpResumed, Payload: encodeOffset(rs.received.Load())})
+	for sent := 0; err == nil && sent < len(replay); {
+		chunk := replay[sent:min(sent+32*1024, len(replay))]
+		if err = rs.writeLocked(protocol.Frame{Op: protocol.OpData, Payload: chunk}); err == nil {
+			sent += len(chunk)
+			info.addDown(int64(len(chunk)))
+		}
+	}
+	if err == nil && rs.remoteEOF {
+		err = rs.writeLocked(protocol.Frame{Op: protocol.OpClose})
+	}
+	if err != nil {
+		rs.detachLocked(ws, closeReason("client", err))
+	}
+	rs.mu.Unlock()
+	if err != nil {
+		return
+	}
+	logInfo("Session resumed: %s -> %s (session %s, replayed %d bytes)", info.ClientAddr, rs.target, info.ID, len(replay))
+
+	rs.serve(ws, info, closed, readerDone)
+}
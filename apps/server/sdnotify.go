@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemd 通知状态，见 sd_notify(3)
+const (
+	sdReady    = "READY=1"
+	sdStopping = "STOPPING=1"
+	sdWatchdog = "WATCHDOG=1"
+)
+
+// sdNotify 通过 NOTIFY_SOCKET 向 systemd 发送状态，未在 Type=notify 服务中运行时不做任何事。
+// 返回是否已发送
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// 以 @ 开头的是抽象命名空间套接字，net 包会自动处理
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// watchdogInterval 返回发送 WATCHDOG=1 的间隔（WatchdogSec 的一半），未启用看门狗时返回 0
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog 定期执行健康自检，通过后发送 WATCHDOG=1；
+// 自检失败时不发送，由 systemd 在超时后重启服务
+func runWatchdog(ctx context.Context, interval time.Duration, check func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := check(); err != nil {
+				logWarn("Watchdog self-check failed: %v", err)
+				continue
+			}
+			if _, err := sdNotify(sdWatchdog); err != nil {
+				logWarn("Failed to notify systemd watchdog: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// healthCheck 通过本机回环请求 /health，确认监听和请求处理仍在工作
+func healthCheck(addr string, timeout time.Duration) func() error {
+	client := &http.Client{Timeout: timeout}
+	return func() error {
+		resp, err := client.Get("http://" + addr + "/health")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("health check returned %s", resp.Status)
+		}
+		return nil
+	}
+}
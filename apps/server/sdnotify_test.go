@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket 启动模拟 systemd 的 NOTIFY_SOCKET 并设置环境变量
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	// unix 套接字路径长度有限，不使用较长的 t.TempDir()
+	dir, err := os.MkdirTemp("", "sd")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen notify socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotify 读取一条通知
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read notify: %v", err)
+	}
+	return string(buf[:n])
+}
+
+// TestSdNotify 设置 NOTIFY_SOCKET 时发送状态，未设置时不做任何事
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := sdNotify(sdReady); sent || err != nil {
+		t.Fatalf("sdNotify without NOTIFY_SOCKET = %v %v, want no-op", sent, err)
+	}
+
+	conn := listenNotifySocket(t)
+	for _, state := range []string{sdReady, sdStopping} {
+		if sent, err := sdNotify(state); !sent || err != nil {
+			t.Fatalf("sdNotify(%q) = %v %v", state, sent, err)
+		}
+		if got := readNotify(t, conn); got != state {
+			t.Fatalf("notify = %q, want %q", got, state)
+		}
+	}
+}
+
+// TestWatchdogInterval 间隔为 WATCHDOG_USEC 的一半，WATCHDOG_PID 不是本进程时不启用
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := watchdogInterval(); got != 0 {
+		t.Fatalf("interval without WATCHDOG_USEC = %v, want 0", got)
+	}
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := watchdogInterval(); got != time.Second {
+		t.Fatalf("interval = %v, want 1s", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := watchdogInterval(); got != 0 {
+		t.Fatalf("interval for another pid = %v, want 0", got)
+	}
+}
+
+// TestWatchdogSelfCheck 自检通过时才发送 WATCHDOG=1
+func TestWatchdogSelfCheck(t *testing.T) {
+	conn := listenNotifySocket(t)
+	health := httptest.NewServer(http.HandlerFunc(healthHandler))
+	defer health.Close()
+
+	var healthy atomic.Bool
+	check := healthCheck(strings.TrimPrefix(health.URL, "http://"), time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runWatchdog(ctx, 20*time.Millisecond, func() error {
+		if !healthy.Load() {
+			return errors.New("unhealthy")
+		}
+		return check()
+	})
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatal("watchdog notified while self-check failing")
+	}
+	healthy.Store(true)
+	if got := readNotify(t, conn); got != sdWatchdog {
+		t.Fatalf("notify = %q, want %q", got, sdWatchdog)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// 凭据文件参数：命令行参数会出现在 ps 和 shell 历史中，凭据可以改为从文件读取
+var (
+	tokenFile           string
+	metricsTokenFile    string
+	collectorTokensFile string
+)
+
+// secretFlag 可以从 -<name>-file 指定的文件读取值的凭据参数。新增凭据参数时加入 secretFlags
+type secretFlag struct {
+	name  string
+	env   string // 同样不出现在命令行中的环境变量
+	value *string
+	file  *string
+}
+
+var secretFlags = []secretFlag{
+	{"token", "TOKEN", &authToken, &tokenFile},
+	{"metrics-token", "METRICS_TOKEN", &metricsToken, &metricsTokenFile},
+	{"collector-tokens", "COLLECTOR_TOKENS", &collectorTokens, &collectorTokensFile},
+}
+
+// loadSecretFiles 从设置了 -<name>-file 的文件读取凭据，set 为命令行上给出的参数名。
+// 返回直接在命令行上给出值的凭据参数，供调用方提示改用文件或环境变量
+func loadSecretFiles(set map[string]bool) (plain []secretFlag, err error) {
+	for _, f := range secretFlags {
+		if *f.file == "" {
+			if set[f.name] {
+				plain = append(plain, f)
+			}
+			continue
+		}
+		if set[f.name] {
+			return nil, fmt.Errorf("-%s and -%s-file are mutually exclusive", f.name, f.name)
+		}
+		if *f.value, err = readSecretFile(*f.file); err != nil {
+			return nil, fmt.Errorf("-%s-file: %w", f.name, err)
+		}
+	}
+	return plain, nil
+}
+
+// readSecretFile 读取凭据文件，去掉首尾空白（如末尾换行）。文件不能为空，也不能对其他用户可读
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	// Windows 的权限位不反映实际访问控制
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&0o004 != 0 {
+		return "", fmt.Errorf("%s is readable by all users (mode %04o); restrict it, e.g. chmod 600", path, perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", errors.New(path + " is empty")
+	}
+	return secret, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSecretFiles 凭据可以从文件读取：文件不能对所有用户可读，也不能与同名参数同时给出；命令行上直接给出的凭据被报告
+func TestSecretFiles(t *testing.T) {
+	prevToken, prevMetrics, prevCollector := authToken, metricsToken, collectorTokens
+	t.Cleanup(func() {
+		authToken, metricsToken, collectorTokens = prevToken, prevMetrics, prevCollector
+		tokenFile, metricsTokenFile, collectorTokensFile = "", "", ""
+	})
+	dir := t.TempDir()
+	write := func(name, content string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	authToken, metricsToken = "from-flag", "from-flag"
+	tokenFile = write("token", "file-token\n", 0o600)
+	plain, err := loadSecretFiles(map[string]bool{"metrics-token": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authToken != "file-token" {
+		t.Fatalf("token = %q, want the trimmed file content", authToken)
+	}
+	if len(plain) != 1 || plain[0].name != "metrics-token" || metricsToken != "from-flag" {
+		t.Fatalf("plain secrets = %+v, metrics token %q; want -metrics-token reported and kept", plain, metricsToken)
+	}
+
+	for _, tc := range []struct {
+		name, path string
+		set        map[string]bool
+		want       string
+	}{
+		{"world-readable", write("open", "secret", 0o644), nil, "readable by all users"},
+		{"empty", write("empty", " \n", 0o600), nil, "is empty"},
+		{"missing", filepath.Join(dir, "missing"), nil, "no such file"},
+		{"directory", dir, nil, "not a regular file"},
+		{"with flag", write("both", "secret", 0o600), map[string]bool{"collector-tokens": true}, "mutually exclusive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tokenFile, collectorTokensFile = "", tc.path
+			if _, err := loadSecretFiles(tc.set); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("load %s: error %v, want %q", tc.path, err, tc.want)
+			}
+		})
+	}
+}
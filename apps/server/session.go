@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/atticus6/echPlus/apps/client/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// dialRemote 连接目标服务器
+var dialRemote = func(network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	return dialer.Dial(network, addr)
+}
+
+// connectToRemote 检查访问控制后连接目标并发送首帧数据
+func connectToRemote(target string, payload []byte) (net.Conn, error) {
+	conn, err := dialTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(payload); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+// handleSession 处理 echPlus 客户端会话，流量和关闭原因记录到 info。
+// first 为调用方已读取的首帧（可恢复会话中的 BIND），为 nil 时从 ws 读取
+func handleSession(ws *websocket.Conn, info *sessionInfo, codec protocol.Codec, limiter *tokenBucket, first *protocol.Frame) {
+	clientAddr, sessionID := info.ClientAddr, info.ID
+	var (
+		mu     sync.Mutex // 保护 ws 写入
+		closed bool
+	)
+	writeFrame := func(f protocol.Frame) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return net.ErrClosed
+		}
+		return protocol.WriteMessage(ws, codec, f)
+	}
+	writeError := func(reason string) {
+		writeFrame(protocol.Frame{Op: protocol.OpError, Payload: []byte(reason)})
+	}
+	defer func() {
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+		ws.Close()
+		logInfo("Connection closed: %s (session %s)", clientAddr, sessionID)
+	}()
+
+	// 设置 ping/pong 保活
+	stopKeepalive := startKeepalive(ws, &mu, &closed)
+	defer stopKeepalive()
+
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	closeDone := func() { closeOnce.Do(func() { close(done) }) }
+	defer closeDone()
+
+	// 读取 CONNECT 或 BIND 控制消息
+	var connect protocol.Frame
+	if first != nil {
+		connect = *first
+	} else {
+		mt, msg, err := ws.ReadMessage()
+		if err != nil {
+			logError("Failed to read CONNECT message: %v", err)
+			info.closeWith(closeReason("client", err))
+			return
+		}
+		if connect, err = codec.Decode(mt, msg); err != nil {
+			logError("Invalid CONNECT from %s: %v", clientAddr, err)
+			info.closeWith("invalid connect")
+			writeError(err.Error())
+			return
+		}
+	}
+	if connect.Op != protocol.OpConnect && connect.Op != protocol.OpBind {
+		logError("Invalid first frame from %s: opcode 0x%02x", clientAddr, connect.Op)
+		info.closeWith("invalid connect")
+		writeError("expected CONNECT")
+		return
+	}
+	target := connect.Target
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		logError("Invalid CONNECT from %s: %v", clientAddr, err)
+		info.closeWith("invalid connect")
+		writeError(fmt.Sprintf("invalid target %q", target))
+		return
+	}
+	sessions.setTarget(sessionID, target)
+
+	var (
+		remote    net.Conn
+		err       error
+		connected = protocol.Frame{Op: protocol.OpConnected}
+	)
+	if connect.Op == protocol.OpBind {
+		remote, err = acceptBind(target, bindAdvertiseHost(ws), func(bound string) error {
+			return writeFrame(protocol.Frame{Op: protocol.OpBound, Target: bound})
+		})
+		if err != nil {
+			logError("BIND for %s failed: %v", target, err)
+			info.closeWith("bind failed: " + err.Error())
+			writeError(err.Error())
+			return
+		}
+		// 等待连入期间未读取 WebSocket，重新开始计算 pong 超时
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		connected.Target = remote.RemoteAddr().String()
+	} else {
+		remote, err = connectToRemote(target, connect.Payload)
+		if err != nil {
+			logError("Failed to connect to %s: %v", target, err)
+			info.closeWith("connect failed: " + err.Error())
+			writeError(err.Error())
+			return
+		}
+	}
+	defer remote.Close()
+	info.addUp(int64(len(connect.Payload)))
+
+	if err := writeFrame(connected); err != nil {
+		logError("Failed to send CONNECTED: %v", err)
+		info.closeWith(closeReason("client", err))
+		return
+	}
+	if connect.Op == protocol.OpBind {
+		logInfo("BIND accepted %s for %s (session %s)", connected.Target, target, sessionID)
+	} else {
+		logInfo("Connected to remote: %s (session %s)", target, sessionID)
+	}
+
+	// Remote -> WebSocket
+	go func() {
+		pumpRemoteToWS(remote, writeFrame, limiter, done, info)
+		closeDone()
+	}()
+
+	// WebSocket -> Remote
+	go func() {
+		defer closeDone()
+		var readBuf bytes.Buffer
+		for {
+			mt, data, err := protocol.ReadMessage(ws, &readBuf)
+			if err != nil {
+				info.closeWith(closeReason("client", err))
+				return
+			}
+			ws.SetReadDeadline(time.Now().Add(pongWait))
+			f, err := codec.Decode(mt, data)
+			if err != nil {
+				logError("Invalid frame from %s: %v (session %s)", clientAddr, err, sessionID)
+				info.closeWith("invalid frame")
+				return
+			}
+			switch f.Op {
+			case protocol.OpData:
+				if !limiter.wait(len(f.Payload), done) {
+					return
+				}
+				n, err := remote.Write(f.Payload)
+				info.addUp(int64(n))
+				if err != nil {
+					info.closeWith(closeReason("remote", err))
+					return
+				}
+			case protocol.OpClose:
+				// 客户端数据已发送完毕：半关闭目标写方向，继续回传剩余数据
+				if cw, ok := remote.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+					continue
+				}
+				info.closeWith("client closed")
+				return
+			}
+		}
+	}()
+
+	<-done
+	logInfo("Session ended: %s -> %s (session %s, up %d, down %d, %s)",
+		clientAddr, target, sessionID, info.BytesUp.Load(), info.BytesDown.Load(), info.reason())
+}
+
+// pumpRemoteToWS 将目标返回的数据转发到 WebSocket，目标关闭后发送 CLOSE。
+// 超出限速时阻塞等待，done 关闭时退出。转发的字节数和关闭原因记录到 info
+func pumpRemoteToWS(remote net.Conn, writeFrame func(protocol.Frame) error, limiter *tokenBucket, done <-chan struct{}, info *sessionInfo) {
+	buf := getRelayBuffer()
+	defer putRelayBuffer(buf)
+	for {
+		n, err := remote.Read(buf[:])
+		if n > 0 {
+			if !limiter.wait(n, done) {
+				return
+			}
+			if werr := writeFrame(protocol.Frame{Op: protocol.OpData, Payload: buf[:n]}); werr != nil {
+				info.closeWith(closeReason("client", werr))
+				return
+			}
+			info.addDown(int64(n))
+		}
+		if err != nil {
+			info.closeWith(closeReason("remote", err))
+			writeFrame(protocol.Frame{Op: protocol.OpClose})
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sessionInfo 活动会话信息
+type sessionInfo struct {
+	ID         string
+	Protocol   string
+	ClientAddr string
+	Target     string
+	StartedAt  time.Time
+
+	BytesUp   atomic.Int64 // 客户端 -> 目标
+	BytesDown atomic.Int64 // 目标 -> 客户端
+
+	reasonOnce  sync.Once
+	closeReason string
+}
+
+// closeWith 记录会话的关闭原因，只保留第一次记录的原因
+func (s *sessionInfo) closeWith(reason string) {
+	s.reasonOnce.Do(func() { s.closeReason = reason })
+}
+
+// reason 返回会话的关闭原因，未记录时为 "closed"，会话结束后调用
+func (s *sessionInfo) reason() string {
+	s.closeWith("closed")
+	return s.closeReason
+}
+
+// addUp、addDown 记录转发的字节数，同时计入 /metrics 的累计值
+func (s *sessionInfo) addUp(n int64) {
+	s.BytesUp.Add(n)
+	metrics.bytesUp.Add(n)
+}
+
+func (s *sessionInfo) addDown(n int64) {
+	s.BytesDown.Add(n)
+	metrics.bytesDown.Add(n)
+}
+
+// accessRecord 生成会话的访问日志记录，会话结束后调用
+func (s *sessionInfo) accessRecord() accessRecord {
+	end := time.Now()
+	return accessRecord{
+		Session:     s.ID,
+		Protocol:    s.Protocol,
+		Client:      s.ClientAddr,
+		Target:      s.Target,
+		Start:       s.StartedAt,
+		End:         end,
+		DurationMs:  end.Sub(s.StartedAt).Milliseconds(),
+		BytesUp:     s.BytesUp.Load(),
+		BytesDown:   s.BytesDown.Load(),
+		CloseReason: s.reason(),
+	}
+}
+
+// sessionRegistry 活动会话登记表，会话 ID 同时通过 X-Session-ID 响应头返回给客户端，
+// 便于将客户端与服务端日志关联
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*sessionInfo
+}
+
+var sessions = &sessionRegistry{sessions: make(map[string]*sessionInfo)}
+
+// newSessionID 生成会话 ID
+func newSessionID() string {
+	return uuid.NewString()
+}
+
+// add 登记会话
+func (r *sessionRegistry) add(id, protocol, clientAddr string) *sessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := &sessionInfo{
+		ID:         id,
+		Protocol:   protocol,
+		ClientAddr: clientAddr,
+		StartedAt:  time.Now(),
+	}
+	r.sessions[id] = info
+	metrics.sessionsTotal.Add(1)
+	return info
+}
+
+// setTarget 记录会话的目标地址
+func (r *sessionRegistry) setTarget(id, target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, ok := r.sessions[id]; ok {
+		info.Target = target
+	}
+}
+
+// remove 注销会话
+func (r *sessionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// count 返回活动会话数
+func (r *sessionRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
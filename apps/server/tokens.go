@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tokenFilePollInterval 检查 -token-file 是否被修改的间隔，收到 SIGHUP 时立即重新加载
+const tokenFilePollInterval = 5 * time.Second
+
+// clientTokens -token-file 中当前接受的客户端令牌，为 nil 时只接受 authToken。
+// 重新加载时整体替换，只影响之后的握手，已建立的会话不受影响
+var clientTokens atomic.Pointer[[]string]
+
+// parseTokens 解析令牌文件：每行一个令牌，忽略空行和 # 开头的注释
+func parseTokens(content string) ([]string, error) {
+	var tokens []string
+	for line := range strings.Lines(content) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || slices.Contains(tokens, line) {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens")
+	}
+	return tokens, nil
+}
+
+// loadClientTokens 按 -token-file 的内容设置接受的令牌，authToken 设为第一个令牌，
+// 供启动时检查是否配置了令牌，运行中的用途以 serverToken 为准
+func loadClientTokens(content string) error {
+	tokens, err := parseTokens(content)
+	if err != nil {
+		return err
+	}
+	authToken = tokens[0]
+	clientTokens.Store(&tokens)
+	return nil
+}
+
+// serverToken 服务端自身使用的令牌（/metrics 的默认令牌、fleet 报告的签名），
+// 使用 -token-file 时为当前文件中的第一个令牌，随重新加载更新，被撤销的令牌不再有效
+func serverToken() string {
+	if p := clientTokens.Load(); p != nil {
+		return (*p)[0]
+	}
+	return authToken
+}
+
+// validClientToken got 是否为接受的客户端令牌（握手子协议、/files/ 的 Bearer 令牌）
+func validClientToken(got string) bool {
+	tokens := []string{authToken}
+	if p := clientTokens.Load(); p != nil {
+		tokens = *p
+	}
+	valid := false
+	for _, token := range tokens {
+		// 逐个比较完，耗时不反映匹配到第几个令牌
+		if token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// reloadTokenFile 重新读取 -token-file，文件无效时保留当前令牌
+func reloadTokenFile() error {
+	content, err := readSecretFile(tokenFile)
+	if err != nil {
+		return err
+	}
+	tokens, err := parseTokens(content)
+	if err != nil {
+		return err
+	}
+	var old []string
+	if p := clientTokens.Swap(&tokens); p != nil {
+		old = *p
+	}
+	added, removed := 0, 0
+	for _, token := range tokens {
+		if !slices.Contains(old, token) {
+			added++
+		}
+	}
+	for _, token := range old {
+		if !slices.Contains(tokens, token) {
+			removed++
+		}
+	}
+	logInfo("Reloaded %s: %d token(s), %d added, %d removed; existing sessions are kept", tokenFile, len(tokens), added, removed)
+	return nil
+}
+
+// watchTokenFile 在 -token-file 的修改时间或大小改变、或从 reload 收到信号时重新加载，直到 ctx 取消。
+// 按路径检查，被替换的文件（如 Kubernetes Secret 更新符号链接）同样生效
+func watchTokenFile(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(tokenFile)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	modTime, size := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		case <-ticker.C:
+			if t, n := stat(); t.Equal(modTime) && n == size {
+				continue
+			}
+		}
+		modTime, size = stat()
+		if err := reloadTokenFile(); err != nil {
+			logWarn("Failed to reload %s, keeping the current tokens: %v", tokenFile, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestParseVLESSRequest 三种地址类型的目标地址都能被 net.SplitHostPort 还原，IPv6 地址带方括号
+func TestParseVLESSRequest(t *testing.T) {
+	userUUID = uuid.New()
+	request := func(atyp byte, addr []byte, payload string) []byte {
+		b := append([]byte{vlessVersion}, userUUID[:]...)
+		b = append(b, 0x00, cmdTCP)
+		b = binary.BigEndian.AppendUint16(b, 443)
+		b = append(b, atyp)
+		b = append(b, addr...)
+		return append(b, payload...)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		addr string
+		host string
+	}{
+		{"ipv4", request(atypIPv4, net.IPv4(192, 0, 2, 1).To4(), "hi"), "192.0.2.1:443", "192.0.2.1"},
+		{"domain", request(atypDomain, append([]byte{11}, "example.com"...), "hi"), "example.com:443", "example.com"},
+		{"ipv6", request(atypIPv6, net.ParseIP("2001:db8::1"), "hi"), "[2001:db8::1]:443", "2001:db8::1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, cmd, payload, err := parseVLESSRequest(tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr != tc.addr || cmd != cmdTCP || string(payload) != "hi" {
+				t.Fatalf("got %q, cmd %d, payload %q", addr, cmd, payload)
+			}
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || host != tc.host || port != "443" {
+				t.Fatalf("SplitHostPort(%q) = %q, %q, %v", addr, host, port, err)
+			}
+		})
+	}
+}